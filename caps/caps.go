@@ -82,3 +82,13 @@ func (f Fulcrum) CanMountAny() bool {
 	}
 	return f.ourCaps.Get(capability.EFFECTIVE, capability.CAP_SYS_ADMIN)
 }
+
+// Whether we have enough caps to set or clear the immutable flag on files.
+// This requires "have CAP_LINUX_IMMUTABLE";
+// or, on mac, is uid==0.
+func (f Fulcrum) CanSetImmutable() bool {
+	if !f.onLinux {
+		return f.ourUID == 0
+	}
+	return f.ourCaps.Get(capability.EFFECTIVE, capability.CAP_LINUX_IMMUTABLE)
+}
@@ -6,18 +6,56 @@ Sniperkit-Bot
 package main
 
 import (
+	"context"
+
 	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/blob"
+	"go.polydawn.net/rio/transmat/chunk"
+	"go.polydawn.net/rio/transmat/cpio"
+	"go.polydawn.net/rio/transmat/deb"
+	"go.polydawn.net/rio/transmat/dockersave"
 	"go.polydawn.net/rio/transmat/git"
+	"go.polydawn.net/rio/transmat/hg"
+	"go.polydawn.net/rio/transmat/iso"
+	"go.polydawn.net/rio/transmat/nar"
+	"go.polydawn.net/rio/transmat/ocilayer"
+	"go.polydawn.net/rio/transmat/plugin"
+	"go.polydawn.net/rio/transmat/rpm"
 	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/zip"
 )
 
 func demuxPackTool(packType string) (rio.PackFunc, error) {
 	switch packType {
 	case "tar":
 		return tartrans.Pack, nil
+	case "zip":
+		return ziptrans.Pack, nil
+	case "oci-layer":
+		return ocilayer.Pack, nil
+	case "cpio":
+		return cpiotrans.Pack, nil
+	case "nar":
+		return nartrans.Pack, nil
+	case "deb":
+		return debtrans.Pack, nil
+	case "docker-save":
+		return dockersavetrans.Pack, nil
+	case "iso":
+		return isotrans.Pack, nil
+	case "rpm":
+		return rpmtrans.Pack, nil
+	case "blob":
+		return blobtrans.Pack, nil
+	case "chunk":
+		return chunktrans.Pack, nil
 	default:
-		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+		if binPath, ok := plugintrans.Lookup(api.PackType(packType)); ok {
+			return plugintrans.PackFunc(binPath), nil
+		}
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q (and no %s%s plugin on the PATH)", packType, plugintrans.BinaryPrefix, packType)
 	}
 }
 
@@ -27,15 +65,70 @@ func demuxUnpackTool(packType string) (rio.UnpackFunc, error) {
 		return tartrans.Unpack, nil
 	case "git":
 		return git.Unpack, nil
+	case "hg":
+		return hg.Unpack, nil
+	case "zip":
+		return ziptrans.Unpack, nil
+	case "oci-layer":
+		return ocilayer.Unpack, nil
+	case "cpio":
+		return cpiotrans.Unpack, nil
+	case "nar":
+		return nartrans.Unpack, nil
+	case "deb":
+		return debtrans.Unpack, nil
+	case "docker-save":
+		return dockersavetrans.Unpack, nil
+	case "iso":
+		return isotrans.Unpack, nil
+	case "rpm":
+		return rpmtrans.Unpack, nil
+	case "blob":
+		return blobtrans.Unpack, nil
+	case "chunk":
+		return chunktrans.Unpack, nil
 	default:
-		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+		if binPath, ok := plugintrans.Lookup(api.PackType(packType)); ok {
+			return plugintrans.UnpackFunc(binPath), nil
+		}
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q (and no %s%s plugin on the PATH)", packType, plugintrans.BinaryPrefix, packType)
+	}
+}
+
+/*
+	An UnpackFunc for wares of any packtype, as the parts of an assembly may be.
+*/
+func unpackAnyTool(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	unpackFunc, err := demuxUnpackTool(string(wareID.Type))
+	if err != nil {
+		if mon.Chan != nil {
+			close(mon.Chan)
+		}
+		return api.WareID{}, err
 	}
+	return unpackFunc(ctx, wareID, path, filt, placementMode, warehouses, mon)
 }
 
 func demuxScanTool(packType string) (rio.ScanFunc, error) {
 	switch packType {
 	case "tar":
 		return tartrans.Scan, nil
+	case "deb":
+		return debtrans.Scan, nil
+	case "docker-save":
+		return dockersavetrans.Scan, nil
+	case "iso":
+		return isotrans.Scan, nil
+	case "rpm":
+		return rpmtrans.Scan, nil
 	default:
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
@@ -49,3 +142,27 @@ func demuxMirrorTool(packType string) (rio.MirrorFunc, error) {
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
 }
+
+func demuxVerifyTool(packType string) (func(context.Context, api.WarehouseAddr, []api.WareID, rio.Monitor) ([]tartrans.WareCheck, error), error) {
+	switch packType {
+	case "tar":
+		return tartrans.VerifyWarehouse, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
+	}
+}
+
+func demuxRepackTool(fromType, toType string) (func(context.Context, api.WareID, tartrans.Compression, int, api.WarehouseAddr, []api.WarehouseAddr, rio.Monitor) (api.WareID, error), error) {
+	switch {
+	case fromType == "tar" && toType == "tar":
+		return tartrans.Repack, nil
+	case fromType == "tar" && toType == "chunk":
+		return func(ctx context.Context, wareID api.WareID, _ tartrans.Compression, _ int, target api.WarehouseAddr, sources []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+			return chunktrans.Repack(ctx, wareID, target, sources, mon)
+		}, nil
+	case fromType == "chunk" && toType == "tar":
+		return chunktrans.RepackAsTar, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "repacking packtype %q as %q is unsupported (unpack it, and pack it again)", fromType, toType)
+	}
+}
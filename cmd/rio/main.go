@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/polydawn/refmt"
@@ -19,9 +20,14 @@ import (
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/stitch"
+	"go.polydawn.net/rio/transmat/git"
+	"go.polydawn.net/rio/transmat/ocilayer"
+	"go.polydawn.net/rio/transmat/tar"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -90,6 +96,11 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Path                string             // Pack target path, abs or rel
 			Filters             api.FilesetFilters // Filters for pack
 			TargetWarehouseAddr string             // Warehouse address to push to
+			Seekable            bool               // Pack a seekable tar
+			EStargz             bool               // Pack an eStargz tar
+			Compression         string             // Compression codec name
+			Level               int                // Compression level
+			Manifest            string             // Path to write a manifest to
 		}{}
 		cmd.Arg("pack", "Pack type").
 			Required().
@@ -97,13 +108,25 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd.Arg("path", "Target path").
 			Required().
 			StringVar(&args.Path)
-		cmd.Flag("target", "Warehouse in which to place the ware").
+		cmd.Flag("target", "Warehouse in which to place the ware (or '-' to write it to stdout, and the WareID to stderr; tar only)").
 			StringVar(&args.TargetWarehouseAddr)
+		cmd.Flag("seekable", "Gzip each entry on its own, and store an index beside the ware, so 'unpack --path' can fetch only part of it (tar only; needs a content-addressable target)").
+			BoolVar(&args.Seekable)
+		cmd.Flag("estargz", "Write an eStargz, for lazy pulling by stargz-snapshotter; the WareID is the same as a plain tar's (tar only)").
+			BoolVar(&args.EStargz)
+		cmd.Flag("compression", "Compress the ware with [gzip, zstd, lz4, none] (tar only)").
+			Default("gzip").
+			EnumVar(&args.Compression,
+				"gzip", "zstd", "lz4", "none")
+		cmd.Flag("level", "Compression level, or 0 for the codec's default: higher packs smaller but slower (gzip 1-9, zstd 1-19, lz4 1-12; tar only)").
+			IntVar(&args.Level)
+		cmd.Flag("manifest", "Write a manifest of every entry packed (its path, metadata, and content hash; one JSON line apiece) to this file (tar only)").
+			StringVar(&args.Manifest)
 		cmd.Flag("uid", "Set UID filter [keep, <int>]").
 			StringVar(&args.Filters.Uid)
 		cmd.Flag("gid", "Set GID filter [keep, <int>]").
 			StringVar(&args.Filters.Gid)
-		cmd.Flag("mtime", "Set mtime filter [keep, <@UNIX>, <RFC3339>]. Will be set to a date if not specified.").
+		cmd.Flag("mtime", "Set mtime filter [keep, keep-ns, <@UNIX>, <RFC3339>]. Will be set to a date if not specified.  'keep' keeps mtimes to the second; 'keep-ns' keeps them to the nanosecond, which changes the WareID of anything with sub-second mtimes (tar only).").
 			StringVar(&args.Filters.Mtime)
 		cmd.Flag("sticky", "Keep setuid, setgid, and sticky bits [keep, zero]").
 			Default("keep").
@@ -120,6 +143,70 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return Recategorize(rio.ErrUsage, err)
 			}
+			packOpts := tartrans.PackOptions{
+				Compression: map[string]tartrans.Compression{
+					"gzip": tartrans.Gzip,
+					"zstd": tartrans.Zstd,
+					"lz4":  tartrans.Lz4,
+					"none": tartrans.Uncompressed,
+				}[args.Compression],
+				Level: args.Level,
+			}
+			if packOpts.Compression != tartrans.Gzip || packOpts.Level != 0 {
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "choosing compression is only supported for tar (not %q)", args.PackType)
+				}
+			}
+			if args.Seekable {
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "seekable packs are only supported for tar (not %q)", args.PackType)
+				}
+				if args.TargetWarehouseAddr == "-" {
+					return Errorf(rio.ErrUsage, "seekable packs can't be written to stdout: the index needs a warehouse to go in")
+				}
+				packOpts.Seekable = true
+			}
+			if args.EStargz {
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "eStargz packs are only supported for tar (not %q)", args.PackType)
+				}
+				packOpts.EStargz = true
+			}
+			if args.Manifest != "" {
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "manifests are only supported for tar (not %q)", args.PackType)
+				}
+				f, err := os.Create(args.Manifest)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "cannot write manifest: %s", err)
+				}
+				defer f.Close()
+				packOpts.Manifest = f
+			}
+			if args.PackType == string(tartrans.PackType) {
+				packFunc = tartrans.PackWith(packOpts)
+			}
+			if args.TargetWarehouseAddr == "-" {
+				// The ware goes to stdout, so everything else goes to stderr.
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "packing to stdout is only supported for tar (not %q)", args.PackType)
+				}
+				oc.stdout = stderr
+				resultWareID, err := tartrans.PackToStream(
+					ctx,
+					api.PackType(args.PackType),
+					path,
+					args.Filters,
+					stdout,
+					packOpts,
+					oc.WireMonitor(ctx, rio.Monitor{}),
+				)
+				if err != nil {
+					return err
+				}
+				oc.EmitResult(resultWareID, nil)
+				return nil
+			}
 			resultWareID, err := packFunc(
 				ctx,
 				api.PackType(args.PackType),
@@ -143,6 +230,10 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Filters              api.FilesetFilters // Filters for unpack
 			PlacementMode        string             // Placement mode enum
 			SourcesWarehouseAddr []string           // Warehouse address to fetch from
+			Paths                []string           // Paths to unpack, if not all of them
+			Includes             []string           // Paths or globs to unpack, if not all of them
+			Submodules           string             // What to do with git submodules
+			LFS                  bool               // Fetch git LFS objects for pointer files
 		}{}
 		cmd.Arg("ware", "Ware ID").
 			Required().
@@ -153,8 +244,18 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd.Flag("placer", "Placement mode to use [copy, direct, mount, none]").
 			EnumVar(&args.PlacementMode,
 				string(rio.Placement_Copy), string(rio.Placement_Direct), string(rio.Placement_Mount), string(rio.Placement_None))
-		cmd.Flag("source", "Warehouses from which to fetch the ware").
+		cmd.Flag("source", "Warehouses from which to fetch the ware (or '-' to read it from stdin; tar only)").
 			StringsVar(&args.SourcesWarehouseAddr)
+		cmd.Flag("path", "Unpack only this path in the ware, and what's under it; may be repeated (seekable tars only)").
+			StringsVar(&args.Paths)
+		cmd.Flag("include", "Unpack only what matches this path or glob, and what's under it; may be repeated.  The whole ware is still fetched and verified (tar only)").
+			StringsVar(&args.Includes)
+		cmd.Flag("submodules", "Fetch and unpack submodules at their pinned commits, all the way down, or leave them as empty dirs [recurse, empty] (git only)").
+			Default("recurse").
+			EnumVar(&args.Submodules,
+				"recurse", "empty")
+		cmd.Flag("lfs", "Fetch the files Git LFS pointers point to, from the LFS server beside the repo, and place those instead (git only)").
+			BoolVar(&args.LFS)
 		cmd.Flag("uid", "Set UID filter [keep, mine, <int>]").
 			Default("mine").
 			StringVar(&args.Filters.Uid)
@@ -179,23 +280,101 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			// Check for reading from stdin before anything's cleared.
+			fromStdin := false
+			for _, addr := range args.SourcesWarehouseAddr {
+				if addr == "-" || addr == "stream:stdin" {
+					fromStdin = true
+				}
+			}
+			if fromStdin {
+				if len(args.SourcesWarehouseAddr) != 1 {
+					return Errorf(rio.ErrUsage, "reading from stdin can't be combined with other sources")
+				}
+				if wareID.Type != tartrans.PackType {
+					return Errorf(rio.ErrUsage, "unpacking from stdin is only supported for tar (not %q)", wareID.Type)
+				}
+			}
+			if len(args.Paths) > 0 {
+				if wareID.Type != tartrans.PackType {
+					return Errorf(rio.ErrUsage, "unpacking some paths is only supported for tar (not %q)", wareID.Type)
+				}
+				if fromStdin {
+					return Errorf(rio.ErrUsage, "unpacking some paths can't be combined with reading from stdin")
+				}
+			}
+			if len(args.Includes) > 0 {
+				if wareID.Type != tartrans.PackType {
+					return Errorf(rio.ErrUsage, "unpacking only what matches is only supported for tar (not %q)", wareID.Type)
+				}
+				if fromStdin || len(args.Paths) > 0 {
+					return Errorf(rio.ErrUsage, "--include can't be combined with reading from stdin, nor with --path")
+				}
+			}
+			if args.Submodules == "empty" || args.LFS {
+				if wareID.Type != git.PackType {
+					return Errorf(rio.ErrUsage, "--submodules and --lfs are only supported for git (not %q)", wareID.Type)
+				}
+				gitOpts := git.UnpackOptions{LFS: args.LFS}
+				if args.Submodules == "empty" {
+					gitOpts.Submodules = git.Submodules_Empty
+				}
+				unpackFunc = git.UnpackWith(gitOpts)
+			}
 			path, err := filepath.Abs(args.Path)
 			if err != nil {
 				return Recategorize(rio.ErrInoperablePath, err)
 			}
-			err = fsOp.RemoveDirContent(osfs.New(fs.MustAbsolutePath(path)), fs.RelPath{})
+			immutablePolicy, err := config.GetImmutableTargetPolicy()
+			if err != nil {
+				return err
+			}
+			err = fsOp.RemoveDirContentWithPolicy(osfs.New(fs.MustAbsolutePath(path)), fs.RelPath{}, fsOp.ImmutablePolicy(immutablePolicy), nil)
 			if err != nil {
 				return Recategorize(rio.ErrInoperablePath, err)
 			}
-			resultWareID, err := unpackFunc(
-				ctx,
-				wareID,
-				path,
-				args.Filters,
-				rio.PlacementMode(args.PlacementMode),
-				convertWarehouseSlice(args.SourcesWarehouseAddr),
-				oc.WireMonitor(ctx, rio.Monitor{}),
-			)
+			var resultWareID api.WareID
+			if len(args.Paths) > 0 {
+				resultWareID, err = tartrans.UnpackPaths(
+					ctx,
+					wareID,
+					path,
+					args.Paths,
+					args.Filters,
+					convertWarehouseSlice(args.SourcesWarehouseAddr),
+					oc.WireMonitor(ctx, rio.Monitor{}),
+				)
+			} else if len(args.Includes) > 0 {
+				resultWareID, err = tartrans.UnpackSelected(
+					ctx,
+					wareID,
+					path,
+					args.Includes,
+					args.Filters,
+					convertWarehouseSlice(args.SourcesWarehouseAddr),
+					oc.WireMonitor(ctx, rio.Monitor{}),
+				)
+			} else if fromStdin {
+				resultWareID, err = tartrans.UnpackFromStream(
+					ctx,
+					wareID,
+					stdin,
+					path,
+					args.Filters,
+					rio.PlacementMode(args.PlacementMode),
+					oc.WireMonitor(ctx, rio.Monitor{}),
+				)
+			} else {
+				resultWareID, err = unpackFunc(
+					ctx,
+					wareID,
+					path,
+					args.Filters,
+					rio.PlacementMode(args.PlacementMode),
+					convertWarehouseSlice(args.SourcesWarehouseAddr),
+					oc.WireMonitor(ctx, rio.Monitor{}),
+				)
+			}
 			if err != nil {
 				return err
 			}
@@ -286,6 +465,216 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			return nil
 		}}
 	}
+	{
+		cmd := app.Command("repack", "Store an already-packed ware in another form (tar recompressed, or tar as chunks, or back), keeping the same fileset.")
+		args := struct {
+			WareID               string   // WareID to repack
+			PackType             string   // Pack type to repack as
+			TargetWarehouseAddr  string   // Warehouse to store the repacked ware in
+			SourceWarehouseAddrs []string // Warehouses we can fetch from
+			Compression          string   // Compression codec name
+			Level                int      // Compression level
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("pack", "Pack type to repack as").
+			Required().
+			StringVar(&args.PackType)
+		cmd.Flag("target", "Warehouse in which to place the repacked ware").
+			StringVar(&args.TargetWarehouseAddr)
+		cmd.Flag("source", "Warehouses from which to fetch the ware").
+			StringsVar(&args.SourceWarehouseAddrs)
+		cmd.Flag("compression", "Compress the repacked ware with [gzip, zstd, lz4, none] (tar only)").
+			Default("gzip").
+			EnumVar(&args.Compression,
+				"gzip", "zstd", "lz4", "none")
+		cmd.Flag("level", "Compression level, or 0 for the codec's default (tar only)").
+			IntVar(&args.Level)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			repackFunc, err := demuxRepackTool(string(wareID.Type), args.PackType)
+			if err != nil {
+				return err
+			}
+			compression := map[string]tartrans.Compression{
+				"gzip": tartrans.Gzip,
+				"zstd": tartrans.Zstd,
+				"lz4":  tartrans.Lz4,
+				"none": tartrans.Uncompressed,
+			}[args.Compression]
+			if compression != tartrans.Gzip || args.Level != 0 {
+				if args.PackType != string(tartrans.PackType) {
+					return Errorf(rio.ErrUsage, "choosing compression is only supported for tar (not %q)", args.PackType)
+				}
+			}
+			resultWareID, err := repackFunc(
+				ctx,
+				wareID,
+				compression,
+				args.Level,
+				api.WarehouseAddr(args.TargetWarehouseAddr),
+				convertWarehouseSlice(args.SourceWarehouseAddrs),
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			oc.EmitResult(resultWareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("pack-image", "Pack an assembly of wares into an OCI image, one layer per ware, written as an OCI image layout.")
+		args := struct {
+			Path                 string             // Where to write the image layout
+			Parts                []string           // "PATH=WAREID" for each ware in the assembly
+			SourceWarehouseAddrs []string           // Warehouses we can fetch from
+			Filters              api.FilesetFilters // Filters for packing the layers
+			Config               ocilayer.ImageConfig // How to run the image
+		}{}
+		cmd.Arg("path", "Where to write the OCI image layout (made if it doesn't exist; other images in it are kept)").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("part", "A ware, and the path it goes at in the image, as 'PATH=WAREID'; may be repeated").
+			Required().
+			StringsVar(&args.Parts)
+		cmd.Flag("source", "Warehouses from which to fetch the wares").
+			StringsVar(&args.SourceWarehouseAddrs)
+		cmd.Flag("entrypoint", "Entrypoint of the image; repeat for each argument").
+			StringsVar(&args.Config.Entrypoint)
+		cmd.Flag("cmd", "Default command of the image; repeat for each argument").
+			StringsVar(&args.Config.Cmd)
+		cmd.Flag("env", "Environment variable of the image, as 'KEY=value'; may be repeated").
+			StringsVar(&args.Config.Env)
+		cmd.Flag("workdir", "Working dir of the image").
+			StringVar(&args.Config.WorkingDir)
+		cmd.Flag("user", "User the image runs as").
+			StringVar(&args.Config.User)
+		cmd.Flag("arch", "Architecture of the image (default: this host's)").
+			StringVar(&args.Config.Architecture)
+		cmd.Flag("os", "OS of the image").
+			Default("linux").
+			StringVar(&args.Config.OS)
+		cmd.Flag("tag", "Name to tag the image with in the layout").
+			StringVar(&args.Config.Tag)
+		cmd.Flag("uid", "Set UID filter [keep, <int>]").
+			StringVar(&args.Filters.Uid)
+		cmd.Flag("gid", "Set GID filter [keep, <int>]").
+			StringVar(&args.Filters.Gid)
+		cmd.Flag("mtime", "Set mtime filter [keep, <@UNIX>, <RFC3339>]. Will be set to a date if not specified.").
+			StringVar(&args.Filters.Mtime)
+		cmd.Flag("sticky", "Keep setuid, setgid, and sticky bits [keep, zero]").
+			Default("keep").
+			EnumVar(&args.Filters.Sticky,
+				"keep", "zero")
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			path, err := filepath.Abs(args.Path)
+			if err != nil {
+				return Recategorize(rio.ErrUsage, err)
+			}
+			var parts []stitch.UnpackSpec
+			for _, s := range args.Parts {
+				ss := strings.SplitN(s, "=", 2)
+				if len(ss) != 2 {
+					return Errorf(rio.ErrUsage, "invalid part %q: must be 'PATH=WAREID'", s)
+				}
+				partPath, err := fs.ParseAbsolutePath(ss[0])
+				if err != nil {
+					return Errorf(rio.ErrUsage, "invalid part %q: %s", s, err)
+				}
+				wareID, err := api.ParseWareID(ss[1])
+				if err != nil {
+					return Errorf(rio.ErrUsage, "invalid part %q: %s", s, err)
+				}
+				parts = append(parts, stitch.UnpackSpec{
+					Path:       partPath,
+					WareID:     wareID,
+					Warehouses: convertWarehouseSlice(args.SourceWarehouseAddrs),
+				})
+			}
+			_, err = ocilayer.PackImage(
+				ctx,
+				unpackAnyTool,
+				parts,
+				args.Filters,
+				args.Config,
+				path,
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			// The image is named by its manifest digest, which was logged; it has no WareID.
+			oc.EmitResult(api.WareID{}, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("verify", "Check that every ware in a content-addressable warehouse still hashes to its WareID.")
+		args := struct {
+			PackType            string   // Pack type
+			SourceWarehouseAddr string   // Warehouse to check
+			ExpectWareIDs       []string // Wares which should be in it
+		}{}
+		cmd.Arg("pack", "Pack type").
+			Required().
+			StringVar(&args.PackType)
+		cmd.Flag("source", "Warehouse to check (must be 'ca+file')").
+			StringVar(&args.SourceWarehouseAddr)
+		cmd.Flag("expect", "Ware ID which should be in the warehouse (reported missing if not)").
+			StringsVar(&args.ExpectWareIDs)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			verifyFunc, err := demuxVerifyTool(string(args.PackType))
+			if err != nil {
+				return err
+			}
+			var expect []api.WareID
+			for _, s := range args.ExpectWareIDs {
+				wareID, err := api.ParseWareID(s)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "invalid ware ID %q: %s", s, err)
+				}
+				expect = append(expect, wareID)
+			}
+			checks, err := verifyFunc(
+				ctx,
+				api.WarehouseAddr(args.SourceWarehouseAddr),
+				expect,
+				oc.WireMonitor(ctx, rio.Monitor{}),
+			)
+			if err != nil {
+				return err
+			}
+			// Each ware was logged as it was checked; sum up the bad ones.
+			var corrupt, missing int
+			for _, check := range checks {
+				switch check.Status {
+				case tartrans.Check_Corrupt:
+					corrupt++
+				case tartrans.Check_Missing:
+					missing++
+				}
+			}
+			switch {
+			case corrupt > 0:
+				return Errorf(rio.ErrWareCorrupt, "%d of %d wares are corrupt (and %d missing)", corrupt, len(checks), missing)
+			case missing > 0:
+				return Errorf(rio.ErrWareNotFound, "%d of %d wares are missing", missing, len(checks))
+			}
+			oc.EmitResult(api.WareID{}, nil)
+			return nil
+		}}
+	}
 	// Okay now let's be clear: actually all of these behaviors should, end of day,
 	//  actually send their errors through our output control.
 	//  We still also return it, both so you can write tests around this
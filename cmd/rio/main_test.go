@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -157,6 +158,226 @@ func TestTarFixtureUnpack(t *testing.T) {
 	)
 }
 
+func TestPackToStdout(t *testing.T) {
+	Convey("rio: packing to stdout", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(ioutil.WriteFile(tmpDir.String()+"/a", []byte("abc"), 0644), ShouldBeNil)
+				ctx := context.Background()
+				Convey("the ware should go to stdout, and the WareID to stderr", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "pack", "tar", tmpDir.String(), "--target=-"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, 0)
+					So(stdout.Bytes()[:2], ShouldResemble, []byte{0x1f, 0x8b})
+					So(lastLine(stderr.String()), ShouldStartWith, "tar:")
+				})
+				Convey("other packtypes should be refused", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "pack", "zip", tmpDir.String(), "--target=-"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+					So(stdout.Len(), ShouldEqual, 0)
+				})
+				Convey("the compression flags should choose the codec and level", func() {
+					for _, tt := range []struct {
+						flags []string
+						magic []byte
+					}{
+						{[]string{"--compression=zstd", "--level=19"}, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+						{[]string{"--compression=lz4", "--level=12"}, []byte{0x04, 0x22, 0x4D, 0x18}},
+						{[]string{"--level=1"}, []byte{0x1f, 0x8b}},
+					} {
+						stdin, stdout, stderr := stdBuffers()
+						exitCode := Main(ctx, append([]string{"rio", "pack", "tar", tmpDir.String(), "--target=-"}, tt.flags...), stdin, stdout, stderr)
+						So(exitCode, ShouldEqual, 0)
+						So(stdout.Bytes()[:len(tt.magic)], ShouldResemble, tt.magic)
+					}
+				})
+				Convey("a manifest should list what was packed", func() {
+					stdin, stdout, stderr := stdBuffers()
+					manifest := tmpDir.String() + ".manifest"
+					defer os.Remove(manifest)
+					exitCode := Main(ctx, []string{"rio", "pack", "tar", tmpDir.String(), "--target=-", "--manifest=" + manifest}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, 0)
+					body, err := ioutil.ReadFile(manifest)
+					So(err, ShouldBeNil)
+					lines := strings.Split(strings.TrimRight(string(body), "\n"), "\n")
+					So(lines, ShouldHaveLength, 2)
+					So(lines[0], ShouldStartWith, `{"name":".","type":"d"`)
+					So(lines[1], ShouldStartWith, `{"name":"./a","type":"f"`)
+				})
+				Convey("bad levels, and compression for other packtypes, should be refused", func() {
+					for _, args := range [][]string{
+						{"rio", "pack", "tar", tmpDir.String(), "--target=-", "--level=42"},
+						{"rio", "pack", "zip", tmpDir.String(), "--compression=zstd"},
+					} {
+						stdin, stdout, stderr := stdBuffers()
+						exitCode := Main(ctx, args, stdin, stdout, stderr)
+						So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+						So(stdout.Len(), ShouldEqual, 0)
+					}
+				})
+			})
+		}),
+	)
+}
+
+func TestUnpackFromStdin(t *testing.T) {
+	Convey("rio: unpacking from stdin", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.Mkdir(tmpDir.String()+"/src", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/a", []byte("abc"), 0644), ShouldBeNil)
+				ctx := context.Background()
+				_, ware, stderr := stdBuffers()
+				So(Main(ctx, []string{"rio", "pack", "tar", tmpDir.String() + "/src", "--target=-"}, &bytes.Buffer{}, ware, stderr), ShouldEqual, 0)
+				wareID := lastLine(stderr.String())
+
+				Convey("a ware piped in should unpack, and be verified", func() {
+					for _, source := range []string{"-", "stream:stdin"} {
+						_, stdout, stderr := stdBuffers()
+						dest := tmpDir.String() + "/unpack-" + source
+						exitCode := Main(ctx, []string{"rio", "unpack", wareID, dest, "--placer=direct", "--source=" + source}, bytes.NewReader(ware.Bytes()), stdout, stderr)
+						So(exitCode, ShouldEqual, 0)
+						So(lastLine(stdout.String()), ShouldEqual, wareID)
+						body, err := ioutil.ReadFile(dest + "/a")
+						So(err, ShouldBeNil)
+						So(string(body), ShouldEqual, "abc")
+					}
+				})
+				Convey("a ware that doesn't match should be a hash mismatch", func() {
+					_, stdout, stderr := stdBuffers()
+					otherWareID := "tar:5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"
+					exitCode := Main(ctx, []string{"rio", "unpack", otherWareID, tmpDir.String() + "/unpack", "--placer=direct", "--source=-"}, bytes.NewReader(ware.Bytes()), stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrWareHashMismatch))
+				})
+				Convey("stdin with other sources should be refused", func() {
+					_, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "unpack", wareID, tmpDir.String() + "/unpack", "--source=-", "--source=file:///nope"}, bytes.NewReader(ware.Bytes()), stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+			})
+		}),
+	)
+}
+
+func TestUnpackPaths(t *testing.T) {
+	Convey("rio: unpacking some paths of a seekable tar", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.MkdirAll(tmpDir.String()+"/src/b", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/a", []byte("abc"), 0644), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/b/c", []byte("def"), 0644), ShouldBeNil)
+				So(os.Mkdir(tmpDir.String()+"/wh", 0755), ShouldBeNil)
+				warehouse := "ca+file://" + tmpDir.String() + "/wh"
+				ctx := context.Background()
+				stdin, stdout, stderr := stdBuffers()
+				So(Main(ctx, []string{"rio", "pack", "tar", tmpDir.String() + "/src", "--target=" + warehouse, "--seekable"}, stdin, stdout, stderr), ShouldEqual, 0)
+				wareID := lastLine(stdout.String())
+
+				Convey("only the paths asked for should be placed", func() {
+					stdin, stdout, stderr := stdBuffers()
+					dest := tmpDir.String() + "/unpack"
+					exitCode := Main(ctx, []string{"rio", "unpack", wareID, dest, "--source=" + warehouse, "--path=b"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, 0)
+					So(lastLine(stdout.String()), ShouldEqual, wareID)
+					body, err := ioutil.ReadFile(dest + "/b/c")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "def")
+					_, err = os.Stat(dest + "/a")
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("seekable packs of other packtypes should be refused", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "pack", "zip", tmpDir.String() + "/src", "--target=" + warehouse, "--seekable"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+			})
+		}),
+	)
+}
+
+func TestUnpackIncludes(t *testing.T) {
+	Convey("rio: unpacking only what matches, from any tar", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.MkdirAll(tmpDir.String()+"/src/b", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/a", []byte("abc"), 0644), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/b/c.txt", []byte("def"), 0644), ShouldBeNil)
+				warehouse := "file://" + tmpDir.String() + "/ware.tgz"
+				ctx := context.Background()
+				stdin, stdout, stderr := stdBuffers()
+				So(Main(ctx, []string{"rio", "pack", "tar", tmpDir.String() + "/src", "--target=" + warehouse}, stdin, stdout, stderr), ShouldEqual, 0)
+				wareID := lastLine(stdout.String())
+
+				Convey("only what matches should be placed, and the WareID still checked", func() {
+					stdin, stdout, stderr := stdBuffers()
+					dest := tmpDir.String() + "/unpack"
+					exitCode := Main(ctx, []string{"rio", "unpack", wareID, dest, "--source=" + warehouse, "--include=b/*.txt"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, 0)
+					So(lastLine(stdout.String()), ShouldEqual, wareID)
+					body, err := ioutil.ReadFile(dest + "/b/c.txt")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "def")
+					_, err = os.Stat(dest + "/a")
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("combined with --path, it should be refused", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "unpack", wareID, tmpDir.String() + "/unpack", "--source=" + warehouse, "--include=a", "--path=b"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+			})
+		}),
+	)
+}
+
+func TestRepack(t *testing.T) {
+	Convey("rio: repacking a tar as chunks, and back", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.MkdirAll(tmpDir.String()+"/src/b", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/a", []byte("abc"), 0644), ShouldBeNil)
+				So(os.Mkdir(tmpDir.String()+"/wh", 0755), ShouldBeNil)
+				warehouse := "ca+file://" + tmpDir.String() + "/wh"
+				ctx := context.Background()
+				stdin, stdout, stderr := stdBuffers()
+				So(Main(ctx, []string{"rio", "pack", "tar", tmpDir.String() + "/src", "--target=" + warehouse}, stdin, stdout, stderr), ShouldEqual, 0)
+				tarWareID := lastLine(stdout.String())
+
+				Convey("the chunked ware should be the same as one packed as chunks, and repack to the same tar", func() {
+					stdin, stdout, stderr := stdBuffers()
+					So(Main(ctx, []string{"rio", "repack", tarWareID, "chunk", "--source=" + warehouse, "--target=" + warehouse}, stdin, stdout, stderr), ShouldEqual, 0)
+					chunkWareID := lastLine(stdout.String())
+					So(chunkWareID, ShouldStartWith, "chunk:")
+					stdin, stdout, stderr = stdBuffers()
+					So(Main(ctx, []string{"rio", "pack", "chunk", tmpDir.String() + "/src"}, stdin, stdout, stderr), ShouldEqual, 0)
+					So(lastLine(stdout.String()), ShouldEqual, chunkWareID)
+
+					warehouse2 := "file://" + tmpDir.String() + "/ware.tar.zst"
+					stdin, stdout, stderr = stdBuffers()
+					So(Main(ctx, []string{"rio", "repack", chunkWareID, "tar", "--source=" + warehouse, "--target=" + warehouse2, "--compression=zstd"}, stdin, stdout, stderr), ShouldEqual, 0)
+					So(lastLine(stdout.String()), ShouldEqual, tarWareID)
+					stdin, stdout, stderr = stdBuffers()
+					So(Main(ctx, []string{"rio", "unpack", tarWareID, tmpDir.String() + "/unpack", "--source=" + warehouse2}, stdin, stdout, stderr), ShouldEqual, 0)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/unpack/a")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "abc")
+				})
+				Convey("compression for chunks should be refused", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "repack", tarWareID, "chunk", "--source=" + warehouse, "--target=" + warehouse, "--compression=zstd"}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+				Convey("other packtypes should be refused", func() {
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(ctx, []string{"rio", "repack", tarWareID, "zip", "--source=" + warehouse, "--target=" + warehouse}, stdin, stdout, stderr)
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+			})
+		}),
+	)
+}
+
 func lastLine(str string) string {
 	str = strings.TrimRight(str, "\n")
 	ss := strings.Split(str, "\n")
@@ -13,13 +13,21 @@ Sniperkit-Bot
 	because it wouldn't be correct to do so when using commands via remote RPC; in
 	such a situation, the *remote* Rio will read its *local* config in order to
 	comply with the operator's rules there on that machine and environment.)
+
+	Config that can be malformed is checked as it's read; a value that doesn't
+	parse is an error of category rio.ErrUsage, rather than a guess.
 */
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/fs"
 )
 
@@ -59,6 +67,305 @@ func GetMountWorkPath() fs.AbsolutePath {
 	return fs.MustAbsolutePath(pth)
 }
 
+/*
+	Return whether unpacking should tolerate filesystems that cannot chown symlinks.
+
+	The default is strict: an "operation not supported" error from chowning
+	a symlink aborts the unpack, just like any other chown error.
+	Setting the `RIO_SYMLINK_CHOWN` environment variable to "skip" makes that
+	specific error a warning instead.
+	Chown errors on any other kind of file are fatal -- except that when not
+	running as root, an unpack that's denied permission to chown only warns.
+*/
+func GetSkipUnsupportedSymlinkChown() (bool, error) {
+	switch os.Getenv("RIO_SYMLINK_CHOWN") {
+	case "", "strict":
+		return false, nil
+	case "skip":
+		return true, nil
+	default:
+		return false, Errorf(rio.ErrUsage, "RIO_SYMLINK_CHOWN must be either \"strict\" or \"skip\"")
+	}
+}
+
+/*
+	Return whether the cache should fsync wares as it commits them.
+
+	The default is not to: a commit is a rename, which is atomic, but after
+	a crash the renamed shelf may turn out to be missing, or to hold files
+	whose content never reached the disk.  Setting the `RIO_CACHE_SYNC`
+	environment variable to "fsync" makes every commit sync the ware's
+	files and dirs before the rename, and the shelf's parent dirs after it.
+	That's durable, but costs a good deal of throughput on big wares.
+*/
+func GetCacheSync() (bool, error) {
+	switch os.Getenv("RIO_CACHE_SYNC") {
+	case "", "none":
+		return false, nil
+	case "fsync":
+		return true, nil
+	default:
+		return false, Errorf(rio.ErrUsage, "RIO_CACHE_SYNC must be either \"none\" or \"fsync\"")
+	}
+}
+
+/*
+	Return the policy for immutable files found where an unpack needs to
+	clear the way: "fail" (the default), "clear", or "skip".
+	See fsOp.ImmutablePolicy for what each means.
+
+	This is set by the `RIO_IMMUTABLE_TARGETS` environment variable.
+	The result is returned as a plain string, so that this package
+	needn't depend on fsOp; "fail" is returned as the empty string.
+*/
+func GetImmutableTargetPolicy() (string, error) {
+	switch v := os.Getenv("RIO_IMMUTABLE_TARGETS"); v {
+	case "", "fail":
+		return "", nil
+	case "clear", "skip":
+		return v, nil
+	default:
+		return "", Errorf(rio.ErrUsage, "RIO_IMMUTABLE_TARGETS must be one of \"fail\", \"clear\", or \"skip\"")
+	}
+}
+
+/*
+	Return the policy for backslashes in tar entry names:
+	"strict" (the default), "backslash", or "reject".
+	See tartrans.SeparatorPolicy for what each means, and the risks.
+
+	This is set by the `RIO_TAR_SEPARATORS` environment variable.
+	As with GetImmutableTargetPolicy, it's returned as a plain string,
+	and the default is returned as the empty string.
+*/
+func GetTarSeparatorPolicy() (string, error) {
+	switch v := os.Getenv("RIO_TAR_SEPARATORS"); v {
+	case "", "strict":
+		return "", nil
+	case "backslash", "reject":
+		return v, nil
+	default:
+		return "", Errorf(rio.ErrUsage, "RIO_TAR_SEPARATORS must be one of \"strict\", \"backslash\", or \"reject\"")
+	}
+}
+
+/*
+	Return the table for remapping uids in filesets, from the
+	`RIO_FILTER_UIDMAP` environment variable; see getIdMap for the format.
+*/
+func GetFilterUidMap() (map[uint32]uint32, error) {
+	return getIdMap("RIO_FILTER_UIDMAP")
+}
+
+/*
+	Return the table for remapping gids in filesets, from the
+	`RIO_FILTER_GIDMAP` environment variable; see getIdMap for the format.
+*/
+func GetFilterGidMap() (map[uint32]uint32, error) {
+	return getIdMap("RIO_FILTER_GIDMAP")
+}
+
+/*
+	Parses an id remap table.  The format is comma-separated "from:to" pairs,
+	e.g. "0:1000,33:1033"; ids not listed are left alone.
+	This is meant for unpacking into (or packing from) a container whose
+	user namespace maps ids differently than the host.
+
+	The remap is applied to every entry while packing (before hashing) and
+	unpacking (before chowning), ahead of the uid/gid filters; so a filter
+	that sets a fixed id still wins.  Returns nil if unset.
+*/
+func getIdMap(envVar string) (map[uint32]uint32, error) {
+	v := os.Getenv(envVar)
+	if v == "" {
+		return nil, nil
+	}
+	m := map[uint32]uint32{}
+	for _, pair := range strings.Split(v, ",") {
+		var from, to uint32
+		if n, err := fmt.Sscanf(pair, "%d:%d", &from, &to); err != nil || n != 2 || fmt.Sprintf("%d:%d", from, to) != pair {
+			return nil, Errorf(rio.ErrUsage, "%s must be comma-separated \"from:to\" id pairs; %q is not", envVar, pair)
+		}
+		if _, dup := m[from]; dup {
+			return nil, Errorf(rio.ErrUsage, "%s maps id %d more than once", envVar, from)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+/*
+	Return the permission bits to clear from every entry in filesets, from
+	the `RIO_FILTER_PERMS_MASK` environment variable.  The format is octal,
+	like a umask: "022" clears group and other write, and "6022" clears
+	setuid and setgid as well.
+
+	Like the id remap tables, the mask is applied to every entry while
+	packing (before hashing) and unpacking (before chmodding); so a ware
+	packed with a mask has a WareID describing the masked perms.
+	Returns zero if unset.
+*/
+func GetFilterPermsMask() (fs.Perms, error) {
+	v := os.Getenv("RIO_FILTER_PERMS_MASK")
+	if v == "" {
+		return 0, nil
+	}
+	mask, err := strconv.ParseUint(v, 8, 16)
+	if err != nil || mask > 07777 {
+		return 0, Errorf(rio.ErrUsage, "RIO_FILTER_PERMS_MASK must be octal permission bits, no more than 7777")
+	}
+	return fs.Perms(mask), nil
+}
+
+/*
+	Return which extended attributes to keep in filesets, from the
+	`RIO_FILTER_XATTRS` environment variable.
+
+	Keeping xattrs is opt-in: unset, `enabled` is false, and xattrs are
+	left out of filesets as they always have been -- pack doesn't read them
+	(so they're not in the hash), and unpack doesn't place them.
+	Otherwise it's a comma-separated list, each either a whole key
+	("security.capability") or a namespace, ending in a dot ("user.");
+	xattrs matching none of them are dropped.  "all" keeps them all, and
+	returns a nil `keep`; "none" drops them all.
+
+	Like the perms mask, a list (or "none") applies to every entry while
+	packing (before hashing) and unpacking (before placing); so a ware
+	packed with some xattrs dropped has a WareID without them.
+*/
+func GetFilterXattrs() (keep []string, enabled bool, err error) {
+	v := os.Getenv("RIO_FILTER_XATTRS")
+	switch v {
+	case "":
+		return nil, false, nil
+	case "all":
+		return nil, true, nil
+	case "none":
+		return []string{}, true, nil
+	}
+	keep = strings.Split(v, ",")
+	for _, k := range keep {
+		if k == "" || k == "." || strings.ContainsAny(k, " \t\x00") {
+			return nil, false, Errorf(rio.ErrUsage, "RIO_FILTER_XATTRS must be \"all\", \"none\", or a comma-separated list of xattr keys and namespaces (like \"user.,security.capability\")")
+		}
+	}
+	return keep, true, nil
+}
+
+/*
+	Return how many files pack may hash at once.
+
+	The default is 1: each file is read once, hashed as it's streamed into
+	the tar.  Setting the `RIO_PACK_PARALLELISM` environment variable to a
+	larger number has that many workers hash files ahead of the tar writer;
+	which reads each file twice (the second time, usually from page cache),
+	but can use more than one core.  The WareID is the same either way.
+*/
+func GetPackParallelism() (int, error) {
+	v := os.Getenv("RIO_PACK_PARALLELISM")
+	if v == "" {
+		return 1, nil
+	}
+	var n int
+	if _, err := fmt.Sscanf(v, "%d", &n); err != nil || n < 1 || fmt.Sprintf("%d", n) != v {
+		return 0, Errorf(rio.ErrUsage, "RIO_PACK_PARALLELISM must be a positive integer")
+	}
+	return n, nil
+}
+
+/*
+	Return how many times a fetch from one warehouse is retried after a
+	transient failure -- the warehouse can't be reached, answers with a
+	server error, or the fetch breaks partway -- before moving on to the
+	next warehouse.  Each retry waits twice as long as the one before.
+
+	The default is 3; the `RIO_FETCH_RETRIES` environment variable can set
+	any other number, including 0 to fail over at once.
+*/
+func GetFetchRetries() (int, error) {
+	v := os.Getenv("RIO_FETCH_RETRIES")
+	if v == "" {
+		return 3, nil
+	}
+	var n int
+	if _, err := fmt.Sscanf(v, "%d", &n); err != nil || n < 0 || fmt.Sprintf("%d", n) != v {
+		return 0, Errorf(rio.ErrUsage, "RIO_FETCH_RETRIES must be a non-negative integer")
+	}
+	return n, nil
+}
+
+/*
+	Return the dir holding TLS certs for HTTPS warehouses, one subdir per
+	server, named by its host (and port, if the warehouse addr gives one):
+	`ca.crt` (or any `*.crt`) are CAs to trust for that server, on top of
+	the system's; and `client.cert` with `client.key` is the certificate to
+	present to it, for servers that want mutual TLS.  (This is the same
+	layout docker uses for registries.)
+
+	The default value is `"$RIO_BASE/certs.d"`;
+	this can be overriden by the `RIO_TLS_CERTS_DIR` environment variable.
+*/
+func GetTLSCertsPath() fs.AbsolutePath {
+	pth := os.Getenv("RIO_TLS_CERTS_DIR")
+	if pth == "" {
+		return GetRioBasePath().Join(fs.MustRelPath("certs.d"))
+	}
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		panic(err)
+	}
+	return fs.MustAbsolutePath(pth)
+}
+
+/*
+	Return the TLS files to use for HTTPS warehouses that have no dir of
+	their own under GetTLSCertsPath: a CA bundle, from the `RIO_TLS_CA_FILE`
+	environment variable; and a client certificate and its key, from
+	`RIO_TLS_CLIENT_CERT` and `RIO_TLS_CLIENT_KEY`.  Any may be unset (and
+	are, by default); but the cert and key go together.
+*/
+func GetTLSDefaultFiles() (caFile, certFile, keyFile string, err error) {
+	caFile = os.Getenv("RIO_TLS_CA_FILE")
+	certFile = os.Getenv("RIO_TLS_CLIENT_CERT")
+	keyFile = os.Getenv("RIO_TLS_CLIENT_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return "", "", "", Errorf(rio.ErrUsage, "RIO_TLS_CLIENT_CERT and RIO_TLS_CLIENT_KEY must be set together")
+	}
+	return
+}
+
+/*
+	Return the path of the file naming credentials for warehouses, by host;
+	see the warehouse/credentials package for what goes in it.
+
+	The default value is `"$RIO_BASE/credentials.json"`;
+	this can be overriden by the `RIO_CREDENTIALS_FILE` environment variable.
+*/
+func GetCredentialsPath() fs.AbsolutePath {
+	pth := os.Getenv("RIO_CREDENTIALS_FILE")
+	if pth == "" {
+		return GetRioBasePath().Join(fs.MustRelPath("credentials.json"))
+	}
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		panic(err)
+	}
+	return fs.MustAbsolutePath(pth)
+}
+
+/*
+	Return the credential helper to ask for hosts the credentials file
+	doesn't list, from the `RIO_CREDENTIAL_HELPER` environment variable.
+	If unset, the file's own default (if any) is used.
+*/
+func GetCredentialHelper() (string, error) {
+	v := os.Getenv("RIO_CREDENTIAL_HELPER")
+	if strings.ContainsAny(v, "/ \t") {
+		return "", Errorf(rio.ErrUsage, "RIO_CREDENTIAL_HELPER must be a helper name (like \"pass\"), not a path")
+	}
+	return v, nil
+}
+
 /*
 	Return the home-base path prefix that is the default root for all other Rio paths.
 
@@ -0,0 +1,44 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package config
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestMalformedConfig(t *testing.T) {
+	Convey("Malformed config should be a usage error, not a panic:", t, func() {
+		for _, tr := range []struct {
+			envVar, value string
+			get           func() error
+		}{
+			{"RIO_SYMLINK_CHOWN", "sometimes", func() error { _, err := GetSkipUnsupportedSymlinkChown(); return err }},
+			{"RIO_CACHE_SYNC", "always", func() error { _, err := GetCacheSync(); return err }},
+			{"RIO_IMMUTABLE_TARGETS", "melt", func() error { _, err := GetImmutableTargetPolicy(); return err }},
+			{"RIO_TAR_SEPARATORS", "slash", func() error { _, err := GetTarSeparatorPolicy(); return err }},
+			{"RIO_FILTER_UIDMAP", "0:1,0:2", func() error { _, err := GetFilterUidMap(); return err }},
+			{"RIO_FILTER_GIDMAP", "0=1", func() error { _, err := GetFilterGidMap(); return err }},
+			{"RIO_FILTER_PERMS_MASK", "0899", func() error { _, err := GetFilterPermsMask(); return err }},
+			{"RIO_FILTER_XATTRS", "user.,,", func() error { _, _, err := GetFilterXattrs(); return err }},
+			{"RIO_PACK_PARALLELISM", "0", func() error { _, err := GetPackParallelism(); return err }},
+			{"RIO_FETCH_RETRIES", "-1", func() error { _, err := GetFetchRetries(); return err }},
+			{"RIO_TLS_CLIENT_CERT", "/client.cert", func() error { _, _, _, err := GetTLSDefaultFiles(); return err }},
+			{"RIO_CREDENTIAL_HELPER", "/bin/pass", func() error { _, err := GetCredentialHelper(); return err }},
+		} {
+			Convey(tr.envVar, func() {
+				defer os.Setenv(tr.envVar, os.Getenv(tr.envVar))
+				So(tr.get(), ShouldBeNil)
+				os.Setenv(tr.envVar, tr.value)
+				So(tr.get(), errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			})
+		}
+	})
+}
@@ -29,6 +29,28 @@ const (
 	ErrRecursion     ErrorCategory = "fs-recursion" // returned when cycles detected in symlinks.
 	ErrShortWrite    ErrorCategory = "fs-shortwrite"
 	ErrPermission    ErrorCategory = "fs-permission"
+	ErrNotSupported  ErrorCategory = "fs-not-supported" // returned when the platform or underlying filesystem can't do the operation at all (ENOTSUP/EOPNOTSUPP); e.g. lchown on a symlink on some filesystems.
+
+	/*
+		Error returned when something already exists at a path, but it's not
+		the type of thing asked for -- e.g. a regular file where a symlink
+		was to be made -- and the operation won't replace it.
+
+		Unlike ErrAlreadyExists (which says "there is something there"),
+		this says the something isn't a version of what was asked for: in
+		replacing it, real data could be lost.
+	*/
+	ErrWrongType ErrorCategory = "fs-wrong-type"
+
+	/*
+		Error returned when an operation would need to remove or overwrite
+		a file that carries the immutable inode flag (as set by `chattr +i`).
+
+		The kernel reports this as a plain EPERM, which is indistinguishable
+		from ordinary permission problems; functions that check the inode
+		flags use this category instead, so the cause is clear.
+	*/
+	ErrTargetImmutable ErrorCategory = "fs-target-immutable"
 
 	/*
 		Error returned when operating in a confined filesystem slice and an
@@ -71,6 +93,12 @@ func NormalizeIOError(ioe error) error {
 		switch e2.Err {
 		case syscall.ENOTDIR:
 			return ErrorDetailed(ErrNotDir, e2.Error(), map[string]string{"path": e2.Path})
+		case syscall.ENODATA: // "no such xattr".
+			return ErrorDetailed(ErrNotExists, e2.Error(), map[string]string{"path": e2.Path})
+		}
+		// Not a switch case: on linux these are the same number, and that would be a duplicate case.
+		if e2.Err == syscall.ENOTSUP || e2.Err == syscall.EOPNOTSUPP {
+			return ErrorDetailed(ErrNotSupported, e2.Error(), map[string]string{"path": e2.Path})
 		}
 	}
 	// Predicates.  God knows what they'll match;
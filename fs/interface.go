@@ -32,6 +32,13 @@ type FS interface {
 
 	Mklink(path RelPath, target string) error
 
+	/*
+		Make a hardlink at path to the existing file at target.
+		Neither path follows a symlink in its last segment (like link(2)).
+		Dirs can't be hardlinked.
+	*/
+	Mkhardlink(path RelPath, target RelPath) error
+
 	Mkfifo(path RelPath, perms Perms) error
 
 	MkdevBlock(path RelPath, major int64, minor int64, perms Perms) error
@@ -42,18 +49,86 @@ type FS interface {
 
 	Chmod(path RelPath, perms Perms) error
 
+	/*
+		Set the mtime and atime of a path, with nanosecond precision.
+		Does not follow symlinks: on a symlink, it's the link's own times
+		that are set (which is what unpacking a symlink needs).
+	*/
 	SetTimesLNano(path RelPath, mtime time.Time, atime time.Time) error
 
+	/*
+		As SetTimesLNano, but follows symlinks.
+	*/
 	SetTimesNano(path RelPath, mtime time.Time, atime time.Time) error
 
 	Stat(path RelPath) (*Metadata, error)
 
 	LStat(path RelPath) (*Metadata, error)
 
+	/*
+		Exactly like LStat, but also fills in Metadata.Xattrs.
+
+		LStat doesn't do this because it costs another syscall for the list,
+		plus one per xattr; use this when you need a complete description
+		of the file, e.g. for hashing.
+		If the filesystem doesn't support xattrs, the file has none:
+		that's not an error.  Xattrs is left nil if there are none.
+	*/
+	LStatWithXattrs(path RelPath) (*Metadata, error)
+
+	/*
+		Report which inode a path is, and how many names it has.
+		Does not follow symlinks (like LStat).
+
+		Two paths with the same Dev and Ino are hardlinks to the same file.
+	*/
+	LInode(path RelPath) (Inode, error)
+
 	ReadDirNames(path RelPath) ([]string, error)
 
+	/*
+		List a dir's entries, sorted by name, with their metadata as if by
+		LStat -- except cheaper: symlinks' Linkname is not filled in,
+		and (as with LStat) neither are Xattrs.
+		Each entry's Name is the full path (the given path joined with the
+		entry name), so it can be passed straight back to other methods.
+	*/
+	ReadDir(path RelPath) ([]Metadata, error)
+
 	Readlink(path RelPath) (target string, isSymlink bool, err error)
 
+	/*
+		List the names of the extended attributes set on a path,
+		without fetching any of their values.
+		Does not follow symlinks (like LStat).
+
+		Returns an empty slice if the path has no xattrs, and an error
+		of category ErrNotSupported if the filesystem has no xattrs at all.
+	*/
+	LListXattr(path RelPath) ([]string, error)
+
+	/*
+		Get all the extended attributes set on a path, names and values.
+		Does not follow symlinks.
+		Errors are as for LListXattr.
+	*/
+	LGetXattr(path RelPath) (map[string][]byte, error)
+
+	/*
+		Set one extended attribute on a path, creating or replacing it.
+		Does not follow symlinks.
+	*/
+	LSetXattr(path RelPath, name string, value []byte) error
+
+	/*
+		Report the size and free space of the filesystem holding path
+		(following symlinks, like statfs(2)).
+
+		Returns an error of category ErrNotSupported if there's no such
+		thing to report, as for filesystems that aren't on a disk.
+	*/
+	Statfs(path RelPath) (FsStat, error)
+
 	/*
 		Resolve a symlink (within the confines of the basepath!), returning
 		the path to the final result.
@@ -71,6 +146,24 @@ type FS interface {
 	ResolveLink(symlink string, startingAt RelPath) (RelPath, error)
 }
 
+/*
+	Space on a filesystem, in bytes, as reported by FS.Statfs.
+*/
+type FsStat struct {
+	Size      uint64 // total size of the filesystem
+	Free      uint64 // space not in use
+	Available uint64 // space not in use that an unprivileged user may use (less than Free, if some is reserved for root)
+}
+
+/*
+	Identifies an inode, as reported by FS.LInode.
+*/
+type Inode struct {
+	Dev   uint64 // which device (filesystem) the inode is on
+	Ino   uint64 // the inode number within that device
+	Nlink uint64 // how many names (hardlinks) the inode has
+}
+
 type File interface {
 	io.Closer
 	io.Reader
@@ -0,0 +1,668 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	An fs.FS that lives entirely in memory.
+
+	This is for tests: it can hold ownership, device nodes, setuid bits,
+	and xattrs without needing any privileges to create them, and it never
+	touches a real disk.  Errors are the same categories osfs would return
+	(we build the same syscall errors and normalize them the same way).
+
+	The process is treated as all-powerful: there are no permission checks.
+	Symlinks are resolved exactly like osfs does, including confinement to
+	the filesystem root.
+*/
+package memfs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Returns a new, empty filesystem (just a root dir, 0755).
+
+	The basePath is only used for reporting (BasePath, and paths in errors);
+	nothing is ever read or written there.
+*/
+func New(basePath fs.AbsolutePath) fs.FS {
+	now := time.Now()
+	return &memFS{
+		basePath: basePath,
+		dev:      atomic.AddUint64(&lastDev, 1),
+		lastIno:  1,
+		root: &node{
+			ino:   1,
+			nlink: 1,
+			meta: fs.Metadata{
+				Type:  fs.Type_Dir,
+				Perms: 0755,
+				Uid:   uint32(os.Getuid()),
+				Gid:   uint32(os.Getgid()),
+				Mtime: now, Atime: now, Ctime: now,
+			},
+			children: map[string]*node{},
+		},
+	}
+}
+
+// Each memfs is a device of its own, so inodes in different ones never look alike.
+var lastDev uint64
+
+type memFS struct {
+	mu       sync.Mutex
+	basePath fs.AbsolutePath
+	dev      uint64
+	lastIno  uint64
+	root     *node
+}
+
+type node struct {
+	ino      uint64
+	nlink    uint64           // how many names the node has.  (Dirs don't count their children's "..".)
+	meta     fs.Metadata      // Name is ignored; it's filled in by whoever asks.
+	children map[string]*node // if dir.
+	body     []byte           // if file.
+	xattrs   map[string][]byte
+}
+
+func (afs *memFS) BasePath() fs.AbsolutePath {
+	return afs.basePath
+}
+
+func (afs *memFS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	// Like open(2) without O_NOFOLLOW, a symlink in the last position is followed
+	//  -- unless we're only here to exclusively create, in which case it's just "exists".
+	exclusive := flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0
+	rpath, err := afs.realpath(path, !exclusive)
+	if err != nil {
+		return nil, err
+	}
+	n, err := afs.lookup(rpath)
+	switch Category(err) {
+	case nil:
+		if exclusive {
+			return nil, afs.pathError("open", rpath, syscall.EEXIST)
+		}
+	case fs.ErrNotExists:
+		if flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		n, err = afs.create(rpath, fs.Metadata{Type: fs.Type_File, Perms: perms})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	f := &memFile{afs: afs, n: n, name: afs.basePath.Join(rpath).String()}
+	switch flag & syscall.O_ACCMODE {
+	case os.O_RDONLY:
+		f.readable = true
+	case os.O_WRONLY:
+		f.writable = true
+	case os.O_RDWR:
+		f.readable, f.writable = true, true
+	}
+	f.appending = flag&os.O_APPEND != 0
+	if n.meta.Type == fs.Type_Dir && f.writable {
+		return nil, afs.pathError("open", rpath, syscall.EISDIR)
+	}
+	if flag&os.O_TRUNC != 0 && f.writable && n.meta.Type == fs.Type_File {
+		n.body = nil
+		n.touch()
+	}
+	return f, nil
+}
+
+func (afs *memFS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	return afs.mknode(path, fs.Metadata{Type: fs.Type_Dir, Perms: perms})
+}
+
+func (afs *memFS) Mklink(path fs.RelPath, target string) error {
+	return afs.mknode(path, fs.Metadata{Type: fs.Type_Symlink, Perms: 0777, Linkname: target})
+}
+
+func (afs *memFS) Mkhardlink(path fs.RelPath, target fs.RelPath) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rtarget, err := afs.realpath(target, false)
+	if err != nil {
+		return err
+	}
+	n, err := afs.lookup(rtarget)
+	if err != nil {
+		return err
+	}
+	if n.meta.Type == fs.Type_Dir {
+		return afs.pathError("link", rtarget, syscall.EPERM)
+	}
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	// Same checks as making any other node; then it's just another name for the same one.
+	if _, err := afs.create(rpath, fs.Metadata{Type: fs.Type_File}); err != nil {
+		return err
+	}
+	parent, _ := afs.lookup(rpath.Dir())
+	parent.children[rpath.Last()] = n
+	n.nlink++
+	n.meta.Ctime = time.Now()
+	return nil
+}
+
+func (afs *memFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return afs.mknode(path, fs.Metadata{Type: fs.Type_NamedPipe, Perms: perms})
+}
+
+func (afs *memFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknode(path, fs.Metadata{Type: fs.Type_Device, Perms: perms, Devmajor: major, Devminor: minor})
+}
+
+func (afs *memFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknode(path, fs.Metadata{Type: fs.Type_CharDevice, Perms: perms, Devmajor: major, Devminor: minor})
+}
+
+func (afs *memFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return afs.modify(path, false, func(n *node) {
+		n.meta.Uid, n.meta.Gid = uid, gid
+	})
+}
+
+func (afs *memFS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	return afs.modify(path, true, func(n *node) {
+		n.meta.Perms = perms & 07777
+	})
+}
+
+func (afs *memFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.modify(path, false, func(n *node) {
+		n.meta.Mtime, n.meta.Atime = mtime, atime
+	})
+}
+
+func (afs *memFS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.modify(path, true, func(n *node) {
+		n.meta.Mtime, n.meta.Atime = mtime, atime
+	})
+}
+
+func (afs *memFS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, true, false)
+}
+
+func (afs *memFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false, false)
+}
+
+func (afs *memFS) LStatWithXattrs(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false, true)
+}
+
+func (afs *memFS) LInode(path fs.RelPath) (fs.Inode, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, false)
+	if err != nil {
+		return fs.Inode{}, err
+	}
+	return fs.Inode{afs.dev, n.ino, n.nlink}, nil
+}
+
+func (afs *memFS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, rpath, err := afs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.meta.Type != fs.Type_Dir {
+		return nil, afs.pathError("readdirent", rpath, syscall.ENOTDIR)
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (afs *memFS) ReadDir(path fs.RelPath) ([]fs.Metadata, error) {
+	names, err := afs.ReadDirNames(path)
+	if err != nil {
+		return nil, err
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.Metadata, 0, len(names))
+	for _, name := range names {
+		child, ok := n.children[name]
+		if !ok {
+			continue // raced with a change between our two locks; it's gone.
+		}
+		fmeta := child.stat(path.Join(fs.MustRelPath(name)))
+		fmeta.Linkname = "" // as promised: cheap, like osfs.
+		entries = append(entries, fmeta)
+	}
+	return entries, nil
+}
+
+func (afs *memFS) Readlink(path fs.RelPath) (string, bool, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return "", false, err
+	}
+	return afs.readlink(rpath)
+}
+
+func (afs *memFS) LListXattr(path fs.RelPath) ([]string, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for k := range n.xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (afs *memFS) LGetXattr(path fs.RelPath) (map[string][]byte, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(n.xattrs))
+	for k, v := range n.xattrs {
+		xattrs[k] = append([]byte{}, v...)
+	}
+	return xattrs, nil
+}
+
+func (afs *memFS) LSetXattr(path fs.RelPath, name string, value []byte) error {
+	return afs.modify(path, false, func(n *node) {
+		if n.xattrs == nil {
+			n.xattrs = map[string][]byte{}
+		}
+		n.xattrs[name] = append([]byte{}, value...)
+	})
+}
+
+func (afs *memFS) Statfs(path fs.RelPath) (fs.FsStat, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if _, _, err := afs.resolve(path, true); err != nil {
+		return fs.FsStat{}, err
+	}
+	return fs.FsStat{}, Errorf(fs.ErrNotSupported, "memfs has no fixed size to report")
+}
+
+func (afs *memFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if err := startingAt.Validate(); err != nil {
+		return startingAt, err
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
+}
+
+//
+// Internals.  Everything below expects the lock to be held.
+//
+
+func (afs *memFS) stat(path fs.RelPath, resolveLast bool, withXattrs bool) (*fs.Metadata, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, resolveLast)
+	if err != nil {
+		return nil, err
+	}
+	fmeta := n.stat(path)
+	if withXattrs && len(n.xattrs) > 0 {
+		fmeta.Xattrs = make(map[string]string, len(n.xattrs))
+		for k, v := range n.xattrs {
+			fmeta.Xattrs[k] = string(v)
+		}
+	}
+	return &fmeta, nil
+}
+
+// Make a new node of any kind but plain file (those come from OpenFile).
+func (afs *memFS) mknode(path fs.RelPath, fmeta fs.Metadata) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	_, err = afs.create(rpath, fmeta)
+	return err
+}
+
+// Find a node and apply some change to it.
+func (afs *memFS) modify(path fs.RelPath, resolveLast bool, fn func(*node)) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	n, _, err := afs.resolve(path, resolveLast)
+	if err != nil {
+		return err
+	}
+	fn(n)
+	n.meta.Ctime = time.Now()
+	return nil
+}
+
+// Add a node at an already-resolved path.
+//  The parent must exist and be a dir; the path must not exist.
+func (afs *memFS) create(rpath fs.RelPath, fmeta fs.Metadata) (*node, error) {
+	if rpath == (fs.RelPath{}) {
+		return nil, afs.pathError("mkdir", rpath, syscall.EEXIST)
+	}
+	parent, err := afs.lookup(rpath.Dir())
+	if err != nil {
+		return nil, err
+	}
+	if parent.meta.Type != fs.Type_Dir {
+		return nil, afs.pathError("mkdir", rpath, syscall.ENOTDIR)
+	}
+	name := rpath.Last()
+	if _, exists := parent.children[name]; exists {
+		return nil, afs.pathError("mkdir", rpath, syscall.EEXIST)
+	}
+	now := time.Now()
+	fmeta.Name = fs.RelPath{}
+	fmeta.Perms &= 07777
+	fmeta.Uid = uint32(os.Getuid())
+	fmeta.Gid = uint32(os.Getgid())
+	fmeta.Mtime, fmeta.Atime, fmeta.Ctime = now, now, now
+	afs.lastIno++
+	n := &node{ino: afs.lastIno, nlink: 1, meta: fmeta}
+	if fmeta.Type == fs.Type_Dir {
+		n.children = map[string]*node{}
+	}
+	parent.children[name] = n
+	parent.touch()
+	return n, nil
+}
+
+// Resolve a path (as osfs would) and find the node.
+func (afs *memFS) resolve(path fs.RelPath, resolveLast bool) (*node, fs.RelPath, error) {
+	rpath, err := afs.realpath(path, resolveLast)
+	if err != nil {
+		return nil, rpath, err
+	}
+	n, err := afs.lookup(rpath)
+	return n, rpath, err
+}
+
+// Find the node at a path, without following any symlinks.
+//  (Use realpath first if you want that.)
+func (afs *memFS) lookup(rpath fs.RelPath) (*node, error) {
+	n := afs.root
+	for _, segment := range segmentsOf(rpath) {
+		if n.meta.Type != fs.Type_Dir {
+			return nil, afs.pathError("lstat", rpath, syscall.ENOTDIR)
+		}
+		child, ok := n.children[segment]
+		if !ok {
+			return nil, afs.pathError("lstat", rpath, syscall.ENOENT)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (afs *memFS) readlink(rpath fs.RelPath) (string, bool, error) {
+	n, err := afs.lookup(rpath)
+	if err != nil {
+		return "", false, err
+	}
+	if n.meta.Type != fs.Type_Symlink {
+		return "", false, nil
+	}
+	return n.meta.Linkname, true, nil
+}
+
+// Same algorithm as osfs: resolve every symlink on the way, confined to our root,
+//  and the last one too if resolveLast.
+func (afs *memFS) realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+	if err := path.Validate(); err != nil {
+		return path, err
+	}
+	segments := segmentsOf(path)
+	iLast := len(segments) - 1
+	resolved := fs.RelPath{}
+	for i, segment := range segments {
+		resolved = resolved.Join(fs.MustRelPath(segment))
+		if i == iLast && !resolveLast {
+			return resolved, nil
+		}
+		morelink, isLink, err := afs.readlink(resolved)
+		if err != nil {
+			if i == iLast && Category(err) == fs.ErrNotExists {
+				return resolved, nil // might be about to be created; the caller will see.
+			}
+			return resolved, err
+		}
+		if isLink {
+			resolved, err = afs.resolveLink(morelink, resolved, map[fs.RelPath]struct{}{})
+			if err != nil {
+				return resolved, err
+			}
+		}
+	}
+	return resolved, nil
+}
+
+func (afs *memFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
+	if _, isSeen := seen[startingAt]; isSeen {
+		return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+	}
+	seen[startingAt] = struct{}{}
+	segments := strings.Split(symlink, "/")
+	path := startingAt
+	if segments[0] == "" { // rooted
+		path = fs.RelPath{}
+		segments = segments[1:]
+	} else {
+		path = startingAt.Dir() // drop the link node itself
+	}
+	iLast := len(segments) - 1
+	for i, s := range segments {
+		// Identity segments can simply be skipped.
+		if s == "" || s == "." {
+			continue
+		}
+		// Excessive up segements aren't an error; they simply no-op when already at root.
+		if s == ".." && path == (fs.RelPath{}) {
+			continue
+		}
+		// Okay, join the segment and peek at it.
+		if s == ".." {
+			path = path.Dir()
+		} else {
+			path = path.Join(fs.MustRelPath(s))
+		}
+		// Bail on cycles before considering recursion!
+		if path == startingAt {
+			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+		}
+		// Check if this is a symlink; if so we must recurse on it.
+		morelink, isLink, err := afs.readlink(path)
+		if err != nil {
+			if i == iLast && Category(err) == fs.ErrNotExists {
+				return path, nil
+			}
+			return startingAt, err
+		}
+		if isLink {
+			path, err = afs.resolveLink(morelink, path, seen)
+			if err != nil {
+				return startingAt, err
+			}
+		}
+	}
+	return path, nil
+}
+
+// Errors are made exactly as the os would have, then normalized the same way osfs does.
+func (afs *memFS) pathError(op string, rpath fs.RelPath, errno syscall.Errno) error {
+	return fs.NormalizeIOError(&os.PathError{Op: op, Path: afs.basePath.Join(rpath).String(), Err: errno})
+}
+
+func segmentsOf(path fs.RelPath) []string {
+	return strings.Split(path.String(), "/")[1:]
+}
+
+func (n *node) stat(name fs.RelPath) fs.Metadata {
+	fmeta := n.meta
+	fmeta.Name = name
+	if fmeta.Type == fs.Type_File {
+		fmeta.Size = int64(len(n.body))
+	}
+	return fmeta
+}
+
+// Update mtime (and ctime), as any content change does.
+func (n *node) touch() {
+	now := time.Now()
+	n.meta.Mtime, n.meta.Ctime = now, now
+}
+
+var _ fs.File = &memFile{}
+
+type memFile struct {
+	afs       *memFS
+	n         *node
+	name      string // absolute, for errors.
+	off       int64
+	readable  bool
+	writable  bool
+	appending bool
+	closed    bool
+}
+
+func (f *memFile) Close() error {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return f.pathError("close", syscall.EBADF)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Read(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, off)
+	if err == nil && n < len(bs) {
+		err = io.EOF // ReadAt must explain short reads.
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(bs []byte, off int64) (int, error) {
+	switch {
+	case f.closed || !f.readable:
+		return 0, f.pathError("read", syscall.EBADF)
+	case f.n.meta.Type == fs.Type_Dir:
+		return 0, f.pathError("read", syscall.EISDIR)
+	case off >= int64(len(f.n.body)):
+		return 0, io.EOF
+	}
+	return copy(bs, f.n.body[off:]), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return 0, f.pathError("seek", syscall.EBADF)
+	}
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.off + offset
+	case io.SeekEnd:
+		abs = int64(len(f.n.body)) + offset
+	default:
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	if abs < 0 {
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	f.off = abs
+	return abs, nil
+}
+
+func (f *memFile) Write(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.appending {
+		f.off = int64(len(f.n.body))
+	}
+	n, err := f.writeAt(bs, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	return f.writeAt(bs, off)
+}
+
+func (f *memFile) writeAt(bs []byte, off int64) (int, error) {
+	if f.closed || !f.writable {
+		return 0, f.pathError("write", syscall.EBADF)
+	}
+	if end := off + int64(len(bs)); end > int64(len(f.n.body)) {
+		grown := make([]byte, end)
+		copy(grown, f.n.body)
+		f.n.body = grown
+	}
+	copy(f.n.body[off:], bs)
+	f.n.touch()
+	return len(bs), nil
+}
+
+func (f *memFile) pathError(op string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: f.name, Err: errno}
+}
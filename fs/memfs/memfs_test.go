@@ -0,0 +1,127 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package memfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/tests"
+)
+
+func TestAll(t *testing.T) {
+	Convey("memfs spec compliance tests", t, func() {
+		afs := New(fs.MustAbsolutePath("/mem"))
+
+		tests.CheckBaseLstat(afs)
+		tests.CheckMkdirLstatRoundtrip(afs)
+		tests.CheckDeepMkdirError(afs)
+		tests.CheckMklinkLstatRoundtrip(afs)
+		tests.CheckSetTimesRoundtrip(afs)
+		tests.CheckHardlinkInodes(afs)
+		tests.CheckSymlinks(afs)
+		tests.CheckPerniciousSymlinks(afs)
+		tests.CheckOpsTraversingSymlinks(afs)
+	})
+}
+
+func TestUnprivileged(t *testing.T) {
+	Convey("memfs should do root-only things without root", t, func() {
+		afs := New(fs.MustAbsolutePath("/mem"))
+		f1 := fs.MustRelPath("f1")
+		f, err := afs.OpenFile(f1, os.O_CREATE|os.O_WRONLY, 04755)
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		Convey("chown to any uid and gid", func() {
+			So(afs.Lchown(f1, 4000, 5000), ShouldBeNil)
+			fmeta, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(fmeta.Uid, ShouldEqual, 4000)
+			So(fmeta.Gid, ShouldEqual, 5000)
+			So(fmeta.Perms, ShouldEqual, 04755)
+		})
+		Convey("make devices", func() {
+			dev := fs.MustRelPath("dev")
+			So(afs.MkdevChar(dev, 1, 3, 0666), ShouldBeNil)
+			fmeta, err := afs.LStat(dev)
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_CharDevice)
+			So(fmeta.Devmajor, ShouldEqual, 1)
+			So(fmeta.Devminor, ShouldEqual, 3)
+		})
+		Convey("set trusted xattrs", func() {
+			So(afs.LSetXattr(f1, "trusted.x", []byte("y")), ShouldBeNil)
+			fmeta, err := afs.LStatWithXattrs(f1)
+			So(err, ShouldBeNil)
+			So(fmeta.Xattrs, ShouldResemble, map[string]string{"trusted.x": "y"})
+		})
+	})
+}
+
+func TestFiles(t *testing.T) {
+	Convey("memfs files", t, func() {
+		afs := New(fs.MustAbsolutePath("/mem"))
+		f1 := fs.MustRelPath("f1")
+		f, err := afs.OpenFile(f1, os.O_CREATE|os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		f.Write([]byte("hello"))
+		So(f.Close(), ShouldBeNil)
+
+		Convey("should read back what was written", func() {
+			f, err := afs.OpenFile(f1, os.O_RDONLY, 0)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			bs, err := ioutil.ReadAll(f)
+			So(err, ShouldBeNil)
+			So(string(bs), ShouldEqual, "hello")
+			fmeta, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(fmeta.Size, ShouldEqual, 5)
+		})
+		Convey("should append and truncate", func() {
+			f, err := afs.OpenFile(f1, os.O_WRONLY|os.O_APPEND, 0)
+			So(err, ShouldBeNil)
+			f.Write([]byte(" world"))
+			f.Close()
+			fmeta, _ := afs.LStat(f1)
+			So(fmeta.Size, ShouldEqual, 11)
+			f, err = afs.OpenFile(f1, os.O_WRONLY|os.O_TRUNC, 0)
+			So(err, ShouldBeNil)
+			f.Close()
+			fmeta, _ = afs.LStat(f1)
+			So(fmeta.Size, ShouldEqual, 0)
+		})
+		Convey("exclusive create should refuse existing files", func() {
+			_, err := afs.OpenFile(f1, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			So(err, errcat.ErrorShouldHaveCategory, fs.ErrAlreadyExists)
+		})
+		Convey("should refuse to write a read-only handle", func() {
+			f, err := afs.OpenFile(f1, os.O_RDONLY, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("x"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("hardlinks should be the same file", func() {
+			f2 := fs.MustRelPath("f2")
+			So(afs.Mkhardlink(f2, f1), ShouldBeNil)
+			So(afs.Chmod(f2, 0600), ShouldBeNil)
+			fmeta, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(fmeta.Perms, ShouldEqual, 0600)
+			So(afs.Mkhardlink(fs.MustRelPath("d"), fs.RelPath{}), errcat.ErrorShouldHaveCategory, fs.ErrPermission)
+		})
+		Convey("files are not dirs", func() {
+			So(afs.Mkdir(fs.MustRelPath("f1/d"), 0755), errcat.ErrorShouldHaveCategory, fs.ErrNotDir)
+			_, err := afs.ReadDirNames(f1)
+			So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotDir)
+		})
+	})
+}
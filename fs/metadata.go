@@ -20,12 +20,16 @@ type Metadata struct {
 	Devmajor int64     // major number of character or block device
 	Devminor int64     // minor number of character or block device
 	Mtime    time.Time // modified time
+	Atime    time.Time // access time (as reported by stat; zero where the platform doesn't say)
+	Ctime    time.Time // change time (as reported by stat; zero where the platform doesn't say)
 	Xattrs   map[string]string
 
-	// Notably absent fields:
-	//  - ctime -- it's pointless to keep; you can't set such a thing in any posix filesystem.
-	//  - atime -- similarly pointless; you can set it, but maybe, with asterisks, and it's
+	// Note that Atime and Ctime are informational only: they're not part of
+	//  any hash, and not placed on unpack.
+	//  - ctime -- you can't set such a thing in any posix filesystem.
+	//  - atime -- you can set it, but maybe, with asterisks, and it's
 	//     almost certain end up trampled again moments later.
+	//  They're still useful to look at, e.g. for change detection.
 }
 
 /*
@@ -72,6 +76,7 @@ const (
 	Type_Device     Type = 'D'
 	Type_CharDevice Type = 'c'
 	Type_Hardlink   Type = 'h' // Rare, and may only appear contextually.
+	Type_Whiteout   Type = 'w' // A deletion, in a fileset layered over another.  Never on disk as such.
 )
 
 func (t Type) String() string {
@@ -92,6 +97,8 @@ func (t Type) String() string {
 		return "chardev"
 	case Type_Hardlink:
 		return "hardline"
+	case Type_Whiteout:
+		return "whiteout"
 	case Type_Invalid:
 		fallthrough
 	default:
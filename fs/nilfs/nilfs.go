@@ -48,6 +48,14 @@ func (afs *nilFS) Mklink(path fs.RelPath, target string) error {
 	return nil
 }
 
+func (afs *nilFS) Mkhardlink(path fs.RelPath, target fs.RelPath) error {
+	if _, err := afs.realpath(path, false); err != nil {
+		return err
+	}
+	_, err := afs.realpath(target, false)
+	return err
+}
+
 func (afs *nilFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
 	_, err := afs.realpath(path, false)
 	if err != nil {
@@ -120,6 +128,18 @@ func (afs *nilFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
 	return &fs.Metadata{}, nil
 }
 
+func (afs *nilFS) LStatWithXattrs(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.LStat(path)
+}
+
+func (afs *nilFS) LInode(path fs.RelPath) (fs.Inode, error) {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return fs.Inode{}, err
+	}
+	return fs.Inode{}, nil
+}
+
 func (afs *nilFS) ReadDirNames(path fs.RelPath) ([]string, error) {
 	_, err := afs.realpath(path, false)
 	if err != nil {
@@ -128,6 +148,14 @@ func (afs *nilFS) ReadDirNames(path fs.RelPath) ([]string, error) {
 	return nil, nil
 }
 
+func (afs *nilFS) ReadDir(path fs.RelPath) ([]fs.Metadata, error) {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
 func (afs *nilFS) Readlink(path fs.RelPath) (string, bool, error) {
 	_, err := afs.realpath(path, false)
 	if err != nil {
@@ -136,20 +164,52 @@ func (afs *nilFS) Readlink(path fs.RelPath) (string, bool, error) {
 	return "", false, nil
 }
 
+func (afs *nilFS) LListXattr(path fs.RelPath) ([]string, error) {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return []string{}, nil
+}
+
+func (afs *nilFS) LGetXattr(path fs.RelPath) (map[string][]byte, error) {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{}, nil
+}
+
+func (afs *nilFS) LSetXattr(path fs.RelPath, name string, value []byte) error {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (afs *nilFS) Statfs(path fs.RelPath) (fs.FsStat, error) {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return fs.FsStat{}, err
+	}
+	return fs.FsStat{}, Errorf(fs.ErrNotSupported, "nilfs has no space to report")
+}
+
 // resolves a path.
 // resolving a path can have errors traversing things and still return nil error,
 //  because failure to resolve the path doesn't necessarily mean you shouldn't try.
 // (it does however return real errors in case of ErrRecurse and ErrBreakout.)
 func (afs *nilFS) realpath(path fs.RelPath, resolveLast bool) (string, error) {
-	if path.GoesUp() {
-		return "", Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	if err := path.Validate(); err != nil {
+		return "", err
 	}
 	return afs.BasePath().Join(path).String(), nil
 }
 
 func (afs *nilFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
-	if startingAt.GoesUp() {
-		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	if err := startingAt.Validate(); err != nil {
+		return startingAt, err
 	}
 	return startingAt, nil
 }
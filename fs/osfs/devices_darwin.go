@@ -0,0 +1,24 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Darwin's dev_t is 32 bits: 8 of major, then 24 of minor (see sys/types.h).
+
+package osfs
+
+import (
+	"syscall"
+)
+
+func devModesJoin(major int64, minor int64) uint32 {
+	return uint32(((major & 0xff) << 24) | (minor & 0xffffff))
+}
+
+func devModesSplit(rdev uint64) (major int64, minor int64) {
+	return int64((rdev >> 24) & 0xff), int64(rdev & 0xffffff)
+}
+
+func statDevice(sys *syscall.Stat_t) (major int64, minor int64) {
+	return devModesSplit(uint64(uint32(sys.Rdev)))
+}
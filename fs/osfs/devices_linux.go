@@ -0,0 +1,36 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Device numbers pack major and minor differently on every platform.
+
+package osfs
+
+import (
+	"syscall"
+)
+
+/*
+	Linux's dev_t is 64 bits, laid out as glibc's makedev does it: the low
+	8 bits of minor, then the low 12 of major, then the rest of minor, then
+	the rest of major.  (The old 16-bit layout is the bottom of this, so
+	small numbers come out the same either way.)
+*/
+func devModesJoin(major int64, minor int64) uint64 {
+	maj, min := uint64(major), uint64(minor)
+	return (maj&0x00000fff)<<8 |
+		(maj&0xfffff000)<<32 |
+		(min & 0x000000ff) |
+		(min&0xffffff00)<<12
+}
+
+func devModesSplit(rdev uint64) (major int64, minor int64) {
+	major = int64((rdev&0x00000000000fff00)>>8 | (rdev&0xfffff00000000000)>>32)
+	minor = int64((rdev & 0x00000000000000ff) | (rdev&0x00000ffffff00000)>>12)
+	return major, minor
+}
+
+func statDevice(sys *syscall.Stat_t) (major int64, minor int64) {
+	return devModesSplit(sys.Rdev)
+}
@@ -0,0 +1,51 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package osfs
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestDevModesLinux(t *testing.T) {
+	Convey("device numbers should be encoded the same as glibc's makedev", t, func() {
+		for _, tr := range []struct {
+			major, minor int64
+			rdev         uint64
+		}{
+			{8, 1, 0x801},
+			{259, 300000, 0x493103e0},
+			{0x12345, 0xabcdef, 0x1200abcd345ef},
+			{0x7fffffff, 0x7fffffff, 0x7ffff7ffffffffff},
+			{0xffffffff, 0xffffffff, 0xffffffffffffffff},
+		} {
+			So(devModesJoin(tr.major, tr.minor), ShouldEqual, tr.rdev)
+			major, minor := devModesSplit(tr.rdev)
+			So([2]int64{major, minor}, ShouldResemble, [2]int64{tr.major, tr.minor})
+		}
+	})
+}
+
+func TestMkdevRoundtrip(t *testing.T) {
+	testutil.RequiresRoot(t)
+	Convey("device nodes with big numbers should lstat back as made", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			// The kernel keeps 12 bits of major and 20 of minor; these use all of them.
+			So(afs.MkdevBlock(fs.MustRelPath("blk"), 4095, 0xfffff, 0600), ShouldBeNil)
+			So(afs.MkdevChar(fs.MustRelPath("chr"), 259, 300000, 0600), ShouldBeNil)
+			fmeta, err := afs.LStat(fs.MustRelPath("blk"))
+			So(err, ShouldBeNil)
+			So([2]int64{fmeta.Devmajor, fmeta.Devminor}, ShouldResemble, [2]int64{4095, 0xfffff})
+			fmeta, err = afs.LStat(fs.MustRelPath("chr"))
+			So(err, ShouldBeNil)
+			So([2]int64{fmeta.Devmajor, fmeta.Devminor}, ShouldResemble, [2]int64{259, 300000})
+		})
+	})
+}
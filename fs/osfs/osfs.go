@@ -7,6 +7,7 @@ package osfs
 
 import (
 	"os"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -57,13 +58,26 @@ func (afs *osFS) Mklink(path fs.RelPath, target string) error {
 	return fs.NormalizeIOError(err)
 }
 
+func (afs *osFS) Mkhardlink(path fs.RelPath, target fs.RelPath) error {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	rtarget, err := afs.realpath(target, false)
+	if err != nil {
+		return err
+	}
+	err = os.Link(rtarget, rpath)
+	return fs.NormalizeIOError(err)
+}
+
 func (afs *osFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
 	rpath, err := afs.realpath(path, false)
 	if err != nil {
 		return err
 	}
 	err = syscall.Mkfifo(rpath, uint32(perms&07777))
-	return fs.NormalizeIOError(err)
+	return fs.NormalizeIOError(reinstateHighPerms(rpath, perms, err))
 }
 
 func (afs *osFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
@@ -73,7 +87,7 @@ func (afs *osFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.
 	}
 	mode := uint32(perms&07777) | syscall.S_IFBLK
 	err = syscall.Mknod(rpath, mode, int(devModesJoin(major, minor)))
-	return fs.NormalizeIOError(err)
+	return fs.NormalizeIOError(reinstateHighPerms(rpath, perms, err))
 }
 
 func (afs *osFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
@@ -83,7 +97,20 @@ func (afs *osFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.P
 	}
 	mode := uint32(perms&07777) | syscall.S_IFCHR
 	err = syscall.Mknod(rpath, mode, int(devModesJoin(major, minor)))
-	return fs.NormalizeIOError(err)
+	return fs.NormalizeIOError(reinstateHighPerms(rpath, perms, err))
+}
+
+/*
+	Mknod (and mkfifo) may quietly drop setuid and setgid -- e.g. setgid,
+	when the node's group isn't one of ours -- so if any of the high bits
+	were asked for, set the perms again now, with an explicit chmod.
+	(Passes through an error from the create, doing nothing.)
+*/
+func reinstateHighPerms(rpath string, perms fs.Perms, err error) error {
+	if err != nil || perms&(fs.Perms_Setuid|fs.Perms_Setgid|fs.Perms_Sticky) == 0 {
+		return err
+	}
+	return os.Chmod(rpath, permsToOs(perms))
 }
 
 func (afs *osFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
@@ -128,7 +155,58 @@ func (afs *osFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
 	return afs.convertFileinfo(path, fi)
 }
 
+func (afs *osFS) LStatWithXattrs(path fs.RelPath) (*fs.Metadata, error) {
+	fmeta, err := afs.LStat(path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs, err := afs.LGetXattr(path)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotSupported:
+		return fmeta, nil
+	default:
+		return nil, err
+	}
+	if len(xattrs) > 0 {
+		fmeta.Xattrs = make(map[string]string, len(xattrs))
+		for k, v := range xattrs {
+			fmeta.Xattrs[k] = string(v)
+		}
+	}
+	return fmeta, nil
+}
+
+func (afs *osFS) LInode(path fs.RelPath) (fs.Inode, error) {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return fs.Inode{}, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(rpath, &st); err != nil {
+		return fs.Inode{}, fs.NormalizeIOError(&os.PathError{"lstat", rpath, err})
+	}
+	// The field types differ by platform, hence the conversions.
+	return fs.Inode{uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink)}, nil
+}
+
 func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata, error) {
+	fmeta := convertFileinfoCheap(path, fi)
+	// If it's a symlink, get that info.
+	//  It's an extra syscall, but we almost always want it.
+	if fmeta.Type == fs.Type_Symlink {
+		target, _, err := afs.readlink(afs.basePath.Join(path).String())
+		if err != nil {
+			return nil, err
+		}
+		fmeta.Linkname = target
+	}
+	return fmeta, nil
+}
+
+// Everything convertFileinfo does, except the extra syscall to read symlinks.
+func convertFileinfoCheap(path fs.RelPath, fi os.FileInfo) *fs.Metadata {
 	// Copy over the easy 1-to-1 parts.
 	fmeta := &fs.Metadata{
 		Name:  path,
@@ -144,13 +222,6 @@ func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata,
 		fmeta.Type = fs.Type_Dir
 	case os.ModeSymlink:
 		fmeta.Type = fs.Type_Symlink
-		// If it's a symlink, get that info.
-		//  It's an extra syscall, but we almost always want it.
-		if target, _, err := afs.readlink(afs.basePath.Join(path).String()); err == nil {
-			fmeta.Linkname = target
-		} else {
-			return nil, err
-		}
 	case os.ModeNamedPipe:
 		fmeta.Type = fs.Type_NamedPipe
 	case os.ModeSocket:
@@ -180,20 +251,22 @@ func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata,
 		fmeta.Size = fi.Size()
 	}
 
-	// Munge UID and GID bits.  These are platform dependent.
+	// Munge UID and GID bits, and atime and ctime.  These are platform dependent.
 	// Also munge device bits if applicable; also platform dependent.
 	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
 		fmeta.Uid = sys.Uid
 		fmeta.Gid = sys.Gid
+		fmeta.Atime, fmeta.Ctime = statTimes(sys)
 		if fmeta.Type == fs.Type_Device || fmeta.Type == fs.Type_CharDevice {
-			fmeta.Devmajor, fmeta.Devminor = devModesSplit(sys.Rdev)
+			fmeta.Devmajor, fmeta.Devminor = statDevice(sys)
 		}
 	}
 
 	// Xattrs are not set by this method, because they require an unbounded
 	//  number of additional syscalls (1 to list, $n to get values).
+	//  Use LStatWithXattrs (or LGetXattr) for those.
 
-	return fmeta, nil
+	return fmeta
 }
 
 func (afs *osFS) ReadDirNames(path fs.RelPath) ([]string, error) {
@@ -213,6 +286,30 @@ func (afs *osFS) ReadDirNames(path fs.RelPath) ([]string, error) {
 	return names, nil
 }
 
+func (afs *osFS) ReadDir(path fs.RelPath) ([]fs.Metadata, error) {
+	rpath, err := afs.realpath(path, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(rpath)
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	entries := make([]fs.Metadata, len(fis))
+	for i, fi := range fis {
+		entries[i] = *convertFileinfoCheap(path.Join(fs.MustRelPath(fi.Name())), fi)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name.String() < entries[j].Name.String()
+	})
+	return entries, nil
+}
+
 func (afs *osFS) Readlink(path fs.RelPath) (string, bool, error) {
 	rpath, err := afs.realpath(path, false)
 	if err != nil {
@@ -222,6 +319,25 @@ func (afs *osFS) Readlink(path fs.RelPath) (string, bool, error) {
 	err = fs.NormalizeIOError(err)
 	return target, isLink, err
 }
+
+func (afs *osFS) Statfs(path fs.RelPath) (fs.FsStat, error) {
+	rpath, err := afs.realpath(path, true)
+	if err != nil {
+		return fs.FsStat{}, err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(rpath, &st); err != nil {
+		return fs.FsStat{}, fs.NormalizeIOError(&os.PathError{"statfs", rpath, err})
+	}
+	// Counts are in blocks; the field types differ by platform, hence the conversions.
+	bsize := uint64(st.Bsize)
+	return fs.FsStat{
+		Size:      uint64(st.Blocks) * bsize,
+		Free:      uint64(st.Bfree) * bsize,
+		Available: uint64(st.Bavail) * bsize,
+	}, nil
+}
+
 func (afs *osFS) readlink(path string) (string, bool, error) {
 	target, err := os.Readlink(path)
 	switch {
@@ -242,8 +358,8 @@ func (afs *osFS) readlink(path string) (string, bool, error) {
 //  because failure to resolve the path doesn't necessarily mean you shouldn't try.
 // (it does however return real errors in case of ErrRecurse and ErrBreakout.)
 func (afs *osFS) realpath(path fs.RelPath, resolveLast bool) (string, error) {
-	if path.GoesUp() {
-		return "", Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	if err := path.Validate(); err != nil {
+		return "", err
 	}
 	path, err := afs._realpath(path, resolveLast)
 	return afs.BasePath().Join(path).String(), err
@@ -272,8 +388,8 @@ func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error
 }
 
 func (afs *osFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
-	if startingAt.GoesUp() {
-		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	if err := startingAt.Validate(); err != nil {
+		return startingAt, err
 	}
 	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
 }
@@ -301,7 +417,11 @@ func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.
 			continue
 		}
 		// Okay, join the segment and peek at it.
-		path = path.Join(fs.MustRelPath(s))
+		if s == ".." {
+			path = path.Dir()
+		} else {
+			path = path.Join(fs.MustRelPath(s))
+		}
 		// Bail on cycles before considering recursion!
 		if path == startingAt {
 			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
@@ -337,13 +457,3 @@ func permsToOs(perms fs.Perms) (mode os.FileMode) {
 	}
 	return mode
 }
-
-func devModesJoin(major int64, minor int64) uint32 {
-	// Constants herein are not a joy: they're a workaround for https://github.com/golang/go/issues/8106
-	return uint32(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff))
-}
-
-func devModesSplit(rdev uint64) (major int64, minor int64) {
-	// Constants herein are not a joy: they're a workaround for https://github.com/golang/go/issues/8106
-	return int64((rdev >> 8) & 0xff), int64((rdev & 0xff) | ((rdev >> 12) & 0xfff00))
-}
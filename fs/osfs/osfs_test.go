@@ -6,9 +6,13 @@ Sniperkit-Bot
 package osfs
 
 import (
+	"fmt"
+	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/tests"
 	"go.polydawn.net/rio/testutil"
@@ -26,9 +30,118 @@ func TestAll(t *testing.T) {
 			tests.CheckMkdirLstatRoundtrip(afs)
 			tests.CheckDeepMkdirError(afs)
 			tests.CheckMklinkLstatRoundtrip(afs)
+			tests.CheckSetTimesRoundtrip(afs)
+			tests.CheckHardlinkInodes(afs)
 			tests.CheckSymlinks(afs)
 			tests.CheckPerniciousSymlinks(afs)
 			tests.CheckOpsTraversingSymlinks(afs)
 		})
 	})
 }
+
+func TestStatTimes(t *testing.T) {
+	Convey("osfs stat should report atime and ctime", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			f1 := fs.MustRelPath("f1")
+			before := time.Now().Add(-time.Second)
+			f, err := afs.OpenFile(f1, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			f.Close()
+			atime := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+			So(afs.SetTimesNano(f1, fs.DefaultAtime, atime), ShouldBeNil)
+
+			fmeta, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(fmeta.Atime.UTC(), ShouldResemble, atime)
+			// Ctime can't be set; it's just "recently".
+			So(fmeta.Ctime.After(before), ShouldBeTrue)
+		})
+	})
+}
+
+func TestMkfifoPerms(t *testing.T) {
+	Convey("osfs mkfifo should keep the high perm bits", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			for _, perms := range []fs.Perms{0644 | fs.Perms_Setgid, 0755 | fs.Perms_Setuid | fs.Perms_Sticky} {
+				path := fs.MustRelPath(fmt.Sprintf("fifo%o", perms))
+				So(afs.Mkfifo(path, perms), ShouldBeNil)
+				fmeta, err := afs.LStat(path)
+				So(err, ShouldBeNil)
+				So(fmeta.Type, ShouldEqual, fs.Type_NamedPipe)
+				So(fmeta.Perms, ShouldEqual, perms)
+			}
+		})
+	})
+}
+
+func TestDevModes(t *testing.T) {
+	Convey("device numbers should survive joining and splitting", t, func() {
+		for _, dev := range [][2]int64{{0, 0}, {8, 1}, {1, 255}, {4, 300}, {202, 65535}} {
+			major, minor := devModesSplit(uint64(devModesJoin(dev[0], dev[1])))
+			So([2]int64{major, minor}, ShouldResemble, dev)
+		}
+	})
+}
+
+func TestReadDir(t *testing.T) {
+	Convey("osfs ReadDir", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			d := fs.MustRelPath("d")
+			So(afs.Mkdir(d, 0755), ShouldBeNil)
+			f, err := afs.OpenFile(d.Join(fs.MustRelPath("zfile")), syscall.O_CREAT|syscall.O_WRONLY, 0640)
+			So(err, ShouldBeNil)
+			f.Write([]byte("abc"))
+			f.Close()
+			So(afs.Mkdir(d.Join(fs.MustRelPath("adir")), 0700), ShouldBeNil)
+			So(afs.Mklink(d.Join(fs.MustRelPath("mlink")), "./zfile"), ShouldBeNil)
+			So(afs.Mkfifo(d.Join(fs.MustRelPath("bfifo")), 0600), ShouldBeNil)
+
+			Convey("should list every entry, sorted, with types and perms", func() {
+				entries, err := afs.ReadDir(d)
+				So(err, ShouldBeNil)
+				So(entries, ShouldHaveLength, 4)
+				type summary struct {
+					Name  string
+					Type  fs.Type
+					Perms fs.Perms
+					Size  int64
+				}
+				var got []summary
+				for _, e := range entries {
+					got = append(got, summary{e.Name.String(), e.Type, e.Perms, e.Size})
+				}
+				So(got, ShouldResemble, []summary{
+					{"./d/adir", fs.Type_Dir, 0700, 0},
+					{"./d/bfifo", fs.Type_NamedPipe, 0600, 0},
+					{"./d/mlink", fs.Type_Symlink, 0777, 0},
+					{"./d/zfile", fs.Type_File, 0640, 3},
+				})
+				// Cheap: no readlink.
+				So(entries[2].Linkname, ShouldEqual, "")
+			})
+			Convey("should error on missing dirs", func() {
+				_, err := afs.ReadDir(fs.MustRelPath("nope"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+		})
+	})
+}
+
+func TestStatfs(t *testing.T) {
+	Convey("osfs statfs should report the space on the filesystem", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			st, err := afs.Statfs(fs.RelPath{})
+			So(err, ShouldBeNil)
+			So(st.Size, ShouldBeGreaterThan, 0)
+			So(st.Free, ShouldBeLessThanOrEqualTo, st.Size)
+			So(st.Available, ShouldBeLessThanOrEqualTo, st.Free)
+
+			_, err = afs.Statfs(fs.MustRelPath("nope"))
+			So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+		})
+	})
+}
@@ -0,0 +1,15 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package osfs
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(sys *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(sys.Atimespec.Sec, sys.Atimespec.Nsec), time.Unix(sys.Ctimespec.Sec, sys.Ctimespec.Nsec)
+}
@@ -0,0 +1,15 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package osfs
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(sys *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(sys.Atim.Sec, sys.Atim.Nsec), time.Unix(sys.Ctim.Sec, sys.Ctim.Nsec)
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// The Stat_t time fields are named differently on every platform;
+// we only dig them out on linux and darwin.  Elsewhere, leave them zero.
+
+package osfs
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(sys *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Time{}, time.Time{}
+}
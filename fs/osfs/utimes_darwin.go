@@ -0,0 +1,74 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Darwin has no utimensat in the standard lib (nor lutimes); setattrlist
+// with FSOPT_NOFOLLOW is how to set times on a symlink itself.
+
+package osfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.polydawn.net/rio/fs"
+)
+
+// These are not currently available in syscall.  (See sys/attr.h.)
+const (
+	_ATTR_BIT_MAP_COUNT = 5
+	_ATTR_CMN_MODTIME   = 0x00000400
+	_ATTR_CMN_ACCTIME   = 0x00001000
+	_FSOPT_NOFOLLOW     = 0x00000001
+)
+
+type attrList struct {
+	bitmapCount uint16
+	_           uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+func (afs *osFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+
+	_path, err := syscall.BytePtrFromString(rpath)
+	if err != nil { // EINVAL if the path string contains NUL bytes.
+		return fs.NormalizeIOError(err)
+	}
+
+	// The attribute values go in the order of their bits: mtime, then atime.
+	attrs := attrList{bitmapCount: _ATTR_BIT_MAP_COUNT, commonAttr: _ATTR_CMN_MODTIME | _ATTR_CMN_ACCTIME}
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(mtime.UnixNano()),
+		syscall.NsecToTimespec(atime.UnixNano()),
+	}
+	if _, _, err := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&times[0])), unsafe.Sizeof(times), _FSOPT_NOFOLLOW, 0); err != 0 {
+		return fs.NormalizeIOError(&os.PathError{Op: "setattrlist", Path: rpath, Err: err})
+	}
+	return nil
+}
+
+func (afs *osFS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	rpath, err := afs.realpath(path, true)
+	if err != nil {
+		return err
+	}
+
+	var utimes [2]syscall.Timespec
+	utimes[0] = syscall.NsecToTimespec(atime.UnixNano())
+	utimes[1] = syscall.NsecToTimespec(mtime.UnixNano())
+	if err := syscall.UtimesNano(rpath, utimes[0:]); err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// The stdlib offers 'listxattr', 'getxattr', and 'setxattr', but not the 'l*'
+// variants that refuse to follow symlinks, so we make those syscalls ourselves.
+
+package osfs
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"go.polydawn.net/rio/fs"
+)
+
+func (afs *osFS) LListXattr(path fs.RelPath) ([]string, error) {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	_path, err := syscall.BytePtrFromString(rpath)
+	if err != nil { // EINVAL if the path string contains NUL bytes.
+		return nil, fs.NormalizeIOError(err)
+	}
+	buf, errno := growingRead(func(dest []byte) (int, syscall.Errno) {
+		return llistxattr(_path, dest)
+	})
+	if errno != 0 {
+		return nil, fs.NormalizeIOError(&os.PathError{"llistxattr", rpath, errno})
+	}
+
+	// The list is a series of NUL-terminated names.
+	keys := []string{}
+	for _, k := range bytes.Split(buf, []byte{0}) {
+		if len(k) > 0 {
+			keys = append(keys, string(k))
+		}
+	}
+	return keys, nil
+}
+
+func (afs *osFS) LGetXattr(path fs.RelPath) (map[string][]byte, error) {
+	keys, err := afs.LListXattr(path)
+	if err != nil {
+		return nil, err
+	}
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	_path, err := syscall.BytePtrFromString(rpath)
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	xattrs := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		_key, err := syscall.BytePtrFromString(key)
+		if err != nil {
+			return nil, fs.NormalizeIOError(err)
+		}
+		value, errno := growingRead(func(dest []byte) (int, syscall.Errno) {
+			return lgetxattr(_path, _key, dest)
+		})
+		switch errno {
+		case 0:
+			xattrs[key] = value
+		case syscall.ENODATA:
+			// Removed since we listed it.  Fine; it's just not here.
+		default:
+			return nil, fs.NormalizeIOError(&os.PathError{"lgetxattr", rpath, errno})
+		}
+	}
+	return xattrs, nil
+}
+
+func (afs *osFS) LSetXattr(path fs.RelPath, name string, value []byte) error {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	_path, err := syscall.BytePtrFromString(rpath)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	_name, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	var _value unsafe.Pointer
+	if len(value) > 0 {
+		_value = unsafe.Pointer(&value[0])
+	}
+	if _, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(_name)), uintptr(_value), uintptr(len(value)), 0, 0); errno != 0 {
+		return fs.NormalizeIOError(&os.PathError{"lsetxattr", rpath, errno})
+	}
+	return nil
+}
+
+// Ask for the size first, then fetch.
+//  If the value grows between those two calls we get ERANGE, so loop.
+func growingRead(read func(dest []byte) (int, syscall.Errno)) ([]byte, syscall.Errno) {
+	for {
+		sz, errno := read(nil)
+		if errno != 0 {
+			return nil, errno
+		}
+		if sz == 0 {
+			return []byte{}, 0
+		}
+		buf := make([]byte, sz)
+		sz, errno = read(buf)
+		switch errno {
+		case 0:
+			return buf[:sz], 0
+		case syscall.ERANGE:
+			continue
+		default:
+			return nil, errno
+		}
+	}
+}
+
+func llistxattr(path *byte, dest []byte) (int, syscall.Errno) {
+	var _dest unsafe.Pointer
+	if len(dest) > 0 {
+		_dest = unsafe.Pointer(&dest[0])
+	}
+	sz, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(path)), uintptr(_dest), uintptr(len(dest)))
+	return int(sz), errno
+}
+
+func lgetxattr(path *byte, key *byte, dest []byte) (int, syscall.Errno) {
+	var _dest unsafe.Pointer
+	if len(dest) > 0 {
+		_dest = unsafe.Pointer(&dest[0])
+	}
+	sz, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(key)), uintptr(_dest), uintptr(len(dest)), 0, 0)
+	return int(sz), errno
+}
@@ -0,0 +1,104 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package osfs
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestXattrs(t *testing.T) {
+	Convey("osfs xattrs", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := New(tmpDir)
+			f1 := fs.MustRelPath("f1")
+			f, err := afs.OpenFile(f1, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			f.Close()
+
+			Convey("a path with no xattrs should list an empty slice", func() {
+				keys, err := afs.LListXattr(f1)
+				So(err, ShouldBeNil)
+				So(keys, ShouldNotBeNil)
+				So(keys, ShouldBeEmpty)
+				xattrs, err := afs.LGetXattr(f1)
+				So(err, ShouldBeNil)
+				So(xattrs, ShouldBeEmpty)
+			})
+			Convey("xattrs should roundtrip", func() {
+				// Not every filesystem we might be testing on supports user xattrs.
+				err := afs.LSetXattr(f1, "user.rio-test-a", []byte("1"))
+				if errcat.Category(err) == fs.ErrNotSupported {
+					keys, err := afs.LListXattr(f1)
+					So(keys, ShouldBeNil)
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotSupported)
+					return
+				}
+				So(err, ShouldBeNil)
+				// Longer than any initial guess at a buffer size would be.
+				long := bytes.Repeat([]byte("0123456789"), 300)
+				So(afs.LSetXattr(f1, "user.rio-test-b", long), ShouldBeNil)
+				So(afs.LSetXattr(f1, "user.rio-test-empty", []byte{}), ShouldBeNil)
+
+				keys, err := afs.LListXattr(f1)
+				So(err, ShouldBeNil)
+				So(keys, ShouldContain, "user.rio-test-a")
+				So(keys, ShouldContain, "user.rio-test-b")
+				So(keys, ShouldContain, "user.rio-test-empty")
+				xattrs, err := afs.LGetXattr(f1)
+				So(err, ShouldBeNil)
+				So(xattrs, ShouldResemble, map[string][]byte{
+					"user.rio-test-a":     []byte("1"),
+					"user.rio-test-b":     long,
+					"user.rio-test-empty": []byte{},
+				})
+
+				Convey("and LStatWithXattrs should include them, while LStat does not", func() {
+					fmeta, err := afs.LStatWithXattrs(f1)
+					So(err, ShouldBeNil)
+					So(fmeta.Xattrs, ShouldResemble, map[string]string{
+						"user.rio-test-a":     "1",
+						"user.rio-test-b":     string(long),
+						"user.rio-test-empty": "",
+					})
+					fmeta, err = afs.LStat(f1)
+					So(err, ShouldBeNil)
+					So(fmeta.Xattrs, ShouldBeNil)
+				})
+				Convey("and setting again should replace", func() {
+					So(afs.LSetXattr(f1, "user.rio-test-a", []byte("2")), ShouldBeNil)
+					xattrs, err := afs.LGetXattr(f1)
+					So(err, ShouldBeNil)
+					So(xattrs["user.rio-test-a"], ShouldResemble, []byte("2"))
+				})
+			})
+			Convey("symlinks should not be followed", func() {
+				So(afs.Mklink(fs.MustRelPath("l1"), "./f1"), ShouldBeNil)
+				afs.LSetXattr(f1, "user.rio-test-a", []byte("1"))
+				keys, err := afs.LListXattr(fs.MustRelPath("l1"))
+				So(err, ShouldBeNil)
+				So(keys, ShouldNotContain, "user.rio-test-a")
+				xattrs, err := afs.LGetXattr(fs.MustRelPath("l1"))
+				So(err, ShouldBeNil)
+				So(xattrs, ShouldNotContainKey, "user.rio-test-a")
+			})
+			Convey("a missing path should error", func() {
+				_, err := afs.LListXattr(fs.MustRelPath("nope"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				_, err = afs.LGetXattr(fs.MustRelPath("nope"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				err = afs.LSetXattr(fs.MustRelPath("nope"), "user.rio-test-a", []byte("1"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+		})
+	})
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Xattrs are only implemented on linux.  Elsewhere they're reported as
+// unsupported, which scans treat as "no xattrs".
+
+package osfs
+
+import (
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/rio/fs"
+)
+
+func (afs *osFS) LListXattr(path fs.RelPath) ([]string, error) {
+	return nil, Errorf(fs.ErrNotSupported, "xattrs are not supported on this platform")
+}
+
+func (afs *osFS) LGetXattr(path fs.RelPath) (map[string][]byte, error) {
+	return nil, Errorf(fs.ErrNotSupported, "xattrs are not supported on this platform")
+}
+
+func (afs *osFS) LSetXattr(path fs.RelPath, name string, value []byte) error {
+	return Errorf(fs.ErrNotSupported, "xattrs are not supported on this platform")
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"path"
 	"strings"
+
+	. "github.com/warpfork/go-errcat"
 )
 
 /*
@@ -24,17 +26,65 @@ type RelPath struct {
 
 /*
 	Converts a string to an relative path struct.
-	Will panic if the given path is absolute.
+	Will panic if the given path is absolute, or goes up (see CleanRelPath):
+	this is for paths that are constants, or that we made ourselves, where
+	either would be a programming error.
 */
 func MustRelPath(p string) RelPath {
+	path, err := CleanRelPath(p)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+/*
+	Converts a string to a relative path struct,
+	returning an error if the given path string is absolute.
+
+	The path is normalized: "." segments, repeated and trailing slashes,
+	and ".." segments that have somewhere to go are all collapsed, so
+	"./a//b/", "a/c/../b", and "a/b" all come out the same.
+
+	Paths that still go up (see GoesUp) are valid relative paths, and are
+	useful for joining; but they can't be used in an fs.FS.  If the string
+	came from somewhere untrusted, use CleanRelPath instead.
+*/
+func ParseRelPath(p string) (RelPath, error) {
 	p = path.Clean(p)
 	if p[0] == '/' {
-		panic(fmt.Errorf("fs: not a relative path (%q)", p))
+		return RelPath{}, fmt.Errorf("fs: not a relative path (%q)", p)
 	}
 	if p == "." { // We can't stop people from using the zero value, so, use it.
-		return RelPath{}
+		return RelPath{}, nil
+	}
+	return RelPath{p, strings.LastIndexByte(p, '/')}, nil
+}
+
+/*
+	Exactly like ParseRelPath, but also refuses paths that go up out of
+	wherever they're relative to (see Validate), with an ErrBreakout.
+	"a/../b" is fine (it's "b"); "a/../../b" is not.
+*/
+func CleanRelPath(p string) (RelPath, error) {
+	path, err := ParseRelPath(p)
+	if err != nil {
+		return path, err
+	}
+	return path, path.Validate()
+}
+
+/*
+	Returns an ErrBreakout error if this path goes up (see GoesUp), and so
+	would escape the base path of any filesystem it's used in; nil otherwise.
+
+	Every fs.FS checks this for the paths it's given.
+*/
+func (p RelPath) Validate() error {
+	if p.GoesUp() {
+		return Errorf(ErrBreakout, "fs: invalid path %q: must not depart basepath", p)
 	}
-	return RelPath{p, strings.LastIndexByte(p, '/')}
+	return nil
 }
 
 /*
@@ -150,10 +200,10 @@ func (p RelPath) SplitParent() []RelPath {
 
 /*
 	Predicate for if this path goes "up" -- in other words, if it starts with
-	"..".
+	a ".." segment.  (Names that merely start with dots, like "..aa", don't.)
 */
 func (p RelPath) GoesUp() bool {
-	return len(p.path) >= 2 && p.path[0:2] == ".."
+	return p.path == ".." || strings.HasPrefix(p.path, "../")
 }
 
 /*
@@ -10,12 +10,22 @@ import (
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 )
 
 //--------------
 // RelPath
 //--------------
 
+// Like MustRelPath, but for the paths that go up, which it refuses.
+func parseRelPath(p string) RelPath {
+	path, err := ParseRelPath(p)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
 func TestRelPath(t *testing.T) {
 	Convey("RelPath stringer suite:", t, func() {
 		for _, tr := range []struct {
@@ -36,10 +46,10 @@ func TestRelPath(t *testing.T) {
 				MustRelPath("a/bb/ccc"),
 				"./a/bb/ccc"},
 			{"denormalized value",
-				MustRelPath("../a/bb/../ccc"),
+				parseRelPath("../a/bb/../ccc"),
 				"../a/ccc"},
 			{"lone doubledot value",
-				MustRelPath("../"),
+				parseRelPath("../"),
 				".."},
 			{"dotted value",
 				MustRelPath(".aa"),
@@ -79,14 +89,14 @@ func TestRelPathDir(t *testing.T) {
 				MustRelPath("a/bb/ccc"),
 				MustRelPath("a/bb")},
 			{"denormalized value",
-				MustRelPath("../a/bb/../ccc"),
-				MustRelPath("../a")}, // cleans, then drops
+				parseRelPath("../a/bb/../ccc"),
+				parseRelPath("../a")}, // cleans, then drops
 			{"lone doubledot value",
-				MustRelPath("../"),
+				parseRelPath("../"),
 				MustRelPath(".")}, // yep.  matches what stdlib 'path.Dir' does.
 			{"double doubledot value",
-				MustRelPath("../.."),
-				MustRelPath("..")}, // yep.  matches what stdlib 'path.Dir' does.
+				parseRelPath("../.."),
+				parseRelPath("..")}, // yep.  matches what stdlib 'path.Dir' does.
 		} {
 			Convey(tr.title, func() {
 				v := tr.p1.Dir()
@@ -116,10 +126,10 @@ func TestRelPathLast(t *testing.T) {
 				MustRelPath("a/bb/ccc"),
 				"ccc"},
 			{"denormalized value",
-				MustRelPath("../a/bb/../ccc"),
+				parseRelPath("../a/bb/../ccc"),
 				"ccc"},
 			{"lone doubledot value",
-				MustRelPath("../"),
+				parseRelPath("../"),
 				".."},
 		} {
 			Convey(tr.title, func() {
@@ -156,13 +166,13 @@ func TestRelPathJoins(t *testing.T) {
 				MustRelPath("a/bb/ccc"), MustRelPath("dd/e"),
 				MustRelPath("a/bb/ccc/dd/e")},
 			{"zero,up",
-				MustRelPath("."), MustRelPath(".."),
-				MustRelPath("..")},
+				MustRelPath("."), parseRelPath(".."),
+				parseRelPath("..")},
 			{"short,up",
-				MustRelPath("rel"), MustRelPath(".."),
+				MustRelPath("rel"), parseRelPath(".."),
 				MustRelPath(".")},
 			{"long,up",
-				MustRelPath("r/el"), MustRelPath(".."),
+				MustRelPath("r/el"), parseRelPath(".."),
 				MustRelPath("r")},
 			{"dotted,short",
 				MustRelPath(".dot"), MustRelPath("wonk"),
@@ -359,13 +369,13 @@ func TestAbsolutePathJoins(t *testing.T) {
 				MustAbsolutePath("/a/bb/ccc"), MustRelPath("dd/e"),
 				MustAbsolutePath("/a/bb/ccc/dd/e")},
 			{"root,up",
-				MustAbsolutePath("/"), MustRelPath(".."),
+				MustAbsolutePath("/"), parseRelPath(".."),
 				MustAbsolutePath("/")},
 			{"short,up",
-				MustAbsolutePath("/root"), MustRelPath(".."),
+				MustAbsolutePath("/root"), parseRelPath(".."),
 				MustAbsolutePath("/")},
 			{"long,up",
-				MustAbsolutePath("/r/oot/pth"), MustRelPath(".."),
+				MustAbsolutePath("/r/oot/pth"), parseRelPath(".."),
 				MustAbsolutePath("/r/oot")},
 		} {
 			Convey(tr.title, func() {
@@ -375,3 +385,74 @@ func TestAbsolutePathJoins(t *testing.T) {
 		}
 	})
 }
+
+func TestRelPathGoesUp(t *testing.T) {
+	Convey("RelPath.GoesUp suite:", t, func() {
+		for _, tr := range []struct {
+			title string
+			p1    RelPath
+			up    bool
+		}{
+			{"zero values", RelPath{}, false},
+			{"short value", MustRelPath("aa"), false},
+			{"lone doubledot value", parseRelPath(".."), true},
+			{"leading doubledot value", parseRelPath("../aa"), true},
+			{"denormalized value", parseRelPath("aa/../../bb"), true},
+			{"interior doubledot value", MustRelPath("aa/../bb"), false},
+			{"dotted2 value", MustRelPath("..aa"), false},
+		} {
+			Convey(tr.title, func() {
+				So(tr.p1.GoesUp(), ShouldEqual, tr.up)
+			})
+		}
+	})
+	Convey("ParseRelPath should refuse absolute paths", t, func() {
+		_, err := ParseRelPath("/aa")
+		So(err, ShouldNotBeNil)
+		p, err := ParseRelPath("aa/")
+		So(err, ShouldBeNil)
+		So(p, ShouldResemble, MustRelPath("aa"))
+	})
+}
+
+func TestCleanRelPath(t *testing.T) {
+	Convey("CleanRelPath suite:", t, func() {
+		for _, tr := range []struct {
+			title string
+			str   string
+			p1    RelPath
+		}{
+			{"redundant dots and slashes", "./a//b", parseRelPath("a/b")},
+			{"trailing slash", "a/b/", parseRelPath("a/b")},
+			{"interior doubledot value", "a/../b", parseRelPath("b")},
+			{"doubledot back to the base", "a/..", RelPath{}},
+		} {
+			Convey(tr.title, func() {
+				p, err := CleanRelPath(tr.str)
+				So(err, ShouldBeNil)
+				So(p, ShouldResemble, tr.p1)
+				So(MustRelPath(tr.str), ShouldResemble, tr.p1)
+			})
+		}
+		for _, tr := range []struct {
+			title string
+			str   string
+		}{
+			{"leading doubledot value", "../escape"},
+			{"lone doubledot value", ".."},
+			{"denormalized value", "a/../../escape"},
+		} {
+			Convey("escaping paths should be refused: "+tr.title, func() {
+				_, err := CleanRelPath(tr.str)
+				So(err, errcat.ErrorShouldHaveCategory, ErrBreakout)
+				So(parseRelPath(tr.str).Validate(), errcat.ErrorShouldHaveCategory, ErrBreakout)
+				So(func() { MustRelPath(tr.str) }, ShouldPanic)
+			})
+		}
+		Convey("absolute paths should be refused, but not as breakouts", func() {
+			_, err := CleanRelPath("/a")
+			So(err, ShouldNotBeNil)
+			So(errcat.Category(err), ShouldNotEqual, ErrBreakout)
+		})
+	})
+}
@@ -7,6 +7,7 @@ package tests
 
 import (
 	"os"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/warpfork/go-errcat"
@@ -52,6 +53,63 @@ func CheckMklinkLstatRoundtrip(afs fs.FS) {
 	})
 }
 
+func CheckSetTimesRoundtrip(afs fs.FS) {
+	Convey("SPEC: setting times and lstat should roundtrip", func() {
+		mtime := time.Date(2001, 2, 3, 4, 5, 6, 7000, time.UTC)
+		atime := time.Date(2002, 3, 4, 5, 6, 7, 8000, time.UTC)
+		f1 := fs.MustRelPath("tf1")
+		f, err := afs.OpenFile(f1, os.O_CREATE|os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		f.Close()
+		So(afs.Mklink(fs.MustRelPath("tl1"), "./tf1"), ShouldBeNil)
+		Convey("on a file", func() {
+			So(afs.SetTimesNano(f1, mtime, atime), ShouldBeNil)
+			stat, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, mtime)
+		})
+		Convey("on a symlink itself, with the L variant", func() {
+			So(afs.SetTimesLNano(fs.MustRelPath("tl1"), mtime, atime), ShouldBeNil)
+			stat, err := afs.LStat(fs.MustRelPath("tl1"))
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, mtime)
+			stat, err = afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldNotResemble, mtime)
+		})
+		Convey("through a symlink, otherwise", func() {
+			So(afs.SetTimesNano(fs.MustRelPath("tl1"), mtime, atime), ShouldBeNil)
+			stat, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, mtime)
+			stat, err = afs.LStat(fs.MustRelPath("tl1"))
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldNotResemble, mtime)
+		})
+	})
+}
+
+func CheckHardlinkInodes(afs fs.FS) {
+	Convey("SPEC: hardlinks should share an inode", func() {
+		h1, h2, h3 := fs.MustRelPath("h1"), fs.MustRelPath("h2"), fs.MustRelPath("h3")
+		So(makeFile(afs, h1, "shared"), ShouldBeNil)
+		So(makeFile(afs, h3, "shared"), ShouldBeNil)
+		So(afs.Mkhardlink(h2, h1), ShouldBeNil)
+		ino1, err := afs.LInode(h1)
+		So(err, ShouldBeNil)
+		ino2, err := afs.LInode(h2)
+		So(err, ShouldBeNil)
+		ino3, err := afs.LInode(h3)
+		So(err, ShouldBeNil)
+		So(ino2, ShouldResemble, ino1)
+		So(ino1.Nlink, ShouldEqual, 2)
+		So(ino3.Ino, ShouldNotEqual, ino1.Ino)
+		So(ino3.Nlink, ShouldEqual, 1)
+		_, err = afs.LInode(fs.MustRelPath("nope"))
+		So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+	})
+}
+
 func CheckSymlinks(afs fs.FS) {
 	Convey("SPEC: symlink resolve", func() {
 		Convey("symlinks to files resolve correctly", func() {
@@ -6,10 +6,13 @@ Sniperkit-Bot
 package fsOp
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/lib/guid"
 )
 
 /*
@@ -167,3 +170,168 @@ func RemoveDirContent(afs fs.FS, path fs.RelPath) error {
 	}
 	return nil
 }
+
+/*
+	Remove a path and everything under it (if it exists; if not, no-op),
+	with errors normalized into fs categories.
+
+	Symlinks are never followed: a symlink is removed as a link, and
+	whatever it points to is left alone, wherever that is.  The same goes
+	for the path itself -- if any of its parent segments is a symlink,
+	that's an ErrBreakout, rather than a removal somewhere else entirely.
+	(The walk is done by lstat'ing each node, so unlike the stdlib's
+	RemoveAll there's no guessing about what's a dir.)
+*/
+func RemoveAll(afs fs.FS, path fs.RelPath) error {
+	for parent := path.Dir(); parent != (fs.RelPath{}); parent = parent.Dir() {
+		target, isSymlink, err := afs.Readlink(parent)
+		switch {
+		case isSymlink:
+			return fs.NewBreakoutError(afs.BasePath(), path, parent, target)
+		case Category(err) == fs.ErrNotExists:
+			return nil // nothing under it, then.
+		case err != nil:
+			return err
+		}
+	}
+	err := removeAll(afs, path)
+	if Category(err) == fs.ErrNotExists {
+		return nil
+	}
+	return err
+}
+
+func removeAll(afs fs.FS, path fs.RelPath) error {
+	fmeta, err := afs.LStat(path)
+	if err != nil {
+		return err
+	}
+	if fmeta.Type == fs.Type_Dir {
+		children, err := afs.ReadDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := removeAll(afs, path.Join(fs.MustRelPath(child))); err != nil && Category(err) != fs.ErrNotExists {
+				return err
+			}
+		}
+	}
+	// No remove in the fs.FS interface, so this part assumes osfs, same as RemoveDirContent.
+	if err := os.Remove(afs.BasePath().Join(path).String()); err != nil && !os.IsNotExist(err) {
+		return fs.NormalizeIOError(err)
+	}
+	return nil
+}
+
+/*
+	Make a symlink, as afs.Mklink does; but if there's something at the path
+	already, make sure it's the symlink asked for, rather than erroring.
+
+	If it's a symlink with the same target, that's a no-op.  If it's a
+	symlink to anything else, it's replaced.  If it's anything other than a
+	symlink, it's only replaced (with RemoveAll, so a dir goes with all of
+	its contents) if `clobber` is set; otherwise that's an ErrWrongType,
+	and nothing is touched.
+
+	Replacing isn't atomic: for a moment, there's nothing at the path.
+*/
+func MklinkForce(afs fs.FS, path fs.RelPath, target string, clobber bool) error {
+	err := afs.Mklink(path, target)
+	if Category(err) != fs.ErrAlreadyExists {
+		return err
+	}
+	existing, isSymlink, err := afs.Readlink(path)
+	switch {
+	case err != nil:
+		return err
+	case isSymlink && existing == target:
+		return nil
+	case !isSymlink && !clobber:
+		fmeta, err := afs.LStat(path)
+		if err != nil {
+			return err
+		}
+		return ErrorDetailed(fs.ErrWrongType,
+			fmt.Sprintf("refusing to replace %s at %q with a symlink", fmeta.Type, path),
+			map[string]string{"path": path.String(), "type": fmeta.Type.String()},
+		)
+	}
+	if err := RemoveAll(afs, path); err != nil {
+		return err
+	}
+	return afs.Mklink(path, target)
+}
+
+/*
+	Read a whole file into memory, with errors normalized into fs categories.
+	Meant for small files: the whole body ends up in one slice.
+
+	Symlinks are followed as OpenFile does (so, never out of the filesystem).
+*/
+func ReadFile(afs fs.FS, path fs.RelPath) ([]byte, error) {
+	f, err := afs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bs, err := ioutil.ReadAll(f)
+	return bs, fs.NormalizeIOError(err)
+}
+
+/*
+	Write a whole file, creating or replacing it, atomically: the data
+	goes to a temp file next to it first, which is then renamed into place.
+	Anyone reading the path sees either what was there before (or nothing,
+	if nothing was) or all of the new data -- never part of it.
+	If this fails, the path is left as it was.
+
+	The file gets exactly the perms given (the temp file is chmod'd, so
+	the umask doesn't get a say), and is owned by the current process.
+
+	If any of the path's parent segments is a symlink, that's an ErrBreakout,
+	as in RemoveAll.  A symlink at the path itself is replaced, not written
+	through.  The rename assumes osfs, same as RemoveAll: there's no rename
+	in the fs.FS interface.
+*/
+func WriteFile(afs fs.FS, path fs.RelPath, data []byte, perms fs.Perms) error {
+	for parent := path.Dir(); parent != (fs.RelPath{}); parent = parent.Dir() {
+		target, isSymlink, err := afs.Readlink(parent)
+		switch {
+		case isSymlink:
+			return fs.NewBreakoutError(afs.BasePath(), path, parent, target)
+		case err != nil:
+			return err
+		}
+	}
+	tmpPath := path.Dir().Join(fs.MustRelPath(".tmp.write." + guid.New()))
+	f, err := afs.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perms)
+	if err != nil {
+		return err
+	}
+	err = writeAndSync(f, data)
+	if err2 := f.Close(); err == nil {
+		err = fs.NormalizeIOError(err2)
+	}
+	if err == nil {
+		err = afs.Chmod(tmpPath, perms)
+	}
+	if err == nil {
+		err = fs.NormalizeIOError(os.Rename(afs.BasePath().Join(tmpPath).String(), afs.BasePath().Join(path).String()))
+	}
+	if err != nil {
+		os.Remove(afs.BasePath().Join(tmpPath).String())
+	}
+	return err
+}
+
+// Write all the data, then sync (if the file can), so a rename after won't beat the data to disk.
+func writeAndSync(f fs.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	if syncer, ok := f.(interface{ Sync() error }); ok {
+		return fs.NormalizeIOError(syncer.Sync())
+	}
+	return nil
+}
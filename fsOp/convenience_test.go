@@ -161,6 +161,176 @@ func TestMkdirUsable(t *testing.T) {
 	)
 }
 
+func TestRemoveAll(t *testing.T) {
+	Convey("RemoveAll:", t, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("outside"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("outside/precious"), Type: fs.Type_File, Perms: 0644}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/d"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/d/f"), Type: fs.Type_File, Perms: 0644}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/d/lnkdir"), Type: fs.Type_Symlink, Linkname: "../../outside"}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/lnkfile"), Type: fs.Type_Symlink, Linkname: tmpDir.String() + "/outside/precious"}, nil)
+
+			Convey("RemoveAll should remove links, not what they point to...", func() {
+				So(RemoveAll(afs, fs.MustRelPath("tree")), ShouldBeNil)
+
+				_, err := afs.LStat(fs.MustRelPath("tree"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				So(ShouldStat(afs, fs.MustRelPath("outside/precious")).Type, ShouldEqual, fs.Type_File)
+			})
+			Convey("RemoveAll on a path that doesn't exist should be a no-op...", func() {
+				So(RemoveAll(afs, fs.MustRelPath("nope")), ShouldBeNil)
+				So(RemoveAll(afs, fs.MustRelPath("nope/deeper")), ShouldBeNil)
+			})
+			Convey("RemoveAll on a path through a symlink should refuse...", func() {
+				So(RemoveAll(afs, fs.MustRelPath("tree/d/lnkdir/precious")), errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+				So(ShouldStat(afs, fs.MustRelPath("outside/precious")).Type, ShouldEqual, fs.Type_File)
+			})
+		})
+	})
+}
+
+func TestMklinkForce(t *testing.T) {
+	Convey("MklinkForce:", t, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("lnk"), Type: fs.Type_Symlink, Linkname: "./a"}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("file"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("precious"))
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("dir"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("dir/f"), Type: fs.Type_File, Perms: 0644}, nil)
+			readlink := func(path string) string {
+				target, isSymlink, err := afs.Readlink(fs.MustRelPath(path))
+				So(err, ShouldBeNil)
+				So(isSymlink, ShouldBeTrue)
+				return target
+			}
+
+			Convey("MklinkForce on an empty path should just make the link...", func() {
+				So(MklinkForce(afs, fs.MustRelPath("new"), "./a", false), ShouldBeNil)
+				So(readlink("new"), ShouldEqual, "./a")
+			})
+			Convey("MklinkForce onto the same symlink should be a no-op...", func() {
+				before := ShouldStat(afs, fs.MustRelPath("lnk"))
+				So(MklinkForce(afs, fs.MustRelPath("lnk"), "./a", false), ShouldBeNil)
+				So(readlink("lnk"), ShouldEqual, "./a")
+				So(ShouldStat(afs, fs.MustRelPath("lnk")).Mtime, ShouldResemble, before.Mtime)
+			})
+			Convey("MklinkForce onto a symlink elsewhere should replace it...", func() {
+				So(MklinkForce(afs, fs.MustRelPath("lnk"), "./b", false), ShouldBeNil)
+				So(readlink("lnk"), ShouldEqual, "./b")
+			})
+			Convey("MklinkForce onto a file should refuse, and leave it be...", func() {
+				err := MklinkForce(afs, fs.MustRelPath("file"), "./a", false)
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrWrongType)
+				So(errcat.Details(err)["type"], ShouldEqual, "file")
+				body, err := ReadFile(afs, fs.MustRelPath("file"))
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "precious")
+			})
+			Convey("MklinkForce onto a dir should refuse, and leave it be...", func() {
+				So(MklinkForce(afs, fs.MustRelPath("dir"), "./a", false), errcat.ErrorShouldHaveCategory, fs.ErrWrongType)
+				So(ShouldStat(afs, fs.MustRelPath("dir/f")).Type, ShouldEqual, fs.Type_File)
+			})
+			Convey("MklinkForce with clobber should replace a file or a whole dir...", func() {
+				So(MklinkForce(afs, fs.MustRelPath("file"), "./a", true), ShouldBeNil)
+				So(readlink("file"), ShouldEqual, "./a")
+				So(MklinkForce(afs, fs.MustRelPath("dir"), "./a", true), ShouldBeNil)
+				So(readlink("dir"), ShouldEqual, "./a")
+			})
+			Convey("MklinkForce failing for other reasons should say so as usual...", func() {
+				So(MklinkForce(afs, fs.MustRelPath("nope/deeper"), "./a", true), errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+		})
+	})
+}
+
+func TestReadWriteFile(t *testing.T) {
+	Convey("ReadFile and WriteFile:", t, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("outside"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("d"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("d/lnkdir"), Type: fs.Type_Symlink, Linkname: "../outside"}, nil)
+			noTempFiles := func() {
+				names, err := afs.ReadDirNames(fs.MustRelPath("d"))
+				So(err, ShouldBeNil)
+				for _, name := range names {
+					So(name, ShouldNotStartWith, ".tmp")
+				}
+			}
+
+			Convey("WriteFile then ReadFile should roundtrip, with exact perms...", func() {
+				So(WriteFile(afs, fs.MustRelPath("d/f"), []byte("abc"), 0640), ShouldBeNil)
+				bs, err := ReadFile(afs, fs.MustRelPath("d/f"))
+				So(err, ShouldBeNil)
+				So(string(bs), ShouldEqual, "abc")
+				So(ShouldStat(afs, fs.MustRelPath("d/f")).Perms, ShouldEqual, fs.Perms(0640))
+				noTempFiles()
+
+				Convey("and writing again should replace it...", func() {
+					So(WriteFile(afs, fs.MustRelPath("d/f"), []byte("de"), 0600), ShouldBeNil)
+					bs, err := ReadFile(afs, fs.MustRelPath("d/f"))
+					So(err, ShouldBeNil)
+					So(string(bs), ShouldEqual, "de")
+					So(ShouldStat(afs, fs.MustRelPath("d/f")).Perms, ShouldEqual, fs.Perms(0600))
+					noTempFiles()
+				})
+			})
+			Convey("ReadFile of a missing file should say so...", func() {
+				_, err := ReadFile(afs, fs.MustRelPath("d/nope"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+			Convey("WriteFile into a missing dir should fail, and leave nothing...", func() {
+				So(WriteFile(afs, fs.MustRelPath("d/nope/f"), []byte("abc"), 0644), errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				noTempFiles()
+			})
+			Convey("WriteFile through a symlink should refuse...", func() {
+				So(WriteFile(afs, fs.MustRelPath("d/lnkdir/f"), []byte("abc"), 0644), errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+				_, err := afs.LStat(fs.MustRelPath("outside/f"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+			Convey("readers during writes should see the old file or the new one, never part of one...", func() {
+				old, new := bytes.Repeat([]byte("o"), 1<<20), bytes.Repeat([]byte("n"), 1<<20)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for i := 0; i < 20; i++ {
+						body := old
+						if i%2 == 1 {
+							body = new
+						}
+						if err := WriteFile(afs, fs.MustRelPath("d/f"), body, 0644); err != nil {
+							panic(err)
+						}
+					}
+				}()
+				var reads, torn int
+				for finished := false; !finished; {
+					select {
+					case <-done:
+						finished = true
+					default:
+					}
+					bs, err := ReadFile(afs, fs.MustRelPath("d/f"))
+					if errcat.Category(err) == fs.ErrNotExists {
+						continue // not written the first time yet.
+					}
+					So(err, ShouldBeNil)
+					reads++
+					if !bytes.Equal(bs, old) && !bytes.Equal(bs, new) {
+						torn++
+					}
+				}
+				So(reads, ShouldBeGreaterThan, 0)
+				So(torn, ShouldEqual, 0)
+				noTempFiles()
+			})
+		})
+	})
+}
+
 func mustPlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader) {
 	if fmeta.Type == fs.Type_File && body == nil {
 		body = &bytes.Buffer{}
@@ -0,0 +1,82 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"sort"
+
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Copy a file, or a dir and everything under it, from one filesystem to another.
+
+	Dirs, files (content and perms), symlinks, fifos, and devices are all
+	recreated, with ownership, xattrs, and mtime, via PlaceFile: so ownership
+	is strict, and needs the privileges for chown.
+	Symlinks are copied as links; never followed.
+	Each dir's mtime is set again after all its children are placed, since
+	placing them disturbs it.  (The parent of `dst` is disturbed too; if
+	you care, `defer RepairMtime` on it.)
+
+	`dst` must not exist yet, unless it's the base of dstFs, in which case
+	an existing dir there is reused.  The two filesystems may be the same,
+	but the trees must not overlap.
+
+	Regular files hardlinked to each other within the source tree are
+	recreated as hardlinks in the destination, as spotted by
+	HardlinkIdentity.  Where the link can't be made, each path just gets
+	its own copy.
+*/
+func CopyTree(srcFs fs.FS, src fs.RelPath, dstFs fs.FS, dst fs.RelPath) error {
+	return copyTree(srcFs, src, dstFs, dst, map[FileIdentity]fs.RelPath{})
+}
+
+func copyTree(srcFs fs.FS, src fs.RelPath, dstFs fs.FS, dst fs.RelPath, linked map[FileIdentity]fs.RelPath) error {
+	fmeta, body, err := ScanFileWithXattrs(srcFs, src)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	fmeta.Name = dst
+
+	// Files we've seen before under another name get linked instead of copied.
+	if fmeta.Type == fs.Type_File {
+		if id, ok := HardlinkIdentity(srcFs, src); ok {
+			if first, seen := linked[id]; seen {
+				if err := dstFs.Mkhardlink(dst, first); err == nil {
+					return nil
+				}
+				// Fall through and copy.  Content is right either way.
+			} else {
+				linked[id] = dst
+			}
+		}
+	}
+
+	if err := PlaceFile(dstFs, *fmeta, body, false); err != nil {
+		return err
+	}
+	if fmeta.Type != fs.Type_Dir {
+		return nil
+	}
+
+	names, err := srcFs.ReadDirNames(src)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := fs.MustRelPath(name)
+		if err := copyTree(srcFs, src.Join(child), dstFs, dst.Join(child), linked); err != nil {
+			return err
+		}
+	}
+	// Placing the children moved our mtime.  Put it back.
+	return dstFs.SetTimesNano(dst, fmeta.Mtime, fs.DefaultAtime)
+}
@@ -0,0 +1,92 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/memfs"
+	"go.polydawn.net/rio/fs/osfs"
+	. "go.polydawn.net/rio/testutil"
+)
+
+func TestCopyTree(t *testing.T) {
+	Convey("CopyTree:", t, func() {
+		mtime := time.Unix(1000, 0).UTC()
+		srcFs := memfs.New(fs.MustAbsolutePath("/src"))
+		place := func(fmeta fs.Metadata, body string) {
+			fmeta.Uid, fmeta.Gid, fmeta.Mtime = 4000, 5000, mtime
+			So(PlaceFile(srcFs, fmeta, bytes.NewBufferString(body), false), ShouldBeNil)
+		}
+		place(fs.Metadata{Name: fs.MustRelPath("tree"), Type: fs.Type_Dir, Perms: 0750}, "")
+		place(fs.Metadata{Name: fs.MustRelPath("tree/d"), Type: fs.Type_Dir, Perms: 0755}, "")
+		place(fs.Metadata{Name: fs.MustRelPath("tree/d/f"), Type: fs.Type_File, Perms: 04755}, "body")
+		place(fs.Metadata{Name: fs.MustRelPath("tree/lnk"), Type: fs.Type_Symlink, Linkname: "../nope"}, "")
+		place(fs.Metadata{Name: fs.MustRelPath("tree/fifo"), Type: fs.Type_NamedPipe, Perms: 0600}, "")
+		place(fs.Metadata{Name: fs.MustRelPath("tree/dev"), Type: fs.Type_CharDevice, Perms: 0666, Devmajor: 1, Devminor: 3}, "")
+		// Placing children moved the dirs' mtimes; set them back, so the copy has something to get right.
+		So(srcFs.SetTimesNano(fs.MustRelPath("tree/d"), mtime, fs.DefaultAtime), ShouldBeNil)
+		So(srcFs.SetTimesNano(fs.MustRelPath("tree"), mtime, fs.DefaultAtime), ShouldBeNil)
+
+		Convey("should reproduce every node, with metadata, in another filesystem", func() {
+			dstFs := memfs.New(fs.MustAbsolutePath("/dst"))
+			So(CopyTree(srcFs, fs.MustRelPath("tree"), dstFs, fs.MustRelPath("copy")), ShouldBeNil)
+			for _, name := range []string{"", "d", "d/f", "lnk", "fifo", "dev"} {
+				want, err := srcFs.LStat(fs.MustRelPath("tree/" + name))
+				So(err, ShouldBeNil)
+				got, err := dstFs.LStat(fs.MustRelPath("copy/" + name))
+				So(err, ShouldBeNil)
+				want.Name, got.Name = fs.RelPath{}, fs.RelPath{}
+				want.Atime, got.Atime = time.Time{}, time.Time{}
+				want.Ctime, got.Ctime = time.Time{}, time.Time{}
+				So(got, ShouldResemble, want)
+			}
+			f, err := dstFs.OpenFile(fs.MustRelPath("copy/d/f"), os.O_RDONLY, 0)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			bs, _ := ioutil.ReadAll(f)
+			So(string(bs), ShouldEqual, "body")
+		})
+		Convey("hardlinked files should stay linked, in any filesystem", func() {
+			So(srcFs.Mkhardlink(fs.MustRelPath("tree/f2"), fs.MustRelPath("tree/d/f")), ShouldBeNil)
+			dstFs := memfs.New(fs.MustAbsolutePath("/dst"))
+			So(CopyTree(srcFs, fs.MustRelPath("tree"), dstFs, fs.MustRelPath("copy")), ShouldBeNil)
+			inoA, err := dstFs.LInode(fs.MustRelPath("copy/d/f"))
+			So(err, ShouldBeNil)
+			inoB, err := dstFs.LInode(fs.MustRelPath("copy/f2"))
+			So(err, ShouldBeNil)
+			So(inoB, ShouldResemble, inoA)
+			So(inoA.Nlink, ShouldEqual, 2)
+		})
+	})
+	Convey("CopyTree on disk:", t,
+		Requires(RequiresCanManageOwnership, func() {
+			WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir)
+				So(afs.Mkdir(fs.MustRelPath("src"), 0755), ShouldBeNil)
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("src/a"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("shared"))
+				So(os.Link(tmpDir.Join(fs.MustRelPath("src/a")).String(), tmpDir.Join(fs.MustRelPath("src/b")).String()), ShouldBeNil)
+
+				Convey("hardlinked files should stay linked", func() {
+					So(CopyTree(afs, fs.MustRelPath("src"), afs, fs.MustRelPath("dst")), ShouldBeNil)
+					fiA, err := os.Lstat(tmpDir.Join(fs.MustRelPath("dst/a")).String())
+					So(err, ShouldBeNil)
+					fiB, err := os.Lstat(tmpDir.Join(fs.MustRelPath("dst/b")).String())
+					So(err, ShouldBeNil)
+					So(os.SameFile(fiA, fiB), ShouldBeTrue)
+					So(fiA.Sys().(*syscall.Stat_t).Nlink, ShouldEqual, 2)
+				})
+			})
+		}),
+	)
+}
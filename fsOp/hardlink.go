@@ -0,0 +1,33 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Identifies a file among all the names that are hardlinks to it.
+*/
+type FileIdentity struct {
+	dev, ino uint64
+}
+
+/*
+	Returns the identity of a regular file, if it has more than one name
+	(otherwise there's no point: ok is false).
+*/
+func HardlinkIdentity(afs fs.FS, path fs.RelPath) (_ FileIdentity, ok bool) {
+	fmeta, err := afs.LStat(path)
+	if err != nil || fmeta.Type != fs.Type_File {
+		return FileIdentity{}, false
+	}
+	inode, err := afs.LInode(path)
+	if err != nil || inode.Nlink < 2 {
+		return FileIdentity{}, false
+	}
+	return FileIdentity{inode.Dev, inode.Ino}, true
+}
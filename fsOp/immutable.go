@@ -0,0 +1,219 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	ImmutablePolicy selects what to do when clearing a target path runs into
+	files or dirs carrying the immutable inode flag (`chattr +i`).
+	Without checking, these just cause a bewildering EPERM partway through.
+*/
+type ImmutablePolicy string
+
+const (
+	/*
+		Stop with an error of category fs.ErrTargetImmutable.
+		This is the default.
+	*/
+	ImmutablePolicy_Fail ImmutablePolicy = ""
+
+	/*
+		Clear the immutable flag and carry on removing.
+		This requires CAP_LINUX_IMMUTABLE; without it, the attempt fails
+		with a permission error.
+	*/
+	ImmutablePolicy_Clear ImmutablePolicy = "clear"
+
+	/*
+		Leave immutable entries in place (an immutable dir is left in place
+		along with everything in it), and keep the parent dirs needed to
+		reach them.  Everything else is removed.
+
+		Anything that later tries to place a file at one of the kept paths
+		will find it already exists; unpackers check the policy and skip
+		those entries rather than failing.
+	*/
+	ImmutablePolicy_Skip ImmutablePolicy = "skip"
+)
+
+/*
+	Exactly like RemoveDirContent, but immutable entries are handled
+	according to policy.
+
+	If `onSkip` is non-nil, it's called for each path left in place
+	under ImmutablePolicy_Skip.
+*/
+func RemoveDirContentWithPolicy(afs fs.FS, path fs.RelPath, policy ImmutablePolicy, onSkip func(fs.RelPath)) error {
+	// Same rules as RemoveDirContent: if the path is a file, it goes too.
+	fmeta, err := afs.LStat(path)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return nil // great
+	default:
+		return err
+	}
+	if fmeta.Type != fs.Type_Dir {
+		return RemoveAllWithPolicy(afs, path, policy, onSkip)
+	}
+	if _, err := removeChildrenWithPolicy(afs, path, policy, onSkip); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+	Like `os.RemoveAll` (if the path doesn't exist, no-op), but immutable
+	entries are handled according to policy.
+	See RemoveDirContentWithPolicy.
+*/
+func RemoveAllWithPolicy(afs fs.FS, path fs.RelPath, policy ImmutablePolicy, onSkip func(fs.RelPath)) error {
+	_, err := removeAllWithPolicy(afs, path, policy, onSkip)
+	if Category(err) == fs.ErrNotExists {
+		return nil
+	}
+	return err
+}
+
+/*
+	Remove a path and everything under it, checking inode flags first.
+	Returns true if anything was kept (in which case the path itself remains).
+*/
+func removeAllWithPolicy(afs fs.FS, path fs.RelPath, policy ImmutablePolicy, onSkip func(fs.RelPath)) (kept bool, err error) {
+	fmeta, err := afs.LStat(path)
+	if err != nil {
+		return false, err
+	}
+	// Reading flags means opening the file, which can need more permission
+	//  than unlinking it does; if we can't look, assume there's nothing to see,
+	//  and let the remove report any real problem.
+	flags, err := GetInodeFlags(afs, path)
+	if err != nil && Category(err) != fs.ErrPermission {
+		return false, err
+	}
+	if flags&InodeFlag_Immutable != 0 {
+		switch policy {
+		case ImmutablePolicy_Fail:
+			return false, ErrorDetailed(
+				fs.ErrTargetImmutable,
+				fmt.Sprintf("cannot remove %q: target is immutable", afs.BasePath().Join(path)),
+				map[string]string{"path": afs.BasePath().Join(path).String()},
+			)
+		case ImmutablePolicy_Clear:
+			if err := SetInodeFlags(afs, path, flags&^InodeFlag_Immutable); err != nil {
+				return false, err
+			}
+		case ImmutablePolicy_Skip:
+			if onSkip != nil {
+				onSkip(path)
+			}
+			return true, nil
+		default:
+			panic(fmt.Errorf("unknown immutable policy %q", policy))
+		}
+	}
+	if fmeta.Type == fs.Type_Dir {
+		kept, err := removeChildrenWithPolicy(afs, path, policy, onSkip)
+		if err != nil || kept {
+			return kept, err
+		}
+	}
+	if err := os.Remove(afs.BasePath().Join(path).String()); err != nil {
+		return false, fs.NormalizeIOError(err)
+	}
+	return false, nil
+}
+
+func removeChildrenWithPolicy(afs fs.FS, path fs.RelPath, policy ImmutablePolicy, onSkip func(fs.RelPath)) (kept bool, err error) {
+	children, err := afs.ReadDirNames(path)
+	if err != nil {
+		return false, err
+	}
+	for _, child := range children {
+		childKept, err := removeAllWithPolicy(afs, path.Join(fs.MustRelPath(child)), policy, onSkip)
+		if err != nil {
+			return kept, err
+		}
+		kept = kept || childKept
+	}
+	return kept, nil
+}
+
+/*
+	Checks an error from placing a file at `path` against the immutable
+	target policy: for when clearing the target (with ImmutablePolicy_Skip)
+	left something in the way, or the target was never cleared at all.
+
+	The placement ran into something immutable if the path, or a dir it's
+	in, is immutable; or if it's a dir that was only kept to reach something
+	immutable inside it.  Under ImmutablePolicy_Skip, that's fine: this
+	returns nil, and the caller should leave the path be.  Under the other
+	policies, it's an error of category fs.ErrTargetImmutable.
+
+	Any other error -- one that no immutable file had a hand in -- is
+	returned as is.
+*/
+func CheckImmutableCollision(afs fs.FS, path fs.RelPath, policy ImmutablePolicy, err error) error {
+	switch Category(err) {
+	case fs.ErrAlreadyExists, fs.ErrPermission:
+		// Could be; look.
+	default:
+		return err
+	}
+	frozen, found := findImmutable(afs, path)
+	if !found {
+		return err
+	}
+	if policy == ImmutablePolicy_Skip {
+		return nil
+	}
+	return ErrorDetailed(
+		fs.ErrTargetImmutable,
+		fmt.Sprintf("cannot place %q: target %q is immutable", afs.BasePath().Join(path), afs.BasePath().Join(frozen)),
+		map[string]string{"path": afs.BasePath().Join(frozen).String()},
+	)
+}
+
+/*
+	Finds an immutable entry at the path, above it, or (if it's a dir)
+	anywhere within it.  Anything we can't read the flags of, we pass over.
+*/
+func findImmutable(afs fs.FS, path fs.RelPath) (fs.RelPath, bool) {
+	for _, p := range path.Split() {
+		if flags, err := GetInodeFlags(afs, p); err == nil && flags&InodeFlag_Immutable != 0 {
+			return p, true
+		}
+	}
+	return findImmutableWithin(afs, path)
+}
+
+func findImmutableWithin(afs fs.FS, path fs.RelPath) (fs.RelPath, bool) {
+	children, err := afs.ReadDirNames(path)
+	if err != nil {
+		return fs.RelPath{}, false
+	}
+	for _, child := range children {
+		p := path.Join(fs.MustRelPath(child))
+		if flags, err := GetInodeFlags(afs, p); err == nil && flags&InodeFlag_Immutable != 0 {
+			return p, true
+		}
+		if fmeta, err := afs.LStat(p); err != nil || fmeta.Type != fs.Type_Dir {
+			continue // and never follow a symlink.
+		}
+		if frozen, found := findImmutableWithin(afs, p); found {
+			return frozen, true
+		}
+	}
+	return fs.RelPath{}, false
+}
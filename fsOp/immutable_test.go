@@ -0,0 +1,82 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	. "go.polydawn.net/rio/testutil"
+)
+
+func TestRemoveDirContentWithPolicy(t *testing.T) {
+	Convey("Clearing a target containing immutable files:", t, Requires(RequiresCanSetImmutable, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tgt"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tgt/plain"), Type: fs.Type_File, Perms: 0644}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tgt/deep"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tgt/deep/frozen"), Type: fs.Type_File, Perms: 0644}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tgt/deep/plain"), Type: fs.Type_File, Perms: 0644}, nil)
+			frozen := fs.MustRelPath("tgt/deep/frozen")
+			So(SetInodeFlags(afs, frozen, InodeFlag_Immutable), ShouldBeNil)
+			// Always thaw it again, or the tmpdir cleanup can't remove it either.
+			defer SetInodeFlags(afs, frozen, 0)
+
+			flags, err := GetInodeFlags(afs, frozen)
+			So(err, ShouldBeNil)
+			So(flags&InodeFlag_Immutable, ShouldNotEqual, 0)
+
+			Convey("the fail policy should error clearly", func() {
+				err := RemoveDirContentWithPolicy(afs, fs.MustRelPath("tgt"), ImmutablePolicy_Fail, nil)
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrTargetImmutable)
+				So(ShouldStat(afs, frozen).Type, ShouldEqual, fs.Type_File)
+			})
+			Convey("the clear policy should remove everything", func() {
+				So(RemoveDirContentWithPolicy(afs, fs.MustRelPath("tgt"), ImmutablePolicy_Clear, nil), ShouldBeNil)
+				names, err := afs.ReadDirNames(fs.MustRelPath("tgt"))
+				So(err, ShouldBeNil)
+				So(names, ShouldBeEmpty)
+			})
+			Convey("the skip policy should leave only the immutable file and its parents", func() {
+				var skipped []fs.RelPath
+				So(RemoveDirContentWithPolicy(afs, fs.MustRelPath("tgt"), ImmutablePolicy_Skip, func(path fs.RelPath) {
+					skipped = append(skipped, path)
+				}), ShouldBeNil)
+				So(skipped, ShouldResemble, []fs.RelPath{frozen})
+				So(ShouldStat(afs, frozen).Type, ShouldEqual, fs.Type_File)
+				_, err := afs.LStat(fs.MustRelPath("tgt/plain"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				_, err = afs.LStat(fs.MustRelPath("tgt/deep/plain"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+
+				Convey("and placing over what's left should collide only with that", func() {
+					place := func(name string, typ fs.Type) error {
+						return PlaceFile(afs, fs.Metadata{Name: fs.MustRelPath(name), Type: typ, Perms: 0755}, nil, false)
+					}
+					for _, policy := range []ImmutablePolicy{ImmutablePolicy_Skip, ImmutablePolicy_Fail} {
+						for _, name := range []string{"tgt/deep", "tgt/deep/frozen"} {
+							err := place(name, fs.Type_Dir)
+							So(err, ShouldNotBeNil)
+							if policy == ImmutablePolicy_Skip {
+								So(CheckImmutableCollision(afs, fs.MustRelPath(name), policy, err), ShouldBeNil)
+							} else {
+								So(CheckImmutableCollision(afs, fs.MustRelPath(name), policy, err), errcat.ErrorShouldHaveCategory, fs.ErrTargetImmutable)
+							}
+						}
+					}
+					So(place("tgt/plain", fs.Type_Dir), ShouldBeNil)
+					err := place("tgt/plain", fs.Type_Dir)
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrAlreadyExists)
+					So(CheckImmutableCollision(afs, fs.MustRelPath("tgt/plain"), ImmutablePolicy_Skip, err), ShouldEqual, err)
+				})
+			})
+		})
+	}))
+}
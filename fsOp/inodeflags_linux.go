@@ -0,0 +1,85 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Inode flags (the things `lsattr` and `chattr` show) are only reachable
+// by ioctl, which the standard lib doesn't wrap.
+
+package fsOp
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"go.polydawn.net/rio/fs"
+)
+
+type InodeFlags uint32
+
+const (
+	InodeFlag_Immutable  InodeFlags = 0x00000010 // FS_IMMUTABLE_FL
+	InodeFlag_AppendOnly InodeFlags = 0x00000020 // FS_APPEND_FL
+)
+
+// These are not currently available in syscall.
+//  (Values are for 64-bit platforms; the ioctl number encodes the size of a long.)
+const (
+	_FS_IOC_GETFLAGS = 0x80086601
+	_FS_IOC_SETFLAGS = 0x40086602
+)
+
+/*
+	Read the inode flags of a file or dir.
+
+	Like RemoveDirContent, this assumes an osfs and goes around it.
+
+	Only regular files and dirs can be asked -- getting the flags requires
+	opening the path, which isn't possible for symlinks and is unwise for
+	devices and fifos.  Other types report no flags.
+	Filesystems that have no concept of inode flags also report no flags.
+*/
+func GetInodeFlags(afs fs.FS, path fs.RelPath) (InodeFlags, error) {
+	var flags InodeFlags
+	err := inodeFlagsIoctl(afs, path, _FS_IOC_GETFLAGS, &flags)
+	return flags, err
+}
+
+/*
+	Set the inode flags of a file or dir.
+	Changing the immutable flag requires CAP_LINUX_IMMUTABLE.
+
+	Same caveats as GetInodeFlags; asking to set flags on other types is a no-op.
+*/
+func SetInodeFlags(afs fs.FS, path fs.RelPath, flags InodeFlags) error {
+	return inodeFlagsIoctl(afs, path, _FS_IOC_SETFLAGS, &flags)
+}
+
+func inodeFlagsIoctl(afs fs.FS, path fs.RelPath, op uintptr, flags *InodeFlags) error {
+	fmeta, err := afs.LStat(path)
+	if err != nil {
+		return err
+	}
+	switch fmeta.Type {
+	case fs.Type_File, fs.Type_Dir:
+		// pass
+	default:
+		return nil
+	}
+	rpath := afs.BasePath().Join(path).String()
+	f, err := os.OpenFile(rpath, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	defer f.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), op, uintptr(unsafe.Pointer(flags)))
+	switch {
+	case errno == 0:
+		return nil
+	case op == _FS_IOC_GETFLAGS && (errno == syscall.ENOTTY || errno == syscall.ENOTSUP):
+		return nil
+	default:
+		return fs.NormalizeIOError(&os.PathError{"ioctl", rpath, errno})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Inode flags are a linux thing.  Elsewhere, nothing has any, and setting
+// them isn't supported.
+
+package fsOp
+
+import (
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/rio/fs"
+)
+
+type InodeFlags uint32
+
+const (
+	InodeFlag_Immutable  InodeFlags = 0x00000010 // FS_IMMUTABLE_FL
+	InodeFlag_AppendOnly InodeFlags = 0x00000020 // FS_APPEND_FL
+)
+
+func GetInodeFlags(afs fs.FS, path fs.RelPath) (InodeFlags, error) {
+	return 0, nil
+}
+
+func SetInodeFlags(afs fs.FS, path fs.RelPath, flags InodeFlags) error {
+	return Errorf(fs.ErrNotSupported, "inode flags are not supported on this platform")
+}
@@ -38,6 +38,9 @@ import (
 	This may be considered a security concern; you should whitelist inputs
 	if using this to provision a sandbox.
 
+	Whiteouts remove the path, and everything under it, if it exists
+	(see RemoveAll).  That's the whole of placing one.
+
 	If skipChown is true, it does what it says on the tin: skips setting ownership.
 	This will result in UIDs and GIDs from the rio process being in effect;
 	it's also a rough proxy for "don't require priviledged operations".
@@ -48,6 +51,98 @@ import (
 	because it is not the unpack command's job to maintain a CAS filesystem.)
 */
 func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) error {
+	return PlaceFileWithPolicy(afs, fmeta, body, skipChown, ChownPolicy{})
+}
+
+/*
+	ChownPolicy describes which chown failures PlaceFileWithPolicy may
+	tolerate rather than treating as fatal.
+
+	The zero value is strict: any chown error aborts, same as PlaceFile.
+
+	(Xattrs are always best-effort, whatever the policy: one the target
+	filesystem can't hold, or we lack the privileges to set, is skipped;
+	see OnSkipXattr.)
+*/
+type ChownPolicy struct {
+	/*
+		If true, an `fs.ErrNotSupported` error from chowning a *symlink* is
+		skipped rather than returned.  Some filesystems and platforms simply
+		can't set ownership on a symlink, and the ownership of a symlink is
+		almost never consulted by anything, so this is often safe to ignore.
+
+		Chown errors on any other type of file are still fatal.
+	*/
+	SkipUnsupportedSymlink bool
+
+	/*
+		If true, an `fs.ErrPermission` error from chowning *anything* is
+		skipped rather than returned.  This makes ownership best-effort,
+		which is what you want when running without CAP_CHOWN (e.g. rootless
+		containers) and the ownership is nice-to-have rather than essential.
+	*/
+	SkipUnpermitted bool
+
+	/*
+		If true, xattrs aren't set at all, whatever the metadata says.
+		(Unpacking leaves them off unless config says to keep them.)
+	*/
+	SkipXattrs bool
+
+	/*
+		Optional.  Called with the file's metadata and the error each time
+		a chown error is skipped; use it to raise a warning.
+	*/
+	OnSkip func(fmeta fs.Metadata, err error)
+
+	/*
+		Optional.  Called with the file's metadata, the key, and the error
+		each time an xattr is skipped; use it to raise a warning.
+	*/
+	OnSkipXattr func(fmeta fs.Metadata, key string, err error)
+}
+
+/*
+	Exactly like PlaceFile, but chown errors are handled according to policy.
+
+	See ChownPolicy for what may be skipped.
+*/
+func PlaceFileWithPolicy(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool, policy ChownPolicy) error {
+	return placeFile(afs, fmeta, body, skipChown, policy, false)
+}
+
+/*
+	Like PlaceFileWithPolicy, but placing over whatever's at the path already,
+	the way an image layer is applied over the layers below it.
+
+	An existing dir, where `fmeta` is a dir too, is kept, with everything in
+	it, and given the new attribs (as PlaceFile always does for the base dir).
+	Anything else already at the path is removed first (see RemoveAll).
+*/
+func PlaceFileOver(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool, policy ChownPolicy) error {
+	if fmeta.Type != fs.Type_Whiteout && fmeta.Name != (fs.RelPath{}) {
+		existing, err := afs.LStat(fmeta.Name)
+		switch {
+		case err == nil && existing.Type == fs.Type_Dir && fmeta.Type == fs.Type_Dir:
+			// Kept; placeFile will update it.
+		case err == nil:
+			if err := RemoveAll(afs, fmeta.Name); err != nil {
+				return err
+			}
+		case Category(err) != fs.ErrNotExists:
+			return err
+		}
+	}
+	return placeFile(afs, fmeta, body, skipChown, policy, true)
+}
+
+func placeFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool, policy ChownPolicy, keepDirs bool) error {
+	// Whiteouts are placed by removing whatever's there (a symlink included:
+	//  it's removed, not followed).  There are no attribs to set after that.
+	if fmeta.Type == fs.Type_Whiteout {
+		return RemoveAll(afs, fmeta.Name)
+	}
+
 	// First, no part of the path may be a symlink.
 	for path := fmeta.Name; ; path = path.Dir() {
 		if path == (fs.RelPath{}) {
@@ -79,14 +174,15 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(file, body); err != nil {
+		// Whole blocks of zeros are left as holes; see SparseBlock.
+		if _, err := copySparse(file, body); err != nil {
 			file.Close()
 			return fs.NormalizeIOError(err)
 		}
 		file.Close()
 	case fs.Type_Dir:
-		if fmeta.Name == (fs.RelPath{}) {
-			// for the base dir only:
+		if fmeta.Name == (fs.RelPath{}) || keepDirs {
+			// for the base dir only (or any dir, if placing over):
 			// the dir may exist; we'll just chown+chmod+chtime it.
 			// there is no race-free path through this btw, unless you know of a way to lstat and mkdir in the same syscall.
 			if existingFmeta, err := afs.LStat(fmeta.Name); err == nil && existingFmeta.Type == fs.Type_Dir {
@@ -122,7 +218,17 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 			return err
 		}
 	case fs.Type_Hardlink:
-		panic("todo hardlines not handled")
+		// The link target is a path in this same filesystem, and must stay in it.
+		//  Attribs belong to the target; they're not ours to set, so we're done here.
+		target, err := fs.ParseRelPath(fmeta.Linkname)
+		if err != nil || target.GoesUp() {
+			return ErrorDetailed(
+				fs.ErrBreakout,
+				fmt.Sprintf("breakout error: refusing to hardlink %q to %q, which is outside %q", fmeta.Name, fmeta.Linkname, afs.BasePath()),
+				map[string]string{"path": fmeta.Name.String(), "linkTarget": fmeta.Linkname},
+			)
+		}
+		return afs.Mkhardlink(fmeta.Name, target)
 	default:
 		panic(fmt.Sprintf("placefile: unhandled file mode %q", fmeta.Type))
 	}
@@ -131,7 +237,12 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 	// Unless you asked for us to avoid using that (priviledge-requiring) syscall, of course.
 	if !skipChown {
 		if err := afs.Lchown(fmeta.Name, fmeta.Uid, fmeta.Gid); err != nil {
-			return err
+			if !policy.tolerates(fmeta, err) {
+				return err
+			}
+			if policy.OnSkip != nil {
+				policy.OnSkip(fmeta, err)
+			}
 		}
 		// Chown'ing may clear the setuid and setgid bits, if they were present!
 		//  Reinstate them.
@@ -142,12 +253,23 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 		}
 	}
 
-	// Skipping on xattrs for the moment.
-	//	for key, value := range hdr.Xattrs {
-	//		if err := fspatch.Lsetxattr(destPath, key, []byte(value), 0); err != nil {
-	//			ioError(err)
-	//		}
-	//	}
+	// Set xattrs, if any (and wanted).  Best-effort: keys in the "security." and
+	//  "trusted." namespaces need privileges, "user." ones can't go on symlinks
+	//  at all, and plenty of filesystems (tmpfs, NFS) take only some or none.
+	if !policy.SkipXattrs {
+		for key, value := range fmeta.Xattrs {
+			if err := afs.LSetXattr(fmeta.Name, key, []byte(value)); err != nil {
+				switch Category(err) {
+				case fs.ErrPermission, fs.ErrNotSupported:
+					if policy.OnSkipXattr != nil {
+						policy.OnSkipXattr(fmeta, key, err)
+					}
+				default:
+					return err
+				}
+			}
+		}
+	}
 
 	// Last of all, set times.  (All the earlier mutations like chown would alter them again.)
 	// We split behavior based whether or not target is a symlink, because it broadens
@@ -168,3 +290,14 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 	// Success!
 	return nil
 }
+
+func (policy ChownPolicy) tolerates(fmeta fs.Metadata, err error) bool {
+	switch {
+	case policy.SkipUnsupportedSymlink && fmeta.Type == fs.Type_Symlink && Category(err) == fs.ErrNotSupported:
+		return true
+	case policy.SkipUnpermitted && Category(err) == fs.ErrPermission:
+		return true
+	default:
+		return false
+	}
+}
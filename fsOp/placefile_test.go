@@ -8,9 +8,13 @@ package fsOp
 import (
 	"bytes"
 	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/testutil"
@@ -48,6 +52,45 @@ func TestPlaceFile(t *testing.T) {
 					}, bytes.NewBuffer([]byte("abc\n")), true)
 					So(fsErr.Error(), ShouldContainSubstring, "no such")
 				})
+				Convey("Placing a file with blocks of zeros should leave holes", func() {
+					body := make([]byte, 16*SparseBlock)
+					copy(body[3*SparseBlock:], "abc")
+					fsErr := PlaceFile(afs, fs.Metadata{
+						Name:  fs.MustRelPath("thing"),
+						Type:  fs.Type_File,
+						Perms: 0644,
+					}, bytes.NewBuffer(body), true)
+					So(fsErr, ShouldBeNil)
+					bs, err := ioutil.ReadFile(tmpDir.Join(fs.MustRelPath("thing")).String())
+					So(err, ShouldBeNil)
+					So(bytes.Equal(bs, body), ShouldBeTrue)
+					So(IsSparse(afs, fs.MustRelPath("thing")), ShouldBeTrue)
+				})
+				Convey("Placing a file ending in zeros should leave none of them allocated", func() {
+					body := make([]byte, 16*SparseBlock)
+					copy(body, "abc")
+					fsErr := PlaceFile(afs, fs.Metadata{
+						Name:  fs.MustRelPath("thing"),
+						Type:  fs.Type_File,
+						Perms: 0644,
+					}, bytes.NewBuffer(body), true)
+					So(fsErr, ShouldBeNil)
+					f, err := os.Open(tmpDir.Join(fs.MustRelPath("thing")).String())
+					So(err, ShouldBeNil)
+					defer f.Close()
+					fi, err := f.Stat()
+					So(err, ShouldBeNil)
+					So(fi.Size(), ShouldEqual, len(body))
+					runs, size, err := DataRuns(f)
+					if errcat.Category(err) == fs.ErrNotSupported {
+						return // only linux can say.
+					}
+					So(err, ShouldBeNil)
+					So(size, ShouldEqual, len(body))
+					So(runs, ShouldHaveLength, 1)
+					So(runs[0].Offset, ShouldEqual, 0)
+					So(runs[0].Length, ShouldBeLessThanOrEqualTo, SparseBlock)
+				})
 			})
 			Convey("Simple dir placements should work", func() {
 				// TODO
@@ -58,3 +101,198 @@ func TestPlaceFile(t *testing.T) {
 		})
 	})
 }
+
+// Wraps a real filesystem, but every Lchown fails as if the filesystem can't do it.
+type lchownUnsupportedFS struct {
+	fs.FS
+}
+
+func (afs lchownUnsupportedFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return errcat.ErrorDetailed(fs.ErrNotSupported, "lchown "+path.String()+": operation not supported", map[string]string{"path": path.String()})
+}
+
+func TestPlaceFileChownPolicy(t *testing.T) {
+	Convey("PlaceFile chown policy suite:", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := lchownUnsupportedFS{osfs.New(tmpDir)}
+			symlinkFmeta := fs.Metadata{
+				Name:     fs.MustRelPath("lnk"),
+				Type:     fs.Type_Symlink,
+				Linkname: "./target",
+				Uid:      4000,
+				Gid:      4000,
+			}
+			fileFmeta := fs.Metadata{
+				Name:  fs.MustRelPath("file"),
+				Type:  fs.Type_File,
+				Perms: 0644,
+				Uid:   4000,
+				Gid:   4000,
+			}
+			Convey("The default (strict) policy should fail on unsupported symlink chown", func() {
+				err := PlaceFile(afs, symlinkFmeta, nil, false)
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotSupported)
+			})
+			Convey("The skipping policy should tolerate unsupported symlink chown, and report it", func() {
+				var skipped []fs.RelPath
+				err := PlaceFileWithPolicy(afs, symlinkFmeta, nil, false, ChownPolicy{
+					SkipUnsupportedSymlink: true,
+					OnSkip: func(fmeta fs.Metadata, err error) {
+						skipped = append(skipped, fmeta.Name)
+					},
+				})
+				So(err, ShouldBeNil)
+				So(skipped, ShouldResemble, []fs.RelPath{symlinkFmeta.Name})
+				target, isSymlink, err := afs.Readlink(symlinkFmeta.Name)
+				So(err, ShouldBeNil)
+				So(isSymlink, ShouldBeTrue)
+				So(target, ShouldEqual, "./target")
+			})
+			Convey("The skipping policy should still fail on unsupported chown of non-symlinks", func() {
+				err := PlaceFileWithPolicy(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), false, ChownPolicy{
+					SkipUnsupportedSymlink: true,
+				})
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotSupported)
+			})
+		})
+	})
+}
+
+// Wraps a real filesystem, but every Lchown fails as if we lack CAP_CHOWN.
+type lchownUnpermittedFS struct {
+	fs.FS
+}
+
+func (afs lchownUnpermittedFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return errcat.ErrorDetailed(fs.ErrPermission, "lchown "+path.String()+": operation not permitted", map[string]string{"path": path.String()})
+}
+
+func TestPlaceFileChownPolicyUnpermitted(t *testing.T) {
+	Convey("PlaceFile chown policy without chown permission:", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := lchownUnpermittedFS{osfs.New(tmpDir)}
+			fileFmeta := fs.Metadata{
+				Name:  fs.MustRelPath("file"),
+				Type:  fs.Type_File,
+				Perms: 0644,
+				Uid:   4000,
+				Gid:   4000,
+			}
+			Convey("The default (strict) policy should fail", func() {
+				err := PlaceFile(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), false)
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrPermission)
+			})
+			Convey("The best-effort policy should place the file anyway", func() {
+				err := PlaceFileWithPolicy(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), false, ChownPolicy{
+					SkipUnpermitted: true,
+				})
+				So(err, ShouldBeNil)
+				fmeta, err := afs.LStat(fileFmeta.Name)
+				So(err, ShouldBeNil)
+				So(fmeta.Size, ShouldEqual, 4)
+			})
+		})
+	})
+}
+
+// Wraps a real filesystem, but xattrs can't be set: "security." ones for
+// want of privilege, "user." ones for want of support, and others at all.
+type xattrUnsettableFS struct {
+	fs.FS
+}
+
+func (afs xattrUnsettableFS) LSetXattr(path fs.RelPath, name string, value []byte) error {
+	switch {
+	case strings.HasPrefix(name, "security."):
+		return errcat.ErrorDetailed(fs.ErrPermission, "lsetxattr "+path.String()+": operation not permitted", map[string]string{"path": path.String()})
+	case strings.HasPrefix(name, "user."):
+		return errcat.ErrorDetailed(fs.ErrNotSupported, "lsetxattr "+path.String()+": operation not supported", map[string]string{"path": path.String()})
+	default:
+		return errcat.ErrorDetailed(fs.ErrMisc, "lsetxattr "+path.String()+": input/output error", map[string]string{"path": path.String()})
+	}
+}
+
+func TestPlaceFileXattrs(t *testing.T) {
+	Convey("PlaceFile xattrs:", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := xattrUnsettableFS{osfs.New(tmpDir)}
+			fileFmeta := fs.Metadata{
+				Name:   fs.MustRelPath("file"),
+				Type:   fs.Type_File,
+				Perms:  0644,
+				Xattrs: map[string]string{"security.capability": "x", "user.thing": "y"},
+			}
+			Convey("xattrs we can't set, for want of privilege or support, should be skipped, and reported", func() {
+				var skipped []string
+				err := PlaceFileWithPolicy(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), true, ChownPolicy{
+					OnSkipXattr: func(fmeta fs.Metadata, key string, err error) {
+						skipped = append(skipped, key)
+					},
+				})
+				So(err, ShouldBeNil)
+				sort.Strings(skipped)
+				So(skipped, ShouldResemble, []string{"security.capability", "user.thing"})
+				fmeta, err := afs.LStat(fileFmeta.Name)
+				So(err, ShouldBeNil)
+				So(fmeta.Size, ShouldEqual, 4)
+			})
+			Convey("even with the strict default policy", func() {
+				err := PlaceFile(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), true)
+				So(err, ShouldBeNil)
+			})
+			Convey("other failures should still be errors", func() {
+				fileFmeta.Xattrs = map[string]string{"trusted.thing": "z"}
+				err := PlaceFile(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), true)
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrMisc)
+			})
+			Convey("with SkipXattrs, none should even be tried", func() {
+				fileFmeta.Xattrs = map[string]string{"trusted.thing": "z"}
+				err := PlaceFileWithPolicy(afs, fileFmeta, bytes.NewBuffer([]byte("abc\n")), true, ChownPolicy{
+					SkipXattrs: true,
+					OnSkipXattr: func(fmeta fs.Metadata, key string, err error) {
+						panic("should not be called")
+					},
+				})
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestPlaceFileOver(t *testing.T) {
+	Convey("PlaceFileOver suite:", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			So(PlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("d"), Type: fs.Type_Dir, Perms: 0755}, nil, true), ShouldBeNil)
+			So(PlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("d/kept"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("old"), true), ShouldBeNil)
+			So(PlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("old"), true), ShouldBeNil)
+
+			Convey("A dir over a dir should keep what's in it, and take the new attribs", func() {
+				So(PlaceFileOver(afs, fs.Metadata{Name: fs.MustRelPath("d"), Type: fs.Type_Dir, Perms: 0700}, nil, true, ChownPolicy{}), ShouldBeNil)
+				fmeta, err := afs.LStat(fs.MustRelPath("d"))
+				So(err, ShouldBeNil)
+				So(fmeta.Perms, ShouldEqual, 0700)
+				_, err = afs.LStat(fs.MustRelPath("d/kept"))
+				So(err, ShouldBeNil)
+			})
+			Convey("A file over a file should replace it", func() {
+				So(PlaceFileOver(afs, fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("new"), true, ChownPolicy{}), ShouldBeNil)
+				bs, err := ioutil.ReadFile(tmpDir.String() + "/f")
+				So(err, ShouldBeNil)
+				So(string(bs), ShouldEqual, "new")
+			})
+			Convey("A file over a dir should replace the dir, and all in it", func() {
+				So(PlaceFileOver(afs, fs.Metadata{Name: fs.MustRelPath("d"), Type: fs.Type_File, Perms: 0644}, bytes.NewBufferString("new"), true, ChownPolicy{}), ShouldBeNil)
+				fmeta, err := afs.LStat(fs.MustRelPath("d"))
+				So(err, ShouldBeNil)
+				So(fmeta.Type, ShouldEqual, fs.Type_File)
+			})
+			Convey("A dir over a file should replace the file", func() {
+				So(PlaceFileOver(afs, fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_Dir, Perms: 0755}, nil, true, ChownPolicy{}), ShouldBeNil)
+				fmeta, err := afs.LStat(fs.MustRelPath("f"))
+				So(err, ShouldBeNil)
+				So(fmeta.Type, ShouldEqual, fs.Type_Dir)
+			})
+		})
+	})
+}
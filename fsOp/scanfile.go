@@ -18,6 +18,8 @@ import (
 
 	The reader is nil if the path is any type other than a file.  If a
 	reader is returned, the caller is expected to close it.
+
+	Xattrs aren't scanned; see ScanFileWithXattrs.
 */
 func ScanFile(afs fs.FS, path fs.RelPath) (fmeta *fs.Metadata, body io.ReadCloser, err error) {
 	// most of the heavy work is already done by fs.Lstat; this method just adds the file content.
@@ -25,13 +27,31 @@ func ScanFile(afs fs.FS, path fs.RelPath) (fmeta *fs.Metadata, body io.ReadClose
 	if err != nil {
 		return fmeta, nil, err
 	}
+	return scanBody(afs, path, fmeta)
+}
+
+/*
+	Exactly like ScanFile, but also fills in Metadata.Xattrs.
+
+	The same files can carry different xattrs from one host to the next
+	(an selinux label is the host's business, not the fileset's), so
+	anything that hashes should only ask for them if the user opted in.
+*/
+func ScanFileWithXattrs(afs fs.FS, path fs.RelPath) (fmeta *fs.Metadata, body io.ReadCloser, err error) {
+	fmeta, err = afs.LStatWithXattrs(path)
+	if err != nil {
+		return fmeta, nil, err
+	}
+	return scanBody(afs, path, fmeta)
+}
+
+func scanBody(afs fs.FS, path fs.RelPath, fmeta *fs.Metadata) (_ *fs.Metadata, body io.ReadCloser, err error) {
 	switch fmeta.Type {
 	case fs.Type_File:
-		var err error
 		body, err = afs.OpenFile(path, os.O_RDONLY, 0)
 		if err != nil {
 			return fmeta, body, err
 		}
 	}
-	return
+	return fmeta, body, nil
 }
@@ -0,0 +1,139 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Where the filesystem can't say where a file's holes are (see DataRuns),
+	they're looked for as whole blocks of zeros of this size, at offsets
+	aligned to it.  Runs of zeros shorter than this are just written out.
+*/
+const SparseBlock = 64 << 10
+
+var zeroBlock = make([]byte, SparseBlock)
+
+/*
+	Returns true if bs is all zeros.
+*/
+func IsZero(bs []byte) bool {
+	for len(bs) > SparseBlock {
+		if !bytes.Equal(bs[:SparseBlock], zeroBlock) {
+			return false
+		}
+		bs = bs[SparseBlock:]
+	}
+	return bytes.Equal(bs, zeroBlock[:len(bs)])
+}
+
+/*
+	Returns true if a regular file has fewer blocks allocated than its size
+	needs -- which is to say, it has holes in it (or the filesystem is
+	compressing it; either way, its zero runs are worth looking for).
+
+	Like RemoveDirContent, this assumes an osfs and goes around it:
+	fs.Metadata doesn't carry allocation.
+*/
+func IsSparse(afs fs.FS, path fs.RelPath) bool {
+	fi, err := os.Lstat(afs.BasePath().Join(path).String())
+	if err != nil {
+		return false
+	}
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode().IsRegular() && sys.Blocks*512 < fi.Size()
+}
+
+/*
+	A run of data in a file; everything between runs is a hole.
+*/
+type DataRun struct {
+	Offset, Length int64
+}
+
+/*
+	Copies body into file, leaving whole blocks of zeros (in the file's
+	block size, or SparseBlock if it won't say) as holes rather than writing
+	them.  The holes are punched afterwards (see PunchHole), so none of them
+	is left allocated -- not even the one the file's last byte is written
+	into, to give it its full size.  Where punching isn't supported, the
+	blocks that were skipped are holes anyway, if the filesystem has them.
+*/
+func copySparse(file fs.File, body io.Reader) (n int64, err error) {
+	block := holeBlockSize(file)
+	buf := make([]byte, (SparseBlock+block-1)/block*block)
+	var holes []DataRun
+	for {
+		m, err := io.ReadFull(body, buf)
+		for off := 0; off < m; off += block {
+			chunk := buf[off:m]
+			if len(chunk) > block {
+				chunk = chunk[:block]
+			}
+			at := n + int64(off)
+			if len(chunk) == block && IsZero(chunk) {
+				if last := len(holes) - 1; last >= 0 && holes[last].Offset+holes[last].Length == at {
+					holes[last].Length += int64(block)
+				} else {
+					holes = append(holes, DataRun{at, int64(block)})
+				}
+			} else if _, err := file.WriteAt(chunk, at); err != nil {
+				return n, err
+			}
+		}
+		n += int64(m)
+		switch err {
+		case nil:
+			continue
+		case io.EOF, io.ErrUnexpectedEOF:
+			// done
+		default:
+			return n, err
+		}
+		break
+	}
+	if len(holes) == 0 {
+		return n, nil
+	}
+	if last := holes[len(holes)-1]; last.Offset+last.Length == n {
+		if _, err := file.WriteAt([]byte{0}, n-1); err != nil {
+			return n, err
+		}
+	}
+	for _, hole := range holes {
+		switch err := PunchHole(file, hole.Offset, hole.Length); Category(err) {
+		case nil, fs.ErrNotSupported:
+			// Either way, it's as much of a hole as it's going to get.
+		default:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+/*
+	The size of the blocks a file's holes can be made of: the filesystem's
+	block size, if the file can say, or else SparseBlock.
+*/
+func holeBlockSize(file fs.File) int {
+	if f, ok := file.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if fi, err := f.Stat(); err == nil {
+			if sys, ok := fi.Sys().(*syscall.Stat_t); ok && sys.Blksize > 0 {
+				return int(sys.Blksize)
+			}
+		}
+	}
+	return SparseBlock
+}
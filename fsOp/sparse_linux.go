@@ -0,0 +1,99 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Finding and making holes in files takes lseek and fallocate flags that
+// the standard lib doesn't name.
+
+package fsOp
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+// These are not currently available in syscall.
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+/*
+	Asks the filesystem where a file's data is (with SEEK_DATA and
+	SEEK_HOLE), returning the runs of data between its holes, and the
+	file's size.  The file's offset is left where it was.
+
+	Filesystems that don't keep track of holes report the whole file as
+	data.  If the file can't be asked at all (it's not an OS file, or the
+	kernel predates SEEK_DATA), the error is of category fs.ErrNotSupported.
+*/
+func DataRuns(file io.Seeker) (runs []DataRun, size int64, err error) {
+	if _, ok := file.(*os.File); !ok {
+		return nil, 0, Errorf(fs.ErrNotSupported, "can't ask where the holes are in a %T", file)
+	}
+	pos, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, fs.NormalizeIOError(err)
+	}
+	defer file.Seek(pos, io.SeekStart)
+	size, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, fs.NormalizeIOError(err)
+	}
+	for off := int64(0); off < size; {
+		start, err := file.Seek(off, seekData)
+		if isErrno(err, syscall.ENXIO) {
+			break // nothing but hole from here to the end.
+		} else if isErrno(err, syscall.EINVAL) {
+			return nil, 0, Errorf(fs.ErrNotSupported, "can't ask where the holes are: %s", err)
+		} else if err != nil {
+			return nil, 0, fs.NormalizeIOError(err)
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return nil, 0, fs.NormalizeIOError(err)
+		}
+		if end > size {
+			end = size // it grew while we looked; the caller will find out.
+		}
+		runs = append(runs, DataRun{start, end - start})
+		off = end
+	}
+	return runs, size, nil
+}
+
+/*
+	Deallocates a range of a file, leaving a hole (which reads as zeros).
+	The file's size doesn't change.  Errors with category fs.ErrNotSupported
+	if the file isn't an OS file, or its filesystem can't do it.
+*/
+func PunchHole(file fs.File, offset, length int64) error {
+	f, ok := file.(*os.File)
+	if !ok {
+		return Errorf(fs.ErrNotSupported, "can't punch holes in a %T", file)
+	}
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	switch err {
+	case nil:
+		return nil
+	case syscall.EOPNOTSUPP:
+		return Errorf(fs.ErrNotSupported, "can't punch holes in %q: %s", f.Name(), err)
+	default:
+		return fs.NormalizeIOError(&os.PathError{Op: "fallocate", Path: f.Name(), Err: err})
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == errno
+}
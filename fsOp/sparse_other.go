@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Asking where holes are, and punching them, is only implemented on linux.
+// Elsewhere they're reported as unsupported: holes are found by looking
+// for zeros, and made by seeking over them.
+
+package fsOp
+
+import (
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+func DataRuns(file io.Seeker) (runs []DataRun, size int64, err error) {
+	return nil, 0, Errorf(fs.ErrNotSupported, "finding holes is not supported on this platform")
+}
+
+func PunchHole(file fs.File, offset, length int64) error {
+	return Errorf(fs.ErrNotSupported, "punching holes is not supported on this platform")
+}
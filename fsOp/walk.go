@@ -0,0 +1,74 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"errors"
+
+	"go.polydawn.net/rio/fs"
+)
+
+var (
+	// Return from a Walk func, on a dir, to not walk into that dir.
+	SkipDir = errors.New("skip this dir")
+	// Return from a Walk func to end the walk there, without error.
+	StopWalk = errors.New("stop walking")
+)
+
+/*
+	Walks the tree at `root`, calling `fn` on each path in it, root first.
+
+	The order is deterministic: each dir's entries are visited sorted by
+	name, and a dir is visited before its contents (and all of its contents
+	before its next sibling).  That's the same order on every walk of the
+	same tree, so anything hashed along the way comes out the same.
+
+	The metadata for the root is as from LStat; all the rest is as from
+	ReadDir, so a symlink's Linkname is not filled in.  Symlinks are never
+	followed, including at the root: a symlink to a dir is visited as a
+	symlink, and what's in the dir isn't.
+
+	If `fn` returns SkipDir on a dir, that dir's contents are skipped
+	(on anything else, SkipDir is the same as nil).  If it returns
+	StopWalk, the walk ends, and Walk returns nil.  Any other error ends
+	the walk and is returned as-is, as is any error from reading the tree.
+
+	(fs.Walk, by contrast, has post-visits too, but no skipping or stopping,
+	and isn't promised to keep any order.)
+*/
+func Walk(afs fs.FS, root fs.RelPath, fn func(fs.RelPath, *fs.Metadata) error) error {
+	fmeta, err := afs.LStat(root)
+	if err != nil {
+		return err
+	}
+	err = walk(afs, fmeta, fn)
+	if err == StopWalk {
+		return nil
+	}
+	return err
+}
+
+func walk(afs fs.FS, fmeta *fs.Metadata, fn func(fs.RelPath, *fs.Metadata) error) error {
+	switch err := fn(fmeta.Name, fmeta); {
+	case err == SkipDir:
+		return nil
+	case err != nil:
+		return err
+	}
+	if fmeta.Type != fs.Type_Dir {
+		return nil
+	}
+	entries, err := afs.ReadDir(fmeta.Name)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if err := walk(afs, &entries[i], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/memfs"
+	"go.polydawn.net/rio/fs/osfs"
+	. "go.polydawn.net/rio/testutil"
+)
+
+func TestWalk(t *testing.T) {
+	for _, fsName := range []string{"osfs", "memfs"} {
+		fsName := fsName
+		Convey("Walk, on "+fsName+":", t, func() {
+			WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir)
+				if fsName == "memfs" {
+					afs = memfs.New(tmpDir)
+				}
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree"), Type: fs.Type_Dir, Perms: 0755}, nil)
+				// Placed out of order, so that any order that comes out is the walk's.
+				for _, name := range []string{"tree/c", "tree/a", "tree/b", "tree/a/z", "tree/a/y"} {
+					mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath(name), Type: fs.Type_Dir, Perms: 0755}, nil)
+				}
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/a/y/f"), Type: fs.Type_File, Perms: 0644}, nil)
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/a.f"), Type: fs.Type_File, Perms: 0644}, nil)
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("tree/lnk"), Type: fs.Type_Symlink, Linkname: "./a"}, nil)
+				walk := func(root string, fn func(fs.RelPath, *fs.Metadata) error) ([]string, error) {
+					var visited []string
+					err := Walk(afs, fs.MustRelPath(root), func(path fs.RelPath, fmeta *fs.Metadata) error {
+						visited = append(visited, path.String())
+						if fn != nil {
+							return fn(path, fmeta)
+						}
+						return nil
+					})
+					return visited, err
+				}
+
+				Convey("Walk should visit dirs before their contents, in sorted order, every time...", func() {
+					visited, err := walk("tree", nil)
+					So(err, ShouldBeNil)
+					So(visited, ShouldResemble, []string{
+						"./tree",
+						"./tree/a",
+						"./tree/a/y",
+						"./tree/a/y/f",
+						"./tree/a/z",
+						"./tree/a.f",
+						"./tree/b",
+						"./tree/c",
+						"./tree/lnk",
+					})
+					again, err := walk("tree", nil)
+					So(err, ShouldBeNil)
+					So(again, ShouldResemble, visited)
+				})
+				Convey("Walk should not traverse symlinks, even at the root...", func() {
+					visited, err := walk("tree/lnk", func(path fs.RelPath, fmeta *fs.Metadata) error {
+						So(fmeta.Type, ShouldEqual, fs.Type_Symlink)
+						return nil
+					})
+					So(err, ShouldBeNil)
+					So(visited, ShouldResemble, []string{"./tree/lnk"})
+				})
+				Convey("Walk should skip the contents of a dir on SkipDir...", func() {
+					visited, err := walk("tree", func(path fs.RelPath, fmeta *fs.Metadata) error {
+						switch path.String() {
+						case "./tree/a", "./tree/a.f":
+							return SkipDir
+						}
+						return nil
+					})
+					So(err, ShouldBeNil)
+					So(visited, ShouldResemble, []string{"./tree", "./tree/a", "./tree/a.f", "./tree/b", "./tree/c", "./tree/lnk"})
+				})
+				Convey("Walk should end on StopWalk, without error...", func() {
+					visited, err := walk("tree", func(path fs.RelPath, fmeta *fs.Metadata) error {
+						if path.String() == "./tree/a/y/f" {
+							return StopWalk
+						}
+						return nil
+					})
+					So(err, ShouldBeNil)
+					So(visited, ShouldResemble, []string{"./tree", "./tree/a", "./tree/a/y", "./tree/a/y/f"})
+				})
+				Convey("Walk should end on any other error, and return it...", func() {
+					visited, err := walk("tree", func(path fs.RelPath, fmeta *fs.Metadata) error {
+						if path.String() == "./tree/b" {
+							return errcat.Errorf(fs.ErrMisc, "halt")
+						}
+						return nil
+					})
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrMisc)
+					So(visited, ShouldHaveLength, 7)
+				})
+				Convey("Walk on a path that doesn't exist should say so...", func() {
+					visited, err := walk("nope", nil)
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					So(visited, ShouldBeEmpty)
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package stitch
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/polydawn/refmt/misc"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/lib/guid"
+)
+
+/*
+	AssemblyState is the record of progress kept in an Assembler's state file,
+	so that rerunning an interrupted assembly of the same spec can skip
+	work that's already done.
+
+	The SpecHash covers the target base path and every part's path, wareID,
+	and filters (warehouses are excluded: where a ware came from doesn't
+	change what it is).  If the spec changes at all, the hash changes,
+	and the whole state is considered stale and discarded.
+
+	Fetches are what get resumed: a part recorded as cached is not unpacked
+	again if its cache shelf is still on disk.
+	Placements are recorded too, but are *not* reused: the teardown for a
+	mount can't be reconstructed from a file by a different process, so
+	every placement is redone (all placers already clear or mask whatever
+	is at their destination).
+*/
+type AssemblyState struct {
+	SpecHash string
+	Cached   map[string]string // target path -> cache path
+	Placed   map[string]bool   // target path -> placement was completed
+}
+
+type assemblyStateFile struct {
+	path  fs.AbsolutePath
+	mu    sync.Mutex
+	state AssemblyState
+}
+
+/*
+	Load the state file at the given path.
+	If it's missing, unreadable, or doesn't match the spec hash (stale),
+	a fresh, empty state is used instead.
+*/
+func loadAssemblyState(path fs.AbsolutePath, specHash string) *assemblyStateFile {
+	sf := &assemblyStateFile{path: path}
+	if bs, err := ioutil.ReadFile(path.String()); err == nil {
+		if json.Unmarshal(bs, &sf.state) == nil && sf.state.SpecHash == specHash {
+			if sf.state.Cached == nil {
+				sf.state.Cached = map[string]string{}
+			}
+			if sf.state.Placed == nil {
+				sf.state.Placed = map[string]bool{}
+			}
+			return sf
+		}
+	}
+	sf.state = AssemblyState{
+		SpecHash: specHash,
+		Cached:   map[string]string{},
+		Placed:   map[string]bool{},
+	}
+	return sf
+}
+
+/*
+	Return the cache path recorded for a part, if there is one
+	and it's still present on disk.
+*/
+func (sf *assemblyStateFile) cachedPath(part UnpackSpec) (fs.AbsolutePath, bool) {
+	sf.mu.Lock()
+	cachePath, ok := sf.state.Cached[part.Path.String()]
+	sf.mu.Unlock()
+	if !ok {
+		return fs.AbsolutePath{}, false
+	}
+	if _, err := os.Lstat(cachePath); err != nil {
+		return fs.AbsolutePath{}, false
+	}
+	return fs.MustAbsolutePath(cachePath), true
+}
+
+func (sf *assemblyStateFile) markCached(part UnpackSpec, cachePath fs.AbsolutePath) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.state.Cached[part.Path.String()] = cachePath.String()
+	return sf.save()
+}
+
+func (sf *assemblyStateFile) markPlaced(part UnpackSpec) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.state.Placed[part.Path.String()] = true
+	return sf.save()
+}
+
+func (sf *assemblyStateFile) remove() error {
+	if err := os.Remove(sf.path.String()); err != nil && !os.IsNotExist(err) {
+		return Errorf(rio.ErrLocalCacheProblem, "error removing assembly state file: %s", err)
+	}
+	return nil
+}
+
+// Write to a temp file and rename, so an interruption never leaves a torn state file.
+// Caller must hold the lock.
+func (sf *assemblyStateFile) save() error {
+	bs, err := json.Marshal(sf.state)
+	if err != nil {
+		panic(err)
+	}
+	tmpPath := sf.path.Dir().Join(fs.MustRelPath(".tmp.state." + guid.New()))
+	if err := ioutil.WriteFile(tmpPath.String(), bs, 0644); err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "error saving assembly state file: %s", err)
+	}
+	if err := os.Rename(tmpPath.String(), sf.path.String()); err != nil {
+		os.Remove(tmpPath.String())
+		return Errorf(rio.ErrLocalCacheProblem, "error saving assembly state file: %s", err)
+	}
+	return nil
+}
+
+/*
+	Hash the parts of a spec that determine the assembly result.
+	Parts must already be sorted.
+*/
+func assemblySpecHash(targetFs fs.FS, parts []UnpackSpec) string {
+	type hashedPart struct {
+		Path    string
+		WareID  string
+		Filters interface{}
+	}
+	hashed := struct {
+		Base  string
+		Parts []hashedPart
+	}{Base: targetFs.BasePath().String()}
+	for _, part := range parts {
+		hashed.Parts = append(hashed.Parts, hashedPart{part.Path.String(), part.WareID.String(), part.Filters})
+	}
+	bs, err := json.Marshal(hashed)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha512.Sum384(bs)
+	return misc.Base58Encode(sum[:])
+}
@@ -8,6 +8,7 @@ package placer
 import (
 	"fmt"
 	"syscall"
+	"time"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api/rio"
@@ -62,9 +63,41 @@ func (j bindJanitor) Description() string {
 	return fmt.Sprintf("umount %q;", j.mountPath)
 }
 func (j bindJanitor) Teardown() error {
-	if err := syscall.Unmount(j.mountPath.String(), 0); err != nil {
+	if err := unmountPatiently(j.mountPath.String()); err != nil {
 		return Errorf(rio.ErrLocalCacheProblem, "error tearing down bind mount: %s", err)
 	}
 	return nil
 }
 func (j bindJanitor) AlwaysTry() bool { return true }
+
+// How many times, and how long to first wait, before giving up on a busy mount.
+//  Waits double each time, so the defaults add up to a bit over a second.
+var (
+	unmountRetries = 7
+	unmountBackoff = 10 * time.Millisecond
+)
+
+/*
+	Unmount, retrying for a while if the mount is busy.
+
+	Mounts are often busy only momentarily (some process hasn't quite let go
+	of a cwd or an fd yet), so we retry with backoff; if it's *still* busy,
+	we detach it lazily (MNT_DETACH), which removes it from the namespace now
+	and lets the kernel finish the job once the last user goes away.
+	An error is returned only if even that fails.
+*/
+func unmountPatiently(path string) error {
+	wait := unmountBackoff
+	for i := 0; ; i++ {
+		err := syscall.Unmount(path, 0)
+		if err != syscall.EBUSY {
+			return err
+		}
+		if i == unmountRetries {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
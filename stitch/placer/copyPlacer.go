@@ -11,9 +11,11 @@ import (
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/log"
 )
 
 var _ Placer = CopyPlacer
@@ -24,22 +26,42 @@ var _ Placer = CopyPlacer
 	Whether you need a "writable" mode or not is ignored; you're getting one.
 	The result filesystem will always be writable; it is not possible to make
 	a read-only filesystem with this placer.
+
+	Needs no mount privileges, so this works in rootless containers.
+	Perms, symlinks, fifos, and device nodes are all reproduced;
+	ownership is best-effort (without the caps for chown, it's skipped).
 */
 func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
+	return copyPlace(srcPath, dstPath, false, rio.Monitor{})
+}
+
+/*
+	Exactly like CopyPlacer, but anything skipped -- ownership we weren't
+	permitted to set, say -- is logged to `mon` as a warning.
+*/
+func CopyPlacerWithMonitor(mon rio.Monitor) Placer {
+	return func(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
+		return copyPlace(srcPath, dstPath, false, mon)
+	}
+}
+
+/*
+	Does the work of CopyPlacer; and of HardlinkPlacer, for which `link` is
+	set, making each regular file a hardlink to its source instead of a copy
+	(or, if the link can't be made, a copy after all).
+*/
+func copyPlace(srcPath, dstPath fs.AbsolutePath, link bool, mon rio.Monitor) (Janitor, error) {
 	// Determine desired type.
 	srcStat, err := rootFs.LStat(srcPath.CoerceRelative())
 	if err != nil {
 		return nil, Errorf(rio.ErrLocalCacheProblem, "error placing with copy placer: %s", err)
 	}
 	switch srcStat.Type {
-	case fs.Type_File:
-		// pass
-	case fs.Type_Dir:
+	case fs.Type_File, fs.Type_Dir, fs.Type_Symlink, fs.Type_NamedPipe, fs.Type_Device, fs.Type_CharDevice:
 		// pass
 	default:
-		// Some of the other placers (namely, bind) can handle device files and such, but copy does not.
-		// Symlinks are on the wishlist for copyplacer support, PRs welcome.
-		return nil, Errorf(rio.ErrAssemblyInvalid, "placer: source may only be dir or plain file (%s is %s)", srcPath, srcStat.Type)
+		// A live socket can't be copied; you'd have to bind it.
+		return nil, Errorf(rio.ErrAssemblyInvalid, "placer: copy placer cannot place %s (%s)", srcStat.Type, srcPath)
 	}
 
 	// Capture the parent dir mtime and defer its repair, because we're about to disrupt it.
@@ -47,25 +69,52 @@ func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
 
 	// Remove any files already here -- this is to emulate the same behavior
 	//  as would be seen with a mount (things masked just vanish).
-	if err := os.RemoveAll(dstPath.String()); err != nil {
+	//  Immutable files can't simply vanish; config says what to do with them.
+	//  If they're skipped, they stay, and so does whatever we'd have copied over them.
+	policy, err := config.GetImmutableTargetPolicy()
+	if err != nil {
+		return nil, err
+	}
+	immutablePolicy := fsOp.ImmutablePolicy(policy)
+	if err := fsOp.RemoveAllWithPolicy(rootFs, dstPath.CoerceRelative(), immutablePolicy, nil); err != nil {
 		return nil, Errorf(rio.ErrAssemblyInvalid, "error clearing copy placement area: %s", err)
 	}
+	skipKept := func(afs fs.FS, path fs.RelPath, err error) error {
+		if err == nil {
+			return nil
+		}
+		if err := fsOp.CheckImmutableCollision(afs, path, immutablePolicy, err); err != nil {
+			return err
+		}
+		log.ImmutableTargetSkipped(mon, path)
+		return nil
+	}
+	chownPolicy := fsOp.ChownPolicy{
+		SkipUnpermitted: true,
+		OnSkip: func(fmeta fs.Metadata, err error) {
+			log.ChownSkipped(mon, fmeta.Name, err)
+		},
+	}
 
-	// If plain file: handle that first and return early.
+	// If anything other than a dir: handle that first and return early.
 	//  The non-recursive case is much easier.
-	switch srcStat.Type {
-	case fs.Type_File:
+	if srcStat.Type != fs.Type_Dir {
+		if link && srcStat.Type == fs.Type_File && os.Link(srcPath.String(), dstPath.String()) == nil {
+			return copyJanitor{
+				dstPath,
+			}, nil
+		}
 		fmeta, body, err := fsOp.ScanFile(rootFs, srcPath.CoerceRelative())
 		if err != nil {
 			return nil, Errorf(rio.ErrLocalCacheProblem, "error placing with copy placer: %s", err)
 		}
-		defer body.Close()
+		if body != nil {
+			defer body.Close()
+		}
 		fmeta.Name = dstPath.CoerceRelative()
 		return copyJanitor{
 			dstPath,
-		}, fsOp.PlaceFile(rootFs, *fmeta, body, false)
-	case fs.Type_Symlink:
-		panic("TODO copy placer support for symlinks")
+		}, skipKept(rootFs, fmeta.Name, fsOp.PlaceFileWithPolicy(rootFs, *fmeta, body, false, chownPolicy))
 	}
 
 	// For dirs, do a treewalk and copy.  Mtime repair required following every node.
@@ -75,6 +124,13 @@ func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
 		if filenode.Err != nil {
 			return filenode.Err
 		}
+		if link && filenode.Info.Type == fs.Type_File {
+			if os.Link(srcFs.BasePath().Join(filenode.Info.Name).String(), dstFs.BasePath().Join(filenode.Info.Name).String()) == nil {
+				return nil
+			}
+			// Fall through and copy.  (Content is right either way; and if
+			//  something kept is in the way, placing the copy will say so.)
+		}
 		fmeta, body, err := fsOp.ScanFile(srcFs, filenode.Info.Name)
 		if err != nil {
 			return err
@@ -82,7 +138,7 @@ func CopyPlacer(srcPath, dstPath fs.AbsolutePath, _ bool) (Janitor, error) {
 		if body != nil {
 			defer body.Close()
 		}
-		return fsOp.PlaceFile(dstFs, *fmeta, body, false)
+		return skipKept(dstFs, fmeta.Name, fsOp.PlaceFileWithPolicy(dstFs, *fmeta, body, false, chownPolicy))
 	}
 	postVisit := func(filenode *fs.FilewalkNode) error {
 		if filenode.Info.Type == fs.Type_Dir {
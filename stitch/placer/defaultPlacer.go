@@ -0,0 +1,171 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package placer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"go.polydawn.net/rio/caps"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+)
+
+var _ Placer = DefaultPlacer
+
+/*
+	Names a placement mechanism, as chosen by DefaultPlacer.
+*/
+type Mechanism string
+
+const (
+	Mechanism_Overlay Mechanism = "overlay"
+	Mechanism_Bind    Mechanism = "bind"
+	Mechanism_Copy    Mechanism = "copy"
+)
+
+/*
+	What DefaultPlacer found out about this process's environment.
+	Use its String form to explain to an operator why (for example) a slow
+	copy was done instead of a mount.
+*/
+type PlacerProbe struct {
+	CanOverlay   bool
+	OverlayError error // why overlay is unusable, if it is.
+	CanBind      bool
+	BindError    error // why bind is unusable, if it is.
+}
+
+/*
+	Picks a mechanism for a placement.
+
+	Writable placements must never mutate the source, which rules out bind:
+	overlay if we can, else copy.
+	Read-only placements prefer bind, which is the cheapest of all.
+*/
+func (p PlacerProbe) Choose(writable bool) Mechanism {
+	switch {
+	case writable && p.CanOverlay:
+		return Mechanism_Overlay
+	case writable:
+		return Mechanism_Copy
+	case p.CanBind:
+		return Mechanism_Bind
+	case p.CanOverlay: // overlay placer does a bind itself for read-only.
+		return Mechanism_Overlay
+	default:
+		return Mechanism_Copy
+	}
+}
+
+func (p PlacerProbe) String() string {
+	overlay := "usable"
+	if !p.CanOverlay {
+		overlay = fmt.Sprintf("unusable (%s)", p.OverlayError)
+	}
+	bind := "usable"
+	if !p.CanBind {
+		bind = fmt.Sprintf("unusable (%s)", p.BindError)
+	}
+	return fmt.Sprintf("overlay: %s; bind: %s; writable placements use %s, read-only placements use %s",
+		overlay, bind, p.Choose(true), p.Choose(false))
+}
+
+var (
+	defaultProbeOnce sync.Once
+	defaultProbe     PlacerProbe
+)
+
+/*
+	Returns the result of probing which placers work here.
+	The probe runs once per process; later calls return the same result.
+*/
+func DefaultPlacerProbe() PlacerProbe {
+	defaultProbeOnce.Do(func() {
+		defaultProbe = probePlacers()
+	})
+	return defaultProbe
+}
+
+/*
+	Tries each mount placer for real, placing an empty dir in a tmpdir
+	and tearing it down again; all that's left afterwards is the result.
+	(In particular, the mount work dir isn't touched: probing shouldn't
+	leave anything behind, even if nothing ever gets placed.)
+*/
+func probePlacers() (p PlacerProbe) {
+	fulcrum := caps.Scan()
+	if !fulcrum.CanMountAny() {
+		p.OverlayError = fmt.Errorf("no caps for mounting")
+		p.BindError = fmt.Errorf("no caps for mounting")
+		return
+	}
+	tmpDir, err := ioutil.TempDir("", "rio-placer-probe-")
+	if err != nil {
+		p.OverlayError = err
+		p.BindError = err
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	probeDir := fs.MustAbsolutePath(tmpDir)
+	if err := os.Mkdir(probeDir.Join(fs.MustRelPath("src")).String(), 0755); err != nil {
+		p.OverlayError = err
+		p.BindError = err
+		return
+	}
+
+	if fulcrum.CanMountBind() {
+		p.BindError = probePlacer(BindPlacer, probeDir, "bind", false)
+	} else {
+		p.BindError = fmt.Errorf("no caps for mounting binds")
+	}
+	p.CanBind = p.BindError == nil
+
+	overlayPlacer, err := NewOverlayPlacer(probeDir.Join(fs.MustRelPath("overlay")))
+	if err != nil {
+		p.OverlayError = err
+	} else {
+		p.OverlayError = probePlacer(overlayPlacer, probeDir, "overlay", true)
+	}
+	p.CanOverlay = p.OverlayError == nil
+	return
+}
+
+func probePlacer(placer Placer, probeDir fs.AbsolutePath, name string, writable bool) error {
+	dstPath := probeDir.Join(fs.MustRelPath("dst-" + name))
+	janitor, err := placer(probeDir.Join(fs.MustRelPath("src")), dstPath, writable)
+	if err != nil {
+		return err
+	}
+	return janitor.Teardown()
+}
+
+/*
+	Places with the best mechanism available, per DefaultPlacerProbe:
+	overlay, bind, or plain copy as a last resort (which always works,
+	but costs time and space proportional to the fileset).
+
+	Call `DefaultPlacerProbe().Choose(writable)` to see which it'll use.
+*/
+func DefaultPlacer(srcPath, dstPath fs.AbsolutePath, writable bool) (Janitor, error) {
+	probe := DefaultPlacerProbe()
+	switch probe.Choose(writable) {
+	case Mechanism_Overlay:
+		overlayPlacer, err := NewOverlayPlacer(config.GetMountWorkPath().Join(fs.MustRelPath("overlay")))
+		if err != nil {
+			return nil, err
+		}
+		return overlayPlacer(srcPath, dstPath, writable)
+	case Mechanism_Bind:
+		return BindPlacer(srcPath, dstPath, writable)
+	case Mechanism_Copy:
+		return CopyPlacer(srcPath, dstPath, writable)
+	default:
+		panic("unreachable")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package placer
+
+import (
+	"os"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+var _ Placer = HardlinkPlacer
+
+/*
+	Makes files appear in place like CopyPlacer does, except that for
+	read-only placements on the same filesystem as the source, each regular
+	file is a hardlink to the source's file rather than a copy of it.
+	Dirs, symlinks, and the rest are still recreated; they're cheap.
+	This saves the time and space of copying the contents, which is most of it.
+
+	Writable placements, and placements onto another filesystem (where a
+	hardlink can't reach), get a plain copy, exactly as from CopyPlacer.
+
+	"Read-only" is only a promise here: the placed files are the source's
+	files, so anything with permission to write one can alter the source
+	(which, when it's the cache, would be very bad).  Use this only where
+	that promise is kept, or where a bind mount would have been used if
+	there were the caps for it.
+
+	Teardown is a recursive remove, which drops the links without touching
+	the files they point to.  Needs no mount privileges.
+*/
+func HardlinkPlacer(srcPath, dstPath fs.AbsolutePath, writable bool) (Janitor, error) {
+	if writable {
+		return copyPlace(srcPath, dstPath, false, rio.Monitor{})
+	}
+	same, err := sameDevice(srcPath, dstPath.Dir())
+	if err != nil {
+		return nil, Errorf(rio.ErrAssemblyInvalid, "error placing with hardlink placer: %s", err)
+	}
+	return copyPlace(srcPath, dstPath, same, rio.Monitor{})
+}
+
+func sameDevice(a, b fs.AbsolutePath) (bool, error) {
+	aStat, err := os.Lstat(a.String())
+	if err != nil {
+		return false, err
+	}
+	bStat, err := os.Lstat(b.String())
+	if err != nil {
+		return false, err
+	}
+	aSys, ok1 := aStat.Sys().(*syscall.Stat_t)
+	bSys, ok2 := bStat.Sys().(*syscall.Stat_t)
+	return ok1 && ok2 && aSys.Dev == bSys.Dev, nil
+}
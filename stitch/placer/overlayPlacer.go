@@ -23,8 +23,15 @@ import (
 	If writable=false, the overlay indirection will be skipped, and a simple bind mount used.
 	If writable=true, an overlay work/layer dir will be created in a tmpdir, and writes
 	end up there (meaning the original source remains unmutated).
+	Teardown unmounts, then removes the work/layer dirs.
+
+	Returns an error if the kernel doesn't support overlayfs, so callers
+	can choose another placer.
 */
 func NewOverlayPlacer(workDir fs.AbsolutePath) (Placer, error) {
+	if !isFSAvailable("overlay") {
+		return nil, Errorf(rio.ErrAssemblyInvalid, "placer: overlayfs is not supported by this kernel")
+	}
 	if err := fsOp.MkdirAll(rootFs, workDir.CoerceRelative(), 0700); err != nil {
 		return nil, Errorf(rio.ErrLocalCacheProblem, "error creating overlay work area: %s", err)
 	}
@@ -84,35 +91,34 @@ func NewOverlayPlacer(workDir fs.AbsolutePath) (Placer, error) {
 		//  If you were doing this in a shell, it'd be roughly `mount -t overlay overlay -o lowerdir=lower,upperdir=upper,workdir=work mntpoint`.
 		//  Yes, this may behave oddly in the event of paths containing ":" or "=" or ",".
 		if err := syscall.Mount("none", dstPath.String(), "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", srcPath, upperPath, workPath)); err != nil {
+			os.RemoveAll(overlayPath.String())
+			if err == syscall.ENODEV {
+				return nil, Errorf(rio.ErrAssemblyInvalid, "error placing with overlay mount: overlayfs is not supported by this kernel")
+			}
 			return nil, Errorf(rio.ErrAssemblyInvalid, "error placing with overlay mount: %s", err)
 		}
 
 		// Return a cleanup func that will gracefully unmount... and also remove layer content.
 		return overlayJanitor{
 			dstPath,
-			upperPath,
-			workPath,
+			overlayPath,
 		}, nil
 	}, nil
 }
 
 type overlayJanitor struct {
-	mountPath fs.AbsolutePath
-	upperPath fs.AbsolutePath
-	workPath  fs.AbsolutePath
+	mountPath   fs.AbsolutePath
+	overlayPath fs.AbsolutePath // holds both the upper and work dirs.
 }
 
 func (j overlayJanitor) Description() string {
-	return fmt.Sprintf("umount %q; rm -rf %q; rm -rf %q;", j.mountPath, j.upperPath, j.workPath)
+	return fmt.Sprintf("umount %q; rm -rf %q;", j.mountPath, j.overlayPath)
 }
 func (j overlayJanitor) Teardown() error {
 	if err := syscall.Unmount(j.mountPath.String(), 0); err != nil {
 		return Errorf(rio.ErrLocalCacheProblem, "error tearing down overlay mount: %s", err)
 	}
-	if err := os.RemoveAll(j.upperPath.String()); err != nil {
-		return Errorf(rio.ErrLocalCacheProblem, "error tearing down overlay placement: %s", err)
-	}
-	if err := os.RemoveAll(j.workPath.String()); err != nil {
+	if err := os.RemoveAll(j.overlayPath.String()); err != nil {
 		return Errorf(rio.ErrLocalCacheProblem, "error tearing down overlay placement: %s", err)
 	}
 	return nil
@@ -6,6 +6,10 @@ Sniperkit-Bot
 package placer
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -40,6 +44,191 @@ func TestPlacers(t *testing.T) {
 			overlayPlacer, err := NewOverlayPlacer(tmpDir.Join(fs.MustRelPath("overlay")))
 			So(err, ShouldBeNil)
 			specPlacerGood(overlayPlacer, tmpDir)
+			// Teardown should have left nothing in the work area.
+			leftovers, err := osfs.New(tmpDir).ReadDirNames(fs.MustRelPath("overlay"))
+			So(err, ShouldBeNil)
+			So(leftovers, ShouldBeEmpty)
+		})
+	}))
+}
+
+func TestBindPlacerBusyTeardown(t *testing.T) {
+	Convey("Bind placer teardown should survive a busy mount", t, Requires(RequiresCanMountBind, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			defer func(n int) { unmountRetries = n }(unmountRetries)
+			unmountRetries = 2
+			afs := osfs.New(tmpDir)
+			PlaceFixture(afs, []FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("src"), Type: fs.Type_Dir, Perms: 0755}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("src/file"), Type: fs.Type_File, Perms: 0644}, []byte("asdf")},
+			})
+			janitor, err := BindPlacer(tmpDir.Join(fs.MustRelPath("src")), tmpDir.Join(fs.MustRelPath("dst")), false)
+			So(err, ShouldBeNil)
+
+			// Hold the mount busy.
+			f, err := os.Open(tmpDir.Join(fs.MustRelPath("dst/file")).String())
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			So(janitor.Teardown(), ShouldBeNil)
+			// The mount is gone from view, even though our fd keeps it alive.
+			_, err = afs.LStat(fs.MustRelPath("dst/file"))
+			So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			body, err := ioutil.ReadAll(f)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "asdf")
+		})
+	}))
+}
+
+func TestDefaultPlacer(t *testing.T) {
+	Convey("Default placer choices:", t, func() {
+		Convey("writable placements should never choose bind", func() {
+			So(PlacerProbe{CanOverlay: true, CanBind: true}.Choose(true), ShouldEqual, Mechanism_Overlay)
+			So(PlacerProbe{CanOverlay: false, CanBind: true}.Choose(true), ShouldEqual, Mechanism_Copy)
+			So(PlacerProbe{}.Choose(true), ShouldEqual, Mechanism_Copy)
+		})
+		Convey("read-only placements should prefer bind", func() {
+			So(PlacerProbe{CanOverlay: true, CanBind: true}.Choose(false), ShouldEqual, Mechanism_Bind)
+			So(PlacerProbe{CanOverlay: true}.Choose(false), ShouldEqual, Mechanism_Overlay)
+			So(PlacerProbe{}.Choose(false), ShouldEqual, Mechanism_Copy)
+		})
+	})
+	// Overlay placements make their layers in the mount work dir; keep those out of the way.
+	wrkDir, err := ioutil.TempDir("", "rio-test-wrk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wrkDir)
+	defer os.Setenv("RIO_MOUNT_WORKDIR", os.Getenv("RIO_MOUNT_WORKDIR"))
+	os.Setenv("RIO_MOUNT_WORKDIR", filepath.Join(wrkDir, "mount"))
+	Convey("Probing placers should leave nothing behind:", t, func() {
+		probe := probePlacers()
+		So(probe.CanOverlay, ShouldEqual, probe.OverlayError == nil)
+		So(probe.CanBind, ShouldEqual, probe.BindError == nil)
+		_, err := os.Stat(filepath.Join(wrkDir, "mount"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+	Convey("Default placer spec tests:", t, Requires(RequiresCanManageOwnership, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			So(DefaultPlacerProbe().String(), ShouldNotBeBlank)
+			specPlacerGood(DefaultPlacer, tmpDir)
+		})
+	}))
+}
+
+func TestCopyPlacerSpecialFiles(t *testing.T) {
+	Convey("Copy placer should place non-dir, non-file sources:", t, Requires(RequiresCanManageOwnership, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			PlaceFixture(afs, []FixtureFile{
+				{fs.Metadata{Name: fs.MustRelPath("src"), Type: fs.Type_Dir, Perms: 0755, Mtime: time.Date(2004, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("src/lnk"), Type: fs.Type_Symlink, Linkname: "./nowhere", Uid: 4000, Mtime: time.Date(2005, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("src/fifo"), Type: fs.Type_NamedPipe, Perms: 0640, Mtime: time.Date(2006, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+				{fs.Metadata{Name: fs.MustRelPath("dst"), Type: fs.Type_Dir, Perms: 0755, Mtime: time.Date(2019, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+			})
+			for _, name := range []string{"lnk", "fifo"} {
+				janitor, err := CopyPlacer(tmpDir.Join(fs.MustRelPath("src/"+name)), tmpDir.Join(fs.MustRelPath("dst/"+name)), true)
+				So(err, ShouldBeNil)
+				srcMeta := ShouldStat(afs, fs.MustRelPath("src/"+name))
+				dstMeta := ShouldStat(afs, fs.MustRelPath("dst/"+name))
+				dstMeta.Name = srcMeta.Name
+				So(dstMeta, ShouldResemble, srcMeta)
+				So(janitor.Teardown(), ShouldBeNil)
+				_, err = afs.LStat(fs.MustRelPath("dst/" + name))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			}
+		})
+	}))
+}
+
+func TestHardlinkPlacer(t *testing.T) {
+	Convey("Hardlink placer spec tests:", t, Requires(RequiresCanManageOwnership, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			specPlacerGood(HardlinkPlacer, tmpDir)
+		})
+	}))
+	Convey("Hardlink placer:", t, Requires(RequiresCanManageOwnership, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			srcFixture := func(afs fs.FS) {
+				PlaceFixture(afs, []FixtureFile{
+					{fs.Metadata{Name: fs.MustRelPath("src"), Type: fs.Type_Dir, Perms: 0755, Mtime: time.Date(2004, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("src/file"), Type: fs.Type_File, Uid: 4000, Perms: 0640, Mtime: time.Date(2006, 01, 15, 0, 0, 0, 0, time.UTC)}, []byte("asdf")},
+					{fs.Metadata{Name: fs.MustRelPath("src/lnk"), Type: fs.Type_Symlink, Linkname: "./file", Mtime: time.Date(2005, 01, 15, 0, 0, 0, 0, time.UTC)}, nil},
+				})
+			}
+			links := func(a, b fs.AbsolutePath) uint64 {
+				fiA, err := os.Lstat(a.String())
+				So(err, ShouldBeNil)
+				fiB, err := os.Lstat(b.String())
+				So(err, ShouldBeNil)
+				if !os.SameFile(fiA, fiB) {
+					return 0
+				}
+				return uint64(fiA.Sys().(*syscall.Stat_t).Nlink)
+			}
+			afs := osfs.New(tmpDir)
+			srcFixture(afs)
+			src, dst := tmpDir.Join(fs.MustRelPath("src")), tmpDir.Join(fs.MustRelPath("dst"))
+
+			Convey("read-only placement on the same device should link the files", func() {
+				janitor, err := HardlinkPlacer(src, dst, false)
+				So(err, ShouldBeNil)
+				So(links(src.Join(fs.MustRelPath("file")), dst.Join(fs.MustRelPath("file"))), ShouldEqual, 2)
+				for _, name := range []string{".", "file", "lnk"} {
+					srcMeta := ShouldStat(afs, fs.MustRelPath("src/"+name))
+					dstMeta := ShouldStat(afs, fs.MustRelPath("dst/"+name))
+					dstMeta.Name = srcMeta.Name
+					So(dstMeta, ShouldResemble, srcMeta)
+				}
+
+				Convey("and teardown should leave the source alone", func() {
+					So(janitor.Teardown(), ShouldBeNil)
+					_, err = afs.LStat(fs.MustRelPath("dst"))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					fi, err := os.Lstat(src.Join(fs.MustRelPath("file")).String())
+					So(err, ShouldBeNil)
+					So(fi.Sys().(*syscall.Stat_t).Nlink, ShouldEqual, 1)
+					body, err := ioutil.ReadFile(src.Join(fs.MustRelPath("file")).String())
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "asdf")
+				})
+			})
+			Convey("writable placement should copy", func() {
+				janitor, err := HardlinkPlacer(src, dst, true)
+				So(err, ShouldBeNil)
+				So(links(src.Join(fs.MustRelPath("file")), dst.Join(fs.MustRelPath("file"))), ShouldEqual, 0)
+				So(janitor.Teardown(), ShouldBeNil)
+			})
+			Convey("read-only placement of a single file should link it", func() {
+				janitor, err := HardlinkPlacer(src.Join(fs.MustRelPath("file")), tmpDir.Join(fs.MustRelPath("placed")), false)
+				So(err, ShouldBeNil)
+				So(links(src.Join(fs.MustRelPath("file")), tmpDir.Join(fs.MustRelPath("placed"))), ShouldEqual, 2)
+				So(janitor.Teardown(), ShouldBeNil)
+			})
+			Convey("read-only placement across devices should copy", func() {
+				otherDir, err := ioutil.TempDir("/dev/shm", "rio-test-")
+				if err != nil {
+					SkipSo("no /dev/shm to place across devices from")
+					return
+				}
+				defer os.RemoveAll(otherDir)
+				otherFs := osfs.New(fs.MustAbsolutePath(otherDir))
+				if same, _ := sameDevice(otherFs.BasePath(), tmpDir); same {
+					SkipSo("/dev/shm is on the same device as the tmpdir")
+					return
+				}
+				srcFixture(otherFs)
+				otherSrc := otherFs.BasePath().Join(fs.MustRelPath("src"))
+				janitor, err := HardlinkPlacer(otherSrc, dst, false)
+				So(err, ShouldBeNil)
+				So(links(otherSrc.Join(fs.MustRelPath("file")), dst.Join(fs.MustRelPath("file"))), ShouldEqual, 0)
+				srcMeta := ShouldStat(otherFs, fs.MustRelPath("src/file"))
+				dstMeta := ShouldStat(afs, fs.MustRelPath("dst/file"))
+				dstMeta.Name = srcMeta.Name
+				So(dstMeta, ShouldResemble, srcMeta)
+				So(janitor.Teardown(), ShouldBeNil)
+			})
 		})
 	}))
 }
@@ -57,6 +57,7 @@ type Assembler struct {
 	cache      fs.FS
 	unpackTool rio.UnpackFunc
 	placerTool placer.Placer
+	statePath  *fs.AbsolutePath // if set, progress is recorded here so that Run can be resumed.
 }
 
 func NewAssembler(unpackTool rio.UnpackFunc) (*Assembler, error) {
@@ -71,6 +72,20 @@ func NewAssembler(unpackTool rio.UnpackFunc) (*Assembler, error) {
 	}, nil
 }
 
+/*
+	Configure the assembler to record its progress in a state file at the
+	given path, so that if a Run is interrupted, running it again with the
+	same spec skips the work that's already done.
+
+	A state file that's stale (the spec changed) or unreadable is ignored,
+	and the assembly starts fresh.  The state file is removed when the
+	teardown func returned by Run succeeds.
+	See AssemblyState for what exactly is resumed.
+*/
+func (a *Assembler) ResumeWith(statePath fs.AbsolutePath) {
+	a.statePath = &statePath
+}
+
 func (a *Assembler) Run(ctx context.Context, targetFs fs.FS, parts []UnpackSpec, fillerDirProps fs.Metadata) (func() error, error) {
 	sort.Sort(UnpackSpecByPath(parts))
 
@@ -93,6 +108,12 @@ func (a *Assembler) Run(ctx context.Context, targetFs fs.FS, parts []UnpackSpec,
 		}
 	}
 
+	// Load the state file, if we're keeping one.
+	var state *assemblyStateFile
+	if a.statePath != nil {
+		state = loadAssemblyState(*a.statePath, assemblySpecHash(targetFs, parts))
+	}
+
 	// Fan out materialization into cache paths.
 	unpackResults := make([]unpackResult, len(parts))
 	var wg sync.WaitGroup
@@ -124,6 +145,17 @@ func (a *Assembler) Run(ctx context.Context, targetFs fs.FS, parts []UnpackSpec,
 				res.Path, res.Error = fs.ParseAbsolutePath(ss[1])
 				return
 			}
+			// If a previous run already got this into cache, we're done.
+			if state != nil {
+				if cachePath, ok := state.cachedPath(part); ok {
+					if part.Monitor.Chan != nil {
+						close(part.Monitor.Chan)
+					}
+					res.Path = cachePath
+					res.Writable = true
+					return
+				}
+			}
 			// Unpack with placement=none to populate cache.
 			resultWareID, err := a.unpackTool(
 				ctx, // TODO fork em out
@@ -141,6 +173,9 @@ func (a *Assembler) Run(ctx context.Context, targetFs fs.FS, parts []UnpackSpec,
 			// Yield the cache path.
 			res.Path = config.GetCacheBasePath().Join(cache.ShelfFor(resultWareID))
 			res.Writable = true
+			if state != nil {
+				res.Error = state.markCached(part, res.Path)
+			}
 			// TODO if any error, fan out cancellations
 		}(i, part)
 	}
@@ -211,6 +246,20 @@ func (a *Assembler) Run(ctx context.Context, targetFs fs.FS, parts []UnpackSpec,
 			return nil, err
 		}
 		hk.append(janitor)
+		if state != nil {
+			if err := state.markPlaced(part); err != nil {
+				hk.Teardown()
+				return nil, err
+			}
+		}
+	}
+	if state != nil {
+		return func() error {
+			if err := hk.Teardown(); err != nil {
+				return err
+			}
+			return state.remove()
+		}, nil
 	}
 	return hk.Teardown, nil
 }
@@ -8,6 +8,7 @@ package stitch
 import (
 	"context"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -315,6 +316,76 @@ func TestTreeUnpack(t *testing.T) {
 
 					So(cleanupFunc(), ShouldBeNil)
 				})
+				Convey("Interrupted assembly should resume:", func() {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("tree")))
+					statePath := tmpDir.Join(fs.MustRelPath("assembly.state"))
+					parts := func() []UnpackSpec {
+						return []UnpackSpec{
+							{
+								Path:       fs.MustAbsolutePath("/"),
+								WareID:     api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"},
+								Filters:    api.Filter_NoMutation,
+								Warehouses: []api.WarehouseAddr{"file://../transmat/tar/fixtures/tar_withBase.tgz"},
+							},
+							{
+								Path:       fs.MustAbsolutePath("/bc"),
+								WareID:     api.WareID{"tar", "2jkqXaVWCdH7axj1XW56rxZ6WVQ8f46nqMf2BBX7kjLsU9DsvQCquEoy6GcBcQ1Fqc"},
+								Filters:    api.Filter_NoMutation,
+								Warehouses: []api.WarehouseAddr{"file://../transmat/tar/fixtures/tar_kitchenSink.tgz"},
+							},
+						}
+					}
+
+					// Wrap the unpack tool so we can count calls, and make the
+					//  kitchen sink ware fail on demand to simulate an interruption.
+					var mu sync.Mutex
+					var unpacked []string
+					interrupt := true
+					resumer, err := NewAssembler(func(ctx context.Context, wareID api.WareID, path string, filt api.FilesetFilters, placementMode rio.PlacementMode, warehouses []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						mu.Lock()
+						unpacked = append(unpacked, wareID.Hash)
+						mu.Unlock()
+						if interrupt && wareID.Hash == "2jkqXaVWCdH7axj1XW56rxZ6WVQ8f46nqMf2BBX7kjLsU9DsvQCquEoy6GcBcQ1Fqc" {
+							return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+						}
+						return tartrans.Unpack(ctx, wareID, path, filt, placementMode, warehouses, mon)
+					})
+					So(err, ShouldBeNil)
+					resumer.ResumeWith(statePath)
+
+					_, err = resumer.Run(context.Background(), afs, parts(), defaultFillerProps)
+					So(err, ErrorShouldHaveCategory, rio.ErrCancelled)
+					So(unpacked, ShouldHaveLength, 2)
+					_, err = os.Stat(statePath.String())
+					So(err, ShouldBeNil)
+
+					Convey("Rerunning the same spec should skip wares already cached", func() {
+						interrupt = false
+						cleanupFunc, err := resumer.Run(context.Background(), afs, parts(), defaultFillerProps)
+						So(err, ShouldBeNil)
+						So(unpacked, ShouldHaveLength, 3)
+						So(unpacked[2], ShouldEqual, "2jkqXaVWCdH7axj1XW56rxZ6WVQ8f46nqMf2BBX7kjLsU9DsvQCquEoy6GcBcQ1Fqc")
+
+						// Both inputs should still be in place:
+						So(ShouldStat(afs, fs.MustRelPath("ab")), ShouldResemble,
+							fs.Metadata{Name: fs.MustRelPath("ab"), Type: fs.Type_File, Uid: 7000, Gid: 7000, Perms: 0644, Mtime: time.Date(2015, 05, 30, 19, 53, 35, 0, time.UTC)})
+						So(ShouldStat(afs, fs.MustRelPath("bc/dir/f1")), ShouldResemble,
+							fs.Metadata{Name: fs.MustRelPath("bc/dir/f1"), Type: fs.Type_File, Uid: 7000, Gid: 7000, Perms: 0750, Mtime: time.Date(2017, 9, 27, 18, 25, 55, 0, time.UTC)})
+
+						// Successful teardown is the end of the assembly, so the state goes with it:
+						So(cleanupFunc(), ShouldBeNil)
+						_, err = os.Stat(statePath.String())
+						So(os.IsNotExist(err), ShouldBeTrue)
+					})
+					Convey("Rerunning a changed spec should treat the state as stale", func() {
+						interrupt = false
+						cleanupFunc, err := resumer.Run(context.Background(), afs, parts()[:1], defaultFillerProps)
+						So(err, ShouldBeNil)
+						So(unpacked, ShouldHaveLength, 3)
+						So(unpacked[2], ShouldEqual, "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ")
+						So(cleanupFunc(), ShouldBeNil)
+					})
+				})
 			})
 		}),
 	)
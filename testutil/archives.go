@@ -0,0 +1,125 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"time"
+)
+
+/*
+	The mtime of everything in the archives built here.
+*/
+var ArchiveMtime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+	An entry for the archives built here: a tar header, and the body, for
+	regular files.  Size and ModTime are filled in as the entry's written.
+*/
+type ArchiveEntry struct {
+	tar.Header
+	Body string
+}
+
+func ArchiveDir(name string) ArchiveEntry {
+	return ArchiveEntry{Header: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func ArchiveFile(name string, body string) ArchiveEntry {
+	return ArchiveEntry{Header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, Body: body}
+}
+
+func ArchiveSymlink(name string, target string) ArchiveEntry {
+	return ArchiveEntry{Header: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}}
+}
+
+/*
+	What the distro package transmats' tests unpack: a script, and a
+	symlink to it, in usr/bin.  The names start with "./", as packages' do.
+*/
+var FixturePackaged = []ArchiveEntry{
+	ArchiveDir("./"),
+	ArchiveDir("./usr/"),
+	ArchiveDir("./usr/bin/"),
+	{Header: tar.Header{Name: "./usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0755}, Body: "#!/bin/sh\n"},
+	ArchiveSymlink("./usr/bin/hi", "hello"),
+}
+
+/*
+	Regular files, from the given name and body of each, in turn.
+*/
+func ArchiveFiles(members ...string) []ArchiveEntry {
+	var entries []ArchiveEntry
+	for i := 0; i < len(members); i += 2 {
+		entries = append(entries, ArchiveFile(members[i], members[i+1]))
+	}
+	return entries
+}
+
+/*
+	A tar of the given entries, in order.
+*/
+func MakeTar(entries ...ArchiveEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range entries {
+		hdr := ent.Header
+		hdr.ModTime = ArchiveMtime
+		hdr.Size = int64(len(ent.Body))
+		tw.WriteHeader(&hdr)
+		tw.Write([]byte(ent.Body))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+/*
+	An ar archive (as debs are) of the given entries, in order.
+	Ar holds only regular files; the entries' types are ignored.
+*/
+func MakeAr(entries ...ArchiveEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, ent := range entries {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", ent.Name+"/", ArchiveMtime.Unix(), 0, 0, 0100000|ent.Mode, len(ent.Body))
+		buf.WriteString(ent.Body)
+		if len(ent.Body)%2 == 1 {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+/*
+	A cpio archive in the "newc" format (as rpm payloads are) of the given
+	entries, in order, and the trailer.
+*/
+func MakeCpio(entries ...ArchiveEntry) []byte {
+	var buf bytes.Buffer
+	pad := func() { buf.Write(make([]byte, (4-buf.Len()%4)%4)) }
+	entry := func(name string, mode int64, body string) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			buf.Len()+1, mode, 0, 0, 1, ArchiveMtime.Unix(), len(body), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		pad()
+		buf.WriteString(body)
+		pad()
+	}
+	for _, ent := range entries {
+		switch ent.Typeflag {
+		case tar.TypeDir:
+			entry(ent.Name, 040000|ent.Mode, "")
+		case tar.TypeSymlink:
+			entry(ent.Name, 0120000|ent.Mode, ent.Linkname)
+		default:
+			entry(ent.Name, 0100000|ent.Mode, ent.Body)
+		}
+	}
+	entry("TRAILER!!!", 0, "")
+	return buf.Bytes()
+}
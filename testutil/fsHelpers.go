@@ -6,6 +6,8 @@ Sniperkit-Bot
 package testutil
 
 import (
+	"time"
+
 	"github.com/smartystreets/goconvey/convey"
 	"go.polydawn.net/rio/fs"
 )
@@ -14,5 +16,8 @@ func ShouldStat(afs fs.FS, path fs.RelPath) fs.Metadata {
 	stat, err := afs.LStat(path)
 	convey.So(err, convey.ShouldBeNil)
 	stat.Mtime = stat.Mtime.UTC()
+	// Atime and ctime are whatever the host did to us; callers can't predict them.
+	stat.Atime = time.Time{}
+	stat.Ctime = time.Time{}
 	return *stat
 }
@@ -41,6 +41,11 @@ var RequiresCanMountBind = ConveyRequirement{"have caps for mounting binds", cap
 */
 var RequiresCanMountAny = ConveyRequirement{"have caps for any mounting", caps.Scan().CanMountAny}
 
+/*
+	Require that the test process is running with enough capabilities to be able to set the immutable inode flag.
+*/
+var RequiresCanSetImmutable = ConveyRequirement{"have caps for setting immutable flags", caps.Scan().CanSetImmutable}
+
 /*
 	Require than an env var *not* be set.
 
@@ -53,6 +58,20 @@ func RequiresEnvBlank(key string) ConveyRequirement {
 	}
 }
 
+/*
+	Skips the test unless the process is running as root (euid 0).
+
+	Unlike the `ConveyRequirement`s, this is for a whole `testing.T`, and
+	it skips rather than reporting prereqs: use it first thing in tests
+	that can't mean anything without privileges (making device nodes,
+	chowning to arbitrary ids), so they skip cleanly on machines without.
+*/
+func RequiresRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("requires root (running as euid %d)", os.Geteuid())
+	}
+}
+
 /*
 	Decorates a GoConvey test to check a set of `ConveyRequirement`s,
 	returning a dummy test func that skips (with an explanation!) if any
@@ -6,24 +6,55 @@ Sniperkit-Bot
 package testutil
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"testing"
 
 	"go.polydawn.net/rio/fs"
 )
 
+/*
+	The directory WithTmpdir makes its tmpdirs in.
+
+	If `$RIO_TEST_TMPDIR` is set, it's used as is; otherwise, it's a
+	"rio-test" dir in `$TMPDIR`; and failing that, "/tmp/rio-test/".
+*/
+func TmpBase() string {
+	if dir := os.Getenv("RIO_TEST_TMPDIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("TMPDIR"); dir != "" {
+		return filepath.Join(dir, "rio-test")
+	}
+	return "/tmp/rio-test/"
+}
+
 func WithTmpdir(fn func(tmpDir fs.AbsolutePath)) {
-	tmpBase := "/tmp/rio-test/"
-	err := os.MkdirAll(tmpBase, os.FileMode(0777)|os.ModeSticky)
+	tmpBase, err := filepath.Abs(TmpBase())
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("testutil: can't use %q for tmpdirs (set RIO_TEST_TMPDIR to choose another): %s", TmpBase(), err))
+	}
+	err = os.MkdirAll(tmpBase, os.FileMode(0777)|os.ModeSticky)
+	if err != nil {
+		panic(fmt.Errorf("testutil: can't use %q for tmpdirs (set RIO_TEST_TMPDIR to choose another): %s", tmpBase, err))
 	}
 
 	tmpdir, err := ioutil.TempDir(tmpBase, "")
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("testutil: can't use %q for tmpdirs (set RIO_TEST_TMPDIR to choose another): %s", tmpBase, err))
 	}
 
 	defer os.RemoveAll(tmpdir)
 	fn(fs.MustAbsolutePath(tmpdir))
 }
+
+/*
+	Exactly like WithTmpdir, but skips the test (see RequiresRoot) unless
+	we're root.
+*/
+func WithTmpdirRoot(t *testing.T, fn func(tmpDir fs.AbsolutePath)) {
+	RequiresRoot(t)
+	WithTmpdir(fn)
+}
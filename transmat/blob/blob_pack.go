@@ -0,0 +1,130 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package blobtrans
+
+import (
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The file to pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters.  Checked, but there's nothing left for them to do: see the package docs.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+	}
+	if _, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Short-circuit exit if the path does not exist.
+	afs := osfs.New(path.Dir())
+	name := fs.MustRelPath(path.Last())
+	fmeta, file, err := fsOp.ScanFile(afs, name)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return api.WareID{PackType, ""}, nil
+	default:
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+	if file != nil {
+		defer file.Close()
+	}
+	if fmeta.Type != fs.Type_File {
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot pack %s: a blob must be a file, not a %s", path, fmeta.Type)
+	}
+
+	// Connect to warehouse, and get write controller opened.
+	wc, err := tartrans.OpenWriteController(warehouseAddr, packType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Copy the file in, hashing as we go.
+	prog := progress.New(mon, "pack", fmeta.Size)
+	hasher := wareid.Default(PackType)
+	contentHasher := hasher.New()
+	n, err := io.Copy(wc, io.TeeReader(file, contentHasher))
+	if err != nil {
+		if ctx.Err() != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if n != fmeta.Size {
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "error while packing %s: file changed size while being read", path)
+	}
+	prog.Add(n, name)
+	wareID := hashBlob(hasher, fmeta.Perms&0100 != 0, contentHasher.Sum(nil))
+	prog.Done()
+
+	// If we made it all the way with no errors, commit.
+	//  (Otherwise, the write controller will be closed by default by our defers.)
+	return wareID, wc.Commit(wareID)
+}
+
+/*
+	The metadata a blob has (see the package docs), as of whether it's executable.
+*/
+func blobMetadata(executable bool) fs.Metadata {
+	fmeta := fs.Metadata{
+		Type:  fs.Type_File,
+		Perms: 0644,
+		Mtime: apiutil.DefaultMtime,
+	}
+	if executable {
+		fmeta.Perms = 0755
+	}
+	return fmeta
+}
+
+/*
+	Hash a blob into a WareID: a fileset of one file, hashed exactly as the
+	tar transmat would hash it.
+*/
+func hashBlob(hasher wareid.Hasher, executable bool, contentHash []byte) api.WareID {
+	return hashMetadata(hasher, blobMetadata(executable), contentHash)
+}
+
+func hashMetadata(hasher wareid.Hasher, fmeta fs.Metadata, contentHash []byte) api.WareID {
+	bucket := &fshash.MemoryBucket{}
+	bucket.AddRecord(fmeta, contentHash)
+	return hasher.WareID(bucket)
+}
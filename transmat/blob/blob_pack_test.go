@@ -0,0 +1,77 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package blobtrans
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func packBlob(body string, perms os.FileMode, mtime time.Time) (api.WareID, error) {
+	var wareID api.WareID
+	var err error
+	testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		path := tmpDir.String() + "/blob"
+		So(ioutil.WriteFile(path, []byte(body), perms), ShouldBeNil)
+		So(os.Chmod(path, perms), ShouldBeNil)
+		So(os.Chtimes(path, mtime, mtime), ShouldBeNil)
+		wareID, err = Pack(context.Background(), PackType, path, api.Filter_NoMutation, "", rio.Monitor{})
+	})
+	return wareID, err
+}
+
+func TestBlobPack(t *testing.T) {
+	Convey("Spec compliance: Blob pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+		}),
+	)
+	Convey("Blob transmat: pack hashes the file, and whether it's executable", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			then := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+			alpha, err := packBlob("alpha", 0644, then)
+			So(err, ShouldBeNil)
+			So(alpha.Type, ShouldEqual, PackType)
+			Convey("packing it again should produce the same hash", func() {
+				wareID, err := packBlob("alpha", 0644, then)
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, alpha)
+			})
+			Convey("differences that aren't content or the executable bit should not change the hash", func() {
+				wareID, err := packBlob("alpha", 0600, time.Now())
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, alpha)
+			})
+			Convey("different content should change the hash", func() {
+				wareID, err := packBlob("beta", 0644, then)
+				So(err, ShouldBeNil)
+				So(wareID, ShouldNotResemble, alpha)
+			})
+			Convey("being executable should change the hash", func() {
+				wareID, err := packBlob("alpha", 0755, then)
+				So(err, ShouldBeNil)
+				So(wareID, ShouldNotResemble, alpha)
+			})
+			Convey("a dir should be refused", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,159 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package blobtrans
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to place the file (absolute path; must not exist yet).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy"; "mount" is refused).
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	switch placementMode {
+	case "", rio.Placement_Copy, rio.Placement_Direct, rio.Placement_None:
+		// pass
+	default:
+		return api.WareID{}, Errorf(rio.ErrUsage, "placement mode %q makes no sense for a blob: it's one file", placementMode)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Fetch: onto the path, or, for placement "none", nowhere.
+	var afs fs.FS
+	var name fs.RelPath
+	var file io.WriteCloser
+	if placementMode == rio.Placement_None {
+		file = nopCloser{ioutil.Discard}
+	} else {
+		path2 := fs.MustAbsolutePath(path)
+		afs, name = osfs.New(path2.Dir()), fs.MustRelPath(path2.Last())
+		file, err = afs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+	}
+	prog := progress.New(mon, "unpack", 0)
+	contentHasher := hasher.New()
+	n, err := io.Copy(io.MultiWriter(file, contentHasher), reader)
+	file.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if _, ok := err.(Error); ok {
+			return api.WareID{}, err
+		}
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+	prog.Add(n, name)
+	contentHash := contentHasher.Sum(nil)
+
+	// Which way the WareID matches says if the blob's executable.
+	//  If neither does, that's a mismatch; say we got the plain one.
+	fmeta := blobMetadata(true)
+	prefilterWareID := hashMetadata(hasher, fmeta, contentHash)
+	if prefilterWareID != wareID {
+		fmeta = blobMetadata(false)
+		prefilterWareID = hashMetadata(hasher, fmeta, contentHash)
+	}
+
+	// Apply filters, and set the attribs.
+	filteredFmeta := fmeta
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	host.Apply(&filteredFmeta)
+	filters.Apply(filt2, &filteredFmeta)
+	unpackWareID := hashMetadata(hasher, filteredFmeta, contentHash)
+	if afs != nil {
+		filteredFmeta.Name = name
+		if err := setAttribs(afs, filteredFmeta, filt2.SkipChown, mon); err != nil {
+			return unpackWareID, err
+		}
+	}
+	prog.Done()
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+/*
+	Set the attribs of the placed file, as fsOp.PlaceFile would've if we'd
+	known them before the content was in.  If we're not root, being refused
+	a chown is no surprise: warn, but carry on.
+*/
+func setAttribs(afs fs.FS, fmeta fs.Metadata, skipChown bool, mon rio.Monitor) error {
+	if !skipChown {
+		if err := afs.Lchown(fmeta.Name, fmeta.Uid, fmeta.Gid); err != nil {
+			if Category(err) != fs.ErrPermission || os.Getuid() == 0 {
+				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			log.ChownSkipped(mon, fmeta.Name, err)
+		}
+	}
+	if err := afs.Chmod(fmeta.Name, fmeta.Perms); err != nil {
+		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+	if err := afs.SetTimesNano(fmeta.Name, fmeta.Mtime, fs.DefaultAtime); err != nil {
+		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
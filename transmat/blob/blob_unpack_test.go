@@ -0,0 +1,94 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package blobtrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestBlobUnpack(t *testing.T) {
+	Convey("Blob transmat: round trip", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir))
+				So(os.Mkdir(tmpDir.String()+"/bounce", 0755), ShouldBeNil)
+				pack := func(body string, perms os.FileMode) api.WareID {
+					path := tmpDir.String() + "/src"
+					os.Remove(path)
+					So(ioutil.WriteFile(path, []byte(body), perms), ShouldBeNil)
+					So(os.Chmod(path, perms), ShouldBeNil)
+					wareID, err := Pack(context.Background(), PackType, path, api.Filter_NoMutation, addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				unpack := func(wareID api.WareID, path string, placementMode rio.PlacementMode) (api.WareID, error) {
+					return Unpack(context.Background(), wareID, path, api.Filter_NoMutation, placementMode, []api.WarehouseAddr{addr}, rio.Monitor{})
+				}
+
+				Convey("a plain file should come back as it went, with the blob's metadata", func() {
+					wareID := pack("a dataset", 0600)
+					wareID2, err := unpack(wareID, tmpDir.String()+"/out", "")
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "a dataset")
+					fi, err := os.Lstat(tmpDir.String() + "/out")
+					So(err, ShouldBeNil)
+					So(fi.Mode(), ShouldEqual, os.FileMode(0644))
+					So(fi.ModTime().UTC(), ShouldResemble, apiutil.DefaultMtime)
+				})
+				Convey("an executable should come back executable", func() {
+					wareID := pack("#!/bin/sh\n", 0700)
+					wareID2, err := unpack(wareID, tmpDir.String()+"/out", rio.Placement_Direct)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					fi, err := os.Lstat(tmpDir.String() + "/out")
+					So(err, ShouldBeNil)
+					So(fi.Mode(), ShouldEqual, os.FileMode(0755))
+				})
+				Convey("placement \"none\" should verify, and place nothing", func() {
+					wareID := pack("a dataset", 0644)
+					wareID2, err := unpack(wareID, tmpDir.String()+"/out", rio.Placement_None)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					_, err = os.Lstat(tmpDir.String() + "/out")
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("placement \"mount\" should be refused", func() {
+					wareID := pack("a dataset", 0644)
+					_, err := unpack(wareID, tmpDir.String()+"/out", rio.Placement_Mount)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+				Convey("a path that already exists should be refused", func() {
+					wareID := pack("a dataset", 0644)
+					So(ioutil.WriteFile(tmpDir.String()+"/out", nil, 0644), ShouldBeNil)
+					_, err := unpack(wareID, tmpDir.String()+"/out", "")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrInoperablePath)
+				})
+				Convey("content that doesn't match should be a hash mismatch", func() {
+					wareID := pack("a dataset", 0644)
+					So(ioutil.WriteFile(tmpDir.String()+"/other", []byte("not it"), 0644), ShouldBeNil)
+					_, err := Unpack(context.Background(), wareID, tmpDir.String()+"/out", api.Filter_NoMutation, "",
+						[]api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/other", tmpDir))}, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+			})
+		}),
+	)
+}
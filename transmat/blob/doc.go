@@ -0,0 +1,32 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The blob transmat packs and unpacks wares of exactly one file: a
+	toolchain binary, a dataset, anything that'd only be put in a tarball
+	to get it through the door.  It can use any k/v-styled warehouse (just
+	like the tar transmat); the ware in the warehouse is the file's bytes,
+	verbatim, so any plain URL to a file is already a blob warehouse.
+
+	Pack takes the path of a file, rather than a dir.  Unpack places the
+	file at the path given (which must not exist yet), rather than filling
+	a dir.  Placement modes other than copy make no sense for one file:
+	"direct" is the same as copy, "none" fetches and verifies but places
+	nothing, and "mount" is refused.  Blobs aren't cached.
+
+	The WareID is computed over a fileset of just that one file, as the tar
+	transmat computes WareIDs.  The only metadata that counts is whether the
+	file is executable: beyond that, it's as if uid and gid are 0, mtime is
+	the usual default, and perms are 0644 (or 0755, if executable).  The
+	ware itself doesn't say whether it's executable; unpack tells by which
+	way the WareID matches.  Filters can change what's placed, as usual.
+*/
+package blobtrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("blob")
@@ -0,0 +1,169 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/polydawn/refmt/misc"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+const (
+	// Chunk sizes.  Changing any of these changes every WareID!
+	minChunkSize = 16 * 1024
+	maxChunkSize = 256 * 1024
+	chunkMask    = 1<<16 - 1 // cut when these bits of the rolling hash are zero: one in 64KiB, on average.
+
+	indexMagic = "rio-chunk-index-v1"
+
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+	// Longest index we'll read.  At ~100 bytes a chunk, that's
+	//  a million chunks, or some 60GiB of ware.
+	maxIndexSize = 100 << 20
+)
+
+/*
+	The table for the rolling ("gear") hash: a random-looking uint64 for
+	each byte value.  They're from splitmix64, seeded with zero, so they
+	can be checked; but they're as fixed as the chunk sizes.
+*/
+var gearTable = func() (table [256]uint64) {
+	var x uint64
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+/*
+	Cuts a stream into content-defined chunks.
+	Each chunk the rolling hash says to cut after, within the size limits.
+*/
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, maxChunkSize), buf: make([]byte, 0, maxChunkSize)}
+}
+
+/*
+	Returns the next chunk, or io.EOF when the stream's done.
+	The slice is only good until the next call.
+*/
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var h uint64
+	for len(c.buf) < maxChunkSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = h<<1 + gearTable[b]
+		if len(c.buf) >= minChunkSize && h&chunkMask == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
+
+/*
+	What a chunked ware is: the WareID of the tar the chunks make up, and
+	the chunks, in order.
+*/
+type index struct {
+	tarWareID api.WareID
+	chunks    []chunkRef
+}
+
+type chunkRef struct {
+	hash string
+	size int64
+}
+
+func hashBytes(bs []byte) string {
+	sum := sha512.Sum384(bs)
+	return misc.Base58Encode(sum[:])
+}
+
+func (idx index) encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n%s\n", indexMagic, idx.tarWareID)
+	for _, chunk := range idx.chunks {
+		fmt.Fprintf(&buf, "%s %d\n", chunk.hash, chunk.size)
+	}
+	return buf.Bytes()
+}
+
+/*
+	Parse an index.  Errors are ErrWareCorrupt.
+*/
+func parseIndex(bs []byte) (idx index, err error) {
+	lines := strings.Split(string(bs), "\n")
+	if len(lines) < 3 || lines[len(lines)-1] != "" {
+		return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: truncated")
+	}
+	lines = lines[:len(lines)-1]
+	if lines[0] != indexMagic {
+		return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: not a chunk index (expected %q, got %q)", indexMagic, lines[0])
+	}
+	idx.tarWareID, err = api.ParseWareID(lines[1])
+	if err != nil || idx.tarWareID.Type != tartrans.PackType {
+		return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: %q is not a tar WareID", lines[1])
+	}
+	for _, line := range lines[2:] {
+		fields := strings.Split(line, " ")
+		// The hash ends up in a path in the warehouse, so it had better be base58 and nothing else.
+		if len(fields) != 2 || fields[0] == "" || strings.Trim(fields[0], base58Alphabet) != "" {
+			return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: malformed line %q", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 1 || size > maxChunkSize {
+			return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: malformed line %q", line)
+		}
+		idx.chunks = append(idx.chunks, chunkRef{fields[0], size})
+	}
+	return idx, nil
+}
+
+/*
+	Returns ErrUsage unless the warehouse is content-addressable:
+	the chunks and the index need somewhere to go side by side.
+*/
+func requireCA(warehouseAddr api.WarehouseAddr) error {
+	u, err := url.Parse(string(warehouseAddr))
+	if err != nil {
+		return Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if !strings.HasPrefix(u.Scheme, "ca+") {
+		return Errorf(rio.ErrUsage, "chunked wares need a content-addressable warehouse (one with a 'ca+' scheme), not %q", warehouseAddr)
+	}
+	return nil
+}
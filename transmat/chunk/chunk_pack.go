@@ -0,0 +1,156 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).  Must be content-addressable.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	//  (The tar transmat checks the rest.)
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	if warehouseAddr != "" {
+		if err := requireCA(warehouseAddr); err != nil {
+			return api.WareID{}, err
+		}
+	}
+
+	// Tar the fileset into a pipe, and chunk it as it comes out the other end.
+	//  The tar transmat gets no monitor: it'd close ours when it's done, and we're not.
+	type tarResult struct {
+		wareID api.WareID
+		err    error
+	}
+	pr, pw := io.Pipe()
+	tarDone := make(chan tarResult, 1)
+	go func() {
+		wareID, err := tartrans.PackToStream(ctx, tartrans.PackType, pathStr, filt, pw, tartrans.PackOptions{}, rio.Monitor{})
+		pw.CloseWithError(err) // nil closes with io.EOF, which is just what the chunker wants.
+		tarDone <- tarResult{wareID, err}
+	}()
+	chunks, err := storeChunks(ctx, newChunker(pr), warehouseAddr, mon)
+	pr.Close() // If we stopped early, this stops the tar too.
+	tarred := <-tarDone
+	if err != nil {
+		return api.WareID{}, err // If the tar failed, this is its error, come through the pipe.
+	}
+	if tarred.err != nil {
+		return api.WareID{}, tarred.err
+	}
+
+	// Short-circuit exit if the path does not exist.
+	if tarred.wareID.Hash == "" {
+		return api.WareID{PackType, ""}, nil
+	}
+
+	// Store the index last, so nobody finds it before all its chunks.
+	idxBytes := index{tarred.wareID, chunks}.encode()
+	wareID := api.WareID{PackType, hashBytes(idxBytes)}
+	if warehouseAddr == "" {
+		return wareID, nil
+	}
+	wc, err := tartrans.OpenWriteController(warehouseAddr, PackType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+	if _, err := wc.Write(idxBytes); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return wareID, wc.Commit(wareID)
+}
+
+/*
+	Cut the stream into chunks, and store each in the warehouse (unless the
+	address is blank, for just scanning), returning the list of them.
+
+	Errors reading the stream are returned as they are, so an error from
+	whatever's writing into it comes through unchanged.
+*/
+func storeChunks(
+	ctx context.Context,
+	ch *chunker,
+	warehouseAddr api.WarehouseAddr,
+	mon rio.Monitor,
+) ([]chunkRef, error) {
+	// Report bytes chunked as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	var chunks []chunkRef
+	stored := map[string]struct{}{}
+	for {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		bs, err := ch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk := chunkRef{hashBytes(bs), int64(len(bs))}
+		chunks = append(chunks, chunk)
+		prog.Add(chunk.size, fs.RelPath{})
+
+		// A chunk that repeats within the ware only needs storing once.
+		if _, ok := stored[chunk.hash]; ok || warehouseAddr == "" {
+			continue
+		}
+		if err := storeChunk(warehouseAddr, chunk.hash, bs, mon); err != nil {
+			return nil, err
+		}
+		stored[chunk.hash] = struct{}{}
+	}
+	prog.Done()
+	return chunks, nil
+}
+
+func storeChunk(warehouseAddr api.WarehouseAddr, hash string, bs []byte, mon rio.Monitor) error {
+	wc, err := tartrans.OpenWriteController(warehouseAddr, PackType, mon)
+	if err != nil {
+		return err
+	}
+	defer wc.Close()
+	compWriter, err := tartrans.Compress(wc, tartrans.Gzip, 0)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "%s", err)
+	}
+	if _, err := compWriter.Write(bs); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := compWriter.Close(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return wc.Commit(api.WareID{PackType, hash})
+}
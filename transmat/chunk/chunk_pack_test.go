@@ -0,0 +1,146 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestChunkPack(t *testing.T) {
+	Convey("Spec compliance: Chunk pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, Pack)
+			tests.CheckPackHashVariesOnVariations(PackType, Pack)
+			tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+		}),
+	)
+}
+
+func TestChunker(t *testing.T) {
+	Convey("Chunk transmat: cutting streams into chunks", t, func() {
+		chunkAll := func(bs []byte) [][]byte {
+			var chunks [][]byte
+			ch := newChunker(bytes.NewReader(bs))
+			for {
+				chunk, err := ch.next()
+				if err == io.EOF {
+					return chunks
+				}
+				So(err, ShouldBeNil)
+				chunks = append(chunks, append([]byte(nil), chunk...))
+			}
+		}
+		data := make([]byte, 4<<20)
+		rand.New(rand.NewSource(1)).Read(data)
+		chunks := chunkAll(data)
+
+		Convey("chunks should be within the size limits, and add up to the stream", func() {
+			So(len(chunks), ShouldBeGreaterThan, 1)
+			So(bytes.Join(chunks, nil), ShouldResemble, data)
+			for _, chunk := range chunks[:len(chunks)-1] {
+				So(len(chunk), ShouldBeGreaterThanOrEqualTo, minChunkSize)
+				So(len(chunk), ShouldBeLessThanOrEqualTo, maxChunkSize)
+			}
+		})
+		Convey("a stream of all the same byte should still be cut, at the max size", func() {
+			chunks := chunkAll(make([]byte, 3*maxChunkSize))
+			So(chunks, ShouldHaveLength, 3)
+		})
+		Convey("an insert should only change the chunks around it", func() {
+			edited := append(append(append([]byte(nil), data[:1<<20]...), "an insert"...), data[1<<20:]...)
+			had := map[string]bool{}
+			for _, chunk := range chunks {
+				had[hashBytes(chunk)] = true
+			}
+			var changed int
+			for _, chunk := range chunkAll(edited) {
+				if !had[hashBytes(chunk)] {
+					changed++
+				}
+			}
+			So(changed, ShouldBeGreaterThan, 0)
+			So(changed, ShouldBeLessThanOrEqualTo, 3)
+		})
+	})
+}
+
+func TestChunkPackSharing(t *testing.T) {
+	Convey("Chunk transmat: similar wares share chunks", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir))
+				So(os.Mkdir(tmpDir.String()+"/bounce", 0755), ShouldBeNil)
+				countStored := func() (n int) {
+					filepath.Walk(tmpDir.String()+"/bounce", func(_ string, fi os.FileInfo, _ error) error {
+						if fi != nil && fi.Mode().IsRegular() {
+							n++
+						}
+						return nil
+					})
+					return
+				}
+				big := make([]byte, 2<<20)
+				rand.New(rand.NewSource(1)).Read(big)
+				packFiles := func(files ...tests.FixtureFile) api.WareID {
+					var wareID api.WareID
+					testutil.WithTmpdir(func(srcDir fs.AbsolutePath) {
+						tests.PlaceFixture(osfs.New(srcDir), append(append([]tests.FixtureFile(nil), tests.FixtureAlpha...), files...))
+						var err error
+						wareID, err = Pack(context.Background(), PackType, srcDir.String(), api.Filter_NoMutation, addr, rio.Monitor{})
+						So(err, ShouldBeNil)
+					})
+					return wareID
+				}
+				mtime := tests.FixtureAlpha[0].Metadata.Mtime
+				bigFile := tests.FixtureFile{fs.Metadata{Name: fs.MustRelPath("./big"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: int64(len(big))}, big}
+				first := packFiles(bigFile)
+				storedFirst := countStored()
+				So(storedFirst, ShouldBeGreaterThan, 10)
+
+				Convey("packing the same again should store nothing new", func() {
+					So(packFiles(bigFile), ShouldResemble, first)
+					So(countStored(), ShouldEqual, storedFirst)
+				})
+				Convey("packing with one more small file should store only a few chunks more", func() {
+					extra := tests.FixtureFile{fs.Metadata{Name: fs.MustRelPath("./zzz"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 5}, []byte("extra")}
+					second := packFiles(bigFile, extra)
+					So(second, ShouldNotResemble, first)
+					// One new index, and a chunk or two around the change.
+					So(countStored()-storedFirst, ShouldBeLessThanOrEqualTo, 3)
+				})
+			})
+		}),
+	)
+}
+
+func TestChunkPackWarehouses(t *testing.T) {
+	Convey("Chunk transmat: packing needs a content-addressable warehouse", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureAlpha)
+				_, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, api.WarehouseAddr(fmt.Sprintf("file://%s/ware", tmpDir)), rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			})
+		}),
+	)
+}
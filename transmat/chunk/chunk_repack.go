@@ -0,0 +1,150 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+/*
+	Store a tar ware in the target warehouse as a chunked ware, and return
+	the chunked ware's WareID.  The tar is fetched from the sources, and
+	chunked just as it'd come out of Pack, so the two WareIDs name the same
+	fileset: unpacking either gives the same files, and the chunked ware's
+	index still records the tar's WareID.
+
+	The tar is hashed on the way through, and the index isn't stored unless
+	it matches; chunks already stored by then are harmless, as ever.
+*/
+func Repack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What tar wareID to repack.
+	target api.WarehouseAddr, // Warehouse to store the chunked ware in.  Must be content-addressable.
+	sources []api.WarehouseAddr, // Warehouses we can try to fetch the tar from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != tartrans.PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "can only repack packtype %q as %q (not %q)", tartrans.PackType, PackType, wareID.Type)
+	}
+	if err := requireCA(target); err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a source warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, sources, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Copy the tar, uncompressed, into a pipe, and chunk it as in Pack.
+	//  A hash mismatch is found only at the end of the tar: it comes
+	//  through the pipe, so no index gets stored.
+	pr, pw := io.Pipe()
+	tarDone := make(chan error, 1)
+	go func() {
+		err := tartrans.RepackStream(ctx, wareID, reader, pw, tartrans.Uncompressed, 0, rio.Monitor{})
+		pw.CloseWithError(err)
+		tarDone <- err
+	}()
+	chunks, err := storeChunks(ctx, newChunker(pr), target, mon)
+	pr.Close()
+	tarErr := <-tarDone
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if tarErr != nil {
+		return api.WareID{}, tarErr
+	}
+
+	// Store the index last, so nobody finds it before all its chunks.
+	idxBytes := index{wareID, chunks}.encode()
+	chunkedWareID := api.WareID{PackType, hashBytes(idxBytes)}
+	wc, err := tartrans.OpenWriteController(target, PackType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+	if _, err := wc.Write(idxBytes); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := wc.Commit(chunkedWareID); err != nil {
+		return api.WareID{}, err
+	}
+	log.WareRepacked(mon, wareID, chunkedWareID, string(PackType))
+	return chunkedWareID, nil
+}
+
+/*
+	Store a chunked ware in the target warehouse as a tar ware, compressed
+	as asked, and return the tar's WareID: the one the chunked ware's index
+	records.  Every chunk is checked as it's fetched, and the tar as a whole
+	before it's committed.
+*/
+func RepackAsTar(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What chunked wareID to repack.
+	compression tartrans.Compression, // How to compress the tar.
+	level int, // Compression level; 0 for the codec's default.  See tartrans.Compress.
+	target api.WarehouseAddr, // Warehouse to store the tar in.
+	sources []api.WarehouseAddr, // Warehouses we can try to fetch from.  Must be content-addressable.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	for _, addr := range sources {
+		if err := requireCA(addr); err != nil {
+			return api.WareID{}, err
+		}
+	}
+
+	// Fetch the index; then open the writer for the tar.
+	idx, err := fetchIndex(ctx, wareID, sources, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	wc, err := tartrans.OpenWriteController(target, tartrans.PackType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Copy the tar the chunks make up, fetching them as it's read.
+	//  As in unpack: should fetching a chunk fail, its error says why.
+	chunks := &chunkReader{ctx: ctx, chunks: idx.chunks, warehouses: sources, mon: mon}
+	err = tartrans.RepackStream(ctx, idx.tarWareID, chunks, wc, compression, level, mon)
+	if chunks.err != nil {
+		return api.WareID{}, chunks.err
+	}
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if err := wc.Commit(idx.tarWareID); err != nil {
+		return api.WareID{}, err
+	}
+	log.WareRepacked(mon, wareID, idx.tarWareID, (&compression).Extension())
+	return idx.tarWareID, nil
+}
@@ -0,0 +1,210 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.  Must be content-addressable.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	for _, addr := range warehouses {
+		if err := requireCA(addr); err != nil {
+			return api.WareID{}, err
+		}
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Fetch the index, and check it's the one asked for.
+	//  Everything after follows from it, and is checked in turn.
+	idx, err := fetchIndex(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Extract the tar the chunks make up, fetching them as the tar's read.
+	//  Should fetching a chunk fail, the tar can only say the stream broke:
+	//  the chunk reader's error says why, so that's the one to return.
+	chunks := &chunkReader{ctx: ctx, chunks: idx.chunks, warehouses: warehouses, mon: mon}
+	prefilterWareID, unpackWareID, err := tartrans.ExtractTar(ctx, tartrans.PackType, osfs.New(path2), filt2, chunks, mon)
+	if chunks.err != nil {
+		return api.WareID{}, chunks.err
+	}
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	//  (The chunks were all as the index said, so this would take a tar
+	//  that doesn't hash as it did when it was packed.)
+	if prefilterWareID != idx.tarWareID {
+		return unpackWareID, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q (filtered %q)", idx.tarWareID, prefilterWareID, unpackWareID),
+			map[string]string{
+				"expected": idx.tarWareID.String(),
+				"actual":   prefilterWareID.String(),
+				"filtered": unpackWareID.String(),
+			},
+		)
+	}
+	// Unfiltered, what was placed is the ware asked for.  Filtered, there's
+	//  no chunked ware of it to name: the tar WareID of it is what there is.
+	if unpackWareID == prefilterWareID {
+		return wareID, nil
+	}
+	return unpackWareID, nil
+}
+
+func fetchIndex(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (index, error) {
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return index{}, err
+	}
+	defer reader.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(reader, maxIndexSize+1))
+	if err != nil {
+		return index{}, Errorf(rio.ErrWarehouseUnavailable, "error reading chunk index: %s", err)
+	}
+	if len(bs) > maxIndexSize {
+		return index{}, Errorf(rio.ErrWareCorrupt, "corrupt chunk index: more than %d bytes", maxIndexSize)
+	}
+	if actual := hashBytes(bs); actual != wareID.Hash {
+		actualWareID := api.WareID{PackType, actual}
+		return index{}, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, actualWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   actualWareID.String(),
+			},
+		)
+	}
+	return parseIndex(bs)
+}
+
+/*
+	Reads the chunks of a ware, one after another, as one stream,
+	fetching each as it's needed, and checking it against its hash.
+
+	Errors reading are kept in `err`, as well as returned, so they can
+	be told from whatever the tar reader makes of them.
+*/
+type chunkReader struct {
+	ctx        context.Context
+	chunks     []chunkRef
+	warehouses []api.WarehouseAddr
+	mon        rio.Monitor
+
+	current bytes.Reader
+	err     error
+}
+
+func (r *chunkReader) Read(bs []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.current.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		body, err := r.fetch(r.chunks[0])
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.current.Reset(body)
+		r.chunks = r.chunks[1:]
+	}
+	return r.current.Read(bs)
+}
+
+func (r *chunkReader) fetch(chunk chunkRef) ([]byte, error) {
+	chunkID := api.WareID{PackType, chunk.hash}
+	reader, err := tartrans.PickReader(r.ctx, chunkID, r.warehouses, false, r.mon)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	reader2, err := tartrans.Decompress(reader)
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt chunk %s: %s", chunk.hash, err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(reader2, chunk.size+1))
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt chunk %s: %s", chunk.hash, err)
+	}
+	if int64(len(body)) != chunk.size || hashBytes(body) != chunk.hash {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt chunk %s: contents don't match the hash", chunk.hash)
+	}
+	return body, nil
+}
@@ -0,0 +1,99 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package chunktrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestChunkUnpack(t *testing.T) {
+	Convey("Spec compliance: Chunk unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
+
+func TestChunkUnpackCorruption(t *testing.T) {
+	Convey("Chunk transmat: unpacking checks the index and every chunk", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir))
+				So(os.Mkdir(tmpDir.String()+"/bounce", 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, addr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(context.Background(), wareID, tmpDir.String()+"/out", api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{addr}, rio.Monitor{})
+				}
+				// Every file in the warehouse that isn't the index is a chunk.
+				var chunkPaths []string
+				filepath.Walk(tmpDir.String()+"/bounce", func(path string, fi os.FileInfo, _ error) error {
+					if fi != nil && fi.Mode().IsRegular() && fi.Name() != wareID.Hash {
+						chunkPaths = append(chunkPaths, path)
+					}
+					return nil
+				})
+				So(chunkPaths, ShouldNotBeEmpty)
+
+				Convey("a chunk that doesn't match its hash should be corruption", func() {
+					// Swap in another chunk's bytes, or, with only one, the index's.
+					swapIn := tmpDir.String() + "/bounce"
+					if len(chunkPaths) > 1 {
+						swapIn = chunkPaths[1]
+					} else {
+						filepath.Walk(swapIn, func(path string, fi os.FileInfo, _ error) error {
+							if fi != nil && fi.Name() == wareID.Hash {
+								swapIn = path
+							}
+							return nil
+						})
+					}
+					bs, err := ioutil.ReadFile(swapIn)
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(chunkPaths[0], bs, 0644), ShouldBeNil)
+					_, err = unpack(wareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a missing chunk should be not found", func() {
+					So(os.Remove(chunkPaths[0]), ShouldBeNil)
+					_, err := unpack(wareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+				})
+				Convey("an index that doesn't match the WareID should be a hash mismatch", func() {
+					_, err := unpack(api.WareID{PackType, filepath.Base(chunkPaths[0])})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("a warehouse that isn't content-addressable should be refused", func() {
+					_, err := Unpack(context.Background(), wareID, tmpDir.String()+"/out", api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/ware", tmpDir))}, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,40 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The chunk transmat packs filesets as content-defined chunks, stored one
+	by one in a warehouse, so wares that are mostly the same (tonight's
+	build and last night's, say) share most of their chunks, and the
+	warehouse keeps one copy of each.
+
+	Packing writes the fileset as an uncompressed tar (exactly as the tar
+	transmat would), and cuts the stream wherever a rolling hash of the
+	last few dozen bytes says to: so an edit only changes the chunks around
+	it, and the cuts after it fall where they did before.  Each chunk is
+	gzipped, and stored under the hash of its uncompressed bytes.  Then an
+	index listing the chunks, in order, is stored too; the WareID is the
+	hash of the index.  (So it's not the fileset hash, as most transmats'
+	WareIDs are: it can't be, since a tar ware of the same fileset would be
+	stored under that.  The index records the fileset hash, though, and
+	unpacking checks it.)
+
+	The chunks and the index all go in one warehouse, side by side, so it
+	must be a content-addressable one ("ca+file", "ca+s3", "ca+https",
+	etc); anything else is refused, for packing and unpacking both.
+	Unpacking fetches the index, then the chunks, checking each against
+	its hash as it goes, and unpacks the tar they make up as the tar
+	transmat would.
+
+	The chunk sizes (and the rolling hash's table) are fixed: changing
+	them would change the WareID of everything.  Chunks are at least 16KiB,
+	64KiB or so on average, and at most 256KiB.
+*/
+package chunktrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("chunk")
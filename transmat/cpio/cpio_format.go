@@ -0,0 +1,389 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cpiotrans
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+const (
+	magicNewc   = "070701"
+	magicNewcrc = "070702" // Same as newc, plus a checksum we don't check.
+	trailerName = "TRAILER!!!"
+	headerLen   = 6 + 13*8
+
+	// Longer than any path or symlink target a linux filesystem will hold (PATH_MAX).
+	maxPathLen = 4096
+
+	// The file type bits of a mode, and their values, as in linux's stat.h.
+	modeTypeMask   = 0170000
+	modeSocket     = 0140000
+	modeSymlink    = 0120000
+	modeFile       = 0100000
+	modeBlock      = 0060000
+	modeDir        = 0040000
+	modeChar       = 0020000
+	modeNamedPipe  = 0010000
+	modeXattrEntry = 0 // No type at all: our own entries, carrying xattrs.
+)
+
+/*
+	One newc header.  Every field is 32 bits on the wire (as 8 hex digits);
+	Namesize and the checksum are left out, being the writer's business.
+*/
+type header struct {
+	Ino       uint32
+	Mode      uint32
+	Uid       uint32
+	Gid       uint32
+	Nlink     uint32
+	Mtime     uint32
+	Filesize  uint32
+	Devmajor  uint32
+	Devminor  uint32
+	Rdevmajor uint32
+	Rdevminor uint32
+	Name      string
+}
+
+func (hdr *header) fields() []*uint32 {
+	return []*uint32{
+		&hdr.Ino, &hdr.Mode, &hdr.Uid, &hdr.Gid, &hdr.Nlink, &hdr.Mtime, &hdr.Filesize,
+		&hdr.Devmajor, &hdr.Devminor, &hdr.Rdevmajor, &hdr.Rdevminor,
+	}
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+/*
+	Writes a newc archive.  Call WriteHeader, then Write the body (exactly
+	Filesize bytes of it), and so on; Close writes the trailer.
+	Close doesn't close the underlying writer.
+*/
+type writer struct {
+	w       io.Writer
+	offset  int64 // Bytes written so far; padding is by it.
+	remains int64 // Body bytes yet to be written for the current entry.
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: w}
+}
+
+func (cw *writer) WriteHeader(hdr *header) error {
+	if cw.remains != 0 {
+		return fmt.Errorf("cpio: %d bytes of the last body missing", cw.remains)
+	}
+	if err := cw.pad(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(magicNewc)
+	for _, f := range hdr.fields() {
+		fmt.Fprintf(&buf, "%08X", *f)
+	}
+	fmt.Fprintf(&buf, "%08X%08X", len(hdr.Name)+1, 0)
+	buf.WriteString(hdr.Name)
+	buf.WriteByte(0)
+	if _, err := cw.write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := cw.pad(); err != nil {
+		return err
+	}
+	cw.remains = int64(hdr.Filesize)
+	return nil
+}
+
+func (cw *writer) Write(bs []byte) (int, error) {
+	if int64(len(bs)) > cw.remains {
+		return 0, fmt.Errorf("cpio: body longer than the header said")
+	}
+	n, err := cw.write(bs)
+	cw.remains -= int64(n)
+	return n, err
+}
+
+func (cw *writer) Close() error {
+	if err := cw.WriteHeader(&header{Nlink: 1, Name: trailerName}); err != nil {
+		return err
+	}
+	return cw.pad()
+}
+
+func (cw *writer) write(bs []byte) (int, error) {
+	n, err := cw.w.Write(bs)
+	cw.offset += int64(n)
+	return n, err
+}
+
+func (cw *writer) pad() error {
+	_, err := cw.write(make([]byte, pad4(cw.offset)))
+	return err
+}
+
+/*
+	Reads a newc archive.  Next returns each header in turn, and io.EOF
+	at the trailer; Read reads the body of the entry Next last returned.
+	Errors are ErrWareCorrupt (or whatever the underlying reader said).
+*/
+type reader struct {
+	r       io.Reader
+	offset  int64
+	remains int64
+	short   error // set if an entry's body ran out early; see Read.
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: r}
+}
+
+func (cr *reader) Next() (*header, error) {
+	// Skip whatever's left of the last body, and the padding after.
+	if err := cr.skip(cr.remains + pad4(cr.offset+cr.remains)); err != nil {
+		return nil, err
+	}
+	cr.remains = 0
+	buf := make([]byte, headerLen)
+	if err := cr.readFull(buf); err != nil {
+		return nil, err
+	}
+	magic := string(buf[0:6])
+	if magic != magicNewc && magic != magicNewcrc {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt cpio: not a newc header (magic %q)", magic)
+	}
+	hdr := &header{}
+	var nums [13]uint32
+	for i := range nums {
+		field := string(buf[6+i*8 : 6+(i+1)*8])
+		n, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "corrupt cpio: header field %q is not hex", field)
+		}
+		nums[i] = uint32(n)
+	}
+	for i, f := range hdr.fields() {
+		*f = nums[i]
+	}
+	namesize := int64(nums[11])
+	if namesize < 1 || namesize > maxPathLen+1 {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt cpio: name size %d makes no sense", namesize)
+	}
+	name := make([]byte, namesize)
+	if err := cr.readFull(name); err != nil {
+		return nil, err
+	}
+	if name[namesize-1] != 0 {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt cpio: name is not NUL-terminated")
+	}
+	hdr.Name = string(name[:namesize-1])
+	if err := cr.skip(pad4(cr.offset)); err != nil {
+		return nil, err
+	}
+	if hdr.Name == trailerName {
+		return nil, io.EOF
+	}
+	cr.remains = int64(hdr.Filesize)
+	return hdr, nil
+}
+
+func (cr *reader) Read(bs []byte) (int, error) {
+	if cr.remains == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(bs)) > cr.remains {
+		bs = bs[:cr.remains]
+	}
+	n, err := cr.r.Read(bs)
+	cr.offset += int64(n)
+	cr.remains -= int64(n)
+	if err == io.EOF && cr.remains > 0 {
+		// Kept, since whoever we return this to may well bury it in their own.
+		cr.short = Errorf(rio.ErrWareCorrupt, "corrupt cpio: unexpected EOF")
+		return n, cr.short
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (cr *reader) readFull(bs []byte) error {
+	n, err := io.ReadFull(cr.r, bs)
+	cr.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: unexpected EOF")
+	}
+	return err
+}
+
+func (cr *reader) skip(n int64) error {
+	m, err := io.CopyN(ioutil.Discard, cr.r, n)
+	cr.offset += m
+	if err == io.EOF {
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: unexpected EOF")
+	}
+	return err
+}
+
+// Mutate the header fields to match the given fmeta.
+// Leaves Ino and Nlink alone; the caller picks those.
+// Returns ErrPackInvalid for things newc can't hold (see the package docs).
+// Xattrs aren't in the header at all; see xattrEntry.
+func metadataToCpioHdr(fmeta *fs.Metadata, hdr *header) error {
+	hdr.Name = strings.TrimPrefix(fmeta.Name.String(), "./")
+	mode, err := fsTypeToMode(fmeta.Type)
+	if err != nil {
+		return err
+	}
+	hdr.Mode = mode | uint32(fmeta.Perms&07777)
+	hdr.Uid = fmeta.Uid
+	hdr.Gid = fmeta.Gid
+	mtime := fmeta.Mtime.Unix()
+	if mtime < 0 || mtime > math.MaxUint32 {
+		return Errorf(rio.ErrPackInvalid, "can't pack %q into cpio: mtime %s is outside what newc can hold", fmeta.Name, fmeta.Mtime)
+	}
+	hdr.Mtime = uint32(mtime)
+	hdr.Filesize = 0
+	switch fmeta.Type {
+	case fs.Type_File:
+		if fmeta.Size > math.MaxUint32 {
+			return Errorf(rio.ErrPackInvalid, "can't pack %q into cpio: newc can't hold files of 4GiB or more", fmeta.Name)
+		}
+		hdr.Filesize = uint32(fmeta.Size)
+	case fs.Type_Symlink:
+		hdr.Filesize = uint32(len(fmeta.Linkname))
+	case fs.Type_Device, fs.Type_CharDevice:
+		if fmeta.Devmajor < 0 || fmeta.Devmajor > math.MaxUint32 || fmeta.Devminor < 0 || fmeta.Devminor > math.MaxUint32 {
+			return Errorf(rio.ErrPackInvalid, "can't pack %q into cpio: device numbers %d,%d are too big for newc", fmeta.Name, fmeta.Devmajor, fmeta.Devminor)
+		}
+		hdr.Rdevmajor = uint32(fmeta.Devmajor)
+		hdr.Rdevminor = uint32(fmeta.Devminor)
+	}
+	return nil
+}
+
+func fsTypeToMode(fsType fs.Type) (uint32, error) {
+	switch fsType {
+	case fs.Type_File:
+		return modeFile, nil
+	case fs.Type_Dir:
+		return modeDir, nil
+	case fs.Type_Symlink:
+		return modeSymlink, nil
+	case fs.Type_NamedPipe:
+		return modeNamedPipe, nil
+	case fs.Type_CharDevice:
+		return modeChar, nil
+	case fs.Type_Device:
+		return modeBlock, nil
+	case fs.Type_Socket:
+		return 0, Errorf(rio.ErrPackInvalid, "can't pack sockets into cpio")
+	default:
+		return 0, Errorf(rio.ErrPackInvalid, "can't pack a %s into cpio", fsType)
+	}
+}
+
+// Mutate fs.Metadata fields to match the given cpio header.
+// Absolute names are rejected as corrupt.  Does not check for names that go
+// above '.'; caller may want to do that (see fs.RelPath.GoesUp).
+// The link target of a symlink is the entry's body: the caller fills that in.
+func cpioHdrToMetadata(hdr *header, fmeta *fs.Metadata) error {
+	if hdr.Name == "" {
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: an entry has no name")
+	}
+	path, err := fs.ParseRelPath(hdr.Name)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: %q is not a relative path", hdr.Name)
+	}
+	fmeta.Name = path
+	switch hdr.Mode & modeTypeMask {
+	case modeFile:
+		fmeta.Type = fs.Type_File
+		fmeta.Size = int64(hdr.Filesize)
+	case modeDir:
+		fmeta.Type = fs.Type_Dir
+	case modeSymlink:
+		fmeta.Type = fs.Type_Symlink
+	case modeNamedPipe:
+		fmeta.Type = fs.Type_NamedPipe
+	case modeChar:
+		fmeta.Type = fs.Type_CharDevice
+	case modeBlock:
+		fmeta.Type = fs.Type_Device
+	default:
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: %q is not a kind of file we can unpack", hdr.Name)
+	}
+	fmeta.Perms = fs.Perms(hdr.Mode & 07777)
+	fmeta.Uid = hdr.Uid
+	fmeta.Gid = hdr.Gid
+	fmeta.Mtime = time.Unix(int64(hdr.Mtime), 0).UTC()
+	if fmeta.Type == fs.Type_Device || fmeta.Type == fs.Type_CharDevice {
+		fmeta.Devmajor = int64(hdr.Rdevmajor)
+		fmeta.Devminor = int64(hdr.Rdevminor)
+	}
+	return nil
+}
+
+/*
+	Serialize xattrs as the body of an xattr entry: for each, in order of
+	key, the key, a NUL, the length of the value as 8 hex digits (like
+	every other number in newc), and the value.
+*/
+func xattrEntry(xattrs map[string]string) []byte {
+	keys := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte(0)
+		fmt.Fprintf(&buf, "%08X", len(xattrs[k]))
+		buf.WriteString(xattrs[k])
+	}
+	return buf.Bytes()
+}
+
+func parseXattrEntry(name string, body []byte) (map[string]string, error) {
+	corrupt := func(what string) error {
+		return Errorf(rio.ErrWareCorrupt, "corrupt cpio: %s in the xattrs of %q", what, name)
+	}
+	xattrs := map[string]string{}
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, 0)
+		if i < 1 || len(body) < i+1+8 {
+			return nil, corrupt("truncated xattr")
+		}
+		k := string(body[:i])
+		n, err := strconv.ParseUint(string(body[i+1:i+1+8]), 16, 32)
+		if err != nil {
+			return nil, corrupt("bad length")
+		}
+		body = body[i+1+8:]
+		if uint64(len(body)) < n {
+			return nil, corrupt("truncated xattr")
+		}
+		xattrs[k] = string(body[:n])
+		body = body[n:]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,254 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cpiotrans
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	return pack(ctx, packType, pathStr, filt, warehouseAddr, mon, PackOptions{Compression: tartrans.Gzip})
+}
+
+/*
+	Options for how PackWith writes the cpio.
+	None of them change the WareID.
+*/
+type PackOptions struct {
+	Compression tartrans.Compression // How to compress the cpio.  Pack uses Gzip.  (The zero value is Uncompressed!)
+	Level       int                  // Compression level; 0 for the codec's default.  See tartrans.Compress.
+}
+
+/*
+	Returns a PackFunc which behaves exactly like Pack, but writes the
+	cpio as the options say.
+*/
+func PackWith(opts PackOptions) rio.PackFunc {
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		pathStr string,
+		filt api.FilesetFilters,
+		warehouseAddr api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		return pack(ctx, packType, pathStr, filt, warehouseAddr, mon, opts)
+	}
+}
+
+func pack(
+	ctx context.Context,
+	packType api.PackType,
+	pathStr string,
+	filt api.FilesetFilters,
+	warehouseAddr api.WarehouseAddr,
+	mon rio.Monitor,
+	opts PackOptions,
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	// Check the codec now, rather than after opening the warehouse.
+	if _, err := tartrans.Compress(ioutil.Discard, opts.Compression, opts.Level); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Short-circuit exit if the path does not exist.
+	afs := osfs.New(path)
+	_, err = afs.Stat(fs.RelPath{})
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return api.WareID{PackType, ""}, nil
+	default:
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+
+	// Connect to warehouse, and get write controller opened.
+	//  The warehouses don't care what's in a ware; the tar transmat's dialing serves for us too.
+	wc, err := tartrans.OpenWriteController(warehouseAddr, packType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Wrap writer with compression.
+	compressor, err := tartrans.Compress(wc, opts.Compression, opts.Level)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+
+	// Scan and cpio!
+	cpioWriter := newWriter(compressor)
+	wareID, err := packCpio(ctx, afs, filt2, cpioWriter, mon)
+	if err != nil {
+		return wareID, err
+	}
+	// Close the cpio writer (which writes the trailer), then the compressor.
+	if err := cpioWriter.Close(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+
+	// If we made it all the way with no errors, commit.
+	//  (Otherwise, the write controller will be closed by default by our defers.)
+	return wareID, wc.Commit(wareID)
+}
+
+func packCpio(
+	ctx context.Context,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	cw *writer,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	bucket := &fshash.MemoryBucket{}
+	hasher := wareid.Default(PackType)
+
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	scanFile := fsOp.ScanFile
+	if host.Xattrs.KeepsAny() {
+		scanFile = fsOp.ScanFileWithXattrs
+	}
+
+	// Report bytes hashed as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	// Every entry gets an inode number of its own, so no reader mistakes two for hardlinks.
+	var ino uint32
+
+	// Walk the filesystem in order, emitting cpio entries and filling the bucket as we go.
+	err = fsOp.Walk(afs, fs.RelPath{}, func(path fs.RelPath, _ *fs.Metadata) error {
+		// Consider cancellation.
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Open file.
+		fmeta, file, err := scanFile(afs, path)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+
+		// Apply filters.
+		host.Apply(fmeta)
+		filters.Apply(filt, fmeta)
+
+		// Flatten time to seconds.  Newc doesn't do subsecond precision;
+		//  we need to do it here so that the hash and the serial form are describing the same thing.
+		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+
+		// Flip our metadata to cpio header format.
+		ino++
+		hdr := &header{Ino: ino, Nlink: 1}
+		if err := metadataToCpioHdr(fmeta, hdr); err != nil {
+			return err
+		}
+
+		// Xattrs first, if there are any, in an entry of their own.
+		if len(fmeta.Xattrs) > 0 {
+			body := xattrEntry(fmeta.Xattrs)
+			if err := cw.WriteHeader(&header{Ino: ino, Mode: modeXattrEntry, Name: hdr.Name, Filesize: uint32(len(body))}); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			if _, err := cw.Write(body); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+		}
+
+		// Flush the header.
+		if err := cw.WriteHeader(hdr); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+
+		// If it's a file, stream the body into the cpio, hashing it;
+		//  for all, record the metadata in the bucket for the total hash.
+		switch fmeta.Type {
+		case fs.Type_File:
+			contentHasher := hasher.New()
+			n, err := io.Copy(io.MultiWriter(cw, contentHasher), file)
+			if err != nil {
+				if ctx.Err() != nil {
+					return Errorf(rio.ErrCancelled, "cancelled")
+				}
+				return Errorf(rio.ErrPackInvalid, "error while packing %q: %s", path, err)
+			}
+			if n != fmeta.Size {
+				return Errorf(rio.ErrPackInvalid, "error while packing %q: file changed size while we read it", path)
+			}
+			bucket.AddRecord(*fmeta, contentHasher.Sum(nil))
+			prog.Add(n, fmeta.Name)
+		case fs.Type_Symlink:
+			if _, err := io.WriteString(cw, fmeta.Linkname); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			bucket.AddRecord(*fmeta, nil)
+		default:
+			bucket.AddRecord(*fmeta, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Hash the thing!
+	wareID := hasher.WareID(bucket)
+	prog.Done()
+	return wareID, nil
+}
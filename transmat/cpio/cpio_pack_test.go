@@ -0,0 +1,73 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cpiotrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestCpioPack(t *testing.T) {
+	Convey("Spec compliance: Cpio pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, Pack)
+			tests.CheckPackHashVariesOnVariations(PackType, Pack)
+			tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+		}),
+	)
+}
+
+func TestCpioPackHashesLikeTar(t *testing.T) {
+	Convey("Cpio transmat: the hash of a fileset should be the same as tar's", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			for _, fixture := range tests.AllFixtures {
+				Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+					testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+						tests.PlaceFixture(osfs.New(tmpDir), fixture.Files)
+						cpioWareID, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						tarWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(cpioWareID.Type, ShouldEqual, PackType)
+						So(cpioWareID.Hash, ShouldEqual, tarWareID.Hash)
+					})
+				})
+			}
+		}),
+	)
+}
+
+func TestCpioPackRefusals(t *testing.T) {
+	Convey("Cpio transmat: packing what newc can't hold", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			So(afs.Mkdir(fs.MustRelPath("./d"), 0755), ShouldBeNil)
+			Convey("an mtime before 1970 should be refused", func() {
+				So(afs.SetTimesNano(fs.MustRelPath("./d"), time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), fs.DefaultAtime), ShouldBeNil)
+				_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+			})
+			Convey("but the same with mtimes flattened should be fine", func() {
+				So(afs.SetTimesNano(fs.MustRelPath("./d"), time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), fs.DefaultAtime), ShouldBeNil)
+				_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_DefaultFlatten, "", rio.Monitor{})
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,399 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cpiotrans
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackCpio(ctx, hasher, osfs.New(path2), filt2, reader, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+/*
+	Extract a cpio stream onto `afs`, just as Unpack does once it has a
+	reader, and return the WareIDs (prefilter, and filtered) of what was
+	extracted, as of the given packType.
+
+	This is for transmats whose wares have a cpio inside them (an rpm's
+	payload, say).  Nothing is verified against any expected WareID;
+	that's the caller's job.  Filters must already be processed, as for
+	unpacking.
+*/
+func ExtractCpio(
+	ctx context.Context,
+	packType api.PackType,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (prefilterWareID api.WareID, actualWareID api.WareID, err error) {
+	return unpackCpio(ctx, wareid.Default(packType), afs, filt, reader, mon)
+}
+
+func unpackCpio(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Wrap input stream with decompression as necessary.
+	reader2, err := tartrans.Decompress(reader)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio compression: %s", err)
+	}
+	cr := newReader(reader2)
+
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
+	// we keep a second, separate one for the filtered data, which will compute a different hash.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+
+	// Also keep a record of every name we've placed.  Dirs, so parents can be
+	//  inferred as in tar; and everything, because the cpio format doesn't stop
+	//  a name from appearing twice, and we must.
+	dirs := map[fs.RelPath]struct{}{}
+	seen := map[fs.RelPath]struct{}{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Files with more than one link share an inode number, and only one of
+	//  them carries the body: GNU cpio writes it on the last, the kernel's
+	//  gen_init_cpio on the first.  Those seen before the body wait for it;
+	//  those seen after are hardlinked to the first that had it.
+	type linkKey struct{ devmajor, devminor, ino uint32 }
+	type linkTarget struct {
+		prefilter, filtered fs.Metadata
+		contentHash         []byte
+	}
+	type linkPending struct{ prefilter, filtered fs.Metadata }
+	linked := map[linkKey]linkTarget{}
+	pending := map[linkKey][]linkPending{}
+	var pendingOrder []linkKey
+
+	// Report bytes written as we go.  (A cpio stream doesn't say how long it is.)
+	prog := progress.New(mon, "unpack", 0)
+
+	place := func(fmeta fs.Metadata, body io.Reader) error {
+		if err := fsOp.PlaceFileWithPolicy(afs, fmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		return nil
+	}
+	placeLinked := func(target linkTarget, links []linkPending) error {
+		linkname := target.filtered.Name.String()
+		for _, link := range links {
+			hardlink := link.filtered
+			hardlink.Type, hardlink.Linkname = fs.Type_Hardlink, linkname
+			if err := place(hardlink, nil); err != nil {
+				return err
+			}
+			target.prefilter.Name, target.filtered.Name = link.prefilter.Name, link.filtered.Name
+			prefilterBucket.AddRecord(target.prefilter, target.contentHash)
+			filteredBucket.AddRecord(target.filtered, target.contentHash)
+		}
+		return nil
+	}
+	placeFile := func(fmeta, filteredFmeta fs.Metadata, body io.Reader) (linkTarget, error) {
+		hashing := &util.HashingReader{body, hasher.New()}
+		if err := place(filteredFmeta, hashing); err != nil {
+			if cr.short != nil {
+				return linkTarget{}, cr.short // the ware's fault, not the path's.
+			}
+			return linkTarget{}, err
+		}
+		contentHash := hashing.Hasher.Sum(nil)
+		prefilterBucket.AddRecord(fmeta, contentHash)
+		filteredBucket.AddRecord(filteredFmeta, contentHash)
+		prog.Add(fmeta.Size, fmeta.Name)
+		return linkTarget{fmeta, filteredFmeta, contentHash}, nil
+	}
+
+	// Iterate over each cpio entry, mutating filesystem as we go.
+	var entryXattrs map[string]string
+	var xattrsFor string
+	for {
+		hdr, err := cr.Next()
+
+		// Check for done.
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if ctx.Err() != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if _, ok := err.(Error); ok {
+			return api.WareID{}, api.WareID{}, err
+		}
+		if err != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: %s", err)
+		}
+
+		// Xattr entries hold on to what they say until the entry they're for.
+		if hdr.Mode&modeTypeMask == modeXattrEntry {
+			body, err := ioutil.ReadAll(cr)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: %s", err)
+			}
+			entryXattrs, err = parseXattrEntry(hdr.Name, body)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			xattrsFor = hdr.Name
+			continue
+		}
+
+		// Reshuffle metainfo to our default format.
+		fmeta := fs.Metadata{}
+		if err := cpioHdrToMetadata(hdr, &fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+		if entryXattrs != nil {
+			if xattrsFor != hdr.Name {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: xattrs for %q are followed by %q", xattrsFor, hdr.Name)
+			}
+			fmeta.Xattrs, entryXattrs = entryXattrs, nil
+		}
+		if fmeta.Name.GoesUp() {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: paths that use '../' to leave the base dir are invalid")
+		}
+		if _, dup := seen[fmeta.Name]; dup {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: %q appears more than once", fmeta.Name)
+		}
+		seen[fmeta.Name] = struct{}{}
+
+		// Infer parents, if necessary.  Plenty of cpio tools leave dirs out.
+		for _, parent := range fmeta.Name.SplitParent() {
+			if _, exists := dirs[parent]; exists {
+				continue
+			}
+			log.DirectoryInferred(mon, parent, fmeta.Name)
+			conjuredFmeta := fshash.DefaultDirMetadata()
+			conjuredFmeta.Name = parent
+			prefilterBucket.AddRecord(conjuredFmeta, nil)
+			policy.Apply(&conjuredFmeta)
+			filters.Apply(filt, &conjuredFmeta)
+			filteredBucket.AddRecord(conjuredFmeta, nil)
+			dirs[conjuredFmeta.Name] = struct{}{}
+			seen[conjuredFmeta.Name] = struct{}{}
+			if err := place(conjuredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+		}
+
+		// Symlinks keep their target in the body.
+		if fmeta.Type == fs.Type_Symlink {
+			if hdr.Filesize == 0 || hdr.Filesize > maxPathLen {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: symlink %q has no sensible target", fmeta.Name)
+			}
+			target, err := ioutil.ReadAll(cr)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: %s", err)
+			}
+			fmeta.Linkname = string(target)
+		}
+
+		// Apply filters.
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt, &filteredFmeta)
+
+		// Place the file.
+		switch {
+		case fmeta.Type == fs.Type_File && hdr.Nlink > 1:
+			key := linkKey{hdr.Devmajor, hdr.Devminor, hdr.Ino}
+			if target, ok := linked[key]; ok && hdr.Filesize == 0 {
+				if err := placeLinked(target, []linkPending{{fmeta, filteredFmeta}}); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				continue
+			}
+			if hdr.Filesize == 0 {
+				if _, ok := pending[key]; !ok {
+					pendingOrder = append(pendingOrder, key)
+				}
+				pending[key] = append(pending[key], linkPending{fmeta, filteredFmeta})
+				continue
+			}
+			target, err := placeFile(fmeta, filteredFmeta, cr)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			linked[key] = target
+			if err := placeLinked(target, pending[key]); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			delete(pending, key)
+		case fmeta.Type == fs.Type_File:
+			if _, err := placeFile(fmeta, filteredFmeta, cr); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+		case fmeta.Type == fs.Type_Dir:
+			dirs[fmeta.Name] = struct{}{}
+			fallthrough
+		default:
+			if err := place(filteredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			prefilterBucket.AddRecord(fmeta, nil)
+			filteredBucket.AddRecord(filteredFmeta, nil)
+		}
+	}
+	if entryXattrs != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt cpio: xattrs for %q, but no %q", xattrsFor, xattrsFor)
+	}
+
+	// Links still waiting for a body never had one: they're empty files.
+	for _, key := range pendingOrder {
+		links, ok := pending[key]
+		if !ok {
+			continue
+		}
+		target, err := placeFile(links[0].prefilter, links[0].filtered, &io.LimitedReader{})
+		if err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+		if err := placeLinked(target, links[1:]); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+	}
+
+	// An empty cpio still has a root; if nothing said what it is, conjure it.
+	if _, exists := dirs[fs.RelPath{}]; !exists {
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		prefilterBucket.AddRecord(conjuredFmeta, nil)
+		policy.Apply(&conjuredFmeta)
+		filters.Apply(filt, &conjuredFmeta)
+		filteredBucket.AddRecord(conjuredFmeta, nil)
+		if err := place(conjuredFmeta, nil); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
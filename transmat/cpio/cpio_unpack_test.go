@@ -0,0 +1,125 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cpiotrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestCpioUnpack(t *testing.T) {
+	Convey("Spec compliance: Cpio unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+			Convey("Using kvfs warehouse, in *non*-content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
+
+func TestCpioUnpackForeign(t *testing.T) {
+	Convey("Cpio transmat: unpacking cpios made by other tools", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.cpio", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				type entry struct {
+					hdr  header
+					body string
+				}
+				writeCpio := func(entries ...entry) {
+					var buf bytes.Buffer
+					cw := newWriter(&buf)
+					for _, e := range entries {
+						e.hdr.Filesize = uint32(len(e.body))
+						So(cw.WriteHeader(&e.hdr), ShouldBeNil)
+						_, err := cw.Write([]byte(e.body))
+						So(err, ShouldBeNil)
+					}
+					So(cw.Close(), ShouldBeNil)
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.cpio", buf.Bytes(), 0644), ShouldBeNil)
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				Convey("names sharing an inode should come out hardlinked, wherever the body was", func() {
+					writeCpio(
+						entry{header{Ino: 7, Mode: modeFile | 0644, Nlink: 2, Name: "a"}, ""},
+						entry{header{Ino: 7, Mode: modeFile | 0644, Nlink: 2, Name: "b"}, "body"},
+						entry{header{Ino: 9, Mode: modeFile | 0644, Nlink: 2, Name: "c"}, "other"},
+						entry{header{Ino: 9, Mode: modeFile | 0644, Nlink: 2, Name: "d"}, ""},
+					)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					for name, body := range map[string]string{"a": "body", "b": "body", "c": "other", "d": "other"} {
+						bs, err := ioutil.ReadFile(tmpDir.String() + "/out/" + name)
+						So(err, ShouldBeNil)
+						So(string(bs), ShouldEqual, body)
+					}
+					stA, err := os.Stat(tmpDir.String() + "/out/a")
+					So(err, ShouldBeNil)
+					stB, err := os.Stat(tmpDir.String() + "/out/b")
+					So(err, ShouldBeNil)
+					So(os.SameFile(stA, stB), ShouldBeTrue)
+				})
+				Convey("a name that leaves the base dir should be corruption", func() {
+					writeCpio(entry{header{Mode: modeFile | 0644, Nlink: 1, Name: "../escape"}, "body"})
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a name that appears twice should be corruption", func() {
+					writeCpio(
+						entry{header{Mode: modeFile | 0644, Nlink: 1, Name: "a"}, "body"},
+						entry{header{Mode: modeFile | 0644, Nlink: 1, Name: "a"}, "body"},
+					)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a truncated archive should be corruption", func() {
+					writeCpio(entry{header{Mode: modeFile | 0644, Nlink: 1, Name: "a"}, "body"})
+					bs, err := ioutil.ReadFile(tmpDir.String() + "/ware.cpio")
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.cpio", bs[:headerLen+4], 0644), ShouldBeNil)
+					_, err = unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+			})
+		}),
+	)
+}
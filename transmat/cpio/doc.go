@@ -0,0 +1,40 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The cpio transmat packs filesystems into the "newc" cpio format (the
+	one the linux kernel reads an initramfs from), and can use any
+	k/v-styled warehouse for storage (just like the tar transmat).
+
+	The WareID is computed over the fileset, exactly as the tar transmat
+	computes it: so a fileset packed as cpio has the same hash as when it's
+	packed as tar (only the packtype differs), and unpacking checks it the
+	same way.  Newc keeps mtimes to the second, as we do.
+
+	Pack compresses with gzip, which any kernel that takes an initramfs can
+	read; PackWith can pick another codec, or none.  Unpack reads whatever
+	the tar transmat's Decompress does.
+
+	Newc has fixed 32-bit fields, so some filesets can't be packed: files
+	of 4GiB or more, mtimes before 1970 or after 2106, device numbers that
+	don't fit.  Those are ErrPackInvalid, as are sockets.
+	Newc has no place for xattrs either, so they ride in an entry of our
+	own, just ahead of the file they belong to: the same name, no type bits
+	in its mode, and the xattrs as its body.  The kernel skips such entries.
+	Hardlinks aren't kept on pack: each name is packed as a file of its own.
+	(That doesn't change the WareID, which sees each name as the file it is.)
+	On unpack, names sharing an inode number are placed as hardlinks, with
+	the body wherever in the group it was written.
+
+	Only the first archive in the stream is unpacked; the kernel reads on
+	after the trailer (for early microcode, say), but we don't.
+*/
+package cpiotrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("cpio")
@@ -0,0 +1,84 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package debtrans
+
+import (
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+const (
+	arMagic     = "!<arch>\n"
+	arHeaderLen = 60
+)
+
+/*
+	Read through a deb's ar archive, up to the start of its data.tar;
+	return a reader for just that member.  Checks the deb is one we know
+	(the debian-binary member comes first and says "2.x").
+	Errors are ErrWareCorrupt (or whatever the underlying reader said).
+*/
+func findDataTar(r io.Reader) (io.Reader, error) {
+	corrupt := func(format string, args ...interface{}) error {
+		return Errorf(rio.ErrWareCorrupt, "corrupt deb: "+format, args...)
+	}
+	buf := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, corrupt("not an ar archive")
+	}
+	if string(buf) != arMagic {
+		return nil, corrupt("not an ar archive")
+	}
+	for i := 0; ; i++ {
+		hdr := make([]byte, arHeaderLen)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil, corrupt("no data.tar member")
+			}
+			return nil, corrupt("truncated member header")
+		}
+		if string(hdr[58:60]) != "`\n" {
+			return nil, corrupt("bad member header")
+		}
+		// GNU ar ends names with a slash; BSD ar doesn't.  Either pads with spaces.
+		name := strings.TrimSuffix(strings.TrimRight(string(hdr[0:16]), " "), "/")
+		size, err := strconv.ParseInt(strings.TrimRight(string(hdr[48:58]), " "), 10, 64)
+		if err != nil || size < 0 {
+			return nil, corrupt("bad size for member %q", name)
+		}
+		body := io.LimitReader(r, size)
+		switch {
+		case i == 0:
+			if name != "debian-binary" {
+				return nil, corrupt("first member is %q, not debian-binary", name)
+			}
+			version, err := ioutil.ReadAll(body)
+			if err != nil || int64(len(version)) != size {
+				return nil, corrupt("truncated debian-binary")
+			}
+			if !strings.HasPrefix(string(version), "2.") {
+				return nil, corrupt("format version %q is not one we know", strings.TrimSpace(string(version)))
+			}
+		case strings.HasPrefix(name, "data.tar"):
+			return body, nil
+		default:
+			if n, err := io.Copy(ioutil.Discard, body); err != nil || n != size {
+				return nil, corrupt("truncated member %q", name)
+			}
+		}
+		// Members are padded to an even length.
+		if size%2 == 1 {
+			if _, err := io.ReadFull(r, buf[:1]); err != nil {
+				return nil, corrupt("truncated member %q", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package debtrans
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+	_ rio.ScanFunc   = Scan
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Find the data.tar, and extract it.
+	dataTar, err := findDataTar(reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	prefilterWareID, unpackWareID, err := tartrans.ExtractTar(ctx, PackType, osfs.New(path2), filt2, dataTar, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	if prefilterWareID != wareID {
+		return unpackWareID, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q (filtered %q)", wareID, prefilterWareID, unpackWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   prefilterWareID.String(),
+				"filtered": unpackWareID.String(),
+			},
+		)
+	}
+	return unpackWareID, nil
+}
+
+/*
+	Read a deb from a single warehouse (a monowarehouse, not a CA one),
+	and report its WareID, without placing anything.
+	This is how to find out the WareID of a deb to unpack it by.
+*/
+func Scan(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Ignored: nothing is placed, nor cached.
+	addr api.WarehouseAddr, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	filt = apiutil.MergeFilters(filt, api.Filter_NoMutation)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Dial warehouse.
+	reader, err := tartrans.PickReader(ctx, api.WareID{PackType, "-"}, []api.WarehouseAddr{addr}, true, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Find the data.tar, and extract it to nowhere.
+	dataTar, err := findDataTar(reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	_, unpackedWareID, err := tartrans.ExtractTar(ctx, PackType, nilFS.New(), filt2, dataTar, mon)
+	return unpackedWareID, err
+}
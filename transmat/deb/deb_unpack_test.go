@@ -0,0 +1,97 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package debtrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestDebUnpack(t *testing.T) {
+	Convey("Deb transmat: unpacking debs", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.deb", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				writeDeb := func(members ...string) {
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.deb", testutil.MakeAr(testutil.ArchiveFiles(members...)...), 0644), ShouldBeNil)
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+				dataTar := string(testutil.MakeTar(testutil.FixturePackaged...))
+
+				Convey("a deb should scan, then unpack by the scanned WareID", func() {
+					writeDeb("debian-binary", "2.0\n", "control.tar.gz", "not looked at", "data.tar", dataTar)
+					wareID, err := Scan(context.Background(), PackType, api.Filter_NoMutation, "", addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID.Type, ShouldEqual, PackType)
+					wareID2, err := unpack(wareID)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/usr/bin/hello")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "#!/bin/sh\n")
+					target, err := os.Readlink(tmpDir.String() + "/out/usr/bin/hi")
+					So(err, ShouldBeNil)
+					So(target, ShouldEqual, "hello")
+
+					Convey("and its hash should be the data.tar's, as a tar", func() {
+						So(ioutil.WriteFile(tmpDir.String()+"/data.tar", []byte(dataTar), 0644), ShouldBeNil)
+						tarWareID, err := tartrans.Scan(context.Background(), tartrans.PackType, api.Filter_NoMutation, rio.Placement_Direct, api.WarehouseAddr(fmt.Sprintf("file://%s/data.tar", tmpDir)), rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(tarWareID.Hash, ShouldEqual, wareID.Hash)
+					})
+				})
+				Convey("the wrong WareID should be a hash mismatch", func() {
+					writeDeb("debian-binary", "2.0\n", "control.tar.gz", "", "data.tar", dataTar)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("a deb with no data.tar should be corruption", func() {
+					writeDeb("debian-binary", "2.0\n", "control.tar.gz", "")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a deb of a format version we don't know should be corruption", func() {
+					writeDeb("debian-binary", "3.0\n", "data.tar", dataTar)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a file that's not an ar archive at all should be corruption", func() {
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.deb", []byte(dataTar), 0644), ShouldBeNil)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("packing should be refused", func() {
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,26 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The deb transmat unpacks Debian packages (".deb" files, as apt fetches
+	them) onto filesystems, so a distro package can be a rio input as is.
+	It can use any k/v-styled warehouse (just like the tar transmat).
+
+	Only the package's files are unpacked: that's the data.tar member of the
+	deb's ar archive, in whatever compression the tar transmat reads.
+	The control files and maintainer scripts aren't placed, and nothing is
+	run.  The WareID is computed over the unpacked fileset, exactly as the
+	tar transmat computes it: so a deb's WareID is the same hash as its
+	data.tar's as a tar ware (only the packtype differs).  Scan reports it.
+
+	Pack is unsupported: rio reads debs, but doesn't make them.
+*/
+package debtrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("deb")
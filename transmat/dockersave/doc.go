@@ -0,0 +1,40 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The docker-save transmat unpacks images as `docker save` exports them
+	(a tar of a manifest.json and the image's layer tars) onto filesystems,
+	so an image from a local Docker daemon can be a rio input as is.
+	It can use any k/v-styled warehouse (just like the tar transmat).
+
+	The image's layers are applied in the order the manifest lists them,
+	flattened into one fileset: each entry replaces whatever an earlier
+	layer had at its name (except that a dir over a dir keeps what's in it),
+	whiteouts (".wh." in front of a name) delete that name, and opaque dirs
+	(a ".wh..wh..opq" entry in them) have everything earlier layers put in
+	them deleted.  None of that leaves a trace: what's unpacked is just the
+	image's filesystem, as a container would see it.  The image config, and
+	the tags, aren't placed.
+
+	The WareID is computed over that flattened fileset, exactly as the tar
+	transmat computes it: so an image's WareID is the same hash as a tar of
+	its filesystem would have (only the packtype differs).  Scan reports it.
+	A save of more than one image is refused: there's no one fileset to
+	flatten it to.
+
+	Pack is unsupported: rio reads docker saves, but doesn't make them.
+*/
+package dockersavetrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("docker-save")
+
+const (
+	// The entry that makes the dir it's in opaque.
+	opaqueMarker = ".wh..wh..opq"
+)
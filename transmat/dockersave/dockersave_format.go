@@ -0,0 +1,118 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package dockersavetrans
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+const manifestName = "manifest.json"
+
+// An entry of manifest.json: one per image in the save.
+type manifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// A layer tar, as a span of the save.
+type layerSpan struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// A name as the save's manifest uses it: no "./", and no trailing slash.
+func saveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+/*
+	Read through a docker save, noting where each member is; parse its
+	manifest.json; and return where each of the image's layers is, in the
+	order they're to be applied.
+
+	The save is read from a file, rather than a stream, because the
+	manifest can come anywhere (`docker save` puts it last).
+	Newer saves are laid out as OCI image layouts too, and their layer
+	paths may be symlinks to blobs; those are followed.
+	Errors are ErrWareCorrupt (or ErrLocalCacheProblem, for the file).
+*/
+func findLayers(save *os.File) ([]layerSpan, error) {
+	corrupt := func(format string, args ...interface{}) error {
+		return Errorf(rio.ErrWareCorrupt, "corrupt docker save: "+format, args...)
+	}
+	members := map[string]layerSpan{}
+	links := map[string]string{}
+	var manifest []manifestEntry
+	tr := tar.NewReader(save)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, corrupt("%s", err)
+		}
+		name := saveName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// The tar reader reads up to the body and no further: so this is where the body starts.
+			offset, err := save.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read spool file: %s", err)
+			}
+			members[name] = layerSpan{name, offset, hdr.Size}
+			if name == manifestName {
+				if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+					return nil, corrupt("unparsable %s: %s", manifestName, err)
+				}
+			}
+		case tar.TypeSymlink:
+			links[name] = saveName(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			links[name] = saveName(hdr.Linkname)
+		}
+	}
+	if _, ok := members[manifestName]; !ok {
+		return nil, corrupt("no %s", manifestName)
+	}
+	switch len(manifest) {
+	case 0:
+		return nil, corrupt("%s lists no images", manifestName)
+	case 1:
+		// good.
+	default:
+		return nil, corrupt("%s lists %d images; only saves of one image can be unpacked", manifestName, len(manifest))
+	}
+	layers := make([]layerSpan, len(manifest[0].Layers))
+	for i, layerName := range manifest[0].Layers {
+		name := saveName(layerName)
+		// Follow links, but not round in circles.
+		for hops := 0; hops <= len(links); hops++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		span, ok := members[name]
+		if !ok {
+			return nil, corrupt("layer %q is not in the save", layerName)
+		}
+		span.name = layerName
+		layers[i] = span
+	}
+	return layers, nil
+}
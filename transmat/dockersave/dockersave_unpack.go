@@ -0,0 +1,465 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package dockersavetrans
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+	_ rio.ScanFunc   = Scan
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// The manifest can come after the layers, so fetch the whole ware to a spool file first.
+	spool, err := spoolWare(ctx, wareID, reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	layers, err := findLayers(spool)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackImage(ctx, hasher, osfs.New(path2), filt2, spool, layers, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+/*
+	Read a docker save from a single warehouse (a monowarehouse, not a CA
+	one), and report its WareID, without placing anything.
+	This is how to find out the WareID of an image to unpack it by.
+*/
+func Scan(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Ignored: nothing is placed, nor cached.
+	addr api.WarehouseAddr, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	filt = apiutil.MergeFilters(filt, api.Filter_NoMutation)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Dial warehouse.
+	wareID := api.WareID{PackType, "-"}
+	reader, err := tartrans.PickReader(ctx, wareID, []api.WarehouseAddr{addr}, true, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Spool, find the layers, and flatten them to nowhere.
+	spool, err := spoolWare(ctx, wareID, reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	layers, err := findLayers(spool)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	_, unpackedWareID, err := unpackImage(ctx, wareid.Default(PackType), nilFS.New(), filt2, spool, layers, mon)
+	return unpackedWareID, err
+}
+
+/*
+	Copy the ware into a file in the cache dir, and return it.
+	The caller removes the file when done.
+*/
+func spoolWare(ctx context.Context, wareID api.WareID, reader io.Reader) (*os.File, error) {
+	spoolDir := config.GetCacheBasePath().Join(fs.MustRelPath(string(PackType) + "/fetch"))
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), spoolDir.CoerceRelative(), 0700); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	file, err := ioutil.TempFile(spoolDir.String(), wareID.Hash+".")
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot open spool file for fetch: %s", err)
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "fetch of ware %s broke: %s", wareID, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read spool file: %s", err)
+	}
+	return file, nil
+}
+
+/*
+	Apply each layer, in order, onto `afs`; and hash the fileset that
+	results.
+
+	Unlike the oci-layer transmat, which hashes a layer as the layer it is
+	(whiteouts and all), this keeps a record of the whole flattened fileset
+	as it goes, and only hashes that, at the end: whatever a later layer
+	replaced or deleted isn't part of the WareID.
+*/
+func unpackImage(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	save io.ReaderAt,
+	layers []layerSpan,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Keep a record of each entry of the flattened fileset, and its content hash.
+	//  Buckets for hashing are made from this at the end; as in every transmat,
+	//  one for the raw ware data, and one for the filtered data.
+	type record struct {
+		prefilter, filtered fs.Metadata
+		contentHash         []byte
+	}
+	records := map[fs.RelPath]*record{}
+	under := func(name, dir fs.RelPath) bool {
+		if dir == (fs.RelPath{}) {
+			return name != dir
+		}
+		return strings.HasPrefix(name.String(), dir.String()+"/")
+	}
+	forget := func(name fs.RelPath) {
+		delete(records, name)
+		for other := range records {
+			if under(other, name) {
+				delete(records, other)
+			}
+		}
+	}
+
+	// Remember everything the current layer placed (and the dirs above it),
+	//  so making a dir opaque deletes only what was there before.
+	var placed map[fs.RelPath]struct{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Report bytes written as we go.  (The layers don't say how much they hold.)
+	prog := progress.New(mon, "unpack", 0)
+
+	place := func(fmeta fs.Metadata, body io.Reader) error {
+		if err := fsOp.PlaceFileOver(afs, fmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		placed[fmeta.Name] = struct{}{}
+		for _, parent := range fmeta.Name.SplitParent() {
+			placed[parent] = struct{}{}
+		}
+		return nil
+	}
+
+	// Record an entry over whatever was at its name.  A dir over a dir keeps
+	//  what's in it, as on disk; anything else goes, and what was in it.
+	keep := func(rec *record) {
+		name := rec.prefilter.Name
+		if existing, ok := records[name]; ok && !(existing.prefilter.Type == fs.Type_Dir && rec.prefilter.Type == fs.Type_Dir) {
+			forget(name)
+		}
+		records[name] = rec
+	}
+
+	// Conjure a dir with default attribs, where one is needed but wasn't given.
+	conjureDir := func(name fs.RelPath) error {
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		conjuredFmeta.Name = name
+		rec := &record{prefilter: conjuredFmeta}
+		policy.Apply(&conjuredFmeta)
+		filters.Apply(filt, &conjuredFmeta)
+		rec.filtered = conjuredFmeta
+		if err := place(conjuredFmeta, nil); err != nil {
+			return err
+		}
+		keep(rec)
+		return nil
+	}
+
+	// Infer parents, if necessary.  The tar format allows implicit parent dirs.
+	inferParents := func(name fs.RelPath) error {
+		for _, parent := range name.SplitParent() {
+			if existing, ok := records[parent]; ok && existing.prefilter.Type == fs.Type_Dir {
+				continue
+			}
+			log.DirectoryInferred(mon, parent, name)
+			if err := conjureDir(parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, layer := range layers {
+		placed = map[fs.RelPath]struct{}{}
+		corrupt := func(format string, args ...interface{}) error {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer %q: "+format, append([]interface{}{layer.name}, args...)...)
+		}
+
+		// Wrap the layer with decompression as necessary.
+		//  `docker save` writes them uncompressed, but OCI layouts may hold gzipped ones.
+		reader, err := tartrans.Decompress(io.NewSectionReader(save, layer.offset, layer.size))
+		if err != nil {
+			return api.WareID{}, api.WareID{}, corrupt("%s", err)
+		}
+		tr := tar.NewReader(reader)
+
+		// Iterate over each tar entry, mutating filesystem as we go.
+		for {
+			thdr, err := tr.Next()
+
+			// Check for done.
+			if err == io.EOF {
+				break // sucess!  end of layer.
+			}
+			if ctx.Err() != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+			}
+			if err != nil {
+				return api.WareID{}, api.WareID{}, corrupt("%s", err)
+			}
+
+			// Opaque markers aren't files, nor whiteouts of a file: handle them first.
+			//  Everything the dir held before this layer goes (but not what this layer put there).
+			if name, err := fs.ParseRelPath(thdr.Name); err == nil && name.Last() == opaqueMarker {
+				if name.GoesUp() {
+					return api.WareID{}, api.WareID{}, corrupt("paths that use '../' to leave the base dir are invalid")
+				}
+				if thdr.Typeflag != tar.TypeReg && thdr.Typeflag != tar.TypeRegA || thdr.Size != 0 {
+					return api.WareID{}, api.WareID{}, corrupt("%q is named as an opaque marker, but is not an empty file", thdr.Name)
+				}
+				if err := inferParents(name); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				dir := name.Dir()
+				for other := range records {
+					if _, ours := placed[other]; ours || !under(other, dir) {
+						continue
+					}
+					if err := fsOp.RemoveAll(afs, other); err != nil {
+						return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+					}
+					delete(records, other)
+				}
+				continue
+			}
+
+			// Reshuffle metainfo to our default format.
+			//  (Whiteouts come out as such, named for what they delete.)
+			fmeta := fs.Metadata{}
+			if err := tartrans.LayerTarHdrToMetadata(thdr, &fmeta); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			if fmeta.Name.GoesUp() {
+				return api.WareID{}, api.WareID{}, corrupt("paths that use '../' to leave the base dir are invalid")
+			}
+
+			// Whiteouts delete, and are gone: they're not part of the flattened fileset.
+			if fmeta.Type == fs.Type_Whiteout {
+				if err := place(fmeta, nil); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				forget(fmeta.Name)
+				continue
+			}
+			if err := inferParents(fmeta.Name); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+
+			// Apply filters.
+			filteredFmeta := fmeta
+			policy.Apply(&filteredFmeta)
+			filters.Apply(filt, &filteredFmeta)
+
+			// Place the file.
+			switch fmeta.Type {
+			case fs.Type_File:
+				reader := &util.HashingReader{tr, hasher.New()}
+				if err := place(filteredFmeta, reader); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				keep(&record{fmeta, filteredFmeta, reader.Hasher.Sum(nil)})
+				prog.Add(fmeta.Size, fmeta.Name)
+			case fs.Type_Hardlink:
+				linkname, err := fs.ParseRelPath(fmeta.Linkname)
+				if err != nil {
+					return api.WareID{}, api.WareID{}, corrupt("hardlink %q refers to %q, which is not a relative path", fmeta.Name, fmeta.Linkname)
+				}
+				target, ok := records[linkname]
+				if !ok || target.prefilter.Type != fs.Type_File {
+					return api.WareID{}, api.WareID{}, corrupt("hardlink %q refers to %q, which is not a file in the image", fmeta.Name, fmeta.Linkname)
+				}
+				if err := place(filteredFmeta, nil); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				rec := *target
+				rec.prefilter.Name, rec.filtered.Name = fmeta.Name, fmeta.Name
+				keep(&rec)
+			default:
+				if err := place(filteredFmeta, nil); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				keep(&record{fmeta, filteredFmeta, nil})
+			}
+		}
+	}
+
+	// An image with no layers (or only empty ones) is still a fileset: an empty dir.
+	if _, ok := records[fs.RelPath{}]; !ok {
+		placed = map[fs.RelPath]struct{}{}
+		if err := conjureDir(fs.RelPath{}); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+	}
+
+	// Now the flattened fileset can go in the buckets.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+	for _, rec := range records {
+		prefilterBucket.AddRecord(rec.prefilter, rec.contentHash)
+		filteredBucket.AddRecord(rec.filtered, rec.contentHash)
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
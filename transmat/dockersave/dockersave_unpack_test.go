@@ -0,0 +1,115 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package dockersavetrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestDockerSaveUnpack(t *testing.T) {
+	Convey("Docker-save transmat: unpacking images", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/image.tar", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				writeSave := func(members ...string) {
+					So(ioutil.WriteFile(tmpDir.String()+"/image.tar", testutil.MakeTar(testutil.ArchiveFiles(members...)...), 0644), ShouldBeNil)
+				}
+				placed := func() (names []string) {
+					filepath.Walk(tmpDir.String()+"/out", func(path string, _ os.FileInfo, _ error) error {
+						rel, _ := filepath.Rel(tmpDir.String()+"/out", path)
+						names = append(names, rel)
+						return nil
+					})
+					return
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				// The second layer deletes a file, empties a dir, and replaces a file with a dir.
+				dir, file := testutil.ArchiveDir, testutil.ArchiveFile
+				privateDir := func(name string) testutil.ArchiveEntry {
+					ent := dir(name)
+					ent.Mode = 0700
+					return ent
+				}
+				layer1 := testutil.MakeTar(dir("etc/"), file("etc/a", "a"), file("etc/b", "b"), dir("opt/"), dir("opt/old/"), file("opt/old/x", "x"), file("srv", "srv"))
+				layer2 := testutil.MakeTar(file("etc/.wh.a", ""), privateDir("opt/"), file("opt/.wh..wh..opq", ""), file("opt/new", "new"), dir("srv/"), file("srv/y", "y"))
+				manifest := `[{"Config":"cfg.json","RepoTags":["example:latest"],"Layers":["aaa/layer.tar","bbb/layer.tar"]}]`
+
+				Convey("an image should scan, then unpack by the scanned WareID, flattened", func() {
+					writeSave("aaa/layer.tar", string(layer1), "bbb/layer.tar", string(layer2), "cfg.json", "{}", "manifest.json", manifest)
+					wareID, err := Scan(context.Background(), PackType, api.Filter_NoMutation, "", addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID.Type, ShouldEqual, PackType)
+					wareID2, err := unpack(wareID)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/b", "opt", "opt/new", "srv", "srv/y"})
+					fi, err := os.Stat(tmpDir.String() + "/out/opt")
+					So(err, ShouldBeNil)
+					So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+
+					Convey("and its hash should be the flattened fileset's, as a tar", func() {
+						flat := testutil.MakeTar(dir("etc/"), file("etc/b", "b"), privateDir("opt/"), file("opt/new", "new"), dir("srv/"), file("srv/y", "y"))
+						So(ioutil.WriteFile(tmpDir.String()+"/flat.tar", flat, 0644), ShouldBeNil)
+						tarWareID, err := tartrans.Scan(context.Background(), tartrans.PackType, api.Filter_NoMutation, rio.Placement_Direct, api.WarehouseAddr(fmt.Sprintf("file://%s/flat.tar", tmpDir)), rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(tarWareID.Hash, ShouldEqual, wareID.Hash)
+					})
+				})
+				Convey("the wrong WareID should be a hash mismatch", func() {
+					writeSave("aaa/layer.tar", string(layer1), "bbb/layer.tar", string(layer2), "manifest.json", manifest)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("a save with no manifest should be corruption", func() {
+					writeSave("aaa/layer.tar", string(layer1))
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a save whose manifest lists a layer it doesn't have should be corruption", func() {
+					writeSave("aaa/layer.tar", string(layer1), "manifest.json", manifest)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a save of more than one image should be corruption", func() {
+					writeSave("aaa/layer.tar", string(layer1), "manifest.json", `[{"Layers":["aaa/layer.tar"]},{"Layers":["aaa/layer.tar"]}]`)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("packing should be refused", func() {
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
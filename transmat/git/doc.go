@@ -15,6 +15,16 @@ Sniperkit-Bot
 	paradoxically, the internal layout of the `.git` objects is can be
 	quite unpredictable, and is definitely not a function of the commit hash!).
 
+	Submodules are fetched and unpacked at the commits the superproject pins
+	them to, recursively, so the whole source tree comes out; or, with
+	UnpackWith and Submodules_Empty, left as empty dirs, as a plain
+	`git clone` would.  See SubmoduleMode.
+
+	Git LFS pointer files are placed as they are, unless UnpackOptions.LFS
+	asks for the files they point to, which are fetched from the repo's LFS
+	server (or, for a repo on the local filesystem, its own LFS objects),
+	and checked against the sha256 in the pointer.
+
 	Packing into git is not supported because the semantics don't align:
 	commit hashes are not a pure function of the packed file contents (due
 	to additional info like commit timestamps and the parent commits),
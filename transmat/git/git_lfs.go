@@ -0,0 +1,282 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	gitWarehouse "go.polydawn.net/rio/warehouse/impl/git"
+)
+
+/*
+	Git LFS keeps big files out of the repo: what's committed in their place
+	is a "pointer file", a few lines naming the real content by its sha256
+	and size, which is fetched from the LFS server beside the repo.
+	See https://github.com/git-lfs/git-lfs/blob/master/docs/spec.md .
+*/
+type lfsPointer struct {
+	oid  string // Hex sha256 of the content.
+	size int64
+}
+
+// Pointer files are under this size, by the spec; anything bigger is just a file.
+const lfsPointerMaxSize = 1024
+
+const lfsSpecVersion = "https://git-lfs.github.com/spec/v1"
+
+/*
+	Parse a blob as an LFS pointer, if it is one.
+	Anything that isn't exactly a pointer -- in particular, a file that
+	happens to start with the version line -- is left as a plain file.
+*/
+func parseLFSPointer(blob []byte) (lfsPointer, bool) {
+	if len(blob) >= lfsPointerMaxSize || !bytes.HasSuffix(blob, []byte("\n")) {
+		return lfsPointer{}, false
+	}
+	var ptr lfsPointer
+	var hasVersion, hasOid, hasSize bool
+	for i, line := range strings.Split(string(blob[:len(blob)-1]), "\n") {
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			return lfsPointer{}, false
+		}
+		switch kv[0] {
+		case "version":
+			if i != 0 || kv[1] != lfsSpecVersion {
+				return lfsPointer{}, false
+			}
+			hasVersion = true
+		case "oid":
+			sum := strings.TrimPrefix(kv[1], "sha256:")
+			if sum == kv[1] || len(sum) != 64 || strings.Trim(sum, "0123456789abcdef") != "" {
+				return lfsPointer{}, false
+			}
+			ptr.oid = sum
+			hasOid = true
+		case "size":
+			size, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || size < 0 {
+				return lfsPointer{}, false
+			}
+			ptr.size = size
+			hasSize = true
+		}
+	}
+	return ptr, hasVersion && hasOid && hasSize
+}
+
+/*
+	Fetches the LFS objects of one repo, keeping them in the cache, so
+	unpacking another commit that has them needn't fetch them again.
+	Every object is checked against its pointer before it's kept.
+*/
+type lfsFetcher struct {
+	repoAddr api.WarehouseAddr // The repo's warehouse; the LFS server is found from it.
+	storeDir fs.AbsolutePath   // Where objects are kept, named by oid.
+}
+
+func newLFSFetcher(whCtrl *gitWarehouse.Controller) *lfsFetcher {
+	return &lfsFetcher{
+		repoAddr: whCtrl.Addr(),
+		storeDir: config.GetCacheBasePath().Join(fs.MustRelPath("git/lfs-objects")),
+	}
+}
+
+/*
+	Open the content a pointer names: from the cache, if it's there, and
+	otherwise fetched into the cache first.
+*/
+func (lf *lfsFetcher) open(ctx context.Context, ptr lfsPointer) (io.ReadCloser, error) {
+	objPath := lf.storeDir.Join(fs.MustRelPath(ptr.oid)).String()
+	if f, err := os.Open(objPath); err == nil {
+		return f, nil
+	}
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), lf.storeDir.CoerceRelative(), 0700); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	body, err := lf.fetch(ctx, ptr)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	// Copy to a temp file, hashing; and keep it only if it checks out.
+	tmp, err := ioutil.TempFile(lf.storeDir.String(), ptr.oid+".tmp")
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot write LFS object to cache: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(body, ptr.size+1))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "fetch of LFS object %s broke: %s", ptr.oid, err)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); n != ptr.size || actual != ptr.oid {
+		return nil, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("LFS object mismatch: expected sha256:%s (%d bytes), got sha256:%s (%d bytes)", ptr.oid, ptr.size, actual, n),
+			map[string]string{
+				"expected": ptr.oid,
+				"actual":   actual,
+			},
+		)
+	}
+	if err := os.Rename(tmp.Name(), objPath); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot write LFS object to cache: %s", err)
+	}
+	f, err := os.Open(objPath)
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read LFS object from cache: %s", err)
+	}
+	return f, nil
+}
+
+/*
+	Get the body of an LFS object.  A repo on the local filesystem keeps
+	its objects in its own 'lfs/objects' dir, so they're read from there;
+	anything else is asked of its LFS server, with the batch API.
+*/
+func (lf *lfsFetcher) fetch(ctx context.Context, ptr lfsPointer) (io.ReadCloser, error) {
+	remote, err := gitWarehouse.SanitizeRemote(string(lf.repoAddr))
+	if err != nil {
+		return nil, err
+	}
+	if filepath.IsAbs(remote) {
+		for _, dir := range []string{filepath.Join(remote, ".git"), remote} {
+			f, err := os.Open(filepath.Join(dir, "lfs/objects", ptr.oid[0:2], ptr.oid[2:4], ptr.oid))
+			if err == nil {
+				return f, nil
+			}
+		}
+		return nil, Errorf(rio.ErrWareNotFound, "LFS object %s not found in repo %s", ptr.oid, lf.repoAddr)
+	}
+	href, header, err := lf.batch(ctx, remote, ptr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "LFS server for %s gave a bad download link: %s", lf.repoAddr, err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "error fetching LFS object %s: %s", ptr.oid, err)
+	}
+	switch resp.StatusCode {
+	case 200:
+		return resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWareNotFound, "LFS object %s not found", ptr.oid)
+	default:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code fetching LFS object %s: %s", ptr.oid, resp.Status)
+	}
+}
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+/*
+	Ask the LFS server where to download an object from.
+	The server is at "info/lfs" under the repo's URL (with ".git" on the
+	end of it, if it hasn't one), as git-lfs finds it by default.
+*/
+func (lf *lfsFetcher) batch(ctx context.Context, remote string, ptr lfsPointer) (href string, header map[string]string, err error) {
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", nil, Errorf(rio.ErrUsage, "fetching LFS objects needs an http or https remote (not %q)", lf.repoAddr)
+	}
+	if !strings.HasSuffix(u.Path, ".git") {
+		u.Path += ".git"
+	}
+	u.Path += "/info/lfs/objects/batch"
+
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   []map[string]interface{}{{"oid": ptr.oid, "size": ptr.size}},
+	})
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(reqBody))
+	if err != nil {
+		return "", nil, Errorf(rio.ErrUsage, "failed to build LFS request for %s: %s", lf.repoAddr, err)
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return "", nil, Errorf(rio.ErrWarehouseUnavailable, "error connecting to LFS server for %s: %s", lf.repoAddr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", nil, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from LFS server for %s: %s", lf.repoAddr, resp.Status)
+	}
+	var batchResp struct {
+		Objects []struct {
+			Oid     string
+			Actions struct {
+				Download *struct {
+					Href   string
+					Header map[string]string
+				}
+			}
+			Error *struct {
+				Code    int
+				Message string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+		return "", nil, Errorf(rio.ErrWarehouseUnavailable, "unparsable response from LFS server for %s: %s", lf.repoAddr, err)
+	}
+	for _, obj := range batchResp.Objects {
+		if obj.Oid != ptr.oid {
+			continue
+		}
+		switch {
+		case obj.Error != nil && obj.Error.Code == 404:
+			return "", nil, Errorf(rio.ErrWareNotFound, "LFS object %s not found on the server for %s", ptr.oid, lf.repoAddr)
+		case obj.Error != nil:
+			return "", nil, Errorf(rio.ErrWarehouseUnavailable, "LFS server for %s refused object %s: %s", lf.repoAddr, ptr.oid, obj.Error.Message)
+		case obj.Actions.Download == nil:
+			return "", nil, Errorf(rio.ErrWarehouseUnavailable, "LFS server for %s gave no download for object %s", lf.repoAddr, ptr.oid)
+		}
+		return obj.Actions.Download.Href, obj.Actions.Download.Header, nil
+	}
+	return "", nil, Errorf(rio.ErrWarehouseUnavailable, "LFS server for %s didn't answer for object %s", lf.repoAddr, ptr.oid)
+}
@@ -0,0 +1,38 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseLFSPointer(t *testing.T) {
+	Convey("Git transmat: recognizing LFS pointer files", t, func() {
+		pointer := "version https://git-lfs.github.com/spec/v1\n" +
+			"oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\n" +
+			"size 12345\n"
+		Convey("a pointer should give its oid and size", func() {
+			ptr, ok := parseLFSPointer([]byte(pointer))
+			So(ok, ShouldBeTrue)
+			So(ptr.oid, ShouldEqual, "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393")
+			So(ptr.size, ShouldEqual, 12345)
+		})
+		Convey("anything not exactly a pointer should be a plain file", func() {
+			for _, blob := range []string{
+				"hello\n",
+				pointer[:len(pointer)-1],
+				"version https://git-lfs.github.com/spec/v1\nsize 12345\n",
+				"oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\nversion https://git-lfs.github.com/spec/v1\nsize 12345\n",
+				"version https://git-lfs.github.com/spec/v1\noid md5:d41d8cd98f00b204e9800998ecf8427e\nsize 12345\n",
+			} {
+				_, ok := parseLFSPointer([]byte(blob))
+				So(ok, ShouldBeFalse)
+			}
+		})
+	})
+}
@@ -6,10 +6,14 @@ Sniperkit-Bot
 package git
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
@@ -22,6 +26,7 @@ import (
 	"go.polydawn.net/rio/transmat/mixins/cache"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
 	gitWarehouse "go.polydawn.net/rio/warehouse/impl/git"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -31,6 +36,43 @@ var (
 	_ rio.UnpackFunc = Unpack
 )
 
+/*
+	SubmoduleMode selects what unpacking does with the submodules of a
+	commit (its gitlinks, as '.gitmodules' names them).
+
+	Either way, the WareID is the commit's: it pins the commits of its
+	submodules, but not what's placed for them; so the cache keeps the
+	unpacks of each mode apart.
+*/
+type SubmoduleMode string
+
+const (
+	/*
+		Fetch each submodule from the URL '.gitmodules' gives it, and
+		unpack its pinned commit at its path; and so on for their own
+		submodules, all the way down, to get the whole source tree.
+		A relative URL ("../lib.git") is taken relative to the warehouse
+		its superproject came from, as git does.
+		This is what `Unpack` does.
+	*/
+	Submodules_Recurse SubmoduleMode = ""
+
+	/*
+		Leave each submodule as an empty dir, as `git clone` without
+		`--recurse-submodules` does, and log a warning for it.
+		Nothing is fetched for them.
+	*/
+	Submodules_Empty SubmoduleMode = "empty"
+)
+
+/*
+	Options for how UnpackWith treats a commit.
+*/
+type UnpackOptions struct {
+	Submodules SubmoduleMode // What to place for submodules.  See SubmoduleMode.
+	LFS        bool          // Fetch the content of Git LFS pointer files, and place that instead.  See lfsFetcher.
+}
+
 func Unpack(
 	ctx context.Context, // Long-running call.  Cancellable.
 	wareID api.WareID, // What wareID to fetch for unpacking.
@@ -40,107 +82,188 @@ func Unpack(
 	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
 ) (_ api.WareID, err error) {
-	if mon.Chan != nil {
-		defer close(mon.Chan)
-	}
-	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+	return UnpackWith(UnpackOptions{})(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
 
-	// Sanitize arguments.
-	if wareID.Type != PackType {
-		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
-	}
-	if placementMode == "" {
-		placementMode = rio.Placement_Copy
+/*
+	Returns an UnpackFunc which behaves exactly like Unpack, but treats
+	the commit as the options say.
+*/
+func UnpackWith(opts UnpackOptions) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != PackType {
+			return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+		}
+		// Each set of options places something different for the one WareID,
+		//  so each gets a cache of its own.
+		var variant []string
+		switch opts.Submodules {
+		case Submodules_Recurse:
+		case Submodules_Empty:
+			variant = append(variant, "nosubmodules")
+		default:
+			return api.WareID{}, Errorf(rio.ErrUsage, "unknown submodule mode %q", opts.Submodules)
+		}
+		if opts.LFS {
+			variant = append(variant, "lfs")
+		}
+		cacheBasePath := config.GetCacheBasePath()
+		if len(variant) > 0 {
+			cacheBasePath = cacheBasePath.Join(fs.MustRelPath("git/" + strings.Join(variant, "+")))
+		}
+		if placementMode == "" {
+			placementMode = rio.Placement_Copy
+		}
+		// Wrap the direct unpack func with cache behavior; call that.
+		return cache.Lrn2Cache(
+			osfs.New(cacheBasePath),
+			unpackWith(opts),
+		)(ctx, wareID, path, filt, placementMode, warehouses, mon)
 	}
-	// Wrap the direct unpack func with cache behavior; call that.
-	return cache.Lrn2Cache(
-		osfs.New(config.GetCacheBasePath()),
-		unpack,
-	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
 }
 
-func unpack(
-	ctx context.Context,
-	wareID api.WareID,
-	path string,
-	filt api.FilesetFilters,
-	placementMode rio.PlacementMode,
-	warehouses []api.WarehouseAddr,
-	mon rio.Monitor,
-) (_ api.WareID, err error) {
-	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+func unpackWith(opts UnpackOptions) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
-	// Sanitize arguments.
-	path2 := fs.MustAbsolutePath(path)
-	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
-	if err != nil {
-		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
-	}
+		// Sanitize arguments.
+		path2 := fs.MustAbsolutePath(path)
+		filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+		}
 
-	// Pick a warehouse and get a reader.
-	//  This is a *very* expensive operation for git.  It's less
-	//  of "pick a warehouse" and more "download the whole thing and hope we
-	//  get what we wanted" (which is very ironic for a system that has
-	//  a CAS system on its inside, yes).
-	whCtrl, err := pick(ctx,
-		wareID,
-		warehouses,
-		osfs.New(config.GetCacheBasePath().Join(fs.MustRelPath("git/objs"))),
-		mon,
-	)
-	if err != nil {
-		return api.WareID{}, err
+		// Pick a warehouse and get a reader.
+		//  This is a *very* expensive operation for git.  It's less
+		//  of "pick a warehouse" and more "download the whole thing and hope we
+		//  get what we wanted" (which is very ironic for a system that has
+		//  a CAS system on its inside, yes).
+		whCtrl, err := pick(ctx,
+			wareID,
+			warehouses,
+			osfs.New(config.GetCacheBasePath().Join(fs.MustRelPath("git/objs"))),
+			mon,
+		)
+		if err != nil {
+			return api.WareID{}, err
+		}
+
+		// Construct filesystem wrapper to use for all our ops.
+		afs := osfs.New(path2)
+
+		// Walk.  Submodules are fetched and walked as they come up.
+		if err := unpackOneRepo(ctx, whCtrl, wareID.Hash, afs, filt2, opts, mon); err != nil {
+			return api.WareID{}, err
+		}
+
+		// That's it.  Checkout should have already checked the hash, so we just return it.
+		return wareID, nil
 	}
+}
 
-	// Get submodule config.  Fetch them all.
-	submodules, err := whCtrl.Submodules(wareID.Hash)
+/*
+	Fetch the submodules of a commit, each at the commit it's pinned to,
+	and return their warehouse controllers, by path.
+	All of them are fetched before anything's placed, so a submodule
+	that can't be had fails the unpack early.
+*/
+func pickSubmodules(
+	ctx context.Context,
+	whCtrl *gitWarehouse.Controller,
+	commitHash string,
+	mon rio.Monitor,
+) (map[string]*gitWarehouse.Controller, error) {
+	submodules, err := whCtrl.Submodules(commitHash)
 	if err != nil {
-		return api.WareID{}, err
+		return nil, err
 	}
-	// We'll organize them by path now; only thing that's useful.
 	submoduleCtrls := map[string]*gitWarehouse.Controller{}
 	for _, submCfg := range submodules {
 		// TODO it would be dreamy to parallelize this.
-		whCtrl, err := pick(ctx,
-			api.WareID{"git", submCfg.Hash},
-			[]api.WarehouseAddr{api.WarehouseAddr(submCfg.URL)},
+		submCtrl, err := pick(ctx,
+			api.WareID{PackType, submCfg.Hash},
+			[]api.WarehouseAddr{submoduleAddr(whCtrl.Addr(), submCfg.URL)},
 			osfs.New(config.GetCacheBasePath().Join(fs.MustRelPath("git/objs"))),
 			mon,
 		)
 		if err != nil {
-			return api.WareID{}, err
+			return nil, err
 		}
-		submoduleCtrls[submCfg.Path] = whCtrl
+		submoduleCtrls[submCfg.Path] = submCtrl
 	}
+	return submoduleCtrls, nil
+}
 
-	// Open a tree to walk in the main repo.
-	//  We'll do submodule checkouts somewhere deep in the middle of this.
-	tr, err := whCtrl.GetTree(wareID.Hash)
-	if err != nil {
-		panic(err)
+/*
+	Returns where to fetch a submodule from, given the URL '.gitmodules'
+	gives it, and the address its superproject came from.
+	As with git, a URL starting with "./" or "../" is relative to the
+	superproject's (as if that were a dir); any other is used as it is.
+*/
+func submoduleAddr(superAddr api.WarehouseAddr, submURL string) api.WarehouseAddr {
+	if !strings.HasPrefix(submURL, "./") && !strings.HasPrefix(submURL, "../") {
+		return api.WarehouseAddr(submURL)
 	}
-
-	// Construct filesystem wrapper to use for all our ops.
-	afs := osfs.New(path2)
-
-	// Walk.
-	if err := unpackOneRepo(ctx, tr, afs, true, filt2, submoduleCtrls, mon); err != nil {
-		return api.WareID{}, err
+	u, err := url.Parse(string(superAddr))
+	if err != nil || u.Scheme == "" {
+		return api.WarehouseAddr(path.Join(string(superAddr), submURL))
 	}
-
-	// That's it.  Checkout should have already checked the hash, so we just return it.
-	return wareID, nil
+	u.Path = path.Join(u.Path, submURL)
+	return api.WarehouseAddr(u.String())
 }
 
 func unpackOneRepo(
 	ctx context.Context,
-	tr *object.Tree,
+	whCtrl *gitWarehouse.Controller,
+	commitHash string,
 	afs fs.FS,
-	isRoot bool, // if true, will recurse for submodules (with this set to false).
 	filt apiutil.FilesetFilters,
-	submoduleCtrls map[string]*gitWarehouse.Controller,
+	opts UnpackOptions,
 	mon rio.Monitor,
 ) (err error) {
+	// Open a tree to walk.
+	//  (The warehouse says what went wrong, if the hash isn't a commit or its tree is missing.)
+	tr, err := whCtrl.GetTree(commitHash)
+	if err != nil {
+		return err
+	}
+	// Get submodule config, and fetch them all, if we're to recurse.
+	//  We'll do submodule checkouts somewhere deep in the middle of the walk.
+	var submoduleCtrls map[string]*gitWarehouse.Controller
+	if opts.Submodules == Submodules_Recurse {
+		submoduleCtrls, err = pickSubmodules(ctx, whCtrl, commitHash, mon)
+		if err != nil {
+			return err
+		}
+	}
+	// LFS objects come from beside the repo they're committed in.
+	var lfs *lfsFetcher
+	if opts.LFS {
+		lfs = newLFSFetcher(whCtrl)
+	}
+
 	tw := object.NewTreeWalker(tr, true, nil)
 
 	// Make the root dir.  Git doesn't have metadata for the tree root.
@@ -203,25 +326,21 @@ func unpackOneRepo(
 			}
 			fmeta.Linkname = string(blob)
 		case filemode.Submodule:
-			// Ooowee!  Recurse time!
-			if !isRoot {
-				// Except of course if we're already a submodule, in which case no.
-				// Like git, we will make the empty dir, though.
+			if opts.Submodules == Submodules_Empty {
+				// Like git without --recurse-submodules, we'll make the empty dir.
+				log.SubmoduleLeftEmpty(mon, fmeta.Name, te.Hash.String())
 				fmeta.Type = fs.Type_Dir
 				fmeta.Perms = 0755
 				dirs = append(dirs, fmeta.Name)
 				break
 			}
+			// Ooowee!  Recurse time!
 			submCtrl, ok := submoduleCtrls[name]
 			if !ok {
 				return Errorf(rio.ErrWareCorrupt, "gitlink found at path %q but no matching config in .gitmodules", name)
 			}
-			submTr, err := submCtrl.GetTree(te.Hash.String())
-			if err != nil {
-				panic(err)
-			}
 			submFs := osfs.New(afs.BasePath().Join(fmeta.Name))
-			if err := unpackOneRepo(ctx, submTr, submFs, false, filt, nil, mon); err != nil {
+			if err := unpackOneRepo(ctx, submCtrl, te.Hash.String(), submFs, filt, opts, mon); err != nil {
 				return err
 			}
 			continue
@@ -248,6 +367,21 @@ func unpackOneRepo(
 			if err != nil {
 				return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
 			}
+			// A small file may be an LFS pointer; if so, place what it points to.
+			if lfs != nil && tf.Blob.Size < lfsPointerMaxSize {
+				blob, err := ioutil.ReadAll(reader)
+				reader.Close()
+				if err != nil {
+					return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
+				}
+				if ptr, ok := parseLFSPointer(blob); ok {
+					if reader, err = lfs.open(ctx, ptr); err != nil {
+						return err
+					}
+				} else {
+					reader = ioutil.NopCloser(bytes.NewReader(blob))
+				}
+			}
 			if err := fsOp.PlaceFile(afs, fmeta, reader, filt.SkipChown); err != nil {
 				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
@@ -0,0 +1,27 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+)
+
+func TestSubmoduleAddr(t *testing.T) {
+	Convey("Git transmat: where submodules are fetched from", t, func() {
+		Convey("an absolute URL should be used as it is", func() {
+			So(submoduleAddr("https://example.org/org/app.git", "https://example.net/lib.git"), ShouldEqual, api.WarehouseAddr("https://example.net/lib.git"))
+			So(submoduleAddr("https://example.org/org/app.git", "/srv/lib"), ShouldEqual, api.WarehouseAddr("/srv/lib"))
+		})
+		Convey("a relative URL should be relative to the superproject's", func() {
+			So(submoduleAddr("https://example.org/org/app.git", "../lib.git"), ShouldEqual, api.WarehouseAddr("https://example.org/org/lib.git"))
+			So(submoduleAddr("file:///srv/repos/app", "../lib"), ShouldEqual, api.WarehouseAddr("file:///srv/repos/lib"))
+			So(submoduleAddr("/srv/repos/app", "./sub"), ShouldEqual, api.WarehouseAddr("/srv/repos/app/sub"))
+		})
+	})
+}
@@ -0,0 +1,29 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The hg transmat can unpack filesystems from the Mercurial version control
+	system.  It's the git transmat's counterpart, and works the same way:
+
+	the hg transmat is read-only (unpack; no pack);
+	`rio unpack hg` must specify a full changeset hash (not a revision
+	number, a branch, a bookmark, or a tag, all of which are indirect or
+	mutable, or both);
+	and the unpacked filesystem will *not* include the `.hg` dir.
+
+	Mercurial keeps even less file metadata than git: a file is executable
+	or not, or a symlink.  So every file is unpacked with the same owner and
+	times, as in the git transmat; and dirs, which Mercurial doesn't track at
+	all, are made as needed.  Subrepos aren't unpacked.
+
+	This requires `hg` on the path (see the hg warehouse).
+*/
+package hg
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("hg")
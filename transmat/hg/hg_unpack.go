@@ -0,0 +1,205 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package hg
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	hgWarehouse "go.polydawn.net/rio/warehouse/impl/hg"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Pick a warehouse.
+	//  As for git, this can mean fetching the whole repo.
+	whCtrl, err := pick(ctx,
+		wareID,
+		warehouses,
+		osfs.New(config.GetCacheBasePath().Join(fs.MustRelPath("hg/objs"))),
+		mon,
+	)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Have hg archive the changeset, and read that.
+	reader, err := whCtrl.Archive(ctx, wareID.Hash)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if err := unpackArchive(ctx, reader, osfs.New(path2), filt2); err != nil {
+		reader.Close()
+		return api.WareID{}, err
+	}
+	if err := reader.Close(); err != nil {
+		return api.WareID{}, err
+	}
+
+	// That's it.  The changeset hash was checked by hg, so we just return it.
+	return wareID, nil
+}
+
+func unpackArchive(
+	ctx context.Context,
+	reader io.Reader,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+) error {
+	tr := tar.NewReader(reader)
+
+	// Make the root dir.  Mercurial doesn't have metadata for the root, nor any dir.
+	conjuredFmeta := fshash.DefaultDirMetadata()
+	filters.Apply(filt, &conjuredFmeta)
+	if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, filt.SkipChown); err != nil {
+		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Extract.
+	// Iterate over each entry, mutating filesystem as we go.
+	dirs := make([]fs.RelPath, 1, 200) // Keep for dir time repair at end.
+	dirs[0] = fs.RelPath{}
+	seenDirs := map[fs.RelPath]struct{}{fs.RelPath{}: {}}
+	for {
+		thdr, err := tr.Next()
+
+		// Check for done.
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if err != nil {
+			return Errorf(rio.ErrWareCorrupt, "corrupt hg archive: %s", err)
+		}
+
+		// Every name is under the archive prefix; strip that.
+		name := strings.TrimPrefix(thdr.Name, hgWarehouse.ArchivePrefix+"/")
+		if name == thdr.Name {
+			return Errorf(rio.ErrWareCorrupt, "corrupt hg archive: %q is not under the archive prefix", thdr.Name)
+		}
+		relName, err := fs.ParseRelPath(name)
+		if err != nil || relName.GoesUp() {
+			return Errorf(rio.ErrWareCorrupt, "corrupt hg archive: %q is not a path in the repo", name)
+		}
+
+		// Make the dirs above it, as the git transmat makes them.
+		for _, parent := range relName.SplitParent() {
+			if _, ok := seenDirs[parent]; ok {
+				continue
+			}
+			seenDirs[parent] = struct{}{}
+			dirFmeta := fs.Metadata{Name: parent, Type: fs.Type_Dir, Perms: 0755, Uid: 1000, Gid: 1000, Mtime: apiutil.DefaultMtime}
+			filters.Apply(filt, &dirFmeta)
+			if err := fsOp.PlaceFile(afs, dirFmeta, nil, filt.SkipChown); err != nil {
+				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			dirs = append(dirs, parent)
+		}
+
+		// Reshuffle metainfo to our default format.
+		fmeta := fs.Metadata{Name: relName, Uid: 1000, Gid: 1000}
+		switch thdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			fmeta.Type = fs.Type_File
+			fmeta.Perms = 0644
+			if thdr.Mode&0111 != 0 {
+				fmeta.Perms = 0755
+			}
+		case tar.TypeSymlink:
+			fmeta.Type = fs.Type_Symlink
+			fmeta.Perms = 0644
+			fmeta.Linkname = thdr.Linkname
+		default:
+			return Errorf(rio.ErrWareCorrupt, "corrupt hg archive: %q is neither a file nor a symlink", name)
+		}
+		fmeta.Mtime = apiutil.DefaultMtime // the archive has the commit time, but that's not part of the files
+
+		// Apply filters.
+		filters.Apply(filt, &fmeta)
+
+		// Place the file.
+		var body io.Reader
+		if fmeta.Type == fs.Type_File {
+			body = tr
+		}
+		if err := fsOp.PlaceFile(afs, fmeta, body, filt.SkipChown); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+	}
+
+	// Cleanup dir times with a post-order traversal.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := afs.SetTimesNano(dirs[i], fs.DefaultAtime, fs.DefaultAtime); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+	}
+
+	return nil
+}
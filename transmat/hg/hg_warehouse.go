@@ -0,0 +1,88 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package hg
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	hgWarehouse "go.polydawn.net/rio/warehouse/impl/hg"
+)
+
+// Pick a warehouse.
+//
+// As for git, this function is not cheap: remote repos are cloned
+// (or pulled, if cloned before) into the cache before anything else.
+func pick(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	objcacheWorkdir fs.FS,
+	mon rio.Monitor,
+) (whCtrl *hgWarehouse.Controller, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	var anyWarehouses bool // for clarity in final error messages
+	for _, addr := range warehouses {
+		u, err := url.Parse(string(addr))
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+		}
+		switch u.Scheme {
+		case "ssh", "http", "https", "file":
+			whCtrl, err = hgWarehouse.NewController(objcacheWorkdir, addr)
+		default:
+			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'ssh', 'http', 'https', or 'file')", u.Scheme)
+		}
+		switch Category(err) {
+		case nil:
+			anyWarehouses = true
+			// pass
+		case rio.ErrWarehouseUnavailable:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue // okay!  skip to the next one.
+		default:
+			return nil, err
+		}
+		// Check if the local clone has the hash already; return early if so
+		if whCtrl.Contains(wareID.Hash) {
+			log.WareObjCacheHit(mon, wareID)
+			return whCtrl, nil // happy path return!
+		}
+		// Fetch from the remote.
+		err = whCtrl.Clone(ctx)
+		if err == nil {
+			err = whCtrl.Update(ctx)
+		}
+		switch Category(err) {
+		case nil:
+			// pass
+		case rio.ErrWarehouseUnavailable:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue // okay!  skip to the next one.
+		default:
+			return nil, err
+		}
+		// Check again if we have the changeset now after fetching.
+		if whCtrl.Contains(wareID.Hash) {
+			log.WareReaderOpened(mon, addr, wareID)
+			return whCtrl, nil // happy path return!
+		} else {
+			log.WareNotFound(mon, fmt.Errorf("not in this repo"), addr, wareID)
+			continue // okay!  skip to the next one.
+		}
+	}
+	if !anyWarehouses {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "no warehouses were available!")
+	}
+	return nil, Errorf(rio.ErrWareNotFound, "none of the available warehouses have ware %q!", wareID)
+}
@@ -0,0 +1,39 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The iso transmat unpacks ISO 9660 images (".iso" files: CD and DVD
+	images, as OS installer media is shipped) onto filesystems, so an image
+	can be a rio input as is.  It can use any k/v-styled warehouse (just
+	like the tar transmat).
+
+	Images with Rock Ridge extensions (as mkisofs, genisoimage, and xorriso
+	make by default) are unpacked as Rock Ridge describes them: names, perms,
+	owners, mtimes, symlinks, and devices all come from there.  Dirs that
+	were moved to keep the image within ISO 9660's depth limit are put back
+	where they belong (the dir they were moved to stays, empty, as it does
+	when the image is mounted).  Images without Rock Ridge have only what ISO 9660
+	itself says: names (minus the ";1" version suffix), and mtimes; so every
+	dir is unpacked 0755, and every file 0644, owned by 0:0.
+	Joliet names aren't read (Rock Ridge is preferred when both are there;
+	and Joliet doesn't have perms).  Files split into several extents, as
+	files of 4GB and more must be, are read whole.  Only the first session
+	of a multi-session image is read.
+
+	The WareID is computed over the unpacked fileset, exactly as the tar
+	transmat computes it (mtimes are kept to the second).  Scan reports it.
+
+	Pack is unsupported: rio reads ISO images, but doesn't make them.
+
+	An image is read from the middle, so unpacking fetches the whole ware
+	into the cache dir before reading any of it.
+*/
+package isotrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("iso")
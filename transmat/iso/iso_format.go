@@ -0,0 +1,628 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package isotrans
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+const (
+	sectorSize = 2048
+
+	// Volume descriptors start after the "system area", which is 16 sectors.
+	firstDescriptor = 16
+	// No image has more descriptors than this; it's so a bad one can't keep us reading.
+	maxDescriptors = 64
+
+	descriptorPrimary    = 1
+	descriptorTerminator = 255
+
+	// Directory record flags.
+	flagDir      = 0x02
+	flagNotFinal = 0x80 // More extents of this file follow, in the next records.
+
+	// Bigger dirs than this aren't dirs; they're a bad size field.
+	maxDirSize = 64 << 20
+	// Nor is a tree deeper than this.  (Rock Ridge relocation keeps ISO 9660's own limit at 8.)
+	maxDepth = 256
+	// Continuation areas to follow, per record, before giving up on a loop of them.
+	maxContinuations = 32
+)
+
+func corrupt(format string, args ...interface{}) error {
+	return Errorf(rio.ErrWareCorrupt, "corrupt iso: "+format, args...)
+}
+
+/*
+	A directory record, as it is in the image.
+*/
+type dirRecord struct {
+	lba      uint32 // Where the extent starts, in sectors.
+	size     uint32 // How long the extent is, in bytes.
+	recorded time.Time
+	flags    byte
+	ident    []byte
+	sysUse   []byte // The System Use area: where Rock Ridge is.
+}
+
+func parseDirRecord(buf []byte) (dirRecord, error) {
+	if len(buf) < 34 || int(buf[0]) < 34 || int(buf[0]) > len(buf) {
+		return dirRecord{}, corrupt("truncated directory record")
+	}
+	buf = buf[:buf[0]]
+	nameLen := int(buf[32])
+	if 33+nameLen > len(buf) {
+		return dirRecord{}, corrupt("truncated directory record")
+	}
+	rec := dirRecord{
+		lba:      binary.LittleEndian.Uint32(buf[2:6]),
+		size:     binary.LittleEndian.Uint32(buf[10:14]),
+		recorded: parseShortTime(buf[18:25]),
+		flags:    buf[25],
+		ident:    buf[33 : 33+nameLen],
+	}
+	// The identifier is padded to an even length; the System Use area follows.
+	suStart := 33 + nameLen
+	if nameLen%2 == 0 {
+		suStart++
+	}
+	if suStart < len(buf) {
+		rec.sysUse = buf[suStart:]
+	}
+	return rec, nil
+}
+
+// The "." and ".." records of a dir have one-byte identifiers, 0 and 1.
+func (rec dirRecord) isSelf() bool   { return len(rec.ident) == 1 && rec.ident[0] == 0 }
+func (rec dirRecord) isParent() bool { return len(rec.ident) == 1 && rec.ident[0] == 1 }
+
+// The 7-byte form of time ISO 9660 uses in directory records (and Rock Ridge, in its short form).
+func parseShortTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 && b[2] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone).UTC()
+}
+
+// The 17-byte form: digits for "YYYYMMDDhhmmsscc", then the zone.
+func parseLongTime(b []byte) time.Time {
+	var n [7]int
+	for i, width := range []int{4, 2, 2, 2, 2, 2, 2} {
+		for _, c := range b[:width] {
+			n[i] = n[i]*10 + int(c-'0')
+		}
+		b = b[width:]
+	}
+	if n[0] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[0]))*15*60)
+	return time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], n[6]*10*int(time.Millisecond), zone).UTC()
+}
+
+/*
+	An image, open for reading.
+*/
+type isoImage struct {
+	r    io.ReaderAt
+	size int64
+
+	// If the image uses SUSP (the System Use Sharing Protocol, which Rock
+	//  Ridge is built on), and how many bytes of each System Use area to skip.
+	susp     bool
+	suspSkip int
+}
+
+func (img *isoImage) read(offset int64, n int) ([]byte, error) {
+	if offset < 0 || offset+int64(n) > img.size {
+		return nil, corrupt("extent at %d (of %d bytes) is past the end of the image", offset, n)
+	}
+	buf := make([]byte, n)
+	if _, err := img.r.ReadAt(buf, offset); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read spool file: %s", err)
+	}
+	return buf, nil
+}
+
+/*
+	Open an image: find the primary volume descriptor, and from it the root
+	dir; and see if the root says the image uses SUSP.
+	Errors are ErrWareCorrupt (or ErrLocalCacheProblem, for the file).
+*/
+func openImage(r io.ReaderAt, size int64) (*isoImage, dirRecord, error) {
+	img := &isoImage{r: r, size: size}
+	var root *dirRecord
+	for i := 0; i < maxDescriptors; i++ {
+		desc, err := img.read(int64(firstDescriptor+i)*sectorSize, sectorSize)
+		if err != nil {
+			if i == 0 {
+				return nil, dirRecord{}, corrupt("not an ISO 9660 image")
+			}
+			return nil, dirRecord{}, err
+		}
+		if string(desc[1:6]) != "CD001" {
+			return nil, dirRecord{}, corrupt("not an ISO 9660 image")
+		}
+		if desc[0] == descriptorTerminator {
+			break
+		}
+		if desc[0] == descriptorPrimary && root == nil {
+			rec, err := parseDirRecord(desc[156:190])
+			if err != nil {
+				return nil, dirRecord{}, err
+			}
+			root = &rec
+		}
+	}
+	if root == nil {
+		return nil, dirRecord{}, corrupt("no primary volume descriptor")
+	}
+
+	// SUSP says it's in use with an "SP" entry, first in the root's "." record.
+	self, _, err := img.readDir(*root)
+	if err != nil {
+		return nil, dirRecord{}, err
+	}
+	if su := self.sysUse; len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+		img.susp = true
+		img.suspSkip = int(su[6])
+	}
+	return img, *root, nil
+}
+
+/*
+	Read a dir's records: its "." record, and the rest (but not "..").
+	Records don't cross sectors; the rest of a sector after the last one is zeros.
+*/
+func (img *isoImage) readDir(dir dirRecord) (self dirRecord, children []dirRecord, err error) {
+	if dir.size > maxDirSize {
+		return dirRecord{}, nil, corrupt("dir of %d bytes", dir.size)
+	}
+	data, err := img.read(int64(dir.lba)*sectorSize, int(dir.size))
+	if err != nil {
+		return dirRecord{}, nil, err
+	}
+	var sawSelf bool
+	for pos := 0; pos < len(data); {
+		if data[pos] == 0 {
+			pos = (pos/sectorSize + 1) * sectorSize
+			continue
+		}
+		end := pos + int(data[pos])
+		if sectorEnd := (pos/sectorSize + 1) * sectorSize; end > sectorEnd {
+			return dirRecord{}, nil, corrupt("directory record crosses a sector")
+		}
+		rec, err := parseDirRecord(data[pos:])
+		if err != nil {
+			return dirRecord{}, nil, err
+		}
+		pos = end
+		switch {
+		case rec.isSelf():
+			self, sawSelf = rec, true
+		case rec.isParent():
+			// nothing to say.
+		default:
+			children = append(children, rec)
+		}
+	}
+	if !sawSelf {
+		return dirRecord{}, nil, corrupt("dir has no \".\" record")
+	}
+	return self, children, nil
+}
+
+/*
+	What Rock Ridge says about a record.  (Anything it doesn't say is left zero.)
+*/
+type rockRidge struct {
+	hasPX    bool
+	mode     uint32
+	uid, gid uint32
+
+	hasNM bool
+	name  string
+
+	hasSL bool
+	link  string
+
+	mtime time.Time
+
+	hasPN           bool
+	devHigh, devLow uint32
+
+	relocated bool   // "RE": this is where a dir was moved to; its real place has a "CL".
+	childLink uint32 // "CL": this stands for a dir that was moved; here's where it went.
+	hasCL     bool
+}
+
+/*
+	Read the SUSP entries of a record, following continuation areas.
+	Unknown entries are skipped, as SUSP says to.
+*/
+func (img *isoImage) rockRidge(rec dirRecord, isRootSelf bool) (rockRidge, error) {
+	var rr rockRidge
+	if !img.susp {
+		return rr, nil
+	}
+	area := rec.sysUse
+	if !isRootSelf {
+		if len(area) < img.suspSkip {
+			return rr, nil
+		}
+		area = area[img.suspSkip:]
+	}
+	var linkSep bool // If the next symlink component needs a slash before it.
+	for continuations := 0; ; continuations++ {
+		var next []byte
+		for len(area) >= 4 {
+			sig, l := string(area[0:2]), int(area[2])
+			if l < 4 || l > len(area) {
+				break // Padding, or junk: either way, there's no more.
+			}
+			entry := area[4:l]
+			area = area[l:]
+			switch sig {
+			case "ST":
+				area = nil
+			case "CE":
+				if len(entry) < 24 {
+					return rr, corrupt("truncated SUSP continuation")
+				}
+				block := binary.LittleEndian.Uint32(entry[0:4])
+				offset := binary.LittleEndian.Uint32(entry[8:12])
+				length := binary.LittleEndian.Uint32(entry[16:20])
+				if length > sectorSize {
+					return rr, corrupt("SUSP continuation of %d bytes", length)
+				}
+				var err error
+				next, err = img.read(int64(block)*sectorSize+int64(offset), int(length))
+				if err != nil {
+					return rr, err
+				}
+			case "PX":
+				if len(entry) < 32 {
+					return rr, corrupt("truncated Rock Ridge PX entry")
+				}
+				rr.hasPX = true
+				rr.mode = binary.LittleEndian.Uint32(entry[0:4])
+				rr.uid = binary.LittleEndian.Uint32(entry[16:20])
+				rr.gid = binary.LittleEndian.Uint32(entry[24:28])
+			case "NM":
+				if len(entry) < 1 {
+					return rr, corrupt("truncated Rock Ridge NM entry")
+				}
+				if entry[0]&0x06 != 0 { // "." or ".." -- which we know already.
+					continue
+				}
+				rr.hasNM = true
+				rr.name += string(entry[1:])
+			case "SL":
+				if len(entry) < 1 {
+					return rr, corrupt("truncated Rock Ridge SL entry")
+				}
+				rr.hasSL = true
+				for comps := entry[1:]; len(comps) > 0; {
+					if len(comps) < 2 || len(comps) < 2+int(comps[1]) {
+						return rr, corrupt("truncated Rock Ridge SL entry")
+					}
+					flags, content := comps[0], comps[2:2+int(comps[1])]
+					comps = comps[2+int(comps[1]):]
+					if flags&0x08 != 0 { // root
+						rr.link += "/"
+						linkSep = false
+						continue
+					}
+					if linkSep {
+						rr.link += "/"
+					}
+					switch {
+					case flags&0x02 != 0: // current
+						rr.link += "."
+					case flags&0x04 != 0: // parent
+						rr.link += ".."
+					default:
+						rr.link += string(content)
+					}
+					linkSep = flags&0x01 == 0 // continues in the next component, or not
+				}
+			case "TF":
+				if len(entry) < 1 {
+					return rr, corrupt("truncated Rock Ridge TF entry")
+				}
+				flags, stamps := entry[0], entry[1:]
+				width := 7
+				if flags&0x80 != 0 {
+					width = 17
+				}
+				// Creation, then modification, then the rest; each only if flagged.
+				for bit := uint(0); bit < 7; bit++ {
+					if flags&(1<<bit) == 0 {
+						continue
+					}
+					if len(stamps) < width {
+						return rr, corrupt("truncated Rock Ridge TF entry")
+					}
+					if bit == 1 {
+						if width == 7 {
+							rr.mtime = parseShortTime(stamps[:width])
+						} else {
+							rr.mtime = parseLongTime(stamps[:width])
+						}
+					}
+					stamps = stamps[width:]
+				}
+			case "PN":
+				if len(entry) < 16 {
+					return rr, corrupt("truncated Rock Ridge PN entry")
+				}
+				rr.hasPN = true
+				rr.devHigh = binary.LittleEndian.Uint32(entry[0:4])
+				rr.devLow = binary.LittleEndian.Uint32(entry[8:12])
+			case "RE":
+				rr.relocated = true
+			case "CL":
+				if len(entry) < 8 {
+					return rr, corrupt("truncated Rock Ridge CL entry")
+				}
+				rr.hasCL = true
+				rr.childLink = binary.LittleEndian.Uint32(entry[0:4])
+			}
+		}
+		if next == nil {
+			return rr, nil
+		}
+		if continuations >= maxContinuations {
+			return rr, corrupt("too many SUSP continuations")
+		}
+		area = next
+	}
+}
+
+/*
+	Work out a record's own name (not yet a path; the caller joins it to its dir's).
+*/
+func recordName(rec dirRecord, rr rockRidge) (string, error) {
+	var name string
+	switch {
+	case rr.hasNM:
+		name = rr.name
+	case rec.flags&flagDir != 0:
+		name = string(rec.ident)
+	default:
+		// Files have a version suffix; and a trailing dot, if they've no extension.
+		name = string(rec.ident)
+		if i := strings.LastIndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", corrupt("%q is not a sensible name", name)
+	}
+	return name, nil
+}
+
+/*
+	Work out everything but the name (and, for files, the size) of a record's metadata.
+*/
+func recordToMetadata(rec dirRecord, rr rockRidge, fmeta *fs.Metadata) error {
+	// Type and perms.
+	if rr.hasPX {
+		switch rr.mode & 0170000 {
+		case 0100000:
+			fmeta.Type = fs.Type_File
+		case 0040000:
+			fmeta.Type = fs.Type_Dir
+		case 0120000:
+			fmeta.Type = fs.Type_Symlink
+		case 0010000:
+			fmeta.Type = fs.Type_NamedPipe
+		case 0020000:
+			fmeta.Type = fs.Type_CharDevice
+		case 0060000:
+			fmeta.Type = fs.Type_Device
+		default:
+			return corrupt("%q has mode %o, which is not a kind of file we can unpack", fmeta.Name, rr.mode)
+		}
+		fmeta.Perms = fs.Perms(rr.mode & 07777)
+		fmeta.Uid, fmeta.Gid = rr.uid, rr.gid
+	} else if rec.flags&flagDir != 0 {
+		fmeta.Type, fmeta.Perms = fs.Type_Dir, 0755
+	} else {
+		fmeta.Type, fmeta.Perms = fs.Type_File, 0644
+	}
+	if (fmeta.Type == fs.Type_Dir) != (rec.flags&flagDir != 0) {
+		return corrupt("%q is a dir to ISO 9660, but not to Rock Ridge (or the other way round)", fmeta.Name)
+	}
+
+	// The rest.
+	switch fmeta.Type {
+	case fs.Type_Symlink:
+		if !rr.hasSL || rr.link == "" {
+			return corrupt("symlink %q has no target", fmeta.Name)
+		}
+		fmeta.Linkname = rr.link
+	case fs.Type_Device, fs.Type_CharDevice:
+		if !rr.hasPN {
+			return corrupt("device %q has no device numbers", fmeta.Name)
+		}
+		// As Linux reads it: some old images put both numbers in the low word.
+		if rr.devHigh == 0 && rr.devLow&^0xff != 0 {
+			fmeta.Devmajor, fmeta.Devminor = int64(rr.devLow>>8), int64(rr.devLow&0xff)
+		} else {
+			fmeta.Devmajor, fmeta.Devminor = int64(rr.devHigh), int64(rr.devLow)
+		}
+	}
+	fmeta.Mtime = rec.recorded
+	if !rr.mtime.IsZero() {
+		fmeta.Mtime = rr.mtime
+	}
+	fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+	return nil
+}
+
+/*
+	Walk the tree, calling visit for every entry: the root first, and each
+	dir before what's in it.  Files come with their extents.
+*/
+func (img *isoImage) walk(root dirRecord, visit func(fmeta fs.Metadata, extents []extent) error) error {
+	self, _, err := img.readDir(root)
+	if err != nil {
+		return err
+	}
+	rr, err := img.rockRidge(self, true)
+	if err != nil {
+		return err
+	}
+	fmeta := fs.Metadata{}
+	if err := recordToMetadata(self, rr, &fmeta); err != nil {
+		return err
+	}
+	if err := visit(fmeta, nil); err != nil {
+		return err
+	}
+	return img.walkDir(fs.RelPath{}, root, map[uint32]struct{}{root.lba: {}}, 0, visit)
+}
+
+func (img *isoImage) walkDir(
+	path fs.RelPath,
+	dir dirRecord,
+	visited map[uint32]struct{},
+	depth int,
+	visit func(fmeta fs.Metadata, extents []extent) error,
+) error {
+	if depth > maxDepth {
+		return corrupt("dirs nested more than %d deep", maxDepth)
+	}
+	_, children, err := img.readDir(dir)
+	if err != nil {
+		return err
+	}
+	names := map[string]struct{}{}
+	for i := 0; i < len(children); i++ {
+		rec := children[i]
+		rr, err := img.rockRidge(rec, false)
+		if err != nil {
+			return err
+		}
+		if rr.relocated {
+			continue // It's listed again where it belongs, with a "CL".
+		}
+		name, err := recordName(rec, rr)
+		if err != nil {
+			return err
+		}
+
+		// A file of several extents is several records in a row, with the same identifier.
+		extents := []extent{{rec.lba, rec.size}}
+		for last := rec; last.flags&flagNotFinal != 0; {
+			i++
+			if i >= len(children) || !bytes.Equal(children[i].ident, rec.ident) {
+				return corrupt("%s is missing extents", identString(rec.ident))
+			}
+			last = children[i]
+			extents = append(extents, extent{last.lba, last.size})
+		}
+
+		if _, dup := names[name]; dup {
+			return corrupt("%q appears more than once in %q", name, path)
+		}
+		names[name] = struct{}{}
+		fmeta := fs.Metadata{Name: path.Join(fs.MustRelPath(name))}
+
+		// A relocated dir: this record only points at it; the dir, and what it says about itself, is elsewhere.
+		if rr.hasCL {
+			if rec, err = img.readSelf(rr.childLink); err != nil {
+				return err
+			}
+			if rr, err = img.rockRidge(rec, false); err != nil {
+				return err
+			}
+			extents = []extent{{rec.lba, rec.size}}
+		}
+
+		if err := recordToMetadata(rec, rr, &fmeta); err != nil {
+			return err
+		}
+		switch fmeta.Type {
+		case fs.Type_File:
+			for _, ext := range extents {
+				fmeta.Size += int64(ext.size)
+			}
+			if err := visit(fmeta, extents); err != nil {
+				return err
+			}
+		case fs.Type_Dir:
+			if len(extents) > 1 {
+				return corrupt("dir %q has more than one extent", fmeta.Name)
+			}
+			if _, loops := visited[rec.lba]; loops {
+				return corrupt("dir %q is already somewhere else in the tree", fmeta.Name)
+			}
+			visited[rec.lba] = struct{}{}
+			if err := visit(fmeta, nil); err != nil {
+				return err
+			}
+			if err := img.walkDir(fmeta.Name, rec, visited, depth+1, visit); err != nil {
+				return err
+			}
+		default:
+			if err := visit(fmeta, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read the "." record of the dir at a block: which says how big the dir is.
+func (img *isoImage) readSelf(lba uint32) (dirRecord, error) {
+	buf, err := img.read(int64(lba)*sectorSize, sectorSize)
+	if err != nil {
+		return dirRecord{}, err
+	}
+	rec, err := parseDirRecord(buf)
+	if err != nil {
+		return dirRecord{}, err
+	}
+	if !rec.isSelf() || rec.lba != lba {
+		return dirRecord{}, corrupt("relocated dir at block %d isn't there", lba)
+	}
+	return rec, nil
+}
+
+// A file's extents, read end to end.
+type extent struct{ lba, size uint32 }
+
+func (img *isoImage) body(extents []extent) (io.Reader, int64, error) {
+	readers := make([]io.Reader, len(extents))
+	var total int64
+	for i, ext := range extents {
+		offset := int64(ext.lba) * sectorSize
+		if offset+int64(ext.size) > img.size {
+			return nil, 0, corrupt("extent at %d (of %d bytes) is past the end of the image", offset, ext.size)
+		}
+		readers[i] = io.NewSectionReader(img.r, offset, int64(ext.size))
+		total += int64(ext.size)
+	}
+	return io.MultiReader(readers...), total, nil
+}
+
+// For error messages: a name as it is in the image.
+func identString(ident []byte) string {
+	return fmt.Sprintf("%q", string(bytes.TrimRight(ident, "\x00")))
+}
@@ -0,0 +1,37 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package isotrans
+
+import (
+	"context"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+/*
+	Refuses, always: this transmat only unpacks.
+	(It's here so that asking for it gets a clear answer, rather than
+	"unsupported packtype".)
+*/
+func Pack(
+	ctx context.Context,
+	packType api.PackType,
+	pathStr string,
+	filt api.FilesetFilters,
+	warehouseAddr api.WarehouseAddr,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	return api.WareID{}, Errorf(rio.ErrUsage, "packtype %q is unpack-only: rio can read ISO images, but not make them (pack as tar instead)", PackType)
+}
@@ -0,0 +1,283 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package isotrans
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+	_ rio.ScanFunc   = Scan
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// An image is read from the middle, so fetch the whole ware to a spool file first.
+	spool, size, err := spoolWare(ctx, wareID, reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackISO(ctx, hasher, osfs.New(path2), filt2, spool, size, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+func Scan(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Ignored: nothing is placed, nor cached.
+	addr api.WarehouseAddr, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	filt = apiutil.MergeFilters(filt, api.Filter_NoMutation)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Dial warehouse.
+	wareID := api.WareID{PackType, "-"}
+	reader, err := tartrans.PickReader(ctx, wareID, []api.WarehouseAddr{addr}, true, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Spool, and extract to nowhere.
+	spool, size, err := spoolWare(ctx, wareID, reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	_, unpackedWareID, err := unpackISO(ctx, wareid.Default(PackType), nilFS.New(), filt2, spool, size, mon)
+	return unpackedWareID, err
+}
+
+/*
+	Copy the ware into a file in the cache dir, and return it (seeked
+	nowhere in particular; it's read with ReadAt) with its size.
+	The caller removes the file when done.
+*/
+func spoolWare(ctx context.Context, wareID api.WareID, reader io.Reader) (*os.File, int64, error) {
+	spoolDir := config.GetCacheBasePath().Join(fs.MustRelPath(string(PackType) + "/fetch"))
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), spoolDir.CoerceRelative(), 0700); err != nil {
+		return nil, 0, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	file, err := ioutil.TempFile(spoolDir.String(), wareID.Hash+".")
+	if err != nil {
+		return nil, 0, Errorf(rio.ErrLocalCacheProblem, "cannot open spool file for fetch: %s", err)
+	}
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		if ctx.Err() != nil {
+			return nil, 0, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if _, ok := err.(Error); ok {
+			return nil, 0, err
+		}
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "fetch of ware %s broke: %s", wareID, err)
+	}
+	return file, size, nil
+}
+
+func unpackISO(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	image io.ReaderAt,
+	size int64,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	img, root, err := openImage(image, size)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
+	// we keep a second, separate one for the filtered data, which will compute a different hash.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Report bytes written as we go.  How much there is to write isn't known
+	//  without walking the tree twice; the image's size is near enough.
+	prog := progress.New(mon, "unpack", size)
+
+	// Walk the image, mutating filesystem as we go.  Parents always come before
+	//  their contents, so there's nothing to infer (except, if there's no
+	//  Rock Ridge, the root's mtime is whatever the image says).
+	if err := img.walk(root, func(fmeta fs.Metadata, extents []extent) error {
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Apply filters.
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt, &filteredFmeta)
+
+		// Place the file.
+		var body io.Reader
+		var hashing *util.HashingReader
+		if fmeta.Type == fs.Type_File {
+			r, _, err := img.body(extents)
+			if err != nil {
+				return err
+			}
+			hashing = &util.HashingReader{r, hasher.New()}
+			body = hashing
+		}
+		if err := fsOp.PlaceFileWithPolicy(afs, filteredFmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		if hashing != nil {
+			prefilterBucket.AddRecord(fmeta, hashing.Hasher.Sum(nil))
+			filteredBucket.AddRecord(filteredFmeta, hashing.Hasher.Sum(nil))
+			prog.Add(fmeta.Size, fmeta.Name)
+		} else {
+			prefilterBucket.AddRecord(fmeta, nil)
+			filteredBucket.AddRecord(filteredFmeta, nil)
+		}
+		return nil
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
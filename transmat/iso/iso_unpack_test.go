@@ -0,0 +1,279 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package isotrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	// When every record in a test image was recorded; and the mtime Rock Ridge gives instead, where it's used.
+	recorded = []byte{118, 1, 2, 3, 4, 5, 0}
+	rrStamp  = []byte{118, 6, 7, 8, 9, 10, 0}
+	rrMtime  = time.Date(2018, 6, 7, 8, 9, 10, 0, time.UTC)
+)
+
+// A file (with a body) or dir (with children) for makeISO.  su is its System Use area: where Rock Ridge goes.
+type isoEntry struct {
+	ident    string
+	su       []byte
+	dir      bool
+	children []isoEntry
+	body     []byte
+	split    bool // Write the body one sector per extent, as a multi-extent file.
+}
+
+// An image of the given root: volume descriptors, then each dir in one sector, followed by its files' bodies.
+func makeISO(root isoEntry) []byte {
+	img := make([]byte, 18*sectorSize)
+	copy(img[16*sectorSize:], append([]byte{descriptorPrimary}, "CD001\x01"...))
+	copy(img[17*sectorSize:], append([]byte{descriptorTerminator}, "CD001\x01"...))
+	alloc := func(data []byte) uint32 {
+		lba := uint32(len(img) / sectorSize)
+		img = append(img, make([]byte, (len(data)+sectorSize-1)/sectorSize*sectorSize)...)
+		copy(img[lba*sectorSize:], data)
+		return lba
+	}
+	var writeDir func(dir isoEntry, selfSU []byte) uint32
+	writeDir = func(dir isoEntry, selfSU []byte) uint32 {
+		lba := alloc(make([]byte, sectorSize))
+		recs := append(isoRecord("\x00", lba, sectorSize, flagDir, selfSU), isoRecord("\x01", lba, sectorSize, flagDir, nil)...)
+		for _, child := range dir.children {
+			if child.dir {
+				recs = append(recs, isoRecord(child.ident, writeDir(child, nil), sectorSize, flagDir, child.su)...)
+				continue
+			}
+			chunks := [][]byte{child.body}
+			if child.split {
+				chunks = nil
+				for body := child.body; len(body) > 0; {
+					n := len(body)
+					if n > sectorSize {
+						n = sectorSize
+					}
+					chunks, body = append(chunks, body[:n]), body[n:]
+				}
+			}
+			for i, chunk := range chunks {
+				flags, su := byte(0), child.su
+				if i < len(chunks)-1 {
+					flags = flagNotFinal
+				}
+				if i > 0 {
+					su = nil
+				}
+				recs = append(recs, isoRecord(child.ident, alloc(chunk), uint32(len(chunk)), flags, su)...)
+			}
+		}
+		copy(img[lba*sectorSize:], recs)
+		return lba
+	}
+	rootLBA := writeDir(root, root.su)
+	copy(img[16*sectorSize+156:], isoRecord("\x00", rootLBA, sectorSize, flagDir, nil))
+	return img
+}
+
+func isoRecord(ident string, lba, size uint32, flags byte, su []byte) []byte {
+	suStart := 33 + len(ident) + (1 - len(ident)%2)
+	b := make([]byte, (suStart+len(su)+1)/2*2)
+	b[0] = byte(len(b))
+	binary.LittleEndian.PutUint32(b[2:], lba)
+	binary.BigEndian.PutUint32(b[6:], lba)
+	binary.LittleEndian.PutUint32(b[10:], size)
+	binary.BigEndian.PutUint32(b[14:], size)
+	copy(b[18:25], recorded)
+	b[25] = flags
+	b[32] = byte(len(ident))
+	copy(b[33:], ident)
+	copy(b[suStart:], su)
+	return b
+}
+
+// SUSP and Rock Ridge entries.
+func suEntry(sig string, body ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(body)), 1}, body...)
+}
+func bothEndian(v uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+	return b
+}
+func rr(mode, uid uint32, name string) []byte {
+	px := bytes.Join([][]byte{bothEndian(mode), bothEndian(1), bothEndian(uid), bothEndian(uid)}, nil)
+	su := append(suEntry("PX", px...), suEntry("TF", append([]byte{0x02}, rrStamp...)...)...)
+	if name != "" {
+		su = append(su, suEntry("NM", append([]byte{0}, name...)...)...)
+	}
+	return su
+}
+func symlink(name string, components ...string) []byte {
+	var sl []byte
+	for _, c := range components {
+		switch c {
+		case "/":
+			sl = append(sl, 0x08, 0)
+		case "..":
+			sl = append(sl, 0x04, 0)
+		default:
+			sl = append(append(sl, 0, byte(len(c))), c...)
+		}
+	}
+	return append(rr(0120777, 0, name), suEntry("SL", append([]byte{0}, sl...)...)...)
+}
+
+func TestISOUnpack(t *testing.T) {
+	Convey("ISO transmat: unpacking images", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/image.iso", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				scanThenUnpack := func(img []byte) api.WareID {
+					So(ioutil.WriteFile(tmpDir.String()+"/image.iso", img, 0644), ShouldBeNil)
+					wareID, err := Scan(context.Background(), PackType, api.Filter_NoMutation, "", addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID.Type, ShouldEqual, PackType)
+					wareID2, err := unpack(wareID)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					return wareID
+				}
+				placed := func() (names []string) {
+					filepath.Walk(tmpDir.String()+"/out", func(path string, _ os.FileInfo, _ error) error {
+						rel, _ := filepath.Rel(tmpDir.String()+"/out", path)
+						names = append(names, rel)
+						return nil
+					})
+					return
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				rockRidge := isoEntry{dir: true, su: append(suEntry("SP", 0xbe, 0xef, 0), rr(040755, 0, "")...), children: []isoEntry{
+					{ident: "ABS.;1", su: symlink("abs", "/", "usr", "lib")},
+					{ident: "A.;1", su: rr(0100644, 1000, "a"), body: []byte("hello")},
+					{ident: "BIN", dir: true, su: rr(040750, 0, "bin"), children: []isoEntry{
+						{ident: "LINK.;1", su: symlink("link", "..", "a")},
+						{ident: "TOOL.;1", su: rr(0104755, 0, "tool"), body: []byte("#!/bin/sh\n")},
+					}},
+				}}
+				plain := isoEntry{dir: true, children: []isoEntry{
+					{ident: "DIR", dir: true, children: []isoEntry{
+						{ident: "BIG.BIN;1", body: bytes.Repeat([]byte("0123456789"), 300), split: true},
+					}},
+					{ident: "NOEXT.;1"},
+					{ident: "README.TXT;1", body: []byte("read me")},
+				}}
+
+				Convey("an image with Rock Ridge should scan, then unpack by the scanned WareID, as Rock Ridge says", func() {
+					wareID := scanThenUnpack(makeISO(rockRidge))
+					So(placed(), ShouldResemble, []string{".", "a", "abs", "bin", "bin/link", "bin/tool"})
+					fi, err := os.Lstat(tmpDir.String() + "/out/bin/tool")
+					So(err, ShouldBeNil)
+					So(fi.Mode()&(os.ModePerm|os.ModeSetuid), ShouldEqual, os.ModeSetuid|0755)
+					So(fi.ModTime().UTC(), ShouldResemble, rrMtime)
+					fi, err = os.Lstat(tmpDir.String() + "/out/bin")
+					So(err, ShouldBeNil)
+					So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0750))
+					target, err := os.Readlink(tmpDir.String() + "/out/bin/link")
+					So(err, ShouldBeNil)
+					So(target, ShouldEqual, "../a")
+					target, err = os.Readlink(tmpDir.String() + "/out/abs")
+					So(err, ShouldBeNil)
+					So(target, ShouldEqual, "/usr/lib")
+
+					Convey("and its hash should be the same fileset's, as a tar", func() {
+						var buf bytes.Buffer
+						tw := tar.NewWriter(&buf)
+						bodies := map[string]string{"a": "hello", "bin/tool": "#!/bin/sh\n"}
+						for _, hdr := range []tar.Header{
+							{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+							{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000},
+							{Name: "abs", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "/usr/lib"},
+							{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0750},
+							{Name: "bin/link", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "../a"},
+							{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755},
+						} {
+							hdr.ModTime, hdr.Size = rrMtime, int64(len(bodies[hdr.Name]))
+							So(tw.WriteHeader(&hdr), ShouldBeNil)
+							tw.Write([]byte(bodies[hdr.Name]))
+						}
+						So(tw.Close(), ShouldBeNil)
+						So(ioutil.WriteFile(tmpDir.String()+"/same.tar", buf.Bytes(), 0644), ShouldBeNil)
+						tarWareID, err := tartrans.Scan(context.Background(), tartrans.PackType, api.Filter_NoMutation, rio.Placement_Direct, api.WarehouseAddr(fmt.Sprintf("file://%s/same.tar", tmpDir)), rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(tarWareID.Hash, ShouldEqual, wareID.Hash)
+					})
+				})
+				Convey("an image without Rock Ridge should unpack with plain names and default perms", func() {
+					scanThenUnpack(makeISO(plain))
+					So(placed(), ShouldResemble, []string{".", "DIR", "DIR/BIG.BIN", "NOEXT", "README.TXT"})
+					fi, err := os.Lstat(tmpDir.String() + "/out/README.TXT")
+					So(err, ShouldBeNil)
+					So(fi.Mode(), ShouldEqual, os.FileMode(0644))
+					So(fi.ModTime().UTC(), ShouldResemble, time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC))
+					fi, err = os.Lstat(tmpDir.String() + "/out/DIR")
+					So(err, ShouldBeNil)
+					So(fi.Mode(), ShouldEqual, os.ModeDir|0755)
+
+					Convey("and a file of several extents should be read whole", func() {
+						body, err := ioutil.ReadFile(tmpDir.String() + "/out/DIR/BIG.BIN")
+						So(err, ShouldBeNil)
+						So(string(body), ShouldEqual, string(bytes.Repeat([]byte("0123456789"), 300)))
+					})
+				})
+				Convey("the wrong WareID should be a hash mismatch", func() {
+					So(ioutil.WriteFile(tmpDir.String()+"/image.iso", makeISO(plain), 0644), ShouldBeNil)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("something that isn't an image should be corruption", func() {
+					So(ioutil.WriteFile(tmpDir.String()+"/image.iso", bytes.Repeat([]byte("not an iso"), 4000), 0644), ShouldBeNil)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("an image cut short should be corruption", func() {
+					img := makeISO(plain)
+					So(ioutil.WriteFile(tmpDir.String()+"/image.iso", img[:len(img)-sectorSize], 0644), ShouldBeNil)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("packing should be refused", func() {
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
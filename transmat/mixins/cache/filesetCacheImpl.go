@@ -7,30 +7,78 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/util"
 	cacheapi "go.polydawn.net/rio/cache"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/lib/guid"
 	"go.polydawn.net/rio/stitch/placer"
+	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/log"
 )
 
 var ShelfFor = cacheapi.ShelfFor
 
 func Lrn2Cache(cacheFs fs.FS, unpackTool rio.UnpackFunc) rio.UnpackFunc {
-	return cache{cacheFs, unpackTool}.Unpack
+	return cache{cacheFs, unpackTool, nil}.Unpack
 }
 
+/*
+	Lrn2Cache, plus a check that the cache has room for a ware before
+	unpacking it there.  `sizeOf` says how many bytes the ware needs at
+	least, if it can tell; if it can't, the check is skipped.
+*/
+func Lrn2CacheSized(cacheFs fs.FS, unpackTool rio.UnpackFunc, sizeOf SizeFunc) rio.UnpackFunc {
+	return cache{cacheFs, unpackTool, sizeOf}.Unpack
+}
+
+/*
+	As Lrn2Cache, but the func returned also hands back the placement's
+	Janitor, so the caller can undo it (unmount a mount; remove a copy)
+	when done with it.
+*/
+func Lrn2CachePlacing(cacheFs fs.FS, unpackTool rio.UnpackFunc) PlacingUnpackFunc {
+	return cache{cacheFs, unpackTool, nil}.UnpackPlacing
+}
+
+/*
+	An UnpackFunc that also returns the Janitor for whatever it placed.
+	The Janitor is nil if the cache placed nothing itself: for placement
+	"none", and for a "direct" unpack, which the unpack tool does straight
+	to the path.
+*/
+type PlacingUnpackFunc func(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, placer.Janitor, error)
+
+/*
+	Returns a lower bound on the space unpacking the ware will need, or
+	false if there's no telling.  It shouldn't take long: it's an estimate
+	for a pre-flight check, not a fetch.
+*/
+type SizeFunc func(ctx context.Context, wareID api.WareID, warehouses []api.WarehouseAddr) (size int64, known bool)
+
 type cache struct {
 	fs         fs.FS
 	unpackTool rio.UnpackFunc
+	sizeOf     SizeFunc // optional.
 }
 
 /*
@@ -41,6 +89,11 @@ type cache struct {
 
 	Any behaviors specified by the placementMode -- copying, mounting, etc -- are enacted
 	by this func after the unpack finishes and the temp path committed to the cache.
+	Except "direct": that goes straight to the unpack tool, to unpack at the path,
+	and the cache is neither read nor filled.  (Placing from a shelf directly
+	would mean handing out the shelf itself, and shelves are read-only.)
+	Whatever's placed stays placed: there's no returning a Janitor from an
+	UnpackFunc.  (UnpackPlacing does.)
 */
 func (c cache) Unpack(
 	ctx context.Context,
@@ -50,101 +103,196 @@ func (c cache) Unpack(
 	placementMode rio.PlacementMode,
 	warehouses []api.WarehouseAddr,
 	monitor rio.Monitor,
-) (_ api.WareID, err error) {
+) (api.WareID, error) {
+	resultWareID, _, err := c.UnpackPlacing(ctx, wareID, path, filt, placementMode, warehouses, monitor)
+	return resultWareID, err
+}
+
+/*
+	As Unpack, but also returns the Janitor for the placement; see PlacingUnpackFunc.
+*/
+func (c cache) UnpackPlacing(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (_ api.WareID, _ placer.Janitor, err error) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
 	// Zeroth thing: caches are by hash, but remember that filters can give you a
 	//  result hash which is different than the requested ware hash.
 	//  Right now we deal with this simply/stupidly: if you used filters, no cache for you.
+	//  (The same goes for id remapping, perms masks, and xattr filters from config, which are filters by another name.
+	//  Any xattr config at all means no cache: what's on the shelf was placed without them.)
 	resultWareID := wareID
-	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	host, err := filters.HostFiltersFromConfig()
 	if err != nil {
-		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+		return api.WareID{}, nil, err
 	}
-	if filt2.IsHashAltering() {
+	if filt2.IsHashAltering() || host.IsHashAltering() || host.Xattrs.Enabled {
 		resultWareID = api.WareID{"-", "-"} // This value forces cache miss.
 	}
 
-	// First thing: Check if we already have the ware in cache and can jump to placement ASAP.
-	//  (This must be first because we're willing to read cache even in "direct" mode, but
-	//  yet *not* willing to even initialize empty cache dirs in that mode.)
+	// Shelves are read-only once committed: every placement copies or mounts
+	//  *from* them.  A destination inside the cache would scribble on the
+	//  shelves themselves (or on the shelf we were just asked to read), so refuse.
+	//  (Direct mode too: it doesn't read shelves, but it could still land on one.)
+	cacheBase := c.fs.BasePath().String()
+	if placementMode != rio.Placement_None && (path == cacheBase || strings.HasPrefix(path, strings.TrimSuffix(cacheBase, "/")+"/")) {
+		return api.WareID{}, nil, Errorf(rio.ErrUsage, "cannot place %q: destination is inside the cache (%s)", path, cacheBase)
+	}
+
+	// In direct mode: be direct.  Do nothing to cache, and don't place from it either:
+	//  shelves are read-only, and direct would mean handing one out.
+	if placementMode == rio.Placement_Direct {
+		resultWareID, err := c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
+		return resultWareID, nil, err
+	}
+
+	// Check if we already have the ware in cache and can jump to placement ASAP.
 	shelf := ShelfFor(resultWareID)
 	_, err = c.fs.Stat(shelf)
 	switch Category(err) {
 	case fs.ErrNotExists: // "not exists" is just a cache miss...
-		switch placementMode {
-		case rio.Placement_Direct: // In direct mode: be direct.  Do nothing to cache.
-			return c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
-		default: // Everyone else: unpack into cache.
-			// pass
-		}
-		// Unpack into the cache.
-		resultWareID, shelf, err = c.populate(ctx, wareID, filt, warehouses, monitor)
+		// Unpack into the cache.  (Or, if somebody beat us to it, use theirs.)
+		resultWareID, shelf, unlock, err := c.populateOnce(ctx, resultWareID, wareID, filt, warehouses, monitor)
 		if err != nil {
-			return resultWareID, err
+			return resultWareID, nil, err
 		}
-		// Now place it from the cache shelf.
-		return resultWareID, c.place(ctx, placementMode, shelf, path)
+		defer unlock()
+		// Now place it from the cache shelf.  (Still locked, so Sweep leaves it be.)
+		janitor, err := c.place(ctx, placementMode, shelf, path, monitor)
+		return resultWareID, janitor, err
 	case nil: // Cache has it!  Reaction varies.
 		log.CacheHasIt(monitor, wareID)
-		return resultWareID, c.place(ctx, placementMode, shelf, path)
-	default:
-		// Unknown errors reading cache are mostly considered game over.  Except:
-		//  Since direct mode has no responsibility to the cache, it can still go.
-		switch placementMode {
-		case rio.Placement_Direct:
-			return c.unpackTool(ctx, wareID, path, filt, rio.Placement_Direct, warehouses, monitor)
-		default:
-			return api.WareID{}, Errorf(rio.ErrLocalCacheProblem, "error reading cache: %s", err)
+		// Hold the lock shared while placing, so Sweep leaves the shelf be.
+		//  If it was swept between our look and our lock, it's a miss after all.
+		unlock, err := c.lockShared(ctx, resultWareID, monitor)
+		if err != nil {
+			return api.WareID{}, nil, err
 		}
+		if _, err := c.fs.Stat(shelf); err == nil {
+			defer unlock()
+			janitor, err := c.place(ctx, placementMode, shelf, path, monitor)
+			return resultWareID, janitor, err
+		}
+		unlock()
+		return c.UnpackPlacing(ctx, wareID, path, filt, placementMode, warehouses, monitor)
+	default:
+		// Unknown errors reading cache are game over.  (Direct mode never got this far.)
+		return api.WareID{}, nil, Errorf(rio.ErrLocalCacheProblem, "error reading cache: %s", err)
 	}
 }
 
+/*
+	Place the shelf at the destination, as placementMode says, and return
+	the placement's Janitor (nil for placement "none").  Never called for
+	"direct"; UnpackPlacing doesn't use the cache for that.
+*/
 func (c cache) place(
 	ctx context.Context,
 	placementMode rio.PlacementMode,
 	shelf fs.RelPath,
 	destination string, // still a string at this phase because it's either abs or "-"
-) error {
+	monitor rio.Monitor,
+) (placer.Janitor, error) {
 	absShelf := c.fs.BasePath().Join(shelf)
+	if placementMode == rio.Placement_None { // If no placement, cache having it is victory!
+		return nil, nil
+	}
 	switch placementMode {
-	case rio.Placement_None: // If no placement, cache having it is victory!
-		return nil
-	case rio.Placement_Direct: // In direct mode, copy.
-		_, err := placer.CopyPlacer(absShelf, fs.MustAbsolutePath(destination), true)
-		return err
 	case rio.Placement_Copy: // In copy mode, ... well obviously copy.
-		_, err := placer.CopyPlacer(absShelf, fs.MustAbsolutePath(destination), true)
-		return err
+		return placer.CopyPlacerWithMonitor(monitor)(absShelf, fs.MustAbsolutePath(destination), true)
 	case rio.Placement_Mount: // In mount mode, mount.
 		placerFn, err := placer.GetMountPlacer()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		_, err = placerFn(absShelf, fs.MustAbsolutePath(destination), true)
-		return err
+		return placerFn(absShelf, fs.MustAbsolutePath(destination), true)
 	default:
 		panic("unreachable")
 	}
 }
 
+/*
+	Populate the cache with the ware, holding its lock while we do.
+
+	Whoever gets the lock first does the unpack; anyone who waited for it
+	then finds the shelf already there (if the first succeeded), and is
+	done without delegating at all.  `shelfWareID` is what the caller
+	would look for on the shelf -- the forced-miss value, if filters are
+	in play, in which case everyone does their own unpack, one at a time.
+
+	On success, the shelf is still locked (see populate), so it can be
+	placed from before Sweep gets a look at it; call `unlock` after.
+*/
+func (c cache) populateOnce(
+	ctx context.Context,
+	shelfWareID api.WareID,
+	wareID api.WareID,
+	filt api.FilesetFilters,
+	warehouses []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (_ api.WareID, _ fs.RelPath, unlock func(), err error) {
+	unlockWare, err := c.lock(ctx, wareID, monitor)
+	if err != nil {
+		return api.WareID{}, fs.RelPath{}, nil, err
+	}
+	// Unlock on the way out -- including by panic -- unless handing it over.
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			unlockWare()
+		}
+	}()
+
+	shelf := ShelfFor(shelfWareID)
+	if _, err := c.fs.Stat(shelf); err == nil {
+		log.CacheHasIt(monitor, wareID)
+		handedOver = true
+		return shelfWareID, shelf, unlockWare, nil
+	}
+	resultWareID, shelf, release, err := c.populate(ctx, wareID, filt, warehouses, monitor)
+	if err != nil {
+		return resultWareID, shelf, nil, err
+	}
+	handedOver = true
+	return resultWareID, shelf, func() { release(); unlockWare() }, nil
+}
+
 func (c cache) populate(
 	ctx context.Context,
 	wareID api.WareID,
 	filt api.FilesetFilters,
 	warehouses []api.WarehouseAddr,
 	monitor rio.Monitor,
-) (_ api.WareID, _ fs.RelPath, err error) {
+) (_ api.WareID, _ fs.RelPath, release func(), err error) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
 	// Initialize cache.
 	//  Ensure the cache commit root dir exists.
 	//  Also ensure the cache parent dir exists... no bound on recursion.
 	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), c.fs.BasePath().CoerceRelative(), 0700); err != nil {
-		return api.WareID{}, fs.RelPath{}, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+		return api.WareID{}, fs.RelPath{}, nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
 	}
 	if err := fsOp.MkdirAll(c.fs, fs.MustRelPath(string(wareID.Type)+"/fileset"), 0700); err != nil {
-		return api.WareID{}, fs.RelPath{}, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+		return api.WareID{}, fs.RelPath{}, nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+
+	// If we can tell the ware won't fit, say so now, rather than fill the disk first.
+	if c.sizeOf != nil {
+		if size, known := c.sizeOf(ctx, wareID, warehouses); known {
+			if err := c.checkSpace(wareID, size); err != nil {
+				return api.WareID{}, fs.RelPath{}, nil, err
+			}
+		}
 	}
 
 	// Pick a temp path to unpack into.
@@ -152,11 +300,29 @@ func (c cache) populate(
 	tmpPathStr := c.fs.BasePath().Join(tmpPath).String()
 	// Defer cleanup of the temp path.
 	//  (If we're successful, we'll have moved it out of this path before return.)
-	defer os.RemoveAll(tmpPathStr)
+	//  This covers failed and cancelled unpacks alike: either way the delegate
+	//  returns an error, and whatever it left half-written goes.
+	//  A cleanup failure is only logged; the unpack's own error is the one to report.
+	defer func() {
+		if err := fsOp.RemoveAll(c.fs, tmpPath); err != nil {
+			log.CacheTempCleanupFailed(monitor, c.fs.BasePath().Join(tmpPath), err)
+		}
+	}()
 	// Delegate!
 	resultWareID, err := c.unpackTool(ctx, wareID, tmpPathStr, filt, rio.Placement_Direct, warehouses, monitor)
 	if err != nil {
-		return resultWareID, fs.RelPath{}, err
+		return resultWareID, fs.RelPath{}, nil, err
+	}
+
+	// The caller holds the lock for `wareID`, which covers the shelf if that's
+	//  where it goes.  If filters sent it elsewhere, lock that too (shared:
+	//  others may be placing from it), so it's not swept before it's placed.
+	release = func() {}
+	if resultWareID != wareID {
+		release, err = c.lockShared(ctx, resultWareID, monitor)
+		if err != nil {
+			return resultWareID, fs.RelPath{}, nil, err
+		}
 	}
 
 	// Successful unpack: commit it to its shelf location.
@@ -164,15 +330,140 @@ func (c cache) populate(
 	//  In case of race: accept our fate, assume the racing party acted in good faith,
 	//  return the shelf path anyway, and our defer'd rm will act on our wasted copy.
 	shelf := ShelfFor(resultWareID)
-	c.fs.Mkdir(shelf.Dir().Dir(), 0755)
-	c.fs.Mkdir(shelf.Dir(), 0755)
-	if err := os.Rename(tmpPathStr, c.fs.BasePath().Join(shelf).String()); err != nil {
-		if _, ok := err.(*os.LinkError); ok && os.IsExist(err) {
-			// Oh, fine.  Somebody raced us to it.
-			return resultWareID, shelf, nil
+	if err := fsOp.MkdirAll(c.fs, shelf.Dir(), 0755); err != nil {
+		release()
+		return resultWareID, shelf, nil, Errorf(rio.ErrLocalCacheProblem, "error commiting %q into cache: %s", resultWareID, err)
+	}
+	if err := c.commit(tmpPath, shelf); err != nil {
+		release()
+		return resultWareID, shelf, nil, Errorf(rio.ErrLocalCacheProblem, "error commiting %q into cache: %s", resultWareID, err)
+	}
+	return resultWareID, shelf, release, nil
+}
+
+/*
+	Return ErrLocalCacheProblem if the cache filesystem has less than
+	`size` bytes available.  If the filesystem can't say, that's no error:
+	the check is best-effort, and the unpack may as well try.
+*/
+func (c cache) checkSpace(wareID api.WareID, size int64) error {
+	st, err := c.fs.Statfs(fs.RelPath{})
+	if err != nil {
+		return nil
+	}
+	if size > 0 && uint64(size) > st.Available {
+		return ErrorDetailed(
+			rio.ErrLocalCacheProblem,
+			fmt.Sprintf("not enough space in cache for %q: it needs at least %d bytes, but %s has %d available", wareID, size, c.fs.BasePath(), st.Available),
+			map[string]string{
+				"needed":    strconv.FormatInt(size, 10),
+				"available": strconv.FormatUint(st.Available, 10),
+			},
+		)
+	}
+	return nil
+}
+
+// Swappable for tests, since a real EXDEV needs two filesystems.
+var rename = os.Rename
+
+// Swappable for tests, so they can see what gets synced, and in what order.
+var syncPath = func(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+/*
+	Move a finished unpack from its temp path onto its shelf.
+
+	Normally this is just a rename.  If the shelf is on another device than
+	the temp path (some part of the cache is a separate mount), we copy to a
+	second temp path beside the shelf and rename that instead, so the shelf
+	still only ever appears complete.
+
+	If config asks for it (see config.GetCacheSync), whatever's about to be
+	renamed is synced first, so the shelf can't appear with content that's
+	not on disk; and the shelf's parent dirs are synced after, so the
+	rename itself survives a crash.
+
+	An existing shelf means somebody raced us to it; that's success.
+	Cleaning up the temp path (either way) is the caller's job.
+*/
+func (c cache) commit(tmpPath, shelf fs.RelPath) error {
+	durable, err := config.GetCacheSync()
+	if err != nil {
+		return err
+	}
+	absShelf := c.fs.BasePath().Join(shelf)
+	if durable {
+		if err := c.syncTree(tmpPath); err != nil {
+			return err
 		}
-		// Any other error: sad.
-		return resultWareID, shelf, Errorf(rio.ErrLocalCacheProblem, "error commiting %q into cache: %s", resultWareID, err)
 	}
-	return resultWareID, shelf, nil
+	err = rename(c.fs.BasePath().Join(tmpPath).String(), absShelf.String())
+	if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+		nearPath := shelf.Dir().Join(fs.MustRelPath(".tmp.commit." + guid.New()))
+		defer fsOp.RemoveAll(c.fs, nearPath)
+		if _, err := placer.CopyPlacer(c.fs.BasePath().Join(tmpPath), c.fs.BasePath().Join(nearPath), true); err != nil {
+			return err
+		}
+		if durable {
+			if err := c.syncTree(nearPath); err != nil {
+				return err
+			}
+		}
+		err = rename(c.fs.BasePath().Join(nearPath).String(), absShelf.String())
+	}
+	if _, ok := err.(*os.LinkError); ok && os.IsExist(err) {
+		// Oh, fine.  Somebody raced us to it.
+		return nil
+	}
+	if err != nil || !durable {
+		return err
+	}
+	// The rename is an entry in the shelf's parent; and that parent (and
+	//  its parents) may have only just been made, too.  Sync up to the cache root.
+	for dir := shelf.Dir(); ; dir = dir.Dir() {
+		if err := syncPath(c.fs.BasePath().Join(dir).String()); err != nil {
+			return err
+		}
+		if dir == (fs.RelPath{}) {
+			return nil
+		}
+	}
+}
+
+/*
+	Sync every file and dir under `path`, and then `path` itself:
+	children before their dirs, so when a dir is synced, its entries are
+	for content that's already on disk.  Other kinds of file have no
+	content to sync, and are skipped (and opening them could block, or
+	follow a symlink).
+*/
+func (c cache) syncTree(path fs.RelPath) error {
+	fmeta, err := c.fs.LStat(path)
+	if err != nil {
+		return err
+	}
+	switch fmeta.Type {
+	case fs.Type_Dir:
+		children, err := c.fs.ReadDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := c.syncTree(path.Join(fs.MustRelPath(child))); err != nil {
+				return err
+			}
+		}
+	case fs.Type_File:
+		// pass
+	default:
+		return nil
+	}
+	return syncPath(c.fs.BasePath().Join(path).String())
 }
@@ -0,0 +1,447 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/guid"
+	"go.polydawn.net/rio/testutil"
+)
+
+/*
+	An UnpackFunc that counts its calls and "unpacks" an empty dir,
+	claiming whatever wareID it was asked for.
+	If `fail` is set, it leaves some junk behind and then returns that error.
+	If `delay` is set, it takes that long, so concurrent callers overlap.
+*/
+type recordingUnpack struct {
+	mu    sync.Mutex
+	calls []string // paths, one per call
+	fail  error
+	delay time.Duration
+}
+
+func (r *recordingUnpack) Unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, path)
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return api.WareID{}, err
+	}
+	if r.fail != nil {
+		os.Mkdir(filepath.Join(path, "partial"), 0755)
+		return api.WareID{}, r.fail
+	}
+	return wareID, nil
+}
+
+func TestCache(t *testing.T) {
+	Convey("Fileset cache:", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				cacheFs := osfs.New(tmpDir.Join(fs.MustRelPath("cache")))
+				rec := &recordingUnpack{}
+				unpack := Lrn2Cache(cacheFs, rec.Unpack)
+				wareID := api.WareID{"tar", "fakefakefake"}
+
+				Convey("Unpacking the same ware twice should only delegate once", func() {
+					for _, dest := range []string{"dest1", "dest2"} {
+						gotWareID, err := unpack(
+							context.Background(),
+							wareID,
+							tmpDir.Join(fs.MustRelPath(dest)).String(),
+							api.Filter_NoMutation,
+							rio.Placement_Copy,
+							nil,
+							rio.Monitor{},
+						)
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID)
+						So(testutil.ShouldStat(osfs.New(tmpDir), fs.MustRelPath(dest)).Type, ShouldEqual, fs.Type_Dir)
+					}
+					So(rec.calls, ShouldHaveLength, 1)
+					So(testutil.ShouldStat(cacheFs, ShelfFor(wareID)).Type, ShouldEqual, fs.Type_Dir)
+				})
+				Convey("Concurrent unpacks of the same ware should only delegate once", func() {
+					rec.delay = 100 * time.Millisecond
+					errs := make(chan error)
+					for i := 0; i < 4; i++ {
+						go func(dest string) {
+							gotWareID, err := unpack(
+								context.Background(),
+								wareID,
+								tmpDir.Join(fs.MustRelPath(dest)).String(),
+								api.Filter_NoMutation,
+								rio.Placement_Copy,
+								nil,
+								rio.Monitor{},
+							)
+							if err == nil && gotWareID != wareID {
+								err = Errorf(rio.ErrWareHashMismatch, "got %s", gotWareID)
+							}
+							errs <- err
+						}(fmt.Sprintf("dest%d", i))
+					}
+					for i := 0; i < 4; i++ {
+						So(<-errs, ShouldBeNil)
+					}
+					So(rec.calls, ShouldHaveLength, 1)
+					for i := 0; i < 4; i++ {
+						So(testutil.ShouldStat(osfs.New(tmpDir), fs.MustRelPath(fmt.Sprintf("dest%d", i))).Type, ShouldEqual, fs.Type_Dir)
+					}
+				})
+				Convey("Waiting on the lock should stop if cancelled, and release it either way", func() {
+					unlock, err := cache{cacheFs, rec.Unpack, nil}.lock(context.Background(), wareID, rio.Monitor{})
+					So(err, ShouldBeNil)
+					ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+					defer cancel()
+					_, err = unpack(ctx, wareID, tmpDir.Join(fs.MustRelPath("dest")).String(), api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+					So(err, ErrorShouldHaveCategory, rio.ErrCancelled)
+					So(rec.calls, ShouldHaveLength, 0)
+					unlock()
+
+					// Even a panicking delegate shouldn't leave the lock held.
+					So(func() {
+						Lrn2Cache(cacheFs, func(context.Context, api.WareID, string, api.FilesetFilters, rio.PlacementMode, []api.WarehouseAddr, rio.Monitor) (api.WareID, error) {
+							panic("boom")
+						})(context.Background(), wareID, tmpDir.Join(fs.MustRelPath("dest")).String(), api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+					}, ShouldPanic)
+					_, err = unpack(context.Background(), wareID, tmpDir.Join(fs.MustRelPath("dest")).String(), api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(rec.calls, ShouldHaveLength, 1)
+				})
+				Convey("A failed unpack should leave no temp dir behind", func() {
+					rec.fail = Errorf(rio.ErrWareCorrupt, "boom")
+					_, err := unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("dest")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Copy,
+						nil,
+						rio.Monitor{},
+					)
+					So(err, ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+					So(rec.calls, ShouldHaveLength, 1)
+					So(strings.HasPrefix(filepath.Base(rec.calls[0]), ".tmp.unpack."), ShouldBeTrue)
+					_, err = os.Lstat(rec.calls[0])
+					So(os.IsNotExist(err), ShouldBeTrue)
+					_, err = cacheFs.Stat(ShelfFor(wareID))
+					So(err, ErrorShouldHaveCategory, fs.ErrNotExists)
+				})
+				Convey("Committing across devices should fall back to copying", func() {
+					defer func() { rename = os.Rename }()
+					rename = func(oldpath, newpath string) error {
+						if strings.HasPrefix(filepath.Base(oldpath), ".tmp.unpack.") {
+							return &os.LinkError{"rename", oldpath, newpath, syscall.EXDEV}
+						}
+						return os.Rename(oldpath, newpath)
+					}
+					gotWareID, shelf, _, err := cache{cacheFs, rec.Unpack, nil}.populate(
+						context.Background(), wareID, api.Filter_NoMutation, nil, rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					So(shelf, ShouldResemble, ShelfFor(wareID))
+					So(testutil.ShouldStat(cacheFs, shelf).Type, ShouldEqual, fs.Type_Dir)
+					// Neither the unpack temp dir nor the copy's temp dir should remain.
+					_, err = os.Lstat(rec.calls[0])
+					So(os.IsNotExist(err), ShouldBeTrue)
+					siblings, err := cacheFs.ReadDirNames(shelf.Dir())
+					So(err, ShouldBeNil)
+					So(siblings, ShouldResemble, []string{filepath.Base(shelf.String())})
+				})
+				Convey("Committing with fsync on should sync the ware, then the rename", func() {
+					var synced []string
+					defer func(orig func(string) error) { syncPath = orig }(syncPath)
+					syncPath = func(path string) error {
+						synced = append(synced, strings.TrimPrefix(path, cacheFs.BasePath().String()))
+						return nil
+					}
+					populate := func() {
+						_, _, _, err := cache{cacheFs, func(ctx context.Context, wareID api.WareID, path string, filt api.FilesetFilters, placementMode rio.PlacementMode, warehouses []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+							if _, err := rec.Unpack(ctx, wareID, path, filt, placementMode, warehouses, mon); err != nil {
+								return api.WareID{}, err
+							}
+							return wareID, ioutil.WriteFile(filepath.Join(path, "a"), []byte("hello"), 0644)
+						}, nil}.populate(context.Background(), wareID, api.Filter_NoMutation, nil, rio.Monitor{})
+						So(err, ShouldBeNil)
+					}
+					Convey("when configured", func() {
+						defer os.Unsetenv("RIO_CACHE_SYNC")
+						os.Setenv("RIO_CACHE_SYNC", "fsync")
+						populate()
+						tmpPath := strings.TrimPrefix(rec.calls[0], cacheFs.BasePath().String())
+						So(synced, ShouldResemble, []string{
+							tmpPath + "/a",
+							tmpPath,
+							"/tar/fileset/fak/efa",
+							"/tar/fileset/fak",
+							"/tar/fileset",
+							"/tar",
+							"",
+						})
+					})
+					Convey("and not at all by default", func() {
+						populate()
+						So(synced, ShouldHaveLength, 0)
+					})
+				})
+				Convey("A ware that won't fit should fail before unpacking anything", func() {
+					sized := func(size int64, known bool) rio.UnpackFunc {
+						return Lrn2CacheSized(cacheFs, rec.Unpack, func(context.Context, api.WareID, []api.WarehouseAddr) (int64, bool) {
+							return size, known
+						})
+					}
+					dest := tmpDir.Join(fs.MustRelPath("dest")).String()
+					_, err := sized(1<<62, true)(context.Background(), wareID, dest, api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+					So(err, ErrorShouldHaveCategory, rio.ErrLocalCacheProblem)
+					So(Details(err)["needed"], ShouldEqual, "4611686018427387904")
+					So(rec.calls, ShouldHaveLength, 0)
+
+					// A size that fits, or no size at all, goes ahead.
+					_, err = sized(1, true)(context.Background(), wareID, dest, api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(rec.calls, ShouldHaveLength, 1)
+					_, err = sized(1<<62, false)(context.Background(), api.WareID{"tar", "otherfake"}, dest+"2", api.Filter_NoMutation, rio.Placement_Direct, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+				})
+				Convey("Losing a race to commit should still succeed", func() {
+					theirs := cacheFs.BasePath().Join(ShelfFor(wareID)).Join(fs.MustRelPath("theirs"))
+					So(fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), theirs.CoerceRelative(), 0755), ShouldBeNil)
+					_, shelf, _, err := cache{cacheFs, rec.Unpack, nil}.populate(
+						context.Background(), wareID, api.Filter_NoMutation, nil, rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(testutil.ShouldStat(cacheFs, shelf.Join(fs.MustRelPath("theirs"))).Type, ShouldEqual, fs.Type_Dir)
+					_, err = os.Lstat(rec.calls[0])
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("Given a pre-seeded shelf", func() {
+					absShelf := cacheFs.BasePath().Join(ShelfFor(wareID))
+					So(os.MkdirAll(absShelf.String(), 0755), ShouldBeNil)
+					So(ioutil.WriteFile(absShelf.Join(fs.MustRelPath("a")).String(), []byte("hello"), 0644), ShouldBeNil)
+					unpackTo := func(dest string, mode rio.PlacementMode) error {
+						_, err := unpack(context.Background(), wareID, dest, api.Filter_NoMutation, mode, nil, rio.Monitor{})
+						return err
+					}
+					shouldHaveSeed := func(dest fs.AbsolutePath) {
+						body, err := ioutil.ReadFile(dest.Join(fs.MustRelPath("a")).String())
+						So(err, ShouldBeNil)
+						So(string(body), ShouldEqual, "hello")
+					}
+					shelfShouldBeUntouched := func() {
+						names, err := cacheFs.ReadDirNames(ShelfFor(wareID))
+						So(err, ShouldBeNil)
+						So(names, ShouldResemble, []string{"a"})
+					}
+
+					Convey("placement 'none' should place nothing", func() {
+						So(unpackTo("-", rio.Placement_None), ShouldBeNil)
+						So(rec.calls, ShouldHaveLength, 0)
+					})
+					Convey("placement 'copy' should give an independent copy", func() {
+						dest := tmpDir.Join(fs.MustRelPath("dest"))
+						So(unpackTo(dest.String(), rio.Placement_Copy), ShouldBeNil)
+						shouldHaveSeed(dest)
+						So(ioutil.WriteFile(dest.Join(fs.MustRelPath("b")).String(), nil, 0644), ShouldBeNil)
+						shelfShouldBeUntouched()
+						So(rec.calls, ShouldHaveLength, 0)
+					})
+					Convey("placement 'direct' should unpack directly, leaving the shelf be", func() {
+						dest := tmpDir.Join(fs.MustRelPath("dest"))
+						So(unpackTo(dest.String(), rio.Placement_Direct), ShouldBeNil)
+						So(rec.calls, ShouldResemble, []string{dest.String()})
+						shelfShouldBeUntouched()
+					})
+					Convey("placement 'mount' should give a writable view, leaving the shelf untouched",
+						testutil.Requires(testutil.RequiresCanMountAny, func() {
+							dest := tmpDir.Join(fs.MustRelPath("dest"))
+							defer os.Setenv("RIO_MOUNT_WORKDIR", os.Getenv("RIO_MOUNT_WORKDIR"))
+							os.Setenv("RIO_MOUNT_WORKDIR", tmpDir.Join(fs.MustRelPath("wrk."+guid.New())).String())
+							So(unpackTo(dest.String(), rio.Placement_Mount), ShouldBeNil)
+							defer syscall.Unmount(dest.String(), 0)
+							shouldHaveSeed(dest)
+							So(ioutil.WriteFile(dest.Join(fs.MustRelPath("b")).String(), nil, 0644), ShouldBeNil)
+							shelfShouldBeUntouched()
+							So(rec.calls, ShouldHaveLength, 0)
+						}),
+					)
+					Convey("the placement's janitor should be handed back, and undo it", func() {
+						unpackPlacing := Lrn2CachePlacing(cacheFs, rec.Unpack)
+						Convey("for 'none', there's nothing to undo", func() {
+							_, janitor, err := unpackPlacing(context.Background(), wareID, "-", api.Filter_NoMutation, rio.Placement_None, nil, rio.Monitor{})
+							So(err, ShouldBeNil)
+							So(janitor, ShouldBeNil)
+						})
+						Convey("for 'copy', it removes the copy", func() {
+							dest := tmpDir.Join(fs.MustRelPath("dest"))
+							_, janitor, err := unpackPlacing(context.Background(), wareID, dest.String(), api.Filter_NoMutation, rio.Placement_Copy, nil, rio.Monitor{})
+							So(err, ShouldBeNil)
+							shouldHaveSeed(dest)
+							So(janitor.Teardown(), ShouldBeNil)
+							_, err = os.Lstat(dest.String())
+							So(os.IsNotExist(err), ShouldBeTrue)
+							shelfShouldBeUntouched()
+						})
+						Convey("for 'mount', it unmounts", testutil.Requires(testutil.RequiresCanMountAny, func() {
+							dest := tmpDir.Join(fs.MustRelPath("dest"))
+							defer os.Setenv("RIO_MOUNT_WORKDIR", os.Getenv("RIO_MOUNT_WORKDIR"))
+							os.Setenv("RIO_MOUNT_WORKDIR", tmpDir.Join(fs.MustRelPath("wrk."+guid.New())).String())
+							_, janitor, err := unpackPlacing(context.Background(), wareID, dest.String(), api.Filter_NoMutation, rio.Placement_Mount, nil, rio.Monitor{})
+							So(err, ShouldBeNil)
+							shouldHaveSeed(dest)
+							So(janitor.Teardown(), ShouldBeNil)
+							_, err = os.Lstat(dest.Join(fs.MustRelPath("a")).String())
+							So(os.IsNotExist(err), ShouldBeTrue)
+							shelfShouldBeUntouched()
+						}))
+					})
+					Convey("a destination inside the cache should be rejected", func() {
+						for _, mode := range []rio.PlacementMode{rio.Placement_Direct, rio.Placement_Copy, rio.Placement_Mount} {
+							So(unpackTo(absShelf.String(), mode), ErrorShouldHaveCategory, rio.ErrUsage)
+							So(unpackTo(cacheFs.BasePath().Join(fs.MustRelPath("elsewhere")).String(), mode), ErrorShouldHaveCategory, rio.ErrUsage)
+						}
+						shelfShouldBeUntouched()
+					})
+				})
+			})
+		}),
+	)
+}
+
+func TestSweep(t *testing.T) {
+	Convey("Sweeping the cache:", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				cacheFs := osfs.New(tmpDir.Join(fs.MustRelPath("cache")))
+				rec := &recordingUnpack{}
+				unpack := Lrn2Cache(cacheFs, rec.Unpack)
+				wareIDs := []api.WareID{
+					{"tar", "aaaaaaaaaaaa"},
+					{"tar", "bbbbbbbbbbbb"},
+					{"tar", "cccccccccccc"},
+					{"git", "dddddddddddd"},
+				}
+				for _, wareID := range wareIDs {
+					_, err := unpack(context.Background(), wareID, "-", api.Filter_NoMutation, rio.Placement_None, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+				}
+				shelves := func() []api.WareID {
+					var got []api.WareID
+					So(cache{fs: cacheFs}.eachShelf(func(wareID api.WareID, _ fs.RelPath) error {
+						got = append(got, wareID)
+						return nil
+					}), ShouldBeNil)
+					return got
+				}
+				So(shelves(), ShouldHaveLength, 4)
+
+				Convey("exactly the kept shelves should remain", func() {
+					So(Sweep(cacheFs, []api.WareID{wareIDs[1], wareIDs[3]}), ShouldBeNil)
+					So(shelves(), ShouldResemble, []api.WareID{wareIDs[3], wareIDs[1]})
+					// Nothing else in the cache dirs should have been touched.
+					testutil.ShouldStat(cacheFs, fs.MustRelPath("tar/lock"))
+				})
+				Convey("a shelf whose lock is held should be skipped", func() {
+					unlock, err := cache{fs: cacheFs}.lockShared(context.Background(), wareIDs[0], rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(Sweep(cacheFs, nil), ShouldBeNil)
+					So(shelves(), ShouldResemble, []api.WareID{wareIDs[0]})
+					unlock()
+					So(Sweep(cacheFs, nil), ShouldBeNil)
+					So(shelves(), ShouldHaveLength, 0)
+				})
+				Convey("a shelf that's mounted somewhere should be skipped", testutil.Requires(testutil.RequiresCanMountBind, func() {
+					target := tmpDir.Join(fs.MustRelPath("target"))
+					So(os.Mkdir(target.String(), 0755), ShouldBeNil)
+					So(syscall.Mount(cacheFs.BasePath().Join(ShelfFor(wareIDs[0])).String(), target.String(), "bind", syscall.MS_BIND, ""), ShouldBeNil)
+					So(Sweep(cacheFs, nil), ShouldBeNil)
+					So(shelves(), ShouldResemble, []api.WareID{wareIDs[0]})
+					So(syscall.Unmount(target.String(), 0), ShouldBeNil)
+					So(Sweep(cacheFs, nil), ShouldBeNil)
+					So(shelves(), ShouldHaveLength, 0)
+				}))
+				Convey("a symlink in a shelf should be removed, not followed", func() {
+					outside := tmpDir.Join(fs.MustRelPath("outside"))
+					So(os.Mkdir(outside.String(), 0755), ShouldBeNil)
+					So(ioutil.WriteFile(outside.String()+"/precious", []byte("x"), 0644), ShouldBeNil)
+					So(os.Symlink(outside.String(), cacheFs.BasePath().Join(ShelfFor(wareIDs[0])).String()+"/ln"), ShouldBeNil)
+					So(Sweep(cacheFs, nil), ShouldBeNil)
+					So(shelves(), ShouldHaveLength, 0)
+					_, err := os.Stat(outside.String() + "/precious")
+					So(err, ShouldBeNil)
+				})
+				Convey("a cache that doesn't exist should sweep to nothing", func() {
+					So(Sweep(osfs.New(tmpDir.Join(fs.MustRelPath("nope"))), nil), ShouldBeNil)
+				})
+			})
+		}),
+	)
+}
+
+func TestMountSources(t *testing.T) {
+	Convey("Mount sources should be read from mountinfo:", t, func() {
+		mountinfo := strings.Join([]string{
+			`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+			`23 22 0:5 / /proc rw - proc proc rw`,
+			`31 22 8:1 /var/cache/rio/tar/fileset/aa/bb/aabbcc /mnt/bound rw shared:1 - ext4 /dev/sda1 rw`,
+			`32 22 0:40 / /mnt/over rw - overlay overlay rw,lowerdir=/var/cache/rio/tar/fileset/dd/ee/ddeeff:/srv/other,upperdir=/tmp/up,workdir=/tmp/work`,
+			`33 22 8:1 /srv/with\040space /mnt/spaced rw - ext4 /dev/sda1 rw`,
+			`34 22 0:41 / /mnt/aufs rw - aufs none rw,si=1f2e3d`,
+		}, "\n")
+		mounts, err := parseMountSources(strings.NewReader(mountinfo), func(si string) []string {
+			So(si, ShouldEqual, "1f2e3d")
+			return []string{"/var/cache/rio/tar/fileset/11/22/112233"}
+		})
+		So(err, ShouldBeNil)
+		shelf := func(s string) fs.AbsolutePath { return fs.MustAbsolutePath("/var/cache/rio/tar/fileset/" + s) }
+
+		Convey("the source of a bind should count", func() {
+			So(mounts.within(shelf("aa/bb/aabbcc")), ShouldBeTrue)
+			So(mounts.within(fs.MustAbsolutePath("/mnt")), ShouldBeFalse)
+		})
+		Convey("each layer of an overlay or aufs mount should count", func() {
+			So(mounts.within(shelf("dd/ee/ddeeff")), ShouldBeTrue)
+			So(mounts.within(fs.MustAbsolutePath("/srv/other")), ShouldBeTrue)
+			So(mounts.within(shelf("11/22/112233")), ShouldBeTrue)
+		})
+		Convey("the parents of a source should count, but not its siblings", func() {
+			So(mounts.within(fs.MustAbsolutePath("/var/cache/rio")), ShouldBeTrue)
+			So(mounts.within(shelf("aa/bb/aabbc")), ShouldBeFalse)
+			So(mounts.within(shelf("aa/bb/aabbccdd")), ShouldBeFalse)
+		})
+		Convey("escaped paths should be unescaped", func() {
+			So(mounts.within(fs.MustAbsolutePath("/srv/with space")), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,116 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cache
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/log"
+)
+
+// How often to retry a lock somebody else holds.
+var lockPollInterval = 20 * time.Millisecond
+
+/*
+	Take the ware's lock: an exclusive flock on `{type}/lock/{hash}` in the
+	cache.  Blocks until the lock is ours, or the context is cancelled.
+
+	The lock is advisory, and only other cache users take it; it's what
+	makes two unpacks of the same ware (in this process or another) take
+	turns populating, rather than both doing the work and racing to commit.
+
+	The returned func releases the lock; defer it.  (If the process dies,
+	the kernel releases it for us.)  Lockfiles are left in place after:
+	removing one would race with somebody else just opening it.
+*/
+func (c cache) lock(ctx context.Context, wareID api.WareID, monitor rio.Monitor) (unlock func(), err error) {
+	return c.flock(ctx, wareID, syscall.LOCK_EX, monitor)
+}
+
+/*
+	Take the ware's lock shared: as lock, but any number of holders can
+	share it (while nobody holds it exclusively).  Placing from a shelf
+	holds this, so Sweep can see the shelf is in use.
+*/
+func (c cache) lockShared(ctx context.Context, wareID api.WareID, monitor rio.Monitor) (unlock func(), err error) {
+	return c.flock(ctx, wareID, syscall.LOCK_SH, monitor)
+}
+
+/*
+	Take the ware's lock exclusively if nobody else holds it at all;
+	if somebody does, `ok` is false (and there's nothing to unlock).
+*/
+func (c cache) tryLock(wareID api.WareID) (unlock func(), ok bool, err error) {
+	f, err := c.openLock(wareID)
+	if err != nil {
+		return nil, false, err
+	}
+	switch err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err {
+	case nil:
+		return lockRelease(f), true, nil
+	case syscall.EWOULDBLOCK:
+		f.Close()
+		return nil, false, nil
+	default:
+		f.Close()
+		return nil, false, Errorf(rio.ErrLocalCacheProblem, "cannot take cache lock %q: %s", f.Name(), err)
+	}
+}
+
+func (c cache) flock(ctx context.Context, wareID api.WareID, how int, monitor rio.Monitor) (unlock func(), err error) {
+	f, err := c.openLock(wareID)
+	if err != nil {
+		return nil, err
+	}
+	for waited := false; ; waited = true {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return lockRelease(f), nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, Errorf(rio.ErrLocalCacheProblem, "cannot take cache lock %q: %s", f.Name(), err)
+		}
+		if !waited {
+			log.CacheLockWait(monitor, wareID)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, Errorf(rio.ErrCancelled, "cancelled while waiting for cache lock on %q", wareID)
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (c cache) openLock(wareID api.WareID) (*os.File, error) {
+	lockDir := c.fs.BasePath().Join(fs.MustRelPath(string(wareID.Type) + "/lock"))
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), lockDir.CoerceRelative(), 0700); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	lockPath := lockDir.Join(fs.MustRelPath(wareID.Hash)).String()
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot open cache lock %q: %s", lockPath, err)
+	}
+	return f, nil
+}
+
+func lockRelease(f *os.File) func() {
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
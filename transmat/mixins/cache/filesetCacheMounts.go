@@ -0,0 +1,174 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cache
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	The paths that mounts are made *from*: the source of each bind mount,
+	and each layer of each overlay or aufs mount.
+
+	A mount placement only holds its shelf's lock while mounting, and the
+	mount may well outlive the process that made it; so Sweep asks this,
+	rather than the lock, whether a shelf is still in use.
+*/
+type mountSources []string
+
+/*
+	Read the mount sources from /proc/self/mountinfo.
+	Where there's no such thing (not linux), there are no mounts to know of.
+*/
+func readMountSources() (mountSources, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read mounts: %s", err)
+	}
+	defer f.Close()
+	return parseMountSources(f, aufsBranches)
+}
+
+type mountinfoEntry struct {
+	dev        string // "major:minor"
+	root       string // path of the mount's root, within its filesystem
+	mountPoint string
+	fsType     string
+	superOpts  string
+}
+
+/*
+	Parse mountinfo (see proc(5)) into mount sources.  `branches` looks up
+	an aufs mount's layers by its "si" option, since mountinfo doesn't say.
+*/
+func parseMountSources(r io.Reader, branches func(si string) []string) (mountSources, error) {
+	var entries []mountinfoEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++ // skip the optional fields.
+		}
+		if sep+2 >= len(fields) {
+			continue
+		}
+		entry := mountinfoEntry{
+			dev:        fields[2],
+			root:       unescapeMountinfo(fields[3]),
+			mountPoint: unescapeMountinfo(fields[4]),
+			fsType:     fields[sep+1],
+		}
+		if sep+3 < len(fields) {
+			entry.superOpts = fields[sep+3]
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read mounts: %s", err)
+	}
+
+	var sources mountSources
+	for i, e := range entries {
+		switch e.fsType {
+		case "overlay":
+			for _, opt := range strings.Split(e.superOpts, ",") {
+				if strings.HasPrefix(opt, "lowerdir=") {
+					for _, lower := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+						sources = append(sources, unescapeMountinfo(lower))
+					}
+				}
+			}
+		case "aufs":
+			for _, opt := range strings.Split(e.superOpts, ",") {
+				if strings.HasPrefix(opt, "si=") {
+					sources = append(sources, branches(strings.TrimPrefix(opt, "si="))...)
+				}
+			}
+		}
+		// A bind mount looks like any other mount, except its root is deeper
+		//  in its filesystem.  Wherever else that filesystem is mounted, the
+		//  same root is reachable by path: that's the source.
+		for j, m := range entries {
+			if i == j || m.dev != e.dev || !withinPath(e.root, m.root) {
+				continue
+			}
+			sources = append(sources, path.Join(m.mountPoint, strings.TrimPrefix(e.root, m.root)))
+		}
+	}
+	return sources, nil
+}
+
+/*
+	True if anything is mounted from `p`, or from anything within it.
+*/
+func (ms mountSources) within(p fs.AbsolutePath) bool {
+	for _, source := range ms {
+		if withinPath(source, p.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func withinPath(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+/*
+	Mountinfo escapes space, tab, newline, and backslash in octal ("\040").
+*/
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+/*
+	An aufs mount's layers are listed in sysfs, one file per branch,
+	each holding "{path}={perm}".
+*/
+func aufsBranches(si string) []string {
+	files, _ := filepath.Glob("/sys/fs/aufs/si_" + si + "/br[0-9]*")
+	var paths []string
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		line := strings.TrimSpace(string(body))
+		if i := strings.LastIndexByte(line, '='); i > 0 {
+			paths = append(paths, line[:i])
+		}
+	}
+	return paths
+}
@@ -0,0 +1,130 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cache
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+)
+
+/*
+	Remove every committed shelf in the cache, except those for the wares
+	in `keep`, to reclaim space.
+
+	It's safe to sweep while other processes unpack: each shelf's lock is
+	tried first, and a shelf whose lock is held -- by an unpack populating
+	it, or placing from it -- is left for next time.  So is a shelf that's
+	mounted somewhere: a mount placement only holds the lock while
+	mounting, and the mount may outlive the process that made it.
+	Temp dirs, partial fetches, and lockfiles aren't shelves, and are
+	left alone too.
+
+	Shelves are removed with fsOp.RemoveAll, so a symlink inside one is
+	removed, and never followed.  Returns the first error; shelves after
+	it aren't looked at.
+*/
+func Sweep(cacheFs fs.FS, keep []api.WareID) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	kept := make(map[api.WareID]struct{}, len(keep))
+	for _, wareID := range keep {
+		kept[wareID] = struct{}{}
+	}
+	c := cache{fs: cacheFs}
+	return c.eachShelf(func(wareID api.WareID, shelf fs.RelPath) error {
+		if _, ok := kept[wareID]; ok {
+			return nil
+		}
+		unlock, ok, err := c.tryLock(wareID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil // in use; next time.
+		}
+		defer unlock()
+		// Only ask after locking: a mount made since couldn't be seen.
+		mounts, err := readMountSources()
+		if err != nil {
+			return err
+		}
+		if mounts.within(c.fs.BasePath().Join(shelf)) {
+			return nil // mounted; next time.
+		}
+		if err := fsOp.RemoveAll(c.fs, shelf); err != nil {
+			return Errorf(rio.ErrLocalCacheProblem, "error sweeping %q from cache: %s", wareID, err)
+		}
+		return nil
+	})
+}
+
+/*
+	Call `fn` for each committed shelf: that is, each
+	`{type}/fileset/{chunk}/{chunk}/{hash}` (see ShelfFor), skipping the
+	temp dirs that commits leave beside shelves while they work.
+	Shelves come in order of their paths.
+	A cache that doesn't exist yet has no shelves.
+*/
+func (c cache) eachShelf(fn func(wareID api.WareID, shelf fs.RelPath) error) error {
+	readDir := func(path fs.RelPath) ([]string, error) {
+		names, err := c.fs.ReadDirNames(path)
+		switch Category(err) {
+		case nil:
+			sort.Strings(names)
+			return names, nil
+		case fs.ErrNotExists, fs.ErrNotDir:
+			return nil, nil
+		default:
+			return nil, Errorf(rio.ErrLocalCacheProblem, "error reading cache: %s", err)
+		}
+	}
+	types, err := readDir(fs.RelPath{})
+	if err != nil {
+		return err
+	}
+	for _, typ := range types {
+		if strings.HasPrefix(typ, ".tmp.") {
+			continue
+		}
+		filesets := fs.MustRelPath(typ + "/fileset")
+		chunk1s, err := readDir(filesets)
+		if err != nil {
+			return err
+		}
+		for _, chunk1 := range chunk1s {
+			chunk2s, err := readDir(filesets.Join(fs.MustRelPath(chunk1)))
+			if err != nil {
+				return err
+			}
+			for _, chunk2 := range chunk2s {
+				dir := filesets.Join(fs.MustRelPath(chunk1 + "/" + chunk2))
+				hashes, err := readDir(dir)
+				if err != nil {
+					return err
+				}
+				for _, hash := range hashes {
+					if strings.HasPrefix(hash, ".tmp.") {
+						continue
+					}
+					wareID := api.WareID{api.PackType(typ), hash}
+					if ShelfFor(wareID) != dir.Join(fs.MustRelPath(hash)) {
+						continue // not a shelf; not ours to sweep.
+					}
+					if err := fn(wareID, dir.Join(fs.MustRelPath(hash))); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -6,8 +6,10 @@ Sniperkit-Bot
 package filters
 
 import (
+	"fmt"
 	"os"
 
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/util"
 	"go.polydawn.net/rio/fs"
 )
@@ -17,6 +19,36 @@ var (
 	myGid = uint32(os.Getgid())
 )
 
+/*
+	The mtime filter which keeps mtimes to the nanosecond.  Plain "keep"
+	keeps them to the second, since that's all most formats can hold;
+	this keeps the rest too, where the format can (so far, only tar can).
+	It changes the WareID of anything with sub-second mtimes.
+
+	apiutil doesn't know this one; ProcessFilters takes it out first.
+*/
+const MtimeKeepNanos = "keep-ns"
+
+/*
+	Exactly like apiutil.ProcessFilters, but also knows MtimeKeepNanos for
+	the mtime filter.  Packing, the filters come back as for "keep", and
+	keepNanos is true.  Unpacking, it's an error, and says why: unpack
+	places mtimes as exactly as the ware has them already.
+
+	Transmats that can't keep nanoseconds should stick to apiutil's for
+	packing, so that asking them to is an error.
+*/
+func ProcessFilters(ff api.FilesetFilters, mode apiutil.FilterPurpose) (_ apiutil.FilesetFilters, keepNanos bool, err error) {
+	if ff.Mtime == MtimeKeepNanos {
+		if mode != apiutil.FilterPurposePack {
+			return apiutil.FilesetFilters{}, false, fmt.Errorf("mtime filter %q is only for packing (unpack keeps mtimes as exactly as the ware has them; use \"keep\")", MtimeKeepNanos)
+		}
+		ff.Mtime, keepNanos = "keep", true
+	}
+	filt, err := apiutil.ProcessFilters(ff, mode)
+	return filt, keepNanos, err
+}
+
 /*
 	Mutate the given fmeta handle to apply filters.
 
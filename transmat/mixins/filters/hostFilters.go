@@ -0,0 +1,105 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package filters
+
+import (
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/log"
+)
+
+/*
+	The filters that come from config rather than api.FilesetFilters:
+	the operator's rules for what may land on their host.
+	See IdRemap, PermsMask, and XattrFilter.
+*/
+type HostFilters struct {
+	Remap  IdRemap
+	Mask   PermsMask
+	Xattrs XattrFilter
+}
+
+/*
+	Load the filters from config.
+	Do this once per pack or unpack; not per file.
+*/
+func HostFiltersFromConfig() (h HostFilters, err error) {
+	if h.Remap, err = IdRemapFromConfig(); err != nil {
+		return
+	}
+	if h.Mask, err = PermsMaskFromConfig(); err != nil {
+		return
+	}
+	h.Xattrs, err = XattrFilterFromConfig()
+	return
+}
+
+/*
+	True if any of the filters could change anything (and thus change hashes).
+*/
+func (h HostFilters) IsHashAltering() bool {
+	return h.Remap.IsHashAltering() || h.Mask.IsHashAltering() || h.Xattrs.IsHashAltering()
+}
+
+/*
+	Mutate the given fmeta handle to apply the remap, the mask, and the
+	xattr filter.  Do this before Apply.
+*/
+func (h HostFilters) Apply(fmeta *fs.Metadata) {
+	h.Remap.Apply(fmeta)
+	h.Mask.Apply(fmeta)
+	h.Xattrs.Apply(fmeta)
+}
+
+/*
+	How unpack places files on this host: the HostFilters, and how
+	failures to chown (or set xattrs) are taken.
+
+	Some filesystems can't chown symlinks at all; the operator may choose
+	to shrug that off.  And if we're not root, being refused a chown is no
+	surprise: it's warned about, but unpack carries on.  Xattrs are only
+	placed if the XattrFilter keeps any.
+*/
+type PlacementPolicy struct {
+	HostFilters
+	Chown fsOp.ChownPolicy
+}
+
+/*
+	Load the policy from config.  Skipped chowns and xattrs are logged to
+	the monitor as they happen.
+	Do this once per unpack; not per file.
+*/
+func PlacementPolicyFromConfig(mon rio.Monitor) (PlacementPolicy, error) {
+	host, err := HostFiltersFromConfig()
+	if err != nil {
+		return PlacementPolicy{}, err
+	}
+	skipSymlinkChown, err := config.GetSkipUnsupportedSymlinkChown()
+	if err != nil {
+		return PlacementPolicy{}, err
+	}
+	return PlacementPolicy{host, fsOp.ChownPolicy{
+		SkipUnsupportedSymlink: skipSymlinkChown,
+		SkipUnpermitted:        os.Getuid() != 0,
+		SkipXattrs:             !host.Xattrs.KeepsAny(),
+		OnSkip: func(fmeta fs.Metadata, err error) {
+			if Category(err) == fs.ErrPermission {
+				log.ChownSkipped(mon, fmeta.Name, err)
+				return
+			}
+			log.SymlinkChownSkipped(mon, fmeta.Name, err)
+		},
+		OnSkipXattr: func(fmeta fs.Metadata, key string, err error) {
+			log.XattrSkipped(mon, fmeta.Name, key, err)
+		},
+	}}, nil
+}
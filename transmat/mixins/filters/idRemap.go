@@ -0,0 +1,58 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package filters
+
+import (
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Tables for remapping uids and gids.  Ids not in a table are left alone.
+
+	This isn't part of the api.FilesetFilters, because it's a fact about
+	the host (its user namespace) rather than about the fileset; so it comes
+	from config.  Apply it before Apply, so explicit id filters still win.
+*/
+type IdRemap struct {
+	Uid map[uint32]uint32
+	Gid map[uint32]uint32
+}
+
+/*
+	Load the remap tables from config.
+	Do this once per pack or unpack; not per file.
+*/
+func IdRemapFromConfig() (IdRemap, error) {
+	uids, err := config.GetFilterUidMap()
+	if err != nil {
+		return IdRemap{}, err
+	}
+	gids, err := config.GetFilterGidMap()
+	if err != nil {
+		return IdRemap{}, err
+	}
+	return IdRemap{Uid: uids, Gid: gids}, nil
+}
+
+/*
+	True if the remap could change anything (and thus change hashes).
+*/
+func (r IdRemap) IsHashAltering() bool {
+	return len(r.Uid) > 0 || len(r.Gid) > 0
+}
+
+/*
+	Mutate the given fmeta handle to apply the remap.
+*/
+func (r IdRemap) Apply(fmeta *fs.Metadata) {
+	if to, ok := r.Uid[fmeta.Uid]; ok {
+		fmeta.Uid = to
+	}
+	if to, ok := r.Gid[fmeta.Gid]; ok {
+		fmeta.Gid = to
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package filters
+
+import (
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Permission bits to clear from every entry, like a umask.
+	The mask is over the whole of fs.Perms, so it can clear the setuid,
+	setgid, and sticky bits as well as the usual nine.
+
+	Like IdRemap, this comes from config rather than api.FilesetFilters:
+	it's the operator's rule for what may land on their host, not a fact
+	about the fileset.  Apply it alongside the remap, before Apply.
+*/
+type PermsMask fs.Perms
+
+/*
+	Load the mask from config.
+	Do this once per pack or unpack; not per file.
+*/
+func PermsMaskFromConfig() (PermsMask, error) {
+	mask, err := config.GetFilterPermsMask()
+	return PermsMask(mask), err
+}
+
+/*
+	True if the mask could change anything (and thus change hashes).
+*/
+func (m PermsMask) IsHashAltering() bool {
+	return m != 0
+}
+
+/*
+	Mutate the given fmeta handle to apply the mask.
+
+	Symlinks are left alone: their perms are always 0777, and there's no
+	chmodding them to anything else, so masking would only make the hash
+	describe something that can't be placed.
+*/
+func (m PermsMask) Apply(fmeta *fs.Metadata) {
+	if fmeta.Type == fs.Type_Symlink {
+		return
+	}
+	fmeta.Perms &^= fs.Perms(m)
+}
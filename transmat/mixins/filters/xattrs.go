@@ -0,0 +1,94 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package filters
+
+import (
+	"strings"
+
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Which xattrs to keep.
+
+	The zero value is the default, and keeps xattrs out of filesets, as
+	they always have been: pack doesn't read them, and unpack doesn't place
+	them.  (Unpack still hashes whatever xattrs the ware has, so its WareID
+	checks out the same either way.)  Xattrs are opt-in because the same
+	files carry different ones from host to host -- an selinux label is the
+	host's business -- and WareIDs would differ along with them.
+
+	Enabled, Keep says which: each a whole key, or a namespace ending in a
+	dot.  Nil keeps them all; empty (but not nil) keeps none.
+
+	Like PermsMask, this comes from config rather than api.FilesetFilters:
+	whether "security.capability" may land on a host is the operator's
+	call.  Apply it alongside the remap and mask, before Apply.
+*/
+type XattrFilter struct {
+	Enabled bool
+	Keep    []string
+}
+
+/*
+	Load the filter from config.
+	Do this once per pack or unpack; not per file.
+*/
+func XattrFilterFromConfig() (XattrFilter, error) {
+	keep, enabled, err := config.GetFilterXattrs()
+	return XattrFilter{enabled, keep}, err
+}
+
+/*
+	True if the filter could change anything (and thus change hashes).
+*/
+func (f XattrFilter) IsHashAltering() bool {
+	return f.Enabled && f.Keep != nil
+}
+
+/*
+	True if the filter keeps any xattrs at all.  If not, there's no need
+	to read them while packing, and none are placed while unpacking.
+*/
+func (f XattrFilter) KeepsAny() bool {
+	return f.Enabled && (f.Keep == nil || len(f.Keep) > 0)
+}
+
+/*
+	Mutate the given fmeta handle to drop the xattrs not kept.
+	The map is replaced rather than edited, since it may be shared
+	with another copy of the metadata.
+
+	When not enabled, this changes nothing: there's nothing to drop while
+	packing, and while unpacking, what's hashed is what the ware has.
+	(Keeping them from being placed is up to the placer; see KeepsAny.)
+*/
+func (f XattrFilter) Apply(fmeta *fs.Metadata) {
+	if !f.Enabled || f.Keep == nil || len(fmeta.Xattrs) == 0 {
+		return
+	}
+	var kept map[string]string
+	for k, v := range fmeta.Xattrs {
+		if !f.keeps(k) {
+			continue
+		}
+		if kept == nil {
+			kept = make(map[string]string, len(fmeta.Xattrs))
+		}
+		kept[k] = v
+	}
+	fmeta.Xattrs = kept
+}
+
+func (f XattrFilter) keeps(key string) bool {
+	for _, k := range f.Keep {
+		if key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+	return false
+}
@@ -93,6 +93,12 @@ func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
 			enc.Step(&tok.Token{Type: tok.TBytes, Bytes: record.ContentHash})
 			// finalize our hash here and upsub to save us the work of hanging onto the hasher until the postvisit call
 			upsubs.Peek()(hasher.Sum(nil))
+		case fs.Type_Whiteout:
+			// A whiteout is all metadata, but it has to count: it's the only
+			//  thing that tells a layer with one from a layer without.
+			//  (Symlinks, devices, and so on don't upsub; that's long-standing,
+			//  and changing it would change every existing WareID with them in.)
+			upsubs.Peek()(hasher.Sum(nil))
 		}
 		return nil
 	}
@@ -38,6 +38,24 @@ func CacheHasIt(mon rio.Monitor, ware api.WareID) {
 	}
 }
 
+// Emit info log entry when another unpack of the same ware holds the cache lock;
+// we'll wait for it, and then most likely find the ware already cached.
+func CacheLockWait(mon rio.Monitor, ware api.WareID) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("cache: waiting for another unpack of ware %q", ware),
+			Detail: [][2]string{
+				{"wareID", ware.String()},
+			},
+		},
+	}
+}
+
 // Log path for a 'rio.ErrWarehouseUnavailable'; mode is "read" or "write".
 func WarehouseUnavailable(mon rio.Monitor, err error, wh api.WarehouseAddr, ware api.WareID, mode string) {
 	if mon.Chan == nil {
@@ -76,6 +94,26 @@ func WareNotFound(mon rio.Monitor, err error, wh api.WarehouseAddr, ware api.War
 	}
 }
 
+// Log a transient failure to fetch from a warehouse, which will be retried after `wait`.
+func WareFetchRetrying(mon rio.Monitor, err error, wh api.WarehouseAddr, ware api.WareID, wait time.Duration) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("fetch of ware %q from warehouse %q failed; retrying in %s", ware, wh, wait),
+			Detail: [][2]string{
+				{"warehouse", string(wh)},
+				{"wareID", ware.String()},
+				{"error", err.Error()},
+				{"wait", wait.String()},
+			},
+		},
+	}
+}
+
 func WareReaderOpened(mon rio.Monitor, wh api.WarehouseAddr, ware api.WareID) {
 	if mon.Chan == nil {
 		return
@@ -93,6 +131,25 @@ func WareReaderOpened(mon rio.Monitor, wh api.WarehouseAddr, ware api.WareID) {
 	}
 }
 
+// Emit info log entry for a fetch picking up where an earlier one was cut off.
+func WareFetchResumed(mon rio.Monitor, wh api.WarehouseAddr, ware api.WareID, offset int64) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("resuming fetch of ware %q from warehouse %q at byte %d", ware, wh, offset),
+			Detail: [][2]string{
+				{"warehouse", string(wh)},
+				{"wareID", ware.String()},
+				{"offset", fmt.Sprintf("%d", offset)},
+			},
+		},
+	}
+}
+
 // This logs a cache hit where the "object store" (as git calls it, for example)
 // has the object we need -- as opposed to our fileset cache, which presumably
 // has already missed, or we would've returned that already.
@@ -130,6 +187,86 @@ func MirrorNoop(mon rio.Monitor, wh api.WarehouseAddr, ware api.WareID) {
 	}
 }
 
+// Log the outcome of checking one ware in a warehouse; status is "ok", "corrupt", or "missing".
+// Anything but ok is a warning, and the detail says why.
+func WareChecked(mon rio.Monitor, wh api.WarehouseAddr, ware api.WareID, status string, detail string) {
+	if mon.Chan == nil {
+		return
+	}
+	evt := &rio.Event_Log{
+		Time:  time.Now(),
+		Level: rio.LogInfo,
+		Msg:   fmt.Sprintf("verify: ware %q in warehouse %q is %s", ware, wh, status),
+		Detail: [][2]string{
+			{"warehouse", string(wh)},
+			{"wareID", ware.String()},
+			{"status", status},
+		},
+	}
+	if status != "ok" {
+		evt.Level = rio.LogWarn
+		evt.Msg += ": " + detail
+		evt.Detail = append(evt.Detail, [2]string{"detail", detail})
+	}
+	mon.Chan <- rio.Event{Log: evt}
+}
+
+// Log the digests of a packed image layer, which image manifests and configs refer to it by.
+func LayerPacked(mon rio.Monitor, ware api.WareID, digest, diffID string, size int64) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("packed ware %q as layer %s (diff_id %s, %d bytes)", ware, digest, diffID, size),
+			Detail: [][2]string{
+				{"wareID", ware.String()},
+				{"digest", digest},
+				{"diffID", diffID},
+				{"size", fmt.Sprintf("%d", size)},
+			},
+		},
+	}
+}
+
+// Log the manifest digest of a packed image, which is what a registry or runtime names it by.
+func ImagePacked(mon rio.Monitor, manifestDigest string, layers int) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("packed image %s (%d layers)", manifestDigest, layers),
+			Detail: [][2]string{
+				{"manifestDigest", manifestDigest},
+				{"layers", fmt.Sprintf("%d", layers)},
+			},
+		},
+	}
+}
+
+// Log the TOC digest of a packed eStargz, which the layer's annotation needs for lazy pulling to verify it.
+func EstargzPacked(mon rio.Monitor, ware api.WareID, tocDigest string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("packed ware %q as eStargz (TOC digest %s)", ware, tocDigest),
+			Detail: [][2]string{
+				{"wareID", ware.String()},
+				{"tocDigest", tocDigest},
+			},
+		},
+	}
+}
+
 // Emit debug log entry for implicit parent dir creation.
 // This is mostly a tar thing and probably shouldn't be in the general mixins;
 // the fact that it's here is a hint that we need some serious refactor on logs.
@@ -152,3 +289,154 @@ func DirectoryInferred(mon rio.Monitor, inferred, path fs.RelPath) {
 		},
 	}
 }
+
+// Emit warning log entry for a symlink whose ownership couldn't be set
+// because the filesystem doesn't support it (and config said to skip that).
+func SymlinkChownSkipped(mon rio.Monitor, path fs.RelPath, err error) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: could not set ownership of symlink %q (continuing anyway): %s", path, err),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"error", err.Error()},
+			},
+		},
+	}
+}
+
+// Emit warning log entry for a path left untouched because the target
+// already there was immutable (and config said to skip those).
+func ImmutableTargetSkipped(mon rio.Monitor, path fs.RelPath) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: leaving immutable target %q in place", path),
+			Detail: [][2]string{
+				{"path", path.String()},
+			},
+		},
+	}
+}
+
+// Emit warning log entry for a temp dir in the cache that couldn't be removed.
+// This never replaces the error from the unpack itself; it's only garbage.
+func CacheTempCleanupFailed(mon rio.Monitor, path fs.AbsolutePath, err error) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("cache: could not remove temp unpack dir %q: %s", path, err),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"error", err.Error()},
+			},
+		},
+	}
+}
+
+// Emit warning log entry for a path whose ownership couldn't be set
+// because we lack the privileges (and aren't root, so that's expected).
+func ChownSkipped(mon rio.Monitor, path fs.RelPath, err error) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: not permitted to set ownership of %q (continuing anyway): %s", path, err),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"error", err.Error()},
+			},
+		},
+	}
+}
+
+// Emit warning log entry for an xattr that couldn't be set, because the
+// filesystem can't hold it or we lack the privileges (xattrs are best-effort).
+func XattrSkipped(mon rio.Monitor, path fs.RelPath, key string, err error) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: could not set xattr %q on %q (continuing anyway): %s", key, path, err),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"xattr", key},
+				{"error", err.Error()},
+			},
+		},
+	}
+}
+
+// Emit warning log entry for a hardlink that was among the paths asked for,
+// when the file it links to wasn't (so there's nothing on disk to link it to).
+func HardlinkSkipped(mon rio.Monitor, path, target fs.RelPath) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: skipping hardlink %q: it links to %q, which wasn't among the paths unpacked", path, target),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"target", target.String()},
+			},
+		},
+	}
+}
+
+// Log a ware repacked into another form; both WareIDs name the same fileset.
+func WareRepacked(mon rio.Monitor, from, to api.WareID, form string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("repacked ware %q as %q (%s); they're the same fileset", from, to, form),
+			Detail: [][2]string{
+				{"from", from.String()},
+				{"to", to.String()},
+				{"form", form},
+			},
+		},
+	}
+}
+
+// Log a submodule left as an empty dir, rather than fetched and unpacked.
+func SubmoduleLeftEmpty(mon rio.Monitor, path fs.RelPath, hash string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: submodule %q (at commit %s) left empty", path, hash),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"hash", hash},
+			},
+		},
+	}
+}
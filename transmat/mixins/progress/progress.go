@@ -0,0 +1,79 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Helpers for emitting rio.Event_Progress on a rio.Monitor, throttled so
+	that a fileset of a million tiny files doesn't mean a million events.
+*/
+package progress
+
+import (
+	"time"
+
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+// Minimum time between progress events (other than the final one).
+var Interval = 200 * time.Millisecond
+
+/*
+	Tracks bytes processed for one pack or unpack, and reports them.
+
+	A Reporter on a zero Monitor does nothing, so it's always safe to use.
+	Not safe for concurrent use.
+*/
+type Reporter struct {
+	mon       rio.Monitor
+	phase     string
+	totalWork int64 // zero if unknown.
+	totalProg int64
+	lastSent  time.Time
+}
+
+/*
+	Start tracking progress of a phase (e.g. "pack" or "unpack").
+	The total amount of work may be zero, for "unknown".
+*/
+func New(mon rio.Monitor, phase string, totalWork int64) *Reporter {
+	return &Reporter{mon: mon, phase: phase, totalWork: totalWork, lastSent: time.Now()}
+}
+
+/*
+	Record n more bytes processed, while working on the given path.
+	An event is sent only if at least Interval has passed since the last.
+*/
+func (r *Reporter) Add(n int64, path fs.RelPath) {
+	r.totalProg += n
+	if r.mon.Chan == nil {
+		return
+	}
+	if now := time.Now(); now.Sub(r.lastSent) >= Interval {
+		r.lastSent = now
+		r.send(path.String(), r.totalWork)
+	}
+}
+
+/*
+	Send the final event, reporting all of the work as done.
+	(If the total wasn't known up front, it is now.)
+*/
+func (r *Reporter) Done() {
+	if r.mon.Chan == nil {
+		return
+	}
+	r.send("done", r.totalProg)
+}
+
+func (r *Reporter) send(desc string, totalWork int64) {
+	r.mon.Chan <- rio.Event{
+		Progress: &rio.Event_Progress{
+			Phase:     r.phase,
+			Desc:      desc,
+			TotalProg: int(r.totalProg),
+			TotalWork: int(totalWork),
+		},
+	}
+}
@@ -7,6 +7,7 @@ package tests
 
 import (
 	"bytes"
+	"strings"
 	"time"
 
 	"go.polydawn.net/rio/fs"
@@ -54,15 +55,38 @@ var FixtureAlphaDiffPerm3 = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 07644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
 }
 
+// just the setuid bit, for checking it can be masked out on its own.
+var FixtureAlphaDiffSetuid = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 04644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
+}
+
 var FixtureAlphaDiffUidGid = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
 	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3, Uid: 444, Gid: 444}, []byte("zyx")},
 }
 
+var FixtureAlphaDiffXattr = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3, Xattrs: map[string]string{"user.rio-fixture": "val"}}, []byte("zyx")},
+}
+
 var FixtureEmpty = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
 }
 
+// a dir with nothing in it.  tar can leave these out; we mustn't.
+var FixtureEmptyDir = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0750, Mtime: defaultTime}, nil},
+}
+
+var FixtureEmptyDirDiffFilled = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0750, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./d/c"), Type: fs.Type_File, Perms: 0664, Mtime: defaultTime, Size: 0}, []byte{}},
+}
+
 var FixtureMultifile = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
 	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
@@ -91,6 +115,13 @@ var FixtureSymlinks = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("./ln"), Type: fs.Type_Symlink, Perms: 0777, Mtime: defaultTime, Linkname: "./a"}, nil},
 }
 
+// the types that aren't files, dirs, or links.  a device node needs CAP_MKNOD to place.
+var FixtureSpecials = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./fifo"), Type: fs.Type_NamedPipe, Perms: 0640, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./null"), Type: fs.Type_CharDevice, Perms: 0666, Mtime: defaultTime, Devmajor: 1, Devminor: 3}, nil},
+}
+
 // deep and varied structures.  files and dirs.
 // subtle: a dir with a sibling that's a suffix of its name (can trip up dir/child adjacency sorting).
 // subtle: a file with a sibling that's a suffix of its name (other half of the test, to make sure the prefix doesn't create an incorrect tree node).
@@ -108,6 +139,45 @@ var FixtureGamma = []FixtureFile{
 	{fs.Metadata{Name: fs.MustRelPath("./var/fun"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 3}, []byte("zyx")},
 }
 
+// paths and a link target longer than a ustar header has room for (100 bytes),
+// with one name that's longer than that on its own, so not even ustar's prefix field can help.
+var FixtureLongPaths = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./" + longDirA), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./" + longDirA + "/" + longDirB), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./" + longDirA + "/" + longDirB + "/" + longName), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 4}, []byte("deep")},
+	{fs.Metadata{Name: fs.MustRelPath("./ln"), Type: fs.Type_Symlink, Perms: 0777, Mtime: defaultTime, Linkname: longDirA + "/" + longDirB + "/" + longName}, nil},
+}
+
+var (
+	longDirA = "dir-" + strings.Repeat("a", 60)
+	longDirB = "dir-" + strings.Repeat("b", 60)
+	longName = "file-" + strings.Repeat("n", 150)
+)
+
+// one file that's mostly zeros: some data at the start, some in the middle, and some at the very end.
+// not in AllFixtures, because it's big; it's for checking that sparse files stay sparse (see fsOp.SparseBlock).
+var FixtureSparse = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./sparse"), Type: fs.Type_File, Perms: 0644, Mtime: defaultTime, Size: 4 << 20}, sparseBody(4 << 20)},
+}
+
+// a layer that deletes "./a" from whatever it's unpacked over.  see fs.Type_Whiteout.
+// not in AllFixtures: a whiteout is gone once it's placed, so there's nothing to round trip.
+// PlaceWhiteoutFixture puts it on disk the way overlayfs would, for packing.
+var FixtureWhiteout = []FixtureFile{
+	{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: defaultTime}, nil},
+	{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Whiteout, Mtime: defaultTime}, nil},
+}
+
+func sparseBody(size int) []byte {
+	body := make([]byte, size)
+	copy(body, "head")
+	copy(body[1<<20+7:], "middle")
+	copy(body[size-4:], "tail")
+	return body
+}
+
 var AllFixtures = []struct {
 	Name  string
 	Files []FixtureFile
@@ -118,13 +188,18 @@ var AllFixtures = []struct {
 	{"AlphaDiffPerm", FixtureAlphaDiffPerm},
 	{"AlphaDiffPerm2", FixtureAlphaDiffPerm2},
 	{"AlphaDiffPerm3", FixtureAlphaDiffPerm3},
+	{"AlphaDiffSetuid", FixtureAlphaDiffSetuid},
 	{"AlphaDiffUidGid", FixtureAlphaDiffUidGid},
+	{"AlphaDiffXattr", FixtureAlphaDiffXattr},
 	{"Empty", FixtureEmpty},
+	{"EmptyDir", FixtureEmptyDir},
 	{"Multifile", FixtureMultifile},
 	{"Depth1", FixtureDepth1},
 	{"Depth3", FixtureDepth3},
 	{"Symlinks", FixtureSymlinks},
+	{"Specials", FixtureSpecials},
 	{"Gamma", FixtureGamma},
+	{"LongPaths", FixtureLongPaths},
 }
 
 /*
@@ -148,3 +223,19 @@ func PlaceFixture(afs fs.FS, fixture []FixtureFile) {
 		}
 	}
 }
+
+/*
+	Like PlaceFixture, but whiteouts are placed as overlayfs keeps them on
+	disk -- char devices numbered 0/0 -- rather than applied.
+	Making those needs CAP_MKNOD.
+*/
+func PlaceWhiteoutFixture(afs fs.FS, fixture []FixtureFile) {
+	onDisk := make([]FixtureFile, len(fixture))
+	for i, ff := range fixture {
+		if ff.Metadata.Type == fs.Type_Whiteout {
+			ff.Metadata.Type, ff.Metadata.Devmajor, ff.Metadata.Devminor = fs.Type_CharDevice, 0, 0
+		}
+		onDisk[i] = ff
+	}
+	PlaceFixture(afs, onDisk)
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/fs"
@@ -81,6 +82,7 @@ func CheckPackHashVariesOnVariations(packType api.PackType, pack rio.PackFunc) {
 			{"AlphaDiffPerm", FixtureAlphaDiffPerm},
 			{"AlphaDiffPerm2", FixtureAlphaDiffPerm2},
 			{"AlphaDiffPerm3", FixtureAlphaDiffPerm3},
+			{"AlphaDiffSetuid", FixtureAlphaDiffSetuid},
 			{"AlphaDiffUidGid", FixtureAlphaDiffUidGid},
 		} {
 			Convey(fmt.Sprintf("- Fixture %q vs %q", "Alpha", fixture.Name), func() {
@@ -104,6 +106,86 @@ func CheckPackHashVariesOnVariations(packType api.PackType, pack rio.PackFunc) {
 			})
 		}
 	})
+	Convey("SPEC: Applying the PackFunc to an empty dir should vary in result hash from the same dir with a file in it", func() {
+		var wareIDs []api.WareID
+		for _, files := range [][]FixtureFile{FixtureEmptyDir, FixtureEmptyDirDiffFilled} {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				PlaceFixture(osfs.New(tmpDir), files)
+				wareID, err := pack(
+					context.Background(),
+					packType,
+					tmpDir.String(),
+					api.Filter_NoMutation,
+					"",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				wareIDs = append(wareIDs, wareID)
+			})
+		}
+		So(wareIDs[0], ShouldNotResemble, wareIDs[1])
+	})
+	Convey("SPEC: Applying the PackFunc to a fileset differing only in xattrs should not vary in result hash (unless config keeps them)", func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir)
+			PlaceFixture(afs, FixtureAlphaDiffXattr)
+			wareID, err := pack(
+				context.Background(),
+				packType,
+				tmpDir.String(),
+				api.Filter_NoMutation,
+				"",
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			So(wareID, ShouldResemble, wareIDAlpha)
+		})
+	})
+}
+
+func CheckPackHashCollapsesUnderFilters(packType api.PackType, pack rio.PackFunc) {
+	packFixture := func(files []FixtureFile, filt api.FilesetFilters) (wareID api.WareID) {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			PlaceFixture(osfs.New(tmpDir), files)
+			var err error
+			wareID, err = pack(
+				context.Background(),
+				packType,
+				tmpDir.String(),
+				filt,
+				"",
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+		})
+		return
+	}
+	Convey("SPEC: Applying the PackFunc with filters should erase the variations they cover", func() {
+		for _, fixture := range []struct {
+			Name   string
+			Files  []FixtureFile
+			Filter api.FilesetFilters
+		}{
+			{"AlphaDiffTime", FixtureAlphaDiffTime, api.FilesetFilters{Uid: "keep", Gid: "keep", Mtime: "2010-01-01T00:00:00Z", Sticky: "keep"}},
+			{"AlphaDiffUidGid", FixtureAlphaDiffUidGid, api.FilesetFilters{Uid: "0", Gid: "0", Mtime: "keep", Sticky: "keep"}},
+		} {
+			Convey(fmt.Sprintf("- Fixture %q vs %q, with filter %v", "Alpha", fixture.Name, fixture.Filter), func() {
+				// Distinct when kept...
+				So(packFixture(fixture.Files, api.Filter_NoMutation), ShouldNotResemble, packFixture(FixtureAlpha, api.Filter_NoMutation))
+				// ... but the same once filtered.
+				So(packFixture(fixture.Files, fixture.Filter), ShouldResemble, packFixture(FixtureAlpha, fixture.Filter))
+			})
+		}
+	})
+	Convey("SPEC: Filters left empty should mean the pack defaults, exactly as if they were spelled out", func() {
+		defaulted := packFixture(FixtureGamma, api.Filter_DefaultFlatten)
+		So(packFixture(FixtureGamma, api.FilesetFilters{}), ShouldResemble, defaulted)
+		// Per field, too: only the ones given differ from the defaults.
+		explicit := api.Filter_DefaultFlatten
+		explicit.Mtime = "keep"
+		So(packFixture(FixtureGamma, api.FilesetFilters{Mtime: "keep"}), ShouldResemble, packFixture(FixtureGamma, explicit))
+		So(packFixture(FixtureGamma, api.FilesetFilters{Mtime: "keep"}), ShouldNotResemble, defaulted)
+	})
 }
 
 func CheckPackErrorsGracefully(packType api.PackType, pack rio.PackFunc) {
@@ -123,6 +205,25 @@ func CheckPackErrorsGracefully(packType api.PackType, pack rio.PackFunc) {
 				So(wareID.Hash, ShouldEqual, "")
 				So(wareID.String(), ShouldEqual, packType+":-")
 			})
+			Convey("Packing with a filter value that means nothing should be refused, before anything's read", func() {
+				for _, filt := range []api.FilesetFilters{
+					{Mtime: "kepe"},
+					{Uid: "-1"},
+					{Gid: "root"},
+					{Sticky: "maybe"},
+					{Uid: "mine"}, // "mine" only means something when unpacking.
+				} {
+					_, err := pack(
+						context.Background(),
+						packType,
+						tmpDir.String()+"/nonexistent",
+						filt,
+						"",
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				}
+			})
 		})
 	})
 }
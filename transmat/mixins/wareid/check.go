@@ -0,0 +1,52 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package wareid
+
+import (
+	"fmt"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	Hash the buckets an unpack filled: what the ware said, and what was
+	placed after filters.  The first is what verifies the ware.
+
+	If nothing that was applied could have altered the hash, the two had
+	better be the same; if they're not, that's a bug in the transmat (or
+	the filters), and we panic.
+*/
+func (h Hasher) WareIDs(prefilter, filtered fshash.Bucket, hashAltering bool) (prefilterWareID, filteredWareID api.WareID) {
+	prefilterWareID, filteredWareID = h.WareID(prefilter), h.WareID(filtered)
+	if !hashAltering && prefilterWareID != filteredWareID {
+		panic(fmt.Errorf("prefilterHash %q != filteredHash %q", prefilterWareID.Hash, filteredWareID.Hash))
+	}
+	return
+}
+
+/*
+	Check the ware's hash came out as expected.  A mismatch IS an error;
+	but the caller should return the (filtered) hash we got either way.
+
+	Errors are of category `rio.ErrWareHashMismatch`.
+*/
+func Check(expected, prefilterWareID, filteredWareID api.WareID) error {
+	if prefilterWareID == expected {
+		return nil
+	}
+	return ErrorDetailed(
+		rio.ErrWareHashMismatch,
+		fmt.Sprintf("hash mismatch: expected %q, got %q (filtered %q)", expected, prefilterWareID, filteredWareID),
+		map[string]string{
+			"expected": expected.String(),
+			"actual":   prefilterWareID.String(),
+			"filtered": filteredWareID.String(),
+		},
+	)
+}
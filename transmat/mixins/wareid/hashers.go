@@ -0,0 +1,112 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Hashing filesets into WareIDs, and checking them.
+
+	Every transmat hashes its filesets the same way (see fshash), and
+	picks the hash the same way: from the WareID, when unpacking one, and
+	from what it's asked for (or the default), when packing.  So that's
+	all here, rather than in each transmat.
+*/
+package wareid
+
+import (
+	"crypto/sha512"
+	"hash"
+	"strings"
+
+	"github.com/polydawn/refmt/misc"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	Algorithm selects the hash the WareID (and every file's content
+	hash within it) is computed with.
+
+	The algorithm is recorded in the WareID's hash string, as a prefix
+	before a "-" (which base58 never contains): "tar:sha512-3vQB7B6M...".
+	The default algorithm has no prefix, so every WareID from before there
+	was a choice still means what it did.
+*/
+type Algorithm string
+
+const (
+	/*
+		SHA-384, base58 encoded.  The default, and the only choice there
+		used to be.
+	*/
+	Algorithm_SHA384 Algorithm = ""
+
+	/*
+		SHA-512, base58 encoded, prefixed "sha512-".
+	*/
+	Algorithm_SHA512 Algorithm = "sha512"
+)
+
+var algorithms = map[Algorithm]func() hash.Hash{
+	Algorithm_SHA384: sha512.New384,
+	Algorithm_SHA512: sha512.New,
+}
+
+/*
+	The hash used both for each file's contents and for the tree as a whole,
+	and the pack type the WareIDs it makes are of.  Pack, unpack, scan, and
+	diff all get theirs from here, so they agree.
+*/
+type Hasher struct {
+	PackType api.PackType
+	Algo     Algorithm
+	New      func() hash.Hash
+}
+
+/*
+	The hasher for when there's no WareID to say otherwise (as when packing,
+	or scanning).
+*/
+func Default(packType api.PackType) Hasher {
+	return Hasher{packType, Algorithm_SHA384, sha512.New384}
+}
+
+/*
+	Look up the hasher for an algorithm, or return ErrUsage if we don't have it.
+*/
+func For(packType api.PackType, algo Algorithm) (Hasher, error) {
+	newHash, ok := algorithms[algo]
+	if !ok {
+		return Hasher{}, Errorf(rio.ErrUsage, "unsupported hash algorithm %q", algo)
+	}
+	return Hasher{packType, algo, newHash}, nil
+}
+
+/*
+	Look up the hasher a WareID was made with, so we can verify it.
+	Returns ErrUsage for algorithms we don't know.
+*/
+func Lookup(wareID api.WareID) (Hasher, error) {
+	var algo Algorithm
+	if i := strings.IndexByte(wareID.Hash, '-'); i > 0 {
+		algo = Algorithm(wareID.Hash[:i])
+	}
+	h, err := For(wareID.Type, algo)
+	if err != nil {
+		return h, Errorf(rio.ErrUsage, "cannot verify ware %s: %s", wareID, err)
+	}
+	return h, nil
+}
+
+/*
+	Hash the bucket into a WareID.
+*/
+func (h Hasher) WareID(bucket fshash.Bucket) api.WareID {
+	encoded := misc.Base58Encode(fshash.HashBucket(bucket, h.New))
+	if h.Algo != Algorithm_SHA384 {
+		encoded = string(h.Algo) + "-" + encoded
+	}
+	return api.WareID{h.PackType, encoded}
+}
@@ -0,0 +1,64 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package wareid
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+func TestWareIDs(t *testing.T) {
+	bucket := func(mode fs.Perms) fshash.Bucket {
+		b := &fshash.MemoryBucket{}
+		b.AddRecord(fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: mode}, nil)
+		return b
+	}
+	Convey("WareIDs and their hashers:", t, func() {
+		Convey("the default hasher makes unprefixed hashes, which look up the same hasher", func() {
+			wareID := Default("tar").WareID(bucket(0755))
+			So(wareID.Type, ShouldEqual, api.PackType("tar"))
+			So(wareID.Hash, ShouldNotContainSubstring, "-")
+			h, err := Lookup(wareID)
+			So(err, ShouldBeNil)
+			So(h.Algo, ShouldEqual, Algorithm_SHA384)
+			So(h.WareID(bucket(0755)), ShouldResemble, wareID)
+		})
+		Convey("other algorithms prefix their hashes, and are looked up by the prefix", func() {
+			h, err := For("zip", Algorithm_SHA512)
+			So(err, ShouldBeNil)
+			wareID := h.WareID(bucket(0755))
+			So(wareID.Hash, ShouldStartWith, "sha512-")
+			h2, err := Lookup(wareID)
+			So(err, ShouldBeNil)
+			So(h2.Algo, ShouldEqual, Algorithm_SHA512)
+			So(h2.WareID(bucket(0755)), ShouldResemble, wareID)
+		})
+		Convey("unknown algorithms are a usage error", func() {
+			_, err := Lookup(api.WareID{"tar", "md5-abcd"})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+		Convey("Check accepts the expected hash, and rejects others", func() {
+			h := Default("tar")
+			a, b := h.WareID(bucket(0755)), h.WareID(bucket(0700))
+			So(Check(a, a, b), ShouldBeNil)
+			err := Check(a, b, b)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+			So(errcat.Details(err)["expected"], ShouldEqual, a.String())
+			So(errcat.Details(err)["actual"], ShouldEqual, b.String())
+		})
+		Convey("WareIDs panics if buckets disagree when nothing should have altered them", func() {
+			h := Default("tar")
+			So(func() { h.WareIDs(bucket(0755), bucket(0700), true) }, ShouldNotPanic)
+			So(func() { h.WareIDs(bucket(0755), bucket(0700), false) }, ShouldPanic)
+		})
+	})
+}
@@ -0,0 +1,41 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The nar transmat packs filesystems into Nix's NAR format ("Nix
+	ARchive"), and unpacks NARs (such as a Nix binary cache serves, xz'd
+	or not) back onto filesystems.  It can use any k/v-styled warehouse
+	for storage (just like the tar transmat).
+
+	NAR holds very little: names, file contents, whether a file is
+	executable, and symlink targets.  No owners, no mtimes, no other perms,
+	no xattrs, and no device nodes, fifos, or sockets (packing any of those
+	last is ErrPackInvalid).  So a fileset is normalized as it's packed, the
+	way the Nix store normalizes what it holds:
+
+	  - uid and gid are 0;
+	  - mtimes are apiutil.DefaultMtime (as for dirs tar leaves implicit);
+	  - files are 0755 if the owner could execute them, and 0644 if not;
+	  - dirs are 0755, and symlinks 0777;
+	  - xattrs are dropped.
+
+	The WareID is computed over that normalized fileset, by the same means
+	the tar transmat uses: so the WareID is the same for a fileset packed
+	here as for the same fileset, normalized likewise, packed as tar.
+	It is *not* the Nix narHash (that's a sha256 of the NAR bytes); but NAR
+	is canonical -- a fileset has exactly one NAR -- so the narHash of a
+	ware can be had by hashing it.  Unpacking places the normalized
+	metadata (with filters applied, as ever).
+
+	A NAR's root can be a file or a symlink, where a fileset's is always a
+	dir; unpacking such a NAR is an error.
+*/
+package nartrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("nar")
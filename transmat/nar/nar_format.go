@@ -0,0 +1,193 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package nartrans
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+)
+
+const (
+	narMagic = "nix-archive-1"
+
+	// Longest name we'll unpack (NAME_MAX), and longest symlink target (PATH_MAX).
+	//  Nothing else in a NAR but file contents is longer than a few bytes.
+	maxNameLen   = 255
+	maxTargetLen = 4096
+)
+
+/*
+	Flatten metadata to what a NAR can say about it; see the package docs.
+	Returns ErrPackInvalid for the types NAR has no place for.
+*/
+func normalize(fmeta *fs.Metadata) error {
+	switch fmeta.Type {
+	case fs.Type_File:
+		if fmeta.Perms&0100 != 0 {
+			fmeta.Perms = 0755
+		} else {
+			fmeta.Perms = 0644
+		}
+	case fs.Type_Dir:
+		fmeta.Perms = 0755
+	case fs.Type_Symlink:
+		fmeta.Perms = 0777
+	case fs.Type_Socket:
+		return Errorf(rio.ErrPackInvalid, "can't pack sockets into nar")
+	default:
+		return Errorf(rio.ErrPackInvalid, "can't pack %q into nar: nar has no place for a %s", fmeta.Name, fmeta.Type)
+	}
+	fmeta.Uid, fmeta.Gid = 0, 0
+	fmeta.Mtime = apiutil.DefaultMtime
+	fmeta.Devmajor, fmeta.Devminor = 0, 0
+	fmeta.Xattrs = nil
+	return nil
+}
+
+/*
+	Writes the tokens of a NAR.  Every token is a string: a little-endian
+	uint64 length, the bytes, then zeros to the next multiple of 8.
+*/
+type narWriter struct {
+	w io.Writer
+}
+
+func (nw narWriter) str(tokens ...string) error {
+	for _, s := range tokens {
+		if err := nw.length(uint64(len(s))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(nw.w, s); err != nil {
+			return err
+		}
+		if err := nw.pad(int64(len(s))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write file contents as a string token, copying exactly size bytes from body.
+//  If body ends short, that's io.ErrUnexpectedEOF, and the NAR is ruined.
+func (nw narWriter) contents(size int64, body io.Reader) error {
+	if err := nw.length(uint64(size)); err != nil {
+		return err
+	}
+	n, err := io.Copy(nw.w, io.LimitReader(body, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nw.pad(size)
+}
+
+func (nw narWriter) length(n uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	_, err := nw.w.Write(buf[:])
+	return err
+}
+
+func (nw narWriter) pad(n int64) error {
+	var zeros [8]byte
+	_, err := nw.w.Write(zeros[:(8-n%8)%8])
+	return err
+}
+
+/*
+	Reads the tokens of a NAR.
+	Errors are ErrWareCorrupt (or whatever the underlying reader said).
+*/
+type narReader struct {
+	r io.Reader
+}
+
+func (nr narReader) length() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(nr.r, buf[:]); err != nil {
+		return 0, nr.eof(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// Read a string token no longer than max.
+func (nr narReader) str(max int) (string, error) {
+	n, err := nr.length()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(max) {
+		return "", Errorf(rio.ErrWareCorrupt, "corrupt nar: a string of %d bytes, where at most %d make sense", n, max)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(nr.r, buf); err != nil {
+		return "", nr.eof(err)
+	}
+	return string(buf), nr.pad(int64(n))
+}
+
+// Read string tokens, and insist they're the ones given.
+func (nr narReader) expect(tokens ...string) error {
+	for _, want := range tokens {
+		got, err := nr.str(len(want))
+		if err != nil {
+			if Category(err) == rio.ErrWareCorrupt {
+				return Errorf(rio.ErrWareCorrupt, "corrupt nar: expected %q", want)
+			}
+			return err
+		}
+		if got != want {
+			return Errorf(rio.ErrWareCorrupt, "corrupt nar: expected %q, got %q", want, got)
+		}
+	}
+	return nil
+}
+
+// Read the padding after a string of n bytes.  Nix insists it's zeros; so do we.
+func (nr narReader) pad(n int64) error {
+	var buf [8]byte
+	pad := buf[:(8-n%8)%8]
+	if _, err := io.ReadFull(nr.r, pad); err != nil {
+		return nr.eof(err)
+	}
+	for _, b := range pad {
+		if b != 0 {
+			return Errorf(rio.ErrWareCorrupt, "corrupt nar: nonzero padding")
+		}
+	}
+	return nil
+}
+
+// Skip the rest of a body of which the LimitedReader is left, and the padding after.
+func (nr narReader) finish(body *io.LimitedReader, size int64) error {
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return nr.eof(err)
+	}
+	if body.N > 0 {
+		return Errorf(rio.ErrWareCorrupt, "corrupt nar: unexpected EOF")
+	}
+	return nr.pad(size)
+}
+
+// Categorize a read error.  Anything the stream says that isn't ours
+//  already is the ware's fault: a bad checksum in the compression, say.
+func (nr narReader) eof(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Errorf(rio.ErrWareCorrupt, "corrupt nar: unexpected EOF")
+	}
+	if _, ok := err.(Error); ok {
+		return err
+	}
+	return Errorf(rio.ErrWareCorrupt, "corrupt nar: %s", err)
+}
@@ -0,0 +1,230 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package nartrans
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters.  Checked, but there's nothing left for them to do: see the package docs.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+	}
+	if _, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Short-circuit exit if the path does not exist.
+	afs := osfs.New(path)
+	fmeta, err := afs.LStat(fs.RelPath{})
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return api.WareID{PackType, ""}, nil
+	default:
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+	if fmeta.Type != fs.Type_Dir {
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot pack %s: a fileset's root must be a dir", path)
+	}
+
+	// Connect to warehouse, and get write controller opened.
+	//  The warehouses don't care what's in a ware; the tar transmat's dialing serves for us too.
+	wc, err := tartrans.OpenWriteController(warehouseAddr, packType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Scan and nar!  NARs are all small writes; buffer them.
+	buf := bufio.NewWriter(wc)
+	wareID, err := packNar(ctx, afs, narWriter{buf}, mon)
+	if err != nil {
+		return wareID, err
+	}
+	if err := buf.Flush(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+
+	// If we made it all the way with no errors, commit.
+	//  (Otherwise, the write controller will be closed by default by our defers.)
+	return wareID, wc.Commit(wareID)
+}
+
+func packNar(
+	ctx context.Context,
+	afs fs.FS,
+	nw narWriter,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	bucket := &fshash.MemoryBucket{}
+	hasher := wareid.Default(PackType)
+
+	// Report bytes hashed as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	writeErr := func(err error) error {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+
+	// A NAR nests each dir's entries inside it, but the walk only says when
+	//  a dir starts: so keep the dirs still open, and close them as the walk
+	//  moves on out of each.  The root closes with one paren; the rest with
+	//  two, since each is a node inside an entry.
+	var open []fs.RelPath
+	closeTo := func(dir *fs.RelPath) error {
+		for len(open) > 0 && (dir == nil || open[len(open)-1] != *dir) {
+			closing := open[len(open)-1]
+			open = open[:len(open)-1]
+			if closing == (fs.RelPath{}) {
+				if err := nw.str(")"); err != nil {
+					return writeErr(err)
+				}
+				continue
+			}
+			if err := nw.str(")", ")"); err != nil {
+				return writeErr(err)
+			}
+		}
+		return nil
+	}
+
+	if err := nw.str(narMagic); err != nil {
+		return api.WareID{}, writeErr(err)
+	}
+
+	// Walk the filesystem in order (which is the order NAR wants, too),
+	//  emitting NAR nodes and filling the bucket as we go.
+	err := fsOp.Walk(afs, fs.RelPath{}, func(path fs.RelPath, _ *fs.Metadata) error {
+		// Consider cancellation.
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Open file.
+		fmeta, file, err := fsOp.ScanFile(afs, path)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+
+		// Normalize, which is the only filtering a NAR leaves room for.
+		if err := normalize(fmeta); err != nil {
+			return err
+		}
+
+		// Close whatever dirs we've walked out of, and open an entry, unless this is the root.
+		if path != (fs.RelPath{}) {
+			dir := path.Dir()
+			if err := closeTo(&dir); err != nil {
+				return err
+			}
+			if err := nw.str("entry", "(", "name", path.Last(), "node"); err != nil {
+				return writeErr(err)
+			}
+		}
+
+		// Emit the node, and record the metadata in the bucket for the total hash.
+		//  Dirs stay open until the walk leaves them.
+		switch fmeta.Type {
+		case fs.Type_File:
+			if err := nw.str("(", "type", "regular"); err != nil {
+				return writeErr(err)
+			}
+			if fmeta.Perms&0100 != 0 {
+				if err := nw.str("executable", ""); err != nil {
+					return writeErr(err)
+				}
+			}
+			if err := nw.str("contents"); err != nil {
+				return writeErr(err)
+			}
+			contentHasher := hasher.New()
+			if err := nw.contents(fmeta.Size, io.TeeReader(file, contentHasher)); err != nil {
+				if ctx.Err() != nil {
+					return Errorf(rio.ErrCancelled, "cancelled")
+				}
+				return Errorf(rio.ErrPackInvalid, "error while packing %q: %s", path, err)
+			}
+			if err := nw.str(")"); err != nil {
+				return writeErr(err)
+			}
+			bucket.AddRecord(*fmeta, contentHasher.Sum(nil))
+			prog.Add(fmeta.Size, fmeta.Name)
+		case fs.Type_Symlink:
+			if err := nw.str("(", "type", "symlink", "target", fmeta.Linkname, ")"); err != nil {
+				return writeErr(err)
+			}
+			bucket.AddRecord(*fmeta, nil)
+		case fs.Type_Dir:
+			if err := nw.str("(", "type", "directory"); err != nil {
+				return writeErr(err)
+			}
+			open = append(open, path)
+			bucket.AddRecord(*fmeta, nil)
+			return nil
+		}
+
+		// Files and symlinks close their entry right away.
+		if path != (fs.RelPath{}) {
+			if err := nw.str(")"); err != nil {
+				return writeErr(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if err := closeTo(nil); err != nil {
+		return api.WareID{}, err
+	}
+
+	// Hash the thing!
+	wareID := hasher.WareID(bucket)
+	prog.Done()
+	return wareID, nil
+}
@@ -0,0 +1,92 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package nartrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func packFixture(files []tests.FixtureFile) (api.WareID, error) {
+	var wareID api.WareID
+	var err error
+	testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		tests.PlaceFixture(osfs.New(tmpDir), files)
+		wareID, err = Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+	})
+	return wareID, err
+}
+
+func TestNarPack(t *testing.T) {
+	Convey("Spec compliance: Nar pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+			Convey("Packing a fixture twice should produce the same hash", func() {
+				for _, fixture := range tests.AllFixtures {
+					if fixture.Name == "Specials" {
+						continue
+					}
+					Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+						wareID1, err := packFixture(fixture.Files)
+						So(err, ShouldBeNil)
+						wareID2, err := packFixture(fixture.Files)
+						So(err, ShouldBeNil)
+						So(wareID1, ShouldResemble, wareID2)
+					})
+				}
+			})
+		}),
+	)
+}
+
+func TestNarPackNormalizes(t *testing.T) {
+	Convey("Nar transmat: pack keeps only what a NAR can hold", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			alpha, err := packFixture(tests.FixtureAlpha)
+			So(err, ShouldBeNil)
+			Convey("differences a NAR can't hold should not change the hash", func() {
+				for _, fixture := range []struct {
+					Name  string
+					Files []tests.FixtureFile
+				}{
+					{"AlphaDiffTime", tests.FixtureAlphaDiffTime},
+					{"AlphaDiffPerm", tests.FixtureAlphaDiffPerm},
+					{"AlphaDiffSetuid", tests.FixtureAlphaDiffSetuid},
+					{"AlphaDiffUidGid", tests.FixtureAlphaDiffUidGid},
+					{"AlphaDiffXattr", tests.FixtureAlphaDiffXattr},
+				} {
+					wareID, err := packFixture(fixture.Files)
+					So(err, ShouldBeNil)
+					So(wareID, ShouldResemble, alpha)
+				}
+			})
+			Convey("differences a NAR can hold should change it", func() {
+				wareID, err := packFixture(tests.FixtureAlphaDiffContent)
+				So(err, ShouldBeNil)
+				So(wareID, ShouldNotResemble, alpha)
+				executable := append([]tests.FixtureFile(nil), tests.FixtureAlpha...)
+				executable[1].Metadata.Perms = 0700
+				wareID, err = packFixture(executable)
+				So(err, ShouldBeNil)
+				So(wareID, ShouldNotResemble, alpha)
+			})
+			Convey("types a NAR has no place for should be refused", func() {
+				_, err := packFixture(tests.FixtureSpecials)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+			})
+		}),
+	)
+}
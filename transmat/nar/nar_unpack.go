@@ -0,0 +1,307 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package nartrans
+
+import (
+	"context"
+	"io"
+	"math"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackNar(ctx, hasher, osfs.New(path2), filt2, reader, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+func unpackNar(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Wrap input stream with decompression as necessary.
+	//  Binary caches serve NARs xz'd, mostly.
+	reader2, err := tartrans.Decompress(reader)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt nar compression: %s", err)
+	}
+	nr := narReader{reader2}
+
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
+	// we keep a second, separate one for the filtered data, which will compute a different hash.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Report bytes written as we go.  (A NAR doesn't say how long it is.)
+	prog := progress.New(mon, "unpack", 0)
+
+	// Place a node, with its body if it's a file; and put it in the buckets.
+	place := func(fmeta fs.Metadata, body io.Reader) error {
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt, &filteredFmeta)
+		var hashing *util.HashingReader
+		if body != nil {
+			hashing = &util.HashingReader{body, hasher.New()}
+			body = hashing
+		}
+		if err := fsOp.PlaceFileWithPolicy(afs, filteredFmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		if hashing == nil {
+			prefilterBucket.AddRecord(fmeta, nil)
+			filteredBucket.AddRecord(filteredFmeta, nil)
+			return nil
+		}
+		contentHash := hashing.Hasher.Sum(nil)
+		prefilterBucket.AddRecord(fmeta, contentHash)
+		filteredBucket.AddRecord(filteredFmeta, contentHash)
+		prog.Add(fmeta.Size, fmeta.Name)
+		return nil
+	}
+
+	// Parse and place, depth first, as the NAR nests.
+	if err := nr.expect(narMagic); err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	var parseNode func(path fs.RelPath) error
+	parseNode = func(path fs.RelPath) error {
+		if err := nr.expect("(", "type"); err != nil {
+			return err
+		}
+		typ, err := nr.str(len("directory"))
+		if err != nil {
+			return err
+		}
+		if path == (fs.RelPath{}) && typ != "directory" {
+			return Errorf(rio.ErrWareCorrupt, "cannot unpack a nar whose root is a %s: a fileset's root must be a dir", typ)
+		}
+		fmeta := fs.Metadata{Name: path}
+		switch typ {
+		case "regular":
+			fmeta.Type = fs.Type_File
+			token, err := nr.str(len("executable"))
+			if err != nil {
+				return err
+			}
+			if token == "executable" {
+				fmeta.Perms = 0100
+				if err := nr.expect("", "contents"); err != nil {
+					return err
+				}
+			} else if token != "contents" {
+				return Errorf(rio.ErrWareCorrupt, "corrupt nar: expected \"contents\", got %q", token)
+			}
+			size, err := nr.length()
+			if err != nil {
+				return err
+			}
+			if size > math.MaxInt64 {
+				return Errorf(rio.ErrWareCorrupt, "corrupt nar: %q claims to be %d bytes", path, size)
+			}
+			fmeta.Size = int64(size)
+			normalize(&fmeta)
+			body := &io.LimitedReader{R: nr.r, N: fmeta.Size}
+			if err := place(fmeta, body); err != nil {
+				return err
+			}
+			if err := nr.finish(body, fmeta.Size); err != nil {
+				return err
+			}
+		case "symlink":
+			fmeta.Type = fs.Type_Symlink
+			if err := nr.expect("target"); err != nil {
+				return err
+			}
+			fmeta.Linkname, err = nr.str(maxTargetLen)
+			if err != nil {
+				return err
+			}
+			if fmeta.Linkname == "" {
+				return Errorf(rio.ErrWareCorrupt, "corrupt nar: symlink %q has no target", path)
+			}
+			normalize(&fmeta)
+			if err := place(fmeta, nil); err != nil {
+				return err
+			}
+		case "directory":
+			fmeta.Type = fs.Type_Dir
+			normalize(&fmeta)
+			if err := place(fmeta, nil); err != nil {
+				return err
+			}
+			// Entries, in strictly increasing order of name, till the dir closes.
+			var prev string
+			for {
+				token, err := nr.str(len("entry"))
+				if err != nil {
+					return err
+				}
+				if token == ")" {
+					return nil
+				}
+				if token != "entry" {
+					return Errorf(rio.ErrWareCorrupt, "corrupt nar: expected \"entry\", got %q", token)
+				}
+				if err := nr.expect("(", "name"); err != nil {
+					return err
+				}
+				name, err := nr.str(maxNameLen)
+				if err != nil {
+					return err
+				}
+				if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+					return Errorf(rio.ErrWareCorrupt, "corrupt nar: %q is not a valid name, in %q", name, path)
+				}
+				if name <= prev {
+					return Errorf(rio.ErrWareCorrupt, "corrupt nar: entries in %q are out of order, or repeat (%q after %q)", path, name, prev)
+				}
+				prev = name
+				if err := nr.expect("node"); err != nil {
+					return err
+				}
+				if err := parseNode(path.Join(fs.MustRelPath(name))); err != nil {
+					return err
+				}
+				if err := nr.expect(")"); err != nil {
+					return err
+				}
+			}
+		default:
+			return Errorf(rio.ErrWareCorrupt, "corrupt nar: %q is of no type we know (%q)", path, typ)
+		}
+		return nr.expect(")")
+	}
+	if err := parseNode(fs.RelPath{}); err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
@@ -0,0 +1,148 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package nartrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestNarUnpack(t *testing.T) {
+	Convey("Nar transmat: round trip", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			for _, fixture := range tests.AllFixtures {
+				if fixture.Name == "Specials" {
+					continue
+				}
+				Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+					testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+						defer os.Unsetenv("RIO_CACHE")
+						os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+						addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir))
+						osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+						fixturePath := tmpDir.Join(fs.MustRelPath("fixture"))
+						tests.PlaceFixture(osfs.New(fixturePath), fixture.Files)
+						wareID, err := Pack(context.Background(), PackType, fixturePath.String(), api.Filter_NoMutation, addr, rio.Monitor{})
+						So(err, ShouldBeNil)
+						unpackPath := tmpDir.Join(fs.MustRelPath("unpack"))
+						wareID2, err := Unpack(context.Background(), wareID, unpackPath.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{addr}, rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(wareID2, ShouldResemble, wareID)
+
+						// What's on disk should be the fixture, normalized.
+						afs := osfs.New(unpackPath)
+						for _, file := range fixture.Files {
+							fmeta, reader, err := fsOp.ScanFile(afs, file.Metadata.Name)
+							So(err, ShouldBeNil)
+							expect := file.Metadata
+							So(normalize(&expect), ShouldBeNil)
+							So(fmeta.Perms, ShouldEqual, expect.Perms)
+							So(fmeta.Mtime.UTC(), ShouldResemble, apiutil.DefaultMtime)
+							So(fmeta.Linkname, ShouldEqual, expect.Linkname)
+							if file.Metadata.Type == fs.Type_File {
+								body, _ := ioutil.ReadAll(reader)
+								So(string(body), ShouldResemble, string(file.Body))
+							}
+						}
+					})
+				})
+			}
+		}),
+	)
+}
+
+func TestNarUnpackForeign(t *testing.T) {
+	Convey("Nar transmat: unpacking NARs written by hand", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.nar", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				writeNar := func(tokens ...string) {
+					var buf bytes.Buffer
+					So(narWriter{&buf}.str(tokens...), ShouldBeNil)
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.nar", buf.Bytes(), 0644), ShouldBeNil)
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				Convey("a NAR as Nix writes it should unpack, executable bits and all", func() {
+					writeNar(narMagic, "(", "type", "directory",
+						"entry", "(", "name", "bin", "node", "(", "type", "directory",
+						"entry", "(", "name", "hello", "node", "(", "type", "regular", "executable", "", "contents", "#!/bin/sh\n", ")", ")",
+						")", ")",
+						"entry", "(", "name", "lib", "node", "(", "type", "symlink", "target", "bin", ")", ")",
+						"entry", "(", "name", "readme", "node", "(", "type", "regular", "contents", "hi", ")", ")",
+						")",
+					)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					fi, err := os.Lstat(tmpDir.String() + "/out/bin/hello")
+					So(err, ShouldBeNil)
+					So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0755))
+					fi, err = os.Lstat(tmpDir.String() + "/out/readme")
+					So(err, ShouldBeNil)
+					So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0644))
+					target, err := os.Readlink(tmpDir.String() + "/out/lib")
+					So(err, ShouldBeNil)
+					So(target, ShouldEqual, "bin")
+				})
+				Convey("entries out of order should be corruption", func() {
+					writeNar(narMagic, "(", "type", "directory",
+						"entry", "(", "name", "b", "node", "(", "type", "regular", "contents", "", ")", ")",
+						"entry", "(", "name", "a", "node", "(", "type", "regular", "contents", "", ")", ")",
+						")",
+					)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a name that leaves the dir should be corruption", func() {
+					writeNar(narMagic, "(", "type", "directory",
+						"entry", "(", "name", "..", "node", "(", "type", "regular", "contents", "", ")", ")",
+						")",
+					)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a NAR of just one file should be refused", func() {
+					writeNar(narMagic, "(", "type", "regular", "contents", "hi", ")")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a truncated NAR should be corruption", func() {
+					writeNar(narMagic, "(", "type", "directory")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,61 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The oci-layer transmat packs filesets into OCI image layers (gzipped
+	tars, per the OCI image spec, as Docker and container registries use
+	them) and unpacks layers back onto filesystems.
+
+	The WareID is the fileset hash, computed exactly as the tar transmat
+	computes it; the layer's own digests (of the blob, and of the tar
+	inside it, which the image config calls the "diff_id") are a separate
+	matter, and PackLayer returns them, for building image manifests with.
+
+	What makes a layer a layer is deletion.  Both kinds OCI has are
+	translated to and from the way overlayfs keeps them on disk, so an
+	overlayfs upper dir packs as the layer it describes:
+
+	  - A whiteout (".wh." in front of a name) deletes that name from
+	    whatever the layer is unpacked onto.  On disk, it's a char device
+	    numbered 0/0.  (See tartrans.LayerTarHdrToMetadata; the plain tar
+	    transmat takes ".wh." entries for the files they are.)
+	  - An opaque dir (a ".wh..wh..opq" entry in it) has everything that
+	    was in it before the layer deleted.  On disk, it's a dir with the
+	    xattr "trusted.overlay.opaque" set to "y".
+
+	Unpacking applies the layer over what's at the target path already:
+	each entry replaces whatever was at its name, except that a dir over a
+	dir keeps what's in it (see fsOp.PlaceFileOver).  So layering only
+	means something with placement mode "direct"; with the cache in play,
+	a layer is unpacked into an empty dir, and deletes nothing.
+	Either way, the deletions are part of the WareID, and what's on disk
+	afterwards has no trace of them (no device nodes, no xattrs).
+
+	PackImage goes the rest of the way to a container image: it packs each
+	ware of an assembly (as stitch places them) as a layer at its path,
+	and writes the layers, an image config, and a manifest out as an OCI
+	image layout, which container tools can run or push as is.
+*/
+package ocilayer
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("oci-layer")
+
+const (
+	// The media type of every layer we pack.
+	MediaType_LayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// The entry that makes the dir it's in opaque.
+	opaqueMarker = ".wh..wh..opq"
+
+	// The xattr that makes a dir opaque, on disk.
+	opaqueXattr = "trusted.overlay.opaque"
+
+	// The prefix of whiteout names, which can't be packed as anything else.
+	whiteoutPrefix = ".wh."
+)
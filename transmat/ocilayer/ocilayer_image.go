@@ -0,0 +1,314 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/cache"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/stitch"
+	"go.polydawn.net/rio/transmat/mixins/log"
+)
+
+const (
+	MediaType_ImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaType_ImageConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaType_ImageIndex    = "application/vnd.oci.image.index.v1+json"
+
+	// The annotation an image layout's index tags images with.
+	annotation_RefName = "org.opencontainers.image.ref.name"
+)
+
+/*
+	What goes in an image's config besides its layers: how to run it.
+	Blank fields are left out, but for Architecture and OS, which default
+	to this host's and "linux".
+*/
+type ImageConfig struct {
+	Architecture string
+	OS           string
+	Entrypoint   []string
+	Cmd          []string
+	Env          []string // "KEY=value" each.
+	WorkingDir   string
+	User         string
+	Tag          string // Optionally: the name to tag the image with in the layout's index.
+}
+
+/*
+	What PackImage made: the layers, in order, and the digests of the
+	config and manifest, each as stored in the layout.
+*/
+type ImageDescriptor struct {
+	Layers         []LayerDescriptor
+	ConfigDigest   string
+	ManifestDigest string
+}
+
+/*
+	Pack an assembly -- wares at paths, as stitch.Assembler places them --
+	into an OCI image, one layer per part, and write it out as an OCI image
+	layout at layoutPath (which is made if need be; blobs already there
+	are kept, so several images can share a layout).
+
+	The parts are layered in the order they'd be placed (parents first),
+	each at its path; so the image's filesystem is what the assembly
+	gives.  As in an assembly, a part hides whatever earlier parts put
+	at its path: its root dir is made opaque.  The dirs above a part's
+	path, if no earlier layer has them, are left for the runtime to make.
+
+	Each part is fetched into the cache with unpackTool, as the assembler
+	does, and packed from there with the given filters; each layer's
+	WareID is the hash of the layer as the oci-layer transmat would
+	unpack it.  Mounts can't be packed, and are rejected.
+*/
+func PackImage(
+	ctx context.Context, // Long-running call.  Cancellable.
+	unpackTool rio.UnpackFunc, // Fetches the parts into the cache.
+	parts []stitch.UnpackSpec, // The assembly.  Each part's monitor is its unpack's.
+	filt api.FilesetFilters, // Optionally: filters to apply while packing each layer.  Empty fields get api.Filter_DefaultFlatten's.
+	imgConf ImageConfig, // How to run the image.
+	layoutPath string, // Where to write the OCI image layout (absolute path).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ ImageDescriptor, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	layout, err := fs.ParseAbsolutePath(layoutPath)
+	if err != nil {
+		return ImageDescriptor{}, Errorf(rio.ErrUsage, "image layout path must be absolute: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	if err != nil {
+		return ImageDescriptor{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	if len(parts) == 0 {
+		return ImageDescriptor{}, Errorf(rio.ErrUsage, "an image needs at least one part")
+	}
+	sort.Sort(stitch.UnpackSpecByPath(parts))
+	for i, part := range parts {
+		if part.WareID.Type == "mount" {
+			return ImageDescriptor{}, Errorf(rio.ErrAssemblyInvalid, "cannot pack a mount into an image (at %q)", part.Path)
+		}
+		if i > 0 && part.Path == parts[i-1].Path {
+			return ImageDescriptor{}, Errorf(rio.ErrAssemblyInvalid, "two parts at %q", part.Path)
+		}
+	}
+	blobDir := layout.Join(fs.MustRelPath("blobs/sha256")).String()
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return ImageDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+
+	// Fetch and pack each part as a layer.
+	var img ImageDescriptor
+	for i, part := range parts {
+		resultWareID, err := unpackTool(ctx, part.WareID, "-", part.Filters, rio.Placement_None, part.Warehouses, part.Monitor)
+		if err != nil {
+			return ImageDescriptor{}, err
+		}
+		shelf := osfs.New(config.GetCacheBasePath().Join(cache.ShelfFor(resultWareID)))
+		desc, err := writeLayerBlob(ctx, blobDir, shelf, part.Path.CoerceRelative(), i > 0, filt2, mon)
+		if err != nil {
+			return ImageDescriptor{}, err
+		}
+		log.LayerPacked(mon, desc.WareID, desc.Digest, desc.DiffID, desc.Size)
+		img.Layers = append(img.Layers, desc)
+	}
+
+	// Write the config, and the manifest naming it and the layers.
+	configBlob := imageConfigFor(imgConf, parts, img.Layers)
+	configDesc, err := writeJSONBlob(blobDir, MediaType_ImageConfig, configBlob)
+	if err != nil {
+		return ImageDescriptor{}, err
+	}
+	manifest := imageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaType_ImageManifest,
+		Config:        configDesc,
+	}
+	for _, layer := range img.Layers {
+		manifest.Layers = append(manifest.Layers, ociDescriptor{layer.MediaType, layer.Digest, layer.Size, nil})
+	}
+	manifestDesc, err := writeJSONBlob(blobDir, MediaType_ImageManifest, manifest)
+	if err != nil {
+		return ImageDescriptor{}, err
+	}
+	img.ConfigDigest, img.ManifestDigest = configDesc.Digest, manifestDesc.Digest
+
+	// Add the image to the layout's index, replacing any image with the same tag.
+	if imgConf.Tag != "" {
+		manifestDesc.Annotations = map[string]string{annotation_RefName: imgConf.Tag}
+	}
+	if err := addToIndex(layout, manifestDesc); err != nil {
+		return ImageDescriptor{}, err
+	}
+	log.ImagePacked(mon, img.ManifestDigest, len(img.Layers))
+	return img, nil
+}
+
+/*
+	Pack a layer into a blob in blobDir, named by its digest.
+*/
+func writeLayerBlob(ctx context.Context, blobDir string, afs fs.FS, at fs.RelPath, opaqueRoot bool, filt apiutil.FilesetFilters, mon rio.Monitor) (LayerDescriptor, error) {
+	tmp, err := ioutil.TempFile(blobDir, ".layer.tmp")
+	if err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	desc, err := writeLayer(ctx, afs, at, opaqueRoot, filt, tmp, mon)
+	if err != nil {
+		return LayerDescriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(blobDir, strings.TrimPrefix(desc.Digest, "sha256:"))); err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	return desc, nil
+}
+
+// A content descriptor, as manifests and indexes refer to blobs.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type imageManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type imageIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type imageConfigBlob struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Entrypoint []string `json:"Entrypoint,omitempty"`
+		Cmd        []string `json:"Cmd,omitempty"`
+		Env        []string `json:"Env,omitempty"`
+		WorkingDir string   `json:"WorkingDir,omitempty"`
+		User       string   `json:"User,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []imageHistory `json:"history"`
+}
+
+type imageHistory struct {
+	CreatedBy string `json:"created_by"`
+}
+
+/*
+	Build the image config.  There's no creation time in it, so the same
+	assembly always makes the same image.
+*/
+func imageConfigFor(imgConf ImageConfig, parts []stitch.UnpackSpec, layers []LayerDescriptor) imageConfigBlob {
+	var blob imageConfigBlob
+	blob.Architecture, blob.OS = imgConf.Architecture, imgConf.OS
+	if blob.Architecture == "" {
+		blob.Architecture = runtime.GOARCH
+	}
+	if blob.OS == "" {
+		blob.OS = "linux"
+	}
+	blob.Config.Entrypoint = imgConf.Entrypoint
+	blob.Config.Cmd = imgConf.Cmd
+	blob.Config.Env = imgConf.Env
+	blob.Config.WorkingDir = imgConf.WorkingDir
+	blob.Config.User = imgConf.User
+	blob.RootFS.Type = "layers"
+	blob.RootFS.DiffIDs = []string{}
+	for i, layer := range layers {
+		blob.RootFS.DiffIDs = append(blob.RootFS.DiffIDs, layer.DiffID)
+		blob.History = append(blob.History, imageHistory{fmt.Sprintf("rio: %s at %s", parts[i].WareID, parts[i].Path)})
+	}
+	return blob
+}
+
+/*
+	Marshal a value to JSON and write it as a blob in blobDir.
+*/
+func writeJSONBlob(blobDir string, mediaType string, v interface{}) (ociDescriptor, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, Errorf(rio.ErrUsage, "cannot encode %s: %s", mediaType, err)
+	}
+	sum := sha256.Sum256(bs)
+	if err := ioutil.WriteFile(filepath.Join(blobDir, fmt.Sprintf("%x", sum)), bs, 0644); err != nil {
+		return ociDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	return ociDescriptor{mediaType, fmt.Sprintf("sha256:%x", sum), int64(len(bs)), nil}, nil
+}
+
+/*
+	Add a manifest to the layout's index.json, making it (and the
+	oci-layout file) if it's not there.  An entry with the same digest, or
+	the same tag, is replaced.
+*/
+func addToIndex(layout fs.AbsolutePath, manifestDesc ociDescriptor) error {
+	indexPath := layout.Join(fs.MustRelPath("index.json")).String()
+	index := imageIndex{SchemaVersion: 2, MediaType: MediaType_ImageIndex}
+	switch bs, err := ioutil.ReadFile(indexPath); {
+	case err == nil:
+		if err := json.Unmarshal(bs, &index); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "cannot add to image layout: unparsable index.json: %s", err)
+		}
+	case os.IsNotExist(err):
+		// A new layout.
+	default:
+		return Errorf(rio.ErrWarehouseUnwritable, "cannot add to image layout: %s", err)
+	}
+	tag := manifestDesc.Annotations[annotation_RefName]
+	manifests := []ociDescriptor{}
+	for _, desc := range index.Manifests {
+		if desc.Digest == manifestDesc.Digest || (tag != "" && desc.Annotations[annotation_RefName] == tag) {
+			continue
+		}
+		manifests = append(manifests, desc)
+	}
+	index.Manifests = append(manifests, manifestDesc)
+	bs, _ := json.Marshal(index)
+	if err := ioutil.WriteFile(indexPath, bs, 0644); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	layoutFile := layout.Join(fs.MustRelPath("oci-layout")).String()
+	if err := ioutil.WriteFile(layoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "cannot write image layout: %s", err)
+	}
+	return nil
+}
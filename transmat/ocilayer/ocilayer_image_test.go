@@ -0,0 +1,116 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/stitch"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestPackImage(t *testing.T) {
+	Convey("OCI layer transmat: packing an assembly as an image", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				// Bonk our own config env vars to isolate cache.
+				os.Setenv("RIO_BASE", tmpDir.String()+"/rio-base")
+
+				// Two wares: one for the root, and one to go at /opt/b.
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("base"))), tests.FixtureDepth1)
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("app"))), tests.FixtureMultifile)
+				baseAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/base.tgz", tmpDir))
+				appAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/app.tgz", tmpDir))
+				baseWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String()+"/base", api.Filter_NoMutation, baseAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				appWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String()+"/app", api.Filter_NoMutation, appAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				parts := []stitch.UnpackSpec{
+					{Path: fs.MustAbsolutePath("/opt/b"), WareID: appWareID, Filters: api.Filter_NoMutation, Warehouses: []api.WarehouseAddr{appAddr}},
+					{Path: fs.MustAbsolutePath("/"), WareID: baseWareID, Filters: api.Filter_NoMutation, Warehouses: []api.WarehouseAddr{baseAddr}},
+				}
+				layout := tmpDir.String() + "/image"
+				readJSON := func(path string, v interface{}) {
+					bs, err := ioutil.ReadFile(path)
+					So(err, ShouldBeNil)
+					So(json.Unmarshal(bs, v), ShouldBeNil)
+				}
+				blobPath := func(digest string) string {
+					return layout + "/blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+				}
+
+				img, err := PackImage(context.Background(), tartrans.Unpack, parts, api.Filter_NoMutation, ImageConfig{Cmd: []string{"/opt/b/a"}, Tag: "latest"}, layout, rio.Monitor{})
+				So(err, ShouldBeNil)
+				So(img.Layers, ShouldHaveLength, 2)
+
+				Convey("the layout should index a manifest naming the config and each layer, in order", func() {
+					var index imageIndex
+					readJSON(layout+"/index.json", &index)
+					So(index.Manifests, ShouldHaveLength, 1)
+					So(index.Manifests[0].Digest, ShouldEqual, img.ManifestDigest)
+					So(index.Manifests[0].Annotations[annotation_RefName], ShouldEqual, "latest")
+					var manifest imageManifest
+					readJSON(blobPath(img.ManifestDigest), &manifest)
+					So(manifest.Config.Digest, ShouldEqual, img.ConfigDigest)
+					So(manifest.Layers, ShouldHaveLength, 2)
+					var config imageConfigBlob
+					readJSON(blobPath(img.ConfigDigest), &config)
+					So(config.Config.Cmd, ShouldResemble, []string{"/opt/b/a"})
+					So(config.OS, ShouldEqual, "linux")
+					for i, layer := range img.Layers {
+						So(manifest.Layers[i].Digest, ShouldEqual, layer.Digest)
+						So(config.RootFS.DiffIDs[i], ShouldEqual, layer.DiffID)
+						fi, err := os.Stat(blobPath(layer.Digest))
+						So(err, ShouldBeNil)
+						So(fi.Size(), ShouldEqual, layer.Size)
+					}
+				})
+				Convey("unpacking the layers in order should give the assembly, and each its WareID", func() {
+					for _, layer := range img.Layers {
+						gotWareID, err := Unpack(context.Background(), layer.WareID, tmpDir.String()+"/rootfs", api.Filter_NoMutation, rio.Placement_Direct,
+							[]api.WarehouseAddr{api.WarehouseAddr("file://" + blobPath(layer.Digest))}, rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, layer.WareID)
+					}
+					body, err := ioutil.ReadFile(tmpDir.String() + "/rootfs/d/c")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "asdf")
+					body, err = ioutil.ReadFile(tmpDir.String() + "/rootfs/opt/b/b")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "qwe")
+				})
+				Convey("packing the same assembly again should make the same image", func() {
+					img2, err := PackImage(context.Background(), tartrans.Unpack, parts, api.Filter_NoMutation, ImageConfig{Cmd: []string{"/opt/b/a"}, Tag: "latest"}, layout, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(img2, ShouldResemble, img)
+					var index imageIndex
+					readJSON(layout+"/index.json", &index)
+					So(index.Manifests, ShouldHaveLength, 1)
+				})
+				Convey("mounts should be rejected", func() {
+					_, err := PackImage(context.Background(), tartrans.Unpack, []stitch.UnpackSpec{
+						{Path: fs.MustAbsolutePath("/"), WareID: api.WareID{"mount", "ro:/tmp"}},
+					}, api.Filter_NoMutation, ImageConfig{}, layout, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrAssemblyInvalid)
+				})
+			})
+		}),
+	)
+}
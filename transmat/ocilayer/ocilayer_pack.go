@@ -0,0 +1,384 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+/*
+	What an image manifest needs to say about a layer, besides where it is.
+*/
+type LayerDescriptor struct {
+	WareID    api.WareID // The fileset hash, as every transmat has.
+	MediaType string     // Always MediaType_LayerGzip.
+	Digest    string     // "sha256:..." of the blob, as stored in the warehouse.
+	DiffID    string     // "sha256:..." of the tar, uncompressed.  Image configs list these.
+	Size      int64      // Length of the blob, in bytes.
+}
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (api.WareID, error) {
+	desc, err := PackLayer(ctx, packType, pathStr, filt, warehouseAddr, mon)
+	return desc.WareID, err
+}
+
+/*
+	Pack, but returning the layer's digests along with the WareID.
+	(Pack logs them, too, so they're not lost from the command line.)
+
+	Packing a path that doesn't exist gives a descriptor with nothing but
+	a zero WareID, as Pack does.
+*/
+func PackLayer(
+	ctx context.Context,
+	packType api.PackType,
+	pathStr string,
+	filt api.FilesetFilters,
+	warehouseAddr api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ LayerDescriptor, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return LayerDescriptor{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	if err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Short-circuit exit if the path does not exist.
+	afs := osfs.New(path)
+	_, err = afs.Stat(fs.RelPath{})
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return LayerDescriptor{WareID: api.WareID{PackType, ""}}, nil
+	default:
+		return LayerDescriptor{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+
+	// Connect to warehouse, and get write controller opened.
+	//  The warehouses don't care what's in a ware; the tar transmat's dialing serves for us too.
+	wc, err := tartrans.OpenWriteController(warehouseAddr, packType, mon)
+	if err != nil {
+		return LayerDescriptor{}, err
+	}
+	defer wc.Close()
+
+	// Scan and tarify!
+	desc, err := writeLayer(ctx, afs, fs.RelPath{}, false, filt2, wc, mon)
+	if err != nil {
+		return desc, err
+	}
+
+	// If we made it all the way with no errors, commit.
+	//  (Otherwise, the write controller will be closed by default by our defers.)
+	if err := wc.Commit(desc.WareID); err != nil {
+		return LayerDescriptor{}, err
+	}
+	log.LayerPacked(mon, desc.WareID, desc.Digest, desc.DiffID, desc.Size)
+	return desc, nil
+}
+
+/*
+	Pack the fileset in afs as a gzipped layer, writing it to w, and
+	return its descriptor.  The fileset is put at path `at` in the layer;
+	see packLayer.  (On error, the descriptor may still have the WareID.)
+*/
+func writeLayer(
+	ctx context.Context,
+	afs fs.FS,
+	at fs.RelPath,
+	opaqueRoot bool,
+	filt apiutil.FilesetFilters,
+	w io.Writer,
+	mon rio.Monitor,
+) (LayerDescriptor, error) {
+	// Digest the blob on its way out, and the tar on its way into the compressor.
+	blob := &digestingWriter{w: w, h: sha256.New()}
+	compWriter, err := tartrans.Compress(blob, tartrans.Gzip, 0)
+	if err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	diff := &digestingWriter{w: compWriter, h: sha256.New()}
+	tarWriter := tar.NewWriter(diff)
+
+	wareID, err := packLayer(ctx, afs, at, opaqueRoot, filt, tarWriter, mon)
+	if err != nil {
+		return LayerDescriptor{WareID: wareID}, err
+	}
+	// Close all the intermediate writer layers to ensure they've flushed.
+	if err := tarWriter.Close(); err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := compWriter.Close(); err != nil {
+		return LayerDescriptor{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return LayerDescriptor{
+		WareID:    wareID,
+		MediaType: MediaType_LayerGzip,
+		Digest:    blob.digest(),
+		DiffID:    diff.digest(),
+		Size:      blob.n,
+	}, nil
+}
+
+/*
+	Walk afs, writing it to tw as layer entries, and return the WareID.
+
+	Everything is put under `at`: blank, for the fileset to be the whole
+	layer.  The dirs above `at` aren't written; the hash has them as the
+	unpacker infers them, so the WareID is what unpacking the layer gives.
+	If opaqueRoot is set, the fileset's root dir is made opaque, so that
+	nothing earlier layers put at `at` shows through.
+*/
+func packLayer(
+	ctx context.Context,
+	afs fs.FS,
+	at fs.RelPath,
+	opaqueRoot bool,
+	filt apiutil.FilesetFilters,
+	tw *tar.Writer,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	bucket := &fshash.MemoryBucket{}
+	hasher := wareid.Default(PackType)
+
+	// The dirs above `at` go in the bucket as unpacking infers them: unfiltered.
+	for _, parent := range at.SplitParent() {
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		conjuredFmeta.Name = parent
+		bucket.AddRecord(conjuredFmeta, nil)
+	}
+
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	scanFile := fsOp.ScanFile
+	if host.Xattrs.KeepsAny() {
+		scanFile = fsOp.ScanFileWithXattrs
+	}
+
+	// Report bytes hashed as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	// Files with several names are packed once, then linked to by the others.
+	//  (The bucket sees each name as the file it is, as in the tar transmat.)
+	type firstName struct {
+		name        fs.RelPath
+		contentHash []byte
+	}
+	hardlinks := map[fsOp.FileIdentity]firstName{}
+
+	// Walk the filesystem in order, emitting tar entries and filling the bucket as we go.
+	err = fsOp.Walk(afs, fs.RelPath{}, func(path fs.RelPath, _ *fs.Metadata) error {
+		// Consider cancellation.
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Open file.
+		fmeta, file, err := scanFile(afs, path)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+		fmeta.Name = at.Join(fmeta.Name)
+		if fmeta.Type == fs.Type_Dir {
+			marked, err := markedOpaque(afs, path)
+			if err != nil {
+				return err
+			}
+			if marked || (opaqueRoot && path == (fs.RelPath{})) {
+				fmeta.Xattrs = withKey(fmeta.Xattrs, opaqueXattr, "y")
+			}
+		}
+
+		// Translate overlayfs's deletions to ours.  A name that reads as a
+		//  deletion, but isn't one, can't go in a layer at all.
+		if strings.HasPrefix(fmeta.Name.Last(), whiteoutPrefix) {
+			return Errorf(rio.ErrPackInvalid, "cannot pack %q: in a layer, names starting with %q are whiteouts", fmeta.Name, whiteoutPrefix)
+		}
+		if fmeta.Type == fs.Type_CharDevice && fmeta.Devmajor == 0 && fmeta.Devminor == 0 {
+			fmeta.Type = fs.Type_Whiteout
+		}
+		opaque := fmeta.Type == fs.Type_Dir && fmeta.Xattrs[opaqueXattr] == "y"
+
+		// Apply filters.
+		host.Apply(fmeta)
+		if opaque {
+			fmeta.Xattrs = withKey(fmeta.Xattrs, opaqueXattr, "y") // whatever else is dropped, not this.
+		}
+		filters.Apply(filt, fmeta)
+
+		// Flatten time to seconds.  The tar writer impl doesn't do subsecond precision;
+		//  we need to do it here so that the hash and the serial form are describing the same thing.
+		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+
+		// Flip our metadata to tar header format.
+		//  An opaque dir's xattr becomes the marker entry, written right after it.
+		hdr := &tar.Header{}
+		tartrans.MetadataToTarHdr(fmeta, hdr)
+		if opaque {
+			hdr.Xattrs = withoutKey(fmeta.Xattrs, opaqueXattr)
+		}
+
+		// If this is another name for a file we've already packed, link to it:
+		//  no body, and the same content hash as before.
+		id, linkable := fsOp.HardlinkIdentity(afs, path)
+		if first, seen := hardlinks[id]; linkable && seen {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first.name.String(), 0
+			if err := tw.WriteHeader(hdr); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			bucket.AddRecord(*fmeta, first.contentHash)
+			return nil
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+		if opaque {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     fmeta.Name.Join(fs.MustRelPath(opaqueMarker)).String(),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Uid:      int(fmeta.Uid),
+				Gid:      int(fmeta.Gid),
+				ModTime:  fmeta.Mtime,
+			}); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+		}
+
+		// If it's a file, stream the body into the tar, hashing it;
+		//  for all, record the metadata in the bucket for the total hash.
+		if file == nil {
+			bucket.AddRecord(*fmeta, nil)
+			return nil
+		}
+		contentHasher := hasher.New()
+		n, err := io.Copy(io.MultiWriter(tw, contentHasher), file)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrPackInvalid, "error while packing %q: %s", path, err)
+		}
+		if n != fmeta.Size {
+			return Errorf(rio.ErrPackInvalid, "file %q changed while being packed", path)
+		}
+		contentHash := contentHasher.Sum(nil)
+		bucket.AddRecord(*fmeta, contentHash)
+		if linkable {
+			hardlinks[id] = firstName{fmeta.Name, contentHash}
+		}
+		prog.Add(n, fmeta.Name)
+		return nil
+	})
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Hash the thing!
+	wareID := hasher.WareID(bucket)
+	prog.Done()
+	return wareID, nil
+}
+
+func withoutKey(m map[string]string, key string) map[string]string {
+	if len(m) <= 1 {
+		return nil
+	}
+	m2 := make(map[string]string, len(m)-1)
+	for k, v := range m {
+		if k != key {
+			m2[k] = v
+		}
+	}
+	return m2
+}
+
+// Passes writes through, hashing and counting them.
+type digestingWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (d *digestingWriter) Write(bs []byte) (int, error) {
+	n, err := d.w.Write(bs)
+	d.h.Write(bs[:n])
+	d.n += int64(n)
+	return n, err
+}
+
+func (d *digestingWriter) digest() string {
+	return fmt.Sprintf("sha256:%x", d.h.Sum(nil))
+}
+
+/*
+	True if overlayfs has marked the dir opaque.  That's the one xattr read
+	while packing a layer: it's part of what the layer says, not the host.
+*/
+func markedOpaque(afs fs.FS, path fs.RelPath) (bool, error) {
+	xattrs, err := afs.LGetXattr(path)
+	switch Category(err) {
+	case nil:
+		return string(xattrs[opaqueXattr]) == "y", nil
+	case fs.ErrNotSupported:
+		return false, nil
+	default:
+		return false, err
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestLayerPack(t *testing.T) {
+	Convey("Spec compliance: OCI layer pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, Pack)
+			tests.CheckPackHashVariesOnVariations(PackType, Pack)
+			tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+		}),
+	)
+}
+
+func TestLayerPackDescriptor(t *testing.T) {
+	Convey("OCI layer transmat: packing", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+
+				Convey("the descriptor should digest the blob as stored, and the tar within", func() {
+					desc, err := PackLayer(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, api.WarehouseAddr(fmt.Sprintf("file://%s/layer.tgz", tmpDir)), rio.Monitor{})
+					So(err, ShouldBeNil)
+					blob, err := ioutil.ReadFile(tmpDir.String() + "/layer.tgz")
+					So(err, ShouldBeNil)
+					So(desc.MediaType, ShouldEqual, MediaType_LayerGzip)
+					So(desc.Size, ShouldEqual, len(blob))
+					So(desc.Digest, ShouldEqual, fmt.Sprintf("sha256:%x", sha256.Sum256(blob)))
+					gz, err := gzip.NewReader(bytes.NewReader(blob))
+					So(err, ShouldBeNil)
+					diff, err := ioutil.ReadAll(gz)
+					So(err, ShouldBeNil)
+					So(desc.DiffID, ShouldEqual, fmt.Sprintf("sha256:%x", sha256.Sum256(diff)))
+				})
+				Convey("the hash should be the same as tar's, for the same fileset", func() {
+					layerWareID, err := Pack(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					tarWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, afs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(layerWareID.Type, ShouldEqual, PackType)
+					So(layerWareID.Hash, ShouldEqual, tarWareID.Hash)
+				})
+			})
+		}),
+	)
+}
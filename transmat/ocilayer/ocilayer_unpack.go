@@ -0,0 +1,332 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").  Use "direct" to layer onto what's there.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackLayer(ctx, hasher, osfs.New(path2), filt2, reader, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+func unpackLayer(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Wrap input stream with decompression as necessary.
+	//  Layers are gzipped, as we pack them, but registries hold uncompressed ones too.
+	reader2, err := tartrans.Decompress(reader)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer compression: %s", err)
+	}
+	tr := tar.NewReader(reader2)
+
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
+	// we keep a second, separate one for the filtered data, which will compute a different hash.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+
+	// Dirs aren't put in the buckets until the end: an opaque marker in a dir
+	//  changes the dir's record (in the hash, it's the dir's xattr, as on disk),
+	//  and may come after it.  Also remember everything this layer placed,
+	//  so making a dir opaque deletes only what was there before.
+	type dirRecord struct{ prefilter, filtered fs.Metadata }
+	dirs := map[fs.RelPath]*dirRecord{}
+	opaque := map[fs.RelPath]struct{}{}
+	placed := map[fs.RelPath]struct{}{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Hardlinks refer back to earlier files; remember those.
+	type linkTarget struct {
+		prefilter, filtered fs.Metadata
+		contentHash         []byte
+	}
+	hardlinks := map[fs.RelPath]linkTarget{}
+
+	// Report bytes written as we go.  (A tar stream doesn't say how long it is.)
+	prog := progress.New(mon, "unpack", 0)
+
+	place := func(fmeta fs.Metadata, body io.Reader) error {
+		if err := fsOp.PlaceFileOver(afs, fmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		placed[fmeta.Name] = struct{}{}
+		return nil
+	}
+
+	// Infer parents, if necessary.  The tar format allows implicit parent dirs.
+	inferParents := func(name fs.RelPath) error {
+		for _, parent := range name.SplitParent() {
+			if _, exists := dirs[parent]; exists {
+				continue
+			}
+			log.DirectoryInferred(mon, parent, name)
+			conjuredFmeta := fshash.DefaultDirMetadata()
+			conjuredFmeta.Name = parent
+			record := &dirRecord{prefilter: conjuredFmeta}
+			policy.Apply(&conjuredFmeta)
+			filters.Apply(filt, &conjuredFmeta)
+			record.filtered = conjuredFmeta
+			dirs[parent] = record
+			if err := place(conjuredFmeta, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Iterate over each tar entry, mutating filesystem as we go.
+	for {
+		thdr, err := tr.Next()
+
+		// Check for done.
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if ctx.Err() != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if err != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: %s", err)
+		}
+
+		// Opaque markers aren't files, nor whiteouts of a file: handle them first.
+		//  Everything the dir held before this layer goes (but not what this layer put there).
+		if name, err := fs.ParseRelPath(thdr.Name); err == nil && name.Last() == opaqueMarker {
+			if name.GoesUp() {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: paths that use '../' to leave the base dir are invalid")
+			}
+			if thdr.Typeflag != tar.TypeReg && thdr.Typeflag != tar.TypeRegA || thdr.Size != 0 {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: %q is named as an opaque marker, but is not an empty file", thdr.Name)
+			}
+			if err := inferParents(name); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			dir := name.Dir()
+			entries, err := afs.ReadDir(dir)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			for _, entry := range entries {
+				if _, ours := placed[entry.Name]; ours {
+					continue
+				}
+				if err := fsOp.RemoveAll(afs, entry.Name); err != nil {
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				}
+			}
+			opaque[dir] = struct{}{}
+			continue
+		}
+
+		// Reshuffle metainfo to our default format.
+		//  (Whiteouts come out as such, named for what they delete.)
+		fmeta := fs.Metadata{}
+		if err := tartrans.LayerTarHdrToMetadata(thdr, &fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+		if fmeta.Name.GoesUp() {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := inferParents(fmeta.Name); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+
+		// Apply filters.
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt, &filteredFmeta)
+
+		// Place the file.
+		switch fmeta.Type {
+		case fs.Type_File:
+			reader := &util.HashingReader{tr, hasher.New()}
+			if err := place(filteredFmeta, reader); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			contentHash := reader.Hasher.Sum(nil)
+			prefilterBucket.AddRecord(fmeta, contentHash)
+			filteredBucket.AddRecord(filteredFmeta, contentHash)
+			hardlinks[fmeta.Name] = linkTarget{fmeta, filteredFmeta, contentHash}
+			prog.Add(fmeta.Size, fmeta.Name)
+		case fs.Type_Hardlink:
+			linkname, err := fs.ParseRelPath(fmeta.Linkname)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: hardlink %q refers to %q, which is not a relative path", fmeta.Name, fmeta.Linkname)
+			}
+			target, ok := hardlinks[linkname]
+			if !ok {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt layer: hardlink %q refers to %q, which is not a file earlier in the layer", fmeta.Name, fmeta.Linkname)
+			}
+			if err := place(filteredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			target.prefilter.Name, target.filtered.Name = fmeta.Name, fmeta.Name
+			prefilterBucket.AddRecord(target.prefilter, target.contentHash)
+			filteredBucket.AddRecord(target.filtered, target.contentHash)
+		case fs.Type_Dir:
+			if err := place(filteredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			dirs[fmeta.Name] = &dirRecord{fmeta, filteredFmeta}
+		default:
+			// (Whiteouts come this way too: placing one removes whatever is at its path.)
+			if err := place(filteredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			prefilterBucket.AddRecord(fmeta, nil)
+			filteredBucket.AddRecord(filteredFmeta, nil)
+		}
+	}
+
+	// Now the dirs can go in the buckets.
+	//  An opaque dir is hashed with the xattr it'd have on disk (but isn't given it).
+	for name, record := range dirs {
+		if _, ok := opaque[name]; ok {
+			record.prefilter.Xattrs = withKey(record.prefilter.Xattrs, opaqueXattr, "y")
+			record.filtered.Xattrs = withKey(record.filtered.Xattrs, opaqueXattr, "y")
+		}
+		prefilterBucket.AddRecord(record.prefilter, nil)
+		filteredBucket.AddRecord(record.filtered, nil)
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
+
+func withKey(m map[string]string, key, value string) map[string]string {
+	m2 := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		m2[k] = v
+	}
+	m2[key] = value
+	return m2
+}
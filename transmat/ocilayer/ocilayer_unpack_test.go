@@ -0,0 +1,123 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocilayer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestLayerUnpack(t *testing.T) {
+	Convey("Spec compliance: OCI layer unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
+
+func TestLayerDeletions(t *testing.T) {
+	Convey("OCI layer transmat: whiteouts and opaque dirs", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/layer.tgz", tmpDir))
+
+				// The upper layer, as overlayfs would leave it: "./a" deleted,
+				//  and "./d" made opaque, with one new file in it.
+				upper := osfs.New(tmpDir.Join(fs.MustRelPath("upper")))
+				mtime := tests.FixtureAlpha[0].Metadata.Mtime
+				tests.PlaceWhiteoutFixture(upper, []tests.FixtureFile{
+					{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Whiteout, Mtime: mtime}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime, Xattrs: map[string]string{opaqueXattr: "y"}}, nil},
+					{fs.Metadata{Name: fs.MustRelPath("./d/new"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 3}, []byte("new")},
+				})
+				wareID, err := Pack(context.Background(), PackType, upper.BasePath().String(), api.Filter_NoMutation, addr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("packing should write OCI's whiteout and opaque marker entries", func() {
+					f, err := os.Open(tmpDir.String() + "/layer.tgz")
+					So(err, ShouldBeNil)
+					defer f.Close()
+					gz, err := gzip.NewReader(f)
+					So(err, ShouldBeNil)
+					tr := tar.NewReader(gz)
+					var names []string
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						So(err, ShouldBeNil)
+						names = append(names, hdr.Name)
+						if hdr.Name == "./d/" {
+							So(hdr.Xattrs, ShouldBeEmpty)
+						}
+					}
+					So(names, ShouldResemble, []string{"./", "./.wh.a", "./d/", "./d/.wh..wh..opq", "./d/new"})
+				})
+				Convey("unpacking over a lower layer should delete what's whited out, and what was in the opaque dir", func() {
+					lower := osfs.New(tmpDir.Join(fs.MustRelPath("lower")))
+					tests.PlaceFixture(lower, tests.FixtureDepth1)
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						lower.BasePath().String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					_, err = lower.LStat(fs.MustRelPath("a"))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					_, err = lower.LStat(fs.MustRelPath("d/c"))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					fmeta, err := lower.LStat(fs.MustRelPath("d/new"))
+					So(err, ShouldBeNil)
+					So(fmeta.Size, ShouldEqual, 3)
+					fmeta, err = lower.LStat(fs.MustRelPath("d"))
+					So(err, ShouldBeNil)
+					So(fmeta.Xattrs[opaqueXattr], ShouldEqual, "")
+				})
+				Convey("an opaque dir should hash differently than a plain one", func() {
+					plain := osfs.New(tmpDir.Join(fs.MustRelPath("plain")))
+					tests.PlaceWhiteoutFixture(plain, []tests.FixtureFile{
+						{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+						{fs.Metadata{Name: fs.MustRelPath("./a"), Type: fs.Type_Whiteout, Mtime: mtime}, nil},
+						{fs.Metadata{Name: fs.MustRelPath("./d"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+						{fs.Metadata{Name: fs.MustRelPath("./d/new"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 3}, []byte("new")},
+					})
+					plainWareID, err := Pack(context.Background(), PackType, plain.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(plainWareID, ShouldNotResemble, wareID)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,48 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The plugin transmat hands packing and unpacking off to another program,
+	so a pack type rio doesn't know can be added without rebuilding rio.
+
+	A plugin for pack type "foo" is an executable named "rio-transmat-foo",
+	found on the PATH.  (Pack types are lowercase letters, digits, and
+	dashes; nothing else is looked for.)  Rio runs it once per operation,
+	with no arguments, writes one JSON request to its stdin, and closes it:
+
+		{"protocol": 1, "op": "pack", "packType": "foo", "path": "/abs/path",
+		 "filters": {"uid": "", "gid": "", "mtime": "", "sticky": ""},
+		 "warehouses": ["file:///some/ware"]}
+
+		{"protocol": 1, "op": "unpack", "wareID": "foo:abc123", "path": "/abs/path",
+		 "filters": {"uid": "keep", "gid": "keep", "mtime": "keep", "sticky": "zero"},
+		 "warehouses": ["https://example.org/wares/", "file:///some/ware"]}
+
+	Filters are as the user gave them (see api.FilesetFilters); blank means
+	the operation's default.  A pack has at most one warehouse, and none if
+	it's only to compute the WareID.
+
+	The plugin answers on its stdout just as `rio --format=json` does: a
+	stream of rio.Event messages, one per line, ending with the result:
+
+		{"log":{...},"prog":null,"result":null}
+		{"log":null,"prog":null,"result":{"wareID":"foo:abc123","error":null}}
+
+	An error goes in the result, and the plugin exits with the error's
+	category's exit code (see rio.ExitCodeForCategory); zero, otherwise.
+	Anything the plugin writes to stderr is kept for error messages.
+	Should the operation be cancelled, the plugin gets SIGINT, then SIGKILL.
+
+	Unpacks always place directly, at the path given, which is empty:
+	rio does the caching and the placement modes around the plugin, as
+	for every transmat.  Mirroring and scanning aren't part of the protocol.
+*/
+package plugintrans
+
+// The protocol version in requests.  Bumped only for changes old plugins can't ignore.
+const ProtocolVersion = 1
+
+// Plugins for pack type "foo" are named this plus "foo".
+const BinaryPrefix = "rio-transmat-"
@@ -0,0 +1,280 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package plugintrans
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/polydawn/refmt"
+	refmtjson "github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+)
+
+var validPackType = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+/*
+	Find the plugin for a pack type on the PATH, returning its path,
+	or false if there's none (or the pack type isn't a valid name).
+*/
+func Lookup(packType api.PackType) (string, bool) {
+	if !validPackType.MatchString(string(packType)) {
+		return "", false
+	}
+	binPath, err := exec.LookPath(BinaryPrefix + string(packType))
+	if err != nil {
+		return "", false
+	}
+	return binPath, true
+}
+
+/*
+	The request written to a plugin's stdin.  See the package docs.
+*/
+type request struct {
+	Protocol   int
+	Op         string
+	PackType   api.PackType
+	WareID     string
+	Path       string
+	Filters    filters
+	Warehouses []api.WarehouseAddr
+}
+
+type filters struct {
+	Uid    string
+	Gid    string
+	Mtime  string
+	Sticky string
+}
+
+var requestAtlas = atlas.MustBuild(
+	atlas.BuildEntry(request{}).StructMap().
+		AddField("Protocol", atlas.StructMapEntry{SerialName: "protocol"}).
+		AddField("Op", atlas.StructMapEntry{SerialName: "op"}).
+		AddField("PackType", atlas.StructMapEntry{SerialName: "packType", OmitEmpty: true}).
+		AddField("WareID", atlas.StructMapEntry{SerialName: "wareID", OmitEmpty: true}).
+		AddField("Path", atlas.StructMapEntry{SerialName: "path"}).
+		AddField("Filters", atlas.StructMapEntry{SerialName: "filters"}).
+		AddField("Warehouses", atlas.StructMapEntry{SerialName: "warehouses"}).
+		Complete(),
+	atlas.BuildEntry(filters{}).StructMap().
+		AddField("Uid", atlas.StructMapEntry{SerialName: "uid"}).
+		AddField("Gid", atlas.StructMapEntry{SerialName: "gid"}).
+		AddField("Mtime", atlas.StructMapEntry{SerialName: "mtime"}).
+		AddField("Sticky", atlas.StructMapEntry{SerialName: "sticky"}).
+		Complete(),
+)
+
+func filtersFor(filt api.FilesetFilters) filters {
+	return filters{filt.Uid, filt.Gid, filt.Mtime, filt.Sticky}
+}
+
+/*
+	Returns a PackFunc that packs with the plugin at binPath.
+*/
+func PackFunc(binPath string) rio.PackFunc {
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		path string,
+		filt api.FilesetFilters,
+		warehouseAddr api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		req := request{
+			Protocol:   ProtocolVersion,
+			Op:         "pack",
+			PackType:   packType,
+			Path:       path,
+			Filters:    filtersFor(filt),
+			Warehouses: []api.WarehouseAddr{},
+		}
+		if warehouseAddr != "" {
+			req.Warehouses = []api.WarehouseAddr{warehouseAddr}
+		}
+		return call(ctx, binPath, req, mon)
+	}
+}
+
+/*
+	Returns an UnpackFunc that unpacks with the plugin at binPath.
+	The cache and placement modes are handled here, as for any transmat;
+	the plugin only ever places directly.
+*/
+func UnpackFunc(binPath string) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		if placementMode == "" {
+			placementMode = rio.Placement_Copy
+		}
+		return cache.Lrn2Cache(
+			osfs.New(config.GetCacheBasePath()),
+			func(
+				ctx context.Context,
+				wareID api.WareID,
+				path string,
+				filt api.FilesetFilters,
+				_ rio.PlacementMode,
+				warehouses []api.WarehouseAddr,
+				mon rio.Monitor,
+			) (api.WareID, error) {
+				if warehouses == nil {
+					warehouses = []api.WarehouseAddr{}
+				}
+				return call(ctx, binPath, request{
+					Protocol:   ProtocolVersion,
+					Op:         "unpack",
+					WareID:     wareID.String(),
+					Path:       path,
+					Filters:    filtersFor(filt),
+					Warehouses: warehouses,
+				}, mon)
+			},
+		)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+	}
+}
+
+/*
+	Run the plugin on one request, forwarding its events to the monitor,
+	and return its result.  (This is much the same dance as the rio exec
+	client does with rio itself; plugins speak rio's own output format.)
+	The monitor isn't closed.
+*/
+func call(ctx context.Context, binPath string, req request, mon rio.Monitor) (api.WareID, error) {
+	var reqBuf bytes.Buffer
+	if err := refmt.NewMarshallerAtlased(refmtjson.EncodeOptions{}, &reqBuf, requestAtlas).Marshal(req); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "plugin %s: cannot encode request: %s", binPath, err)
+	}
+	reqBuf.WriteByte('\n')
+
+	// Spawn process.
+	cmd := exec.Command(binPath)
+	cmd.Stdin = &reqBuf
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "plugin %s: failed to start: %s", binPath, err)
+	}
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	if err = cmd.Start(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "plugin %s: failed to start: %s", binPath, err)
+	}
+
+	// Signal the plugin should we be cancelled; stop watching once it's done.
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(os.Interrupt)
+			time.Sleep(100 * time.Millisecond)
+			cmd.Process.Signal(os.Kill)
+		case <-exited:
+		}
+	}()
+
+	// Consume stdout, forwarding events to the monitor, up to the result.
+	unmarshaller := refmt.NewUnmarshallerAtlased(refmtjson.DecodeOptions{}, stdout, rio.Atlas)
+	var msgSlot rio.Event
+	for {
+		msgSlot = rio.Event{}
+		if err := unmarshaller.Unmarshal(&msgSlot); err != nil {
+			if err == io.EOF {
+				break // The exit code, and stderr, will say what happened.
+			}
+			cmd.Process.Kill()
+			cmd.Wait()
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "plugin %s: API parse error: %s (stderr: %q)", binPath, err, stderrBuf.String())
+		}
+		if msgSlot.Result != nil {
+			break
+		}
+		if mon.Chan != nil {
+			select {
+			case <-ctx.Done():
+			case mon.Chan <- msgSlot:
+			}
+		}
+	}
+	io.Copy(ioutil.Discard, stdout) // Let it finish writing, if it has more to say.
+
+	// Wait for it, and check the exit code agrees with the result.
+	code, err := waitFor(binPath, cmd)
+	if ctx.Err() != nil {
+		return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+	}
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "%s (stderr: %q)", err, stderrBuf.String())
+	}
+	if code == 0 {
+		if msgSlot.Result == nil {
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "plugin %s: exited zero, but gave no result (stderr: %q)", binPath, stderrBuf.String())
+		}
+		if msgSlot.Result.Error != nil {
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "plugin %s: exited zero, but result had error, category=%s: %s", binPath, msgSlot.Result.Error.Category(), msgSlot.Result.Error)
+		}
+		return msgSlot.Result.WareID, nil
+	}
+	exitCategory := rio.CategoryForExitCode(code)
+	if msgSlot.Result == nil || msgSlot.Result.Error == nil || msgSlot.Result.Error.Category() != exitCategory {
+		return api.WareID{}, Errorf(exitCategory, "plugin %s: exited %d (stderr: %q)", binPath, code, stderrBuf.String())
+	}
+	return api.WareID{}, msgSlot.Result.Error
+}
+
+func waitFor(binPath string, cmd *exec.Cmd) (int, error) {
+	err := cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1, Errorf(rio.ErrRPCBreakdown, "plugin %s: unknown wait error: %s", binPath, err)
+	}
+	waitStatus, ok := exitErr.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1, Errorf(rio.ErrRPCBreakdown, "plugin %s: unknown process state implementation %T", binPath, exitErr.ProcessState.Sys())
+	}
+	switch {
+	case waitStatus.Exited():
+		return waitStatus.ExitStatus(), nil
+	case waitStatus.Signaled():
+		return -1, Errorf(rio.ErrRPCBreakdown, "plugin %s: killed with signal %d", binPath, waitStatus.Signal())
+	default:
+		return -1, Errorf(rio.ErrRPCBreakdown, "plugin %s: unknown process wait status (%#v)", binPath, waitStatus)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package plugintrans
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/polydawn/refmt"
+	refmtjson "github.com/polydawn/refmt/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestPlugin(t *testing.T) {
+	Convey("Plugin transmat: calling out to rio-transmat-* binaries", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			oldPath := os.Getenv("PATH")
+			defer os.Setenv("PATH", oldPath)
+			os.Setenv("PATH", tmpDir.String())
+			writePlugin := func(packType, script string) {
+				So(ioutil.WriteFile(tmpDir.String()+"/"+BinaryPrefix+packType, []byte("#!/bin/sh\n"+script), 0755), ShouldBeNil)
+			}
+			writePlugin("foo", `cat > "$0.req"`+"\n"+`echo '{"log":null,"prog":null,"result":{"wareID":"foo:abc123","error":null}}'`+"\n")
+			writePlugin("broken", "echo oh no >&2\nexit 3\n")
+			writePlugin("stubborn", "trap '' INT\nexec sleep 10\n")
+
+			Convey("plugins should be found by pack type, on the PATH", func() {
+				binPath, ok := Lookup("foo")
+				So(ok, ShouldBeTrue)
+				So(binPath, ShouldEqual, tmpDir.String()+"/"+BinaryPrefix+"foo")
+				_, ok = Lookup("bar")
+				So(ok, ShouldBeFalse)
+				_, ok = Lookup("../foo")
+				So(ok, ShouldBeFalse)
+			})
+			Convey("packing should send the request, and return the result", func() {
+				binPath, _ := Lookup("foo")
+				wareID, err := PackFunc(binPath)(context.Background(), "foo", "/some/path", api.Filter_NoMutation, "file:///some/ware", rio.Monitor{})
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, api.WareID{"foo", "abc123"})
+				reqBytes, err := ioutil.ReadFile(binPath + ".req")
+				So(err, ShouldBeNil)
+				var req request
+				So(refmt.UnmarshalAtlased(refmtjson.DecodeOptions{}, reqBytes, &req, requestAtlas), ShouldBeNil)
+				So(req.Protocol, ShouldEqual, ProtocolVersion)
+				So(req.Op, ShouldEqual, "pack")
+				So(req.Path, ShouldEqual, "/some/path")
+				So(req.Filters.Uid, ShouldEqual, "keep")
+				So(req.Warehouses, ShouldResemble, []api.WarehouseAddr{"file:///some/ware"})
+			})
+			Convey("a plugin exiting without a result should be an error, with its stderr", func() {
+				binPath, _ := Lookup("broken")
+				_, err := PackFunc(binPath)(context.Background(), "broken", "/some/path", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "oh no")
+			})
+			Convey("cancelling should stop a plugin, even one ignoring interrupts", func() {
+				binPath, _ := Lookup("stubborn")
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer cancel()
+				start := time.Now()
+				_, err := PackFunc(binPath)(ctx, "stubborn", "/some/path", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			})
+		})
+	})
+}
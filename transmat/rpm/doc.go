@@ -0,0 +1,28 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The rpm transmat unpacks RPM packages (".rpm" files, as yum and dnf
+	fetch them) onto filesystems, so a distro package can be a rio input
+	as is.  It can use any k/v-styled warehouse (just like the tar transmat).
+
+	Only the package's files are unpacked: that's the cpio payload after the
+	rpm's lead and headers, in whatever compression the tar transmat reads.
+	The headers are skipped over, not interpreted: so no scriptlets are run,
+	and the header's idea of each file's owner isn't consulted (the payload
+	says too, by number, and that's what's placed).  The WareID is computed
+	over the unpacked fileset, exactly as the cpio transmat computes it:
+	so an rpm's WareID is the same hash as its payload's as a cpio ware
+	(only the packtype differs).  Scan reports it.
+
+	Pack is unsupported: rio reads rpms, but doesn't make them.
+*/
+package rpmtrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("rpm")
@@ -0,0 +1,75 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package rpmtrans
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+const (
+	leadLen   = 96
+	leadMagic = "\xed\xab\xee\xdb"
+
+	headerMagic = "\x8e\xad\xe8\x01"
+
+	// Limits on a header's size, as rpm itself enforces them.
+	//  Nothing legit comes near; anything past them is garbage or hostile.
+	maxHeaderIndexes = 0x0000ffff
+	maxHeaderData    = 0x0fffffff
+)
+
+/*
+Read through an rpm's lead, signature header, and main header, up to
+the start of its payload; leave the reader there.
+Errors are ErrWareCorrupt (or whatever the underlying reader said).
+*/
+func skipToPayload(r io.Reader) error {
+	lead := make([]byte, leadLen)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: not an rpm")
+	}
+	if string(lead[0:4]) != leadMagic {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: not an rpm")
+	}
+	// The signature header is padded to a multiple of 8; the main header isn't.
+	if err := skipHeader(r, "signature", true); err != nil {
+		return err
+	}
+	return skipHeader(r, "main", false)
+}
+
+/*
+Skip one header structure: magic, four reserved bytes, index count and
+data size (both big-endian), then the index entries (16 bytes each) and
+the data.
+*/
+func skipHeader(r io.Reader, which string, padded bool) error {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: truncated %s header", which)
+	}
+	if string(intro[0:4]) != headerMagic {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: bad %s header magic", which)
+	}
+	nindex := binary.BigEndian.Uint32(intro[8:12])
+	hsize := binary.BigEndian.Uint32(intro[12:16])
+	if nindex > maxHeaderIndexes || hsize > maxHeaderData {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: %s header claims %d entries and %d bytes", which, nindex, hsize)
+	}
+	size := 16*int64(nindex) + int64(hsize)
+	if padded {
+		size += (8 - size%8) % 8
+	}
+	if n, err := io.CopyN(ioutil.Discard, r, size); err != nil || n != size {
+		return Errorf(rio.ErrWareCorrupt, "corrupt rpm: truncated %s header", which)
+	}
+	return nil
+}
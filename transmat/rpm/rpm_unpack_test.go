@@ -0,0 +1,130 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package rpmtrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+// A header structure with nindex (garbage) entries and hsize (garbage) bytes of data.
+func makeHeader(nindex, hsize int, padded bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(headerMagic)
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.BigEndian, uint32(nindex))
+	binary.Write(&buf, binary.BigEndian, uint32(hsize))
+	buf.Write(bytes.Repeat([]byte{0x5a}, 16*nindex+hsize))
+	if padded {
+		buf.Write(make([]byte, (8-hsize%8)%8))
+	}
+	return buf.Bytes()
+}
+
+// Gzipped, as rpm payloads usually are.
+func gzipped(bs []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(bs)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func makeLead() []byte {
+	lead := make([]byte, leadLen)
+	copy(lead, leadMagic)
+	lead[4], lead[5] = 3, 0 // version 3.0
+	copy(lead[10:], "hello-1.0-1")
+	return lead
+}
+
+func TestRpmUnpack(t *testing.T) {
+	Convey("Rpm transmat: unpacking rpms", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.rpm", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				writeRpm := func(parts ...[]byte) {
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.rpm", bytes.Join(parts, nil), 0644), ShouldBeNil)
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+				var files []testutil.ArchiveEntry // As rpmbuild lays payloads out: no dirs.
+				for _, ent := range testutil.FixturePackaged {
+					if ent.Typeflag != tar.TypeDir {
+						files = append(files, ent)
+					}
+				}
+				payload := gzipped(testutil.MakeCpio(files...))
+
+				Convey("an rpm should scan, then unpack by the scanned WareID", func() {
+					writeRpm(makeLead(), makeHeader(3, 13, true), makeHeader(5, 77, false), payload)
+					wareID, err := Scan(context.Background(), PackType, api.Filter_NoMutation, "", addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID.Type, ShouldEqual, PackType)
+					wareID2, err := unpack(wareID)
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/usr/bin/hello")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "#!/bin/sh\n")
+					target, err := os.Readlink(tmpDir.String() + "/out/usr/bin/hi")
+					So(err, ShouldBeNil)
+					So(target, ShouldEqual, "hello")
+				})
+				Convey("the wrong WareID should be a hash mismatch", func() {
+					writeRpm(makeLead(), makeHeader(1, 8, true), makeHeader(1, 3, false), payload)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("a file that's not an rpm should be corruption", func() {
+					writeRpm(payload)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("an rpm with unpadded signatures should be corruption", func() {
+					writeRpm(makeLead(), makeHeader(1, 5, false), makeHeader(1, 3, false), payload)
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("an rpm cut off in its headers should be corruption", func() {
+					writeRpm(makeLead(), makeHeader(1, 8, true), makeHeader(1, 3, false)[:20])
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("packing should be refused", func() {
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 	"xi2.org/x/xz"
 )
 
@@ -23,6 +25,8 @@ const (
 	Bzip2
 	Gzip
 	Xz
+	Zstd
+	Lz4
 )
 
 func (compression *Compression) Extension() string {
@@ -35,6 +39,10 @@ func (compression *Compression) Extension() string {
 		return "tar.gz"
 	case Xz:
 		return "tar.xz"
+	case Zstd:
+		return "tar.zst"
+	case Lz4:
+		return "tar.lz4"
 	}
 	return "[unknown]"
 }
@@ -45,6 +53,8 @@ func DetectCompression(source []byte) Compression {
 		Bzip2: {0x42, 0x5A, 0x68},
 		Gzip:  {0x1F, 0x8B, 0x08},
 		Xz:    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
+		Lz4:   {0x04, 0x22, 0x4D, 0x18},
 	} {
 		if bytes.Compare(m, source[:len(m)]) == 0 {
 			return compression
@@ -70,7 +80,71 @@ func Decompress(stream io.Reader) (io.Reader, error) {
 		return bzip2.NewReader(buf), nil
 	case Xz:
 		return xz.NewReader(buf, 0)
+	case Zstd:
+		// One goroutine: nothing closes what we return, so it mustn't keep any running.
+		zr, err := zstd.NewReader(buf, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	case Lz4:
+		return lz4.NewReader(buf), nil
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	}
 }
+
+/*
+	Wrap a writer so what's written to it comes out compressed.
+	Close the result to flush it; that doesn't close the underlying writer.
+
+	Level 0 means the codec's default; otherwise it's the codec's own scale
+	(for gzip, 1 through 9; for zstd, 1 through 19; for lz4, 1 through 12).
+	Levels mean nothing to Uncompressed.  The zstd encoder has only four
+	speeds, so zstd levels are rounded to the nearest of those, as the
+	encoder's EncoderLevelFromZstd does.  Lz4 levels 1 and 2 are its fast
+	mode, the default.
+
+	Only Uncompressed, Gzip, Zstd, and Lz4 can be written: the other formats
+	Decompress understands have no encoder among our dependencies.
+	Zstd is much the quicker to unpack, which adds up with big wares;
+	Lz4 is quicker still, though bigger, which suits warehouses on a LAN.
+*/
+func Compress(stream io.Writer, compression Compression, level int) (io.WriteCloser, error) {
+	switch compression {
+	case Uncompressed:
+		return nopWriteCloser{stream}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(stream, level)
+	case Zstd:
+		if level == 0 {
+			return zstd.NewWriter(stream, zstd.WithEncoderConcurrency(1))
+		}
+		if level < 1 || level > 19 {
+			return nil, fmt.Errorf("zstd: level %d is out of range (1 through 19)", level)
+		}
+		return zstd.NewWriter(stream, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case Lz4:
+		if level < 0 || level > 12 {
+			return nil, fmt.Errorf("lz4: level %d is out of range (1 through 12)", level)
+		}
+		zw := lz4.NewWriter(stream)
+		if level >= 3 {
+			// The HC levels, as the lz4 tool counts them, double how far
+			//  the match finder searches at each step.
+			zw.Header.CompressionLevel = 1 << uint(level-1)
+		}
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression format for writing: %s", (&compression).Extension())
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
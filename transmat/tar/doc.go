@@ -6,6 +6,22 @@ Sniperkit-Bot
 /*
 	The tar transmat packs filesystems into the widely-recognized "tar" format,
 	and can use any k/v-styled warehouse for storage.
+
+	Hardlinks survive the trip: pack notices files that are the same inode
+	(by dev and inode number) and emits each name after the first as a link
+	entry, and unpack makes the links again.  Which names are linked counts
+	in the WareID, so a fileset hashes differently linked than copied; but
+	not which name a walk reaches first, so it hashes the same in any
+	PackOrder.  (See paxHardlink for how.)
+
+	Sparse files stay sparse: pack writes files with holes as PAX
+	"GNU.sparse" 1.0 entries, so the zeros aren't in the ware, and unpack
+	punches holes where the content has whole blocks of zeros.  Pack asks
+	the filesystem where the holes are (SEEK_DATA/SEEK_HOLE; see
+	fsOp.DataRuns), and where it can't, looks for zero blocks instead (see
+	fsOp.SparseBlock).  Only files the filesystem says are short of blocks
+	get looked at, so dense files pay nothing for it.  The WareID is over
+	all the content, zeros and all; a file hashes the same sparse or not.
 */
 package tartrans
 
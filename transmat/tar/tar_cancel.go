@@ -0,0 +1,34 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	Wraps a reader so that each read checks the context first, and fails
+	with ErrCancelled once it's been cancelled.
+
+	Checking between entries isn't enough on its own: one big file is one
+	long io.Copy.  With this under the copy, cancellation lands within one
+	buffer (io.Copy's, or the tar reader's) of when it was asked for.
+*/
+type cancellableReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r cancellableReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, Errorf(rio.ErrCancelled, "cancelled")
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,119 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarCancel(t *testing.T) {
+	Convey("Tar transmat: cancellation", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				Convey("cancelling mid-unpack should stop within the file, and leave nothing in the cache", func() {
+					os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+					defer os.Unsetenv("RIO_CACHE")
+
+					// One big file, then a small one; the cancel comes halfway through the big one.
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					big := make([]byte, 8<<20)
+					So(tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big)), ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					tw.Write(big)
+					So(tw.WriteHeader(&tar.Header{Name: "small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					tw.Write([]byte("small"))
+					So(tw.Close(), ShouldBeNil)
+					filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+					wareID, _, err := unpackTar(context.Background(), defaultHasher, nilFS.New(), filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+					So(err, ShouldBeNil)
+
+					// Serve the ware through a fifo, so we know exactly how far the reader got.
+					warePath := tmpDir.Join(fs.MustRelPath("ware.tar")).String()
+					So(syscall.Mkfifo(warePath, 0644), ShouldBeNil)
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					half := buf.Len() / 2
+					afterCancel := make(chan int)
+					go func() {
+						f, err := os.OpenFile(warePath, os.O_WRONLY, 0)
+						if err != nil {
+							panic(err)
+						}
+						defer f.Close()
+						f.Write(buf.Bytes()[:half])
+						cancel()
+						// Keep offering the rest; this stops when the reader hangs up.
+						n, _ := f.Write(buf.Bytes()[half:])
+						afterCancel <- n
+					}()
+
+					_, err = Unpack(
+						ctx,
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Copy,
+						[]api.WarehouseAddr{api.WarehouseAddr("file://" + warePath)},
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+					So(<-afterCancel, ShouldBeLessThan, 1<<20)
+
+					cacheFs := osfs.New(tmpDir.Join(fs.MustRelPath("cache")))
+					_, err = cacheFs.LStat(cache.ShelfFor(wareID))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					names, err := ioutil.ReadDir(cacheFs.BasePath().String())
+					So(err, ShouldBeNil)
+					for _, fi := range names {
+						So(fi.Name(), ShouldNotStartWith, ".tmp")
+					}
+					_, err = os.Stat(tmpDir.Join(fs.MustRelPath("out")).String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("cancelling a pack should commit nothing", func() {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					tests.PlaceFixture(afs, tests.FixtureGamma)
+					So(os.Mkdir(tmpDir.Join(fs.MustRelPath("wh")).String(), 0755), ShouldBeNil)
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					_, err := Pack(
+						ctx,
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr("ca+file://"+tmpDir.Join(fs.MustRelPath("wh")).String()),
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+					names, err := ioutil.ReadDir(tmpDir.Join(fs.MustRelPath("wh")).String())
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+				})
+			})
+		}),
+	)
+}
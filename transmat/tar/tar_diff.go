@@ -0,0 +1,312 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+type DiffKind string
+
+const (
+	Diff_Added    DiffKind = "added"
+	Diff_Removed  DiffKind = "removed"
+	Diff_Modified DiffKind = "modified"
+)
+
+/*
+	One line of output from DiffWares.
+
+	For Diff_Modified entries, Fields lists which attributes differ;
+	the names are the same short keys the fshash format uses where one exists
+	("t" type, "p" perms, "u" uid, "g" gid, "l" linkname, "d" device numbers,
+	"m" mtime, "x" xattrs), plus "h" for file content.
+	Fields is empty for added and removed entries.
+*/
+type DiffEntry struct {
+	Path   fs.RelPath
+	Kind   DiffKind
+	Fields []string
+}
+
+func (d DiffEntry) String() string {
+	if len(d.Fields) == 0 {
+		return fmt.Sprintf("%s %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s %s (%s)", d.Kind, d.Path, strings.Join(d.Fields, ","))
+}
+
+/*
+	Compare two tar wares, reporting every path that was added, removed,
+	or modified going from wareA to wareB.
+
+	Neither ware is unpacked to disk: both are streamed from the warehouses,
+	and file bodies are only hashed, never kept.  Wares are compared raw,
+	with no filters applied.
+
+	The entries for wareA's side are held in memory (metadata and content
+	hashes only), and then wareB is streamed past them; added and modified
+	entries are passed to `emit` as soon as they're seen, in wareB's order.
+	Removed entries are emitted last, sorted by path.
+	If `emit` returns an error, the diff stops and that error is returned.
+
+	Both wares are verified against their WareIDs as they're read.
+	Note that wareB's hash can only be checked after the whole stream is read,
+	so if it mismatches, DiffWares will return ErrWareHashMismatch *after*
+	having already emitted entries; treat those as garbage in that case.
+*/
+func DiffWares(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareA api.WareID, // The "before" ware.
+	wareB api.WareID, // The "after" ware.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	emit func(DiffEntry) error, // Receives each difference as it's found.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	for _, wareID := range []api.WareID{wareA, wareB} {
+		if wareID.Type != PackType {
+			return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+		}
+	}
+	//  Content hashes are only comparable if they're the same kind.
+	hasherA, err := lookupHasher(wareA)
+	if err != nil {
+		return err
+	}
+	hasherB, err := lookupHasher(wareB)
+	if err != nil {
+		return err
+	}
+	if hasherA.Algo != hasherB.Algo {
+		return Errorf(rio.ErrUsage, "cannot diff wares hashed with different algorithms (%s vs %s)", wareA, wareB)
+	}
+
+	// Scan the "before" side into memory.
+	type record struct {
+		fmeta       fs.Metadata
+		contentHash []byte
+		seen        bool
+	}
+	before := map[fs.RelPath]*record{}
+	if err := scanWare(ctx, hasherA, wareA, warehouses, mon, func(fmeta fs.Metadata, contentHash []byte) error {
+		before[fmeta.Name] = &record{fmeta: fmeta, contentHash: contentHash}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Stream the "after" side past it.
+	if err := scanWare(ctx, hasherB, wareB, warehouses, mon, func(fmeta fs.Metadata, contentHash []byte) error {
+		prev, exists := before[fmeta.Name]
+		if !exists {
+			return emit(DiffEntry{Path: fmeta.Name, Kind: Diff_Added})
+		}
+		prev.seen = true
+		if fields := diffFields(prev.fmeta, prev.contentHash, fmeta, contentHash); len(fields) > 0 {
+			return emit(DiffEntry{Path: fmeta.Name, Kind: Diff_Modified, Fields: fields})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Anything in the "before" side that we didn't see again was removed.
+	var removed []string
+	for path, rec := range before {
+		if !rec.seen {
+			removed = append(removed, path.String())
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		if err := emit(DiffEntry{Path: fs.MustRelPath(path), Kind: Diff_Removed}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffFields(a fs.Metadata, aHash []byte, b fs.Metadata, bHash []byte) (fields []string) {
+	if a.Type != b.Type {
+		fields = append(fields, "t")
+	}
+	if a.Perms != b.Perms {
+		fields = append(fields, "p")
+	}
+	if a.Uid != b.Uid {
+		fields = append(fields, "u")
+	}
+	if a.Gid != b.Gid {
+		fields = append(fields, "g")
+	}
+	if a.Linkname != b.Linkname {
+		fields = append(fields, "l")
+	}
+	if a.Devmajor != b.Devmajor || a.Devminor != b.Devminor {
+		fields = append(fields, "d")
+	}
+	if !a.Mtime.Equal(b.Mtime) {
+		fields = append(fields, "m")
+	}
+	if !xattrsEqual(a.Xattrs, b.Xattrs) {
+		fields = append(fields, "x")
+	}
+	if !bytes.Equal(aHash, bHash) {
+		fields = append(fields, "h")
+	}
+	return
+}
+
+func xattrsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v != v2 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Stream every entry of a tar ware past the visit func, without placing
+	anything on a filesystem, then verify the ware hash.
+
+	Parent dirs the tar leaves implicit are conjured with default metadata,
+	exactly as unpack would, so the entries visited describe the same fileset
+	the WareID does.
+*/
+func scanWare(
+	ctx context.Context,
+	hasher wareHasher,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+	visit func(fmeta fs.Metadata, contentHash []byte) error,
+) error {
+	reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	gotWareID, err := scanTar(ctx, hasher, reader, visit)
+	if err != nil {
+		return err
+	}
+	if gotWareID != wareID {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, gotWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   gotWareID.String(),
+			},
+		)
+	}
+	return nil
+}
+
+func scanTar(
+	ctx context.Context,
+	hasher wareHasher,
+	reader io.Reader,
+	visit func(fmeta fs.Metadata, contentHash []byte) error,
+) (api.WareID, error) {
+	// Wrap input stream with decompression as necessary.
+	reader2, err := Decompress(reader)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
+	}
+	tr := tar.NewReader(cancellableReader{ctx, reader2})
+
+	// Same bookkeeping as unpack: a bucket for the hash, and a record of dirs seen.
+	bucket := &fshash.MemoryBucket{}
+	dirs := map[fs.RelPath]struct{}{}
+	hardlinks := hardlinkTargets{}
+	stargz := estargzSkipper{}
+
+	for {
+		fmeta := fs.Metadata{}
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if ctx.Err() != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+		}
+		if stargz.skip(thdr) {
+			continue
+		}
+		if err := TarHdrToMetadata(thdr, &fmeta); err != nil {
+			return api.WareID{}, err
+		}
+		if fmeta.Name.GoesUp() {
+			return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
+		}
+
+		// Infer parents, if necessary.
+		for _, parent := range fmeta.Name.SplitParent() {
+			if _, exists := dirs[parent]; exists {
+				continue
+			}
+			conjuredFmeta := fshash.DefaultDirMetadata()
+			conjuredFmeta.Name = parent
+			dirs[parent] = struct{}{}
+			bucket.AddRecord(conjuredFmeta, nil)
+			if err := visit(conjuredFmeta, nil); err != nil {
+				return api.WareID{}, err
+			}
+		}
+
+		// Hash the body, if any; then visit.
+		var contentHash []byte
+		switch fmeta.Type {
+		case fs.Type_File:
+			hr := &util.HashingReader{tr, hasher.New()}
+			if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+				return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+			}
+			contentHash = hr.Hasher.Sum(nil)
+			hardlinks.remember(fmeta, fmeta, contentHash)
+		case fs.Type_Hardlink:
+			target, err := hardlinks.resolve(fmeta, thdr)
+			if err != nil {
+				return api.WareID{}, err
+			}
+			fmeta, contentHash = target.prefilter, target.contentHash
+		case fs.Type_Dir:
+			dirs[fmeta.Name] = struct{}{}
+		}
+		bucket.AddRecord(fmeta, contentHash)
+		if err := visit(fmeta, contentHash); err != nil {
+			return api.WareID{}, err
+		}
+	}
+
+	return hasher.WareID(bucket), nil
+}
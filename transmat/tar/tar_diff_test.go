@@ -0,0 +1,86 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarDiff(t *testing.T) {
+	Convey("Tar transmat: diffing wares", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				warehouses := []api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))}
+				n := 0
+				packFixture := func(fixture []tests.FixtureFile) api.WareID {
+					n++
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath(fmt.Sprintf("src%d", n))))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					tests.PlaceFixture(afs, fixture)
+					wareID, err := Pack(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						warehouses[0],
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				diff := func(a, b api.WareID) (entries []string, err error) {
+					err = DiffWares(context.Background(), a, b, warehouses, func(d DiffEntry) error {
+						entries = append(entries, d.String())
+						return nil
+					}, rio.Monitor{})
+					return
+				}
+
+				Convey("Identical wares should have no diff", func() {
+					wareID := packFixture(tests.FixtureGamma)
+					entries, err := diff(wareID, wareID)
+					So(err, ShouldBeNil)
+					So(entries, ShouldBeEmpty)
+				})
+				Convey("Changed content should be reported as a modification", func() {
+					entries, err := diff(packFixture(tests.FixtureAlpha), packFixture(tests.FixtureAlphaDiffContent))
+					So(err, ShouldBeNil)
+					So(entries, ShouldResemble, []string{"modified ./a (h)"})
+				})
+				Convey("Changed attributes should be reported by field", func() {
+					entries, err := diff(packFixture(tests.FixtureAlpha), packFixture(tests.FixtureAlphaDiffUidGid))
+					So(err, ShouldBeNil)
+					So(entries, ShouldResemble, []string{"modified ./a (u,g)"})
+				})
+				Convey("Added and removed paths should be reported", func() {
+					entries, err := diff(packFixture(tests.FixtureDepth1), packFixture(tests.FixtureDepth3))
+					So(err, ShouldBeNil)
+					So(entries, ShouldResemble, []string{
+						"added ./d/d2",
+						"added ./d/d2/c",
+						"removed ./d/c",
+					})
+				})
+				Convey("Missing wares should error", func() {
+					wareID := packFixture(tests.FixtureAlpha)
+					_, err := diff(wareID, api.WareID{"tar", "nonexistent"})
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,309 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	eStargz is a gzipped tar laid out so it can be read a file at a time,
+	for lazy pulling (as by stargz-snapshotter):
+
+	  - each file's body is a gzip member of its own;
+	  - the first entry is a "landmark" file, saying none of the files are
+	    to be prefetched;
+	  - after the fileset comes a table of contents (the TOC), as one more
+	    entry, saying where each file's body is and what its digest is;
+	  - and last, a footer: an empty gzip member whose header says where
+	    the TOC starts.
+
+	It's still one gzip stream, and one tar; so anything can unpack it.
+	The landmark and the TOC aren't part of the fileset, though, and are
+	left out when unpacking (see estargzSkipper), so an eStargz hashes the
+	same as a plain tar of the same fileset: the WareID is the same.
+	Which means no fileset can have files of those names at its root.
+
+	Large files aren't cut into chunks: each file's body is one member.
+	The TOC digest, which the image layer's annotation must carry for it
+	to be verified when lazily pulled, is logged once the pack is done.
+*/
+const (
+	estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+	estargzPrefetchLandmark   = ".prefetch.landmark"
+	estargzTOCName            = "stargz.index.json"
+	estargzFooterSize         = 51
+)
+
+// What the landmark file contains.  (Nothing reads it; it just can't be empty.)
+const estargzLandmarkContents = 0xf
+
+type estargzTOC struct {
+	Version int            `json:"version"`
+	Entries []estargzEntry `json:"entries"`
+}
+
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var estargzTypes = map[byte]string{
+	tar.TypeDir:     "dir",
+	tar.TypeReg:     "reg",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// A name as eStargz sees it: no "./", and no trailing slash.
+func estargzName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func estargzReserved(name string) bool {
+	switch estargzName(name) {
+	case estargzNoPrefetchLandmark, estargzPrefetchLandmark, estargzTOCName:
+		return true
+	}
+	return false
+}
+
+/*
+	Writes an eStargz: tar into `tw`, with the hooks from `hooks` given to
+	packTar, and the landmark and TOC from `writeLandmark` and `finish`,
+	before and after.
+
+	Sits between the tar writer and the gzip members, so it can digest
+	each file's body on its way through.
+*/
+type estargzWriter struct {
+	tw      *tar.Writer
+	members *memberWriter
+	toc     estargzTOC
+
+	body       hash.Hash // Digests the body being written, if there is one.
+	bodyLeft   int64
+	bodyOffset int64
+}
+
+func newEstargzWriter(members *memberWriter) *estargzWriter {
+	ew := &estargzWriter{members: members, toc: estargzTOC{Version: 1}}
+	ew.tw = tar.NewWriter(ew)
+	return ew
+}
+
+func (ew *estargzWriter) Write(bs []byte) (int, error) {
+	n, err := ew.members.Write(bs)
+	if ew.body != nil && ew.bodyLeft > 0 {
+		m := int64(n)
+		if m > ew.bodyLeft {
+			m = ew.bodyLeft
+		}
+		ew.body.Write(bs[:m])
+		ew.bodyLeft -= m
+	}
+	return n, err
+}
+
+func (ew *estargzWriter) hooks() packHooks {
+	return packHooks{body: ew.startBody, entry: ew.endEntry}
+}
+
+func (ew *estargzWriter) writeLandmark() error {
+	hdr := &tar.Header{
+		Name:     estargzNoPrefetchLandmark,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     1,
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := ew.tw.WriteHeader(hdr); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	fmeta := fs.Metadata{Name: fs.MustRelPath(estargzNoPrefetchLandmark), Type: fs.Type_File, Perms: 0644, Size: 1, Mtime: hdr.ModTime}
+	if err := ew.startBody(fmeta); err != nil {
+		return err
+	}
+	if _, err := ew.tw.Write([]byte{estargzLandmarkContents}); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return ew.record(fmeta, fmeta.Name)
+}
+
+// Start a member for the file's body, so it can be read without its header.
+func (ew *estargzWriter) startBody(fmeta fs.Metadata) error {
+	offset, err := ew.members.cut()
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	ew.body, ew.bodyLeft, ew.bodyOffset = sha256.New(), fmeta.Size, offset
+	return nil
+}
+
+func (ew *estargzWriter) endEntry(fmeta fs.Metadata, _ []byte, bodyIn fs.RelPath) error {
+	if estargzReserved(fmeta.Name.String()) {
+		return Errorf(rio.ErrPackInvalid, "cannot pack %q: in an eStargz, that name is the format's own", fmeta.Name)
+	}
+	return ew.record(fmeta, bodyIn)
+}
+
+/*
+	Add an entry to the TOC; if it had a body, end the body's member,
+	so the next header starts a new one.
+*/
+func (ew *estargzWriter) record(fmeta fs.Metadata, bodyIn fs.RelPath) error {
+	hdr := &tar.Header{}
+	MetadataToTarHdr(&fmeta, hdr)
+	if bodyIn != fmeta.Name {
+		hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, bodyIn.String(), 0
+	}
+	entry := estargzEntry{
+		Name:     hdr.Name,
+		Type:     estargzTypes[hdr.Typeflag],
+		Size:     hdr.Size,
+		LinkName: hdr.Linkname,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		DevMajor: hdr.Devmajor,
+		DevMinor: hdr.Devminor,
+	}
+	if !hdr.ModTime.IsZero() {
+		entry.ModTime3339 = hdr.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	for k, v := range hdr.Xattrs {
+		if entry.Xattrs == nil {
+			entry.Xattrs = map[string][]byte{}
+		}
+		entry.Xattrs[k] = []byte(v)
+	}
+	if ew.body != nil {
+		if err := ew.tw.Flush(); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+		if _, err := ew.members.cut(); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+		entry.Offset = ew.bodyOffset
+		entry.Digest = fmt.Sprintf("sha256:%x", ew.body.Sum(nil))
+		entry.ChunkDigest = entry.Digest
+		ew.body = nil
+	}
+	ew.toc.Entries = append(ew.toc.Entries, entry)
+	return nil
+}
+
+/*
+	Write the TOC and the footer, and close the tar and the gzip.
+	Returns the TOC digest.
+*/
+func (ew *estargzWriter) finish() (string, error) {
+	if err := ew.tw.Flush(); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	tocOffset, err := ew.members.cut()
+	if err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	tocJSON, err := json.MarshalIndent(ew.toc, "", "\t")
+	if err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing eStargz TOC: %s", err)
+	}
+	if err := ew.tw.WriteHeader(&tar.Header{
+		Name:     estargzTOCName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(tocJSON)),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if _, err := ew.tw.Write(tocJSON); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := ew.tw.Close(); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := ew.members.Close(); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if _, err := ew.members.out.Write(estargzFooter(tocOffset)); err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(tocJSON)), nil
+}
+
+/*
+	The footer: an empty gzip member, uncompressed so it's always the same
+	size, with the TOC's offset in an extra field of its header.
+
+	Spelled out byte by byte, since readers seek to exactly
+	estargzFooterSize from the end, and compress/gzip's way of writing an
+	empty body has changed between Go versions.
+*/
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := make([]byte, 0, estargzFooterSize)
+	footer = append(footer, 0x1f, 0x8b, 8, 1<<2, 0, 0, 0, 0, 0, 0xff) // magic; deflate; FEXTRA; no mtime; unknown OS.
+	footer = append(footer, 0, 0, 'S', 'G', 0, 0)
+	binary.LittleEndian.PutUint16(footer[10:], uint16(4+len(subfield)))
+	binary.LittleEndian.PutUint16(footer[14:], uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)    // one stored block, final, empty.
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0) // crc32 and size of nothing.
+	return footer
+}
+
+/*
+	Tells an eStargz's own entries from the fileset's, when unpacking.
+
+	A tar is taken for an eStargz if its first entry is the no-prefetch
+	landmark (as any eStargz without files to prefetch starts); from there
+	on, landmarks and TOCs at the root are skipped.  In any other tar,
+	nothing is.
+*/
+type estargzSkipper struct {
+	seen, on bool
+}
+
+func (s *estargzSkipper) skip(hdr *tar.Header) bool {
+	first := !s.seen
+	s.seen = true
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return false
+	}
+	if first && estargzName(hdr.Name) == estargzNoPrefetchLandmark {
+		s.on = true
+	}
+	return s.on && estargzReserved(hdr.Name)
+}
@@ -0,0 +1,128 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarEstargz(t *testing.T) {
+	packEstargz := PackWith(PackOptions{Compression: Gzip, EStargz: true})
+	Convey("Spec compliance: Tar pack, eStargz", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, packEstargz)
+			tests.CheckPackHashVariesOnVariations(PackType, packEstargz)
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.CheckRoundTrip(PackType, packEstargz, Unpack, api.WarehouseAddr(fmt.Sprintf("file://%s/bounce", tmpDir)))
+			})
+		}),
+	)
+	Convey("Tar transmat: eStargz packs", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				var ware bytes.Buffer
+				wareID, err := PackToStream(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, &ware, PackOptions{Compression: Gzip, EStargz: true}, rio.Monitor{})
+				So(err, ShouldBeNil)
+				bs := ware.Bytes()
+
+				Convey("should hash the same as a plain tar", func() {
+					plainWareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID, ShouldResemble, plainWareID)
+					filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+					unpackedWareID, _, err := unpackTar(context.Background(), defaultHasher, osfs.New(tmpDir.Join(fs.MustRelPath("out"))), filt, bytes.NewReader(bs), rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(unpackedWareID, ShouldResemble, wareID)
+				})
+				Convey("should start with the landmark, and end with the TOC and footer", func() {
+					gz, err := gzip.NewReader(bytes.NewReader(bs))
+					So(err, ShouldBeNil)
+					var names []string
+					tr := tar.NewReader(gz)
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						So(err, ShouldBeNil)
+						names = append(names, hdr.Name)
+					}
+					So(names[0], ShouldEqual, estargzNoPrefetchLandmark)
+					So(names[len(names)-1], ShouldEqual, estargzTOCName)
+
+					// The footer says where the TOC is.
+					footer, err := gzip.NewReader(bytes.NewReader(bs[len(bs)-estargzFooterSize:]))
+					So(err, ShouldBeNil)
+					extra := footer.Header.Extra
+					So(string(extra[:2]), ShouldEqual, "SG")
+					So(string(extra[len(extra)-6:]), ShouldEqual, "STARGZ")
+					tocOffset, err := strconv.ParseInt(string(extra[4:20]), 16, 64)
+					So(err, ShouldBeNil)
+
+					// The TOC says where each file's body is, and what its digest is.
+					gz, err = gzip.NewReader(bytes.NewReader(bs[tocOffset:]))
+					So(err, ShouldBeNil)
+					tr = tar.NewReader(gz)
+					hdr, err := tr.Next()
+					So(err, ShouldBeNil)
+					So(hdr.Name, ShouldEqual, estargzTOCName)
+					var toc estargzTOC
+					So(json.NewDecoder(tr).Decode(&toc), ShouldBeNil)
+					So(toc.Version, ShouldEqual, 1)
+					So(toc.Entries, ShouldHaveLength, len(tests.FixtureGamma)+1)
+					for _, entry := range toc.Entries {
+						if entry.Type != "reg" || entry.Size == 0 {
+							continue
+						}
+						gz, err := gzip.NewReader(bytes.NewReader(bs[entry.Offset:]))
+						So(err, ShouldBeNil)
+						gz.Multistream(false)
+						body, err := ioutil.ReadAll(gz)
+						So(err, ShouldBeNil)
+						So(len(body), ShouldBeGreaterThanOrEqualTo, entry.Size)
+						So(fmt.Sprintf("sha256:%x", sha256.Sum256(body[:entry.Size])), ShouldEqual, entry.Digest)
+					}
+				})
+			})
+		}),
+	)
+	Convey("Tar transmat: eStargz packs need gzip, and names of their own", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureAlpha)
+				_, err := PackWith(PackOptions{Compression: Uncompressed, EStargz: true})(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				_, err = PackWith(PackOptions{Compression: Gzip, EStargz: true, Seekable: true})(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/"+estargzTOCName, []byte("{}"), 0644), ShouldBeNil)
+				_, err = PackWith(PackOptions{Compression: Gzip, EStargz: true})(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+			})
+		}),
+	)
+}
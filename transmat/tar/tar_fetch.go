@@ -0,0 +1,153 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Pick a warehouse and get a reader, as PickReader does; but from
+	warehouses that can read from an offset (see
+	`warehouse.BlobstoreRangeController`), the whole ware is fetched into a
+	staging file in the cache first, and the reader reads that.
+
+	If the fetch breaks, the staging file keeps what arrived, and the next
+	try asks the warehouse only for the rest.  If the warehouse won't do the
+	range after all, the staging file is emptied and the fetch starts over.
+
+	Once a fetch is complete, the staged file is only good for one read:
+	closing the reader removes it.  By then the unpack has either verified
+	the ware against its WareID, or found it bad -- in which case a retry
+	had better fetch it fresh anyway.  (A tar WareID hashes the fileset,
+	not the bytes of the tar, so there's no verifying it sooner than that.)
+*/
+func pickStagedReader(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (io.ReadCloser, error) {
+	return pickReader(ctx, wareID, warehouses, false, func(whCtrl warehouse.BlobstoreController, addr api.WarehouseAddr) (io.ReadCloser, error) {
+		ranged, ok := whCtrl.(warehouse.BlobstoreRangeController)
+		if !ok {
+			return whCtrl.OpenReader(ctx, wareID)
+		}
+		return stageFetch(ctx, wareID, addr, ranged, mon)
+	}, mon)
+}
+
+func stageFetch(
+	ctx context.Context,
+	wareID api.WareID,
+	addr api.WarehouseAddr,
+	whCtrl warehouse.BlobstoreRangeController,
+	mon rio.Monitor,
+) (io.ReadCloser, error) {
+	// Staging files are per ware *and* per warehouse: two warehouses may
+	//  well hold different bytes (say, compressed differently) for one WareID.
+	stageDir := config.GetCacheBasePath().Join(fs.MustRelPath(string(wareID.Type) + "/fetch"))
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), stageDir.CoerceRelative(), 0700); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	addrSum := sha256.Sum256([]byte(addr))
+	stagePath := stageDir.Join(fs.MustRelPath(fmt.Sprintf("%s.%x", wareID.Hash, addrSum[:8]))).String()
+	file, err := os.OpenFile(stagePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot open staging file for fetch: %s", err)
+	}
+
+	// If somebody else is already fetching this, don't fight over the file:
+	//  just read straight from the warehouse, as if staging weren't a thing.
+	//  (The flock goes when the file is closed, whichever way we leave.)
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+		return r, err
+	}
+
+	// Ask for whatever we don't have yet.
+	have, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read staging file for fetch: %s", err)
+	}
+	reader, start, err := whCtrl.OpenReaderFrom(ctx, wareID, have)
+	if err != nil {
+		if have == 0 {
+			os.Remove(stagePath)
+		}
+		file.Close()
+		return nil, err
+	}
+	defer reader.Close()
+	switch {
+	case start != have:
+		if err := file.Truncate(start); err != nil {
+			file.Close()
+			return nil, Errorf(rio.ErrLocalCacheProblem, "cannot reset staging file for fetch: %s", err)
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			file.Close()
+			return nil, Errorf(rio.ErrLocalCacheProblem, "cannot reset staging file for fetch: %s", err)
+		}
+	case start > 0:
+		log.WareFetchResumed(mon, addr, wareID, start)
+	}
+
+	// Fetch the rest.  If this breaks, keep what we got, for next time.
+	if _, err := io.Copy(stageWriter{file}, cancellableReader{ctx, reader}); err != nil {
+		file.Close()
+		if _, ok := err.(Error); !ok {
+			return nil, Errorf(rio.ErrWarehouseUnavailable, "fetch of ware %s from warehouse %s broke: %s", wareID, addr, err)
+		}
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, Errorf(rio.ErrLocalCacheProblem, "cannot read staging file for fetch: %s", err)
+	}
+	return stagedWare{file, stagePath}, nil
+}
+
+// Tags write errors, so they're not mistaken for the warehouse's fault.
+type stageWriter struct {
+	*os.File
+}
+
+func (w stageWriter) Write(bs []byte) (int, error) {
+	n, err := w.File.Write(bs)
+	if err != nil {
+		return n, Errorf(rio.ErrLocalCacheProblem, "cannot write staging file for fetch: %s", err)
+	}
+	return n, nil
+}
+
+// A fully fetched ware.  Closing it removes the staging file.
+type stagedWare struct {
+	*os.File
+	path string
+}
+
+func (s stagedWare) Close() error {
+	os.Remove(s.path)
+	return s.File.Close()
+}
@@ -0,0 +1,161 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/testutil"
+)
+
+/*
+	Serves one ware; while `broken`, every response is cut off after
+	`chunk` bytes.  Records each request's Range header, and counts the
+	body bytes it sends.
+*/
+type flakyWarehouse struct {
+	mu       sync.Mutex
+	ware     []byte
+	broken   bool
+	noRanges bool
+	chunk    int
+	ranges   []string
+	sent     int
+}
+
+func (f *flakyWarehouse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ranges = append(f.ranges, req.Header.Get("Range"))
+	var start int
+	if !f.noRanges && req.Header.Get("Range") != "" {
+		fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(f.ware)-1, len(f.ware)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(f.ware)-start))
+		w.WriteHeader(206)
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(f.ware)))
+	}
+	body := f.ware[start:]
+	if f.broken && len(body) > f.chunk {
+		body = body[:f.chunk]
+	}
+	n, _ := w.Write(body)
+	f.sent += n
+	if f.broken {
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func TestTarFetchResume(t *testing.T) {
+	Convey("Tar transmat: fetches that break should be resumed", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				body := make([]byte, 1<<20)
+				rand.Read(body)
+				So(tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body)), ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+				tw.Write(body)
+				So(tw.Close(), ShouldBeNil)
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+				So(err, ShouldBeNil)
+				wareID, _, err := unpackTar(context.Background(), defaultHasher, nilFS.New(), filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				wh := &flakyWarehouse{ware: buf.Bytes(), broken: true, chunk: buf.Len() / 8}
+				srv := httptest.NewServer(wh)
+				defer srv.Close()
+				unpack := func(dest string) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath(dest)).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{api.WarehouseAddr(srv.URL + "/ware.tar")},
+						rio.Monitor{},
+					)
+				}
+				stagedFiles := func() []os.FileInfo {
+					fis, err := ioutil.ReadDir(tmpDir.Join(fs.MustRelPath("cache/tar/fetch")).String())
+					So(err, ShouldBeNil)
+					return fis
+				}
+
+				// First try: one request and three in-stream resumes, each cut off; that's half.
+				//  (No retries of the whole fetch, here; that's tested below.)
+				withFetchRetries(0, func() {
+					_, err = unpack("out1")
+				})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+				So(wh.sent, ShouldEqual, 4*wh.chunk)
+				So(stagedFiles(), ShouldHaveLength, 1)
+				So(stagedFiles()[0].Size(), ShouldEqual, 4*wh.chunk)
+
+				Convey("the retry should only ask for the rest", func() {
+					wh.broken, wh.sent, wh.ranges = false, 0, nil
+					gotWareID, err := unpack("out2")
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					So(wh.ranges, ShouldResemble, []string{fmt.Sprintf("bytes=%d-", 4*wh.chunk)})
+					So(wh.sent, ShouldEqual, buf.Len()-4*wh.chunk)
+					got, err := ioutil.ReadFile(tmpDir.Join(fs.MustRelPath("out2/a")).String())
+					So(err, ShouldBeNil)
+					So(bytes.Equal(got, body), ShouldBeTrue)
+					So(stagedFiles(), ShouldBeEmpty)
+				})
+				Convey("with retries, one unpack should get the rest, however many breaks it takes", func() {
+					wh.sent, wh.ranges = 0, nil
+					withFetchRetries(3, func() {
+						gotWareID, err := unpack("out2")
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID)
+					})
+					So(wh.ranges[0], ShouldEqual, fmt.Sprintf("bytes=%d-", 4*wh.chunk))
+					So(wh.sent, ShouldEqual, buf.Len()-4*wh.chunk)
+					So(stagedFiles(), ShouldBeEmpty)
+				})
+				Convey("if the server stops doing ranges, the retry should start over", func() {
+					wh.broken, wh.noRanges, wh.sent = false, true, 0
+					gotWareID, err := unpack("out2")
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					So(wh.sent, ShouldEqual, buf.Len())
+					So(stagedFiles(), ShouldBeEmpty)
+				})
+				Convey("a staged ware that turns out bad should be dropped", func() {
+					wh.broken, wh.ware = false, bytes.Replace(wh.ware, body[len(body)-16:], make([]byte, 16), 1)
+					_, err := unpack("out2")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					So(stagedFiles(), ShouldBeEmpty)
+				})
+			})
+		}),
+	)
+}
@@ -17,8 +17,11 @@ import (
 // Mutate tar.Header fields to match the given fmeta.
 func MetadataToTarHdr(fmeta *fs.Metadata, hdr *tar.Header) {
 	hdr.Name = fmeta.Name.String()
-	if fmeta.Type == fs.Type_Dir {
+	switch fmeta.Type {
+	case fs.Type_Dir:
 		hdr.Name += "/"
+	case fs.Type_Whiteout:
+		hdr.Name = whiteoutEntryName(fmeta.Name).String()
 	}
 	hdr.Typeflag = fsTypeToTarType(fmeta.Type)
 	hdr.Mode = int64(fmeta.Perms)
@@ -30,11 +33,24 @@ func MetadataToTarHdr(fmeta *fs.Metadata, hdr *tar.Header) {
 	hdr.Devminor = fmeta.Devminor
 	hdr.ModTime = fmeta.Mtime
 	hdr.Xattrs = fmeta.Xattrs
+	// The tar writer rounds mtimes to the second, unless told to use PAX;
+	//  and PAX is only needed for the nanoseconds, so whole seconds come out as ever.
+	hdr.Format = tar.FormatUnknown
+	if fmeta.Mtime.Nanosecond() != 0 {
+		hdr.Format = tar.FormatPAX
+	}
+	// A file with a Linkname is one of several names for the same file;
+	//  that goes in a PAX record (see paxHardlink).
+	hdr.PAXRecords = nil
+	if fmeta.Type == fs.Type_File && fmeta.Linkname != "" {
+		hdr.Linkname = ""
+		hdr.PAXRecords = map[string]string{paxHardlink: fmeta.Linkname}
+	}
 }
 
 func fsTypeToTarType(fsType fs.Type) byte {
 	switch fsType {
-	case fs.Type_File:
+	case fs.Type_File, fs.Type_Whiteout:
 		return tar.TypeReg
 	case fs.Type_Hardlink:
 		return tar.TypeLink
@@ -57,9 +73,14 @@ func fsTypeToTarType(fsType fs.Type) byte {
 }
 
 // Mutate fs.Metadata fields to match the given tar header.
-// Does not check for names that go above '.'; caller may want to do that.
+// Absolute names are rejected as corrupt.  Does not check for names that go
+// above '.'; caller may want to do that (see fs.RelPath.GoesUp).
 func TarHdrToMetadata(hdr *tar.Header, fmeta *fs.Metadata) error {
-	fmeta.Name = fs.MustRelPath(hdr.Name) // FIXME should not use the 'must' path
+	name, err := fs.ParseRelPath(hdr.Name)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt tar: %q is not a relative path", hdr.Name)
+	}
+	fmeta.Name = name
 	fmeta.Type = tarTypeToFsType(hdr.Typeflag)
 	if fmeta.Type == fs.Type_Invalid {
 		return Errorf(rio.ErrWareCorrupt, "corrupt tar: %q is not a known file type", hdr.Typeflag)
@@ -73,6 +94,9 @@ func TarHdrToMetadata(hdr *tar.Header, fmeta *fs.Metadata) error {
 	fmeta.Devminor = hdr.Devminor
 	fmeta.Mtime = hdr.ModTime
 	fmeta.Xattrs = hdr.Xattrs
+	if name, ok := hdr.PAXRecords[paxHardlink]; ok && fmeta.Type == fs.Type_File {
+		fmeta.Linkname = name
+	}
 	return nil
 }
 
@@ -0,0 +1,76 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Hardlinks in a tar refer back to a file earlier in the same tar.
+
+	In the fileset hash, a hardlink is that file again under another name
+	-- same metadata, same content -- plus which name it's linked to, so
+	that a fileset hashes differently linked than copied.  Which name the
+	tar links to is whichever was packed first, though; so what goes in the
+	hash is the one in the entry's paxHardlink record, which doesn't depend
+	on the order of the tar.
+
+	This remembers enough of each file seen to say so.
+*/
+type hardlinkTargets map[fs.RelPath]hardlinkTarget
+
+type hardlinkTarget struct {
+	prefilter   fs.Metadata
+	filtered    fs.Metadata
+	contentHash []byte
+}
+
+func (targets hardlinkTargets) remember(prefilter, filtered fs.Metadata, contentHash []byte) {
+	targets[prefilter.Name] = hardlinkTarget{prefilter, filtered, contentHash}
+}
+
+/*
+	Looks up what a hardlink entry refers to, returning the target's records
+	renamed to the link's name, and linked as the entry's header says.
+*/
+func (targets hardlinkTargets) resolve(fmeta fs.Metadata, thdr *tar.Header) (hardlinkTarget, error) {
+	name, err := fs.ParseRelPath(fmeta.Linkname)
+	if err != nil {
+		return hardlinkTarget{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: hardlink %q refers to %q, which is not a relative path", fmeta.Name, fmeta.Linkname)
+	}
+	target, ok := targets[name]
+	if !ok {
+		return hardlinkTarget{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: hardlink %q refers to %q, which is not a file earlier in the tar", fmeta.Name, fmeta.Linkname)
+	}
+	target.prefilter.Name = fmeta.Name
+	target.filtered.Name = fmeta.Name
+	target.prefilter.Linkname = thdr.PAXRecords[paxHardlink]
+	target.filtered.Linkname = thdr.PAXRecords[paxHardlink]
+	return target, nil
+}
+
+/*
+	The PAX record that says which name a file is hardlinked to.
+
+	Each name of a hardlinked file is in the hash as the file it is, plus
+	a Linkname of the least (lexically) of its names; except for that name
+	itself, which has none.  Picking the least name, rather than the one
+	the tar links to (whichever was packed first), keeps the WareID the
+	same in every PackOrder.
+
+	Tar headers have no room for a regular file's Linkname, and a link
+	entry's Linkname is the name it links to in the tar; so it goes in
+	this record, on each entry but the least name's.  In fs.Metadata,
+	it's a file's Linkname (see MetadataToTarHdr and TarHdrToMetadata).
+	Tars without it -- from other packers, or from before links counted --
+	hash their links as copies.
+*/
+const paxHardlink = "RIO.hardlink"
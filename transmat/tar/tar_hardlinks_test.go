@@ -0,0 +1,163 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestTarHardlinks(t *testing.T) {
+	Convey("Tar transmat: hardlinks", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposePack)
+				So(err, ShouldBeNil)
+				sameFile := func(afs fs.FS, a, b string) bool {
+					fiA, err := os.Lstat(afs.BasePath().Join(fs.MustRelPath(a)).String())
+					So(err, ShouldBeNil)
+					fiB, err := os.Lstat(afs.BasePath().Join(fs.MustRelPath(b)).String())
+					So(err, ShouldBeNil)
+					return os.SameFile(fiA, fiB)
+				}
+				// Makes ./a, ./dir/b, and ./c; a and b are either linked, or copies.
+				makeTree := func(name string, linked bool) fs.FS {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					So(afs.Mkdir(fs.MustRelPath("dir"), 0755), ShouldBeNil)
+					for _, f := range []struct{ name, body string }{{"a", "shared\n"}, {"c", "alone\n"}} {
+						So(ioutil.WriteFile(afs.BasePath().Join(fs.MustRelPath(f.name)).String(), []byte(f.body), 0644), ShouldBeNil)
+					}
+					if linked {
+						So(afs.Mkhardlink(fs.MustRelPath("dir/b"), fs.MustRelPath("a")), ShouldBeNil)
+					} else {
+						So(ioutil.WriteFile(afs.BasePath().Join(fs.MustRelPath("dir/b")).String(), []byte("shared\n"), 0644), ShouldBeNil)
+					}
+					mtime := time.Unix(1000, 0)
+					for _, p := range []string{"a", "dir/b", "c", "dir", "."} {
+						So(afs.SetTimesNano(fs.MustRelPath(p), mtime, fs.DefaultAtime), ShouldBeNil)
+					}
+					return afs
+				}
+				pack := func(afs fs.FS, order PackOrder) (api.WareID, []byte) {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					wareID, err := packTar(context.Background(), defaultHasher, afs, filt, order, false, tw, &buf, packHooks{}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(tw.Close(), ShouldBeNil)
+					return wareID, buf.Bytes()
+				}
+				unpack := func(name string, tarBytes []byte) api.WareID {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					unfilt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+					prefilterWareID, _, err := unpackTar(context.Background(), defaultHasher, afs, unfilt, bytes.NewReader(tarBytes), rio.Monitor{})
+					So(err, ShouldBeNil)
+					return prefilterWareID
+				}
+				// Lists the names of the link entries in a tar, and what they link to.
+				links := func(tarBytes []byte) (links [][2]string) {
+					tr := tar.NewReader(bytes.NewReader(tarBytes))
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							return links
+						}
+						So(err, ShouldBeNil)
+						if hdr.Typeflag == tar.TypeLink {
+							links = append(links, [2]string{hdr.Name, hdr.Linkname})
+						}
+					}
+				}
+
+				Convey("packing should emit each extra name as a link", func() {
+					linkedFs := makeTree("linked", true)
+					linkedWareID, tarBytes := pack(linkedFs, PackOrder_Walk)
+					So(links(tarBytes), ShouldResemble, [][2]string{{"./dir/b", "./a"}})
+
+					Convey("and the hash should count the link", func() {
+						copiesWareID, _ := pack(makeTree("copies", false), PackOrder_Walk)
+						So(linkedWareID, ShouldNotResemble, copiesWareID)
+					})
+					Convey("and unpacking should make the link again, and hash it the same way", func() {
+						So(unpack("unpacked", tarBytes), ShouldResemble, linkedWareID)
+						afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpacked")))
+						So(sameFile(afs, "a", "dir/b"), ShouldBeTrue)
+						So(sameFile(afs, "a", "c"), ShouldBeFalse)
+					})
+				})
+				Convey("the hash should not depend on which name came first", func() {
+					// GNU tar order reaches ./init/zed first; lexical order, ./init.d/zed.
+					afs := makeTree("orders", false)
+					So(afs.Mkdir(fs.MustRelPath("init"), 0755), ShouldBeNil)
+					So(afs.Mkdir(fs.MustRelPath("init.d"), 0755), ShouldBeNil)
+					So(ioutil.WriteFile(afs.BasePath().Join(fs.MustRelPath("init/zed")).String(), []byte("zed\n"), 0644), ShouldBeNil)
+					So(afs.Mkhardlink(fs.MustRelPath("init.d/zed"), fs.MustRelPath("init/zed")), ShouldBeNil)
+					for _, p := range []string{"init/zed", "init", "init.d", "."} {
+						So(afs.SetTimesNano(fs.MustRelPath(p), time.Unix(1000, 0), fs.DefaultAtime), ShouldBeNil)
+					}
+					gnuWareID, gnuBytes := pack(afs, PackOrder_GnuTar)
+					lexicalWareID, lexicalBytes := pack(afs, PackOrder_Lexical)
+					So(links(gnuBytes), ShouldResemble, [][2]string{{"./init.d/zed", "./init/zed"}})
+					So(links(lexicalBytes), ShouldResemble, [][2]string{{"./init/zed", "./init.d/zed"}})
+					So(lexicalWareID, ShouldResemble, gnuWareID)
+					So(unpack("unpacked-gnu", gnuBytes), ShouldResemble, gnuWareID)
+					So(unpack("unpacked-lexical", lexicalBytes), ShouldResemble, gnuWareID)
+				})
+				Convey("a hardlink to nothing earlier in the tar should be refused", func() {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					So(tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a", Mode: 0644}), ShouldBeNil)
+					So(tw.Close(), ShouldBeNil)
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpacked")))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					unfilt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+					_, _, err = unpackTar(context.Background(), defaultHasher, afs, unfilt, &buf, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a fixture from gnu tar with a hardlinked pair should unpack linked", func() {
+					wareID := api.WareID{"tar", "6GyWhVJAH91rys7VBx2tAog5VsEsspb4TCdUzExXeZPP2LyUkMgKR8SE3w4cVwfZWn"}
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{"file://./fixtures/tar_hardlinks.tgz"},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					afs := osfs.New(tmpDir)
+					So(sameFile(afs, "a", "dir/b"), ShouldBeTrue)
+					_, reader, err := fsOp.ScanFile(afs, fs.MustRelPath("dir/b"))
+					So(err, ShouldBeNil)
+					defer reader.Close()
+					body, _ := ioutil.ReadAll(reader)
+					So(string(body), ShouldEqual, "shared\n")
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,47 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+)
+
+/*
+	HashAlgorithm selects the hash the WareID (and every file's content
+	hash within it) is computed with.  See wareid.Algorithm; every
+	transmat shares them, and verifies by them.
+*/
+type HashAlgorithm = wareid.Algorithm
+
+const (
+	HashAlgorithm_SHA384 = wareid.Algorithm_SHA384 // The default, and the only choice there used to be.
+	HashAlgorithm_SHA512 = wareid.Algorithm_SHA512
+)
+
+/*
+	The hash used both for each file's contents and for the tree as a whole;
+	pack, unpack, scan, and diff all get theirs from here, so they agree.
+*/
+type wareHasher = wareid.Hasher
+
+// The hasher for when there's no WareID to say otherwise (as when scanning).
+var defaultHasher = wareid.Default(PackType)
+
+/*
+	Look up the hasher for an algorithm, or return ErrUsage if we don't have it.
+*/
+func hasherFor(algo HashAlgorithm) (wareHasher, error) {
+	return wareid.For(PackType, algo)
+}
+
+/*
+	Look up the hasher a WareID was made with, so we can verify it.
+	Returns ErrUsage for algorithms we don't know.
+*/
+func lookupHasher(wareID api.WareID) (wareHasher, error) {
+	return wareid.Lookup(wareID)
+}
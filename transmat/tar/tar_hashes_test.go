@@ -0,0 +1,99 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarHashAlgorithms(t *testing.T) {
+	Convey("Tar transmat: hash algorithms", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+				packHashed := func(algo HashAlgorithm, name string) api.WareID {
+					wareID, err := PackWith(PackOptions{Compression: Gzip, Hash: algo})(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name)),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				unpackFrom := func(wareID api.WareID, name string) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.String()+"/unpack-"+name,
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name))},
+						rio.Monitor{},
+					)
+				}
+
+				Convey("each algorithm should give its own stable WareID, which says which it is", func() {
+					wareID384 := packHashed(HashAlgorithm_SHA384, "a.tgz")
+					wareID512 := packHashed(HashAlgorithm_SHA512, "b.tgz")
+					So(wareID512, ShouldNotResemble, wareID384)
+					So(packHashed(HashAlgorithm_SHA384, "c.tgz"), ShouldResemble, wareID384)
+					So(packHashed(HashAlgorithm_SHA512, "d.tgz"), ShouldResemble, wareID512)
+					So(strings.Contains(wareID384.Hash, "-"), ShouldBeFalse)
+					So(wareID512.Hash, ShouldStartWith, "sha512-")
+
+					// The default is what Pack always did.
+					wareIDPack, err := Pack(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareIDPack, ShouldResemble, wareID384)
+
+					Convey("and unpack should verify each with its own algorithm", func() {
+						gotWareID, err := unpackFrom(wareID512, "b.tgz")
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID512)
+						gotWareID, err = unpackFrom(wareID384, "a.tgz")
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID384)
+					})
+					Convey("and claiming the wrong algorithm should be a mismatch", func() {
+						wrongWareID := api.WareID{"tar", "sha512-" + wareID384.Hash}
+						_, err := unpackFrom(wrongWareID, "a.tgz")
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					})
+				})
+				Convey("unknown algorithms should be refused, for pack and unpack", func() {
+					_, err := PackWith(PackOptions{Compression: Gzip, Hash: "md5"})(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						"",
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+					_, err = unpackFrom(api.WareID{"tar", "md5-abcd"}, "a.tgz")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,121 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarIdRemap(t *testing.T) {
+	Convey("Tar transmat: id remapping from config", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_FILTER_UIDMAP")
+				defer os.Unsetenv("RIO_FILTER_GIDMAP")
+				packFixture := func(name string, files []tests.FixtureFile) api.WareID {
+					srcFs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(srcFs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					tests.PlaceFixture(srcFs, files)
+					wareID, err := Pack(context.Background(), PackType, srcFs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID
+				}
+
+				Convey("packing should remap before hashing", func() {
+					wareIDAlpha := packFixture("alpha", tests.FixtureAlpha)
+					So(packFixture("diff", tests.FixtureAlphaDiffUidGid), ShouldNotResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_UIDMAP", "444:0")
+					os.Setenv("RIO_FILTER_GIDMAP", "444:0")
+					So(packFixture("diff-remapped", tests.FixtureAlphaDiffUidGid), ShouldResemble, wareIDAlpha)
+				})
+				Convey("unpacking should remap before chowning", func() {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					So(tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 1, Uid: 444, Gid: 445, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					tw.Write([]byte("x"))
+					So(tw.Close(), ShouldBeNil)
+					filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+
+					os.Setenv("RIO_FILTER_UIDMAP", "444:1444,1:2")
+					os.Setenv("RIO_FILTER_GIDMAP", "1:2")
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpack")))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					prefilterWareID, filteredWareID, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(filteredWareID, ShouldNotResemble, prefilterWareID)
+					fmeta := testutil.ShouldStat(afs, fs.MustRelPath("a"))
+					So(fmeta.Uid, ShouldEqual, 1444)
+					So(fmeta.Gid, ShouldEqual, 445)
+				})
+				Convey("malformed tables should be rejected", func() {
+					os.Setenv("RIO_FILTER_UIDMAP", "444=0")
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarUnpackUnprivileged(t *testing.T) {
+	Convey("Tar transmat: unpacking without the caps to chown", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			So(tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 1, Uid: 444, Gid: 445, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+			tw.Write([]byte("x"))
+			So(tw.Close(), ShouldBeNil)
+			filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+			So(err, ShouldBeNil)
+
+			// If we're root, step down to nobody for the unpack (keeping root
+			//  as the saved uid, so we can step back up afterwards).
+			So(os.Chmod(tmpDir.String(), 0777), ShouldBeNil)
+			if os.Getuid() == 0 {
+				So(syscall.Setresgid(65534, 65534, 0), ShouldBeNil)
+				So(syscall.Setresuid(65534, 65534, 0), ShouldBeNil)
+				defer syscall.Setresgid(0, 0, 0)
+				defer syscall.Setresuid(0, 0, 0)
+			}
+
+			afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpack")))
+			So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+			monChan := make(chan rio.Event, 10)
+			_, _, err = unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{Chan: monChan})
+			close(monChan)
+
+			Convey("the chown should be warned about, not fail the unpack", func() {
+				So(err, ShouldBeNil)
+				var warned []string
+				for evt := range monChan {
+					if evt.Log != nil && evt.Log.Level == rio.LogWarn {
+						warned = append(warned, evt.Log.Detail[0][1])
+					}
+				}
+				So(warned, ShouldContain, "./a")
+				fmeta := testutil.ShouldStat(afs, fs.MustRelPath("a"))
+				So(fmeta.Uid, ShouldEqual, os.Getuid())
+			})
+		})
+	})
+}
@@ -0,0 +1,53 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"encoding/json"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	A manifest lists every entry of a ware as it's packed: one JSON object
+	per line, with the entry's path, metadata, and content hash, in the
+	same form as a seekable tar's index entries (but with no offsets).
+	Those are exactly the records the WareID is hashed from, so an auditor
+	can tell which files differ between two wares by comparing their
+	manifests, without fetching either ware.
+
+	Entries come in the order they were packed (see PackOrder); the first
+	is always the root dir.  A hardlink is listed as the file it is, with
+	its own name, and the content hash of what it's linked to.
+*/
+type manifestWriter struct {
+	enc *json.Encoder
+}
+
+/*
+	Returns a hook for packTar that writes each entry to the manifest,
+	after calling `next` (if any) for it.
+*/
+func (mw *manifestWriter) recorder(next packHook) packHook {
+	return func(fmeta fs.Metadata, contentHash []byte, bodyIn fs.RelPath) error {
+		if next != nil {
+			if err := next(fmeta, contentHash, bodyIn); err != nil {
+				return err
+			}
+		}
+		if err := mw.enc.Encode(seekEntryFor(fmeta, contentHash)); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack manifest: %s", err)
+		}
+		return nil
+	}
+}
+
+func newManifestWriter(w io.Writer) *manifestWriter {
+	return &manifestWriter{json.NewEncoder(w)}
+}
@@ -0,0 +1,88 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarManifest(t *testing.T) {
+	Convey("Tar transmat: a manifest written while packing", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				src := tmpDir.String() + "/src"
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				packManifest := func(opts PackOptions) (api.WareID, []seekEntry) {
+					var buf bytes.Buffer
+					opts.Manifest = &buf
+					wareID, err := PackWith(opts)(context.Background(), PackType, src, api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					var entries []seekEntry
+					dec := json.NewDecoder(&buf)
+					for {
+						var entry seekEntry
+						if err := dec.Decode(&entry); err == io.EOF {
+							break
+						} else {
+							So(err, ShouldBeNil)
+						}
+						entries = append(entries, entry)
+					}
+					return wareID, entries
+				}
+				wareID, entries := packManifest(PackOptions{Compression: Gzip})
+
+				Convey("should list every entry, starting at the root", func() {
+					So(entries, ShouldHaveLength, len(tests.FixtureGamma))
+					So(entries[0].Name, ShouldEqual, ".")
+					So(entries[0].Type, ShouldEqual, string(fs.Type_Dir))
+				})
+				Convey("should hash to the WareID", func() {
+					bucket := &fshash.MemoryBucket{}
+					for _, entry := range entries {
+						fmeta, err := entry.metadata()
+						So(err, ShouldBeNil)
+						bucket.AddRecord(fmeta, entry.ContentHash)
+					}
+					So(defaultHasher.WareID(bucket), ShouldResemble, wareID)
+				})
+				Convey("should be the same whatever the codec", func() {
+					_, entries2 := packManifest(PackOptions{Compression: Zstd})
+					So(entries2, ShouldResemble, entries)
+				})
+				Convey("compared to another's, should show just what changed", func() {
+					So(ioutil.WriteFile(src+"/var/fun", []byte("xyz"), 0644), ShouldBeNil)
+					wareID2, entries2 := packManifest(PackOptions{Compression: Gzip})
+					So(wareID2, ShouldNotResemble, wareID)
+					So(entries2, ShouldHaveLength, len(entries))
+					var changed []string
+					for i := range entries {
+						a, _ := json.Marshal(entries[i])
+						b, _ := json.Marshal(entries2[i])
+						if !bytes.Equal(a, b) {
+							changed = append(changed, entries2[i].Name)
+						}
+					}
+					So(changed, ShouldResemble, []string{"./var/fun"})
+				})
+			})
+		}),
+	)
+}
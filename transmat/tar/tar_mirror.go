@@ -34,10 +34,15 @@ func Mirror(
 		defer close(mon.Chan)
 	}
 
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
 	// Try to read the ware from the target first; if successfull, no-op out.
 	//  We don't fully re-verify the content, because that requires a time
 	//  committment, and we want this command to be fast when run repeatedly.
-	reader, err := PickReader(wareID, []api.WarehouseAddr{target}, false, mon)
+	reader, err := PickReader(ctx, wareID, []api.WarehouseAddr{target}, false, mon)
 	if err == nil {
 		log.MirrorNoop(mon, target, wareID)
 		reader.Close()
@@ -55,7 +60,7 @@ func Mirror(
 	defer wc.Close()
 
 	// Pick a source warehouse and get a reader.
-	reader, err = PickReader(wareID, sources, false, mon)
+	reader, err = PickReader(ctx, wareID, sources, false, mon)
 	if err != nil {
 		return api.WareID{}, err
 	}
@@ -70,7 +75,7 @@ func Mirror(
 	// "unpack", scanningly.  This drives the copy.
 	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
 	// We can ignore the pre/post filter wareIDs, since we know its a no-mutation filter.
-	gotWare, _, err := unpackTar(ctx, afs, filt, reader, mon)
+	gotWare, _, err := unpackTar(ctx, hasher, afs, filt, reader, mon)
 	if err != nil {
 		// If errors at this stage: still return a blank wareID, because
 		//  we haven't finished *uploading* it.
@@ -0,0 +1,90 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"sort"
+	"strings"
+
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	PackOrder selects the order in which entries are emitted into a tar
+	during pack.
+
+	The order changes the bytes of the archive -- and thus anything that
+	hashes the archive blob, like a content-addressable warehouse path --
+	but it does *not* change the WareID.  The WareID is computed over the
+	fshash bucket, which sorts entries itself; the logical content of a
+	fileset is ordering-independent.
+*/
+type PackOrder string
+
+const (
+	/*
+		Emit entries in whatever order the filesystem walk yields them.
+		This is what `Pack` does, and streams without buffering the tree's
+		metadata up front.
+
+		(At present fs.Walk happens to visit siblings in sorted order, which
+		coincides with PackOrder_GnuTar; but fs.Walk does not promise that,
+		so if you need the order, ask for it.)
+	*/
+	PackOrder_Walk PackOrder = ""
+
+	/*
+		Emit entries in the traversal order of GNU tar's `--sort=name`:
+		depth-first, with the children of each directory sorted bytewise
+		by name, and each directory's contents immediately following it.
+
+		This means `./a/b` comes *before* `./a-b`, even though plain string
+		sorting would put it after.
+
+		Archives produced in this mode can be compared entry-by-entry with
+		`tar --sort=name -C <dir> -c .` output.
+	*/
+	PackOrder_GnuTar PackOrder = "gnutar"
+
+	/*
+		Emit entries sorted bytewise by their full path.
+		This is the same order the fshash bucket uses when computing the WareID.
+		Note that this can separate a directory from its children
+		(`./etc/init.d/*` lands between `./etc/init/` and `./etc/init/zed`);
+		our own unpack doesn't care, but some consumers might.
+	*/
+	PackOrder_Lexical PackOrder = "lexical"
+)
+
+/*
+	Sort a slice of paths in place according to the PackOrder.
+	PackOrder_Walk leaves the slice untouched.
+*/
+func sortForPackOrder(order PackOrder, paths []fs.RelPath) {
+	switch order {
+	case PackOrder_GnuTar:
+		sort.Slice(paths, func(i, j int) bool {
+			return gnutarLess(paths[i], paths[j])
+		})
+	case PackOrder_Lexical:
+		sort.Slice(paths, func(i, j int) bool {
+			return paths[i].String() < paths[j].String()
+		})
+	}
+}
+
+// Compare path segments one at a time, so that a parent always sorts
+// before its children and the children stay contiguous behind it.
+func gnutarLess(a, b fs.RelPath) bool {
+	as := strings.Split(a.String(), "/")
+	bs := strings.Split(b.String(), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
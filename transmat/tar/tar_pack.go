@@ -7,22 +7,25 @@ package tartrans
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"context"
-	"crypto/sha512"
 	"io"
+	"io/ioutil"
 	"time"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/warehouse"
 )
 
 var (
@@ -33,9 +36,109 @@ func Pack(
 	ctx context.Context, // Long-running call.  Cancellable.
 	packType api.PackType, // The name of pack format.
 	pathStr string, // The fileset to scan and pack (absolute path).
-	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
 	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	return pack(ctx, packType, pathStr, filt, warehouseOpener(warehouseAddr, packType, mon), indexOpener(warehouseAddr, packType, mon), mon, PackOptions{Compression: Gzip})
+}
+
+/*
+	Options for how PackWith writes the tar.
+	Save the hash algorithm, none of them change the WareID: it's
+	computed over the fileset, not over the bytes of the archive.
+*/
+type PackOptions struct {
+	Order       PackOrder     // The order to emit entries in.  See PackOrder.
+	Compression Compression   // How to compress the tar.  Pack uses Gzip.  (The zero value is Uncompressed!)
+	Level       int           // Compression level; 0 for the codec's default.  See Compress.
+	Hash        HashAlgorithm // The hash to compute the WareID with.  This *does* change it!  See HashAlgorithm.
+	Seekable    bool          // Gzip each entry on its own, and store an index beside the ware, for UnpackPaths.  Needs Gzip, and a content-addressable warehouse.
+	EStargz     bool          // Write eStargz, for lazy pulling by stargz-snapshotter.  Needs Gzip.  See estargzWriter.
+	Manifest    io.Writer     // Optionally: where to list each entry as it's packed, one JSON line apiece.  See manifestWriter.
+}
+
+/*
+	Returns a PackFunc which behaves exactly like Pack, but writes the
+	tar as the options say.
+*/
+func PackWith(opts PackOptions) rio.PackFunc {
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		pathStr string,
+		filt api.FilesetFilters,
+		warehouseAddr api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		return pack(ctx, packType, pathStr, filt, warehouseOpener(warehouseAddr, packType, mon), indexOpener(warehouseAddr, packType, mon), mon, opts)
+	}
+}
+
+/*
+	Returns a PackFunc which behaves exactly like Pack, but emits tar entries
+	in the given order.
+
+	The WareID returned is the same regardless of order; only the archive
+	bytes differ.  See PackOrder for the available modes.
+*/
+func PackWithOrder(order PackOrder) rio.PackFunc {
+	return PackWith(PackOptions{Order: order, Compression: Gzip})
+}
+
+/*
+	Pack, but writing the tar to `writer` rather than to a warehouse: for
+	piping wares straight from one tool to another.  The WareID is returned
+	once the whole tar is written, and is the same as Pack would return.
+
+	Nothing is written if the path doesn't exist (and the WareID is blank,
+	as from Pack).  If there's an error partway, what's been written already
+	is left as is; a reader on the other end of a pipe should expect it
+	to stop early, and not take it for the whole ware.
+	Closing the writer is up to the caller.
+*/
+func PackToStream(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
+	writer io.Writer, // Where to write the tar.
+	opts PackOptions, // How to write the tar.  (Mind, the zero value is uncompressed.)
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (api.WareID, error) {
+	return pack(ctx, packType, pathStr, filt, func() (warehouse.BlobstoreWriteController, error) {
+		return warehouse.StreamBlobstoreWriteController{writer}, nil
+	}, nil, mon, opts)
+}
+
+func warehouseOpener(warehouseAddr api.WarehouseAddr, packType api.PackType, mon rio.Monitor) func() (warehouse.BlobstoreWriteController, error) {
+	return func() (warehouse.BlobstoreWriteController, error) {
+		return OpenWriteController(warehouseAddr, packType, mon)
+	}
+}
+
+/*
+	Opens a write controller for a seekable tar's index, beside the ware.
+	See seekIndexSuffix.
+*/
+func indexOpener(warehouseAddr api.WarehouseAddr, packType api.PackType, mon rio.Monitor) func() (warehouse.BlobstoreWriteController, error) {
+	return func() (warehouse.BlobstoreWriteController, error) {
+		if err := checkSeekableWarehouse(warehouseAddr); err != nil {
+			return nil, err
+		}
+		return OpenWriteController(warehouseAddr, packType, mon)
+	}
+}
+
+func pack(
+	ctx context.Context,
+	packType api.PackType,
+	pathStr string,
+	filt api.FilesetFilters,
+	openWriteController func() (warehouse.BlobstoreWriteController, error),
+	openIndexWriteController func() (warehouse.BlobstoreWriteController, error), // Only for seekable tars; nil if there's nowhere for an index.
+	mon rio.Monitor,
+	opts PackOptions,
 ) (_ api.WareID, err error) {
 	if mon.Chan != nil {
 		defer close(mon.Chan)
@@ -46,11 +149,45 @@ func Pack(
 	if packType != PackType {
 		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
 	}
+	switch opts.Order {
+	case PackOrder_Walk, PackOrder_GnuTar, PackOrder_Lexical:
+		// pass
+	default:
+		return api.WareID{}, Errorf(rio.ErrUsage, "unknown pack order %q", opts.Order)
+	}
+	hasher, err := hasherFor(opts.Hash)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	// Check the codec now, too, rather than after opening the warehouse.
+	if _, err := Compress(ioutil.Discard, opts.Compression, opts.Level); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	if opts.Seekable {
+		if opts.Compression != Gzip {
+			return api.WareID{}, Errorf(rio.ErrUsage, "seekable tars must be gzipped: they're gzipped entry by entry")
+		}
+		if openIndexWriteController == nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "seekable tars need a warehouse to keep their index in; a stream has no room for it")
+		}
+	}
+	if opts.EStargz {
+		if opts.Compression != Gzip {
+			return api.WareID{}, Errorf(rio.ErrUsage, "eStargz tars must be gzipped: they're gzipped entry by entry")
+		}
+		if opts.Seekable {
+			return api.WareID{}, Errorf(rio.ErrUsage, "a tar can be seekable or eStargz, not both: each has its own index")
+		}
+	}
 	path, err := fs.ParseAbsolutePath(pathStr)
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
 	}
-	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	//  Filters are validated here too, with empty fields filled in from the
+	//  defaults: so a typo is an error rather than a different hash, and
+	//  leaving a field empty hashes the same as spelling out its default.
+	//  Tars can keep mtimes to the nanosecond (in PAX records), if the filter says to.
+	filt2, nanoMtimes, err := filters.ProcessFilters(filt, apiutil.FilterPurposePack)
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
@@ -69,100 +206,357 @@ func Pack(
 		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
 	}
 
-	// Connect to warehouse, and get write controller opened.
-	wc, err := OpenWriteController(warehouseAddr, packType, mon)
+	// Connect to warehouse (or stream), and get write controller opened.
+	wc, err := openWriteController()
 	if err != nil {
 		return api.WareID{}, err
 	}
 	defer wc.Close()
+	//  Seekable tars have an index to store too.
+	var indexWc warehouse.BlobstoreWriteController
+	if opts.Seekable {
+		indexWc, err = openIndexWriteController()
+		if err != nil {
+			return api.WareID{}, err
+		}
+		defer indexWc.Close()
+	}
 
 	// Wrap writer stream to do compress on the way out.
 	//  Note on compression levels: The default is 6; and per http://tukaani.org/lzma/benchmarks.html
 	//  this appears quite reasonable: higher levels appear to have minimal size payoffs, but significantly rising compress time costs;
 	//  decompression time does not vary with compression level.
-	// Save a gzip reference just to close it; tar.Writer doesn't passthru its own close.
-	gzWriter := gzip.NewWriter(wc)
+	// Save a compressor reference just to close it; tar.Writer doesn't passthru its own close.
+	//  (The fileset is hashed before any of this; so the WareID is the same whatever the codec.)
+	//  Seekable and eStargz tars are gzipped a member at a time, with each entry's place noted as it's written.
+	var compWriter io.WriteCloser
+	var members *memberWriter
+	if opts.Seekable || opts.EStargz {
+		members, _ = newMemberWriter(wc, opts.Level)
+		compWriter = members
+	} else {
+		compWriter, _ = Compress(wc, opts.Compression, opts.Level)
+	}
 
 	// Construct tar writer.
-	tarWriter := tar.NewWriter(gzWriter)
+	//  eStargz tars have some entries of their own, besides the fileset's;
+	//  the landmark goes first.
+	var index *seekIndex
+	var stargz *estargzWriter
+	var hooks packHooks
+	var tarWriter *tar.Writer
+	switch {
+	case opts.Seekable:
+		tarWriter = tar.NewWriter(compWriter)
+		index = &seekIndex{}
+		hooks.entry = index.recorder(tarWriter, members)
+	case opts.EStargz:
+		stargz = newEstargzWriter(members)
+		tarWriter = stargz.tw
+		hooks = stargz.hooks()
+		if err := stargz.writeLandmark(); err != nil {
+			return api.WareID{}, err
+		}
+	default:
+		tarWriter = tar.NewWriter(compWriter)
+	}
+	//  A manifest sees each entry after anything else does.
+	if opts.Manifest != nil {
+		hooks.entry = newManifestWriter(opts.Manifest).recorder(hooks.entry)
+	}
 
 	// Scan and tarify!
-	wareID, err := packTar(ctx, afs, filt2, tarWriter)
+	wareID, err := packTar(ctx, hasher, afs, filt2, opts.Order, nanoMtimes, tarWriter, compWriter, hooks, mon)
 	if err != nil {
 		return wareID, err
 	}
 	// Close all the intermediate writer layers to ensure they've flushed.
-	tarWriter.Close()
-	gzWriter.Close()
+	//  (eStargz tars end with their TOC, which does that.)
+	var tocDigest string
+	if opts.EStargz {
+		if tocDigest, err = stargz.finish(); err != nil {
+			return wareID, err
+		}
+	} else {
+		tarWriter.Close()
+		compWriter.Close()
+	}
 
 	// If we made it all the way with no errors, commit.
 	//  (Otherwise, the write controller will be closed by default by our defers.)
-	return wareID, wc.Commit(wareID)
+	//  The index goes after the ware, so nobody finds it first.
+	if err := wc.Commit(wareID); err != nil {
+		return wareID, err
+	}
+	if opts.Seekable {
+		return wareID, storeSeekIndex(indexWc, wareID, index)
+	}
+	if opts.EStargz {
+		log.EstargzPacked(mon, wareID, tocDigest)
+	}
+	return wareID, nil
+}
+
+/*
+	Called by packTar as it writes each entry.  Either may be nil.
+
+	`body` is called for files once their header is written, before the body.
+	`entry` is called once an entry is all written, with what went in the
+	bucket for it, and the name of the entry whose body it has (which is
+	its own, except for hardlinks).
+
+	With a body hook, files are never written as sparse entries: those put
+	header and body out together, with nowhere between to call it.
+*/
+type packHooks struct {
+	body  func(fmeta fs.Metadata) error
+	entry packHook
 }
 
+type packHook func(fmeta fs.Metadata, contentHash []byte, bodyIn fs.RelPath) error
+
 func packTar(
 	ctx context.Context,
+	hasher wareHasher,
 	afs fs.FS,
 	filt apiutil.FilesetFilters,
+	order PackOrder,
+	nanoMtimes bool, // If false, mtimes are truncated to the second.  See filters.MtimeKeepNanos.
 	tw *tar.Writer,
+	raw io.Writer, // What tw writes to.  Sparse entries put a header of their own on it.
+	hooks packHooks, // Optionally: called as each entry is written.
+	mon rio.Monitor,
 ) (api.WareID, error) {
 	// Allocate bucket for keeping each metadata entry and content hash;
 	// the full tree hash will be computed from this at the end.
 	bucket := &fshash.MemoryBucket{}
 
-	// Walk the filesystem, emitting tar entries and filling the bucket as we go.
-	tarHeader := &tar.Header{}
-	preVisit := func(filenode *fs.FilewalkNode) error {
-		if filenode.Err != nil {
-			return filenode.Err
-		}
+	// Backslashes in names may or may not be separators; config says.
+	sepPolicyName, err := config.GetTarSeparatorPolicy()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	sepPolicy := SeparatorPolicy(sepPolicyName)
 
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	scanFile := fsOp.ScanFile
+	if host.Xattrs.KeepsAny() {
+		scanFile = fsOp.ScanFileWithXattrs
+	}
+
+	// File contents may be hashed ahead of the writer, in parallel; config says.
+	//  If so, this is filled in before any entries are emitted.
+	workers, err := config.GetPackParallelism()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	var prehash map[fs.RelPath]<-chan prehashed
+
+	// Report bytes hashed as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	// Files with several names are packed once, then linked to by the others.
+	//  In the bucket, each name but the least links to that one (see paxHardlink);
+	//  so all the names are gathered before any entries are emitted.
+	hardlinks := map[fsOp.FileIdentity]hardlinkTarget{}
+	leastNames := map[fsOp.FileIdentity]fs.RelPath{}
+
+	// Emitting one entry is the same regardless of order:
+	//  scan the file, emit a tar entry, and add it to the bucket.
+	tarHeader := &tar.Header{}
+	packEntry := func(path fs.RelPath) error {
 		// Consider cancellation.
 		if ctx.Err() != nil {
 			return Errorf(rio.ErrCancelled, "cancelled")
 		}
 
 		// Open file.
-		fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
+		fmeta, file, err := scanFile(afs, path) // FIXME : we already have the full metadata loaded; give ScanFile option to accept it!
 		if err != nil {
 			return err
 		}
 
 		// Apply filters.
+		host.Apply(fmeta)
 		filters.Apply(filt, fmeta)
 
-		// Flatten time to seconds.  The tar writer impl doesn't do subsecond precision.
-		//  The writer will always flatten it internally, but we need to do it here as well
-		//  so that the hash and the serial form are describing the same thing.
-		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+		// Refuse names that would be misread under the separator policy.
+		if err := sepPolicy.packName(fmeta.Name.String()); err != nil {
+			return err
+		}
+
+		// Flatten time to seconds, unless asked not to.  Plain tar headers only
+		//  have whole seconds; the nanoseconds go in PAX records (see MetadataToTarHdr).
+		//  Either way, the hash and the serial form must describe the same thing.
+		if !nanoMtimes {
+			fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+		}
+
+		// If this is another name for a file we've already packed, link to it:
+		//  no body, and the same content hash as before.
+		id, linkable := fsOp.HardlinkIdentity(afs, path)
+		if least := leastNames[id]; linkable && least != path {
+			fmeta.Linkname = least.String()
+		}
+		if first, seen := hardlinks[id]; linkable && seen {
+			file.Close()
+			linkFmeta := *fmeta
+			linkFmeta.Type, linkFmeta.Linkname, linkFmeta.Size = fs.Type_Hardlink, first.filtered.Name.String(), 0
+			MetadataToTarHdr(&linkFmeta, tarHeader)
+			if fmeta.Linkname != "" {
+				tarHeader.PAXRecords = map[string]string{paxHardlink: fmeta.Linkname}
+			}
+			if err := tw.WriteHeader(tarHeader); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			bucket.AddRecord(*fmeta, first.contentHash)
+			if hooks.entry != nil {
+				return hooks.entry(*fmeta, first.contentHash, first.filtered.Name)
+			}
+			return nil
+		}
+
+		// If it's a file, it may be hashed already (if hashing in parallel), or need
+		//  hashing before we write anything (if it has holes, which we'll want to
+		//  find); otherwise it's hashed as it's streamed, below.
+		var result prehashed
+		if file != nil {
+			defer file.Close()
+			if pre, ok := prehash[path]; ok {
+				select {
+				case result = <-pre:
+				case <-ctx.Done():
+					return Errorf(rio.ErrCancelled, "cancelled")
+				}
+			} else if sparseCandidate(afs, path, file) {
+				result = hashFile(ctx, afs, hasher, path, file)
+			}
+			if result.err != nil {
+				return result.err
+			}
+			if hooks.body != nil {
+				result.data = nil
+			}
+		}
 
 		// Flip our metadata to tar header format, and flush it.
+		//  Files with holes are written as sparse entries, header and body both.
 		MetadataToTarHdr(fmeta, tarHeader)
-		if err := tw.WriteHeader(tarHeader); err != nil {
+		if result.data != nil {
+			if err := writeSparse(ctx, tw, raw, tarHeader, result.data, file.(io.ReaderAt)); err != nil {
+				return err
+			}
+		} else if err := tw.WriteHeader(tarHeader); err != nil {
 			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
 		}
+		if file != nil && hooks.body != nil {
+			if err := hooks.body(*fmeta); err != nil {
+				return err
+			}
+		}
 
-		// If it's a file, stream the body into the tar while hashing; for all,
-		//  record the metadata in the bucket for the total hash.
-		if file == nil {
+		// If it's a file, stream the body into the tar (hashing it, if we haven't);
+		//  for all, record the metadata in the bucket for the total hash.
+		switch {
+		case file == nil:
 			bucket.AddRecord(*fmeta, nil)
-		} else {
-			defer file.Close()
-			hasher := sha512.New384()
-			tee := io.MultiWriter(tw, hasher)
-			_, err := io.Copy(tee, file)
+			if hooks.entry != nil {
+				return hooks.entry(*fmeta, nil, fmeta.Name)
+			}
+			return nil
+		case result.data != nil:
+			// Written already.
+		case result.contentHash != nil:
+			// Hashed from an earlier read; so hash what's written too, and make
+			//  sure it's the same bytes, or the bucket would describe another file.
+			contentHasher := hasher.New()
+			tee := io.MultiWriter(tw, contentHasher)
+			n, err := io.Copy(tee, cancellableReader{ctx, file})
+			if err != nil {
+				return err
+			}
+			if n != result.size || !bytes.Equal(contentHasher.Sum(nil), result.contentHash) {
+				return Errorf(rio.ErrInoperablePath, "file %q changed while being packed", path)
+			}
+		default:
+			contentHasher := hasher.New()
+			tee := io.MultiWriter(tw, contentHasher)
+			n, err := io.Copy(tee, cancellableReader{ctx, file})
 			if err != nil {
 				return err
 			}
-			bucket.AddRecord(*fmeta, hasher.Sum(nil))
+			result = prehashed{contentHash: contentHasher.Sum(nil), size: n}
+		}
+		bucket.AddRecord(*fmeta, result.contentHash)
+		if linkable {
+			hardlinks[id] = hardlinkTarget{filtered: *fmeta, contentHash: result.contentHash}
+		}
+		prog.Add(result.size, fmeta.Name)
+		if hooks.entry != nil {
+			return hooks.entry(*fmeta, result.contentHash, fmeta.Name)
+		}
+		return nil
+	}
+
+	// Walk the filesystem, gathering names; then emit tar entries, filling the bucket as we go.
+	//  We have to see all the paths first, to know each hardlinked file's least name;
+	//  and then they can be sorted for an explicit order, and if hashing in parallel,
+	//  the workers can get ahead.
+	var paths []fs.RelPath
+	var files []fs.RelPath
+	preVisit := func(filenode *fs.FilewalkNode) error {
+		if filenode.Err != nil {
+			return filenode.Err
+		}
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+		paths = append(paths, filenode.Info.Name)
+		if filenode.Info.Type == fs.Type_File {
+			files = append(files, filenode.Info.Name)
 		}
 		return nil
 	}
 	if err := fs.Walk(afs, preVisit, nil); err != nil {
 		return api.WareID{}, err
 	}
+	sortForPackOrder(order, paths)
+	for _, path := range files {
+		id, linkable := fsOp.HardlinkIdentity(afs, path)
+		if least, ok := leastNames[id]; linkable && (!ok || path.String() < least.String()) {
+			leastNames[id] = path
+		}
+	}
+	if workers > 1 {
+		// Hash in the order the files will be emitted; skip the second and
+		//  later names of hardlinked files, which will be emitted as links.
+		sortForPackOrder(order, files)
+		seen := map[fsOp.FileIdentity]struct{}{}
+		toHash := files[:0]
+		for _, path := range files {
+			if id, linkable := fsOp.HardlinkIdentity(afs, path); linkable {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+			}
+			toHash = append(toHash, path)
+		}
+		prehashCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		prehash = prehashFiles(prehashCtx, afs, hasher, workers, toHash)
+	}
+	for _, path := range paths {
+		if err := packEntry(path); err != nil {
+			return api.WareID{}, err
+		}
+	}
 
 	// Hash the thing!
-	hash := fshash.HashBucket(bucket, sha512.New384)
-	return api.WareID{"tar", misc.Base58Encode(hash)}, nil
+	wareID := hasher.WareID(bucket)
+	prog.Done()
+	return wareID, nil
 }
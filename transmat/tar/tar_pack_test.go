@@ -6,10 +6,24 @@ Sniperkit-Bot
 package tartrans
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/tests"
 )
 
@@ -18,7 +32,310 @@ func TestTarPack(t *testing.T) {
 		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
 			tests.CheckPackProducesConsistentHash(PackType, Pack)
 			tests.CheckPackHashVariesOnVariations(PackType, Pack)
+			tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
 			tests.CheckPackErrorsGracefully(PackType, Pack)
 		}),
 	)
 }
+
+func TestTarPackOrder(t *testing.T) {
+	Convey("Tar transmat: pack ordering", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+				packOrdered := func(order PackOrder, name string) (api.WareID, []string) {
+					wareID, err := PackWithOrder(order)(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name)),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID, tarEntryNames(tmpDir.String() + "/" + name)
+				}
+
+				Convey("GNU tar order should match a fixture produced by gnu tar entry-by-entry", func() {
+					_, names := packOrdered(PackOrder_GnuTar, "gnutar.tgz")
+					So(names, ShouldResemble, tarEntryNames("./fixtures/tar_gnuSortGamma.tgz"))
+				})
+				Convey("Lexical order should sort by full path, even when that separates dirs from their children", func() {
+					_, names := packOrdered(PackOrder_Lexical, "lexical.tgz")
+					So(names, ShouldResemble, []string{
+						"./",
+						"./etc/",
+						"./etc/init/",
+						"./etc/init.d/",
+						"./etc/init.d/service-p",
+						"./etc/init.d/service-q",
+						"./etc/init/zed", // note: not adjacent to its parent!
+						"./etc/trick",
+						"./etc/tricky",
+						"./var/",
+						"./var/fun",
+					})
+				})
+				Convey("The WareID should not vary with order", func() {
+					wareIDWalk, _ := packOrdered(PackOrder_Walk, "walk.tgz")
+					wareIDGnu, _ := packOrdered(PackOrder_GnuTar, "gnutar.tgz")
+					wareIDLexical, _ := packOrdered(PackOrder_Lexical, "lexical.tgz")
+					So(wareIDGnu, ShouldResemble, wareIDWalk)
+					So(wareIDLexical, ShouldResemble, wareIDWalk)
+				})
+				Convey("Unknown orders should be rejected", func() {
+					_, err := PackWithOrder("bogus")(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						"",
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarPackCompression(t *testing.T) {
+	Convey("Tar transmat: pack compression", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+				packCompressed := func(opts PackOptions, name string) (api.WareID, int64) {
+					wareID, err := PackWith(opts)(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name)),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					fi, err := os.Stat(tmpDir.String() + "/" + name)
+					So(err, ShouldBeNil)
+					return wareID, fi.Size()
+				}
+
+				Convey("The WareID should not vary with codec or level, though the stored size does", func() {
+					wareIDDefault, sizeDefault := packCompressed(PackOptions{Compression: Gzip}, "default.tgz")
+					wareIDFast, sizeFast := packCompressed(PackOptions{Compression: Gzip, Level: 1}, "fast.tgz")
+					wareIDNone, sizeNone := packCompressed(PackOptions{Compression: Uncompressed}, "none.tar")
+					wareIDZstd, sizeZstd := packCompressed(PackOptions{Compression: Zstd}, "default.tar.zst")
+					wareIDZstdBest, sizeZstdBest := packCompressed(PackOptions{Compression: Zstd, Level: 19}, "best.tar.zst")
+					wareIDLz4, sizeLz4 := packCompressed(PackOptions{Compression: Lz4}, "default.tar.lz4")
+					wareIDLz4Best, sizeLz4Best := packCompressed(PackOptions{Compression: Lz4, Level: 12}, "best.tar.lz4")
+					So(wareIDFast, ShouldResemble, wareIDDefault)
+					So(wareIDNone, ShouldResemble, wareIDDefault)
+					So(wareIDZstd, ShouldResemble, wareIDDefault)
+					So(wareIDZstdBest, ShouldResemble, wareIDDefault)
+					So(wareIDLz4, ShouldResemble, wareIDDefault)
+					So(wareIDLz4Best, ShouldResemble, wareIDDefault)
+					So(sizeDefault, ShouldBeLessThan, sizeNone)
+					So(sizeFast, ShouldBeLessThan, sizeNone)
+					So(sizeZstd, ShouldBeLessThan, sizeNone)
+					So(sizeZstdBest, ShouldBeLessThan, sizeNone)
+					So(sizeLz4, ShouldBeLessThan, sizeNone)
+					So(sizeLz4Best, ShouldBeLessThan, sizeNone)
+
+					Convey("and each should unpack to the same WareID, detecting its codec", func() {
+						for _, name := range []string{"default.tgz", "fast.tgz", "none.tar", "default.tar.zst", "best.tar.zst", "default.tar.lz4", "best.tar.lz4"} {
+							gotWareID, err := Unpack(
+								context.Background(),
+								wareIDDefault,
+								tmpDir.String()+"/unpack-"+name,
+								api.Filter_NoMutation,
+								rio.Placement_Direct,
+								[]api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name))},
+								rio.Monitor{},
+							)
+							So(err, ShouldBeNil)
+							So(gotWareID, ShouldResemble, wareIDDefault)
+						}
+					})
+				})
+				Convey("Codecs we can't write, and bad levels, should be rejected", func() {
+					for _, opts := range []PackOptions{{Compression: Xz}, {Compression: Gzip, Level: 42}, {Compression: Zstd, Level: 42}, {Compression: Lz4, Level: 42}} {
+						_, err := PackWith(opts)(
+							context.Background(),
+							PackType,
+							afs.BasePath().String(),
+							api.Filter_NoMutation,
+							"",
+							rio.Monitor{},
+						)
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+					}
+				})
+				Convey("A broken zstd ware should be an error, not taken for a plain tar", func() {
+					r, err := Decompress(bytes.NewReader([]byte{0x28, 0xB5, 0x2F, 0xFD, 0, 0, 0, 0, 0, 0}))
+					So(err, ShouldBeNil)
+					_, err = ioutil.ReadAll(r)
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarPackLongPaths(t *testing.T) {
+	Convey("Tar transmat: long paths and link targets", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureLongPaths)
+				_, err := Pack(
+					context.Background(),
+					PackType,
+					afs.BasePath().String(),
+					api.Filter_NoMutation,
+					api.WarehouseAddr(fmt.Sprintf("file://%s/long.tgz", tmpDir)),
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+
+				Convey("should be written whole, in PAX headers, rather than truncated", func() {
+					f, err := os.Open(tmpDir.String() + "/long.tgz")
+					So(err, ShouldBeNil)
+					defer f.Close()
+					r, err := Decompress(f)
+					So(err, ShouldBeNil)
+					tr := tar.NewReader(r)
+					got := map[string]*tar.Header{}
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						So(err, ShouldBeNil)
+						got[hdr.Name] = hdr
+					}
+					for _, file := range tests.FixtureLongPaths[3:] {
+						hdr := got[file.Metadata.Name.String()]
+						So(hdr, ShouldNotBeNil)
+						So(hdr.Linkname, ShouldEqual, file.Metadata.Linkname)
+						So(hdr.Format&tar.FormatPAX, ShouldNotEqual, 0)
+					}
+				})
+			})
+		}),
+	)
+}
+
+func TestTarPackToStream(t *testing.T) {
+	Convey("Tar transmat: pack to a stream", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+				wareID, err := Pack(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("should give the same WareID as Pack, and a tar that unpacks to it", func() {
+					var buf bytes.Buffer
+					streamWareID, err := PackToStream(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, &buf, PackOptions{Compression: Gzip}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(streamWareID, ShouldResemble, wareID)
+					So(buf.Len(), ShouldBeGreaterThan, 0)
+					os.Setenv("RIO_CACHE", tmpDir.String()+"/cache")
+					defer os.Unsetenv("RIO_CACHE")
+					unpackedWareID, err := UnpackFromStream(context.Background(), wareID, &buf, tmpDir.String()+"/unpack", api.Filter_NoMutation, rio.Placement_Direct, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(unpackedWareID, ShouldResemble, wareID)
+				})
+				Convey("should write nothing for a path that doesn't exist", func() {
+					var buf bytes.Buffer
+					streamWareID, err := PackToStream(context.Background(), PackType, tmpDir.String()+"/nonexistent", api.Filter_NoMutation, &buf, PackOptions{Compression: Gzip}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(streamWareID.Hash, ShouldEqual, "")
+					So(buf.Len(), ShouldEqual, 0)
+				})
+			})
+		}),
+	)
+}
+
+func tarEntryNames(path string) (names []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	r, err := Decompress(f)
+	if err != nil {
+		panic(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestTarPackNanoMtimes(t *testing.T) {
+	Convey("Tar transmat: nanosecond mtimes", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.Mkdir(tmpDir.String()+"/src", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/src/file", []byte("tick"), 0644), ShouldBeNil)
+				mtime := time.Unix(1500000000, 123456789)
+				So(os.Chtimes(tmpDir.String()+"/src/file", mtime, mtime), ShouldBeNil)
+				packAndUnpack := func(mtimeFilter string, name string) (api.WareID, time.Time) {
+					wareAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/%s.tgz", tmpDir, name))
+					filt := api.Filter_NoMutation
+					filt.Mtime = mtimeFilter
+					wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", filt, wareAddr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					_, err = Unpack(context.Background(), wareID, tmpDir.String()+"/"+name, api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{wareAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					fi, err := os.Lstat(tmpDir.String() + "/" + name + "/file")
+					So(err, ShouldBeNil)
+					return wareID, fi.ModTime()
+				}
+
+				Convey("by default, should be truncated to the second", func() {
+					_, gotMtime := packAndUnpack("keep", "plain")
+					So(gotMtime.UnixNano(), ShouldEqual, mtime.Truncate(time.Second).UnixNano())
+				})
+				Convey("when asked, should round-trip exactly, and change the WareID", func() {
+					wareIDPlain, _ := packAndUnpack("keep", "plain")
+					wareIDNanos, gotMtime := packAndUnpack(filters.MtimeKeepNanos, "nanos")
+					So(gotMtime.UnixNano(), ShouldEqual, mtime.UnixNano())
+					So(wareIDNanos, ShouldNotResemble, wareIDPlain)
+				})
+				Convey("when asked, but with only whole seconds, the WareID shouldn't change", func() {
+					// (The dir's mtime counts too; it was made just now, so it has nanoseconds of its own.)
+					So(os.Chtimes(tmpDir.String()+"/src/file", mtime, mtime.Truncate(time.Second)), ShouldBeNil)
+					So(os.Chtimes(tmpDir.String()+"/src", mtime, mtime.Truncate(time.Second)), ShouldBeNil)
+					wareIDPlain, _ := packAndUnpack("keep", "plain")
+					wareIDNanos, _ := packAndUnpack(filters.MtimeKeepNanos, "nanos")
+					So(wareIDNanos, ShouldResemble, wareIDPlain)
+				})
+				Convey("asked for while unpacking, should be refused, saying it's only for packing", func() {
+					wareAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/plain.tgz", tmpDir))
+					wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, wareAddr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					filt := api.Filter_NoMutation
+					filt.Mtime = filters.MtimeKeepNanos
+					_, err = Unpack(context.Background(), wareID, tmpDir.String()+"/out", filt, rio.Placement_Copy, []api.WarehouseAddr{wareAddr}, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+					So(err.Error(), ShouldContainSubstring, "only for packing")
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,83 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarPermsMask(t *testing.T) {
+	Convey("Tar transmat: perms masks from config", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_FILTER_PERMS_MASK")
+				packFixture := func(name string, files []tests.FixtureFile) api.WareID {
+					srcFs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(srcFs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					tests.PlaceFixture(srcFs, files)
+					wareID, err := Pack(context.Background(), PackType, srcFs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID
+				}
+
+				Convey("packing should mask before hashing", func() {
+					wareIDAlpha := packFixture("alpha", tests.FixtureAlpha)
+					So(packFixture("setuid", tests.FixtureAlphaDiffSetuid), ShouldNotResemble, wareIDAlpha)
+					So(packFixture("highbits", tests.FixtureAlphaDiffPerm3), ShouldNotResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_PERMS_MASK", "4000")
+					So(packFixture("setuid-masked", tests.FixtureAlphaDiffSetuid), ShouldResemble, wareIDAlpha)
+					// Setgid and sticky are still there.
+					So(packFixture("highbits-part-masked", tests.FixtureAlphaDiffPerm3), ShouldNotResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_PERMS_MASK", "7000")
+					So(packFixture("highbits-masked", tests.FixtureAlphaDiffPerm3), ShouldResemble, wareIDAlpha)
+				})
+				Convey("unpacking should mask before chmodding", func() {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					So(tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					So(tw.WriteHeader(&tar.Header{Name: "d/a", Typeflag: tar.TypeReg, Mode: 06777, Size: 1, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					tw.Write([]byte("x"))
+					So(tw.WriteHeader(&tar.Header{Name: "d/ln", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "a", ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					So(tw.Close(), ShouldBeNil)
+					filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+
+					os.Setenv("RIO_FILTER_PERMS_MASK", "6022")
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpack")))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					prefilterWareID, filteredWareID, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(filteredWareID, ShouldNotResemble, prefilterWareID)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("d")).Perms, ShouldEqual, 0755)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("d/a")).Perms, ShouldEqual, 0755)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("d/ln")).Perms, ShouldEqual, 0777)
+				})
+				Convey("malformed masks should be rejected", func() {
+					for _, mask := range []string{"0899", "17777"} {
+						os.Setenv("RIO_FILTER_PERMS_MASK", mask)
+						_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+					}
+				})
+			})
+		}),
+	)
+}
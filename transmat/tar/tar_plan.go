@@ -0,0 +1,271 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+type PlanAction string
+
+const (
+	Plan_Create PlanAction = "create" // Make the entry, with the type, perms, link or device, xattrs, and mtime given.
+	Plan_Chmod  PlanAction = "chmod"  // Set perms and mtime on the base dir, which exists already (so isn't created).
+	Plan_Chown  PlanAction = "chown"  // Set the uid and gid given.  Not planned if chown is skipped.
+)
+
+/*
+	One line of output from PlanUnpack: something an unpack would do to
+	the target filesystem.
+
+	The Metadata is as it would be placed -- that is, after filters, id
+	remaps, and perms masks.
+*/
+type PlanEntry struct {
+	Action   PlanAction
+	Metadata fs.Metadata
+}
+
+func (p PlanEntry) String() string {
+	m := p.Metadata
+	switch p.Action {
+	case Plan_Create:
+		switch m.Type {
+		case fs.Type_Symlink, fs.Type_Hardlink:
+			return fmt.Sprintf("%s %s %s -> %s", p.Action, m.Type, m.Name, m.Linkname)
+		case fs.Type_Device, fs.Type_CharDevice:
+			return fmt.Sprintf("%s %s %s %04o %d:%d", p.Action, m.Type, m.Name, m.Perms, m.Devmajor, m.Devminor)
+		default:
+			return fmt.Sprintf("%s %s %s %04o", p.Action, m.Type, m.Name, m.Perms)
+		}
+	case Plan_Chmod:
+		return fmt.Sprintf("%s %s %04o", p.Action, m.Name, m.Perms)
+	case Plan_Chown:
+		return fmt.Sprintf("%s %s %d:%d", p.Action, m.Name, m.Uid, m.Gid)
+	default:
+		return fmt.Sprintf("%s %s %s", p.Action, m.Type, m.Name)
+	}
+}
+
+/*
+	Report what Unpack would do to the filesystem at `path`, without doing
+	any of it: nothing is written, mounted, fetched into the cache, or
+	placed from it.  Each step is passed to `emit`, in the order unpack
+	would take it; if `emit` returns an error, planning stops and that
+	error is returned.
+
+	The plan is of unpacking in direct mode.  (The other placement modes
+	end up with the same files; they just get there by way of the cache.)
+	Filters, and the id remaps and perms masks from config, are applied
+	just as unpack applies them.
+
+	The target is read, but only to see whether the base dir is already
+	there, which unpack chmods if so.  Nothing else is checked against it;
+	if the target has files where the ware does, the plan won't say so,
+	but the unpack will fail.  Likewise, a chown the plan lists may turn
+	out to be refused, when not running as root; unpack only warns then.
+
+	As with DiffWares, the ware's hash can only be checked once the whole
+	stream is read; so on ErrWareHashMismatch, the plan already emitted
+	is garbage.
+*/
+func PlanUnpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for planning.
+	path string, // Where the fileset would be unpacked (absolute path).
+	filt api.FilesetFilters, // Optionally: filters unpack would apply.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	emit func(PlanEntry) error, // Receives each step of the plan.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	path2, err := fs.ParseAbsolutePath(path)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "plan must be called with absolute path: %s", err)
+	}
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return err
+	}
+
+	// Pick a warehouse and get a reader.
+	//  Not the staged kind: that would write to the cache.
+	reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	gotWareID, err := planTar(ctx, hasher, osfs.New(path2), filt2, reader, emit)
+	if err != nil {
+		return err
+	}
+	if gotWareID != wareID {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, gotWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   gotWareID.String(),
+			},
+		)
+	}
+	return nil
+}
+
+/*
+	Walks the tar as unpackTar does, emitting what it would do to `afs`
+	rather than doing it.  `afs` is only read.
+	Returns the (prefilter) WareID.
+*/
+func planTar(
+	ctx context.Context,
+	hasher wareHasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	emit func(PlanEntry) error,
+) (api.WareID, error) {
+	// Wrap input stream with decompression as necessary.
+	reader2, err := Decompress(reader)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
+	}
+	tr := tar.NewReader(cancellableReader{ctx, reader2})
+
+	// Same bookkeeping as unpack: a bucket for the hash, and a record of dirs seen.
+	bucket := &fshash.MemoryBucket{}
+	dirs := map[fs.RelPath]struct{}{}
+	hardlinks := hardlinkTargets{}
+	stargz := estargzSkipper{}
+
+	// Same config as unpack, too.
+	sepPolicyName, err := config.GetTarSeparatorPolicy()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	sepPolicy := SeparatorPolicy(sepPolicyName)
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	filter := func(fmeta fs.Metadata) fs.Metadata {
+		host.Apply(&fmeta)
+		filters.Apply(filt, &fmeta)
+		return fmeta
+	}
+
+	// What placing an entry amounts to; see fsOp.PlaceFile.
+	place := func(fmeta fs.Metadata) error {
+		action := Plan_Create
+		if fmeta.Name == (fs.RelPath{}) {
+			if existing, err := afs.LStat(fmeta.Name); err == nil && existing.Type == fs.Type_Dir {
+				action = Plan_Chmod
+			}
+		}
+		if err := emit(PlanEntry{action, fmeta}); err != nil {
+			return err
+		}
+		if fmeta.Type == fs.Type_Hardlink || filt.SkipChown {
+			return nil
+		}
+		return emit(PlanEntry{Plan_Chown, fmeta})
+	}
+
+	for {
+		fmeta := fs.Metadata{}
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // sucess!  end of archive.
+		}
+		if ctx.Err() != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+		}
+		if stargz.skip(thdr) {
+			continue
+		}
+		if thdr.Name, err = sepPolicy.unpackName(thdr.Name); err != nil {
+			return api.WareID{}, err
+		}
+		if err := TarHdrToMetadata(thdr, &fmeta); err != nil {
+			return api.WareID{}, err
+		}
+		if fmeta.Name.GoesUp() {
+			return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
+		}
+
+		// Infer parents, if necessary.
+		for _, parent := range fmeta.Name.SplitParent() {
+			if _, exists := dirs[parent]; exists {
+				continue
+			}
+			conjuredFmeta := fshash.DefaultDirMetadata()
+			conjuredFmeta.Name = parent
+			dirs[parent] = struct{}{}
+			bucket.AddRecord(conjuredFmeta, nil)
+			if err := place(filter(conjuredFmeta)); err != nil {
+				return api.WareID{}, err
+			}
+		}
+
+		// Hash the body, if any; then plan.
+		switch fmeta.Type {
+		case fs.Type_File:
+			hr := &util.HashingReader{tr, hasher.New()}
+			if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+				if ctx.Err() != nil {
+					return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+				}
+				return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+			}
+			bucket.AddRecord(fmeta, hr.Hasher.Sum(nil))
+			hardlinks.remember(fmeta, fmeta, hr.Hasher.Sum(nil))
+		case fs.Type_Hardlink:
+			target, err := hardlinks.resolve(fmeta, thdr)
+			if err != nil {
+				return api.WareID{}, err
+			}
+			bucket.AddRecord(target.prefilter, target.contentHash)
+		case fs.Type_Dir:
+			dirs[fmeta.Name] = struct{}{}
+			fallthrough
+		default:
+			bucket.AddRecord(fmeta, nil)
+		}
+		if err := place(filter(fmeta)); err != nil {
+			return api.WareID{}, err
+		}
+	}
+
+	return hasher.WareID(bucket), nil
+}
@@ -0,0 +1,104 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarPlan(t *testing.T) {
+	Convey("Tar transmat: planning an unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				packFixture := func(name string, place func(fs.FS)) (api.WareID, []api.WarehouseAddr) {
+					srcFs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					place(srcFs)
+					addr := api.WarehouseAddr(fmt.Sprintf("file://%s/%s.tgz", tmpDir, name))
+					wareID, err := Pack(context.Background(), PackType, srcFs.BasePath().String(), api.Filter_NoMutation, addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID, []api.WarehouseAddr{addr}
+				}
+				plan := func(wareID api.WareID, path fs.AbsolutePath, filt api.FilesetFilters, warehouses []api.WarehouseAddr) ([]PlanEntry, error) {
+					var entries []PlanEntry
+					err := PlanUnpack(context.Background(), wareID, path.String(), filt, warehouses, func(entry PlanEntry) error {
+						entries = append(entries, entry)
+						return nil
+					}, rio.Monitor{})
+					return entries, err
+				}
+
+				Convey("the plan should write nothing, and the unpack should then do just what it said", func() {
+					wareID, warehouses := packFixture("gamma", func(afs fs.FS) {
+						tests.PlaceFixture(afs, tests.FixtureGamma)
+						tests.PlaceFixture(afs, tests.FixtureSymlinks[2:])
+					})
+					filt := api.FilesetFilters{Uid: "4321", Gid: "4322", Mtime: "keep", Sticky: "keep"}
+					dest := tmpDir.Join(fs.MustRelPath("dest"))
+					entries, err := plan(wareID, dest, filt, warehouses)
+					So(err, ShouldBeNil)
+					_, err = os.Lstat(dest.String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+					_, err = os.Lstat(tmpDir.Join(fs.MustRelPath("cache")).String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+
+					var lines []string
+					for _, entry := range entries {
+						lines = append(lines, entry.String())
+					}
+					So(lines, ShouldHaveLength, 2*(len(tests.FixtureGamma)+1))
+					So(lines[0], ShouldEqual, "create dir . 0755")
+					So(lines[1], ShouldEqual, "chown . 4321:4322")
+					So(lines, ShouldContain, "create file ./etc/init.d/service-p 0644")
+					So(lines, ShouldContain, "create symlink ./ln -> ./a")
+
+					_, err = Unpack(context.Background(), wareID, dest.String(), filt, rio.Placement_Direct, warehouses, rio.Monitor{})
+					So(err, ShouldBeNil)
+					afs := osfs.New(dest)
+					for _, entry := range entries {
+						got := testutil.ShouldStat(afs, entry.Metadata.Name)
+						So(got.Type, ShouldEqual, entry.Metadata.Type)
+						switch entry.Action {
+						case Plan_Create:
+							if got.Type != fs.Type_Symlink {
+								So(got.Perms, ShouldEqual, entry.Metadata.Perms)
+							}
+							So(got.Linkname, ShouldEqual, entry.Metadata.Linkname)
+							So(got.Mtime.Equal(entry.Metadata.Mtime), ShouldBeTrue)
+						case Plan_Chown:
+							So([2]uint32{got.Uid, got.Gid}, ShouldResemble, [2]uint32{4321, 4322})
+						default:
+							So(entry.Action, ShouldBeIn, Plan_Create, Plan_Chown)
+						}
+					}
+				})
+				Convey("planning the wrong ware should be a hash mismatch", func() {
+					_, warehouses := packFixture("alpha", func(afs fs.FS) {
+						tests.PlaceFixture(afs, tests.FixtureAlpha)
+					})
+					wrongWareID, _ := packFixture("multi", func(afs fs.FS) {
+						tests.PlaceFixture(afs, tests.FixtureMultifile)
+					})
+					_, err := plan(wrongWareID, tmpDir.Join(fs.MustRelPath("dest")), api.Filter_NoMutation, []api.WarehouseAddr{warehouses[0]})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+			})
+		}),
+	)
+}
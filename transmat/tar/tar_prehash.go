@@ -0,0 +1,98 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"io"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+type prehashed struct {
+	contentHash []byte
+	size        int64
+	data        []sparseEntry // if the file has holes; see hashSparse.
+	err         error
+}
+
+/*
+	Hashes the contents of files ahead of the tar writer, `workers` at a time.
+
+	Each path gets a channel which yields its result once; the tar writer
+	takes them in its own order, so the bucket -- and the WareID -- come out
+	exactly as from a serial pack.  Workers take the paths in the order
+	given, so give them in the order the writer will want them.
+
+	Stops early (leaving later channels empty) if the context is cancelled;
+	the caller should cancel it when it's done, in case it stops early itself.
+*/
+func prehashFiles(ctx context.Context, afs fs.FS, hasher wareHasher, workers int, paths []fs.RelPath) map[fs.RelPath]<-chan prehashed {
+	results := make(map[fs.RelPath]<-chan prehashed, len(paths))
+	chans := make([]chan prehashed, len(paths))
+	for i, path := range paths {
+		chans[i] = make(chan prehashed, 1)
+		results[path] = chans[i]
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range paths {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				chans[i] <- prehashFile(ctx, afs, hasher, paths[i])
+			}
+		}()
+	}
+	return results
+}
+
+func prehashFile(ctx context.Context, afs fs.FS, hasher wareHasher, path fs.RelPath) prehashed {
+	if ctx.Err() != nil {
+		return prehashed{err: Errorf(rio.ErrCancelled, "cancelled")}
+	}
+	file, err := afs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return prehashed{err: err}
+	}
+	defer file.Close()
+	return hashFile(ctx, afs, hasher, path, file)
+}
+
+/*
+	Hashes an opened file.  If it has holes on disk, they're found too,
+	for writeSparse; that means a pass over the file before it's written,
+	so we only look in files that do have them.
+
+	Files with holes are read at offsets, so their read position stays put,
+	and they can still be streamed from the start afterwards.
+*/
+func hashFile(ctx context.Context, afs fs.FS, hasher wareHasher, path fs.RelPath, file io.Reader) prehashed {
+	contentHasher := hasher.New()
+	if sparseCandidate(afs, path, file) {
+		n, data, err := hashSparse(ctx, path, file.(io.ReaderAt), contentHasher)
+		if err != nil {
+			return prehashed{err: err}
+		}
+		return prehashed{contentHasher.Sum(nil), n, data, nil}
+	}
+	n, err := io.Copy(contentHasher, cancellableReader{ctx, file})
+	if err != nil {
+		return prehashed{err: err}
+	}
+	return prehashed{contentHasher.Sum(nil), n, nil, nil}
+}
@@ -0,0 +1,144 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func withPackParallelism(n int, fn func()) {
+	defer os.Setenv("RIO_PACK_PARALLELISM", os.Getenv("RIO_PACK_PARALLELISM"))
+	os.Setenv("RIO_PACK_PARALLELISM", strconv.Itoa(n))
+	fn()
+}
+
+func TestTarPackParallel(t *testing.T) {
+	Convey("Spec compliance: Tar pack, hashing in parallel", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			withPackParallelism(4, func() {
+				tests.CheckPackProducesConsistentHash(PackType, Pack)
+				tests.CheckPackHashVariesOnVariations(PackType, Pack)
+				tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
+				tests.CheckPackErrorsGracefully(PackType, Pack)
+			})
+		}),
+	)
+	Convey("Tar transmat: parallel pack should give the serial WareID", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureGamma)
+				So(afs.Mkhardlink(fs.MustRelPath("linked"), fs.MustRelPath("etc/tricky")), ShouldBeNil)
+				So(afs.SetTimesNano(fs.RelPath{}, time.Unix(1000, 0), fs.DefaultAtime), ShouldBeNil)
+				packOrdered := func(parallelism int, order PackOrder) (wareID api.WareID) {
+					withPackParallelism(parallelism, func() {
+						var err error
+						wareID, err = PackWithOrder(order)(
+							context.Background(),
+							PackType,
+							afs.BasePath().String(),
+							api.Filter_NoMutation,
+							api.WarehouseAddr(fmt.Sprintf("file://%s/%d-%s.tgz", tmpDir, parallelism, order)),
+							rio.Monitor{},
+						)
+						So(err, ShouldBeNil)
+					})
+					return
+				}
+
+				wareIDSerial := packOrdered(1, PackOrder_Walk)
+				for _, order := range []PackOrder{PackOrder_Walk, PackOrder_GnuTar, PackOrder_Lexical} {
+					So(packOrdered(4, order), ShouldResemble, wareIDSerial)
+				}
+				Convey("and the same entries, in the same order", func() {
+					So(tarEntryNames(fmt.Sprintf("%s/4-%s.tgz", tmpDir, PackOrder_Walk)), ShouldResemble,
+						tarEntryNames(fmt.Sprintf("%s/1-%s.tgz", tmpDir, PackOrder_Walk)))
+				})
+			})
+		}),
+	)
+}
+
+func TestTarPackParallelChanged(t *testing.T) {
+	Convey("Tar transmat: a file changed after it's hashed, before it's written, should fail the pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				victim := afs.BasePath().Join(fs.MustRelPath("victim")).String()
+				So(ioutil.WriteFile(victim, []byte("before"), 0644), ShouldBeNil)
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposePack)
+				So(err, ShouldBeNil)
+				hooks := packHooks{body: func(fs.Metadata) error {
+					// Same size, so only the content gives it away.
+					return ioutil.WriteFile(victim, []byte("after!"), 0644)
+				}}
+				withPackParallelism(4, func() {
+					_, err = packTar(context.Background(), defaultHasher, afs, filt, PackOrder_Walk, false, tar.NewWriter(ioutil.Discard), ioutil.Discard, hooks, rio.Monitor{})
+				})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrInoperablePath)
+			})
+		}),
+	)
+}
+
+/*
+	Many files, big enough that hashing them is most of the work.
+	Packs uncompressed, since gzip is a single stream and stays serial.
+*/
+func BenchmarkTarPackParallel(b *testing.B) {
+	testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+		if err := afs.Mkdir(fs.RelPath{}, 0755); err != nil {
+			b.Fatal(err)
+		}
+		body := make([]byte, 256<<10)
+		for i := 0; i < 256; i++ {
+			body[0] = byte(i)
+			if err := ioutil.WriteFile(fmt.Sprintf("%s/file-%03d", afs.BasePath(), i), body, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for _, parallelism := range []int{1, 4} {
+			b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+				withPackParallelism(parallelism, func() {
+					b.SetBytes(256 * int64(len(body)))
+					for i := 0; i < b.N; i++ {
+						_, err := PackWith(PackOptions{Compression: Uncompressed})(
+							context.Background(),
+							PackType,
+							afs.BasePath().String(),
+							api.Filter_NoMutation,
+							"",
+							rio.Monitor{},
+						)
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	})
+}
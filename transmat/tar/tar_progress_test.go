@@ -0,0 +1,91 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+)
+
+func TestTarProgress(t *testing.T) {
+	Convey("Tar transmat: progress events", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer func(d time.Duration) { progress.Interval = d }(progress.Interval)
+				progress.Interval = 0 // report every file.
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+				So(err, ShouldBeNil)
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				for _, name := range []string{"a", "b"} {
+					So(tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 300, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+					tw.Write(make([]byte, 300))
+				}
+				So(tw.Close(), ShouldBeNil)
+				progressOf := func(evts []rio.Event) (progs []rio.Event_Progress) {
+					for _, evt := range evts {
+						if evt.Progress != nil {
+							progs = append(progs, *evt.Progress)
+						}
+					}
+					return
+				}
+
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpack")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				Convey("unpacking should report each file, then completion", func() {
+					evtChan := make(chan rio.Event, 10)
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{Chan: evtChan})
+					So(err, ShouldBeNil)
+					close(evtChan)
+					var evts []rio.Event
+					for evt := range evtChan {
+						evts = append(evts, evt)
+					}
+					So(progressOf(evts), ShouldResemble, []rio.Event_Progress{
+						{Phase: "unpack", Desc: "./a", TotalProg: 300},
+						{Phase: "unpack", Desc: "./b", TotalProg: 600},
+						{Phase: "unpack", Desc: "done", TotalProg: 600, TotalWork: 600},
+					})
+
+					Convey("and packing should too", func() {
+						evtChan := make(chan rio.Event, 10)
+						var out bytes.Buffer
+						_, err := packTar(context.Background(), defaultHasher, afs, filt, PackOrder_Walk, false, tar.NewWriter(&out), &out, packHooks{}, rio.Monitor{Chan: evtChan})
+						So(err, ShouldBeNil)
+						close(evtChan)
+						var evts []rio.Event
+						for evt := range evtChan {
+							evts = append(evts, evt)
+						}
+						So(progressOf(evts), ShouldResemble, []rio.Event_Progress{
+							{Phase: "pack", Desc: "./a", TotalProg: 300},
+							{Phase: "pack", Desc: "./b", TotalProg: 600},
+							{Phase: "pack", Desc: "done", TotalProg: 600, TotalWork: 600},
+						})
+					})
+				})
+				Convey("a zero monitor should be fine", func() {
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+					So(err, ShouldBeNil)
+				})
+			})
+		}),
+	)
+}
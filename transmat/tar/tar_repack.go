@@ -0,0 +1,161 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/transmat/mixins/log"
+)
+
+/*
+	Store a tar ware in the target warehouse, compressed anew: fetched from
+	the sources, and decompressed, and compressed again as asked.  The tar
+	inside is copied byte for byte, so the WareID doesn't change; and it's
+	hashed on the way through, so nothing is committed unless it matches.
+
+	The target may be the warehouse the ware is fetched from: the ware is
+	replaced, once the new one is all written.  Seekable and eStargz tars
+	are written entry by entry, so a tar can't be repacked into one of those;
+	and a seekable tar repacked is a plain one (its index, if it's left
+	beside it, no longer says where anything is).
+*/
+func Repack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to repack.
+	compression Compression, // How to compress it now.
+	level int, // Compression level; 0 for the codec's default.  See Compress.
+	target api.WarehouseAddr, // Warehouse to store the repacked ware in.
+	sources []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if _, err := Compress(ioutil.Discard, compression, level); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+
+	// Pick a source warehouse and get a reader; then the writer.
+	reader, err := PickReader(ctx, wareID, sources, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+	wc, err := OpenWriteController(target, PackType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Copy, checking as we go; and commit only if it all checked out.
+	if err := RepackStream(ctx, wareID, reader, wc, compression, level, mon); err != nil {
+		return api.WareID{}, err
+	}
+	if err := wc.Commit(wareID); err != nil {
+		return api.WareID{}, err
+	}
+	log.WareRepacked(mon, wareID, wareID, (&compression).Extension())
+	return wareID, nil
+}
+
+/*
+	Read a tar stream (compressed however Decompress can make out), and
+	write the same tar to `writer`, compressed as asked, checking that it
+	hashes to `wareID` on the way through.  A mismatch is only found once
+	the whole tar has been read, and so written; so whatever's been written
+	is garbage if there's any error, and it's on the caller to discard it.
+	Neither the reader nor the writer is closed.
+
+	For transmats that store tars in some other shape (as the chunk
+	transmat does): this is how they convert to and from plain tar.
+*/
+func RepackStream(
+	ctx context.Context,
+	wareID api.WareID, // The tar WareID the stream should hash to.
+	reader io.Reader,
+	writer io.Writer,
+	compression Compression,
+	level int,
+	mon rio.Monitor,
+) error {
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return err
+	}
+	compWriter, err := Compress(writer, compression, level)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "%s", err)
+	}
+	raw, err := Decompress(reader)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
+	}
+
+	// Everything read of the tar is written on; including whatever follows
+	//  the end of the archive, which the tar reader leaves unread, so that
+	//  the copy is exact.
+	//  (A failed write looks like a failed read to the tar reader; so they're
+	//  kept, to say which it really was.)
+	out := &stickyWriter{w: compWriter}
+	tee := io.TeeReader(raw, out)
+	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+	gotWareID, _, err := unpackTar(ctx, hasher, nilFS.New(), filt, tee, mon)
+	if err == nil {
+		if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+			err = Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+		}
+	}
+	if out.err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", out.err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := compWriter.Close(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if gotWareID != wareID {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, gotWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   gotWareID.String(),
+			},
+		)
+	}
+	return nil
+}
+
+// Keeps the first error writing, and refuses to write after it.
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *stickyWriter) Write(bs []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(bs)
+	sw.err = err
+	return n, err
+}
@@ -0,0 +1,85 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarRepack(t *testing.T) {
+	Convey("Tar transmat: repacking a ware with another compression", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				srcAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.tgz", tmpDir))
+				dstAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.tar.zst", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, srcAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("should keep the WareID, and unpack the same", func() {
+					gotWareID, err := Repack(context.Background(), wareID, Zstd, 3, dstAddr, []api.WarehouseAddr{srcAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					bs, err := ioutil.ReadFile(tmpDir.String() + "/ware.tar.zst")
+					So(err, ShouldBeNil)
+					So(DetectCompression(bs), ShouldEqual, Zstd)
+
+					gotWareID, err = Unpack(context.Background(), wareID, tmpDir.String()+"/out", api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{dstAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/etc/init.d/service-q")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "q!")
+				})
+				Convey("the tar inside should be copied exactly", func() {
+					var zst, plain bytes.Buffer
+					src, err := os.Open(tmpDir.String() + "/ware.tgz")
+					So(err, ShouldBeNil)
+					defer src.Close()
+					So(RepackStream(context.Background(), wareID, src, &zst, Zstd, 0, rio.Monitor{}), ShouldBeNil)
+					So(RepackStream(context.Background(), wareID, &zst, &plain, Uncompressed, 0, rio.Monitor{}), ShouldBeNil)
+					raw, err := Decompress(bytes.NewReader(plain.Bytes()))
+					So(err, ShouldBeNil)
+					rawBytes, err := ioutil.ReadAll(raw)
+					So(err, ShouldBeNil)
+					src2, err := os.Open(tmpDir.String() + "/ware.tgz")
+					So(err, ShouldBeNil)
+					defer src2.Close()
+					orig, err := Decompress(src2)
+					So(err, ShouldBeNil)
+					origBytes, err := ioutil.ReadAll(orig)
+					So(err, ShouldBeNil)
+					So(bytes.Equal(rawBytes, origBytes), ShouldBeTrue)
+				})
+				Convey("a WareID that doesn't match should be a hash mismatch, and store nothing", func() {
+					otherWareID := api.WareID{PackType, "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+					_, err := Repack(context.Background(), otherWareID, Zstd, 0, dstAddr, []api.WarehouseAddr{srcAddr}, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					_, err = os.Stat(tmpDir.String() + "/ware.tar.zst")
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("a level the codec doesn't have should be a usage error", func() {
+					_, err := Repack(context.Background(), wareID, Gzip, 42, dstAddr, []api.WarehouseAddr{srcAddr}, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
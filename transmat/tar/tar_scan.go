@@ -15,6 +15,7 @@ import (
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/nilfs"
 	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/filters"
 )
 
 // A "scan" is roughly the same as an unpack to /dev/null,
@@ -53,7 +54,7 @@ func Scan(
 		placementMode = rio.Placement_None
 	}
 	filt = apiutil.MergeFilters(filt, api.Filter_NoMutation)
-	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
@@ -63,7 +64,7 @@ func Scan(
 	// Dial warehouse.
 	//  Note how this is a subset of the usual accepted warehouses;
 	//  it must be a monowarehouse, not a legit CA storage bucket.
-	reader, err := PickReader(api.WareID{"tar", "-"}, []api.WarehouseAddr{addr}, true, mon)
+	reader, err := PickReader(ctx, api.WareID{"tar", "-"}, []api.WarehouseAddr{addr}, true, mon)
 	if err != nil {
 		return api.WareID{}, err
 	}
@@ -86,6 +87,6 @@ func Scan(
 	// Extract.
 	//  For once we can actually discard the *prefilter* wareID, since we don't have
 	//  an expected one to assert against.
-	_, unpackedWareID, err := unpackTar(ctx, afs, filt2, reader, mon)
+	_, unpackedWareID, err := unpackTar(ctx, defaultHasher, afs, filt2, reader, mon)
 	return unpackedWareID, err
 }
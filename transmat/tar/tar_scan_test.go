@@ -43,6 +43,42 @@ func TestTarFixtureScan(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(gotWareID, ShouldResemble, api.WareID{"tar", "2RLHdc3am6tMCFy56vfcHm5kWLoAtYBfiaQcq17vDm1tEzQn9CC6tcF2yzpAJvehPC"})
 			})
+			Convey("Scan the same fixture, recompressed by the zstd tool", func() {
+				gotWareID, err := Scan(
+					context.Background(),
+					PackType,
+					api.FilesetFilters{},
+					rio.Placement_Direct,
+					"file://./fixtures/tar_withBase.tar.zst",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(gotWareID, ShouldResemble, api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"})
+			})
+			Convey("Scan the same fixture, recompressed by liblz4", func() {
+				gotWareID, err := Scan(
+					context.Background(),
+					PackType,
+					api.FilesetFilters{},
+					rio.Placement_Direct,
+					"file://./fixtures/tar_withBase.tar.lz4",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(gotWareID, ShouldResemble, api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"})
+			})
+			Convey("Scan the same fixture, recompressed by liblzma as xz", func() {
+				gotWareID, err := Scan(
+					context.Background(),
+					PackType,
+					api.FilesetFilters{},
+					rio.Placement_Direct,
+					"file://./fixtures/tar_withBase.tar.xz",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(gotWareID, ShouldResemble, api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"})
+			})
 			Convey("Scan a kitchen sink fixture tar", func() {
 				gotWareID, err := Scan(
 					context.Background(),
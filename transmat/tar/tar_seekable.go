@@ -0,0 +1,493 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Seekable tars are gzipped one entry at a time: each entry is a gzip
+	member of its own, so any one of them can be decompressed without
+	the rest.  (One after another, they're still one gzip stream, and the
+	tar is the same tar; nothing else needs to know.)
+
+	Alongside the ware, an index says where each entry's member is, and
+	what the entry is: its metadata and content hash, just as they go in
+	the fileset hash.  That makes the index its own proof: hashing its
+	records must give the WareID, so an index that does can be trusted,
+	and each member fetched can be checked against its record.
+
+	The index is stored under the WareID's hash plus seekIndexSuffix, which
+	only means something in content-addressable warehouses; so seekable
+	tars can only be packed into those (or nowhere, to just scan).
+*/
+const seekIndexSuffix = ".idx"
+
+// Longest index we'll read: some millions of entries.
+const maxSeekIndexSize = 1 << 30
+
+type seekIndex struct {
+	Entries []seekEntry `json:"entries"`
+}
+
+/*
+	One entry of a seekable tar, as the fileset hash sees it, and where
+	its body is.  For a hardlink, that's the member of the file it's
+	linked to; for anything but a file, there's no body, and no member.
+*/
+type seekEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Perms       fs.Perms          `json:"perms"`
+	Uid         uint32            `json:"uid"`
+	Gid         uint32            `json:"gid"`
+	Size        int64             `json:"size,omitempty"`
+	Linkname    string            `json:"linkname,omitempty"`
+	Devmajor    int64             `json:"devmajor,omitempty"`
+	Devminor    int64             `json:"devminor,omitempty"`
+	Mtime       time.Time         `json:"mtime"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	ContentHash []byte            `json:"contentHash,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	Length      int64             `json:"length,omitempty"`
+}
+
+func seekEntryFor(fmeta fs.Metadata, contentHash []byte) seekEntry {
+	return seekEntry{
+		Name:        fmeta.Name.String(),
+		Type:        string(fmeta.Type),
+		Perms:       fmeta.Perms,
+		Uid:         fmeta.Uid,
+		Gid:         fmeta.Gid,
+		Size:        fmeta.Size,
+		Linkname:    fmeta.Linkname,
+		Devmajor:    fmeta.Devmajor,
+		Devminor:    fmeta.Devminor,
+		Mtime:       fmeta.Mtime,
+		Xattrs:      fmeta.Xattrs,
+		ContentHash: contentHash,
+	}
+}
+
+func (e seekEntry) metadata() (fs.Metadata, error) {
+	name, err := fs.CleanRelPath(e.Name)
+	if err != nil {
+		return fs.Metadata{}, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %s", err)
+	}
+	if len(e.Type) != 1 {
+		return fs.Metadata{}, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %q has no type we know (%q)", e.Name, e.Type)
+	}
+	return fs.Metadata{
+		Name:     name,
+		Type:     fs.Type(e.Type[0]),
+		Perms:    e.Perms,
+		Uid:      e.Uid,
+		Gid:      e.Gid,
+		Size:     e.Size,
+		Linkname: e.Linkname,
+		Devmajor: e.Devmajor,
+		Devminor: e.Devminor,
+		Mtime:    e.Mtime,
+		Xattrs:   e.Xattrs,
+	}, nil
+}
+
+/*
+	Where a ware's index is kept.
+*/
+func seekIndexID(wareID api.WareID) api.WareID {
+	return api.WareID{wareID.Type, wareID.Hash + seekIndexSuffix}
+}
+
+/*
+	Returns ErrUsage if a seekable tar's index has nowhere to go in the
+	warehouse: anything but a content-addressable one (or none at all)
+	keeps a single ware, and the index would take its place.
+*/
+func checkSeekableWarehouse(warehouseAddr api.WarehouseAddr) error {
+	if warehouseAddr == "" {
+		return nil
+	}
+	u, err := url.Parse(string(warehouseAddr))
+	if err != nil {
+		return Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if !strings.HasPrefix(u.Scheme, "ca+") {
+		return Errorf(rio.ErrUsage, "seekable tars need a content-addressable warehouse (one with a 'ca+' scheme) to keep their index in, not %q", warehouseAddr)
+	}
+	return nil
+}
+
+/*
+	Writes gzip, starting a new member whenever `cut` is called, and
+	counting the bytes out so it can say where each member starts.
+*/
+type memberWriter struct {
+	out *countingWriter
+	gz  *gzip.Writer
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(bs []byte) (int, error) {
+	n, err := cw.w.Write(bs)
+	cw.n += int64(n)
+	return n, err
+}
+
+func newMemberWriter(w io.Writer, level int) (*memberWriter, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	out := &countingWriter{w: w}
+	gz, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return nil, err
+	}
+	return &memberWriter{out, gz}, nil
+}
+
+func (mw *memberWriter) Write(bs []byte) (int, error) {
+	return mw.gz.Write(bs)
+}
+
+// Finish the member being written, and start the next; returns the offset it starts at.
+func (mw *memberWriter) cut() (int64, error) {
+	if err := mw.gz.Close(); err != nil {
+		return 0, err
+	}
+	mw.gz.Reset(mw.out)
+	return mw.out.n, nil
+}
+
+func (mw *memberWriter) Close() error {
+	return mw.gz.Close()
+}
+
+/*
+	Returns a hook for packTar that ends each entry's member once the entry
+	is written, and records it in the index.
+*/
+func (idx *seekIndex) recorder(tw *tar.Writer, mw *memberWriter) packHook {
+	var start int64
+	members := map[fs.RelPath][2]int64{}
+	return func(fmeta fs.Metadata, contentHash []byte, bodyIn fs.RelPath) error {
+		if err := tw.Flush(); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+		end, err := mw.cut()
+		if err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+		members[fmeta.Name] = [2]int64{start, end}
+		start = end
+		entry := seekEntryFor(fmeta, contentHash)
+		if fmeta.Type == fs.Type_File {
+			member := members[bodyIn]
+			entry.Offset, entry.Length = member[0], member[1]-member[0]
+		}
+		idx.Entries = append(idx.Entries, entry)
+		return nil
+	}
+}
+
+func storeSeekIndex(wc warehouse.BlobstoreWriteController, wareID api.WareID, idx *seekIndex) error {
+	gz := gzip.NewWriter(wc)
+	if err := json.NewEncoder(gz).Encode(idx); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing seekable tar index: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing seekable tar index: %s", err)
+	}
+	return wc.Commit(seekIndexID(wareID))
+}
+
+/*
+	Fetch a ware's index, and check it against the WareID.
+	Returns the entries' metadata, in the order they were packed.
+*/
+func fetchSeekIndex(
+	ctx context.Context,
+	wareID api.WareID,
+	hasher wareHasher,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ []seekEntry, _ []fs.Metadata, err error) {
+	reader, err := PickReader(ctx, seekIndexID(wareID), warehouses, false, mon)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %s", err)
+	}
+	var idx seekIndex
+	if err := json.NewDecoder(io.LimitReader(gz, maxSeekIndexSize)).Decode(&idx); err != nil {
+		return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %s", err)
+	}
+
+	// Check it's a sane fileset before hashing it: the bucket panics otherwise.
+	bucket := &fshash.MemoryBucket{}
+	fmetas := make([]fs.Metadata, len(idx.Entries))
+	seen := map[fs.RelPath]fs.Type{}
+	for i, entry := range idx.Entries {
+		fmeta, err := entry.metadata()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := seen[fmeta.Name]; ok {
+			return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %q appears twice", entry.Name)
+		}
+		if i == 0 && (fmeta.Name != (fs.RelPath{}) || fmeta.Type != fs.Type_Dir) {
+			return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: the first entry must be the root dir")
+		}
+		if i > 0 && seen[fmeta.Name.Dir()] != fs.Type_Dir {
+			return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %q comes before its parent dir", entry.Name)
+		}
+		if fmeta.Type == fs.Type_File && (entry.Offset < 0 || entry.Length <= 0) {
+			return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: %q has nowhere for its body", entry.Name)
+		}
+		seen[fmeta.Name] = fmeta.Type
+		fmetas[i] = fmeta
+		bucket.AddRecord(fmeta, entry.ContentHash)
+	}
+	if len(fmetas) == 0 {
+		return nil, nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar index: no entries")
+	}
+	if actual := hasher.WareID(bucket); actual != wareID {
+		return nil, nil, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: the seekable tar index for %q is of %q", wareID, actual),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   actual.String(),
+			},
+		)
+	}
+	return idx.Entries, fmetas, nil
+}
+
+/*
+	Unpack only some paths from a seekable tar: each of `paths` and
+	everything under it, along with the dirs above them.  Only the members
+	of the files wanted are fetched; from warehouses that can serve ranges
+	of a ware (see warehouse.BlobstoreRangeController), nothing else is
+	downloaded at all.
+
+	The ware's index is checked against the WareID, and each file fetched
+	against the index, so what's placed is exactly what a full unpack would
+	have placed at those paths (save that hardlinks come out as copies,
+	since what they're linked to may not be wanted).  The WareID returned
+	is the one asked for.  A path that's not in the ware is ErrUsage; a ware
+	that wasn't packed seekable has no index, and is ErrWareNotFound.
+
+	Placement is always direct, and the cache is not involved.
+	Filters apply as usual.
+*/
+func UnpackPaths(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	paths []string, // Which paths in the ware to unpack.
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	afs := osfs.New(fs.MustAbsolutePath(path))
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	var wanted []fs.RelPath
+	for _, p := range paths {
+		rp, err := fs.CleanRelPath(strings.TrimPrefix(p, "/"))
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "invalid path %q: %s", p, err)
+		}
+		wanted = append(wanted, rp)
+	}
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Fetch the index, and pick out what's wanted: what's under any of
+	//  the paths asked for, and the dirs above it.
+	entries, fmetas, err := fetchSeekIndex(ctx, wareID, hasher, warehouses, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	under := func(name, p fs.RelPath) bool {
+		return name == p || p == (fs.RelPath{}) || strings.HasPrefix(name.String(), p.String()+"/")
+	}
+	selected := map[fs.RelPath]struct{}{}
+	found := make([]bool, len(wanted))
+	for _, fmeta := range fmetas {
+		for i, p := range wanted {
+			if under(fmeta.Name, p) {
+				found[i] = true
+				selected[fmeta.Name] = struct{}{}
+				for _, parent := range fmeta.Name.SplitParent() {
+					selected[parent] = struct{}{}
+				}
+			}
+		}
+	}
+	for i, ok := range found {
+		if !ok {
+			return api.WareID{}, Errorf(rio.ErrUsage, "%q is not in ware %s", paths[i], wareID)
+		}
+	}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Report bytes written as we go.
+	prog := progress.New(mon, "unpack", 0)
+
+	// Place what's wanted, in the order it was packed (so parents come first),
+	//  fetching and checking each file's body as we get to it.
+	placed := &fshash.MemoryBucket{}
+	for i, fmeta := range fmetas {
+		if _, ok := selected[fmeta.Name]; !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt2, &filteredFmeta)
+		var body io.Reader
+		if fmeta.Type == fs.Type_File {
+			bs, err := fetchMember(ctx, wareID, hasher, entries[i], warehouses, mon)
+			if err != nil {
+				return api.WareID{}, err
+			}
+			body = bytes.NewReader(bs)
+		}
+		if err := fsOp.PlaceFileWithPolicy(afs, filteredFmeta, body, filt2.SkipChown, policy.Chown); err != nil {
+			return api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		placed.AddRecord(filteredFmeta, entries[i].ContentHash)
+		prog.Add(fmeta.Size, fmeta.Name)
+	}
+
+	// Cleanup dir times with a post-order traversal, as a full unpack does.
+	if err := treewalk.Walk(placed.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+	prog.Done()
+	return wareID, nil
+}
+
+/*
+	Fetch the member holding an entry's body, and return the body,
+	checked against the index.
+*/
+func fetchMember(
+	ctx context.Context,
+	wareID api.WareID,
+	hasher wareHasher,
+	entry seekEntry,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) ([]byte, error) {
+	reader, err := pickReader(ctx, wareID, warehouses, false, func(whCtrl warehouse.BlobstoreController, _ api.WarehouseAddr) (io.ReadCloser, error) {
+		return openRange(ctx, whCtrl, wareID, entry.Offset)
+	}, mon)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	gz, err := gzip.NewReader(io.LimitReader(reader, entry.Length))
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar: member for %q: %s", entry.Name, err)
+	}
+	gz.Multistream(false)
+	tr := tar.NewReader(gz)
+	if _, err := tr.Next(); err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar: member for %q: %s", entry.Name, err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(tr, entry.Size+1))
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar: member for %q: %s", entry.Name, err)
+	}
+	contentHasher := hasher.New()
+	contentHasher.Write(body)
+	if int64(len(body)) != entry.Size || !bytes.Equal(contentHasher.Sum(nil), entry.ContentHash) {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar: %q doesn't match its hash in the index", entry.Name)
+	}
+	return body, nil
+}
+
+/*
+	Open a reader on a ware starting at `offset`: with a range request if
+	the warehouse can do them, and otherwise by reading up to it.
+*/
+func openRange(ctx context.Context, whCtrl warehouse.BlobstoreController, wareID api.WareID, offset int64) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var start int64
+	var err error
+	if rangeCtrl, ok := whCtrl.(warehouse.BlobstoreRangeController); ok {
+		reader, start, err = rangeCtrl.OpenReaderFrom(ctx, wareID, offset)
+	} else {
+		reader, err = whCtrl.OpenReader(ctx, wareID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset-start); err != nil {
+		reader.Close()
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt seekable tar: shorter than its index says")
+	}
+	return reader, nil
+}
@@ -0,0 +1,134 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarSeekable(t *testing.T) {
+	packSeekable := PackWith(PackOptions{Compression: Gzip, Seekable: true})
+	Convey("Spec compliance: Tar pack, seekable", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, packSeekable)
+			tests.CheckPackHashVariesOnVariations(PackType, packSeekable)
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+				tests.CheckRoundTrip(PackType, packSeekable, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+			})
+		}),
+	)
+	Convey("Tar transmat: unpacking some paths of a seekable tar", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir))
+				So(os.Mkdir(tmpDir.String()+"/bounce", 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				wareID, err := packSeekable(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, addr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpackPaths := func(wareID api.WareID, paths ...string) (api.WareID, error) {
+					return UnpackPaths(context.Background(), wareID, tmpDir.String()+"/out", paths, api.Filter_NoMutation, []api.WarehouseAddr{addr}, rio.Monitor{})
+				}
+				placed := func() (names []string) {
+					filepath.Walk(tmpDir.String()+"/out", func(path string, _ os.FileInfo, _ error) error {
+						rel, _ := filepath.Rel(tmpDir.String()+"/out", path)
+						names = append(names, rel)
+						return nil
+					})
+					return
+				}
+				findFile := func(name string) (found string) {
+					filepath.Walk(tmpDir.String()+"/bounce", func(path string, fi os.FileInfo, _ error) error {
+						if fi != nil && fi.Name() == name {
+							found = path
+						}
+						return nil
+					})
+					So(found, ShouldNotEqual, "")
+					return
+				}
+
+				Convey("the WareID should be the same as a plain pack's", func() {
+					plainWareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID, ShouldResemble, plainWareID)
+				})
+				Convey("unpacking a path should place it, what's under it, and the dirs above, and nothing else", func() {
+					gotWareID, err := unpackPaths(wareID, "etc/init.d")
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/init.d", "etc/init.d/service-p", "etc/init.d/service-q"})
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/etc/init.d/service-q")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "q!")
+				})
+				Convey("unpacking several paths should place each of them", func() {
+					_, err := unpackPaths(wareID, "/var/fun", "etc/trick")
+					So(err, ShouldBeNil)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/trick", "var", "var/fun"})
+				})
+				Convey("a path that's not in the ware should be a usage error", func() {
+					_, err := unpackPaths(wareID, "etc/nope")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+				Convey("an index that doesn't match the WareID should be a hash mismatch", func() {
+					other := tmpDir.String() + "/other"
+					tests.PlaceFixture(osfs.New(fs.MustAbsolutePath(other)), tests.FixtureAlpha)
+					otherWareID, err := packSeekable(context.Background(), PackType, other, api.Filter_NoMutation, addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					bs, err := ioutil.ReadFile(findFile(otherWareID.Hash + seekIndexSuffix))
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(findFile(wareID.Hash+seekIndexSuffix), bs, 0644), ShouldBeNil)
+					_, err = unpackPaths(wareID, "etc")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+				Convey("a ware that's shorter than the index says should be corruption", func() {
+					warePath := findFile(wareID.Hash)
+					bs, err := ioutil.ReadFile(warePath)
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(warePath, bs[:len(bs)/2], 0644), ShouldBeNil)
+					_, err = unpackPaths(wareID, ".")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a ware that wasn't packed seekable should have no index to find", func() {
+					plain := tmpDir.String() + "/plain"
+					tests.PlaceFixture(osfs.New(fs.MustAbsolutePath(plain)), tests.FixtureAlpha)
+					plainWareID, err := Pack(context.Background(), PackType, plain, api.Filter_NoMutation, addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					_, err = unpackPaths(plainWareID, "a")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+				})
+			})
+		}),
+	)
+	Convey("Tar transmat: seekable packs need gzip, and somewhere to keep the index", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureAlpha)
+				_, err := packSeekable(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, api.WarehouseAddr(fmt.Sprintf("file://%s/ware", tmpDir)), rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				_, err = PackWith(PackOptions{Compression: Uncompressed, Seekable: true})(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			})
+		}),
+	)
+}
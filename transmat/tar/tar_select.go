@@ -0,0 +1,157 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+)
+
+/*
+	Unpack only the entries of a ware matching any of `patterns`, and
+	everything under them, along with the dirs above them.  A pattern is
+	a path in the ware ("usr/bin"), or a glob as path.Match takes it
+	("usr/lib/*.so"); either way it's matched against whole names, so
+	"usr/bin" doesn't take "usr/bin2" along with it.
+
+	Unlike UnpackPaths, this works for any tar, seekable or not: the whole
+	ware is fetched and read, and what's not wanted is hashed and passed
+	over.  So the whole ware is still verified against the WareID -- and
+	the WareID returned is the one asked for -- even though only part of
+	it is placed.  A hash mismatch is reported as usual; but mind, what
+	was wanted has already been placed by then, just as with a full
+	unpack straight to the path.
+
+	A hardlink whose file isn't among what's wanted has nothing to link to,
+	so it's skipped, with a warning.  A pattern that matches nothing in the
+	ware is ErrUsage (once the ware has been read through and verified).
+
+	Placement is always direct, and the cache is not involved.
+	Filters apply as usual.
+*/
+func UnpackSelected(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	pathStr string, // Where to unpack the fileset (absolute path).
+	patterns []string, // Which paths in the ware to unpack: names or globs.
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	path2, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "unpack must be called with absolute path: %s", err)
+	}
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	sel, err := newPathSelector(patterns)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Extract what's wanted, and check the whole.
+	gotWareID, _, err := unpackTarSelected(ctx, hasher, osfs.New(path2), filt2, reader, sel, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if gotWareID != wareID {
+		return api.WareID{}, ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected %q, got %q", wareID, gotWareID),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   gotWareID.String(),
+			},
+		)
+	}
+	if unmatched := sel.unmatched(); len(unmatched) > 0 {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%q matches nothing in ware %s", unmatched[0], wareID)
+	}
+	return wareID, nil
+}
+
+/*
+	Says which entries are wanted, when unpacking only some of a ware:
+	those where the name, or the name of any dir above, matches a pattern.
+	Remembers which patterns have matched anything.
+*/
+type pathSelector struct {
+	patterns []string // Cleaned, and with no "./" or "/" prefix; "." for the root.
+	given    []string // As given, for error messages.
+	matched  []bool
+}
+
+func newPathSelector(patterns []string) (*pathSelector, error) {
+	sel := &pathSelector{given: patterns, matched: make([]bool, len(patterns))}
+	for _, p := range patterns {
+		clean := path.Clean(strings.TrimPrefix(p, "/"))
+		if clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, Errorf(rio.ErrUsage, "invalid path %q: paths that leave the base dir can't be in a ware", p)
+		}
+		if _, err := path.Match(clean, ""); err != nil {
+			return nil, Errorf(rio.ErrUsage, "invalid path %q: %s", p, err)
+		}
+		sel.patterns = append(sel.patterns, clean)
+	}
+	return sel, nil
+}
+
+func (sel *pathSelector) wants(name fs.RelPath) bool {
+	wanted := false
+	for n := name; ; n = n.Dir() {
+		s := strings.TrimPrefix(n.String(), "./")
+		for i, p := range sel.patterns {
+			if ok, _ := path.Match(p, s); ok {
+				sel.matched[i] = true
+				wanted = true
+			}
+		}
+		if n == (fs.RelPath{}) {
+			return wanted
+		}
+	}
+}
+
+func (sel *pathSelector) unmatched() (patterns []string) {
+	for i, ok := range sel.matched {
+		if !ok {
+			patterns = append(patterns, sel.given[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarUnpackSelected(t *testing.T) {
+	Convey("Tar transmat: unpacking only the paths matching some patterns", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("src"))), tests.FixtureGamma)
+				So(os.Link(tmpDir.String()+"/src/etc/trick", tmpDir.String()+"/src/var/link"), ShouldBeNil)
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.tgz", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, addr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpackSelected := func(wareID api.WareID, patterns ...string) (api.WareID, error) {
+					return UnpackSelected(context.Background(), wareID, tmpDir.String()+"/out", patterns, api.Filter_NoMutation, []api.WarehouseAddr{addr}, rio.Monitor{})
+				}
+				placed := func() (names []string) {
+					filepath.Walk(tmpDir.String()+"/out", func(path string, _ os.FileInfo, _ error) error {
+						rel, _ := filepath.Rel(tmpDir.String()+"/out", path)
+						names = append(names, rel)
+						return nil
+					})
+					return
+				}
+
+				Convey("a path should bring what's under it, and the dirs above, and nothing else", func() {
+					gotWareID, err := unpackSelected(wareID, "/etc/init.d")
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/init.d", "etc/init.d/service-p", "etc/init.d/service-q"})
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/etc/init.d/service-q")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "q!")
+				})
+				Convey("a glob should match whole names", func() {
+					_, err := unpackSelected(wareID, "etc/tr?ck", "etc/*/zed")
+					So(err, ShouldBeNil)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/init", "etc/init/zed", "etc/trick"})
+				})
+				Convey("dirs above what's placed should keep their times", func() {
+					_, err := unpackSelected(wareID, "var/fun")
+					So(err, ShouldBeNil)
+					src, err := os.Stat(tmpDir.String() + "/src/var")
+					So(err, ShouldBeNil)
+					out, err := os.Stat(tmpDir.String() + "/out/var")
+					So(err, ShouldBeNil)
+					So(out.ModTime().Unix(), ShouldEqual, src.ModTime().Unix())
+				})
+				Convey("a hardlink should be placed only along with what it links to", func() {
+					_, err := unpackSelected(wareID, "var")
+					So(err, ShouldBeNil)
+					So(placed(), ShouldResemble, []string{".", "var", "var/fun"})
+
+					So(os.RemoveAll(tmpDir.String()+"/out"), ShouldBeNil)
+					_, err = unpackSelected(wareID, "var", "etc/trick")
+					So(err, ShouldBeNil)
+					So(placed(), ShouldResemble, []string{".", "etc", "etc/trick", "var", "var/fun", "var/link"})
+				})
+				Convey("a pattern that matches nothing should be a usage error", func() {
+					_, err := unpackSelected(wareID, "etc/nope*")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+				Convey("a malformed pattern should be a usage error", func() {
+					_, err := unpackSelected(wareID, "etc/[")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+				Convey("the whole ware should still be verified", func() {
+					otherWareID := api.WareID{PackType, "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+					_, err := unpackSelected(otherWareID, "etc")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+			})
+		}),
+	)
+}
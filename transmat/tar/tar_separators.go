@@ -0,0 +1,91 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	SeparatorPolicy selects how backslashes in tar entry names are understood.
+
+	On linux a backslash is an ordinary filename character; on windows it's
+	a path separator.  A ware made on one and used on the other can thus be
+	silently misread: "a\b" is either one file, or a file "b" in dir "a".
+	Neither reading is wrong per se, so there's no safe automatic choice;
+	the policy must be picked explicitly, with the `RIO_TAR_SEPARATORS`
+	environment variable (see config.GetTarSeparatorPolicy).
+
+	BEWARE: the policy changes *what fileset a ware describes*, and thus
+	its WareID.  The WareID verified on unpack is computed over the names
+	as the policy interprets them, so a ware is only valid under the same
+	policy that was used to pack or scan it.  Translating an existing
+	strict ware will fail hash verification -- as it should, since the
+	result is a different fileset.  (Scan the ware under the translating
+	policy to get the WareID that describes the translated fileset.)
+
+	Only entry names are affected.  Symlink targets are opaque strings
+	and are never translated.
+*/
+type SeparatorPolicy string
+
+const (
+	/*
+		Names are opaque bytes: a backslash is just a character.
+		This is the default, and matches what tar itself does on linux.
+	*/
+	SeparatorPolicy_Strict SeparatorPolicy = ""
+
+	/*
+		Backslashes are path separators, as from a ware packed on windows.
+		On unpack, they're translated to '/' before anything else sees the name.
+		On pack, a name containing a backslash is an error, since it would
+		be misread as a path by anyone using this same policy.
+	*/
+	SeparatorPolicy_Backslash SeparatorPolicy = "backslash"
+
+	/*
+		Any backslash in a name is an error, on both pack and unpack.
+		Use this to guarantee wares mean the same thing on every platform.
+	*/
+	SeparatorPolicy_Reject SeparatorPolicy = "reject"
+)
+
+/*
+	Apply the separator policy to an entry name read from a tar.
+*/
+func (policy SeparatorPolicy) unpackName(name string) (string, error) {
+	if !strings.Contains(name, `\`) {
+		return name, nil
+	}
+	switch policy {
+	case SeparatorPolicy_Strict:
+		return name, nil
+	case SeparatorPolicy_Backslash:
+		name = strings.Replace(name, `\`, "/", -1)
+		if strings.HasPrefix(name, "/") {
+			return "", Errorf(rio.ErrWareCorrupt, "corrupt tar: entry %q is rooted once backslashes are read as separators", name)
+		}
+		return name, nil
+	case SeparatorPolicy_Reject:
+		return "", Errorf(rio.ErrWareCorrupt, "tar entry %q contains a backslash, which the separator policy rejects", name)
+	default:
+		panic("unreachable")
+	}
+}
+
+/*
+	Check an entry name against the separator policy before packing it.
+*/
+func (policy SeparatorPolicy) packName(name string) error {
+	if policy == SeparatorPolicy_Strict || !strings.Contains(name, `\`) {
+		return nil
+	}
+	return Errorf(rio.ErrPackInvalid, "cannot pack %q: name contains a backslash, which would be read as a path separator", name)
+}
@@ -0,0 +1,103 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarSeparatorPolicy(t *testing.T) {
+	Convey("Tar transmat: backslashes in entry names", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_TAR_SEPARATORS")
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+				So(err, ShouldBeNil)
+
+				// A tar as windows might have made it: one file, in a dir, with the dir left implicit.
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				So(tw.WriteHeader(&tar.Header{Name: `a\b`, Typeflag: tar.TypeReg, Mode: 0644, Size: 1, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+				tw.Write([]byte("x"))
+				So(tw.Close(), ShouldBeNil)
+				unpack := func(policy string) (fs.FS, api.WareID, error) {
+					os.Setenv("RIO_TAR_SEPARATORS", policy)
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("unpack-" + policy)))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					wareID, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+					return afs, wareID, err
+				}
+
+				// And a filesystem as linux might have it: one file with an odd name.
+				srcFs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(srcFs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(srcFs, []tests.FixtureFile{
+					{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: time.Unix(1000, 0)}, nil},
+					{fs.Metadata{Name: fs.MustRelPath(`a\b`), Type: fs.Type_File, Perms: 0644, Mtime: time.Unix(1000, 0)}, []byte("x")},
+				})
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				pack := func(policy string) (api.WareID, error) {
+					os.Setenv("RIO_TAR_SEPARATORS", policy)
+					return Pack(
+						context.Background(),
+						PackType,
+						srcFs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir)),
+						rio.Monitor{},
+					)
+				}
+
+				Convey("the strict policy should treat the backslash as part of the name", func() {
+					afs, strictWareID, err := unpack("strict")
+					So(err, ShouldBeNil)
+					So(testutil.ShouldStat(afs, fs.MustRelPath(`a\b`)).Type, ShouldEqual, fs.Type_File)
+
+					_, err = pack("strict")
+					So(err, ShouldBeNil)
+
+					Convey("and so describe a different fileset than the backslash policy", func() {
+						_, translatedWareID, err := unpack("backslash")
+						So(err, ShouldBeNil)
+						So(translatedWareID, ShouldNotResemble, strictWareID)
+					})
+				})
+				Convey("the backslash policy should treat the backslash as a separator", func() {
+					afs, _, err := unpack("backslash")
+					So(err, ShouldBeNil)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("a")).Type, ShouldEqual, fs.Type_Dir)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("a/b")).Type, ShouldEqual, fs.Type_File)
+
+					_, err = pack("backslash")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+				})
+				Convey("the reject policy should refuse the name either way", func() {
+					_, _, err := unpack("reject")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+
+					_, err = pack("reject")
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrPackInvalid)
+				})
+			})
+		}),
+	)
+}
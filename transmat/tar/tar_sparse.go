@@ -0,0 +1,340 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+)
+
+/*
+	A run of data in a sparse file; everything between runs is a hole.
+*/
+type sparseEntry struct {
+	offset, length int64
+}
+
+/*
+	Hashes a file's content, and meanwhile finds its holes: by asking the
+	filesystem where they are (see fsOp.DataRuns), or if it can't say, by
+	looking for them (see scanSparse).
+
+	Returns the runs of data between the holes, or nil if there weren't any
+	holes (or the data is too big to put in a sparse entry anyway).
+	The hash is over all the content, zeros and all, so a file's hash
+	doesn't depend on whether it was sparse.
+*/
+func hashSparse(ctx context.Context, path fs.RelPath, file io.ReaderAt, contentHasher hash.Hash) (size int64, data []sparseEntry, err error) {
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return scanSparse(cancellableReader{ctx, io.NewSectionReader(file, 0, math.MaxInt64)}, contentHasher)
+	}
+	runs, size, err := fsOp.DataRuns(seeker)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotSupported:
+		return scanSparse(cancellableReader{ctx, io.NewSectionReader(file, 0, math.MaxInt64)}, contentHasher)
+	default:
+		return 0, nil, err
+	}
+	var pos int64
+	for _, run := range runs {
+		if _, err := io.CopyN(contentHasher, cancellableReader{ctx, zeros{}}, run.Offset-pos); err != nil {
+			return 0, nil, err
+		}
+		n, err := io.Copy(contentHasher, cancellableReader{ctx, io.NewSectionReader(file, run.Offset, run.Length)})
+		if err != nil {
+			return 0, nil, err
+		}
+		if n != run.Length {
+			return 0, nil, Errorf(rio.ErrPackInvalid, "file %q changed while being packed", path)
+		}
+		data = append(data, sparseEntry{run.Offset, run.Length})
+		pos = run.Offset + run.Length
+	}
+	if _, err := io.CopyN(contentHasher, cancellableReader{ctx, zeros{}}, size-pos); err != nil {
+		return 0, nil, err
+	}
+	if len(data) == 1 && data[0] == (sparseEntry{0, size}) {
+		return size, nil, nil // no holes after all.
+	}
+	// If there's a hole at the end, it's an empty run there, as in scanSparse.
+	if pos < size || len(data) == 0 {
+		data = append(data, sparseEntry{size, 0})
+	}
+	if sparsePhysicalSize(data) > maxUSTARSize {
+		return size, nil, nil
+	}
+	return size, data, nil
+}
+
+/*
+	Hashes a file's content, and meanwhile looks for its holes: runs of
+	whole, aligned, all-zero blocks (see fsOp.SparseBlock).
+	Returns the same as hashSparse.
+*/
+func scanSparse(r io.Reader, contentHasher hash.Hash) (size int64, data []sparseEntry, err error) {
+	br := bufio.NewReaderSize(r, fsOp.SparseBlock)
+	buf := make([]byte, fsOp.SparseBlock)
+	var pos, dataStart int64
+	holeStart := int64(-1)
+	for {
+		n, err := io.ReadFull(br, buf)
+		contentHasher.Write(buf[:n])
+		if n == len(buf) && fsOp.IsZero(buf) {
+			if holeStart < 0 {
+				holeStart = pos
+			}
+		} else if n > 0 && holeStart >= 0 {
+			if holeStart > dataStart {
+				data = append(data, sparseEntry{dataStart, holeStart - dataStart})
+			}
+			dataStart, holeStart = pos, -1
+		}
+		pos += int64(n)
+		switch err {
+		case nil:
+			continue
+		case io.EOF, io.ErrUnexpectedEOF:
+			// done
+		default:
+			return pos, nil, err
+		}
+		break
+	}
+	if holeStart < 0 && dataStart == 0 {
+		return pos, nil, nil // no holes at all.
+	}
+	// The last run of data goes to the end; if there's a hole at the end,
+	//  it's an empty run there, which is how GNU tar marks the size too.
+	if holeStart < 0 {
+		holeStart = pos
+	}
+	if holeStart > dataStart {
+		data = append(data, sparseEntry{dataStart, holeStart - dataStart})
+	}
+	if holeStart < pos || len(data) == 0 {
+		data = append(data, sparseEntry{pos, 0})
+	}
+	if sparsePhysicalSize(data) > maxUSTARSize {
+		return pos, nil, nil
+	}
+	return pos, data, nil
+}
+
+// Reads as an endless run of zeros; what a hole reads as.
+type zeros struct{}
+
+func (zeros) Read(bs []byte) (int, error) {
+	for i := range bs {
+		bs[i] = 0
+	}
+	return len(bs), nil
+}
+
+// The largest size a ustar header can say.
+const maxUSTARSize = 1<<33 - 1
+
+/*
+	The sparse map, as it's written at the start of the entry's data:
+	the number of runs, then each run's offset and length, all in decimal
+	on lines of their own, padded out to a whole tar block.
+*/
+func sparseMap(data []sparseEntry) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", len(data))
+	for _, run := range data {
+		fmt.Fprintf(&buf, "%d\n%d\n", run.offset, run.length)
+	}
+	if pad := buf.Len() % 512; pad != 0 {
+		buf.Write(make([]byte, 512-pad))
+	}
+	return buf.Bytes()
+}
+
+func sparsePhysicalSize(data []sparseEntry) int64 {
+	size := int64(len(sparseMap(data)))
+	for _, run := range data {
+		size += run.length
+	}
+	return size
+}
+
+/*
+	Write a file as a sparse entry, in the PAX "GNU.sparse" 1.0 format
+	(which is what GNU tar writes in PAX mode, and what both GNU tar and
+	golang's tar reader can read back into the whole file).
+
+	The golang tar writer can't write these: it drops "GNU.sparse.*" PAX
+	records.  So we write the PAX header ourselves, straight to `raw` (the
+	stream `tw` writes to), with *every* record the entry needs in it; and
+	then have `tw` write the rest of the entry as plain ustar, so that it
+	doesn't go and write a PAX header of its own.
+
+	`data` is as from hashSparse, and the data runs are read from `file`
+	at their offsets.  If they come up short, the file changed since it was
+	hashed, and that's an ErrPackInvalid.
+*/
+func writeSparse(ctx context.Context, tw *tar.Writer, raw io.Writer, hdr *tar.Header, data []sparseEntry, file io.ReaderAt) error {
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	ustar := *hdr
+	ustar.Name = sparsePlaceholder("GNUSparseFile.0", hdr.Name)
+	ustar.Format = tar.FormatUSTAR
+	ustar.Xattrs, ustar.PAXRecords = nil, nil
+	for k, v := range hdr.Xattrs {
+		records["SCHILY.xattr."+k] = v
+	}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	if hdr.Uid > 07777777 {
+		records["uid"], ustar.Uid = strconv.Itoa(hdr.Uid), 0
+	}
+	if hdr.Gid > 07777777 {
+		records["gid"], ustar.Gid = strconv.Itoa(hdr.Gid), 0
+	}
+	if secs := hdr.ModTime.Unix(); secs < 0 || secs > 077777777777 {
+		records["mtime"], ustar.ModTime = formatPAXTime(hdr.ModTime), time.Unix(0, 0)
+	} else if hdr.ModTime.Nanosecond() != 0 {
+		records["mtime"], ustar.ModTime = formatPAXTime(hdr.ModTime), hdr.ModTime.Truncate(time.Second)
+	}
+	mapBlock := sparseMap(data)
+	ustar.Size = sparsePhysicalSize(data)
+
+	if err := tw.Flush(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if _, err := raw.Write(paxHeader(sparsePlaceholder("PaxHeaders.0", hdr.Name), records)); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if err := tw.WriteHeader(&ustar); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	if _, err := tw.Write(mapBlock); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+	for _, run := range data {
+		n, err := io.Copy(tw, cancellableReader{ctx, io.NewSectionReader(file, run.offset, run.length)})
+		if err != nil {
+			return err
+		}
+		if n != run.length {
+			return Errorf(rio.ErrPackInvalid, "file %q changed while being packed", hdr.Name)
+		}
+	}
+	return nil
+}
+
+/*
+	The name a reader that doesn't know about sparse entries (or PAX)
+	will see: the real name with a directory put in before the last
+	segment, GNU tar style.  If that won't fit a ustar header, it's just
+	the directory name.
+*/
+func sparsePlaceholder(dir, name string) string {
+	parent, file := path.Split(name)
+	placeholder := path.Join(parent, dir, file)
+	if len(placeholder) > 100 {
+		return dir
+	}
+	for _, r := range placeholder {
+		if r >= 0x80 {
+			return dir
+		}
+	}
+	return placeholder
+}
+
+/*
+	A PAX extended header ("x" type) entry: its ustar block, and then the
+	records, padded out to a whole block.
+*/
+func paxHeader(name string, records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body bytes.Buffer
+	for _, k := range keys {
+		// Each record starts with its own length, which counts its own digits.
+		rec := " " + k + "=" + records[k] + "\n"
+		size := len(rec) + len(strconv.Itoa(len(rec)))
+		if len(strconv.Itoa(size)) > len(strconv.Itoa(len(rec))) {
+			size++
+		}
+		fmt.Fprintf(&body, "%d%s", size, rec)
+	}
+
+	block := make([]byte, 512)
+	copy(block[0:100], name)
+	copy(block[100:108], "0000644\x00")                        // mode
+	copy(block[108:116], "0000000\x00")                        // uid
+	copy(block[116:124], "0000000\x00")                        // gid
+	copy(block[124:136], fmt.Sprintf("%011o\x00", body.Len())) // size
+	copy(block[136:148], "00000000000\x00")                    // mtime
+	block[156] = tar.TypeXHeader
+	copy(block[257:265], "ustar\x0000")
+	copy(block[148:156], "        ") // the checksum is summed as if it were spaces
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	if pad := body.Len() % 512; pad != 0 {
+		body.Write(make([]byte, 512-pad))
+	}
+	return append(block, body.Bytes()...)
+}
+
+/*
+	Returns true if the file at `path` is worth looking for holes in
+	(see fsOp.IsSparse), and we can read it at offsets for writeSparse.
+*/
+func sparseCandidate(afs fs.FS, path fs.RelPath, file io.Reader) bool {
+	_, ok := file.(io.ReaderAt)
+	return ok && fsOp.IsSparse(afs, path)
+}
+
+/*
+	Format a time as PAX "mtime" records have it: seconds since the epoch,
+	and the fraction, if any, without trailing zeros (as golang's writer does).
+*/
+func formatPAXTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		// The fraction counts up from the second before; PAX wants it down from zero.
+		sign, secs, nsecs = "-", -(secs + 1), 1e9-nsecs
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
@@ -0,0 +1,207 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+// Bytes actually allocated on disk for the file at path.
+func allocatedSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestTarSparse(t *testing.T) {
+	Convey("Tar transmat: sparse files", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				fixtureBody := tests.FixtureSparse[1].Body
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				tests.PlaceFixture(afs, tests.FixtureSparse)
+				So(fsOp.IsSparse(afs, fs.MustRelPath("sparse")), ShouldBeTrue)
+
+				// The same again, but written out in full.
+				denseFs := osfs.New(tmpDir.Join(fs.MustRelPath("dense")))
+				So(denseFs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				So(ioutil.WriteFile(denseFs.BasePath().String()+"/sparse", fixtureBody, 0644), ShouldBeNil)
+				for _, ff := range []tests.FixtureFile{tests.FixtureSparse[1], tests.FixtureSparse[0]} {
+					So(denseFs.SetTimesNano(ff.Metadata.Name, ff.Metadata.Mtime, fs.DefaultAtime), ShouldBeNil)
+				}
+				So(fsOp.IsSparse(denseFs, fs.MustRelPath("sparse")), ShouldBeFalse)
+
+				pack := func(afs fs.FS, name string) api.WareID {
+					wareID, err := PackWith(PackOptions{Compression: Uncompressed})(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name)),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				wareID := pack(afs, "sparse.tar")
+
+				Convey("packing should record the holes rather than the zeros", func() {
+					fi, err := os.Stat(tmpDir.String() + "/sparse.tar")
+					So(err, ShouldBeNil)
+					So(fi.Size(), ShouldBeLessThan, 1<<20)
+
+					f, err := os.Open(tmpDir.String() + "/sparse.tar")
+					So(err, ShouldBeNil)
+					defer f.Close()
+					tr := tar.NewReader(f)
+					_, err = tr.Next()
+					So(err, ShouldBeNil)
+					hdr, err := tr.Next()
+					So(err, ShouldBeNil)
+					So(hdr.Name, ShouldEqual, "./sparse")
+					So(hdr.Size, ShouldEqual, len(fixtureBody))
+					So(hdr.PAXRecords["GNU.sparse.major"], ShouldEqual, "1")
+					body, err := ioutil.ReadAll(tr)
+					So(err, ShouldBeNil)
+					So(bytes.Equal(body, fixtureBody), ShouldBeTrue)
+				})
+				Convey("the WareID should be the same as if the file weren't sparse", func() {
+					So(pack(denseFs, "dense.tar"), ShouldResemble, wareID)
+					withPackParallelism(4, func() {
+						So(pack(afs, "sparse-parallel.tar"), ShouldResemble, wareID)
+					})
+				})
+				Convey("unpacking should leave the holes as holes", func() {
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.String()+"/out",
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/sparse.tar", tmpDir))},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					got, err := ioutil.ReadFile(tmpDir.String() + "/out/sparse")
+					So(err, ShouldBeNil)
+					So(bytes.Equal(got, fixtureBody), ShouldBeTrue)
+					So(allocatedSize(tmpDir.String()+"/out/sparse"), ShouldBeLessThan, len(fixtureBody)/4)
+				})
+				Convey("unpacking gnu tar's sparse entries should work the same", func() {
+					wareID := api.WareID{"tar", "5GEpzPSECbNosyMnSZLYCwHWEwPybH973ntA3uzDsogDbtnYVgvkgBVFcML6eRQ6ge"}
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.String()+"/out",
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{"file://./fixtures/tar_sparse.tgz"},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					got, err := ioutil.ReadFile(tmpDir.String() + "/out/sparse")
+					So(err, ShouldBeNil)
+					So(bytes.Equal(got, fixtureBody), ShouldBeTrue)
+					So(allocatedSize(tmpDir.String()+"/out/sparse"), ShouldBeLessThan, len(fixtureBody)/4)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarSparseSmallHoles(t *testing.T) {
+	Convey("Tar transmat: holes smaller than fsOp.SparseBlock", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				// Data at each end and a hole between, too short for zero blocks
+				//  to be seen; only the filesystem knows it's there.
+				body := make([]byte, 2*fsOp.SparseBlock)
+				copy(body, "head")
+				copy(body[len(body)-4096:], "tail")
+				place := func(name string, sparse bool) fs.FS {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					f, err := os.Create(afs.BasePath().String() + "/file")
+					So(err, ShouldBeNil)
+					defer f.Close()
+					if sparse {
+						_, err = f.WriteAt(body[:4096], 0)
+						So(err, ShouldBeNil)
+						_, err = f.WriteAt(body[len(body)-4096:], int64(len(body)-4096))
+					} else {
+						_, err = f.Write(body)
+					}
+					So(err, ShouldBeNil)
+					So(afs.SetTimesNano(fs.MustRelPath("file"), fs.DefaultAtime, fs.DefaultAtime), ShouldBeNil)
+					So(afs.SetTimesNano(fs.RelPath{}, fs.DefaultAtime, fs.DefaultAtime), ShouldBeNil)
+					return afs
+				}
+				afs := place("src", true)
+				So(fsOp.IsSparse(afs, fs.MustRelPath("file")), ShouldBeTrue)
+				pack := func(afs fs.FS, name string) api.WareID {
+					wareID, err := PackWith(PackOptions{Compression: Uncompressed})(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						api.WarehouseAddr(fmt.Sprintf("file://%s/%s", tmpDir, name)),
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				wareID := pack(afs, "sparse.tar")
+
+				Convey("packing should record the holes the filesystem reports", func() {
+					fi, err := os.Stat(tmpDir.String() + "/sparse.tar")
+					So(err, ShouldBeNil)
+					So(fi.Size(), ShouldBeLessThan, fsOp.SparseBlock)
+				})
+				Convey("the WareID should be the same as if the file weren't sparse", func() {
+					So(pack(place("dense", false), "dense.tar"), ShouldResemble, wareID)
+				})
+				Convey("unpacking should punch the holes again", func() {
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.String()+"/out",
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{api.WarehouseAddr(fmt.Sprintf("file://%s/sparse.tar", tmpDir))},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					got, err := ioutil.ReadFile(tmpDir.String() + "/out/file")
+					So(err, ShouldBeNil)
+					So(bytes.Equal(got, body), ShouldBeTrue)
+					So(allocatedSize(tmpDir.String()+"/out/file"), ShouldBeLessThan, len(body)/2)
+				})
+			})
+		}),
+	)
+}
@@ -8,12 +8,9 @@ package tartrans
 import (
 	"archive/tar"
 	"context"
-	"crypto/sha512"
-	"fmt"
 	"io"
-	"strings"
+	"io/ioutil"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
@@ -26,7 +23,9 @@ import (
 	"go.polydawn.net/rio/transmat/mixins/cache"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
 	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
 	"go.polydawn.net/rio/transmat/util"
 )
 
@@ -56,9 +55,11 @@ func Unpack(
 		placementMode = rio.Placement_Copy
 	}
 	// Wrap the direct unpack func with cache behavior; call that.
-	return cache.Lrn2Cache(
+	//  Local warehouses can say how big the ware is, so the cache can check it has room.
+	return cache.Lrn2CacheSized(
 		osfs.New(config.GetCacheBasePath()),
 		unpack,
+		wareSize,
 	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
 }
 
@@ -75,45 +76,146 @@ func unpack(
 
 	// Sanitize arguments.
 	path2 := fs.MustAbsolutePath(path)
-	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
 
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
 	// Pick a warehouse and get a reader.
-	reader, err := PickReader(wareID, warehouses, false, mon)
+	//  Remote wares are fetched into the cache first, so a fetch that breaks can be resumed.
+	reader, err := pickStagedReader(ctx, wareID, warehouses, mon)
 	if err != nil {
 		return api.WareID{}, err
 	}
 	defer reader.Close()
 
-	// Construct filesystem wrapper to use for all our ops.
-	afs := osfs.New(path2)
+	// Construct filesystem wrapper to use for all our ops; extract, and check.
+	return unpackVerified(ctx, wareID, hasher, osfs.New(path2), filt2, reader, mon)
+}
+
+/*
+	Unpack, but reading the ware from `reader` rather than fetching it from
+	a warehouse: for piping wares straight from one tool to another.
+
+	The stream is hashed as it's consumed, just as a fetched ware is, so a
+	stream that doesn't match `wareID` is still ErrWareHashMismatch (and,
+	when the cache is in play, is not shelved).  Nothing seeks or rereads.
+
+	If the cache already has the ware, the stream isn't read at all.
+	Either way, closing the stream is up to the caller; and a writer on the
+	other end of a pipe should expect the read to stop early on errors.
+*/
+func UnpackFromStream(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID the stream should be.
+	reader io.Reader, // The stream to read the ware from.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// The same cache behavior as Unpack, around an unpack func that ignores
+	//  warehouses and reads the stream instead.
+	unpackStream := func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		_ rio.PlacementMode,
+		_ []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		path2 := fs.MustAbsolutePath(path)
+		filt2, _, err := filters.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+		}
+		hasher, err := lookupHasher(wareID)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		return unpackVerified(ctx, wareID, hasher, osfs.New(path2), filt2, reader, mon)
+	}
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpackStream,
+	)(ctx, wareID, path, filt, placementMode, nil, mon)
+}
+
+/*
+	Extract a tar stream onto `afs`, just as Unpack does once it has a
+	reader, and return the WareIDs (prefilter, and filtered) of what was
+	extracted, as of the given packType.
+
+	This is for transmats whose wares have a tar inside them somewhere
+	(a deb's data.tar, say): they find the tar, and this does the rest.
+	Nothing is verified against any expected WareID; that's the caller's job.
+	Filters must already be processed, as for unpacking.
+*/
+func ExtractTar(
+	ctx context.Context,
+	packType api.PackType,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (prefilterWareID api.WareID, actualWareID api.WareID, err error) {
+	prefilterWareID, actualWareID, err = unpackTar(ctx, defaultHasher, afs, filt, reader, mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	prefilterWareID.Type, actualWareID.Type = packType, packType
+	return prefilterWareID, actualWareID, nil
+}
+
+/*
+	Extract with unpackTar, and check that what was extracted is `wareID`.
+*/
+func unpackVerified(
+	ctx context.Context,
+	wareID api.WareID,
+	hasher wareHasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	mon rio.Monitor,
+) (api.WareID, error) {
 	// Extract.
-	prefilterWareID, unpackWareID, err := unpackTar(ctx, afs, filt2, reader, mon)
+	prefilterWareID, unpackWareID, err := unpackTar(ctx, hasher, afs, filt, reader, mon)
 	if err != nil {
 		return unpackWareID, err
 	}
 
 	// Check for hash mismatch before returning, because that IS an error,
 	//  but also return the hash we got either way.
-	if prefilterWareID != wareID {
-		return unpackWareID, ErrorDetailed(
-			rio.ErrWareHashMismatch,
-			fmt.Sprintf("hash mismatch: expected %q, got %q (filtered %q)", wareID, prefilterWareID, unpackWareID),
-			map[string]string{
-				"expected": wareID.String(),
-				"actual":   prefilterWareID.String(),
-				"filtered": unpackWareID.String(),
-			},
-		)
-	}
-	return unpackWareID, nil
+	// This is the verification that what we placed is what was asked for.
+	//  The hash was computed from the stream as it was unpacked -- not by a
+	//  second pass over the result -- so it's effectively free, and there's
+	//  no option to skip it.  (When the cache is in play, a mismatch means
+	//  the cache's temp dir is discarded, so the bad ware is never shelved.)
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
 }
 
 func unpackTar(
 	ctx context.Context,
+	hasher wareHasher,
 	afs fs.FS,
 	filt apiutil.FilesetFilters,
 	reader io.Reader,
@@ -122,6 +224,27 @@ func unpackTar(
 	prefilterWareID api.WareID,
 	actualWareID api.WareID,
 	err error,
+) {
+	return unpackTarSelected(ctx, hasher, afs, filt, reader, nil, mon)
+}
+
+/*
+	unpackTar, but placing only what `sel` wants (or everything, if it's nil).
+	Everything is still hashed, so the prefilter WareID is of the whole ware;
+	but when only some of it's placed, there's no filtered WareID to give.
+*/
+func unpackTarSelected(
+	ctx context.Context,
+	hasher wareHasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	reader io.Reader,
+	sel *pathSelector,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
 ) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -133,7 +256,8 @@ func unpackTar(
 	}
 
 	// Convert the raw byte reader to a tar stream.
-	tr := tar.NewReader(reader2)
+	//  Reads check for cancellation, so even one huge file can be interrupted.
+	tr := tar.NewReader(cancellableReader{ctx, reader2})
 
 	// Allocate bucket for keeping each metadata entry and content hash;
 	// the full tree hash will be computed from this at the end.
@@ -147,6 +271,67 @@ func unpackTar(
 	// allowance for implicit parent dirs.
 	dirs := map[fs.RelPath]struct{}{}
 
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// If the target was cleared with the skip policy for immutable files,
+	//  whatever was left in place will collide; let those entries go by.
+	//  (Only those: any other failure to place is still an error.)
+	immutablePolicyName, err := config.GetImmutableTargetPolicy()
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	immutablePolicy := fsOp.ImmutablePolicy(immutablePolicyName)
+	skipKept := func(fmeta fs.Metadata, err error) error {
+		if err == nil {
+			return nil
+		}
+		if err := fsOp.CheckImmutableCollision(afs, fmeta.Name, immutablePolicy, err); err != nil {
+			return err
+		}
+		log.ImmutableTargetSkipped(mon, fmeta.Name)
+		return nil
+	}
+
+	// Backslashes in names may or may not be separators; config says.
+	sepPolicyName, err := config.GetTarSeparatorPolicy()
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	sepPolicy := SeparatorPolicy(sepPolicyName)
+
+	// Hardlinks refer back to earlier files; remember those.
+	hardlinks := hardlinkTargets{}
+
+	// eStargz tars have entries of their own, which aren't the fileset's.
+	stargz := estargzSkipper{}
+
+	// When only some paths are wanted, a dir is placed once something in it
+	//  is; until then, it waits here (filtered, ready to place).
+	//  And a hardlink can only be placed if the file it links to was.
+	placed := map[fs.RelPath]struct{}{}
+	waiting := map[fs.RelPath]fs.Metadata{}
+	placeParents := func(name fs.RelPath) error {
+		for _, parent := range name.SplitParent() {
+			dirFmeta, ok := waiting[parent]
+			if !ok {
+				continue
+			}
+			delete(waiting, parent)
+			if err := skipKept(dirFmeta, fsOp.PlaceFileWithPolicy(afs, dirFmeta, nil, filt.SkipChown, policy.Chown)); err != nil {
+				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			filteredBucket.AddRecord(dirFmeta, nil)
+			placed[parent] = struct{}{}
+		}
+		return nil
+	}
+
+	// Report bytes written as we go.  (A tar stream doesn't say how long it is.)
+	prog := progress.New(mon, "unpack", 0)
+
 	// Iterate over each tar entry, mutating filesystem as we go.
 	for {
 		fmeta := fs.Metadata{}
@@ -156,18 +341,25 @@ func unpackTar(
 		if err == io.EOF {
 			break // sucess!  end of archive.
 		}
+		if ctx.Err() != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
 		if err != nil {
 			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
 		}
-		if ctx.Err() != nil {
-			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		if stargz.skip(thdr) {
+			continue
 		}
 
 		// Reshuffle metainfo to our default format.
+		//  Names are interpreted per the separator policy first; no one else should see the raw name.
+		if thdr.Name, err = sepPolicy.unpackName(thdr.Name); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
 		if err := TarHdrToMetadata(thdr, &fmeta); err != nil {
 			return api.WareID{}, api.WareID{}, err
 		}
-		if strings.HasPrefix(fmeta.Name.String(), "..") {
+		if fmeta.Name.GoesUp() {
 			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
 		}
 
@@ -188,10 +380,15 @@ func unpackTar(
 			conjuredFmeta := fshash.DefaultDirMetadata()
 			conjuredFmeta.Name = parent
 			prefilterBucket.AddRecord(conjuredFmeta, nil)
+			policy.Apply(&conjuredFmeta)
 			filters.Apply(filt, &conjuredFmeta)
-			filteredBucket.AddRecord(conjuredFmeta, nil)
 			dirs[conjuredFmeta.Name] = struct{}{}
-			if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, filt.SkipChown); err != nil {
+			if sel != nil {
+				waiting[parent] = conjuredFmeta
+				continue
+			}
+			filteredBucket.AddRecord(conjuredFmeta, nil)
+			if err := skipKept(conjuredFmeta, fsOp.PlaceFileWithPolicy(afs, conjuredFmeta, nil, filt.SkipChown, policy.Chown)); err != nil {
 				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 		}
@@ -200,22 +397,94 @@ func unpackTar(
 		//  ... uck, to one copy of the meta.  We can't add either to their buckets
 		//  until after the file is placed because we need the content hash.
 		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
 		filters.Apply(filt, &filteredFmeta)
 
+		// If only some paths are wanted, and this isn't one, just hash it.
+		//  Otherwise, make sure the dirs above it are there first.
+		if sel != nil && !sel.wants(fmeta.Name) {
+			switch fmeta.Type {
+			case fs.Type_File:
+				reader := &util.HashingReader{tr, hasher.New()}
+				if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+					if ctx.Err() != nil {
+						return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+					}
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+				}
+				prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
+				hardlinks.remember(fmeta, filteredFmeta, reader.Hasher.Sum(nil))
+			case fs.Type_Hardlink:
+				target, err := hardlinks.resolve(fmeta, thdr)
+				if err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
+				prefilterBucket.AddRecord(target.prefilter, target.contentHash)
+			case fs.Type_Dir:
+				dirs[fmeta.Name] = struct{}{}
+				waiting[fmeta.Name] = filteredFmeta
+				fallthrough
+			default:
+				prefilterBucket.AddRecord(fmeta, nil)
+			}
+			continue
+		}
+		if sel != nil {
+			if err := placeParents(fmeta.Name); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			placed[fmeta.Name] = struct{}{}
+		}
+
 		// Place the file.
 		switch fmeta.Type {
 		case fs.Type_File:
-			reader := &util.HashingReader{tr, sha512.New384()}
-			if err := fsOp.PlaceFile(afs, filteredFmeta, reader, filt.SkipChown); err != nil {
-				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			reader := &util.HashingReader{tr, hasher.New()}
+			if err := fsOp.PlaceFileWithPolicy(afs, filteredFmeta, reader, filt.SkipChown, policy.Chown); err != nil {
+				// A cancelled read surfaces here wrapped as a placement error; say what it really was.
+				if ctx.Err() != nil {
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+				}
+				if err := skipKept(filteredFmeta, err); err != nil {
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+				}
+				// Still need the body hashed, even though it's going nowhere.
+				if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+					if ctx.Err() != nil {
+						return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+					}
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+				}
 			}
 			prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
 			filteredBucket.AddRecord(filteredFmeta, reader.Hasher.Sum(nil))
+			hardlinks.remember(fmeta, filteredFmeta, reader.Hasher.Sum(nil))
+			prog.Add(fmeta.Size, fmeta.Name)
+		case fs.Type_Hardlink:
+			target, err := hardlinks.resolve(fmeta, thdr)
+			if err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			if sel != nil {
+				// (resolve has already checked the link is a proper name.)
+				linkTarget, _ := fs.ParseRelPath(fmeta.Linkname)
+				if _, ok := placed[linkTarget]; !ok {
+					log.HardlinkSkipped(mon, fmeta.Name, linkTarget)
+					prefilterBucket.AddRecord(target.prefilter, target.contentHash)
+					delete(placed, fmeta.Name)
+					continue
+				}
+			}
+			if err := skipKept(filteredFmeta, fsOp.PlaceFileWithPolicy(afs, filteredFmeta, nil, filt.SkipChown, policy.Chown)); err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+			prefilterBucket.AddRecord(target.prefilter, target.contentHash)
+			filteredBucket.AddRecord(target.filtered, target.contentHash)
 		case fs.Type_Dir:
 			dirs[fmeta.Name] = struct{}{}
 			fallthrough
 		default:
-			if err := fsOp.PlaceFile(afs, filteredFmeta, nil, filt.SkipChown); err != nil {
+			if err := skipKept(filteredFmeta, fsOp.PlaceFileWithPolicy(afs, filteredFmeta, nil, filt.SkipChown, policy.Chown)); err != nil {
 				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, nil)
@@ -225,26 +494,30 @@ func unpackTar(
 
 	// Cleanup dir times with a post-order traversal over the bucket.
 	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
-	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
-		record := node.(fshash.RecordIterator).Record()
-		if record.Metadata.Type != fs.Type_Dir {
-			return nil
+	//  (Unpacking only some paths may have placed nothing at all.)
+	if filteredBucket.Length() > 0 {
+		if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+			record := node.(fshash.RecordIterator).Record()
+			if record.Metadata.Type != fs.Type_Dir {
+				return nil
+			}
+			return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+		}); err != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 		}
-		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
-	}); err != nil {
-		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 	}
 
 	// Hash the thing!
-	prefilterHash := misc.Base58Encode(fshash.HashBucket(prefilterBucket, sha512.New384))
-	filteredHash := misc.Base58Encode(fshash.HashBucket(filteredBucket, sha512.New384))
-	if !filt.IsHashAltering() {
-		// Paranoia check for new feature.
-		//  When paranoia reduced, replace with skipping the double computation.
-		if prefilterHash != filteredHash {
-			panic(fmt.Errorf("prefilterHash %q != filteredHash %q", prefilterHash, filteredHash))
-		}
+	//  If only some of it was placed, there's no whole filtered fileset to hash.
+	if sel != nil {
+		prog.Done()
+		return hasher.WareID(prefilterBucket), api.WareID{}, nil
 	}
+	//  (Paranoia check for new feature, if nothing should have altered the hash.
+	//  When paranoia reduced, replace with skipping the double computation.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
 
-	return api.WareID{"tar", prefilterHash}, api.WareID{"tar", filteredHash}, nil
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
 }
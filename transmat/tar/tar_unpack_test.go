@@ -6,20 +6,29 @@ Sniperkit-Bot
 package tartrans
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/util"
 	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/cache"
 	"go.polydawn.net/rio/transmat/mixins/tests"
 )
 
@@ -90,6 +99,65 @@ func TestTarFixtureUnpack(t *testing.T) {
 					So(fmeta.Mtime.UTC(), ShouldResemble, time.Date(2015, 05, 30, 19, 53, 35, 0, time.UTC))
 					So(reader, ShouldBeNil)
 				})
+				Convey("Unpack the same fixture, as a .tar.xz from an http warehouse", func() {
+					defer os.Unsetenv("RIO_CACHE")
+					os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+					srv := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+					defer srv.Close()
+					wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{api.WarehouseAddr(srv.URL + "/tar_withBase.tar.xz")},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+
+					fmeta, _, err := fsOp.ScanFile(osfs.New(tmpDir), fs.MustRelPath("out/bc"))
+					So(err, ShouldBeNil)
+					So(fmeta.Type, ShouldResemble, fs.Type_Dir)
+					So(fmeta.Mtime.UTC(), ShouldResemble, time.Date(2015, 05, 30, 19, 53, 35, 0, time.UTC))
+				})
+				Convey("Unpack over an immutable file", testutil.Requires(testutil.RequiresCanSetImmutable, func() {
+					afs := osfs.New(tmpDir)
+					So(ioutil.WriteFile(tmpDir.Join(fs.MustRelPath("ab")).String(), []byte("kept"), 0644), ShouldBeNil)
+					So(fsOp.SetInodeFlags(afs, fs.MustRelPath("ab"), fsOp.InodeFlag_Immutable), ShouldBeNil)
+					defer fsOp.SetInodeFlags(afs, fs.MustRelPath("ab"), 0)
+					wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+					unpack := func() (api.WareID, error) {
+						return Unpack(
+							context.Background(),
+							wareID,
+							tmpDir.String(),
+							api.Filter_NoMutation,
+							rio.Placement_Direct,
+							[]api.WarehouseAddr{"file://./fixtures/tar_withBase.tgz"},
+							rio.Monitor{},
+						)
+					}
+
+					Convey("by default, it should be an error, saying so", func() {
+						_, err := unpack()
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrInoperablePath)
+						So(err.Error(), ShouldContainSubstring, fmt.Sprintf("target %q is immutable", tmpDir.Join(fs.MustRelPath("ab"))))
+					})
+					Convey("with the skip policy, it should be left in place", func() {
+						os.Setenv("RIO_IMMUTABLE_TARGETS", "skip")
+						defer os.Unsetenv("RIO_IMMUTABLE_TARGETS")
+						gotWareID, err := unpack()
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID)
+
+						body, err := ioutil.ReadFile(tmpDir.Join(fs.MustRelPath("ab")).String())
+						So(err, ShouldBeNil)
+						So(string(body), ShouldResemble, "kept")
+						So(testutil.ShouldStat(afs, fs.MustRelPath("bc")).Type, ShouldEqual, fs.Type_Dir)
+					})
+				}))
 				Convey("Unpack a fixture from gnu tar which lacks a base dir", func() {
 					wareID := api.WareID{"tar", "2RLHdc3am6tMCFy56vfcHm5kWLoAtYBfiaQcq17vDm1tEzQn9CC6tcF2yzpAJvehPC"}
 					gotWareID, err := Unpack(
@@ -125,3 +193,176 @@ func TestTarFixtureUnpack(t *testing.T) {
 		}),
 	)
 }
+
+func TestTarUnpackEscapes(t *testing.T) {
+	Convey("Tar transmat: unpacking hostile tars", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+				So(err, ShouldBeNil)
+				tarOf := func(hdrs ...*tar.Header) io.Reader {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					for _, hdr := range hdrs {
+						hdr.Mode, hdr.ModTime = 0755, time.Unix(1000, 0)
+						So(tw.WriteHeader(hdr), ShouldBeNil)
+						tw.Write(make([]byte, hdr.Size))
+					}
+					So(tw.Close(), ShouldBeNil)
+					return &buf
+				}
+				rootFs := osfs.New(tmpDir)
+				So(rootFs.Mkdir(fs.MustRelPath("root"), 0755), ShouldBeNil)
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("root")))
+				shouldBeNowhere := func(names ...string) {
+					for _, name := range names {
+						_, err := rootFs.LStat(fs.MustRelPath(name))
+						So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+					}
+				}
+
+				Convey("entries using '../' should be refused", func() {
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, tarOf(
+						&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Size: 4},
+					), rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+					shouldBeNowhere("escaped")
+				})
+				Convey("entries with absolute names should be refused", func() {
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, tarOf(
+						&tar.Header{Name: "/escaped", Typeflag: tar.TypeReg, Size: 4},
+					), rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+					shouldBeNowhere("escaped")
+				})
+				Convey("entries written through an earlier symlink should be refused", func() {
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, tarOf(
+						&tar.Header{Name: "lnk", Typeflag: tar.TypeSymlink, Linkname: "../"},
+						&tar.Header{Name: "lnk/escaped", Typeflag: tar.TypeReg, Size: 4},
+					), rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrInoperablePath)
+					shouldBeNowhere("escaped")
+				})
+				Convey("names that merely start with dots are fine", func() {
+					_, _, err := unpackTar(context.Background(), defaultHasher, afs, filt, tarOf(
+						&tar.Header{Name: "..dotty", Typeflag: tar.TypeReg, Size: 4},
+					), rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(testutil.ShouldStat(afs, fs.MustRelPath("..dotty")).Type, ShouldEqual, fs.Type_File)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarUnpackVerifies(t *testing.T) {
+	Convey("Tar transmat: unpack should verify content against the requested ware ID", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				defer os.Unsetenv("RIO_CACHE")
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				So(tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 11, ModTime: time.Unix(1000, 0)}), ShouldBeNil)
+				tw.Write([]byte("hello world"))
+				So(tw.Close(), ShouldBeNil)
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+				So(err, ShouldBeNil)
+				wareID, _, err := unpackTar(context.Background(), defaultHasher, nilFS.New(), filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpack := func(tarBytes []byte) (api.WareID, error) {
+					warePath := tmpDir.Join(fs.MustRelPath("ware.tar")).String()
+					So(ioutil.WriteFile(warePath, tarBytes, 0644), ShouldBeNil)
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Copy,
+						[]api.WarehouseAddr{api.WarehouseAddr("file://" + warePath)},
+						rio.Monitor{},
+					)
+				}
+
+				Convey("intact content should pass", func() {
+					gotWareID, err := unpack(buf.Bytes())
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+				})
+				Convey("one flipped byte should be caught, and not be cached", func() {
+					_, err := unpack(bytes.Replace(buf.Bytes(), []byte("hello world"), []byte("hellO world"), 1))
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					_, err = osfs.New(tmpDir.Join(fs.MustRelPath("cache"))).LStat(cache.ShelfFor(wareID))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				})
+				Convey("a filter value that means nothing should be refused, before anything's fetched", func() {
+					_, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.FilesetFilters{Mtime: "kepe"},
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{"file:///nonexistent"},
+						rio.Monitor{},
+					)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
+
+func TestTarUnpackFromStream(t *testing.T) {
+	Convey("Tar transmat: unpacking from a stream", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				defer os.Unsetenv("RIO_CACHE")
+				srcFs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				tests.PlaceFixture(srcFs, tests.FixtureGamma)
+				wareID, err := Pack(context.Background(), PackType, srcFs.BasePath().String(), api.Filter_NoMutation, api.WarehouseAddr(fmt.Sprintf("file://%s/gamma.tgz", tmpDir)), rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				// Feed the packer straight into a pipe; no warehouse.
+				filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposePack)
+				So(err, ShouldBeNil)
+				packToPipe := func(afs fs.FS) io.ReadCloser {
+					pr, pw := io.Pipe()
+					go func() {
+						compWriter, _ := Compress(pw, Gzip, 0)
+						tarWriter := tar.NewWriter(compWriter)
+						_, err := packTar(context.Background(), defaultHasher, afs, filt, PackOrder_Walk, false, tarWriter, compWriter, packHooks{}, rio.Monitor{})
+						tarWriter.Close()
+						compWriter.Close()
+						pw.CloseWithError(err)
+					}()
+					return pr
+				}
+
+				for _, placementMode := range []rio.PlacementMode{rio.Placement_Direct, rio.Placement_Copy} {
+					Convey(fmt.Sprintf("in %s mode, the result should be the ware", placementMode), func() {
+						stream := packToPipe(srcFs)
+						defer stream.Close()
+						outPath := tmpDir.Join(fs.MustRelPath("out"))
+						gotWareID, err := UnpackFromStream(context.Background(), wareID, stream, outPath.String(), api.Filter_NoMutation, placementMode, rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, wareID)
+						repackedWareID, err := Pack(context.Background(), PackType, outPath.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(repackedWareID, ShouldResemble, wareID)
+					})
+				}
+				Convey("a stream of some other ware should be a hash mismatch, and not be cached", func() {
+					otherFs := osfs.New(tmpDir.Join(fs.MustRelPath("other")))
+					tests.PlaceFixture(otherFs, tests.FixtureAlpha)
+					stream := packToPipe(otherFs)
+					defer stream.Close()
+					_, err := UnpackFromStream(context.Background(), wareID, stream, tmpDir.Join(fs.MustRelPath("out")).String(), api.Filter_NoMutation, rio.Placement_Copy, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+					_, err = osfs.New(tmpDir.Join(fs.MustRelPath("cache"))).LStat(cache.ShelfFor(wareID))
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,166 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	whutil "go.polydawn.net/rio/warehouse/util"
+)
+
+type CheckStatus string
+
+const (
+	Check_OK      CheckStatus = "ok"      // The content hashes to the WareID it's stored under.
+	Check_Corrupt CheckStatus = "corrupt" // The content doesn't parse, or hashes to something else.
+	Check_Missing CheckStatus = "missing" // An expected ware isn't in the warehouse at all.
+)
+
+/*
+	One line of output from VerifyWarehouse: what was found of one ware.
+	Detail says what was wrong, if anything.
+*/
+type WareCheck struct {
+	WareID api.WareID
+	Status CheckStatus
+	Detail string
+}
+
+/*
+	Check every ware in a CA-mode local warehouse ("ca+file") is what its
+	path says it is: each is read back from disk, and its WareID computed
+	anew, as a scan would; that's compared to the hash it's stored under.
+
+	The warehouse holds no record of packtypes, so everything in it is
+	checked as a tar.  Wares listed in `expect` are checked too, and any of
+	them the warehouse doesn't have are reported missing.  (Without an
+	`expect` list, nothing can be missing: a ware that isn't there isn't
+	listed.)
+
+	Each ware is streamed, not buffered, so they can be of any size.
+	The results are sorted by WareID, one per ware, and each is also logged
+	to the monitor as it's found; progress is counted in wares.
+	A corrupt or missing ware isn't an error -- that's what the results are
+	for.  Errors are for when the warehouse can't be checked at all.
+*/
+func VerifyWarehouse(
+	ctx context.Context, // Long-running call.  Cancellable.
+	addr api.WarehouseAddr, // The warehouse to check.  Must be "ca+file".
+	expect []api.WareID, // Optionally: wares which should be there.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ []WareCheck, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if u.Scheme != "ca+file" {
+		return nil, Errorf(rio.ErrUsage, "verify doesn't support %q scheme (only 'ca+file' warehouses can be listed)", u.Scheme)
+	}
+	for _, wareID := range expect {
+		if wareID.Type != PackType {
+			return nil, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+		}
+	}
+	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+
+	// Dial the warehouse, and list what's in it.
+	whCtrl, err := kvfs.NewController(addr)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := whCtrl.(warehouse.BlobstoreListController).ListHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[api.WareID]struct{}{}
+	var wareIDs []api.WareID
+	for _, hash := range hashes {
+		wareIDs = append(wareIDs, api.WareID{PackType, hash})
+		seen[api.WareID{PackType, hash}] = struct{}{}
+	}
+	for _, wareID := range expect {
+		if _, ok := seen[wareID]; !ok {
+			wareIDs = append(wareIDs, wareID)
+			seen[wareID] = struct{}{}
+		}
+	}
+	sort.Slice(wareIDs, func(i, j int) bool { return wareIDs[i].String() < wareIDs[j].String() })
+
+	// Check each in turn.
+	prog := progress.New(mon, "verify", int64(len(wareIDs)))
+	results := make([]WareCheck, 0, len(wareIDs))
+	for _, wareID := range wareIDs {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		check, err := verifyWare(ctx, whCtrl, wareID, filt)
+		if err != nil {
+			return nil, err
+		}
+		log.WareChecked(mon, addr, wareID, string(check.Status), check.Detail)
+		results = append(results, check)
+		chunkA, chunkB, _ := whutil.ChunkifyHash(wareID)
+		prog.Add(1, fs.MustRelPath(path.Join(chunkA, chunkB, wareID.Hash)))
+	}
+	prog.Done()
+	return results, nil
+}
+
+/*
+	Read one ware back and hash it.  Errors are only for failing to read;
+	failing to parse is just a corrupt ware.
+*/
+func verifyWare(ctx context.Context, whCtrl warehouse.BlobstoreController, wareID api.WareID, filt apiutil.FilesetFilters) (WareCheck, error) {
+	check := WareCheck{WareID: wareID}
+	hasher, err := lookupHasher(wareID)
+	if err != nil {
+		check.Status, check.Detail = Check_Corrupt, err.Error()
+		return check, nil
+	}
+	reader, err := whCtrl.OpenReader(ctx, wareID)
+	switch Category(err) {
+	case nil:
+		// pass
+	case rio.ErrWareNotFound:
+		check.Status, check.Detail = Check_Missing, err.Error()
+		return check, nil
+	default:
+		return check, err
+	}
+	defer reader.Close()
+	gotWareID, _, err := unpackTar(ctx, hasher, nilFS.New(), filt, reader, rio.Monitor{})
+	switch {
+	case Category(err) == rio.ErrCancelled:
+		return check, err
+	case err != nil:
+		check.Status, check.Detail = Check_Corrupt, err.Error()
+	case gotWareID != wareID:
+		check.Status, check.Detail = Check_Corrupt, fmt.Sprintf("content hashes to %q", gotWareID)
+	default:
+		check.Status = Check_OK
+	}
+	return check, nil
+}
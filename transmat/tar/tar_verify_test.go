@@ -0,0 +1,108 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	whutil "go.polydawn.net/rio/warehouse/util"
+)
+
+func TestTarVerify(t *testing.T) {
+	Convey("Tar transmat: verifying a warehouse", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.Mkdir(tmpDir.String()+"/wh", 0755), ShouldBeNil)
+				addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				pack := func(name, body string) api.WareID {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					So(ioutil.WriteFile(afs.BasePath().String()+"/file", []byte(body), 0644), ShouldBeNil)
+					// Uncompressed, so the body is there to be found on disk.
+					wareID, err := PackWith(PackOptions{Compression: Uncompressed})(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, addr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID
+				}
+				goodWareID := pack("good", "all is well")
+				badWareID := pack("bad", "soon to be flipped")
+				absentWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				Convey("with nothing wrong, every ware should be ok", func() {
+					checks, err := VerifyWarehouse(context.Background(), addr, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(checks, ShouldHaveLength, 2)
+					for _, check := range checks {
+						So(check.Status, ShouldEqual, Check_OK)
+					}
+				})
+				Convey("a flipped byte should be flagged on just that ware, and an absent expected one as missing", func() {
+					chunkA, chunkB, _ := whutil.ChunkifyHash(badWareID)
+					wherePath := fmt.Sprintf("%s/wh/%s/%s/%s", tmpDir, chunkA, chunkB, badWareID.Hash)
+					bs, err := ioutil.ReadFile(wherePath)
+					So(err, ShouldBeNil)
+					i := bytes.Index(bs, []byte("flipped"))
+					So(i, ShouldBeGreaterThan, 0)
+					bs[i] ^= 0x20
+					So(os.Chmod(wherePath, 0644), ShouldBeNil)
+					So(ioutil.WriteFile(wherePath, bs, 0644), ShouldBeNil)
+
+					evtChan := make(chan rio.Event)
+					var evts []rio.Event
+					done := make(chan struct{})
+					go func() {
+						for evt := range evtChan {
+							evts = append(evts, evt)
+						}
+						close(done)
+					}()
+					checks, err := VerifyWarehouse(context.Background(), addr, []api.WareID{goodWareID, absentWareID}, rio.Monitor{Chan: evtChan})
+					<-done
+					So(err, ShouldBeNil)
+					So(checks, ShouldHaveLength, 3)
+					statuses := map[api.WareID]CheckStatus{}
+					for _, check := range checks {
+						statuses[check.WareID] = check.Status
+					}
+					So(statuses, ShouldResemble, map[api.WareID]CheckStatus{
+						goodWareID:   Check_OK,
+						badWareID:    Check_Corrupt,
+						absentWareID: Check_Missing,
+					})
+
+					var warned []string
+					var lastProgress *rio.Event_Progress
+					for _, evt := range evts {
+						switch {
+						case evt.Log != nil && evt.Log.Level == rio.LogWarn:
+							warned = append(warned, evt.Log.Msg)
+						case evt.Progress != nil:
+							lastProgress = evt.Progress
+						}
+					}
+					So(warned, ShouldHaveLength, 2)
+					So(lastProgress, ShouldNotBeNil)
+					So(lastProgress.TotalProg, ShouldEqual, 3)
+				})
+				Convey("a warehouse that isn't content-addressable can't be verified", func() {
+					_, err := VerifyWarehouse(context.Background(), api.WarehouseAddr(fmt.Sprintf("file://%s/wh", tmpDir)), nil, rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
@@ -6,56 +6,123 @@ Sniperkit-Bot
 package tartrans
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net/url"
+	"strings"
+	"time"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/transmat/mixins/log"
 	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvazblob"
+	"go.polydawn.net/rio/warehouse/impl/kvdav"
 	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	"go.polydawn.net/rio/warehouse/impl/kvgs"
 	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+	"go.polydawn.net/rio/warehouse/impl/kvoci"
+	"go.polydawn.net/rio/warehouse/impl/kvs3"
+	"go.polydawn.net/rio/warehouse/impl/kvsftp"
 )
 
 // The shared bits of warehouseAddr parse and dial code.
 
+// How long to wait before the first retry of a fetch from a warehouse;
+// each retry after that waits twice as long as the last, up to fetchBackoffMax.
+var (
+	fetchBackoff    = 250 * time.Millisecond
+	fetchBackoffMax = 4 * time.Second
+)
+
+/*
+	The blobstore warehouses, by URL scheme.  Each also takes its scheme
+	with "ca+" in front, for a content-addressable warehouse of many wares
+	rather than a single one.  Http warehouses can only be read.
+*/
+var blobstoreSchemes = map[string]struct {
+	newController func(api.WarehouseAddr) (warehouse.BlobstoreController, error)
+	writable      bool
+}{
+	"file":   {kvfs.NewController, true},
+	"http":   {kvhttp.NewController, false},
+	"https":  {kvhttp.NewController, false},
+	"s3":     {kvs3.NewController, true},
+	"gs":     {kvgs.NewController, true},
+	"azblob": {kvazblob.NewController, true},
+	"ssh":    {kvsftp.NewController, true},
+	"oci":    {kvoci.NewController, true},
+	"dav":    {kvdav.NewController, true},
+	"davs":   {kvdav.NewController, true},
+}
+
 // Pick a warehouse.
 //  With K/V warehouses, this takes the form of "pick the first one that answers".
 func PickReader(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	requireMono bool,
+	mon rio.Monitor,
+) (io.ReadCloser, error) {
+	return pickReader(ctx, wareID, warehouses, requireMono, func(whCtrl warehouse.BlobstoreController, _ api.WarehouseAddr) (io.ReadCloser, error) {
+		return whCtrl.OpenReader(ctx, wareID)
+	}, mon)
+}
+
+/*
+	PickReader, but with the opening of each warehouse's reader up to `open`.
+
+	Warehouses are tried in order.  An error of category
+	`rio.ErrWareNotFound` from `open` moves on to the next at once; one of
+	category `rio.ErrWarehouseUnavailable` is taken to be transient, and
+	retried (config.GetFetchRetries times, with exponential backoff) before
+	moving on.  Other errors are returned as they are.
+
+	If no warehouse comes through, the error says what happened at each.
+	It's `rio.ErrWarehouseUnavailable` if any of them might yet have the ware
+	(since it couldn't be reached, or kept failing), and otherwise
+	`rio.ErrWareNotFound`.
+
+	Only opening is retried: once the reader is returned, a failure partway
+	through reading it is the caller's problem.  (The kvhttp readers resume
+	on their own; and a staged fetch is all read before `open` returns.)
+*/
+func pickReader(
+	ctx context.Context,
 	wareID api.WareID,
 	warehouses []api.WarehouseAddr,
 	requireMono bool,
+	open func(whCtrl warehouse.BlobstoreController, addr api.WarehouseAddr) (io.ReadCloser, error),
 	mon rio.Monitor,
 ) (_ io.ReadCloser, err error) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
+	fetchRetries, err := config.GetFetchRetries()
+	if err != nil {
+		return nil, err
+	}
+
 	var anyWarehouses bool // for clarity in final error messages
+	var anyUnavailable bool
+	var tried []string
 	for _, addr := range warehouses {
 		// REVIEW ... Do I really have to parse this again?  is this sanely encapsulated?
 		u, err := url.Parse(string(addr))
 		if err != nil {
 			return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
 		}
-		var whCtrl warehouse.BlobstoreController
-		switch u.Scheme {
-		case "ca+file":
-			if requireMono {
-				return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (a single-ware warehouse is required, not CA-mode)", u.Scheme)
-			}
-			fallthrough
-		case "file":
-			whCtrl, err = kvfs.NewController(addr)
-		case "ca+http", "ca+https":
-			if requireMono {
-				return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (a single-ware warehouse is required, not CA-mode)", u.Scheme)
-			}
-			fallthrough
-		case "http", "https":
-			whCtrl, err = kvhttp.NewController(addr)
-		default:
-			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', or 'ca+https')", u.Scheme)
+		scheme, ok := blobstoreSchemes[strings.TrimPrefix(u.Scheme, "ca+")]
+		if !ok {
+			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', 'ca+https', 's3', 'ca+s3', 'gs', 'ca+gs', 'azblob', 'ca+azblob', 'ssh', 'ca+ssh', 'oci', 'ca+oci', 'dav', 'ca+dav', 'davs', or 'ca+davs')", u.Scheme)
+		}
+		if requireMono && strings.HasPrefix(u.Scheme, "ca+") {
+			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (a single-ware warehouse is required, not CA-mode)", u.Scheme)
 		}
+		whCtrl, err := scheme.newController(addr)
 		switch Category(err) {
 		case nil:
 			anyWarehouses = true
@@ -65,26 +132,98 @@ func PickReader(
 				return nil, err
 			}
 			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			tried = append(tried, fmt.Sprintf("%s: %s", addr, err))
 			continue // okay!  skip to the next one.
 		default:
 			return nil, err
 		}
-		reader, err := whCtrl.OpenReader(wareID)
+		wait := fetchBackoff
+		for retries := fetchRetries; ; retries-- {
+			reader, err := open(whCtrl, addr)
+			switch Category(err) {
+			case nil:
+				log.WareReaderOpened(mon, addr, wareID)
+				return reader, nil // happy path return!
+			case rio.ErrWareNotFound:
+				log.WareNotFound(mon, err, addr, wareID)
+			case rio.ErrWarehouseUnavailable:
+				if retries > 0 {
+					log.WareFetchRetrying(mon, err, addr, wareID, wait)
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return nil, Errorf(rio.ErrCancelled, "cancelled")
+					}
+					if wait *= 2; wait > fetchBackoffMax {
+						wait = fetchBackoffMax
+					}
+					continue // try this one again.
+				}
+				log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+				anyUnavailable = true
+			default:
+				return nil, err
+			}
+			tried = append(tried, fmt.Sprintf("%s: %s", addr, err))
+			break // okay!  skip to the next one.
+		}
+	}
+	var summary string
+	if len(tried) > 0 {
+		summary = " (" + strings.Join(tried, "; ") + ")"
+	}
+	switch {
+	case !anyWarehouses:
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "no warehouses were available!%s", summary)
+	case anyUnavailable:
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "ware %q could not be fetched from any of the warehouses!%s", wareID, summary)
+	default:
+		return nil, Errorf(rio.ErrWareNotFound, "none of the available warehouses have ware %q!%s", wareID, summary)
+	}
+}
+
+/*
+	Look up how big the ware is in the first of the warehouses that has it,
+	for checking there's room before unpacking into the cache.
+	That's the size as stored, so often compressed: a lower bound on the
+	space unpacking will take, rather than an estimate of it.
+
+	This is best-effort, and only asks local warehouses: asking remote ones
+	would cost a round trip each.  If a warehouse that can't say comes
+	before any that can, the size isn't known (that's the one a fetch
+	would likely use), and `known` is false.
+*/
+func wareSize(ctx context.Context, wareID api.WareID, warehouses []api.WarehouseAddr) (size int64, known bool) {
+	for _, addr := range warehouses {
+		u, err := url.Parse(string(addr))
+		if err != nil {
+			return 0, false
+		}
+		switch u.Scheme {
+		case "file", "ca+file":
+			// pass
+		default:
+			return 0, false
+		}
+		whCtrl, err := kvfs.NewController(addr)
+		if err != nil {
+			continue // an unavailable warehouse won't be fetched from, either.
+		}
+		sized, ok := whCtrl.(warehouse.BlobstoreSizeController)
+		if !ok {
+			return 0, false
+		}
+		size, err := sized.WareSize(ctx, wareID)
 		switch Category(err) {
 		case nil:
-			log.WareReaderOpened(mon, addr, wareID)
-			return reader, nil // happy path return!
+			return size, true
 		case rio.ErrWareNotFound:
-			log.WareNotFound(mon, err, addr, wareID)
-			continue // okay!  skip to the next one.
+			continue
 		default:
-			return nil, err
+			return 0, false
 		}
 	}
-	if !anyWarehouses {
-		return nil, Errorf(rio.ErrWarehouseUnavailable, "no warehouses were available!")
-	}
-	return nil, Errorf(rio.ErrWareNotFound, "none of the available warehouses have ware %q!", wareID)
+	return 0, false
 }
 
 func OpenWriteController(
@@ -103,31 +242,31 @@ func OpenWriteController(
 	if err != nil {
 		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
 	}
-	switch u.Scheme {
-	case "":
+	if u.Scheme == "" {
 		return nil, Errorf(rio.ErrUsage, "urls must always have a scheme (e.g. start with 'file://', 'ca+file://', or similar)")
-	case "file", "ca+file":
-		whCtrl, err := kvfs.NewController(warehouseAddr)
-		switch Category(err) {
-		case nil:
-			// pass
-		case rio.ErrWarehouseUnavailable:
-			log.WarehouseUnavailable(mon, err, warehouseAddr, api.WareID{packType, "?"}, "write")
-			return nil, err
-		default:
-			return nil, err
-		}
-		wc, err = whCtrl.OpenWriter()
-		switch Category(err) {
-		case nil:
-			return wc, nil // Yayy!
-		case rio.ErrWarehouseUnwritable:
-			log.WarehouseUnavailable(mon, err, warehouseAddr, api.WareID{packType, "?"}, "write")
-			return nil, err
-		default:
-			return nil, err
-		}
+	}
+	scheme, ok := blobstoreSchemes[strings.TrimPrefix(u.Scheme, "ca+")]
+	if !ok || !scheme.writable {
+		return nil, Errorf(rio.ErrUsage, "this save operation doesn't support %q scheme (valid options are 'file', 'ca+file', 's3', 'ca+s3', 'gs', 'ca+gs', 'azblob', 'ca+azblob', 'ssh', 'ca+ssh', 'oci', 'ca+oci', 'dav', 'ca+dav', 'davs', or 'ca+davs')", u.Scheme)
+	}
+	whCtrl, err := scheme.newController(warehouseAddr)
+	switch Category(err) {
+	case nil:
+		// pass
+	case rio.ErrWarehouseUnavailable:
+		log.WarehouseUnavailable(mon, err, warehouseAddr, api.WareID{packType, "?"}, "write")
+		return nil, err
+	default:
+		return nil, err
+	}
+	wc, err = whCtrl.OpenWriter()
+	switch Category(err) {
+	case nil:
+		return wc, nil // Yayy!
+	case rio.ErrWarehouseUnwritable:
+		log.WarehouseUnavailable(mon, err, warehouseAddr, api.WareID{packType, "?"}, "write")
+		return nil, err
 	default:
-		return nil, Errorf(rio.ErrUsage, "this save operation doesn't support %q scheme (valid options are 'file' or 'ca+file')", u.Scheme)
+		return nil, err
 	}
 }
@@ -0,0 +1,140 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func withFetchRetries(n int, fn func()) {
+	defer os.Setenv("RIO_FETCH_RETRIES", os.Getenv("RIO_FETCH_RETRIES"))
+	os.Setenv("RIO_FETCH_RETRIES", strconv.Itoa(n))
+	defer func(wait time.Duration) { fetchBackoff = wait }(fetchBackoff)
+	fetchBackoff = time.Millisecond
+	fn()
+}
+
+// Answers every request with the same status, and counts them.
+type statusWarehouse struct {
+	mu       sync.Mutex
+	status   int
+	requests int
+}
+
+func (s *statusWarehouse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	w.WriteHeader(s.status)
+}
+
+func TestTarWarehouseFailover(t *testing.T) {
+	Convey("Tar transmat: unpacking from several warehouses", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				So(ioutil.WriteFile(afs.BasePath().String()+"/file", []byte("from the second"), 0644), ShouldBeNil)
+				goodAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.tgz", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, afs.BasePath().String(), api.Filter_NoMutation, goodAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				bad := &statusWarehouse{status: 503}
+				srv := httptest.NewServer(bad)
+				defer srv.Close()
+				badAddr := api.WarehouseAddr(srv.URL + "/ware.tgz")
+
+				unpack := func(warehouses ...api.WarehouseAddr) ([]rio.Event, error) {
+					evtChan := make(chan rio.Event)
+					var evts []rio.Event
+					done := make(chan struct{})
+					go func() {
+						for evt := range evtChan {
+							evts = append(evts, evt)
+						}
+						close(done)
+					}()
+					_, err := Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						warehouses,
+						rio.Monitor{Chan: evtChan},
+					)
+					<-done
+					return evts, err
+				}
+				retryLogs := func(evts []rio.Event) (n int) {
+					for _, evt := range evts {
+						if evt.Log != nil && strings.Contains(evt.Log.Msg, "retrying in") {
+							n++
+						}
+					}
+					return n
+				}
+
+				Convey("a failing first warehouse should be retried, and then the second one fetched from", func() {
+					withFetchRetries(2, func() {
+						evts, err := unpack(badAddr, goodAddr)
+						So(err, ShouldBeNil)
+						So(bad.requests, ShouldEqual, 3)
+						So(retryLogs(evts), ShouldEqual, 2)
+					})
+					got, err := ioutil.ReadFile(tmpDir.Join(fs.MustRelPath("out/file")).String())
+					So(err, ShouldBeNil)
+					So(string(got), ShouldEqual, "from the second")
+				})
+				Convey("a warehouse without the ware should be failed over at once", func() {
+					bad.status = 404
+					withFetchRetries(2, func() {
+						evts, err := unpack(badAddr, goodAddr)
+						So(err, ShouldBeNil)
+						So(bad.requests, ShouldEqual, 1)
+						So(retryLogs(evts), ShouldEqual, 0)
+					})
+				})
+				Convey("if every warehouse fails, the error should say what happened at each", func() {
+					missingAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/nope.tgz", tmpDir))
+					withFetchRetries(1, func() {
+						_, err := unpack(badAddr, missingAddr)
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+						So(err.Error(), ShouldContainSubstring, string(badAddr)+": ")
+						So(err.Error(), ShouldContainSubstring, "503")
+						So(err.Error(), ShouldContainSubstring, string(missingAddr)+": ")
+						So(err.Error(), ShouldContainSubstring, "not found")
+					})
+					Convey("and if each just didn't have it, it's not found, rather than unavailable", func() {
+						bad.status = 404
+						_, err := unpack(badAddr, missingAddr)
+						So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+					})
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,72 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Whiteouts are written the way OCI image layers (and AUFS before them)
+	write them: an empty regular file, named for the path it deletes with
+	".wh." put in front of the last segment.
+
+	That's layer semantics, and only the transmats for layer formats
+	(ocilayer, dockersave) read entries that way, by way of
+	LayerTarHdrToMetadata.  To the plain tar transmat, a ".wh." entry is
+	just the file it is, and packs and hashes the same as ever.
+
+	Names starting ".wh..wh." are AUFS's own bookkeeping, and OCI's
+	"opaque dir" marker.  Layer transmats that handle opaque dirs have to
+	take those before they get here; otherwise they're refused rather than
+	quietly leaving out whatever deletions they meant.
+*/
+const whiteoutPrefix = ".wh."
+
+func whiteoutEntryName(name fs.RelPath) fs.RelPath {
+	return name.Dir().Join(fs.MustRelPath(whiteoutPrefix + name.Last()))
+}
+
+/*
+	Like TarHdrToMetadata, but for a tar that's a layer: whiteout entries
+	come out as Type_Whiteout, named for what they delete.
+	Entries that are named like whiteouts but aren't empty files are corrupt.
+*/
+func LayerTarHdrToMetadata(hdr *tar.Header, fmeta *fs.Metadata) error {
+	if err := TarHdrToMetadata(hdr, fmeta); err != nil {
+		return err
+	}
+	if deletes, ok, err := parseWhiteout(hdr, fmeta.Name); err != nil {
+		return err
+	} else if ok {
+		fmeta.Name, fmeta.Type = deletes, fs.Type_Whiteout
+	}
+	return nil
+}
+
+/*
+	If the entry is a whiteout, returns the path it deletes.
+*/
+func parseWhiteout(hdr *tar.Header, name fs.RelPath) (_ fs.RelPath, ok bool, err error) {
+	if !strings.HasPrefix(name.Last(), whiteoutPrefix) {
+		return fs.RelPath{}, false, nil
+	}
+	target := strings.TrimPrefix(name.Last(), whiteoutPrefix)
+	switch {
+	case strings.HasPrefix(target, whiteoutPrefix):
+		return fs.RelPath{}, false, Errorf(rio.ErrWareCorrupt, "corrupt layer: %q is an aufs or opaque dir whiteout, which are not supported", hdr.Name)
+	case target == "", target == ".", target == "..":
+		return fs.RelPath{}, false, Errorf(rio.ErrWareCorrupt, "corrupt layer: %q is a whiteout of nothing", hdr.Name)
+	case hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA, hdr.Size != 0:
+		return fs.RelPath{}, false, Errorf(rio.ErrWareCorrupt, "corrupt layer: %q is named as a whiteout, but is not an empty file", hdr.Name)
+	}
+	return name.Dir().Join(fs.MustRelPath(target)), true, nil
+}
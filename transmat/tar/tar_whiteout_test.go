@@ -0,0 +1,135 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarWhiteout(t *testing.T) {
+	Convey("Tar transmat: whiteouts are for layers, not plain tars", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				packTo := func(afs fs.FS, name string) (api.WareID, api.WarehouseAddr) {
+					addr := api.WarehouseAddr(fmt.Sprintf("file://%s/%s.tar", tmpDir, name))
+					wareID, err := PackWith(PackOptions{Compression: Uncompressed})(
+						context.Background(),
+						PackType,
+						afs.BasePath().String(),
+						api.Filter_NoMutation,
+						addr,
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					return wareID, addr
+				}
+				secondHeader := func(name string) *tar.Header {
+					f, err := os.Open(fmt.Sprintf("%s/%s.tar", tmpDir, name))
+					So(err, ShouldBeNil)
+					defer f.Close()
+					tr := tar.NewReader(f)
+					_, err = tr.Next()
+					So(err, ShouldBeNil)
+					hdr, err := tr.Next()
+					So(err, ShouldBeNil)
+					return hdr
+				}
+
+				Convey("a 0/0 char device should pack as the device it is", func() {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("upper")))
+					tests.PlaceWhiteoutFixture(afs, tests.FixtureWhiteout)
+					packTo(afs, "upper")
+					hdr := secondHeader("upper")
+					So(hdr.Name, ShouldEqual, "./a")
+					So(hdr.Typeflag, ShouldEqual, tar.TypeChar)
+				})
+				Convey("a '.wh.' file should pack, and unpack, as the file it is", func() {
+					afs := osfs.New(tmpDir.Join(fs.MustRelPath("src")))
+					tests.PlaceFixture(afs, tests.FixtureEmpty)
+					So(ioutil.WriteFile(afs.BasePath().String()+"/.wh.a", []byte("body"), 0644), ShouldBeNil)
+					wareID, addr := packTo(afs, "src")
+					So(secondHeader("src").Name, ShouldEqual, "./.wh.a")
+
+					dest := osfs.New(tmpDir.Join(fs.MustRelPath("dest")))
+					gotWareID, err := Unpack(
+						context.Background(),
+						wareID,
+						dest.BasePath().String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(dest.BasePath().String() + "/.wh.a")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "body")
+				})
+			})
+		}),
+	)
+}
+
+func TestLayerTarHdrToMetadata(t *testing.T) {
+	Convey("Reading a layer's tar headers: names that look like whiteouts", t, func() {
+		read := func(hdr *tar.Header) (fs.Metadata, error) {
+			hdr.Mode, hdr.ModTime = 0644, time.Unix(1000, 0)
+			var fmeta fs.Metadata
+			err := LayerTarHdrToMetadata(hdr, &fmeta)
+			return fmeta, err
+		}
+		Convey("an empty '.wh.' file should read as a whiteout of the name it covers", func() {
+			fmeta, err := read(&tar.Header{Name: "./d/.wh.a", Typeflag: tar.TypeReg})
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_Whiteout)
+			So(fmeta.Name, ShouldResemble, fs.MustRelPath("d/a"))
+		})
+		Convey("other names should read just as TarHdrToMetadata reads them", func() {
+			fmeta, err := read(&tar.Header{Name: "./d/a", Typeflag: tar.TypeReg, Size: 4})
+			So(err, ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_File)
+			So(fmeta.Name, ShouldResemble, fs.MustRelPath("d/a"))
+		})
+		Convey("aufs and opaque dir whiteouts should be refused", func() {
+			_, err := read(&tar.Header{Name: "./.wh..wh..opq", Typeflag: tar.TypeReg})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+		})
+		Convey("whiteouts of nothing should be refused", func() {
+			_, err := read(&tar.Header{Name: "./.wh.", Typeflag: tar.TypeReg})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+			_, err = read(&tar.Header{Name: "./.wh..", Typeflag: tar.TypeReg})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+		})
+		Convey("'.wh.' entries that aren't empty files should be refused", func() {
+			_, err := read(&tar.Header{Name: "./.wh.a", Typeflag: tar.TypeReg, Size: 4})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+			_, err = read(&tar.Header{Name: "./.wh.d/", Typeflag: tar.TypeDir})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+		})
+		Convey("to the plain reader, they're all just files", func() {
+			var fmeta fs.Metadata
+			So(TarHdrToMetadata(&tar.Header{Name: "./.wh.a", Typeflag: tar.TypeReg}, &fmeta), ShouldBeNil)
+			So(fmeta.Type, ShouldEqual, fs.Type_File)
+			So(fmeta.Name, ShouldResemble, fs.MustRelPath(".wh.a"))
+		})
+	})
+}
@@ -0,0 +1,109 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarXattrFilter(t *testing.T) {
+	Convey("Tar transmat: xattr filters from config", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_FILTER_XATTRS")
+				packFixture := func(name string, files []tests.FixtureFile) api.WareID {
+					srcFs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+					So(srcFs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+					tests.PlaceFixture(srcFs, files)
+					wareID, err := Pack(context.Background(), PackType, srcFs.BasePath().String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					return wareID
+				}
+
+				Convey("packing should leave xattrs out unless config keeps them", func() {
+					wareIDAlpha := packFixture("alpha", tests.FixtureAlpha)
+					So(packFixture("xattr", tests.FixtureAlphaDiffXattr), ShouldResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_XATTRS", "all")
+					So(packFixture("xattr-all", tests.FixtureAlphaDiffXattr), ShouldNotResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_XATTRS", "none")
+					So(packFixture("xattr-none", tests.FixtureAlphaDiffXattr), ShouldResemble, wareIDAlpha)
+					os.Setenv("RIO_FILTER_XATTRS", "security.capability")
+					So(packFixture("xattr-caps", tests.FixtureAlphaDiffXattr), ShouldResemble, wareIDAlpha)
+					// A namespace keeps everything in it.
+					os.Setenv("RIO_FILTER_XATTRS", "security.capability,user.")
+					So(packFixture("xattr-user", tests.FixtureAlphaDiffXattr), ShouldNotResemble, wareIDAlpha)
+					// A whole key doesn't keep others that start the same.
+					os.Setenv("RIO_FILTER_XATTRS", "user.rio")
+					So(packFixture("xattr-prefix", tests.FixtureAlphaDiffXattr), ShouldResemble, wareIDAlpha)
+				})
+				Convey("unpacking should place xattrs only if config keeps them", func() {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					So(tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0755, Size: 1, ModTime: time.Unix(1000, 0),
+						PAXRecords: map[string]string{"SCHILY.xattr.user.rio-fixture": "val"}}), ShouldBeNil)
+					tw.Write([]byte("x"))
+					So(tw.Close(), ShouldBeNil)
+					filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+					So(err, ShouldBeNil)
+					unpack := func(name string) (fs.FS, api.WareID, api.WareID) {
+						afs := osfs.New(tmpDir.Join(fs.MustRelPath(name)))
+						So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+						prefilterWareID, filteredWareID, err := unpackTar(context.Background(), defaultHasher, afs, filt, bytes.NewReader(buf.Bytes()), rio.Monitor{})
+						So(err, ShouldBeNil)
+						return afs, prefilterWareID, filteredWareID
+					}
+
+					Convey("by default, the ware's xattrs are hashed, but not placed", func() {
+						afs, prefilterWareID, filteredWareID := unpack("unpack")
+						So(filteredWareID, ShouldResemble, prefilterWareID)
+						xattrs, err := afs.LGetXattr(fs.MustRelPath("a"))
+						if err == nil {
+							So(xattrs, ShouldBeEmpty)
+						}
+					})
+					Convey("with \"none\", they're dropped before hashing, too", func() {
+						os.Setenv("RIO_FILTER_XATTRS", "none")
+						afs, prefilterWareID, filteredWareID := unpack("unpack-none")
+						So(filteredWareID, ShouldNotResemble, prefilterWareID)
+						xattrs, err := afs.LGetXattr(fs.MustRelPath("a"))
+						if err == nil {
+							So(xattrs, ShouldBeEmpty)
+						}
+					})
+					Convey("with \"all\", they're placed (where the filesystem takes them)", func() {
+						os.Setenv("RIO_FILTER_XATTRS", "all")
+						afs, prefilterWareID, filteredWareID := unpack("unpack-all")
+						So(filteredWareID, ShouldResemble, prefilterWareID)
+						xattrs, err := afs.LGetXattr(fs.MustRelPath("a"))
+						if err == nil {
+							So(string(xattrs["user.rio-fixture"]), ShouldEqual, "val")
+						}
+					})
+				})
+				Convey("malformed filters should be rejected", func() {
+					os.Setenv("RIO_FILTER_XATTRS", "user.,,trusted.")
+					_, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
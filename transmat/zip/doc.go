@@ -0,0 +1,38 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The zip transmat packs filesystems into the "zip" format, and can use
+	any k/v-styled warehouse for storage (just like the tar transmat).
+
+	The WareID is computed over the fileset, exactly as the tar transmat
+	computes it: so a fileset packed as zip has the same hash as when it's
+	packed as tar (only the packtype differs), and unpacking checks it the
+	same way.  As with tar, mtimes are kept to the second.
+
+	Zip doesn't have a place for everything a fileset can hold, so some of
+	it rides in extra fields: uid and gid go in the Info-ZIP unix field
+	(0x7875), which other unzip tools read too; device numbers and xattrs
+	go in a field of our own (see extraRio), which other tools will ignore.
+	Hardlinks aren't kept: each name is packed as a file of its own.
+	(That doesn't change the WareID, which sees each name as the file it is.)
+
+	Files of 4GB and more, and zips of more than 65535 entries, or of 4GB
+	and more, are written as zip64 (which is how zip holds sizes and counts
+	that big), and read back the same; that's only where it's needed, so
+	smaller zips are plain zip, as any unzip tool reads.
+	Sizes are written after each body (in a "data descriptor"), since the
+	body is streamed in as it's read from the filesystem.
+
+	Zip is read from the end, so unpacking fetches the whole ware into the
+	cache dir before reading any of it.
+*/
+package ziptrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("zip")
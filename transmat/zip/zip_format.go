@@ -0,0 +1,255 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+const (
+	// The Info-ZIP "new unix" extra field: uid and gid, of any width.
+	extraUnix uint16 = 0x7875
+
+	// Our own extra field, for whatever else the bucket hashes that zip
+	//  has no place for.  It's a run of records, each a tag byte and then:
+	//   - 'd': devmajor, devminor (int64 each);
+	//   - 'x': an xattr: key and value, each a uint16 length and the bytes.
+	//  Everything is little-endian, as in the rest of zip.
+	extraRio uint16 = 0x7269
+
+	// The most the zip writer adds to each header's extra fields: the
+	//  extended timestamp (mtime only), and the zip64 field (both sizes, and
+	//  the offset), each with its own id and length.
+	extraTimeLen  = 4 + 5
+	extraZip64Len = 4 + 24
+)
+
+// Mutate zip.FileHeader fields to match the given fmeta.
+// Leaves Method alone; the caller picks that.
+// Returns ErrPackInvalid for things zip can't hold (sockets; too many xattrs).
+func MetadataToZipHdr(fmeta *fs.Metadata, hdr *zip.FileHeader) error {
+	hdr.Name = fmeta.Name.String()
+	if fmeta.Type == fs.Type_Dir {
+		hdr.Name += "/"
+	}
+	mode, err := fsTypeToFileMode(fmeta.Type)
+	if err != nil {
+		return err
+	}
+	mode |= os.FileMode(fmeta.Perms & 0777)
+	if fmeta.Perms&fs.Perms_Setuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fmeta.Perms&fs.Perms_Setgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fmeta.Perms&fs.Perms_Sticky != 0 {
+		mode |= os.ModeSticky
+	}
+	hdr.SetMode(mode)
+	hdr.Modified = fmeta.Mtime
+
+	// Uid and gid always; the rest only if there's any.
+	var extra bytes.Buffer
+	unix := make([]byte, 11)
+	unix[0], unix[1], unix[6] = 1, 4, 4
+	binary.LittleEndian.PutUint32(unix[2:6], fmeta.Uid)
+	binary.LittleEndian.PutUint32(unix[7:11], fmeta.Gid)
+	writeExtra(&extra, extraUnix, unix)
+	var own bytes.Buffer
+	if fmeta.Type == fs.Type_Device || fmeta.Type == fs.Type_CharDevice {
+		own.WriteByte('d')
+		binary.Write(&own, binary.LittleEndian, fmeta.Devmajor)
+		binary.Write(&own, binary.LittleEndian, fmeta.Devminor)
+	}
+	keys := make([]string, 0, len(fmeta.Xattrs))
+	for k := range fmeta.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fmeta.Xattrs[k]
+		if len(k) > 0xffff || len(v) > 0xffff {
+			return Errorf(rio.ErrPackInvalid, "xattr %q on %q is too big to pack into zip", k, fmeta.Name)
+		}
+		own.WriteByte('x')
+		binary.Write(&own, binary.LittleEndian, uint16(len(k)))
+		own.WriteString(k)
+		binary.Write(&own, binary.LittleEndian, uint16(len(v)))
+		own.WriteString(v)
+	}
+	if own.Len() > 0 {
+		// Leave room for the fields the zip writer will add: the extended timestamp,
+		//  and, for files of 4GB or more, the zip64 sizes and offset.
+		if extra.Len()+4+own.Len() > 0xffff-extraTimeLen-extraZip64Len {
+			return Errorf(rio.ErrPackInvalid, "xattrs on %q are too big to pack into zip", fmeta.Name)
+		}
+		writeExtra(&extra, extraRio, own.Bytes())
+	}
+	hdr.Extra = extra.Bytes()
+	return nil
+}
+
+func writeExtra(buf *bytes.Buffer, id uint16, body []byte) {
+	binary.Write(buf, binary.LittleEndian, id)
+	binary.Write(buf, binary.LittleEndian, uint16(len(body)))
+	buf.Write(body)
+}
+
+func fsTypeToFileMode(fsType fs.Type) (os.FileMode, error) {
+	switch fsType {
+	case fs.Type_File:
+		return 0, nil
+	case fs.Type_Dir:
+		return os.ModeDir, nil
+	case fs.Type_Symlink:
+		return os.ModeSymlink, nil
+	case fs.Type_NamedPipe:
+		return os.ModeNamedPipe, nil
+	case fs.Type_CharDevice:
+		return os.ModeDevice | os.ModeCharDevice, nil
+	case fs.Type_Device:
+		return os.ModeDevice, nil
+	case fs.Type_Socket:
+		return 0, Errorf(rio.ErrPackInvalid, "can't pack sockets into zip")
+	default:
+		return 0, Errorf(rio.ErrPackInvalid, "can't pack a %s into zip", fsType)
+	}
+}
+
+// Mutate fs.Metadata fields to match the given zip header.
+// Absolute names are rejected as corrupt.  Does not check for names that go
+// above '.'; caller may want to do that (see fs.RelPath.GoesUp).
+// The link target of a symlink is the entry's body: the caller fills that in.
+func ZipHdrToMetadata(hdr *zip.FileHeader, fmeta *fs.Metadata) error {
+	mode := hdr.Mode()
+	name := hdr.Name
+	if mode.IsDir() || strings.HasSuffix(name, "/") {
+		mode |= os.ModeDir
+		name = strings.TrimSuffix(name, "/")
+		if name == "" {
+			name = "."
+		}
+	}
+	path, err := fs.ParseRelPath(name)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt zip: %q is not a relative path", hdr.Name)
+	}
+	fmeta.Name = path
+	switch {
+	case mode&os.ModeDir != 0:
+		fmeta.Type = fs.Type_Dir
+	case mode&os.ModeSymlink != 0:
+		fmeta.Type = fs.Type_Symlink
+	case mode&os.ModeNamedPipe != 0:
+		fmeta.Type = fs.Type_NamedPipe
+	case mode&os.ModeCharDevice != 0:
+		fmeta.Type = fs.Type_CharDevice
+	case mode&os.ModeDevice != 0:
+		fmeta.Type = fs.Type_Device
+	case mode&os.ModeType == 0:
+		fmeta.Type = fs.Type_File
+		fmeta.Size = int64(hdr.UncompressedSize64)
+	default:
+		return Errorf(rio.ErrWareCorrupt, "corrupt zip: %q is not a kind of file we can unpack", hdr.Name)
+	}
+	fmeta.Perms = fs.Perms(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		fmeta.Perms |= fs.Perms_Setuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		fmeta.Perms |= fs.Perms_Setgid
+	}
+	if mode&os.ModeSticky != 0 {
+		fmeta.Perms |= fs.Perms_Sticky
+	}
+	// Zip tools that aren't ours may well leave these off; zero is all we can say then.
+	if !hdr.Modified.IsZero() {
+		fmeta.Mtime = hdr.Modified.UTC()
+	}
+	return parseExtras(hdr, fmeta)
+}
+
+func parseExtras(hdr *zip.FileHeader, fmeta *fs.Metadata) error {
+	corrupt := func(what string) error {
+		return Errorf(rio.ErrWareCorrupt, "corrupt zip: %s in extra fields of %q", what, hdr.Name)
+	}
+	extra := hdr.Extra
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			return corrupt("truncated field")
+		}
+		body := extra[4 : 4+size]
+		extra = extra[4+size:]
+		switch id {
+		case extraUnix:
+			// Version, then a length-prefixed uid, then a length-prefixed gid.
+			if len(body) < 2 || body[0] != 1 {
+				return corrupt("unknown unix field version")
+			}
+			ids := [2]uint32{}
+			body = body[1:]
+			for i := range ids {
+				if len(body) < 1 || len(body) < 1+int(body[0]) {
+					return corrupt("truncated unix field")
+				}
+				n := int(body[0])
+				if n > 4 {
+					return corrupt("ids wider than 32 bits")
+				}
+				var buf [4]byte
+				copy(buf[:], body[1:1+n])
+				ids[i] = binary.LittleEndian.Uint32(buf[:])
+				body = body[1+n:]
+			}
+			fmeta.Uid, fmeta.Gid = ids[0], ids[1]
+		case extraRio:
+			for len(body) > 0 {
+				switch body[0] {
+				case 'd':
+					if len(body) < 17 {
+						return corrupt("truncated device numbers")
+					}
+					fmeta.Devmajor = int64(binary.LittleEndian.Uint64(body[1:9]))
+					fmeta.Devminor = int64(binary.LittleEndian.Uint64(body[9:17]))
+					body = body[17:]
+				case 'x':
+					body = body[1:]
+					var kv [2]string
+					for i := range kv {
+						if len(body) < 2 {
+							return corrupt("truncated xattr")
+						}
+						n := int(binary.LittleEndian.Uint16(body[0:2]))
+						if len(body) < 2+n {
+							return corrupt("truncated xattr")
+						}
+						kv[i] = string(body[2 : 2+n])
+						body = body[2+n:]
+					}
+					if fmeta.Xattrs == nil {
+						fmeta.Xattrs = map[string]string{}
+					}
+					fmeta.Xattrs[kv[0]] = kv[1]
+				default:
+					return corrupt("unknown record")
+				}
+			}
+		}
+	}
+	return nil
+}
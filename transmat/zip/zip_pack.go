@@ -0,0 +1,188 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var (
+	_ rio.PackFunc = Pack
+)
+
+func Pack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	packType api.PackType, // The name of pack format.
+	pathStr string, // The fileset to scan and pack (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while packing.  Empty fields get api.Filter_DefaultFlatten's.
+	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if packType != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, packType)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "pack must be called with absolute path: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Short-circuit exit if the path does not exist.
+	afs := osfs.New(path)
+	_, err = afs.Stat(fs.RelPath{})
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return api.WareID{PackType, ""}, nil
+	default:
+		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
+	}
+
+	// Connect to warehouse, and get write controller opened.
+	//  The warehouses don't care what's in a ware; the tar transmat's dialing serves for us too.
+	wc, err := tartrans.OpenWriteController(warehouseAddr, packType, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer wc.Close()
+
+	// Scan and zip!
+	zipWriter := zip.NewWriter(wc)
+	wareID, err := packZip(ctx, afs, filt2, zipWriter, mon)
+	if err != nil {
+		return wareID, err
+	}
+	// Close the zip writer, which is when the central directory is written.
+	if err := zipWriter.Close(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+	}
+
+	// If we made it all the way with no errors, commit.
+	//  (Otherwise, the write controller will be closed by default by our defers.)
+	return wareID, wc.Commit(wareID)
+}
+
+func packZip(
+	ctx context.Context,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	zw *zip.Writer,
+	mon rio.Monitor,
+) (api.WareID, error) {
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	bucket := &fshash.MemoryBucket{}
+	hasher := wareid.Default(PackType)
+
+	host, err := filters.HostFiltersFromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	scanFile := fsOp.ScanFile
+	if host.Xattrs.KeepsAny() {
+		scanFile = fsOp.ScanFileWithXattrs
+	}
+
+	// Report bytes hashed as we go.  (We don't know the total until we're done.)
+	prog := progress.New(mon, "pack", 0)
+
+	// Walk the filesystem in order, emitting zip entries and filling the bucket as we go.
+	err = fsOp.Walk(afs, fs.RelPath{}, func(path fs.RelPath, _ *fs.Metadata) error {
+		// Consider cancellation.
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Open file.
+		fmeta, file, err := scanFile(afs, path)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+
+		// Apply filters.
+		host.Apply(fmeta)
+		filters.Apply(filt, fmeta)
+
+		// Flatten time to seconds.  The zip extended timestamp doesn't do subsecond precision;
+		//  we need to do it here so that the hash and the serial form are describing the same thing.
+		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
+
+		// Flip our metadata to zip header format, and flush it.
+		//  Only file bodies are worth compressing; a symlink's body is its target.
+		hdr := &zip.FileHeader{Method: zip.Store}
+		if fmeta.Type == fs.Type_File {
+			hdr.Method = zip.Deflate
+		}
+		if err := MetadataToZipHdr(fmeta, hdr); err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		}
+
+		// If it's a file, stream the body into the zip, hashing it;
+		//  for all, record the metadata in the bucket for the total hash.
+		switch fmeta.Type {
+		case fs.Type_File:
+			contentHasher := hasher.New()
+			n, err := io.Copy(io.MultiWriter(w, contentHasher), file)
+			if err != nil {
+				if ctx.Err() != nil {
+					return Errorf(rio.ErrCancelled, "cancelled")
+				}
+				return Errorf(rio.ErrPackInvalid, "error while packing %q: %s", path, err)
+			}
+			bucket.AddRecord(*fmeta, contentHasher.Sum(nil))
+			prog.Add(n, fmeta.Name)
+		case fs.Type_Symlink:
+			if _, err := io.WriteString(w, fmeta.Linkname); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			bucket.AddRecord(*fmeta, nil)
+		default:
+			bucket.AddRecord(*fmeta, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Hash the thing!
+	wareID := hasher.WareID(bucket)
+	prog.Done()
+	return wareID, nil
+}
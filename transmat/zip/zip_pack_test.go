@@ -0,0 +1,52 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestZipPack(t *testing.T) {
+	Convey("Spec compliance: Zip pack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			tests.CheckPackProducesConsistentHash(PackType, Pack)
+			tests.CheckPackHashVariesOnVariations(PackType, Pack)
+			tests.CheckPackHashCollapsesUnderFilters(PackType, Pack)
+			tests.CheckPackErrorsGracefully(PackType, Pack)
+		}),
+	)
+}
+
+func TestZipPackHashesLikeTar(t *testing.T) {
+	Convey("Zip transmat: the hash of a fileset should be the same as tar's", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			for _, fixture := range tests.AllFixtures {
+				Convey(fmt.Sprintf("- Fixture %q", fixture.Name), func() {
+					testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+						tests.PlaceFixture(osfs.New(tmpDir), fixture.Files)
+						zipWareID, err := Pack(context.Background(), PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						tarWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(zipWareID.Type, ShouldEqual, PackType)
+						So(zipWareID.Hash, ShouldEqual, tarWareID.Hash)
+					})
+				})
+			}
+		}),
+	)
+}
@@ -0,0 +1,339 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/progress"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+// Longer than any symlink target a linux filesystem will hold (PATH_MAX).
+const maxLinkname = 4096
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	return cache.Lrn2Cache(
+		osfs.New(config.GetCacheBasePath()),
+		unpack,
+	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	hasher, err := wareid.Lookup(wareID)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := tartrans.PickReader(ctx, wareID, warehouses, false, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer reader.Close()
+
+	// Zip needs to seek, so fetch the whole ware to a spool file first.
+	spool, size, err := spoolWare(ctx, wareID, reader)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+	}
+
+	// Extract.
+	prefilterWareID, unpackWareID, err := unpackZip(ctx, hasher, osfs.New(path2), filt2, zr, mon)
+	if err != nil {
+		return unpackWareID, err
+	}
+
+	// Check for hash mismatch before returning, because that IS an error,
+	//  but also return the hash we got either way.
+	return unpackWareID, wareid.Check(wareID, prefilterWareID, unpackWareID)
+}
+
+/*
+	Copy the ware into a file in the cache dir, and return it (seeked
+	nowhere in particular; zip.Reader uses ReadAt) with its size.
+	The caller removes the file when done.
+*/
+func spoolWare(ctx context.Context, wareID api.WareID, reader io.Reader) (*os.File, int64, error) {
+	spoolDir := config.GetCacheBasePath().Join(fs.MustRelPath(string(PackType) + "/fetch"))
+	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), spoolDir.CoerceRelative(), 0700); err != nil {
+		return nil, 0, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	file, err := ioutil.TempFile(spoolDir.String(), wareID.Hash+".")
+	if err != nil {
+		return nil, 0, Errorf(rio.ErrLocalCacheProblem, "cannot open spool file for fetch: %s", err)
+	}
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		if ctx.Err() != nil {
+			return nil, 0, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		if _, ok := err.(Error); ok {
+			return nil, 0, err
+		}
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "fetch of ware %s broke: %s", wareID, err)
+	}
+	return file, size, nil
+}
+
+func unpackZip(
+	ctx context.Context,
+	hasher wareid.Hasher,
+	afs fs.FS,
+	filt apiutil.FilesetFilters,
+	zr *zip.Reader,
+	mon rio.Monitor,
+) (
+	prefilterWareID api.WareID,
+	actualWareID api.WareID,
+	err error,
+) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Allocate bucket for keeping each metadata entry and content hash;
+	// the full tree hash will be computed from this at the end.
+	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
+	// we keep a second, separate one for the filtered data, which will compute a different hash.
+	prefilterBucket := &fshash.MemoryBucket{}
+	filteredBucket := &fshash.MemoryBucket{}
+
+	// Also keep a record of every name we've placed.  Dirs, so parents can be
+	//  inferred as in tar; and everything, because the zip format doesn't stop
+	//  a name from appearing twice, and we must.
+	dirs := map[fs.RelPath]struct{}{}
+	seen := map[fs.RelPath]struct{}{}
+
+	policy, err := filters.PlacementPolicyFromConfig(mon)
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// Report bytes written as we go.  Unlike a tar stream, a zip says up front how much there is.
+	var total int64
+	for _, zf := range zr.File {
+		if zf.Mode().IsRegular() {
+			total += int64(zf.UncompressedSize64)
+		}
+	}
+	prog := progress.New(mon, "unpack", total)
+
+	place := func(fmeta fs.Metadata, body io.Reader) error {
+		if err := fsOp.PlaceFileWithPolicy(afs, fmeta, body, filt.SkipChown, policy.Chown); err != nil {
+			if ctx.Err() != nil {
+				return Errorf(rio.ErrCancelled, "cancelled")
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		return nil
+	}
+
+	// Iterate over each zip entry, mutating filesystem as we go.
+	for _, zf := range zr.File {
+		if ctx.Err() != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		// Reshuffle metainfo to our default format.
+		fmeta := fs.Metadata{}
+		if err := ZipHdrToMetadata(&zf.FileHeader, &fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+		if fmeta.Name.GoesUp() {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: paths that use '../' to leave the base dir are invalid")
+		}
+		if _, dup := seen[fmeta.Name]; dup {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %q appears more than once", fmeta.Name)
+		}
+		seen[fmeta.Name] = struct{}{}
+
+		// Infer parents, if necessary.  Zips made by other tools often leave dirs out.
+		for _, parent := range fmeta.Name.SplitParent() {
+			if _, exists := dirs[parent]; exists {
+				continue
+			}
+			log.DirectoryInferred(mon, parent, fmeta.Name)
+			conjuredFmeta := fshash.DefaultDirMetadata()
+			conjuredFmeta.Name = parent
+			prefilterBucket.AddRecord(conjuredFmeta, nil)
+			policy.Apply(&conjuredFmeta)
+			filters.Apply(filt, &conjuredFmeta)
+			filteredBucket.AddRecord(conjuredFmeta, nil)
+			dirs[conjuredFmeta.Name] = struct{}{}
+			seen[conjuredFmeta.Name] = struct{}{}
+			if err := place(conjuredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+		}
+
+		// Open the body, if there is one.  The zip reader checks the crc as it reaches the end.
+		var body io.ReadCloser
+		if fmeta.Type == fs.Type_File || fmeta.Type == fs.Type_Symlink {
+			body, err = zf.Open()
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+			}
+		}
+		if fmeta.Type == fs.Type_Symlink {
+			target, err := ioutil.ReadAll(io.LimitReader(body, maxLinkname+1))
+			body.Close()
+			if err != nil {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+			}
+			if len(target) == 0 || len(target) > maxLinkname {
+				return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt zip: symlink %q has no sensible target", fmeta.Name)
+			}
+			fmeta.Linkname = string(target)
+		}
+
+		// Apply filters.
+		filteredFmeta := fmeta
+		policy.Apply(&filteredFmeta)
+		filters.Apply(filt, &filteredFmeta)
+
+		// Place the file.
+		switch fmeta.Type {
+		case fs.Type_File:
+			checked := &corruptingReader{R: body}
+			reader := &util.HashingReader{checked, hasher.New()}
+			err := place(filteredFmeta, reader)
+			body.Close()
+			if checked.err != nil {
+				return api.WareID{}, api.WareID{}, checked.err
+			}
+			if err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
+			filteredBucket.AddRecord(filteredFmeta, reader.Hasher.Sum(nil))
+			prog.Add(fmeta.Size, fmeta.Name)
+		case fs.Type_Dir:
+			dirs[fmeta.Name] = struct{}{}
+			fallthrough
+		default:
+			if err := place(filteredFmeta, nil); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
+			prefilterBucket.AddRecord(fmeta, nil)
+			filteredBucket.AddRecord(filteredFmeta, nil)
+		}
+	}
+
+	// An empty zip still has a root; if nothing said what it is, conjure it.
+	if _, exists := dirs[fs.RelPath{}]; !exists {
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		prefilterBucket.AddRecord(conjuredFmeta, nil)
+		policy.Apply(&conjuredFmeta)
+		filters.Apply(filt, &conjuredFmeta)
+		filteredBucket.AddRecord(conjuredFmeta, nil)
+		if err := place(conjuredFmeta, nil); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
+	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	// Hash the thing!
+	//  (Checking the two agree, as in the tar transmat, if nothing should have altered the hash.)
+	hashAltering := filt.IsHashAltering() || policy.IsHashAltering()
+	prefilterWareID, filteredWareID := hasher.WareIDs(prefilterBucket, filteredBucket, hashAltering)
+
+	prog.Done()
+	return prefilterWareID, filteredWareID, nil
+}
+
+// Tags read errors from a zip entry body (a bad crc, most likely) as the ware's fault,
+// and keeps the error: placement wraps whatever its reader returns, so the caller checks here.
+type corruptingReader struct {
+	R   io.Reader
+	err error
+}
+
+func (r *corruptingReader) Read(bs []byte) (int, error) {
+	n, err := r.R.Read(bs)
+	if err != nil && err != io.EOF {
+		r.err = Errorf(rio.ErrWareCorrupt, "corrupt zip: %s", err)
+		return n, r.err
+	}
+	return n, err
+}
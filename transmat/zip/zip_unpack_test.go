@@ -0,0 +1,107 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestZipUnpack(t *testing.T) {
+	Convey("Spec compliance: Zip unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			Convey("Using kvfs warehouse, in content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+					tests.CheckCachePopulation(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+			Convey("Using kvfs warehouse, in *non*-content-addressable mode:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
+
+func TestZipUnpackRefusals(t *testing.T) {
+	Convey("Zip transmat: unpacking zips that are wrong", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Unsetenv("RIO_CACHE")
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				addr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.zip", tmpDir))
+				unpack := func(wareID api.WareID) (api.WareID, error) {
+					return Unpack(
+						context.Background(),
+						wareID,
+						tmpDir.Join(fs.MustRelPath("out")).String(),
+						api.Filter_NoMutation,
+						rio.Placement_Direct,
+						[]api.WarehouseAddr{addr},
+						rio.Monitor{},
+					)
+				}
+				writeZip := func(names ...string) {
+					var buf bytes.Buffer
+					zw := zip.NewWriter(&buf)
+					for _, name := range names {
+						// Stored, not deflated, so the body is there to be found.
+					w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+						So(err, ShouldBeNil)
+						w.Write([]byte("body"))
+					}
+					So(zw.Close(), ShouldBeNil)
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.zip", buf.Bytes(), 0644), ShouldBeNil)
+				}
+				someWareID := api.WareID{PackType, "3vmeJ4cUVBdJ7MXPuJJjcQY1bFMkRbE9Lz1mMy9M9zMcCrBjUYcN3ju9VyqBqd2AUj"}
+
+				Convey("a flipped byte in a file body should be corruption", func() {
+					writeZip("./file")
+					bs, err := ioutil.ReadFile(tmpDir.String() + "/ware.zip")
+					So(err, ShouldBeNil)
+					i := bytes.Index(bs, []byte("body"))
+					So(i, ShouldBeGreaterThan, 0)
+					bs[i] ^= 0x20
+					So(ioutil.WriteFile(tmpDir.String()+"/ware.zip", bs, 0644), ShouldBeNil)
+					_, err = unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a name that leaves the base dir should be corruption", func() {
+					writeZip("../escape")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a name that appears twice should be corruption", func() {
+					writeZip("a", "a")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareCorrupt)
+				})
+				Convey("a well-formed zip that's not the ware asked for should be a hash mismatch", func() {
+					writeZip("a", "d/b")
+					_, err := unpack(someWareID)
+					So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareHashMismatch)
+				})
+			})
+		}),
+	)
+}
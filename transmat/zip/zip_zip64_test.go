@@ -0,0 +1,110 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ziptrans
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/wareid"
+)
+
+// Where the zip64 end of central directory record starts: zips that need it have it, and others don't.
+var zip64EndSignature = []byte{0x50, 0x4b, 0x06, 0x06}
+
+func TestZip64(t *testing.T) {
+	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+
+	Convey("Zip transmat: files of 4GB and more", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, testutil.RequiresLongRun, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				// The big file is sparse, so it costs no disk to make;
+				//  but it has something at the far end, so a size cut short at 32 bits would show.
+				const bigSize = 1<<32 + 1<<20
+				So(os.Mkdir(tmpDir.String()+"/src", 0755), ShouldBeNil)
+				f, err := os.Create(tmpDir.String() + "/src/big")
+				So(err, ShouldBeNil)
+				So(f.Truncate(bigSize), ShouldBeNil)
+				_, err = f.WriteAt([]byte("the end"), bigSize-7)
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+				f, err = os.Create(tmpDir.String() + "/src/small")
+				So(err, ShouldBeNil)
+				f.WriteString("small")
+				So(f.Close(), ShouldBeNil)
+
+				wareID, err := Pack(context.Background(), PackType, tmpDir.String()+"/src", api.Filter_NoMutation, api.WarehouseAddr(fmt.Sprintf("file://%s/ware.zip", tmpDir)), rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("should be packed with zip64 sizes", func() {
+					zr, err := zip.OpenReader(tmpDir.String() + "/ware.zip")
+					So(err, ShouldBeNil)
+					defer zr.Close()
+					var sizes []uint64
+					for _, zf := range zr.File {
+						if zf.Mode().IsRegular() {
+							sizes = append(sizes, zf.UncompressedSize64)
+							// The 32-bit field says "see the zip64 field", for the big one only.
+							So(zf.UncompressedSize == 0xffffffff, ShouldEqual, zf.UncompressedSize64 >= 0xffffffff)
+						}
+					}
+					So(sizes, ShouldResemble, []uint64{bigSize, 5})
+				})
+				Convey("should unpack to the same WareID", func() {
+					zr, err := zip.OpenReader(tmpDir.String() + "/ware.zip")
+					So(err, ShouldBeNil)
+					defer zr.Close()
+					prefilterWareID, _, err := unpackZip(context.Background(), wareid.Default(PackType), nilFS.New(), filt, &zr.Reader, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(prefilterWareID, ShouldResemble, wareID)
+				})
+			})
+		}),
+	)
+	Convey("Zip transmat: zips of more than 65535 entries", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, testutil.RequiresLongRun, func() {
+			const n = 70000
+			write := func(n int) []byte {
+				var buf bytes.Buffer
+				zw := zip.NewWriter(&buf)
+				for i := 0; i < n; i++ {
+					_, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("d/%05d", i), Method: zip.Store})
+					So(err, ShouldBeNil)
+				}
+				So(zw.Close(), ShouldBeNil)
+				return buf.Bytes()
+			}
+			bs := write(n)
+
+			Convey("should have a zip64 central directory", func() {
+				So(bytes.Contains(bs[len(bs)-200:], zip64EndSignature), ShouldBeTrue)
+				// ... which a plain zip doesn't.
+				small := write(3)
+				So(bytes.Contains(small, zip64EndSignature), ShouldBeFalse)
+				So(binary.LittleEndian.Uint16(small[len(small)-12:]), ShouldEqual, 3)
+			})
+			Convey("should unpack every entry", func() {
+				zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+				So(err, ShouldBeNil)
+				So(zr.File, ShouldHaveLength, n)
+				_, _, err = unpackZip(context.Background(), wareid.Default(PackType), nilFS.New(), filt, zr, rio.Monitor{})
+				So(err, ShouldBeNil)
+			})
+		}),
+	)
+}
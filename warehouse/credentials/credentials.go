@@ -0,0 +1,162 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Credentials for warehouses, found by host, so that they needn't be
+	written into warehouse addresses (which end up in formulas, and logs).
+
+	They're listed in the credentials file (see config.GetCredentialsPath),
+	which looks like:
+
+		{
+		  "hosts": {
+		    "artifacts.example.com": {"token": "..."},
+		    "minio.example.com:9000": {"username": "...", "secret": "..."},
+		    "files.example.com": {"username": "deploy", "identity": "/home/ci/.ssh/deploy"},
+		    "registry.example.com": {"helper": "pass"}
+		  },
+		  "helper": "secretservice"
+		}
+
+	A host's entry either gives its credentials outright, or names a helper
+	program to ask for them.  Hosts without an entry are asked of the
+	default helper -- `RIO_CREDENTIAL_HELPER`, or else the file's "helper"
+	-- if there is one; and otherwise have no credentials.  Hosts are as
+	written in the warehouse addr, port and all.
+
+	Helpers speak docker's credential helper protocol: helper "x" is the
+	program "rio-credential-x" (found on the path), run with the argument
+	"get", and given the host on stdin.  It answers on stdout with
+	`{"Username": "...", "Secret": "..."}`; a Username of "<token>" means
+	the Secret is a bearer token.  So docker's own helpers can be used as
+	they are, linked under the rio name.  Answers are kept for the life of
+	the process, since helpers may be slow, or even ask the user.
+
+	What's used of a Credential is up to each warehouse; see them for which
+	fields mean what to them.
+*/
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+)
+
+type Credential struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret"`   // a password, or secret key.
+	Token    string `json:"token"`    // a bearer token.
+	Identity string `json:"identity"` // the path of an SSH private key.
+}
+
+type file struct {
+	Hosts  map[string]hostEntry `json:"hosts"`
+	Helper string               `json:"helper"`
+}
+
+type hostEntry struct {
+	Credential
+	Helper string `json:"helper"`
+}
+
+// Answers from helpers so far, by helper and host.
+var helped = struct {
+	sync.Mutex
+	m map[[2]string]Credential
+}{m: map[[2]string]Credential{}}
+
+/*
+	Find the credentials for a host.  Finding none is not an error: the
+	Credential is just empty.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- if the credentials file can't be read or parsed, or names a helper that doesn't exist
+	  - `rio.ErrWarehouseUnavailable` -- if a helper fails
+*/
+func Lookup(host string) (Credential, error) {
+	var f file
+	pth := config.GetCredentialsPath().String()
+	bs, err := ioutil.ReadFile(pth)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bs, &f); err != nil {
+			return Credential{}, Errorf(rio.ErrUsage, "cannot parse credentials file %q: %s", pth, err)
+		}
+	case os.IsNotExist(err):
+		// Fine; there may still be a helper.
+	default:
+		return Credential{}, Errorf(rio.ErrUsage, "cannot read credentials file %q: %s", pth, err)
+	}
+
+	helper, err := config.GetCredentialHelper()
+	if err != nil {
+		return Credential{}, err
+	}
+	if helper == "" {
+		helper = f.Helper
+	}
+	if entry, ok := f.Hosts[host]; ok {
+		if entry.Helper == "" {
+			return entry.Credential, nil
+		}
+		helper = entry.Helper
+	}
+	if helper == "" {
+		return Credential{}, nil
+	}
+	return ask(helper, host)
+}
+
+// Ask a helper, unless it's been asked already.
+func ask(helper, host string) (Credential, error) {
+	helped.Lock()
+	defer helped.Unlock()
+	if cred, ok := helped.m[[2]string{helper, host}]; ok {
+		return cred, nil
+	}
+	if strings.ContainsAny(helper, "/\\") {
+		return Credential{}, Errorf(rio.ErrUsage, "credential helper %q must be a name, not a path", helper)
+	}
+	cmd := exec.Command("rio-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		return Credential{}, Errorf(rio.ErrUsage, "cannot run credential helper %q: %s", helper, err)
+	}
+	var cred Credential
+	switch {
+	case err != nil && strings.Contains(stdout.String(), "credentials not found"):
+		// What docker's helpers say when they have nothing for the host.  Not an error.
+	case err != nil:
+		return Credential{}, Errorf(rio.ErrWarehouseUnavailable, "credential helper %q failed for %s: %s (%s)", helper, host, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	default:
+		var reply struct {
+			Username string
+			Secret   string
+		}
+		if err := json.Unmarshal(stdout.Bytes(), &reply); err != nil {
+			return Credential{}, Errorf(rio.ErrWarehouseUnavailable, "credential helper %q answered for %s with nonsense: %s", helper, host, err)
+		}
+		if reply.Username == "<token>" {
+			cred.Token = reply.Secret
+		} else {
+			cred.Username, cred.Secret = reply.Username, reply.Secret
+		}
+	}
+	helped.m[[2]string{helper, host}] = cred
+	return cred, nil
+}
@@ -0,0 +1,99 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestLookup(t *testing.T) {
+	Convey("looking up credentials:", t, func() {
+		dir, err := ioutil.TempDir("", "rio-test-credentials")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		for k, v := range map[string]string{
+			"RIO_CREDENTIALS_FILE":  filepath.Join(dir, "credentials.json"),
+			"RIO_CREDENTIAL_HELPER": "",
+			"PATH":                  dir + string(os.PathListSeparator) + os.Getenv("PATH"),
+		} {
+			defer os.Setenv(k, os.Getenv(k))
+			os.Setenv(k, v)
+		}
+		writeFile := func(body string) {
+			So(ioutil.WriteFile(filepath.Join(dir, "credentials.json"), []byte(body), 0600), ShouldBeNil)
+		}
+		// A helper that knows one host per name, and counts how often it's asked.
+		writeHelper := func(name, script string) {
+			So(ioutil.WriteFile(filepath.Join(dir, "rio-credential-"+name), []byte("#!/bin/sh\necho >>"+filepath.Join(dir, name+".calls")+"\n"+script), 0755), ShouldBeNil)
+		}
+		calls := func(name string) int {
+			bs, _ := ioutil.ReadFile(filepath.Join(dir, name+".calls"))
+			return len(bs)
+		}
+
+		Convey("no file and no helper should mean no credentials", func() {
+			cred, err := Lookup("example.com")
+			So(err, ShouldBeNil)
+			So(cred, ShouldResemble, Credential{})
+		})
+		Convey("credentials listed for the host should be used as they are", func() {
+			writeFile(`{"hosts": {"example.com:8443": {"username": "me", "secret": "pw", "identity": "/keys/ci"}}}`)
+			cred, err := Lookup("example.com:8443")
+			So(err, ShouldBeNil)
+			So(cred, ShouldResemble, Credential{Username: "me", Secret: "pw", Identity: "/keys/ci"})
+			cred, err = Lookup("example.com")
+			So(err, ShouldBeNil)
+			So(cred, ShouldResemble, Credential{})
+		})
+		Convey("a helper should be asked for the host, once", func() {
+			writeHelper("t1", `read host; [ "$1" = get ] && [ "$host" = example.com ] && echo '{"ServerURL": "example.com", "Username": "<token>", "Secret": "tok"}'`)
+			writeFile(`{"hosts": {"example.com": {"helper": "t1"}}}`)
+			for i := 0; i < 2; i++ {
+				cred, err := Lookup("example.com")
+				So(err, ShouldBeNil)
+				So(cred, ShouldResemble, Credential{Token: "tok"})
+			}
+			So(calls("t1"), ShouldEqual, 1)
+		})
+		Convey("the default helper should be asked for unlisted hosts", func() {
+			writeHelper("t2", `echo '{"Username": "me", "Secret": "pw"}'`)
+			writeFile(`{"helper": "nope"}`)
+			os.Setenv("RIO_CREDENTIAL_HELPER", "t2")
+			cred, err := Lookup("example.com")
+			So(err, ShouldBeNil)
+			So(cred, ShouldResemble, Credential{Username: "me", Secret: "pw"})
+		})
+		Convey("a helper that has nothing for the host should mean no credentials", func() {
+			writeHelper("t3", `echo "credentials not found in native keychain"; exit 1`)
+			writeFile(`{"helper": "t3"}`)
+			cred, err := Lookup("example.com")
+			So(err, ShouldBeNil)
+			So(cred, ShouldResemble, Credential{})
+		})
+		Convey("a helper that fails otherwise should be an error", func() {
+			writeHelper("t4", `echo "keychain locked" >&2; exit 1`)
+			writeFile(`{"helper": "t4"}`)
+			_, err := Lookup("example.com")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "keychain locked")
+		})
+		Convey("a missing helper, or a broken file, should be usage errors", func() {
+			writeFile(`{"helper": "nonexistent"}`)
+			_, err := Lookup("example.com")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			writeFile(`{"hosts": [`)
+			_, err = Lookup("example.com")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+	})
+}
@@ -136,6 +136,13 @@ func NewController(workingDirectory riofs.FS, addr api.WarehouseAddr) (*Controll
 	return whCtrl, err
 }
 
+/*
+	Returns the address the controller was made with.
+*/
+func (c *Controller) Addr() api.WarehouseAddr {
+	return api.WarehouseAddr(c.addr)
+}
+
 /*
 	Returns the commit for the given hash
 */
@@ -0,0 +1,306 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The hg warehouse is a repository style warehouse, like the git one:
+	the hashes given are Mercurial changeset IDs, which name a state of the
+	repository, rather than describing a fileset.
+
+	There's no Mercurial implementation in Go, so this warehouse requires
+	`hg` to be on the path, and runs it for everything.  It's run with
+	HGPLAIN set, so the user's aliases and output settings don't apply.
+*/
+package hg
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	riofs "go.polydawn.net/rio/fs"
+)
+
+// The null changeset: the parent of the first.
+var nullHash = strings.Repeat("0", 40)
+
+// protocols
+const (
+	protocolHTTP  = "http"
+	protocolHTTPS = "https"
+	protocolSSH   = "ssh"
+	protocolFile  = "file"
+)
+
+/*
+	Combo of remote repo interactions and a local on-disk cache, as for git.
+	Repos that are local already are used directly, rather than cloned.
+*/
+type Controller struct {
+	// user's address retained for messages (minus leading/trailing whitespace)
+	addr string
+	// Address that we will actually use to perform remote operations
+	sanitizedAddr string
+	// The detected protocol based on the address given
+	protocol string
+	// The repo that hg is pointed at: the local one, or our clone of the remote
+	repoPath   string
+	allowClone bool // clones are disabled for local files
+	newClone   bool // whether this controller created the clone in use
+}
+
+/*
+	Initialize a new warehouse controller.  Remote repos are cloned into
+	the `workingDirectory` (see Clone); local ones are used as they are.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+	  - `rio.ErrWarehouseUnavailable` -- if the warehouse doesn't exist, or `hg` isn't on the path
+	  - `rio.ErrLocalCacheProblem` -- if unable to create a cache directory
+*/
+func NewController(workingDirectory riofs.FS, addr api.WarehouseAddr) (*Controller, error) {
+	sanitizedAddr, protocol, err := SanitizeRemote(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("hg"); err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "the hg warehouse requires hg on the path: %s", err)
+	}
+	whCtrl := &Controller{
+		addr:          strings.TrimSpace(string(addr)),
+		sanitizedAddr: sanitizedAddr,
+		protocol:      protocol,
+	}
+
+	// Local repos are used in place.  There's no ping to do: it's there, or it's not.
+	if protocol == protocolFile {
+		if fi, err := os.Stat(filepath.Join(sanitizedAddr, ".hg")); err != nil || !fi.IsDir() {
+			return nil, ErrorDetailed(rio.ErrWarehouseUnavailable, "warehouse does not exist", map[string]string{
+				"warehouse": sanitizedAddr,
+			})
+		}
+		whCtrl.repoPath = sanitizedAddr
+		return whCtrl, nil
+	}
+
+	// Ping the remote and see if it responds.
+	if _, err := run(context.Background(), "", "identify", "--id", "--", sanitizedAddr); err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse unavailable: %s", err)
+	}
+	whCtrl.allowClone = true
+	whCtrl.repoPath = workingDirectory.BasePath().Join(riofs.MustRelPath(SlugifyRemote(sanitizedAddr))).String()
+	if err := os.MkdirAll(workingDirectory.BasePath().String(), 0755); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "could not create repository cache: %s", err)
+	}
+	return whCtrl, nil
+}
+
+/*
+	Returns true if the repository contains the changeset for the given hash.
+	(Every repo has the null changeset; but it has no files, and isn't one.)
+*/
+func (c *Controller) Contains(hash string) bool {
+	if mustBeFullHash(hash) != nil || hash == nullHash {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(c.repoPath, ".hg")); err != nil {
+		return false
+	}
+	out, err := run(context.Background(), c.repoPath, "log", "--rev", hash, "--template", "{node}")
+	return err == nil && string(out) == hash
+}
+
+/*
+	Clones the remote into the cache, unless it's been cloned there already
+	(or is local, and needs no clone).
+	If a clone occurs then controller.newClone will be set to true.
+*/
+func (c *Controller) Clone(ctx context.Context) error {
+	if !c.allowClone {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(c.repoPath, ".hg")); err == nil {
+		return nil
+	}
+	// Clone next to where it'll go, and move it into place when it's done,
+	//  so a clone that breaks off doesn't look like one to use later.
+	tmpPath := c.repoPath + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "could not clear repository cache: %s", err)
+	}
+	if _, err := run(ctx, "", "clone", "--noupdate", "--", c.sanitizedAddr, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return Errorf(rio.ErrWarehouseUnavailable, "unable to clone repository: %s", err)
+	}
+	if err := os.Rename(tmpPath, c.repoPath); err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "could not create repository cache: %s", err)
+	}
+	c.newClone = true
+	return nil
+}
+
+/*
+	Pulls new changesets from the remote into a clone made earlier.
+	(A clone made just now, or a local repo, needs nothing.)
+*/
+func (c *Controller) Update(ctx context.Context) error {
+	if !c.allowClone || c.newClone {
+		return nil
+	}
+	if _, err := run(ctx, c.repoPath, "pull", "--", c.sanitizedAddr); err != nil {
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return Errorf(rio.ErrWarehouseUnavailable, "unable to pull repository: %s", err)
+	}
+	return nil
+}
+
+// What every path in an archive starts with.
+const ArchivePrefix = "ware"
+
+/*
+	Returns a tar of the files of the given changeset (as `hg archive`
+	makes it: with no dirs, nor any .hg_archival.txt; every path is under
+	ArchivePrefix).  Subrepos aren't included.
+
+	The reader must be closed; closing it reports if hg failed.
+*/
+func (c *Controller) Archive(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := mustBeFullHash(hash); err != nil {
+		return nil, err
+	}
+	if !c.Contains(hash) {
+		return nil, Errorf(rio.ErrWareNotFound, "changeset not found")
+	}
+	cmd := command(ctx, c.repoPath,
+		"--config", "ui.archivemeta=false",
+		"archive", "--rev", hash, "--type", "tar", "--prefix", ArchivePrefix, "-",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "could not run hg: %s", err)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, Errorf(rio.ErrLocalCacheProblem, "could not run hg: %s", err)
+	}
+	return &archiveReader{stdout, cmd, stderr}, nil
+}
+
+type archiveReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *archiveReader) Close() error {
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "hg archive failed: %s: %s", err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
+
+func command(ctx context.Context, repoPath string, args ...string) *exec.Cmd {
+	if repoPath != "" {
+		args = append([]string{"--repository", repoPath}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "hg", append([]string{"--noninteractive"}, args...)...)
+	cmd.Env = append(os.Environ(), "HGPLAIN=1")
+	return cmd
+}
+
+// Run hg, and return what it said; or an error with what it complained.
+func run(ctx context.Context, repoPath string, args ...string) ([]byte, error) {
+	cmd := command(ctx, repoPath, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+/*
+	Checks the remote is one we can hand to hg, and absolutizes local paths;
+	returns it, and its protocol.
+	Bare paths are taken as local (as hg itself would).
+*/
+func SanitizeRemote(remote string) (string, string, error) {
+	remote = strings.TrimSpace(remote)
+	if remote == "" {
+		return "", "", Errorf(rio.ErrUsage, "empty hg remote")
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", "", Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "", protocolFile:
+		path := remote
+		if u.Scheme == protocolFile {
+			path = u.Path
+		}
+		if path == "" {
+			return "", "", Errorf(rio.ErrUsage, "empty hg remote")
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return "", "", Errorf(rio.ErrUsage, "failed handling local path")
+		}
+		return path, protocolFile, nil
+	case protocolHTTP, protocolHTTPS, protocolSSH:
+		// hg takes anything after a leading '-' as an option, wherever it is.
+		if u.Host == "" {
+			return "", "", Errorf(rio.ErrUsage, "warehouse has empty host: %s", remote)
+		} else if u.Host[0] == '-' {
+			return "", "", Errorf(rio.ErrUsage, "warehouse host cannot start with '-'")
+		}
+		return remote, u.Scheme, nil
+	default:
+		return "", "", Errorf(rio.ErrUsage, "unsupported hg remote scheme %q (valid options are 'ssh', 'http', 'https', or 'file')", u.Scheme)
+	}
+}
+
+/*
+	An hg changeset ID must be exactly 40 hex characters.
+	(hg accepts prefixes, revision numbers, and bookmarks too; but none of
+	those are content addresses.)
+*/
+func mustBeFullHash(hash string) error {
+	if len(hash) != 40 {
+		return Errorf(rio.ErrUsage, "hg changeset hashes are 40 characters")
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return Errorf(rio.ErrUsage, "hg changeset hashes are hex strings")
+	}
+	return nil
+}
+
+/*
+	Return a string that's safe to use as a dir name.
+
+	Uses URL query escaping so it remains roughly readable.
+	Does not attempt any URL normalization.
+*/
+func SlugifyRemote(remoteURL string) string {
+	return url.QueryEscape(remoteURL)
+}
@@ -0,0 +1,143 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package hg
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	riofs "go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestSanitizeRemote(t *testing.T) {
+	testItems := []struct {
+		in       string
+		out      string
+		protocol string
+		category rio.ErrorCategory
+	}{
+		{"https://hg.example.org/repo", "https://hg.example.org/repo", protocolHTTPS, ""},
+		{" ssh://hg@hg.example.org/repo ", "ssh://hg@hg.example.org/repo", protocolSSH, ""},
+		{"file:///srv/repo", "/srv/repo", protocolFile, ""},
+		{"/srv/repo/", "/srv/repo", protocolFile, ""},
+		{"", "", "", rio.ErrUsage},
+		{"ftp://hg.example.org/repo", "", "", rio.ErrUsage},
+		{"ssh://-oProxyCommand=x/repo", "", "", rio.ErrUsage},
+	}
+	for _, remote := range testItems {
+		t.Run("Sanitize "+remote.in, func(t *testing.T) {
+			out, protocol, err := SanitizeRemote(remote.in)
+			switch {
+			case remote.category == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case remote.category != "" && errcat.Category(err) != remote.category:
+				t.Fatalf("expected error category %q but got %v", remote.category, err)
+			}
+			if out != remote.out || protocol != remote.protocol {
+				t.Errorf("expected %q (%s) but got %q (%s)", remote.out, remote.protocol, out, protocol)
+			}
+		})
+	}
+}
+
+// Make a repo with a few files in one changeset; return the changeset hash.
+func makeRepo(t *testing.T, path string) string {
+	hg := func(args ...string) string {
+		cmd := exec.Command("hg", append([]string{"--repository", path}, args...)...)
+		cmd.Env = append(os.Environ(), "HGPLAIN=1", "HGUSER=rio <rio@example.org>")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("hg %s: %s: %s", args, err, out)
+		}
+		return string(out)
+	}
+	if out, err := exec.Command("hg", "init", path).CombinedOutput(); err != nil {
+		t.Fatalf("hg init: %s: %s", err, out)
+	}
+	os.MkdirAll(filepath.Join(path, "dir/deeper"), 0755)
+	ioutil.WriteFile(filepath.Join(path, "a"), []byte("a!"), 0644)
+	ioutil.WriteFile(filepath.Join(path, "dir/deeper/run"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("../a", filepath.Join(path, "dir/link"))
+	hg("add")
+	hg("commit", "--message", "files")
+	return hg("log", "--rev", ".", "--template", "{node}")
+}
+
+func TestLocalRepo(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("requires hg on the path")
+	}
+	testutil.WithTmpdir(func(tmpDir riofs.AbsolutePath) {
+		repoPath := tmpDir.String() + "/repo"
+		hash := makeRepo(t, repoPath)
+		whCtrl, err := NewController(osfs.New(tmpDir.Join(riofs.MustRelPath("cache"))), api.WarehouseAddr("file://"+repoPath))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		t.Run("Contains", func(t *testing.T) {
+			if !whCtrl.Contains(hash) {
+				t.Errorf("expected the repo to contain %s", hash)
+			}
+			if whCtrl.Contains(hash[:12]) {
+				t.Errorf("expected a short hash not to be accepted")
+			}
+			if whCtrl.Contains(strings.Repeat("0", 40)) {
+				t.Errorf("expected the repo not to contain the null changeset")
+			}
+		})
+		t.Run("Archive", func(t *testing.T) {
+			reader, err := whCtrl.Archive(context.Background(), hash)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var names []string
+			tr := tar.NewReader(reader)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				names = append(names, hdr.Name)
+			}
+			if err := reader.Close(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			expected := []string{"ware/a", "ware/dir/deeper/run", "ware/dir/link"}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("expected %v but got %v", expected, names)
+			}
+		})
+		t.Run("Archive of a changeset the repo doesn't have", func(t *testing.T) {
+			_, err := whCtrl.Archive(context.Background(), strings.Repeat("0", 40))
+			if errcat.Category(err) != rio.ErrWareNotFound {
+				t.Errorf("expected ErrWareNotFound but got %v", err)
+			}
+		})
+	})
+	t.Run("A local repo that doesn't exist", func(t *testing.T) {
+		_, err := NewController(nil, api.WarehouseAddr("file:///nonexistent/repo"))
+		if errcat.Category(err) != rio.ErrWarehouseUnavailable {
+			t.Errorf("expected ErrWarehouseUnavailable but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvazblob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+// What managed identity tokens are asked for: access to storage.
+const storageResource = "https://storage.azure.com/"
+
+/*
+	Where bearer tokens come from, and the last one, kept until shortly
+	before it expires.  An auth with no fetch func is anonymous.
+*/
+type auth struct {
+	mu       sync.Mutex
+	fetch    func(ctx context.Context) (token string, expires time.Time, err error)
+	optional bool // if fetching fails, go anonymous (for good) rather than erroring.
+	tok      string
+	expires  time.Time
+}
+
+/*
+	Return a bearer token, fetching a new one if need be;
+	or "" if we're anonymous.
+*/
+func (a *auth) token(ctx context.Context) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fetch == nil {
+		return "", nil
+	}
+	if a.tok != "" && time.Now().Add(5*time.Minute).Before(a.expires) {
+		return a.tok, nil
+	}
+	tok, expires, err := a.fetch(ctx)
+	if err != nil {
+		if a.optional && ctx.Err() == nil {
+			a.fetch = nil
+			return "", nil
+		}
+		return "", err
+	}
+	a.tok, a.expires = tok, expires
+	return tok, nil
+}
+
+/*
+	Find credentials:
+
+	  - a SAS token in `AZURE_STORAGE_SAS_TOKEN` (with or without its
+	    leading "?"), which goes in every request's query;
+	  - else the managed identity's token, from the App Service (or
+	    Container Apps, or Functions) identity endpoint, if
+	    `IDENTITY_ENDPOINT` and `IDENTITY_HEADER` are set;
+	  - else the managed identity's token from the instance metadata
+	    service, if there is one (`AZURE_POD_IDENTITY_AUTHORITY_HOST`
+	    overrides where it is).
+
+	`AZURE_CLIENT_ID` picks a user-assigned identity over the system one.
+	Finding no identity at all is not an error: requests go anonymous.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- if the SAS token can't be parsed
+*/
+func loadAuth() (url.Values, *auth, error) {
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		vals, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil || vals.Get("sig") == "" {
+			return nil, nil, Errorf(rio.ErrUsage, "cannot parse AZURE_STORAGE_SAS_TOKEN: not a SAS token")
+		}
+		return vals, &auth{}, nil
+	}
+	if os.Getenv("IDENTITY_ENDPOINT") != "" && os.Getenv("IDENTITY_HEADER") != "" {
+		return nil, &auth{fetch: appServiceToken}, nil
+	}
+	return nil, &auth{fetch: instanceToken, optional: true}, nil
+}
+
+// Metadata services answer fast, if they're there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+/*
+	Fetch a token from the App Service identity endpoint.
+*/
+func appServiceToken(ctx context.Context) (string, time.Time, error) {
+	q := url.Values{"api-version": {"2019-08-01"}, "resource": {storageResource}}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+	req, err := http.NewRequest("GET", os.Getenv("IDENTITY_ENDPOINT")+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	return getToken(req.WithContext(ctx))
+}
+
+/*
+	Fetch a token from the instance metadata service.
+*/
+func instanceToken(ctx context.Context) (string, time.Time, error) {
+	host := os.Getenv("AZURE_POD_IDENTITY_AUTHORITY_HOST")
+	if host == "" {
+		host = "http://169.254.169.254"
+	}
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {storageResource}}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(host, "/")+"/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	return getToken(req.WithContext(ctx))
+}
+
+/*
+	Do a request to an identity endpoint, and return the token it grants.
+	They give its expiry as seconds since the epoch, but some as a string,
+	and some as a number.
+*/
+func getToken(req *http.Request) (string, time.Time, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != 200 {
+		return "", time.Time{}, fmt.Errorf("identity endpoint: %s: %s", resp.Status, strings.TrimSpace(string(bs)))
+	}
+	var msg struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresOn   json.RawMessage `json:"expires_on"`
+	}
+	if err := json.Unmarshal(bs, &msg); err != nil {
+		return "", time.Time{}, fmt.Errorf("identity endpoint: %s", err)
+	}
+	if msg.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("identity endpoint: no access token granted")
+	}
+	expiresOn, err := strconv.ParseInt(strings.Trim(string(msg.ExpiresOn), `"`), 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("identity endpoint: unparsable expires_on %s", msg.ExpiresOn)
+	}
+	return msg.AccessToken, time.Unix(expiresOn, 0), nil
+}
@@ -0,0 +1,108 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvazblob
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestLoadAuth(t *testing.T) {
+	Convey("loading credentials:", t, func() {
+		// Unset everything that could find real credentials; each case sets what it uses.
+		for _, k := range []string{
+			"AZURE_STORAGE_SAS_TOKEN", "IDENTITY_ENDPOINT", "IDENTITY_HEADER",
+			"AZURE_POD_IDENTITY_AUTHORITY_HOST", "AZURE_CLIENT_ID",
+		} {
+			defer os.Setenv(k, os.Getenv(k))
+			os.Unsetenv(k)
+		}
+		os.Setenv("AZURE_POD_IDENTITY_AUTHORITY_HOST", "http://127.0.0.1:1")
+		ctx := context.Background()
+		expiresOn := time.Now().Add(time.Hour).Unix()
+
+		Convey("a SAS token should go in the query, and nothing else be sent", func() {
+			os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2020-10-02&sp=rw&sig=abc%2Bdef")
+			sas, a, err := loadAuth()
+			So(err, ShouldBeNil)
+			So(sas.Get("sig"), ShouldEqual, "abc+def")
+			tok, err := a.token(ctx)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "")
+		})
+		Convey("a SAS token without a signature should be a usage error", func() {
+			os.Setenv("AZURE_STORAGE_SAS_TOKEN", "not-a-token")
+			_, _, err := loadAuth()
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+		Convey("the instance's managed identity should be used, and its token kept", func() {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requests++
+				q := req.URL.Query()
+				if req.Header.Get("Metadata") != "true" || req.URL.Path != "/metadata/identity/oauth2/token" ||
+					q.Get("resource") != storageResource || q.Get("client_id") != "uami" {
+					w.WriteHeader(400)
+					return
+				}
+				fmt.Fprintf(w, `{"access_token": "imds-token", "expires_on": "%d", "token_type": "Bearer"}`, expiresOn)
+			}))
+			defer srv.Close()
+			os.Setenv("AZURE_POD_IDENTITY_AUTHORITY_HOST", srv.URL)
+			os.Setenv("AZURE_CLIENT_ID", "uami")
+			_, a, err := loadAuth()
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				tok, err := a.token(ctx)
+				So(err, ShouldBeNil)
+				So(tok, ShouldEqual, "imds-token")
+			}
+			So(requests, ShouldEqual, 1)
+		})
+		Convey("the App Service identity endpoint should be used, if it's set", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("X-IDENTITY-HEADER") != "secret" {
+					w.WriteHeader(401)
+					return
+				}
+				fmt.Fprintf(w, `{"access_token": "app-token", "expires_on": %d, "token_type": "Bearer"}`, expiresOn)
+			}))
+			defer srv.Close()
+			os.Setenv("IDENTITY_ENDPOINT", srv.URL+"/msi/token")
+			os.Setenv("IDENTITY_HEADER", "secret")
+			_, a, err := loadAuth()
+			So(err, ShouldBeNil)
+			tok, err := a.token(ctx)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "app-token")
+
+			Convey("and failing to get a token from it should be an error", func() {
+				os.Setenv("IDENTITY_HEADER", "wrong")
+				_, a, err := loadAuth()
+				So(err, ShouldBeNil)
+				_, err = a.token(ctx)
+				So(err, ShouldNotBeNil)
+			})
+		})
+		Convey("finding nothing should go anonymous", func() {
+			sas, a, err := loadAuth()
+			So(err, ShouldBeNil)
+			So(sas, ShouldBeNil)
+			tok, err := a.token(ctx)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,402 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse in an Azure Blob Storage container.
+
+	Addresses look like "azblob://account/container/path/to/ware.tgz" (one
+	ware, stored at exactly that blob name) or "ca+azblob://account/container/prefix"
+	(content-addressed, each ware at "prefix/abc/def/abcdefghij..." just as
+	in kvfs).
+
+	Requests are authorized with a SAS token, if `AZURE_STORAGE_SAS_TOKEN`
+	is set; or else with a token for the managed identity of wherever we're
+	running, if there is one (see loadAuth); or else not at all, which will
+	do for reading from a public container.  Shared keys aren't supported:
+	make a SAS token from one.  To aim at some other endpoint than the
+	account's own (such as Azurite), set `AZURE_STORAGE_BLOB_ENDPOINT` to
+	the account's URL there, e.g. "http://127.0.0.1:10000/devstoreaccount1".
+
+	This speaks the Blob service REST API directly, rather than via the
+	Azure SDK: we need a handful of its calls, and none of the rest.
+*/
+package kvazblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+/*
+	Wares larger than this are uploaded in blocks of this size.
+	(Azure allows at most 50000 blocks to a blob.)
+*/
+var blockSize int64 = 16 << 20
+
+// The version of the REST API we speak.  Bearer tokens need at least 2017-11-09.
+const apiVersion = "2020-10-02"
+
+type Controller struct {
+	addr      api.WarehouseAddr // user's string retained for messages
+	container string
+	name      string // the blob name in single-ware mode; the name prefix in CA mode.
+	ctntAddr  bool
+	endpoint  *url.URL
+	sas       url.Values
+	auth      *auth
+	client    *http.Client
+}
+
+/*
+	Initialize a new warehouse controller that operates on an Azure
+	Blob Storage container.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses, or an unparsable SAS token
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr:   addr,
+		client: http.DefaultClient,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs; the host is the storage account,
+	//     and the first path segment the container.
+	//  - We extract whether or not it's content-addressible mode here;
+	//  - and extract the blob name (or name prefix).
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "azblob":
+	case "ca+azblob":
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'azblob' or 'ca+azblob')", u.Scheme)
+	}
+	account := u.Host
+	pth := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	whCtrl.container = pth[0]
+	if len(pth) > 1 {
+		whCtrl.name = strings.Trim(pth[1], "/")
+	}
+	if account == "" || whCtrl.container == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "azblob warehouse addr must name a storage account and a container (e.g. 'azblob://account/container/path')")
+	}
+	if whCtrl.name == "" && !whCtrl.ctntAddr {
+		return whCtrl, Errorf(rio.ErrUsage, "azblob warehouse addr must name a blob for the ware (e.g. 'azblob://account/container/path'), unless it's content-addressed ('ca+azblob://')")
+	}
+
+	// Figure out where to talk to, and as whom.
+	endpoint := os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	whCtrl.endpoint, err = url.Parse(endpoint)
+	if err != nil || whCtrl.endpoint.Host == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "invalid azblob endpoint url %q", endpoint)
+	}
+	whCtrl.sas, whCtrl.auth, err = loadAuth()
+	if err != nil {
+		return whCtrl, err
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's as costly as just starting the actual download.
+
+	return whCtrl, nil
+}
+
+func (whCtrl Controller) blobName(wareID api.WareID) string {
+	if !whCtrl.ctntAddr {
+		return whCtrl.name
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return path.Join(whCtrl.name, chunkA, chunkB, wareID.Hash)
+}
+
+/*
+	Issue a request for a blob, with our SAS token or bearer token, if we
+	have either.  The body, if any, is sent with the given length.
+
+	Errors are of the given category (or `rio.ErrCancelled`).
+*/
+func (whCtrl Controller) do(ctx context.Context, method string, blob string, query url.Values, header http.Header, body io.Reader, length int64, category rio.ErrorCategory) (*http.Response, error) {
+	u := *whCtrl.endpoint // copy: we mutate the path.
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + whCtrl.container + "/" + blob
+	q := url.Values{}
+	for k, vs := range whCtrl.sas {
+		q[k] = vs
+	}
+	for k, vs := range query {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, Errorf(category, "failed to build request for warehouse %s: %s", whCtrl.addr, err)
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	token, err := whCtrl.auth.token(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, Errorf(category, "cannot authenticate to warehouse %s: %s", whCtrl.addr, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := whCtrl.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, Errorf(category, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	return resp, nil
+}
+
+/*
+	What Azure says went wrong: a code in a header, and an explanation in
+	an XML body (for all but HEAD requests).
+	Reading it closes the response body.
+*/
+type azError struct {
+	Status  string `xml:"-"`
+	Code    string
+	Message string
+}
+
+func readAzError(resp *http.Response) (azerr azError) {
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(bs, &azerr)
+	if code := resp.Header.Get("x-ms-error-code"); code != "" {
+		azerr.Code = code
+	}
+	azerr.Status = resp.Status
+	return
+}
+
+func (e azError) String() string {
+	if e.Code == "" {
+		return "unexpected HTTP code: " + e.Status
+	}
+	return fmt.Sprintf("%s (%s: %s)", e.Status, e.Code, strings.SplitN(e.Message, "\n", 2)[0])
+}
+
+/*
+	Open a reader for the ware.  The body is streamed, not buffered; the
+	request (and every read after it) is bound to the context.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if there's no such blob
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, a missing container, denied access, and so on
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in, with a ranged
+	GET.  An offset past the end starts over from zero instead; `start`
+	reports where the stream actually begins.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := whCtrl.do(ctx, "GET", whCtrl.blobName(wareID), nil, header, nil, 0, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return &bodyReader{ctx, resp.Body}, 0, nil
+	case 206:
+		return &bodyReader{ctx, resp.Body}, offset, nil
+	case 416:
+		resp.Body.Close()
+		return whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	case 404:
+		// A missing container is also a 404; that's the warehouse missing, not the ware.
+		if azerr := readAzError(resp); azerr.Code == "ContainerNotFound" {
+			return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s does not exist: %s", whCtrl.addr, azerr)
+		}
+		return nil, 0, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, readAzError(resp))
+	}
+}
+
+// Reports read errors caused by cancellation as such.
+type bodyReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *bodyReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		return n, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	}
+	return n, err
+}
+
+/*
+	Open a writer for a ware.
+
+	Nothing is sent to Azure until commit -- since the name is the hash, we
+	can't know it sooner -- so the data is staged in a local temp file.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc := &WriteController{whCtrl: whCtrl}
+	file, err := ioutil.TempFile("", ".tmp.upload.azblob.")
+	if err != nil {
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	wc.stream = file
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	stream *os.File   // Write to this.  (Local staging; removed on close.)
+	whCtrl Controller // Needed for the final upload.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.stream.Write(bs)
+}
+
+/*
+	Cancel the current write.  Close the stream, and remove the staging file.
+*/
+func (wc *WriteController) Close() error {
+	wc.stream.Close()
+	if err := os.Remove(wc.stream.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash, uploading it.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	Wares no bigger than blockSize go up in one request; larger ones as
+	blocks, then a block list that commits them all at once.  Should a
+	block fail, nothing is committed; there's no call to drop the blocks
+	already sent, but Azure discards uncommitted blocks after a week.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	size, err := wc.stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to commit to azblob: %s", err)
+	}
+	blob := wc.whCtrl.blobName(wareID)
+	if size <= blockSize {
+		return wc.sendSection(blob, nil, http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}, 0, size)
+	}
+	return wc.putBlocks(blob, size)
+}
+
+func (wc *WriteController) putBlocks(blob string, size int64) error {
+	whCtrl := wc.whCtrl
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+
+	// Send the blocks.
+	//  Block IDs must all be the same length, so they're zero-padded.
+	var ids []string
+	for offset := int64(0); offset < size; offset += blockSize {
+		length := blockSize
+		if size-offset < length {
+			length = size - offset
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", len(ids))))
+		if err := wc.sendSection(blob, url.Values{"comp": {"block"}, "blockid": {id}}, nil, offset, length); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	// Commit them, in order.
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	xml.NewEncoder(&buf).Encode(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string
+	}{Latest: ids})
+	body := buf.Bytes()
+	resp, err := whCtrl.do(context.Background(), "PUT", blob, url.Values{"comp": {"blocklist"}}, http.Header{"Content-Type": {"application/xml"}}, bytes.NewReader(body), int64(len(body)), rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 201 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readAzError(resp))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+/*
+	PUT a section of the staging file to the blob (with query params saying
+	which block it is, if it's one of several), and check it was accepted.
+*/
+func (wc *WriteController) sendSection(blob string, query url.Values, header http.Header, offset, length int64) error {
+	what := fmt.Sprintf("failed to commit to warehouse %s", wc.whCtrl.addr)
+	var body io.Reader = http.NoBody // so an empty ware is sent with a length, not chunked.
+	if length > 0 {
+		body = io.NewSectionReader(wc.stream, offset, length)
+	}
+	resp, err := wc.whCtrl.do(context.Background(), "PUT", blob, query, header, body, length, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 201 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readAzError(resp))
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,234 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvazblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Just enough of the Blob service to exercise the controller: blobs, and
+	blocks, in container "ctr" of account "acct".  Wants the SAS token "sig=ok".
+*/
+type fakeAzure struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	blocks    map[string][]byte // uncommitted; by blob name and block ID.
+	failBlock int               // if nonzero, refuse this block (counting from one).
+	requests  []string
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := req.URL.Query()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path+" "+q.Get("comp"))
+	fail := func(status int, code string) {
+		w.Header().Set("x-ms-error-code", code)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>no</Message></Error>`, code)
+	}
+	if q.Get("sig") != "ok" || req.Header.Get("x-ms-version") == "" {
+		fail(403, "AuthenticationFailed")
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/acct/ctr/") {
+		fail(404, "ContainerNotFound")
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/acct/ctr/")
+	body, _ := ioutil.ReadAll(req.Body)
+	switch {
+	case req.Method == "GET":
+		bs, ok := f.blobs[name]
+		if !ok {
+			fail(404, "BlobNotFound")
+			return
+		}
+		var start int
+		if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); n == 1 {
+			if start >= len(bs) {
+				fail(416, "InvalidRange")
+				return
+			}
+			w.WriteHeader(206)
+			bs = bs[start:]
+		}
+		w.Write(bs)
+	case req.Method == "PUT" && q.Get("comp") == "block":
+		if len(f.blocks) == f.failBlock-1 {
+			fail(500, "InternalError")
+			return
+		}
+		f.blocks[name+"/"+q.Get("blockid")] = body
+		w.WriteHeader(201)
+	case req.Method == "PUT" && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		xml.Unmarshal(body, &list)
+		var whole []byte
+		for _, id := range list.Latest {
+			bs, ok := f.blocks[name+"/"+id]
+			if !ok {
+				fail(400, "InvalidBlockList")
+				return
+			}
+			whole = append(whole, bs...)
+		}
+		f.blobs[name] = whole
+		f.blocks = map[string][]byte{}
+		w.WriteHeader(201)
+	case req.Method == "PUT" && req.Header.Get("x-ms-blob-type") == "BlockBlob":
+		if req.ContentLength != int64(len(body)) {
+			fail(411, "MissingContentLengthHeader")
+			return
+		}
+		f.blobs[name] = body
+		w.WriteHeader(201)
+	default:
+		fail(400, "UnsupportedHttpVerb")
+	}
+}
+
+func TestKvazblob(t *testing.T) {
+	Convey("kvazblob warehouse, against a fake Azure:", t, func() {
+		fake := &fakeAzure{blobs: map[string][]byte{}, blocks: map[string][]byte{}}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+		for k, v := range map[string]string{
+			"AZURE_STORAGE_BLOB_ENDPOINT": srv.URL + "/acct",
+			"AZURE_STORAGE_SAS_TOKEN":     "?sv=2020-10-02&sig=ok",
+		} {
+			defer os.Setenv(k, os.Getenv(k))
+			os.Setenv(k, v)
+		}
+		defer func(v int64) { blockSize = v }(blockSize)
+		blockSize = 100
+
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		write := func(addr api.WarehouseAddr, body []byte) error {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(body)
+			return wc.Commit(wareID)
+		}
+		read := func(addr api.WarehouseAddr) ([]byte, error) {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+
+		Convey("a small ware should go up in one put, at its content-addressed name", func() {
+			So(write("ca+azblob://acct/ctr/pre/fix", []byte("small")), ShouldBeNil)
+			So(fake.blobs, ShouldContainKey, "pre/fix/abc/def/abcdefghijklmnop")
+			So(fake.requests, ShouldResemble, []string{"PUT /acct/ctr/pre/fix/abc/def/abcdefghijklmnop "})
+			body, err := read("ca+azblob://acct/ctr/pre/fix")
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "small")
+		})
+		Convey("an empty ware should go up too", func() {
+			So(write("azblob://acct/ctr/ware.tgz", nil), ShouldBeNil)
+			So(fake.blobs, ShouldContainKey, "ware.tgz")
+		})
+		Convey("a large ware should go up in blocks", func() {
+			content := bytes.Repeat([]byte("0123456789"), 25)
+			So(write("azblob://acct/ctr/ware.tgz", content), ShouldBeNil)
+			So(fake.requests, ShouldHaveLength, 4) // three blocks, and the list.
+			body, err := read("azblob://acct/ctr/ware.tgz")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, content)
+		})
+		Convey("a failed block should commit nothing", func() {
+			fake.failBlock = 2
+			err := write("azblob://acct/ctr/ware.tgz", bytes.Repeat([]byte("0123456789"), 25))
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+			So(err.Error(), ShouldContainSubstring, "InternalError")
+			So(fake.blobs, ShouldBeEmpty)
+		})
+		Convey("an abandoned write should send nothing", func() {
+			whCtrl, err := NewController("azblob://acct/ctr/ware.tgz")
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			wc.Write([]byte("half"))
+			So(wc.Close(), ShouldBeNil)
+			So(fake.requests, ShouldBeEmpty)
+		})
+		Convey("reads from an offset should use a ranged get, or start over if past the end", func() {
+			So(write("azblob://acct/ctr/ware.tgz", []byte("small")), ShouldBeNil)
+			whCtrl, err := NewController("azblob://acct/ctr/ware.tgz")
+			So(err, ShouldBeNil)
+			for _, tr := range []struct {
+				offset, start int64
+				body          string
+			}{{2, 2, "all"}, {5, 0, "small"}} {
+				reader, start, err := whCtrl.(warehouse.BlobstoreRangeController).OpenReaderFrom(context.Background(), wareID, tr.offset)
+				So(err, ShouldBeNil)
+				body, err := ioutil.ReadAll(reader)
+				reader.Close()
+				So(err, ShouldBeNil)
+				So(start, ShouldEqual, tr.start)
+				So(string(body), ShouldEqual, tr.body)
+			}
+		})
+		Convey("a missing blob should be ware-not-found", func() {
+			_, err := read("azblob://acct/ctr/nope.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("a missing container should be warehouse-unavailable", func() {
+			_, err := read("azblob://acct/nope/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "ContainerNotFound")
+		})
+		Convey("a bad SAS token should be warehouse-unavailable", func() {
+			os.Setenv("AZURE_STORAGE_SAS_TOKEN", "sv=2020-10-02&sig=wrong")
+			_, err := read("azblob://acct/ctr/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "AuthenticationFailed")
+		})
+		Convey("a cancelled context should stop the fetch", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			whCtrl, err := NewController("azblob://acct/ctr/ware.tgz")
+			So(err, ShouldBeNil)
+			_, err = whCtrl.OpenReader(ctx, wareID)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+		})
+		Convey("addrs without a container, or a blob name, are refused, unless content-addressed", func() {
+			_, err := NewController("azblob://acct")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("azblob://acct/ctr")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("ca+azblob://acct/ctr")
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,302 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse on a WebDAV server.
+	The files are laid out just as kvfs lays them out on a local disk.
+
+	Addresses look like "davs://host/path/to/ware.tgz" (one ware, stored at
+	exactly that path) or "ca+davs://host/path" (content-addressed, each
+	ware at "path/abc/def/abcdefghij...").  "dav" and "ca+dav" are the same,
+	over plain HTTP.
+
+	Reading is plain HTTP, and is done just as kvhttp does it (resuming and
+	all).  TLS config and credentials are per host as for kvhttp, too: see
+	config.GetTLSCertsPath, and the warehouse/credentials package.
+*/
+package kvdav
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/lib/guid"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/credentials"
+	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreSizeController  = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+type Controller struct {
+	addr     api.WarehouseAddr // user's string retained for messages
+	baseUrl  *url.URL          // over http(s), as the requests go.
+	ctntAddr bool
+	reads    kvhttp.Controller // does all the reading.
+	client   *http.Client
+	authz    string // the Authorization header to send, if any.
+}
+
+/*
+	Initialize a new warehouse controller that operates on a WebDAV server.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses, or unusable TLS or credentials config
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr: addr,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs, and then swap in the http scheme.
+	//  - We extract whether or not it's content-addressible mode here.
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "dav":
+		u.Scheme = "http"
+	case "ca+dav":
+		u.Scheme = "http"
+		whCtrl.ctntAddr = true
+	case "davs":
+		u.Scheme = "https"
+	case "ca+davs":
+		u.Scheme = "https"
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'dav', 'ca+dav', 'davs', or 'ca+davs')", u.Scheme)
+	}
+	u.Path = path.Clean("/" + u.Path)
+	if u.Host == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "dav warehouse addr must name a host (e.g. 'davs://host/path')")
+	}
+	if u.Path == "/" && !whCtrl.ctntAddr {
+		return whCtrl, Errorf(rio.ErrUsage, "dav warehouse addr must name a file for the ware (e.g. 'davs://host/path'), unless it's content-addressed ('ca+davs://')")
+	}
+	whCtrl.baseUrl = u
+
+	// Reads go through kvhttp, at the same url.
+	httpAddr := u.String()
+	if whCtrl.ctntAddr {
+		httpAddr = "ca+" + httpAddr
+	}
+	reads, err := kvhttp.NewController(api.WarehouseAddr(httpAddr))
+	if err != nil {
+		return whCtrl, err
+	}
+	whCtrl.reads = reads.(kvhttp.Controller)
+
+	// Writes are up to us: figure out how to talk, and as whom.
+	whCtrl.client, err = util.HTTPClient(u)
+	if err != nil {
+		return whCtrl, err
+	}
+	cred, err := credentials.Lookup(u.Host)
+	if err != nil {
+		return whCtrl, err
+	}
+	switch {
+	case cred.Token != "":
+		whCtrl.authz = "Bearer " + cred.Token
+	case cred.Username != "":
+		whCtrl.authz = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Secret))
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's as costly as just starting the actual download.
+
+	return whCtrl, nil
+}
+
+// Where the ware is (or would be) on the server.
+func (whCtrl Controller) wareUrl(wareID api.WareID) *url.URL {
+	u := *whCtrl.baseUrl // copy: we mutate the path.
+	if whCtrl.ctntAddr {
+		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+		u.Path = path.Join(u.Path, chunkA, chunkB, wareID.Hash)
+	}
+	return &u
+}
+
+/*
+	Open a reader for the ware.  See kvhttp.Controller.OpenReader.
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	return whCtrl.reads.OpenReader(ctx, wareID)
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in.
+	See kvhttp.Controller.OpenReaderFrom.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (io.ReadCloser, int64, error) {
+	return whCtrl.reads.OpenReaderFrom(ctx, wareID, offset)
+}
+
+/*
+	Report the size of the ware.  See kvhttp.Controller.WareSize.
+*/
+func (whCtrl Controller) WareSize(ctx context.Context, wareID api.WareID) (int64, error) {
+	return whCtrl.reads.WareSize(ctx, wareID)
+}
+
+/*
+	Issue a request to the server, with our credentials, if we have any.
+	The body, if any, is sent with the given length.
+
+	Errors are of category `rio.ErrWarehouseUnwritable`: we only make
+	requests of our own to write.  None of what we ask for has a body
+	worth reading, so the response's is already closed.
+*/
+func (whCtrl Controller) do(method string, u *url.URL, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "failed to build request for warehouse %s: %s", whCtrl.addr, err)
+	}
+	req.ContentLength = length
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if whCtrl.authz != "" {
+		req.Header.Set("Authorization", whCtrl.authz)
+	}
+	resp, err := whCtrl.client.Do(req)
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+/*
+	Open a writer for a ware.
+
+	Nothing is sent to the server until commit -- since the name is the
+	hash, we can't know where it goes sooner -- so the data is staged in a
+	local temp file.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc := &WriteController{whCtrl: whCtrl}
+	file, err := ioutil.TempFile("", ".tmp.upload.dav.")
+	if err != nil {
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	wc.stream = file
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	stream *os.File   // Write to this.  (Local staging; removed on close.)
+	whCtrl Controller // Needed for the final upload.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.stream.Write(bs)
+}
+
+/*
+	Cancel the current write.  Close the stream, and remove the staging file.
+*/
+func (wc *WriteController) Close() error {
+	wc.stream.Close()
+	if err := os.Remove(wc.stream.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash, uploading it.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	The data is PUT to a temp file beside where the ware goes, and then
+	MOVEd into place; so the ware never appears half-uploaded.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	whCtrl := wc.whCtrl
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+	size, err := wc.stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	finalUrl := whCtrl.wareUrl(wareID)
+
+	// Make parent collections if necessary in content-addr mode.
+	//  One that's already there answers 405; one whose parent isn't, 409.
+	if whCtrl.ctntAddr {
+		for _, dir := range []string{path.Dir(path.Dir(finalUrl.Path)), path.Dir(finalUrl.Path)} {
+			u := *finalUrl
+			u.Path = dir + "/"
+			resp, err := whCtrl.do("MKCOL", &u, nil, nil, 0)
+			if err != nil {
+				return err
+			}
+			switch resp.StatusCode {
+			case 201, 405:
+				// pass
+			case 409:
+				return Errorf(rio.ErrWarehouseUnwritable, "%s: warehouse does not exist (no collection at %s)", what, path.Dir(dir))
+			default:
+				return Errorf(rio.ErrWarehouseUnwritable, "%s: creating collection %s: %s", what, dir, resp.Status)
+			}
+		}
+	}
+
+	// Upload beside the final path.
+	stageUrl := *finalUrl
+	stageUrl.Path = path.Join(path.Dir(finalUrl.Path), ".tmp.upload."+path.Base(finalUrl.Path)+"."+guid.New())
+	var body io.Reader = http.NoBody // so an empty ware is sent with a length, not chunked.
+	if size > 0 {
+		body = io.NewSectionReader(wc.stream, 0, size)
+	}
+	resp, err := whCtrl.do("PUT", &stageUrl, http.Header{"Content-Type": {"application/octet-stream"}}, body, size)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case 200, 201, 204:
+		// pass
+	case 409:
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: warehouse does not exist (no collection at %s)", what, path.Dir(stageUrl.Path))
+	default:
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, resp.Status)
+	}
+
+	// Move into place.
+	resp, err = whCtrl.do("MOVE", &stageUrl, http.Header{"Destination": {finalUrl.String()}, "Overwrite": {"T"}}, nil, 0)
+	if err == nil && resp.StatusCode != 201 && resp.StatusCode != 204 {
+		err = Errorf(rio.ErrWarehouseUnwritable, "%s: moving into place: %s", what, resp.Status)
+	}
+	if err != nil {
+		whCtrl.do("DELETE", &stageUrl, nil, nil, 0)
+		return err
+	}
+	return nil
+}
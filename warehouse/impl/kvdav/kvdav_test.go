@@ -0,0 +1,209 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvdav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Just enough of a WebDAV server to exercise the controller: files, and
+	collections (of which "/" and "/wares" exist to begin with).  Wants
+	"me:pw" for everything.
+*/
+type fakeDav struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	colls    map[string]bool
+	requests []string
+}
+
+func (f *fakeDav) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+	if user, pw, _ := req.BasicAuth(); user != "me" || pw != "pw" {
+		w.WriteHeader(401)
+		return
+	}
+	pth := path.Clean(req.URL.Path)
+	body, _ := ioutil.ReadAll(req.Body)
+	switch req.Method {
+	case "GET", "HEAD":
+		bs, ok := f.files[pth]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(bs))
+	case "PUT":
+		if !f.colls[path.Dir(pth)] {
+			w.WriteHeader(409)
+			return
+		}
+		f.files[pth] = body
+		w.WriteHeader(201)
+	case "MKCOL":
+		switch {
+		case f.colls[pth]:
+			w.WriteHeader(405)
+		case !f.colls[path.Dir(pth)]:
+			w.WriteHeader(409)
+		default:
+			f.colls[pth] = true
+			w.WriteHeader(201)
+		}
+	case "MOVE":
+		dest, err := url.Parse(req.Header.Get("Destination"))
+		bs, ok := f.files[pth]
+		switch {
+		case err != nil || dest.Host != req.Host:
+			w.WriteHeader(502)
+		case !ok:
+			w.WriteHeader(404)
+		case !f.colls[path.Dir(dest.Path)]:
+			w.WriteHeader(409)
+		case f.files[dest.Path] != nil && req.Header.Get("Overwrite") == "F":
+			w.WriteHeader(412)
+		default:
+			delete(f.files, pth)
+			f.files[dest.Path] = bs
+			w.WriteHeader(201)
+		}
+	case "DELETE":
+		delete(f.files, pth)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func TestKvdav(t *testing.T) {
+	Convey("kvdav warehouse, against a fake WebDAV server:", t, func() {
+		fake := &fakeDav{files: map[string][]byte{}, colls: map[string]bool{"/": true, "/wares": true}}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL)
+		host := u.Host
+		credsFile, err := ioutil.TempFile("", "rio-test-credentials")
+		So(err, ShouldBeNil)
+		defer os.Remove(credsFile.Name())
+		fmt.Fprintf(credsFile, `{"hosts": {%q: {"username": "me", "secret": "pw"}}}`, host)
+		credsFile.Close()
+		defer os.Setenv("RIO_CREDENTIALS_FILE", os.Getenv("RIO_CREDENTIALS_FILE"))
+		os.Setenv("RIO_CREDENTIALS_FILE", credsFile.Name())
+
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		write := func(addr string, body []byte) error {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(body)
+			return wc.Commit(wareID)
+		}
+		read := func(addr string) ([]byte, error) {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+
+		Convey("content-addressed: a ware should go up at its chunked path, and come back", func() {
+			So(write("ca+dav://"+host+"/wares", []byte("small")), ShouldBeNil)
+			So(fake.files, ShouldResemble, map[string][]byte{"/wares/abc/def/abcdefghijklmnop": []byte("small")})
+			So(fake.colls["/wares/abc/def"], ShouldBeTrue)
+			body, err := read("ca+dav://" + host + "/wares")
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "small")
+
+			Convey("and again, over the top of itself", func() {
+				So(write("ca+dav://"+host+"/wares", []byte("small")), ShouldBeNil)
+				So(fake.files, ShouldHaveLength, 1)
+			})
+		})
+		Convey("single-ware: a ware should go up at exactly its path", func() {
+			So(write("dav://"+host+"/wares/ware.tgz", nil), ShouldBeNil)
+			So(fake.files, ShouldContainKey, "/wares/ware.tgz")
+			So(fake.requests[0], ShouldStartWith, "PUT /wares/.tmp.upload.ware.tgz.")
+			So(fake.requests[1], ShouldStartWith, "MOVE /wares/.tmp.upload.ware.tgz.")
+		})
+		Convey("reads from an offset, and sizes, should work as for kvhttp", func() {
+			So(write("dav://"+host+"/wares/ware.tgz", []byte("small")), ShouldBeNil)
+			whCtrl, err := NewController(api.WarehouseAddr("dav://" + host + "/wares/ware.tgz"))
+			So(err, ShouldBeNil)
+			reader, start, err := whCtrl.(warehouse.BlobstoreRangeController).OpenReaderFrom(context.Background(), wareID, 2)
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			So(start, ShouldEqual, 2)
+			So(string(body), ShouldEqual, "all")
+			size, err := whCtrl.(warehouse.BlobstoreSizeController).WareSize(context.Background(), wareID)
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, 5)
+		})
+		Convey("a missing collection should be warehouse-unwritable, and leave nothing behind", func() {
+			err := write("ca+dav://"+host+"/nope", []byte("small"))
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+			So(err.Error(), ShouldContainSubstring, "does not exist")
+			err = write("dav://"+host+"/nope/ware.tgz", []byte("small"))
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+			So(fake.files, ShouldBeEmpty)
+		})
+		Convey("an abandoned write should send nothing", func() {
+			whCtrl, err := NewController(api.WarehouseAddr("dav://" + host + "/wares/ware.tgz"))
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			wc.Write([]byte("half"))
+			So(wc.Close(), ShouldBeNil)
+			So(fake.requests, ShouldBeEmpty)
+		})
+		Convey("a missing ware should be ware-not-found", func() {
+			_, err := read("dav://" + host + "/wares/nope.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("without credentials, reads should be warehouse-unavailable, and writes unwritable", func() {
+			os.Setenv("RIO_CREDENTIALS_FILE", credsFile.Name()+".nope")
+			_, err := read("dav://" + host + "/wares/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			err = write("dav://"+host+"/wares/ware.tgz", []byte("small"))
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+			So(strings.Join(fake.requests, "\n"), ShouldNotContainSubstring, "MOVE")
+		})
+		Convey("addrs without a host, or a file, are refused, unless content-addressed", func() {
+			_, err := NewController("davs:///wares/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("davs://example.com/")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("ca+davs://example.com/")
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -6,10 +6,13 @@ Sniperkit-Bot
 package kvfs
 
 import (
+	"context"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
@@ -22,6 +25,8 @@ import (
 
 var (
 	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreListController  = Controller{}
+	_ warehouse.BlobstoreSizeController  = Controller{}
 	_ warehouse.BlobstoreWriteController = &WriteController{}
 )
 
@@ -90,16 +95,8 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 	}
 }
 
-func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
-	finalPath := whCtrl.basePath
-	if whCtrl.ctntAddr {
-		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
-		finalPath = finalPath.
-			Join(fs.MustRelPath(chunkA)).
-			Join(fs.MustRelPath(chunkB)).
-			Join(fs.MustRelPath(wareID.Hash))
-	}
-	file, err := os.OpenFile(finalPath.String(), os.O_RDONLY, 0)
+func (whCtrl Controller) OpenReader(_ context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	file, err := os.OpenFile(whCtrl.warePath(wareID).String(), os.O_RDONLY, 0)
 	switch {
 	case err == nil:
 		return file, nil
@@ -110,6 +107,95 @@ func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
 	}
 }
 
+func (whCtrl Controller) WareSize(_ context.Context, wareID api.WareID) (int64, error) {
+	fi, err := os.Stat(whCtrl.warePath(wareID).String())
+	switch {
+	case err == nil:
+		return fi.Size(), nil
+	case os.IsNotExist(err):
+		return 0, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return 0, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, err)
+	}
+}
+
+// Where the ware is (or would be) on disk.
+func (whCtrl Controller) warePath(wareID api.WareID) fs.AbsolutePath {
+	if !whCtrl.ctntAddr {
+		return whCtrl.basePath
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return whCtrl.basePath.
+		Join(fs.MustRelPath(chunkA)).
+		Join(fs.MustRelPath(chunkB)).
+		Join(fs.MustRelPath(wareID.Hash))
+}
+
+/*
+	List the hashes of all the wares in a CA-mode warehouse, sorted.
+
+	Anything that isn't where a ware would be -- upload temp files, or files
+	in a dir that isn't the start of their name, as warePath would put them --
+	is skipped; so are files kept beside wares (with a "." in their name,
+	which hashes never have).  Whether the content matches the hash isn't checked; it's only
+	read from disk.
+*/
+func (whCtrl Controller) ListHashes(_ context.Context) ([]string, error) {
+	if !whCtrl.ctntAddr {
+		return nil, Errorf(rio.ErrUsage, "warehouse %s is not content-addressable, so its wares can't be listed", whCtrl.addr)
+	}
+	readDir := func(path string) ([]os.FileInfo, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s could not be listed: %s", whCtrl.addr, err)
+		}
+		defer f.Close()
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s could not be listed: %s", whCtrl.addr, err)
+		}
+		return fis, nil
+	}
+	var hashes []string
+	chunkAs, err := readDir(whCtrl.basePath.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, chunkA := range chunkAs {
+		if !chunkA.IsDir() || strings.HasPrefix(chunkA.Name(), ".tmp.") {
+			continue
+		}
+		chunkBs, err := readDir(filepath.Join(whCtrl.basePath.String(), chunkA.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, chunkB := range chunkBs {
+			if !chunkB.IsDir() {
+				continue
+			}
+			wares, err := readDir(filepath.Join(whCtrl.basePath.String(), chunkA.Name(), chunkB.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, ware := range wares {
+				if !ware.Mode().IsRegular() {
+					continue
+				}
+				hash := ware.Name()
+				if len(hash) < 6 || hash[:6] != chunkA.Name()+chunkB.Name() {
+					continue
+				}
+				if strings.Contains(hash, ".") { // Not a ware, but beside one: a seekable tar's index, say.
+					continue
+				}
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
 func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
 	wc := &WriteController{whCtrl: whCtrl}
 	// Pick a random upload path.
@@ -132,7 +218,7 @@ func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error
 }
 
 type WriteController struct {
-	stream    io.WriteCloser  // Write to this.
+	stream    *os.File        // Write to this.
 	whCtrl    Controller      // Needed for the final move-into-place.
 	stagePath fs.AbsolutePath // Needed for the final move-into-place.
 }
@@ -155,7 +241,13 @@ func (wc *WriteController) Close() error {
 	Closes the writer and invalidates any future use.
 */
 func (wc *WriteController) Commit(wareID api.WareID) error {
-	// Close the file.
+	// Flush and close the file.
+	//  The data must be on disk before the rename makes it visible: otherwise
+	//  a crash soon after could leave a truncated ware under a real name.
+	if err := wc.stream.Sync(); err != nil {
+		wc.stream.Close()
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to commit to file: %s", err)
+	}
 	if err := wc.stream.Close(); err != nil {
 		return Errorf(rio.ErrWarehouseUnwritable, "failed to commit to file: %s", err)
 	}
@@ -0,0 +1,127 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestKvfs(t *testing.T) {
+	Convey("kvfs warehouse:", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			wareID := api.WareID{"tar", "abcdefghijklmnop"}
+			write := func(addr api.WarehouseAddr, body string) error {
+				whCtrl, err := NewController(addr)
+				So(err, ShouldBeNil)
+				wc, err := whCtrl.OpenWriter()
+				So(err, ShouldBeNil)
+				defer wc.Close()
+				wc.Write([]byte(body))
+				return wc.Commit(wareID)
+			}
+			read := func(addr api.WarehouseAddr) (string, error) {
+				whCtrl, err := NewController(addr)
+				So(err, ShouldBeNil)
+				reader, err := whCtrl.OpenReader(context.Background(), wareID)
+				if err != nil {
+					return "", err
+				}
+				defer reader.Close()
+				bs, err := ioutil.ReadAll(reader)
+				return string(bs), err
+			}
+			lsTmpDir := func(sub string) []string {
+				fis, err := ioutil.ReadDir(tmpDir.String() + sub)
+				So(err, ShouldBeNil)
+				var names []string
+				for _, fi := range fis {
+					names = append(names, fi.Name())
+				}
+				return names
+			}
+
+			Convey("content-addressed: a committed ware lands at its hash, and reads back", func() {
+				So(os.Mkdir(tmpDir.String()+"/ca", 0755), ShouldBeNil)
+				addr := api.WarehouseAddr("ca+file://" + tmpDir.String() + "/ca")
+				So(write(addr, "content"), ShouldBeNil)
+				So(lsTmpDir("/ca/abc/def"), ShouldResemble, []string{"abcdefghijklmnop"})
+				body, err := read(addr)
+				So(err, ShouldBeNil)
+				So(body, ShouldEqual, "content")
+			})
+			Convey("single-file: a committed ware lands at the path, and reads back", func() {
+				addr := api.WarehouseAddr("file://" + tmpDir.String() + "/ware.tgz")
+				So(write(addr, "content"), ShouldBeNil)
+				So(lsTmpDir(""), ShouldResemble, []string{"ware.tgz"})
+				body, err := read(addr)
+				So(err, ShouldBeNil)
+				So(body, ShouldEqual, "content")
+			})
+			Convey("the size of a committed ware should be known without reading it", func() {
+				So(os.Mkdir(tmpDir.String()+"/ca", 0755), ShouldBeNil)
+				addr := api.WarehouseAddr("ca+file://" + tmpDir.String() + "/ca")
+				whCtrl, err := NewController(addr)
+				So(err, ShouldBeNil)
+				_, err = whCtrl.(Controller).WareSize(context.Background(), wareID)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+				So(write(addr, "content"), ShouldBeNil)
+				size, err := whCtrl.(Controller).WareSize(context.Background(), wareID)
+				So(err, ShouldBeNil)
+				So(size, ShouldEqual, len("content"))
+			})
+			Convey("content-addressed: listing should find committed wares, and nothing else", func() {
+				So(os.Mkdir(tmpDir.String()+"/ca", 0755), ShouldBeNil)
+				addr := api.WarehouseAddr("ca+file://" + tmpDir.String() + "/ca")
+				whCtrl, err := NewController(addr)
+				So(err, ShouldBeNil)
+				hashes, err := whCtrl.(Controller).ListHashes(context.Background())
+				So(err, ShouldBeNil)
+				So(hashes, ShouldBeEmpty)
+				So(write(addr, "content"), ShouldBeNil)
+				wc, err := whCtrl.OpenWriter() // left uncommitted.
+				So(err, ShouldBeNil)
+				defer wc.Close()
+				So(ioutil.WriteFile(tmpDir.String()+"/ca/abc/def/zzzdefgh", nil, 0644), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/ca/abc/def/abcdefghijklmnop.idx", nil, 0644), ShouldBeNil)
+				hashes, err = whCtrl.(Controller).ListHashes(context.Background())
+				So(err, ShouldBeNil)
+				So(hashes, ShouldResemble, []string{"abcdefghijklmnop"})
+			})
+			Convey("single-file: listing should be refused", func() {
+				whCtrl, err := NewController(api.WarehouseAddr("file://" + tmpDir.String() + "/ware.tgz"))
+				So(err, ShouldBeNil)
+				_, err = whCtrl.(Controller).ListHashes(context.Background())
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			})
+			Convey("an abandoned write should leave nothing visible", func() {
+				addr := api.WarehouseAddr("file://" + tmpDir.String() + "/ware.tgz")
+				whCtrl, err := NewController(addr)
+				So(err, ShouldBeNil)
+				wc, err := whCtrl.OpenWriter()
+				So(err, ShouldBeNil)
+				wc.Write([]byte("half"))
+				So(wc.Close(), ShouldBeNil)
+				So(lsTmpDir(""), ShouldBeEmpty)
+				_, err = read(addr)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+			})
+			Convey("a warehouse that doesn't exist should be unavailable", func() {
+				_, err := NewController(api.WarehouseAddr("ca+file://" + tmpDir.String() + "/nope"))
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			})
+		})
+	})
+}
@@ -0,0 +1,276 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvgs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+const (
+	scopeReadWrite   = "https://www.googleapis.com/auth/devstorage.read_write"
+	defaultTokenURI  = "https://oauth2.googleapis.com/token"
+	grantJWTBearer   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	grantRefreshUser = "refresh_token"
+)
+
+/*
+	Where access tokens come from, and the last one, kept until shortly
+	before it expires.  An auth with no fetch func is anonymous.
+*/
+type auth struct {
+	mu       sync.Mutex
+	fetch    func(ctx context.Context, client *http.Client) (token string, expires time.Time, err error)
+	optional bool // if fetching fails, go anonymous (for good) rather than erroring.
+	tok      string
+	expires  time.Time
+}
+
+/*
+	Return an access token, fetching a new one if need be;
+	or "" if we're anonymous.
+*/
+func (a *auth) token(ctx context.Context, client *http.Client) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fetch == nil {
+		return "", nil
+	}
+	if a.tok != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.tok, nil
+	}
+	tok, expires, err := a.fetch(ctx, client)
+	if err != nil {
+		if a.optional && ctx.Err() == nil {
+			a.fetch = nil
+			return "", nil
+		}
+		return "", err
+	}
+	a.tok, a.expires = tok, expires
+	return tok, nil
+}
+
+/*
+	Find credentials the way Google's tools do:
+
+	  - the key file named by `GOOGLE_APPLICATION_CREDENTIALS`;
+	  - else gcloud's application default credentials (as made by
+	    `gcloud auth application-default login`), in "~/.config/gcloud"
+	    or `CLOUDSDK_CONFIG`;
+	  - else the default service account, from the GCE metadata server
+	    (`GCE_METADATA_HOST` overrides where it is).
+
+	Key files may hold a service account key ("service_account") or a
+	user's refresh token ("authorized_user").  Other kinds are rejected.
+	Finding no metadata server is not an error: requests go anonymous.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- if a key file is named but unreadable, or unusable
+*/
+func loadAuth() (*auth, error) {
+	pth := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	named := pth != ""
+	if !named {
+		dir := os.Getenv("CLOUDSDK_CONFIG")
+		if dir == "" {
+			home, _ := os.UserHomeDir()
+			dir = filepath.Join(home, ".config", "gcloud")
+		}
+		pth = filepath.Join(dir, "application_default_credentials.json")
+	}
+	bs, err := ioutil.ReadFile(pth)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err) && !named:
+		return &auth{fetch: metadataToken, optional: true}, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "cannot read gcs credentials: %s", err)
+	}
+
+	var keyFile struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(bs, &keyFile); err != nil {
+		return nil, Errorf(rio.ErrUsage, "cannot parse gcs credentials file %q: %s", pth, err)
+	}
+	if keyFile.TokenURI == "" {
+		keyFile.TokenURI = defaultTokenURI
+	}
+	switch keyFile.Type {
+	case "service_account":
+		key, err := parsePrivateKey(keyFile.PrivateKey)
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "cannot use gcs credentials file %q: %s", pth, err)
+		}
+		return &auth{fetch: func(ctx context.Context, client *http.Client) (string, time.Time, error) {
+			assertion, err := signJWT(key, keyFile.ClientEmail, keyFile.TokenURI, time.Now())
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return exchangeToken(ctx, client, keyFile.TokenURI, url.Values{
+				"grant_type": {grantJWTBearer},
+				"assertion":  {assertion},
+			})
+		}}, nil
+	case "authorized_user":
+		return &auth{fetch: func(ctx context.Context, client *http.Client) (string, time.Time, error) {
+			return exchangeToken(ctx, client, keyFile.TokenURI, url.Values{
+				"grant_type":    {grantRefreshUser},
+				"client_id":     {keyFile.ClientID},
+				"client_secret": {keyFile.ClientSecret},
+				"refresh_token": {keyFile.RefreshToken},
+			})
+		}}, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "cannot use gcs credentials file %q: unsupported type %q", pth, keyFile.Type)
+	}
+}
+
+/*
+	Parse a service account's private key: PEM, holding PKCS#8
+	(as Google issues them) or PKCS#1.
+*/
+func parsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key: %s", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+/*
+	Make the signed JWT a service account trades for an access token:
+	it claims the storage read-write scope, for an hour from now.
+*/
+func signJWT(key *rsa.PrivateKey, email, audience string, now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": scopeReadWrite,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot sign token request: %s", err)
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// What token endpoints, and the metadata server, answer with.
+type tokenMsg struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (msg tokenMsg) token() (string, time.Time, error) {
+	if msg.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access token granted")
+	}
+	return msg.AccessToken, time.Now().Add(time.Duration(msg.ExpiresIn) * time.Second), nil
+}
+
+/*
+	POST a grant to an OAuth token endpoint, and return the access token.
+*/
+func exchangeToken(ctx context.Context, client *http.Client, tokenURI string, form url.Values) (string, time.Time, error) {
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var msg tokenMsg
+	if err := getJSON(client, req.WithContext(ctx), &msg); err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange with %s: %s", tokenURI, err)
+	}
+	return msg.token()
+}
+
+// The metadata server answers fast, if it's there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+/*
+	Fetch an access token for the instance's default service account
+	from the GCE metadata server.
+*/
+func metadataToken(ctx context.Context, _ *http.Client) (string, time.Time, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var msg tokenMsg
+	if err := getJSON(metadataClient, req.WithContext(ctx), &msg); err != nil {
+		return "", time.Time{}, fmt.Errorf("metadata server: %s", err)
+	}
+	return msg.token()
+}
+
+func getJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(bs)))
+	}
+	return json.Unmarshal(bs, v)
+}
@@ -0,0 +1,138 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvgs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestLoadAuth(t *testing.T) {
+	Convey("loading credentials:", t, func() {
+		tmpDir, err := ioutil.TempDir("", "kvgs-creds")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpDir)
+		// Unset everything that could find real credentials; each case sets what it uses.
+		for _, k := range []string{"GOOGLE_APPLICATION_CREDENTIALS", "CLOUDSDK_CONFIG", "GCE_METADATA_HOST"} {
+			defer os.Setenv(k, os.Getenv(k))
+			os.Unsetenv(k)
+		}
+		os.Setenv("CLOUDSDK_CONFIG", tmpDir)
+		os.Setenv("GCE_METADATA_HOST", "127.0.0.1:1")
+		ctx := context.Background()
+
+		// A token endpoint, checking grants as Google's would.
+		var grants []map[string]string
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		So(err, ShouldBeNil)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.ParseForm()
+			switch req.Form.Get("grant_type") {
+			case grantJWTBearer:
+				parts := strings.Split(req.Form.Get("assertion"), ".")
+				if len(parts) != 3 {
+					w.WriteHeader(400)
+					return
+				}
+				sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+				digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+				if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+					w.WriteHeader(400)
+					return
+				}
+				claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+				var grant map[string]interface{}
+				json.Unmarshal(claims, &grant)
+				grants = append(grants, map[string]string{"iss": grant["iss"].(string), "aud": grant["aud"].(string)})
+				fmt.Fprint(w, `{"access_token": "sa-token", "expires_in": 3600, "token_type": "Bearer"}`)
+			case grantRefreshUser:
+				grants = append(grants, map[string]string{"client_id": req.Form.Get("client_id"), "refresh_token": req.Form.Get("refresh_token")})
+				fmt.Fprint(w, `{"access_token": "user-token", "expires_in": 3600, "token_type": "Bearer"}`)
+			default:
+				w.WriteHeader(400)
+			}
+		}))
+		defer srv.Close()
+
+		Convey("a service account key should be traded for a token, and the token kept", func() {
+			pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+			keyFile, _ := json.Marshal(map[string]string{
+				"type":         "service_account",
+				"client_email": "rio@example.iam.gserviceaccount.com",
+				"private_key":  string(pemKey),
+				"token_uri":    srv.URL + "/token",
+			})
+			So(ioutil.WriteFile(tmpDir+"/key.json", keyFile, 0600), ShouldBeNil)
+			os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", tmpDir+"/key.json")
+			a, err := loadAuth()
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				tok, err := a.token(ctx, http.DefaultClient)
+				So(err, ShouldBeNil)
+				So(tok, ShouldEqual, "sa-token")
+			}
+			So(grants, ShouldResemble, []map[string]string{{"iss": "rio@example.iam.gserviceaccount.com", "aud": srv.URL + "/token"}})
+		})
+		Convey("gcloud's application default credentials should be refreshed", func() {
+			So(ioutil.WriteFile(tmpDir+"/application_default_credentials.json", []byte(fmt.Sprintf(
+				`{"type": "authorized_user", "client_id": "cid", "client_secret": "cs", "refresh_token": "rt", "token_uri": %q}`,
+				srv.URL+"/token",
+			)), 0600), ShouldBeNil)
+			a, err := loadAuth()
+			So(err, ShouldBeNil)
+			tok, err := a.token(ctx, http.DefaultClient)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "user-token")
+			So(grants, ShouldResemble, []map[string]string{{"client_id": "cid", "refresh_token": "rt"}})
+		})
+		Convey("a named key file that's missing should be a usage error", func() {
+			os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", tmpDir+"/nope.json")
+			_, err := loadAuth()
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+		Convey("the metadata server's token should be used, if it's there", func() {
+			meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("Metadata-Flavor") != "Google" || req.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+					w.WriteHeader(403)
+					return
+				}
+				fmt.Fprint(w, `{"access_token": "gce-token", "expires_in": 3600, "token_type": "Bearer"}`)
+			}))
+			defer meta.Close()
+			os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(meta.URL, "http://"))
+			a, err := loadAuth()
+			So(err, ShouldBeNil)
+			tok, err := a.token(ctx, http.DefaultClient)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "gce-token")
+		})
+		Convey("finding nothing should go anonymous", func() {
+			a, err := loadAuth()
+			So(err, ShouldBeNil)
+			tok, err := a.token(ctx, http.DefaultClient)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,453 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse in a Google Cloud Storage bucket.
+
+	Addresses look like "gs://bucket/path/to/ware.tgz" (one ware, stored at
+	exactly that object name) or "ca+gs://bucket/prefix" (content-addressed,
+	each ware at "prefix/abc/def/abcdefghij..." just as in kvfs).
+
+	Credentials are found as Google's own tools find them (see loadAuth):
+	a service account key or gcloud's application default credentials, or
+	else the metadata server, when running in GCP.  To aim at an emulator
+	(such as fake-gcs-server), set `STORAGE_EMULATOR_HOST`; no credentials
+	are sent there.
+
+	Uploads are resumable uploads, sent in chunks: a chunk that fails is
+	picked up again from wherever GCS says it got to, rather than starting
+	the whole ware over.
+
+	This speaks the GCS JSON API directly, rather than via Google's client
+	libraries: we need a handful of its calls, and none of the rest.
+*/
+package kvgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+/*
+	Uploads are sent in chunks of this size.
+	(GCS wants every chunk but the last to be a multiple of 256KiB.)
+*/
+var chunkSize int64 = 8 << 20
+
+/*
+	How many times a failed chunk is tried again before the upload is given up on.
+*/
+var chunkRetries = 3
+
+type Controller struct {
+	addr     api.WarehouseAddr // user's string retained for messages
+	bucket   string
+	name     string // the object name in single-ware mode; the name prefix in CA mode.
+	ctntAddr bool
+	endpoint string
+	auth     *auth
+	client   *http.Client
+}
+
+/*
+	Initialize a new warehouse controller that operates on a GCS bucket.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses, or unusable credentials
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr:     addr,
+		endpoint: "https://storage.googleapis.com",
+		client:   http.DefaultClient,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs; the host is the bucket.
+	//  - We extract whether or not it's content-addressible mode here;
+	//  - and extract the object name (or name prefix).
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "gs":
+	case "ca+gs":
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'gs' or 'ca+gs')", u.Scheme)
+	}
+	whCtrl.bucket = u.Host
+	whCtrl.name = strings.Trim(u.Path, "/")
+	if whCtrl.bucket == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "gs warehouse addr must name a bucket (e.g. 'gs://bucket/path')")
+	}
+	if whCtrl.name == "" && !whCtrl.ctntAddr {
+		return whCtrl, Errorf(rio.ErrUsage, "gs warehouse addr must name an object for the ware (e.g. 'gs://bucket/path'), unless it's content-addressed ('ca+gs://')")
+	}
+
+	// Figure out where to talk to, and as whom.
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		whCtrl.endpoint = strings.TrimSuffix(emulator, "/")
+		whCtrl.auth = &auth{}
+	} else {
+		whCtrl.auth, err = loadAuth()
+		if err != nil {
+			return whCtrl, err
+		}
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's as costly as just starting the actual download.
+
+	return whCtrl, nil
+}
+
+func (whCtrl Controller) objectName(wareID api.WareID) string {
+	if !whCtrl.ctntAddr {
+		return whCtrl.name
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return path.Join(whCtrl.name, chunkA, chunkB, wareID.Hash)
+}
+
+/*
+	Issue a request, with our credentials, if we have any.
+
+	Errors are of the given category (or `rio.ErrCancelled`), and say
+	whether the request even got as far as being sent: failing to get a
+	token isn't something sending it again can fix.
+*/
+func (whCtrl Controller) do(ctx context.Context, req *http.Request, category rio.ErrorCategory) (_ *http.Response, sent bool, _ error) {
+	token, err := whCtrl.auth.token(ctx, whCtrl.client)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, false, Errorf(category, "cannot authenticate to warehouse %s: %s", whCtrl.addr, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := whCtrl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, true, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, true, Errorf(category, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	return resp, true, nil
+}
+
+/*
+	What GCS says went wrong: it explains itself in a JSON body
+	(or, for some media requests, plain text).
+	Reading it closes the response body.
+*/
+type gsError struct {
+	Status  string
+	Message string
+}
+
+func readGSError(resp *http.Response) (gserr gsError) {
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var msg struct {
+		Error struct {
+			Message string
+		}
+	}
+	if json.Unmarshal(bs, &msg) == nil {
+		gserr.Message = msg.Error.Message
+	} else {
+		gserr.Message = strings.TrimSpace(string(bs))
+	}
+	gserr.Status = resp.Status
+	return
+}
+
+func (e gsError) String() string {
+	if e.Message == "" {
+		return "unexpected HTTP code: " + e.Status
+	}
+	return fmt.Sprintf("%s (%s)", e.Status, e.Message)
+}
+
+/*
+	Open a reader for the ware.  The body is streamed, not buffered; the
+	request (and every read after it) is bound to the context.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if there's no such object
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, a missing bucket, denied access, and so on
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in, with a ranged
+	GET.  An offset past the end starts over from zero instead; `start`
+	reports where the stream actually begins.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	u := whCtrl.endpoint + "/storage/v1/b/" + url.PathEscape(whCtrl.bucket) + "/o/" + url.PathEscape(whCtrl.objectName(wareID)) + "?alt=media"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, Errorf(rio.ErrUsage, "failed to build request for warehouse %s: %s", whCtrl.addr, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, _, err := whCtrl.do(ctx, req, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return &bodyReader{ctx, resp.Body}, 0, nil
+	case 206:
+		return &bodyReader{ctx, resp.Body}, offset, nil
+	case 416:
+		resp.Body.Close()
+		return whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	case 404:
+		// A missing bucket is also a 404; that's the warehouse missing, not the ware.
+		if gserr := readGSError(resp); strings.Contains(gserr.Message, "bucket does not exist") {
+			return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s does not exist: %s", whCtrl.addr, gserr)
+		}
+		return nil, 0, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, readGSError(resp))
+	}
+}
+
+// Reports read errors caused by cancellation as such.
+type bodyReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *bodyReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		return n, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	}
+	return n, err
+}
+
+/*
+	Open a writer for a ware.
+
+	Nothing is sent to GCS until commit -- since the name is the hash, we
+	can't know it sooner -- so the data is staged in a local temp file.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc := &WriteController{whCtrl: whCtrl}
+	file, err := ioutil.TempFile("", ".tmp.upload.gs.")
+	if err != nil {
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	wc.stream = file
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	stream *os.File   // Write to this.  (Local staging; removed on close.)
+	whCtrl Controller // Needed for the final upload.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.stream.Write(bs)
+}
+
+/*
+	Cancel the current write.  Close the stream, and remove the staging file.
+*/
+func (wc *WriteController) Close() error {
+	wc.stream.Close()
+	if err := os.Remove(wc.stream.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash, uploading it.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	The upload is a resumable upload session, sent chunkSize at a time.
+	Should a chunk fail (a dropped connection, or a 5xx), GCS is asked how
+	much it has, and the upload carries on from there; after chunkRetries
+	failures in a row, the session is cancelled, so GCS drops what it has.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	whCtrl := wc.whCtrl
+	ctx := context.Background()
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+	size, err := wc.stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+
+	// Start the upload session.
+	u := whCtrl.endpoint + "/upload/storage/v1/b/" + url.PathEscape(whCtrl.bucket) + "/o?uploadType=resumable&name=" + url.QueryEscape(whCtrl.objectName(wareID))
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, _, err := whCtrl.do(ctx, req, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readGSError(resp))
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: could not start resumable upload: no session URI", what)
+	}
+
+	// Send the chunks.
+	var offset int64
+	for failures := 0; ; {
+		length := chunkSize
+		if size-offset < length {
+			length = size - offset
+		}
+		done, next, err := wc.sendChunk(ctx, session, offset, length, size)
+		if err == nil {
+			if done {
+				return nil
+			}
+			offset, failures = next, 0
+			continue
+		}
+		if !isRetriable(err) || failures >= chunkRetries {
+			wc.cancelUpload(ctx, session)
+			return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, unwrapRetriable(err))
+		}
+		failures++
+		// Ask where the upload got to, and carry on from there.
+		done, next, err = wc.sendChunk(ctx, session, -1, 0, size)
+		switch {
+		case err == nil && done:
+			return nil
+		case err == nil:
+			offset = next
+		case !isRetriable(err):
+			wc.cancelUpload(ctx, session)
+			return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, unwrapRetriable(err))
+		}
+	}
+}
+
+// A chunk that failed in a way that trying again might fix.
+type retriableError struct{ error }
+
+func isRetriable(err error) bool {
+	_, ok := err.(retriableError)
+	return ok
+}
+
+func unwrapRetriable(err error) error {
+	if re, ok := err.(retriableError); ok {
+		return re.error
+	}
+	return err
+}
+
+/*
+	PUT a chunk of the staging file to the upload session, and return
+	whether the upload is now complete, and if not, how much GCS has.
+	An offset of -1 sends nothing: it only asks how much GCS has.
+*/
+func (wc *WriteController) sendChunk(ctx context.Context, session string, offset, length, size int64) (done bool, next int64, err error) {
+	var body io.Reader
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if offset >= 0 && length > 0 {
+		body = io.NewSectionReader(wc.stream, offset, length)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+	}
+	req, err := http.NewRequest("PUT", session, body)
+	if err != nil {
+		return false, 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Range", contentRange)
+	resp, sent, err := wc.whCtrl.do(ctx, req, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		if sent {
+			return false, 0, retriableError{err}
+		}
+		return false, 0, err
+	}
+	switch {
+	case resp.StatusCode == 200, resp.StatusCode == 201:
+		resp.Body.Close()
+		return true, size, nil
+	case resp.StatusCode == 308:
+		resp.Body.Close()
+		// "Range: bytes=0-N" says it has through N; no Range, that it has nothing.
+		var last int64
+		if n, _ := fmt.Sscanf(resp.Header.Get("Range"), "bytes=0-%d", &last); n == 1 {
+			return false, last + 1, nil
+		}
+		return false, 0, nil
+	case resp.StatusCode == 429, resp.StatusCode >= 500:
+		return false, 0, retriableError{fmt.Errorf("%s", readGSError(resp))}
+	default:
+		return false, 0, fmt.Errorf("%s", readGSError(resp))
+	}
+}
+
+/*
+	Cancel an upload session, so GCS drops what it has of it.
+	Errors are ignored: this is only ever cleanup after some other error.
+*/
+func (wc *WriteController) cancelUpload(ctx context.Context, session string) {
+	req, err := http.NewRequest("DELETE", session, nil)
+	if err != nil {
+		return
+	}
+	if resp, _, err := wc.whCtrl.do(ctx, req, rio.ErrWarehouseUnwritable); err == nil {
+		resp.Body.Close()
+	}
+}
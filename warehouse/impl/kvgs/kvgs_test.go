@@ -0,0 +1,250 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvgs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Just enough of GCS to exercise the controller: objects, and resumable
+	uploads, in bucket "bkt".  Like an emulator, it wants no credentials.
+*/
+type fakeGCS struct {
+	mu         sync.Mutex
+	url        string
+	objects    map[string][]byte
+	sessions   map[string]*fakeSession
+	cancelled  []string
+	failChunks int  // refuse this many chunks, with a 503.
+	keepFailed bool // ... but keep what they sent, as if only the reply was lost.
+	requests   []string
+}
+
+type fakeSession struct {
+	name string
+	size int
+	have []byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.RequestURI())
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, msg)
+	}
+	if req.Header.Get("Authorization") != "" {
+		fail(400, "emulators want no credentials")
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	pth := req.URL.EscapedPath()
+	switch {
+	case req.Method == "GET" && strings.HasPrefix(pth, "/storage/v1/b/"):
+		parts := strings.SplitN(strings.TrimPrefix(pth, "/storage/v1/b/"), "/o/", 2)
+		if parts[0] != "bkt" {
+			fail(404, "The specified bucket does not exist.")
+			return
+		}
+		name, _ := url.PathUnescape(parts[1])
+		bs, ok := f.objects[name]
+		if !ok {
+			fail(404, "No such object: bkt/"+name)
+			return
+		}
+		var start int
+		if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); n == 1 {
+			if start >= len(bs) {
+				fail(416, "The requested range cannot be satisfied.")
+				return
+			}
+			w.WriteHeader(206)
+			bs = bs[start:]
+		}
+		w.Write(bs)
+	case req.Method == "POST" && pth == "/upload/storage/v1/b/bkt/o":
+		var size int
+		fmt.Sscanf(req.Header.Get("X-Upload-Content-Length"), "%d", &size)
+		id := fmt.Sprintf("session-%d", len(f.sessions))
+		f.sessions[id] = &fakeSession{name: req.URL.Query().Get("name"), size: size}
+		w.Header().Set("Location", f.url+"/sessions/"+id)
+	case req.Method == "PUT" && strings.HasPrefix(pth, "/sessions/"):
+		id := strings.TrimPrefix(pth, "/sessions/")
+		sess, ok := f.sessions[id]
+		if !ok {
+			fail(404, "No such upload")
+			return
+		}
+		var first, last, size int
+		if n, _ := fmt.Sscanf(req.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); n == 3 {
+			if f.failChunks > 0 {
+				f.failChunks--
+				if f.keepFailed && first == len(sess.have) {
+					sess.have = append(sess.have, body...)
+				}
+				fail(503, "Backend Error")
+				return
+			}
+			if first != len(sess.have) || last-first+1 != len(body) {
+				fail(400, "chunk out of order")
+				return
+			}
+			sess.have = append(sess.have, body...)
+		}
+		if len(sess.have) == sess.size {
+			f.objects[sess.name] = sess.have
+			delete(f.sessions, id)
+			fmt.Fprintf(w, `{"name":%q}`, sess.name)
+			return
+		}
+		if len(sess.have) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(sess.have)-1))
+		}
+		w.WriteHeader(308)
+	case req.Method == "DELETE" && strings.HasPrefix(pth, "/sessions/"):
+		id := strings.TrimPrefix(pth, "/sessions/")
+		delete(f.sessions, id)
+		f.cancelled = append(f.cancelled, id)
+		w.WriteHeader(499)
+	default:
+		fail(400, "not implemented")
+	}
+}
+
+func TestKvgs(t *testing.T) {
+	Convey("kvgs warehouse, against a fake GCS:", t, func() {
+		fake := &fakeGCS{objects: map[string][]byte{}, sessions: map[string]*fakeSession{}}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+		fake.url = srv.URL
+		defer os.Setenv("STORAGE_EMULATOR_HOST", os.Getenv("STORAGE_EMULATOR_HOST"))
+		os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+		defer func(v int64) { chunkSize = v }(chunkSize)
+		chunkSize = 100
+
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		write := func(addr api.WarehouseAddr, body []byte) error {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(body)
+			return wc.Commit(wareID)
+		}
+		read := func(addr api.WarehouseAddr) ([]byte, error) {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+		content := bytes.Repeat([]byte("0123456789"), 25)
+
+		Convey("a ware should go up in chunks, at its content-addressed name", func() {
+			So(write("ca+gs://bkt/pre/fix", content), ShouldBeNil)
+			So(fake.objects, ShouldContainKey, "pre/fix/abc/def/abcdefghijklmnop")
+			So(fake.requests, ShouldHaveLength, 4) // start, three chunks.
+			So(fake.sessions, ShouldBeEmpty)
+			body, err := read("ca+gs://bkt/pre/fix")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, content)
+		})
+		Convey("an empty ware should go up too", func() {
+			So(write("gs://bkt/ware.tgz", nil), ShouldBeNil)
+			So(fake.objects, ShouldContainKey, "ware.tgz")
+			So(fake.objects["ware.tgz"], ShouldBeEmpty)
+		})
+		Convey("a failed chunk should be picked up from where GCS got to", func() {
+			fake.failChunks, fake.keepFailed = 1, true
+			So(write("gs://bkt/ware.tgz", content), ShouldBeNil)
+			So(fake.objects["ware.tgz"], ShouldResemble, content)
+			// start, the failed chunk, asking how far it got, and only the two chunks after.
+			So(fake.requests, ShouldHaveLength, 5)
+		})
+		Convey("a chunk that keeps failing should cancel the upload", func() {
+			fake.failChunks = 100
+			err := write("gs://bkt/ware.tgz", content)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+			So(err.Error(), ShouldContainSubstring, "Backend Error")
+			So(fake.cancelled, ShouldResemble, []string{"session-0"})
+			So(fake.sessions, ShouldBeEmpty)
+			So(fake.objects, ShouldBeEmpty)
+		})
+		Convey("an abandoned write should send nothing", func() {
+			whCtrl, err := NewController("gs://bkt/ware.tgz")
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			wc.Write([]byte("half"))
+			So(wc.Close(), ShouldBeNil)
+			So(fake.requests, ShouldBeEmpty)
+		})
+		Convey("reads from an offset should use a ranged get, or start over if past the end", func() {
+			So(write("gs://bkt/ware.tgz", []byte("small")), ShouldBeNil)
+			whCtrl, err := NewController("gs://bkt/ware.tgz")
+			So(err, ShouldBeNil)
+			for _, tr := range []struct {
+				offset, start int64
+				body          string
+			}{{2, 2, "all"}, {5, 0, "small"}} {
+				reader, start, err := whCtrl.(warehouse.BlobstoreRangeController).OpenReaderFrom(context.Background(), wareID, tr.offset)
+				So(err, ShouldBeNil)
+				body, err := ioutil.ReadAll(reader)
+				reader.Close()
+				So(err, ShouldBeNil)
+				So(start, ShouldEqual, tr.start)
+				So(string(body), ShouldEqual, tr.body)
+			}
+		})
+		Convey("a missing object should be ware-not-found", func() {
+			_, err := read("gs://bkt/nope.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("a missing bucket should be warehouse-unavailable", func() {
+			_, err := read("gs://nope/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "bucket does not exist")
+		})
+		Convey("a cancelled context should stop the fetch", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			whCtrl, err := NewController("gs://bkt/ware.tgz")
+			So(err, ShouldBeNil)
+			_, err = whCtrl.OpenReader(ctx, wareID)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+		})
+		Convey("addrs without an object name are refused, unless content-addressed", func() {
+			_, err := NewController("gs://bkt")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("ca+gs://bkt")
+			So(err, ShouldBeNil)
+			_, err = NewController("gs:///ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+	})
+}
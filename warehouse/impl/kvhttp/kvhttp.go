@@ -6,6 +6,9 @@ Sniperkit-Bot
 package kvhttp
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -15,26 +18,39 @@ import (
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/credentials"
 	"go.polydawn.net/rio/warehouse/util"
 )
 
 var (
-	_ warehouse.BlobstoreController = Controller{}
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreSizeController  = Controller{}
 )
 
 type Controller struct {
 	addr     api.WarehouseAddr // user's string retained for messages
 	baseUrl  *url.URL
 	ctntAddr bool
+	client   *http.Client
+	authz    string // the Authorization header to send, if any.
 }
 
 /*
-	Initialize a new warehouse controller that operates on a local filesystem.
+	Initialize a new warehouse controller that reads over HTTP(S).
 
 	May return errors of category:
 
-	  - `rio.ErrUsage` -- for unsupported addressses
+	  - `rio.ErrUsage` -- for unsupported addressses, or unusable TLS config
 	  - `rio.ErrWarehouseUnavailable` -- if the warehouse doesn't exist
+
+	For HTTPS, the CAs to trust and the client certificate to present (for
+	servers that want mutual TLS) can be configured per host; see
+	config.GetTLSCertsPath.
+
+	Unless the addr has a user and password in it, the host's credentials
+	(see the warehouse/credentials package) are sent: a token as a bearer
+	token, or else the username and secret for basic auth.
 */
 func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
 	// Stamp out a warehouse handle.
@@ -64,6 +80,22 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'http', 'ca+http', 'https', or 'ca+https')", u.Scheme)
 	}
 	whCtrl.baseUrl = u
+	whCtrl.client, err = util.HTTPClient(u)
+	if err != nil {
+		return whCtrl, err
+	}
+	if u.User == nil {
+		cred, err := credentials.Lookup(u.Host)
+		if err != nil {
+			return whCtrl, err
+		}
+		switch {
+		case cred.Token != "":
+			whCtrl.authz = "Bearer " + cred.Token
+		case cred.Username != "":
+			whCtrl.authz = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Secret))
+		}
+	}
 
 	// We skip checking that the warehouse exists.
 	//  It's as costly as just starting the actual download.
@@ -71,28 +103,215 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 	return whCtrl, nil
 }
 
-func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
-	u := whCtrl.baseUrl
+/*
+	Open a reader for the ware.
+
+	The request (and every read after it) is bound to the context:
+	cancelling it aborts the download, returning `rio.ErrCancelled`.
+
+	If the connection breaks partway through the body, the reader asks for
+	the rest with a `Range` request and carries on, up to `maxResumes` times.
+	If the server doesn't honor the range (or the ware changed under us,
+	per `If-Range`), the read fails rather than starting over silently.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- for a 404
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, or any other non-200 response
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in, with a `Range`
+	request.  If the server answers with the whole ware instead (it doesn't
+	do ranges), or says the range is unsatisfiable, the stream starts from
+	zero; `start` reports which.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	r := &resumingReader{
+		ctx:    ctx,
+		client: whCtrl.client,
+		authz:  whCtrl.authz,
+		url:    whCtrl.wareUrl(wareID),
+		addr:   whCtrl.addr,
+		wareID: wareID,
+		offset: offset,
+	}
+	if err := r.get(true); err != nil {
+		return nil, 0, err
+	}
+	return r, r.offset, nil
+}
+
+/*
+	Report the size of the ware, from the `Content-Length` of a HEAD request,
+	without fetching it.  Errors are as for OpenReader; a server that doesn't
+	say how long the ware is gives `rio.ErrWarehouseUnavailable`.
+*/
+func (whCtrl Controller) WareSize(ctx context.Context, wareID api.WareID) (int64, error) {
+	req, err := http.NewRequest("HEAD", whCtrl.wareUrl(wareID), nil)
+	if err != nil {
+		return 0, Errorf(rio.ErrUsage, "failed to build request for warehouse %s: %s", whCtrl.addr, err)
+	}
+	if whCtrl.authz != "" {
+		req.Header.Set("Authorization", whCtrl.authz)
+	}
+	resp, err := whCtrl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return 0, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == 404:
+		return 0, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	case resp.StatusCode != 200:
+		return 0, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", whCtrl.addr, resp.Status)
+	case resp.ContentLength < 0:
+		return 0, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s did not report the size of ware %s", whCtrl.addr, wareID)
+	}
+	return resp.ContentLength, nil
+}
+
+func (whCtrl Controller) wareUrl(wareID api.WareID) string {
+	u := *whCtrl.baseUrl // copy: we mutate the path.
 	if whCtrl.ctntAddr {
 		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
 		u.Path = path.Join(u.Path, chunkA, chunkB, wareID.Hash)
 	}
-	resp, err := http.Get(u.String())
+	return u.String()
+}
+
+// How many times a broken body download will be resumed before we give up.
+const maxResumes = 3
+
+type resumingReader struct {
+	ctx    context.Context
+	client *http.Client
+	authz  string
+	url    string
+	addr   api.WarehouseAddr
+	wareID api.WareID
+
+	body    io.ReadCloser // current response body.
+	offset  int64         // bytes handed out so far; where a resume starts.
+	etag    string        // validator from the first response (ETag, or else Last-Modified); guards resumes, if present.
+	resumes int
+}
+
+/*
+	Issue a request for the ware, starting from the current offset,
+	and set the body to read from.
+
+	On the first request, the server may decline the range and start from
+	zero; after that, it must follow on exactly, or we fail.  A partial
+	response must start where we asked, per its `Content-Range`.
+*/
+func (r *resumingReader) get(first bool) error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "failed to build request for warehouse %s: %s", r.addr, err)
+	}
+	req = req.WithContext(r.ctx)
+	if r.authz != "" {
+		req.Header.Set("Authorization", r.authz)
+	}
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		if r.etag != "" {
+			req.Header.Set("If-Range", r.etag)
+		}
+	}
+	resp, err := r.client.Do(req)
 	if err != nil {
-		return nil, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+		if r.ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", r.addr, err)
 	}
-	switch resp.StatusCode {
-	case 200:
-		return resp.Body, nil
-	case 404:
+	switch {
+	case (r.offset == 0 || first) && resp.StatusCode == 200:
+		r.offset = 0
+		r.etag = validator(resp)
+	case r.offset > 0 && resp.StatusCode == 206:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != r.offset {
+			resp.Body.Close()
+			return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s answered a request for bytes from %d with the wrong range (%q)", r.addr, r.offset, resp.Header.Get("Content-Range"))
+		}
+		if first {
+			r.etag = validator(resp)
+		}
+	case first && resp.StatusCode == 416:
 		resp.Body.Close()
-		return nil, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+		r.offset = 0
+		return r.get(true)
+	case r.offset > 0 && resp.StatusCode == 200:
+		resp.Body.Close()
+		return Errorf(rio.ErrWarehouseUnavailable, "download from warehouse %s broke after %d bytes, and could not be resumed (server ignored the range, or the ware changed)", r.addr, r.offset)
+	case resp.StatusCode == 404:
+		resp.Body.Close()
+		return Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", r.wareID, r.addr)
 	default:
 		resp.Body.Close()
-		return nil, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", whCtrl.addr, resp.Status)
+		return Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", r.addr, resp.Status)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+/*
+	Pick what to send in `If-Range` when resuming: the ETag if there is one;
+	or else the Last-Modified date, which is good enough for static files.
+*/
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag
 	}
+	return resp.Header.Get("Last-Modified")
 }
 
+func (r *resumingReader) Read(bs []byte) (int, error) {
+	for {
+		n, err := r.body.Read(bs)
+		r.offset += int64(n)
+		switch {
+		case err == nil, err == io.EOF:
+			return n, err
+		case r.ctx.Err() != nil:
+			return n, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		case r.resumes >= maxResumes:
+			return n, Errorf(rio.ErrWarehouseUnavailable, "download from warehouse %s broke after %d bytes, and %d resumes: %s", r.addr, r.offset, r.resumes, err)
+		}
+		// Broken mid-body.  Hand back what we got, if anything, and pick up where it ended.
+		r.body.Close()
+		r.resumes++
+		if err := r.get(false); err != nil {
+			r.body = eofReader{}
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// Stands in for the body after a failed resume, so Close stays safe.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+func (eofReader) Close() error             { return nil }
+
 func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
 	return nil, Errorf(rio.ErrUsage, "http warehouses are readonly!")
 }
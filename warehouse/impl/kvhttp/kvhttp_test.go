@@ -0,0 +1,296 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+func TestKvhttp(t *testing.T) {
+	Convey("kvhttp warehouse:", t, func() {
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		var requests []*http.Request
+		var handler http.HandlerFunc
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req)
+			handler(w, req)
+		}))
+		defer srv.Close()
+		serve := func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		}
+		read := func(ctx context.Context, addr string) ([]byte, error) {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(ctx, wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+
+		Convey("content-addressed: should fetch from the chunked path", func() {
+			handler = serve
+			body, err := read(context.Background(), "ca+"+srv.URL+"/base")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, content)
+			So(requests[0].URL.Path, ShouldEqual, "/base/abc/def/abcdefghijklmnop")
+		})
+		Convey("a 404 should be ware-not-found", func() {
+			handler = http.NotFound
+			_, err := read(context.Background(), srv.URL)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("other codes should be warehouse-unavailable", func() {
+			handler = func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(503) }
+			_, err := read(context.Background(), srv.URL)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+		})
+		Convey("a cancelled context should stop the fetch", func() {
+			handler = serve
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := read(ctx, srv.URL)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+		})
+		Convey("the host's credentials should be sent", func() {
+			handler = serve
+			credsFile, err := ioutil.TempFile("", "rio-test-credentials")
+			So(err, ShouldBeNil)
+			defer os.Remove(credsFile.Name())
+			u, _ := url.Parse(srv.URL)
+			fmt.Fprintf(credsFile, `{"hosts": {%q: {"token": "tok"}}}`, u.Host)
+			credsFile.Close()
+			defer os.Setenv("RIO_CREDENTIALS_FILE", os.Getenv("RIO_CREDENTIALS_FILE"))
+			os.Setenv("RIO_CREDENTIALS_FILE", credsFile.Name())
+			_, err = read(context.Background(), srv.URL)
+			So(err, ShouldBeNil)
+			So(requests[0].Header.Get("Authorization"), ShouldEqual, "Bearer tok")
+
+			Convey("unless the addr has its own", func() {
+				requests = nil
+				_, err = read(context.Background(), "http://me:pw@"+u.Host)
+				So(err, ShouldBeNil)
+				So(requests[0].Header.Get("Authorization"), ShouldEqual, "Basic bWU6cHc=")
+			})
+		})
+		Convey("the size of a ware should come from a HEAD request", func() {
+			handler = serve
+			whCtrl, err := NewController(api.WarehouseAddr(srv.URL))
+			So(err, ShouldBeNil)
+			size, err := whCtrl.(warehouse.BlobstoreSizeController).WareSize(context.Background(), wareID)
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, len(content))
+			So(requests[0].Method, ShouldEqual, "HEAD")
+
+			Convey("or be ware-not-found for a 404", func() {
+				handler = http.NotFound
+				_, err := whCtrl.(warehouse.BlobstoreSizeController).WareSize(context.Background(), wareID)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+			})
+		})
+		Convey("a body cut off partway", func() {
+			// Claim the whole (remaining) length, send a bit, and hang up.
+			etag := `"v1"`
+			cutOff := func(w http.ResponseWriter, req *http.Request) {
+				var offset int
+				fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &offset)
+				if etag != "" {
+					w.Header().Set("ETag", etag)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)-offset))
+				if offset > 0 {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(content)-1, len(content)))
+					w.WriteHeader(206)
+				}
+				w.Write(content[offset : offset+len(content)/8])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			Convey("should resume with a range request", func() {
+				handler = func(w http.ResponseWriter, req *http.Request) {
+					if len(requests) == 1 {
+						cutOff(w, req)
+					}
+					serve(w, req)
+				}
+				body, err := read(context.Background(), srv.URL)
+				So(err, ShouldBeNil)
+				So(body, ShouldResemble, content)
+				So(requests, ShouldHaveLength, 2)
+				So(requests[1].Header.Get("Range"), ShouldEqual, "bytes="+strconv.Itoa(len(content)/8)+"-")
+				So(requests[1].Header.Get("If-Range"), ShouldEqual, `"v1"`)
+			})
+			Convey("should resume guarded by Last-Modified, if there's no ETag", func() {
+				etag = ""
+				modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+				handler = func(w http.ResponseWriter, req *http.Request) {
+					w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+					if len(requests) == 1 {
+						cutOff(w, req)
+					}
+					http.ServeContent(w, req, "", modTime, bytes.NewReader(content))
+				}
+				body, err := read(context.Background(), srv.URL)
+				So(err, ShouldBeNil)
+				So(body, ShouldResemble, content)
+				So(requests[1].Header.Get("If-Range"), ShouldEqual, modTime.Format(http.TimeFormat))
+			})
+			Convey("should fail if the server resumes from the wrong place", func() {
+				handler = func(w http.ResponseWriter, req *http.Request) {
+					if len(requests) == 1 {
+						cutOff(w, req)
+					}
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+					w.WriteHeader(206)
+					w.Write(content)
+				}
+				_, err := read(context.Background(), srv.URL)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+				So(err.Error(), ShouldContainSubstring, "wrong range")
+			})
+			Convey("should fail if the server won't do ranges", func() {
+				handler = func(w http.ResponseWriter, req *http.Request) {
+					if len(requests) == 1 {
+						cutOff(w, req)
+					}
+					w.Write(content)
+				}
+				_, err := read(context.Background(), srv.URL)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			})
+			Convey("should give up if it keeps breaking", func() {
+				handler = cutOff
+				_, err := read(context.Background(), srv.URL)
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+				So(requests, ShouldHaveLength, 1+maxResumes)
+			})
+		})
+	})
+}
+
+func TestKvhttpTLS(t *testing.T) {
+	Convey("kvhttp warehouse, over TLS:", t, func() {
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		certsDir, err := ioutil.TempDir("", "rio-test-certs")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(certsDir)
+		defer os.Setenv("RIO_TLS_CERTS_DIR", os.Getenv("RIO_TLS_CERTS_DIR"))
+		os.Setenv("RIO_TLS_CERTS_DIR", certsDir)
+
+		// A client cert (its own CA), and a server that insists on it.
+		clientCert, clientKey := selfSignedCert()
+		clientPool := x509.NewCertPool()
+		block, _ := pem.Decode(clientCert)
+		parsed, _ := x509.ParseCertificate(block.Bytes)
+		clientPool.AddCert(parsed)
+		// Each case gets a fresh server: clients are kept per host.
+		newServer := func() (*httptest.Server, string) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+			srv.StartTLS()
+			u, _ := url.Parse(srv.URL)
+			hostDir := filepath.Join(certsDir, u.Host)
+			So(os.Mkdir(hostDir, 0755), ShouldBeNil)
+			serverCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+			So(ioutil.WriteFile(filepath.Join(hostDir, "ca.crt"), serverCert, 0644), ShouldBeNil)
+			return srv, hostDir
+		}
+		read := func(addr string) ([]byte, error) {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			if err != nil {
+				return nil, err
+			}
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+
+		Convey("with the server's CA and a client cert in its dir, fetching should work", func() {
+			srv, hostDir := newServer()
+			defer srv.Close()
+			So(ioutil.WriteFile(filepath.Join(hostDir, "client.cert"), clientCert, 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(hostDir, "client.key"), clientKey, 0600), ShouldBeNil)
+			body, err := read(srv.URL)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "hello")
+		})
+		Convey("without a client cert, the server should refuse us", func() {
+			srv, _ := newServer()
+			defer srv.Close()
+			_, err := read(srv.URL)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+		})
+		Convey("a CA file that isn't one should be a usage error", func() {
+			srv, hostDir := newServer()
+			defer srv.Close()
+			So(ioutil.WriteFile(filepath.Join(hostDir, "ca.crt"), []byte("nope"), 0644), ShouldBeNil)
+			_, err := read(srv.URL)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+		})
+	})
+}
+
+// Make a throwaway certificate, and its key, PEM-encoded.
+func selfSignedCert() (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rio-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
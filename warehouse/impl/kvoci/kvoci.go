@@ -0,0 +1,508 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse in an OCI distribution registry (docker registry,
+	Harbor, GHCR, ECR, Artifactory, and so on): each ware is an artifact,
+	per the OCI artifacts guidance, of one layer that is the ware.
+
+	Addresses look like "oci://registry.example.com/team/wares:tag" (one
+	ware, at exactly that tag) or "ca+oci://registry.example.com/team/wares"
+	(content-addressed, each ware tagged after its WareID, e.g.
+	"tar-abcdefghij...").  Registries on loopback addresses are spoken to
+	over plain HTTP; all others, HTTPS (with TLS config from
+	config.GetTLSCertsPath, as for kvhttp).
+
+	Registries ask for credentials as they see fit.  Those listed for the
+	registry host (see the warehouse/credentials package) are used: a token
+	is sent as a bearer token as it is; a username and secret are used to
+	log in, or to get a token from the registry's auth service.  Without
+	any, only anonymous access is possible, as for reading public repos.
+
+	This speaks the distribution API directly: we need a handful of its
+	calls, and none of the rest.
+*/
+package kvoci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/credentials"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreSizeController  = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+/*
+	Wares larger than this are uploaded in chunks of this size;
+	smaller ones, in one request.
+*/
+var chunkSize int64 = 16 << 20
+
+const (
+	manifestType = "application/vnd.oci.image.manifest.v1+json"
+	artifactType = "application/vnd.polydawn.rio.ware.v1"
+	layerType    = artifactType + "." // and then the pack type.
+	emptyType    = "application/vnd.oci.empty.v1+json"
+	wareIDKey    = "net.polydawn.rio.ware-id" // annotation on the manifest.
+)
+
+// The config blob of every ware artifact: an empty JSON object, as the artifacts guidance says.
+var emptyConfig = []byte("{}")
+
+// What names and tags may look like, per the distribution spec.
+var (
+	repoPattern = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+type Controller struct {
+	addr     api.WarehouseAddr // user's string retained for messages
+	base     *url.URL          // the repository's root in the API, e.g. "https://host/v2/team/wares/".
+	repo     string
+	tag      string // the tag in single-ware mode; empty in CA mode.
+	ctntAddr bool
+	auth     *auth
+	client   *http.Client
+}
+
+// The artifact manifest, and the descriptors in it.  (Only what we use of them.)
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+/*
+	Initialize a new warehouse controller that operates on a repository in
+	an OCI registry.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses, or unusable TLS or credentials config
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr: addr,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs; the host is the registry,
+	//     and the path the repository, and maybe a tag.
+	//  - We extract whether or not it's content-addressible mode here.
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "oci":
+	case "ca+oci":
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'oci' or 'ca+oci')", u.Scheme)
+	}
+	whCtrl.repo = strings.Trim(u.Path, "/")
+	if i := strings.LastIndexByte(whCtrl.repo, ':'); i > strings.LastIndexByte(whCtrl.repo, '/') {
+		whCtrl.repo, whCtrl.tag = whCtrl.repo[:i], whCtrl.repo[i+1:]
+	}
+	switch {
+	case u.Host == "" || !repoPattern.MatchString(whCtrl.repo):
+		return whCtrl, Errorf(rio.ErrUsage, "oci warehouse addr must name a registry and a repository, in lower case (e.g. 'oci://registry.example.com/team/wares:tag')")
+	case whCtrl.ctntAddr && whCtrl.tag != "":
+		return whCtrl, Errorf(rio.ErrUsage, "content-addressed oci warehouse addr must not name a tag: each ware is tagged after its ID")
+	case !whCtrl.ctntAddr && !tagPattern.MatchString(whCtrl.tag):
+		return whCtrl, Errorf(rio.ErrUsage, "oci warehouse addr must name a valid tag for the ware (e.g. 'oci://registry.example.com/team/wares:tag'), unless it's content-addressed ('ca+oci://')")
+	}
+
+	// Figure out where to talk to, and as whom.
+	whCtrl.base = &url.URL{Scheme: "https", Host: u.Host, Path: "/v2/" + whCtrl.repo + "/"}
+	if isLoopback(u.Hostname()) {
+		whCtrl.base.Scheme = "http"
+	}
+	whCtrl.client, err = util.HTTPClient(whCtrl.base)
+	if err != nil {
+		return whCtrl, err
+	}
+	cred, err := credentials.Lookup(u.Host)
+	if err != nil {
+		return whCtrl, err
+	}
+	whCtrl.auth = &auth{cred: cred}
+	if cred.Token != "" {
+		whCtrl.auth.header = "Bearer " + cred.Token
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's as costly as just starting the actual download.
+
+	return whCtrl, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The tag the ware is (or would be) at.  Some WareIDs make no valid tag.
+func (whCtrl Controller) wareTag(wareID api.WareID) (string, bool) {
+	if !whCtrl.ctntAddr {
+		return whCtrl.tag, true
+	}
+	tag := fmt.Sprintf("%s-%s", wareID.Type, wareID.Hash)
+	return tag, tagPattern.MatchString(tag)
+}
+
+// The URL of something in the repository, e.g. "manifests/tag".
+func (whCtrl Controller) apiUrl(pth string) string {
+	return whCtrl.base.String() + pth
+}
+
+/*
+	Fetch the manifest of the ware's artifact, and return the descriptor
+	of the ware in it.
+
+	Errors are as for OpenReader.
+*/
+func (whCtrl Controller) wareLayer(ctx context.Context, wareID api.WareID) (descriptor, error) {
+	tag, ok := whCtrl.wareTag(wareID)
+	if !ok {
+		return descriptor{}, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s (its ID makes no valid tag)", wareID, whCtrl.addr)
+	}
+	resp, err := whCtrl.do(ctx, "GET", whCtrl.apiUrl("manifests/"+tag), http.Header{"Accept": {manifestType}}, nil, 0, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return descriptor{}, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		// pass
+	case 404:
+		// Registries make repositories on first push, so one that's not there is just empty.
+		resp.Body.Close()
+		return descriptor{}, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return descriptor{}, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, readRegError(resp))
+	}
+	defer resp.Body.Close()
+	var m manifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&m); err != nil {
+		if ctx.Err() != nil {
+			return descriptor{}, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return descriptor{}, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: unparsable manifest: %s", wareID, whCtrl.addr, err)
+	}
+	if m.ArtifactType != artifactType || len(m.Layers) != 1 {
+		return descriptor{}, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s (what's at tag %q is not a ware)", wareID, whCtrl.addr, tag)
+	}
+	return m.Layers[0], nil
+}
+
+/*
+	Open a reader for the ware: its manifest is fetched, then the layer
+	in it.  The body is streamed, not buffered; the requests (and every
+	read after them) are bound to the context.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if there's no such tag, or it's not a ware
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, denied access, and so on
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in, with a ranged
+	GET of the layer.  An offset past the end, or a registry that won't do
+	ranges, starts from zero instead; `start` reports where the stream
+	actually begins.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	layer, err := whCtrl.wareLayer(ctx, wareID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset >= layer.Size {
+		offset = 0
+	}
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := whCtrl.do(ctx, "GET", whCtrl.apiUrl("blobs/"+layer.Digest), header, nil, 0, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return &bodyReader{ctx, resp.Body}, 0, nil
+	case 206:
+		return &bodyReader{ctx, resp.Body}, offset, nil
+	default:
+		// The manifest's there, so the blob should be; if it's not, that's the registry's problem.
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, readRegError(resp))
+	}
+}
+
+/*
+	Report the size of the ware, from its manifest.
+	Errors are as for OpenReader.
+*/
+func (whCtrl Controller) WareSize(ctx context.Context, wareID api.WareID) (int64, error) {
+	layer, err := whCtrl.wareLayer(ctx, wareID)
+	if err != nil {
+		return 0, err
+	}
+	return layer.Size, nil
+}
+
+// Reports read errors caused by cancellation as such.
+type bodyReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *bodyReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		return n, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	}
+	return n, err
+}
+
+/*
+	Open a writer for a ware.
+
+	Nothing is sent to the registry until commit -- since the tag is the
+	hash, we can't know it sooner -- so the data is staged in a local temp
+	file, and its digest taken on the way.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc := &WriteController{whCtrl: whCtrl, hasher: sha256.New()}
+	file, err := ioutil.TempFile("", ".tmp.upload.oci.")
+	if err != nil {
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	wc.stream = file
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	stream *os.File   // Write to this.  (Local staging; removed on close.)
+	hasher hash.Hash  // Sees everything written, for the layer's digest.
+	whCtrl Controller // Needed for the final upload.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	n, err := wc.stream.Write(bs)
+	wc.hasher.Write(bs[:n])
+	return n, err
+}
+
+/*
+	Cancel the current write.  Close the stream, and remove the staging file.
+*/
+func (wc *WriteController) Close() error {
+	wc.stream.Close()
+	if err := os.Remove(wc.stream.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash, uploading it.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	The layer and config blobs go up first (unless the registry has them
+	already), and then the manifest, which is what makes the ware appear
+	at its tag.  Should an upload fail partway, it's cancelled.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	whCtrl := wc.whCtrl
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+	tag, ok := whCtrl.wareTag(wareID)
+	if !ok {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: ware %s's ID makes no valid tag", what, wareID)
+	}
+	size, err := wc.stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		ArtifactType:  artifactType,
+		Config:        descriptor{emptyType, digestOf(emptyConfig), int64(len(emptyConfig))},
+		Layers:        []descriptor{{layerType + string(wareID.Type), "sha256:" + hex.EncodeToString(wc.hasher.Sum(nil)), size}},
+		Annotations:   map[string]string{wareIDKey: wareID.String()},
+	}
+	if err := wc.pushBlob(m.Layers[0], wc.stream); err != nil {
+		return err
+	}
+	if err := wc.pushBlob(m.Config, bytes.NewReader(emptyConfig)); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(m)
+	resp, err := whCtrl.do(context.Background(), "PUT", whCtrl.apiUrl("manifests/"+tag), http.Header{"Content-Type": {manifestType}}, func() io.Reader { return bytes.NewReader(body) }, int64(len(body)), rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 201 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readRegError(resp))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+/*
+	Upload a blob, unless the registry has it already: in one request if
+	it's no bigger than chunkSize, and otherwise in chunks of that size.
+*/
+func (wc *WriteController) pushBlob(desc descriptor, src io.ReaderAt) error {
+	whCtrl := wc.whCtrl
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+	ctx := context.Background()
+	resp, err := whCtrl.do(ctx, "HEAD", whCtrl.apiUrl("blobs/"+desc.Digest), nil, nil, 0, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil
+	}
+
+	// Start an upload.  Each response says where the next request goes.
+	resp, err = whCtrl.do(ctx, "POST", whCtrl.apiUrl("blobs/uploads/"), nil, nil, 0, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 202 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readRegError(resp))
+	}
+	resp.Body.Close()
+	location, err := nextLocation(resp)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	section := func(offset, length int64) func() io.Reader {
+		return func() io.Reader {
+			if length == 0 {
+				return http.NoBody // so an empty blob is sent with a length, not chunked.
+			}
+			return io.NewSectionReader(src, offset, length)
+		}
+	}
+	octets := http.Header{"Content-Type": {"application/octet-stream"}}
+	var offset int64
+	if desc.Size > chunkSize {
+		for ; offset < desc.Size; offset += chunkSize {
+			length := chunkSize
+			if desc.Size-offset < length {
+				length = desc.Size - offset
+			}
+			header := http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+length-1)},
+			}
+			resp, err := whCtrl.do(ctx, "PATCH", location.String(), header, section(offset, length), length, rio.ErrWarehouseUnwritable)
+			if err != nil {
+				wc.cancelUpload(location)
+				return err
+			}
+			if resp.StatusCode != 202 {
+				wc.cancelUpload(location)
+				return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readRegError(resp))
+			}
+			resp.Body.Close()
+			next, err := nextLocation(resp)
+			if err != nil {
+				wc.cancelUpload(location)
+				return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+			}
+			location = next
+		}
+	}
+
+	// Finish it: with the rest of the blob (all of it, if it wasn't chunked), and its digest.
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+	resp, err = whCtrl.do(ctx, "PUT", location.String(), octets, section(offset, desc.Size-offset), desc.Size-offset, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		wc.cancelUpload(location)
+		return err
+	}
+	if resp.StatusCode != 201 {
+		wc.cancelUpload(location)
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readRegError(resp))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Where an upload goes next, from the response's `Location` (which may be relative).
+func nextLocation(resp *http.Response) (*url.URL, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, fmt.Errorf("registry did not say where to upload to")
+	}
+	return resp.Request.URL.Parse(loc)
+}
+
+// Drop an upload that won't be finished.  Best effort: registries expire them anyway.
+func (wc *WriteController) cancelUpload(location *url.URL) {
+	resp, err := wc.whCtrl.do(context.Background(), "DELETE", location.String(), nil, nil, 0, rio.ErrWarehouseUnwritable)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func digestOf(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
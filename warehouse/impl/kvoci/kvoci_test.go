@@ -0,0 +1,312 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvoci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Just enough of a registry to exercise the controller: repository
+	"team/wares", which wants a token from "/token", which wants "me:pw".
+*/
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   map[string][]byte
+	requests  []string
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+	fail := func(status int, code string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"errors": [{"code": %q, "message": "no"}]}`, code)
+	}
+	if req.URL.Path == "/token" {
+		if user, pw, _ := req.BasicAuth(); user != "me" || pw != "pw" {
+			fail(401, "UNAUTHORIZED")
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, "tok:"+req.URL.Query().Get("scope"))
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/team/wares/") {
+		fail(404, "NAME_UNKNOWN")
+		return
+	}
+	scope := "repository:team/wares:pull"
+	if req.Method != "GET" && req.Method != "HEAD" {
+		scope += ",push"
+	}
+	if req.Header.Get("Authorization") != "Bearer tok:"+scope {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake",scope=%q`, req.Host, scope))
+		fail(401, "UNAUTHORIZED")
+		return
+	}
+	pth := strings.TrimPrefix(req.URL.Path, "/v2/team/wares/")
+	body, _ := ioutil.ReadAll(req.Body)
+	switch {
+	case strings.HasPrefix(pth, "manifests/") && req.Method == "GET":
+		bs, ok := f.manifests[strings.TrimPrefix(pth, "manifests/")]
+		if !ok {
+			fail(404, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", manifestType)
+		w.Write(bs)
+	case strings.HasPrefix(pth, "manifests/") && req.Method == "PUT":
+		var m manifest
+		json.Unmarshal(body, &m)
+		for _, desc := range append(m.Layers, m.Config) {
+			if _, ok := f.blobs[desc.Digest]; !ok {
+				fail(400, "BLOB_UNKNOWN")
+				return
+			}
+		}
+		f.manifests[strings.TrimPrefix(pth, "manifests/")] = body
+		w.WriteHeader(201)
+	case strings.HasPrefix(pth, "blobs/uploads/") && req.Method == "POST":
+		id := fmt.Sprintf("up%d", len(f.requests))
+		f.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/team/wares/blobs/uploads/"+id+"?_state=0")
+		w.WriteHeader(202)
+	case strings.HasPrefix(pth, "blobs/uploads/"):
+		id := strings.TrimPrefix(pth, "blobs/uploads/")
+		bs, ok := f.uploads[id]
+		if !ok {
+			fail(404, "BLOB_UPLOAD_UNKNOWN")
+			return
+		}
+		switch req.Method {
+		case "PATCH":
+			var start, end int
+			fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+			if start != len(bs) || end != start+len(body)-1 {
+				fail(416, "BLOB_UPLOAD_INVALID")
+				return
+			}
+			f.uploads[id] = append(bs, body...)
+			w.Header().Set("Location", fmt.Sprintf("/v2/team/wares/blobs/uploads/%s?_state=%d", id, len(f.uploads[id])))
+			w.WriteHeader(202)
+		case "PUT":
+			bs = append(bs, body...)
+			digest := req.URL.Query().Get("digest")
+			if digestOf(bs) != digest {
+				fail(400, "DIGEST_INVALID")
+				return
+			}
+			delete(f.uploads, id)
+			f.blobs[digest] = bs
+			w.WriteHeader(201)
+		case "DELETE":
+			delete(f.uploads, id)
+			w.WriteHeader(204)
+		}
+	case strings.HasPrefix(pth, "blobs/"):
+		bs, ok := f.blobs[strings.TrimPrefix(pth, "blobs/")]
+		if !ok {
+			fail(404, "BLOB_UNKNOWN")
+			return
+		}
+		var start int
+		if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); n == 1 {
+			w.WriteHeader(206)
+			bs = bs[start:]
+		}
+		if req.Method == "GET" {
+			w.Write(bs)
+		}
+	default:
+		fail(400, "UNSUPPORTED")
+	}
+}
+
+func (f *fakeRegistry) count(request string) (n int) {
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, request) {
+			n++
+		}
+	}
+	return
+}
+
+func TestKvoci(t *testing.T) {
+	Convey("kvoci warehouse, against a fake registry:", t, func() {
+		fake := &fakeRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}, uploads: map[string][]byte{}}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL)
+		host := u.Host
+		credsFile, err := ioutil.TempFile("", "rio-test-credentials")
+		So(err, ShouldBeNil)
+		defer os.Remove(credsFile.Name())
+		fmt.Fprintf(credsFile, `{"hosts": {%q: {"username": "me", "secret": "pw"}}}`, host)
+		credsFile.Close()
+		defer os.Setenv("RIO_CREDENTIALS_FILE", os.Getenv("RIO_CREDENTIALS_FILE"))
+		os.Setenv("RIO_CREDENTIALS_FILE", credsFile.Name())
+		defer func(v int64) { chunkSize = v }(chunkSize)
+		chunkSize = 100
+
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		write := func(addr string, body []byte) error {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(body)
+			return wc.Commit(wareID)
+		}
+		read := func(addr string) ([]byte, error) {
+			whCtrl, err := NewController(api.WarehouseAddr(addr))
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+
+		Convey("a ware should go up as an artifact, tagged after its ID, and come back", func() {
+			So(write("ca+oci://"+host+"/team/wares", []byte("small")), ShouldBeNil)
+			So(fake.manifests, ShouldContainKey, "tar-abcdefghijklmnop")
+			var m manifest
+			So(json.Unmarshal(fake.manifests["tar-abcdefghijklmnop"], &m), ShouldBeNil)
+			So(m.ArtifactType, ShouldEqual, artifactType)
+			So(m.Annotations[wareIDKey], ShouldEqual, wareID.String())
+			So(m.Layers, ShouldResemble, []descriptor{{"application/vnd.polydawn.rio.ware.v1.tar", digestOf([]byte("small")), 5}})
+			So(fake.count("PATCH"), ShouldEqual, 0)
+			body, err := read("ca+oci://" + host + "/team/wares")
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "small")
+
+			Convey("and a blob the registry has already should not be sent again", func() {
+				fake.requests = nil
+				So(write("oci://"+host+"/team/wares:v1", []byte("small")), ShouldBeNil)
+				So(fake.count("POST"), ShouldEqual, 0)
+				So(fake.manifests, ShouldContainKey, "v1")
+			})
+		})
+		Convey("a large ware should go up in chunks", func() {
+			content := bytes.Repeat([]byte("0123456789"), 25)
+			So(write("oci://"+host+"/team/wares:v1", content), ShouldBeNil)
+			So(fake.count("PATCH"), ShouldEqual, 3)
+			body, err := read("oci://" + host + "/team/wares:v1")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, content)
+		})
+		Convey("an empty ware should go up too", func() {
+			So(write("oci://"+host+"/team/wares:v1", nil), ShouldBeNil)
+			body, err := read("oci://" + host + "/team/wares:v1")
+			So(err, ShouldBeNil)
+			So(body, ShouldBeEmpty)
+		})
+		Convey("an abandoned write should send nothing", func() {
+			whCtrl, err := NewController(api.WarehouseAddr("oci://" + host + "/team/wares:v1"))
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			wc.Write([]byte("half"))
+			So(wc.Close(), ShouldBeNil)
+			So(fake.requests, ShouldBeEmpty)
+		})
+		Convey("reads from an offset should use a ranged get, and sizes come from the manifest", func() {
+			So(write("oci://"+host+"/team/wares:v1", []byte("small")), ShouldBeNil)
+			whCtrl, err := NewController(api.WarehouseAddr("oci://" + host + "/team/wares:v1"))
+			So(err, ShouldBeNil)
+			for _, tr := range []struct {
+				offset, start int64
+				body          string
+			}{{2, 2, "all"}, {5, 0, "small"}} {
+				reader, start, err := whCtrl.(warehouse.BlobstoreRangeController).OpenReaderFrom(context.Background(), wareID, tr.offset)
+				So(err, ShouldBeNil)
+				body, err := ioutil.ReadAll(reader)
+				reader.Close()
+				So(err, ShouldBeNil)
+				So(start, ShouldEqual, tr.start)
+				So(string(body), ShouldEqual, tr.body)
+			}
+			size, err := whCtrl.(warehouse.BlobstoreSizeController).WareSize(context.Background(), wareID)
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, 5)
+		})
+		Convey("a missing tag, or a missing repository, should be ware-not-found", func() {
+			_, err := read("oci://" + host + "/team/wares:nope")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+			_, err = read("oci://" + host + "/team/other:v1")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("something at the tag that isn't a ware should be ware-not-found", func() {
+			fake.manifests["v1"] = []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "layers": []}`)
+			_, err := read("oci://" + host + "/team/wares:v1")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+			So(err.Error(), ShouldContainSubstring, "not a ware")
+		})
+		Convey("bad credentials should be warehouse-unavailable, or unwritable", func() {
+			ioutil.WriteFile(credsFile.Name(), []byte(fmt.Sprintf(`{"hosts": {%q: {"username": "me", "secret": "wrong"}}}`, host)), 0600)
+			_, err := read("oci://" + host + "/team/wares:v1")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "401")
+			err = write("oci://"+host+"/team/wares:v1", []byte("small"))
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+		})
+		Convey("a cancelled context should stop the fetch", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			whCtrl, err := NewController(api.WarehouseAddr("oci://" + host + "/team/wares:v1"))
+			So(err, ShouldBeNil)
+			_, err = whCtrl.OpenReader(ctx, wareID)
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrCancelled)
+		})
+		Convey("addrs without a repository, or a tag, are refused, unless content-addressed", func() {
+			for _, addr := range []string{
+				"oci://" + host,
+				"oci://" + host + "/team/wares",
+				"oci://" + host + "/Team/wares:v1",
+				"ca+oci://" + host + "/team/wares:v1",
+			} {
+				_, err := NewController(api.WarehouseAddr(addr))
+				So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			}
+			_, err := NewController(api.WarehouseAddr("ca+oci://" + host + "/team/wares"))
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("auth challenges should parse, quoted commas and all", t, func() {
+		scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/wares:pull,push"`)
+		So(scheme, ShouldEqual, "Bearer")
+		So(params, ShouldResemble, map[string]string{
+			"realm":   "https://auth.example.com/token",
+			"service": "registry.example.com",
+			"scope":   "repository:team/wares:pull,push",
+		})
+		scheme, params = parseChallenge(`Basic realm=registry`)
+		So(scheme, ShouldEqual, "Basic")
+		So(params, ShouldResemble, map[string]string{"realm": "registry"})
+	})
+}
@@ -0,0 +1,233 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvoci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse/credentials"
+)
+
+/*
+	How we authorize to a registry.  Registries say what they want when
+	they refuse a request: basic auth, or a bearer token from an auth
+	service, for some scope.  So nothing is sent until the first refusal;
+	after that, what it asked for is sent with every request (and the
+	token fetched again, when one runs out and is refused).
+
+	Shared by every copy of a controller.
+*/
+type auth struct {
+	cred credentials.Credential
+
+	mu     sync.Mutex
+	header string // the Authorization header to send; none until challenged.
+}
+
+func (a *auth) current() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.header
+}
+
+/*
+	Meet a challenge from a `WWW-Authenticate` header, so the next request
+	is authorized.  `scope` is what to ask for, if the challenge doesn't say.
+*/
+func (a *auth) answer(ctx context.Context, client *http.Client, challenge string, scope string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cred.Token != "" {
+		return fmt.Errorf("token refused")
+	}
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if a.cred.Username == "" {
+			return fmt.Errorf("registry wants a login, and there are no credentials for it")
+		}
+		a.header = "Basic " + base64.StdEncoding.EncodeToString([]byte(a.cred.Username+":"+a.cred.Secret))
+		return nil
+	case "bearer":
+		// pass
+	default:
+		return fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+
+	// Ask the auth service for a token: anonymously, if we've no credentials.
+	u, err := url.Parse(params["realm"])
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("unusable auth realm %q", params["realm"])
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		scope = params["scope"]
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if a.cred.Username != "" {
+		req.SetBasicAuth(a.cred.Username, a.cred.Secret)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("auth service %s refused: %s", u.Host, resp.Status)
+	}
+	var msg struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&msg); err != nil {
+		return fmt.Errorf("auth service %s answered with nonsense: %s", u.Host, err)
+	}
+	if msg.Token == "" {
+		msg.Token = msg.AccessToken
+	}
+	if msg.Token == "" {
+		return fmt.Errorf("auth service %s granted no token", u.Host)
+	}
+	a.header = "Bearer " + msg.Token
+	return nil
+}
+
+/*
+	Split a `WWW-Authenticate` header into its scheme and parameters,
+	e.g. `Bearer realm="https://auth.example.com/token",scope="repository:x:pull,push"`.
+	Values may be quoted, and quoted values may have commas in them.
+*/
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return scheme, params
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return scheme, params
+			}
+			val, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			val, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = val
+	}
+}
+
+/*
+	Issue a request to the registry, authorizing as it asks.  `body`, if
+	not nil, makes the request body (afresh for each try), of the given
+	length.  Requests of category `rio.ErrWarehouseUnwritable` ask for push
+	access; others, pull.
+
+	Errors are of the given category (or `rio.ErrCancelled`).
+*/
+func (whCtrl Controller) do(ctx context.Context, method string, u string, header http.Header, body func() io.Reader, length int64, category rio.ErrorCategory) (*http.Response, error) {
+	for try := 0; ; try++ {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = body()
+		}
+		req, err := http.NewRequest(method, u, bodyReader)
+		if err != nil {
+			return nil, Errorf(category, "failed to build request for warehouse %s: %s", whCtrl.addr, err)
+		}
+		req = req.WithContext(ctx)
+		req.ContentLength = length
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		if authz := whCtrl.auth.current(); authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		resp, err := whCtrl.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+			}
+			return nil, Errorf(category, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if resp.StatusCode != 401 || challenge == "" || try > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		scope := "repository:" + whCtrl.repo + ":pull"
+		if category == rio.ErrWarehouseUnwritable {
+			scope += ",push"
+		}
+		if err := whCtrl.auth.answer(ctx, whCtrl.client, challenge, scope); err != nil {
+			if ctx.Err() != nil {
+				return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+			}
+			return nil, Errorf(category, "cannot authenticate to warehouse %s: %s", whCtrl.addr, err)
+		}
+	}
+}
+
+/*
+	What the registry says went wrong: the errors in a JSON body (for all
+	but HEAD requests), per the distribution spec.
+	Reading it closes the response body.
+*/
+type regError struct {
+	Status string `json:"-"`
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func readRegError(resp *http.Response) (regerr regError) {
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(bs, &regerr)
+	regerr.Status = resp.Status
+	return
+}
+
+func (e regError) String() string {
+	if len(e.Errors) == 0 {
+		return "unexpected HTTP code: " + e.Status
+	}
+	return fmt.Sprintf("%s (%s: %s)", e.Status, e.Errors[0].Code, e.Errors[0].Message)
+}
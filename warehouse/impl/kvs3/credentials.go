@@ -0,0 +1,292 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvs3
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+/*
+	Find credentials and region the way the AWS tools do:
+
+	  - `AWS_ACCESS_KEY_ID`, `AWS_SECRET_ACCESS_KEY`, and `AWS_SESSION_TOKEN`;
+	  - else the `AWS_PROFILE` (or "default") section of the shared credentials
+	    file (`AWS_SHARED_CREDENTIALS_FILE`, or "~/.aws/credentials");
+	  - else the profile's `credential_process`, in either file;
+	  - else the container's credentials, if we're in an ECS task (or
+	    anything else that sets `AWS_CONTAINER_CREDENTIALS_RELATIVE_URI` or
+	    `AWS_CONTAINER_CREDENTIALS_FULL_URI`);
+	  - else the instance's role, from the EC2 instance metadata service
+	    (unless `AWS_EC2_METADATA_DISABLED` is "true");
+	  - the region from `AWS_REGION`, `AWS_DEFAULT_REGION`, or the profile
+	    in the shared config file (`AWS_CONFIG_FILE`, or "~/.aws/config");
+	    and "us-east-1" failing all that.
+
+	SSO and web identity tokens are not consulted.
+	Finding no credentials at all is not an error: requests go anonymous.
+*/
+func loadCredentials() (creds credentials, region string) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+
+	// The config file, unlike the credentials file, says "profile x" for all but the default.
+	configPath := os.Getenv("AWS_CONFIG_FILE")
+	if configPath == "" {
+		configPath = filepath.Join(home, ".aws", "config")
+	}
+	configName := profile
+	if configName != "default" {
+		configName = "profile " + configName
+	}
+	config := readIniSection(configPath, configName)
+
+	creds = credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey == "" {
+		pth := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if pth == "" {
+			pth = filepath.Join(home, ".aws", "credentials")
+		}
+		sect := readIniSection(pth, profile)
+		creds = credentials{
+			accessKey:    sect["aws_access_key_id"],
+			secretKey:    sect["aws_secret_access_key"],
+			sessionToken: sect["aws_session_token"],
+		}
+		if creds.accessKey == "" {
+			process := sect["credential_process"]
+			if process == "" {
+				process = config["credential_process"]
+			}
+			if process != "" {
+				creds = processCredentials(process)
+			}
+		}
+	}
+	if creds.accessKey == "" {
+		creds = remoteCredentials()
+	}
+
+	region = os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = config["region"]
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return
+}
+
+/*
+	Run a `credential_process` command, and parse what it prints.
+	A command that fails, or prints nonsense, yields no credentials.
+*/
+func processCredentials(command string) credentials {
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		return credentials{}
+	}
+	var msg struct {
+		Version         int
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+	}
+	if json.Unmarshal(out, &msg) != nil || msg.Version != 1 {
+		return credentials{}
+	}
+	return credentials{msg.AccessKeyId, msg.SecretAccessKey, msg.SessionToken}
+}
+
+/*
+	Credentials from the container or instance we're running on are
+	fetched over the network, so they're kept for as long as they're good
+	(less a few minutes' margin), and so is finding there are none.
+*/
+var remoteCache struct {
+	sync.Mutex
+	fetched bool
+	creds   credentials
+	expires time.Time
+}
+
+// Metadata services answer fast, if they're there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+func remoteCredentials() credentials {
+	remoteCache.Lock()
+	defer remoteCache.Unlock()
+	if remoteCache.fetched && (remoteCache.expires.IsZero() || time.Now().Add(5*time.Minute).Before(remoteCache.expires)) {
+		return remoteCache.creds
+	}
+	creds, expires := containerCredentials()
+	if creds.accessKey == "" && os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		creds, expires = instanceCredentials()
+	}
+	remoteCache.fetched, remoteCache.creds, remoteCache.expires = true, creds, expires
+	return creds
+}
+
+// What both the container and instance metadata services answer with.
+type remoteCredentialsMsg struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (msg remoteCredentialsMsg) credentials() (credentials, time.Time) {
+	return credentials{msg.AccessKeyId, msg.SecretAccessKey, msg.Token}, msg.Expiration
+}
+
+/*
+	Fetch credentials from the container credentials endpoint, as ECS
+	provides, authorizing with `AWS_CONTAINER_AUTHORIZATION_TOKEN` (or the
+	contents of `AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE`) if set.
+*/
+func containerCredentials() (credentials, time.Time) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	if u == "" {
+		return credentials{}, time.Time{}
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return credentials{}, time.Time{}
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if pth := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); pth != "" {
+		bs, _ := ioutil.ReadFile(pth)
+		token = strings.TrimSpace(string(bs))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var msg remoteCredentialsMsg
+	if metadataGet(req, &msg) != nil {
+		return credentials{}, time.Time{}
+	}
+	return msg.credentials()
+}
+
+/*
+	Fetch the instance role's credentials from the EC2 instance metadata
+	service (IMDSv2: a session token first, then the role, then its
+	credentials).  `AWS_EC2_METADATA_SERVICE_ENDPOINT` overrides where it is.
+*/
+func instanceCredentials() (credentials, time.Time) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	req, _ := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	var token string
+	if metadataGet(req, &token) != nil {
+		return credentials{}, time.Time{}
+	}
+	get := func(pth string, v interface{}) error {
+		req, _ := http.NewRequest("GET", endpoint+pth, nil)
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return metadataGet(req, v)
+	}
+	var roles string
+	if get("/latest/meta-data/iam/security-credentials/", &roles) != nil {
+		return credentials{}, time.Time{}
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return credentials{}, time.Time{}
+	}
+	var msg remoteCredentialsMsg
+	if get("/latest/meta-data/iam/security-credentials/"+role, &msg) != nil {
+		return credentials{}, time.Time{}
+	}
+	return msg.credentials()
+}
+
+/*
+	Do a request to a metadata service, and read the answer into v:
+	a string gets the body as is; anything else, the body as JSON.
+*/
+func metadataGet(req *http.Request, v interface{}) error {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("metadata service: %s", resp.Status)
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if s, ok := v.(*string); ok {
+		*s = string(bs)
+		return nil
+	}
+	return json.Unmarshal(bs, v)
+}
+
+/*
+	Return the keys and values in one section of an ini-style file.
+	A missing file or section just yields an empty map.
+*/
+func readIniSection(pth string, section string) map[string]string {
+	vals := map[string]string{}
+	f, err := os.Open(pth)
+	if err != nil {
+		return vals
+	}
+	defer f.Close()
+	var in bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			in = strings.TrimSpace(line[1:len(line)-1]) == section
+		case in:
+			if i := strings.IndexByte(line, '='); i > 0 {
+				vals[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return vals
+}
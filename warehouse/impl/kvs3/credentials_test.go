@@ -0,0 +1,111 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvs3
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	Convey("loading credentials:", t, func() {
+		tmpDir, err := ioutil.TempDir("", "kvs3-creds")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpDir)
+		// Unset everything that could find real credentials; each case sets what it uses.
+		for _, k := range []string{
+			"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION",
+			"AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE",
+			"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+			"AWS_EC2_METADATA_DISABLED", "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+		} {
+			defer os.Setenv(k, os.Getenv(k))
+			os.Unsetenv(k)
+		}
+		os.Setenv("AWS_SHARED_CREDENTIALS_FILE", tmpDir+"/credentials")
+		os.Setenv("AWS_CONFIG_FILE", tmpDir+"/config")
+		os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+		resetRemoteCache := func() { remoteCache.fetched = false }
+		resetRemoteCache()
+		defer resetRemoteCache()
+		expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+		Convey("the profile's credential_process should be run, and its region used", func() {
+			So(ioutil.WriteFile(tmpDir+"/config", []byte(
+				"[profile ci]\n"+
+					"region = eu-west-3\n"+
+					`credential_process = echo '{"Version": 1, "AccessKeyId": "proc-id", "SecretAccessKey": "proc-secret"}'`+"\n",
+			), 0644), ShouldBeNil)
+			os.Setenv("AWS_PROFILE", "ci")
+			creds, region := loadCredentials()
+			So(creds, ShouldResemble, credentials{"proc-id", "proc-secret", ""})
+			So(region, ShouldEqual, "eu-west-3")
+		})
+		Convey("container credentials should be fetched, with the authorization token", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("Authorization") != "tok" {
+					w.WriteHeader(401)
+					return
+				}
+				fmt.Fprintf(w, `{"AccessKeyId": "ctr-id", "SecretAccessKey": "ctr-secret", "Token": "ctr-session", "Expiration": %q}`, expiration)
+			}))
+			defer srv.Close()
+			os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/creds")
+			os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "tok")
+			creds, region := loadCredentials()
+			So(creds, ShouldResemble, credentials{"ctr-id", "ctr-secret", "ctr-session"})
+			So(region, ShouldEqual, "us-east-1")
+		})
+		Convey("instance credentials should be fetched with a session token, for the instance's role", func() {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requests++
+				switch {
+				case req.Method == "PUT" && req.URL.Path == "/latest/api/token":
+					w.Write([]byte("sess"))
+				case req.Header.Get("X-Aws-Ec2-Metadata-Token") != "sess":
+					w.WriteHeader(401)
+				case req.URL.Path == "/latest/meta-data/iam/security-credentials/":
+					w.Write([]byte("the-role"))
+				case req.URL.Path == "/latest/meta-data/iam/security-credentials/the-role":
+					fmt.Fprintf(w, `{"Code": "Success", "AccessKeyId": "ec2-id", "SecretAccessKey": "ec2-secret", "Token": "ec2-session", "Expiration": %q}`, expiration)
+				default:
+					w.WriteHeader(404)
+				}
+			}))
+			defer srv.Close()
+			os.Setenv("AWS_EC2_METADATA_DISABLED", "false")
+			os.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL)
+			creds, _ := loadCredentials()
+			So(creds, ShouldResemble, credentials{"ec2-id", "ec2-secret", "ec2-session"})
+
+			Convey("and kept, while they're good", func() {
+				creds, _ := loadCredentials()
+				So(creds, ShouldResemble, credentials{"ec2-id", "ec2-secret", "ec2-session"})
+				So(requests, ShouldEqual, 3)
+			})
+		})
+		Convey("env vars should come before all else", func() {
+			os.Setenv("AWS_ACCESS_KEY_ID", "env-id")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+			os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "http://127.0.0.1:1/nope")
+			creds, _ := loadCredentials()
+			So(creds, ShouldResemble, credentials{"env-id", "env-secret", ""})
+		})
+		Convey("finding nothing should go anonymous", func() {
+			creds, _ := loadCredentials()
+			So(creds, ShouldResemble, credentials{})
+		})
+	})
+}
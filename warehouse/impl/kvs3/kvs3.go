@@ -0,0 +1,450 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse in an S3 bucket (or anything speaking the S3 API,
+	like minio or localstack).
+
+	Addresses look like "s3://bucket/path/to/ware.tgz" (one ware, stored at
+	exactly that key) or "ca+s3://bucket/prefix" (content-addressed, each ware
+	at "prefix/abc/def/abcdefghij..." just as in kvfs).
+
+	Credentials and region come from the usual AWS credential chain: env
+	vars, shared files, and the container or instance metadata services
+	(see loadCredentials).  Credentials listed for the bucket (see the
+	warehouse/credentials package) come first, though: the username is the
+	access key ID, the secret its secret key, and a token, if any, the
+	session token.  To aim at some other S3 implementation,
+	set `AWS_ENDPOINT_URL_S3` (or `AWS_ENDPOINT_URL`); buckets are then
+	addressed path-style, as those usually want.
+
+	This speaks the S3 REST API directly, rather than via the AWS SDK:
+	we need a handful of its calls, and none of the rest.
+*/
+package kvs3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+	whcreds "go.polydawn.net/rio/warehouse/credentials"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+/*
+	Wares larger than this are uploaded in parts of this size.
+	(S3 refuses parts under 5MiB, save the last; and allows at most 10000.)
+*/
+var partSize int64 = 16 << 20
+
+type Controller struct {
+	addr      api.WarehouseAddr // user's string retained for messages
+	bucket    string
+	key       string // the object key in single-ware mode; the key prefix in CA mode.
+	ctntAddr  bool
+	endpoint  *url.URL
+	pathStyle bool
+	signer    signer
+	client    *http.Client
+}
+
+/*
+	Initialize a new warehouse controller that operates on an S3 bucket.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr: addr,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs; the host is the bucket.
+	//  - We extract whether or not it's content-addressible mode here;
+	//  - and extract the key (or key prefix).
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "s3":
+	case "ca+s3":
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 's3' or 'ca+s3')", u.Scheme)
+	}
+	whCtrl.bucket = u.Host
+	whCtrl.key = strings.Trim(u.Path, "/")
+	if whCtrl.bucket == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "s3 warehouse addr must name a bucket (e.g. 's3://bucket/path')")
+	}
+	if whCtrl.key == "" && !whCtrl.ctntAddr {
+		return whCtrl, Errorf(rio.ErrUsage, "s3 warehouse addr must name a key for the ware (e.g. 's3://bucket/path'), unless it's content-addressed ('ca+s3://')")
+	}
+
+	// Figure out where to talk to, and as whom.
+	creds, region := loadCredentials()
+	cred, err := whcreds.Lookup(whCtrl.bucket)
+	if err != nil {
+		return whCtrl, err
+	}
+	if cred.Username != "" {
+		creds = credentials{cred.Username, cred.Secret, cred.Token}
+	}
+	whCtrl.signer = signer{creds: creds, region: region, now: time.Now}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	} else {
+		whCtrl.pathStyle = true
+	}
+	whCtrl.endpoint, err = url.Parse(endpoint)
+	if err != nil || whCtrl.endpoint.Host == "" {
+		return whCtrl, Errorf(rio.ErrUsage, "invalid s3 endpoint url %q", endpoint)
+	}
+	whCtrl.client, err = util.HTTPClient(whCtrl.endpoint)
+	if err != nil {
+		return whCtrl, err
+	}
+
+	// Bucket names with dots don't fit the wildcard certs; those have to go path-style.
+	if strings.Contains(whCtrl.bucket, ".") {
+		whCtrl.pathStyle = true
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's as costly as just starting the actual download.
+
+	return whCtrl, nil
+}
+
+func (whCtrl Controller) objectKey(wareID api.WareID) string {
+	if !whCtrl.ctntAddr {
+		return whCtrl.key
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return path.Join(whCtrl.key, chunkA, chunkB, wareID.Hash)
+}
+
+/*
+	Issue a signed request for an object.
+	The body, if any, is sent with the given length and sha256.
+*/
+func (whCtrl Controller) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	u := *whCtrl.endpoint // copy: we mutate the path.
+	pth := "/" + key
+	if whCtrl.pathStyle {
+		pth = "/" + whCtrl.bucket + pth
+	} else {
+		u.Host = whCtrl.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + pth
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body == nil {
+		payloadHash = emptyPayloadHash
+	}
+	whCtrl.signer.sign(req, payloadHash)
+	return whCtrl.client.Do(req)
+}
+
+/*
+	What S3 says went wrong: it explains itself in an XML body.
+	Reading it closes the response body.
+*/
+type s3Error struct {
+	Status  string `xml:"-"`
+	Code    string
+	Message string
+}
+
+func readS3Error(resp *http.Response) (s3err s3Error) {
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(bs, &s3err)
+	s3err.Status = resp.Status
+	return
+}
+
+func (e s3Error) String() string {
+	if e.Code == "" {
+		return "unexpected HTTP code: " + e.Status
+	}
+	return fmt.Sprintf("%s (%s: %s)", e.Status, e.Code, e.Message)
+}
+
+/*
+	Open a reader for the ware.  The body is streamed, not buffered; the
+	request (and every read after it) is bound to the context.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if there's no such key
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, a missing bucket, denied access, and so on
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in, with a ranged
+	GET.  An offset past the end starts over from zero instead; `start`
+	reports where the stream actually begins.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := whCtrl.do(ctx, "GET", whCtrl.objectKey(wareID), nil, header, nil, 0, "")
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	switch resp.StatusCode {
+	case 200:
+		return &bodyReader{ctx, resp.Body}, 0, nil
+	case 206:
+		return &bodyReader{ctx, resp.Body}, offset, nil
+	case 416:
+		resp.Body.Close()
+		return whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	case 404:
+		// A missing bucket is also a 404; that's the warehouse missing, not the ware.
+		if s3err := readS3Error(resp); s3err.Code == "NoSuchBucket" {
+			return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s does not exist: %s", whCtrl.addr, s3err)
+		}
+		return nil, 0, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return nil, 0, Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, readS3Error(resp))
+	}
+}
+
+// Reports read errors caused by cancellation as such.
+type bodyReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *bodyReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		return n, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	}
+	return n, err
+}
+
+/*
+	Open a writer for a ware.
+
+	Nothing is sent to S3 until commit -- since the key is the hash, we
+	can't know it sooner -- so the data is staged in a local temp file.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc := &WriteController{whCtrl: whCtrl}
+	file, err := ioutil.TempFile("", ".tmp.upload.s3.")
+	if err != nil {
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	wc.stream = file
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	stream *os.File   // Write to this.  (Local staging; removed on close.)
+	whCtrl Controller // Needed for the final upload.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.stream.Write(bs)
+}
+
+/*
+	Cancel the current write.  Close the stream, and remove the staging file.
+*/
+func (wc *WriteController) Close() error {
+	wc.stream.Close()
+	if err := os.Remove(wc.stream.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash, uploading it.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	Wares no bigger than partSize go up in one request; larger ones as a
+	multipart upload, which is aborted if any part of it fails, so that
+	S3 doesn't keep (and bill for) the parts.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	size, err := wc.stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to commit to s3: %s", err)
+	}
+	key := wc.whCtrl.objectKey(wareID)
+	if size <= partSize {
+		return wc.putObject(key, size)
+	}
+	return wc.putMultipart(key, size)
+}
+
+func (wc *WriteController) putObject(key string, size int64) error {
+	resp, err := wc.sendSection(key, nil, 0, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (wc *WriteController) putMultipart(key string, size int64) error {
+	whCtrl := wc.whCtrl
+	ctx := context.Background()
+	what := fmt.Sprintf("failed to commit to warehouse %s", whCtrl.addr)
+
+	// Start the upload.
+	resp, err := whCtrl.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, nil, 0, "")
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	if resp.StatusCode != 200 {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readS3Error(resp))
+	}
+	var initiated struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadId == "" {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: could not start multipart upload: %v", what, err)
+	}
+	uploadID := initiated.UploadId
+
+	// From here on, any failure must clean up after itself.
+	abort := func(err error) error {
+		resp, abortErr := whCtrl.do(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, "")
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Send the parts.
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []part
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+partSize, n+1 {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		resp, err := wc.sendSection(key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}, offset, length)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, part{n, resp.Header.Get("ETag")})
+	}
+
+	// Stitch them together.
+	//  S3 may fail this with a 200 and an error in the body, because of course.
+	var buf bytes.Buffer
+	xml.NewEncoder(&buf).Encode(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []part
+	}{Part: parts})
+	body := buf.Bytes()
+	resp, err = whCtrl.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)), hashHex(body))
+	if err != nil {
+		return abort(Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err))
+	}
+	if resp.StatusCode != 200 {
+		return abort(Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readS3Error(resp)))
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err == nil {
+		err = xml.Unmarshal(bs, &result)
+	}
+	if err != nil || result.XMLName.Local != "CompleteMultipartUploadResult" {
+		return abort(Errorf(rio.ErrWarehouseUnwritable, "%s: could not complete multipart upload: %v (%s: %s)", what, err, result.Code, result.Message))
+	}
+	return nil
+}
+
+/*
+	PUT a section of the staging file to the key (with query params saying
+	which part it is, for a multipart upload), and check it was accepted.
+	The section is read twice: once to hash it for the signature, once to send.
+*/
+func (wc *WriteController) sendSection(key string, query url.Values, offset, length int64) (*http.Response, error) {
+	what := fmt.Sprintf("failed to commit to warehouse %s", wc.whCtrl.addr)
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(wc.stream, offset, length)); err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	resp, err := wc.whCtrl.do(context.Background(), "PUT", key, query, nil, io.NewSectionReader(wc.stream, offset, length), length, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, readS3Error(resp))
+	}
+	return resp, nil
+}
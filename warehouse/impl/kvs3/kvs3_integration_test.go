@@ -0,0 +1,72 @@
+//go:build s3integration
+// +build s3integration
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// Runs against a real S3 (or minio, or localstack).  For example:
+//
+//	docker run -d -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	# ...make a bucket "rio-test" in it, then:
+//	AWS_ENDPOINT_URL_S3=http://localhost:9000 AWS_ACCESS_KEY_ID=minio AWS_SECRET_ACCESS_KEY=minio123 \
+//	RIO_TEST_S3_WAREHOUSE=ca+s3://rio-test/wares go test -tags s3integration ./warehouse/impl/kvs3/
+
+package kvs3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/lib/guid"
+)
+
+func TestKvs3Integration(t *testing.T) {
+	addr := api.WarehouseAddr(os.Getenv("RIO_TEST_S3_WAREHOUSE"))
+	if addr == "" {
+		t.Skip("RIO_TEST_S3_WAREHOUSE not set")
+	}
+	Convey("kvs3 warehouse, against a real S3:", t, func() {
+		defer func(v int64) { partSize = v }(partSize)
+		partSize = 5 << 20 // the least S3 allows.
+		whCtrl, err := NewController(addr)
+		So(err, ShouldBeNil)
+		roundtrip := func(content []byte) {
+			wareID := api.WareID{"tar", guid.New()}
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(content)
+			So(wc.Commit(wareID), ShouldBeNil)
+
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			So(err, ShouldBeNil)
+			defer reader.Close()
+			body, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(body, content), ShouldBeTrue)
+		}
+
+		Convey("a small ware should roundtrip", func() {
+			roundtrip([]byte("small"))
+		})
+		Convey("a multipart ware should roundtrip", func() {
+			content := make([]byte, 11<<20) // three parts, the last short.
+			rand.Read(content)
+			roundtrip(content)
+		})
+		Convey("a missing ware should be not-found", func() {
+			_, err := whCtrl.OpenReader(context.Background(), api.WareID{"tar", guid.New()})
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+	})
+}
@@ -0,0 +1,155 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvs3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	AWS Signature Version 4, as much of it as S3 needs.
+
+	See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html --
+	in short: a canonical form of the request is hashed, and that hash is
+	signed with a key derived from the secret, the date, and the region.
+*/
+type signer struct {
+	creds  credentials
+	region string
+	now    func() time.Time
+}
+
+// The payload hash to use for requests with no body.
+var emptyPayloadHash = hashHex(nil)
+
+/*
+	Sign the request in place, by setting the `Authorization` header
+	(and the `X-Amz-*` headers it covers).
+
+	The request's query must already be in canonical form (see canonicalQuery),
+	so that what's signed is what's sent.
+	`payloadHash` is the hex sha256 of the body.
+
+	With no credentials, the request is left anonymous -- which is still
+	enough to read public buckets.
+*/
+func (s signer) sign(req *http.Request, payloadHash string) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.creds.accessKey == "" {
+		return
+	}
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.sessionToken)
+	}
+
+	// Host, plus the headers that change the meaning of the request.
+	//  The rest (user-agent and the like) are left unsigned, so that
+	//  proxies and the http client may touch them.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" || k == "content-md5" {
+			headers[k] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.creds.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+/*
+	Render query params the way sigv4 wants them: sorted, strictly
+	percent-encoded, and with "=" even for empty values.
+*/
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+/*
+	Percent-encode everything but the unreserved characters (and, if asked,
+	slashes).  This is stricter than net/url, and sigv4 requires exactly it.
+*/
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
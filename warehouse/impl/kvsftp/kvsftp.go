@@ -0,0 +1,564 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A blobstore warehouse on a file server reached over SSH, with SFTP.
+	The files are laid out just as kvfs lays them out on a local disk.
+
+	Addresses look like "ssh://user@host:port/path/to/ware.tgz" (one ware,
+	stored at exactly that path) or "ca+ssh://user@host/path" (content-
+	addressed, each ware at "path/abc/def/abcdefghij...").  The user and
+	port are optional.  Paths are absolute; to start from the login's
+	home dir instead, begin the path with "/~/".
+
+	There's no SSH implementation in the standard library, so this
+	warehouse runs `ssh` (and needs it on the path), asking for the sftp
+	subsystem; so keys, agents, known hosts, and ~/.ssh/config are all as
+	the user has them.  `RIO_SSH_COMMAND` replaces "ssh", as GIT_SSH_COMMAND
+	does for git: e.g. "ssh -i /path/to/key -o StrictHostKeyChecking=yes".
+	The server needs no shell, only sftp.
+
+	If the host has credentials listed (see the warehouse/credentials
+	package), its identity is the key ssh uses, and only that one; and its
+	username is who to log in as, if the addr doesn't say.
+
+	Each reader and writer has its own connection, for as long as it's open.
+*/
+package kvsftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/lib/guid"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/credentials"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.BlobstoreRangeController = Controller{}
+	_ warehouse.BlobstoreSizeController  = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+)
+
+// How many reads, or writes, are kept in flight at once.
+const window = 16
+
+type Controller struct {
+	addr     api.WarehouseAddr // user's string retained for messages
+	target   target
+	basePath string // on the server; relative paths are from the login's home.
+	ctntAddr bool
+}
+
+// Who to ssh to.
+type target struct {
+	user     string
+	host     string
+	port     string
+	identity string // a private key file to use, if not ssh's usual.
+}
+
+/*
+	Initialize a new warehouse controller that operates on a file server over SSH.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	// Stamp out a warehouse handle.
+	//  More values will be accumulated in shortly.
+	whCtrl := Controller{
+		addr: addr,
+	}
+
+	// Verify that the addr is sensible up front, and extract features.
+	//  - We parse things mostly like URLs; the host is who to ssh to.
+	//  - We extract whether or not it's content-addressible mode here;
+	//  - and extract the path on the server.
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "ssh":
+	case "ca+ssh":
+		whCtrl.ctntAddr = true
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'ssh' or 'ca+ssh')", u.Scheme)
+	}
+	whCtrl.target = target{host: u.Hostname(), port: u.Port()}
+	if u.User != nil {
+		whCtrl.target.user = u.User.Username()
+	}
+	if whCtrl.target.host == "" || strings.HasPrefix(whCtrl.target.host, "-") {
+		return whCtrl, Errorf(rio.ErrUsage, "ssh warehouse addr must name a host (e.g. 'ssh://user@host/path')")
+	}
+	cred, err := credentials.Lookup(u.Host)
+	if err != nil {
+		return whCtrl, err
+	}
+	if whCtrl.target.user == "" {
+		whCtrl.target.user = cred.Username
+	}
+	whCtrl.target.identity = cred.Identity
+	switch {
+	case u.Path == "/~" || strings.HasPrefix(u.Path, "/~/"):
+		whCtrl.basePath = path.Clean(strings.TrimPrefix(strings.TrimPrefix(u.Path, "/~"), "/"))
+	default:
+		whCtrl.basePath = path.Clean("/" + u.Path)
+	}
+	if !whCtrl.ctntAddr && (whCtrl.basePath == "/" || whCtrl.basePath == ".") {
+		return whCtrl, Errorf(rio.ErrUsage, "ssh warehouse addr must name a file for the ware (e.g. 'ssh://host/path'), unless it's content-addressed ('ca+ssh://')")
+	}
+
+	// We skip checking that the warehouse exists.
+	//  It's a whole ssh connection; we'll find out soon enough, from the actual transfer.
+
+	return whCtrl, nil
+}
+
+// Where the ware is (or would be) on the server.
+func (whCtrl Controller) warePath(wareID api.WareID) string {
+	if !whCtrl.ctntAddr {
+		return whCtrl.basePath
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return path.Join(whCtrl.basePath, chunkA, chunkB, wareID.Hash)
+}
+
+/*
+	The dir that must exist for there to be a warehouse at all: the base
+	path, in CA mode; otherwise the ware's parent, as in kvfs.
+*/
+func (whCtrl Controller) checkPath() string {
+	if !whCtrl.ctntAddr {
+		return path.Dir(whCtrl.basePath)
+	}
+	return whCtrl.basePath
+}
+
+/*
+	Connect, and start an SFTP session.  The context, if cancelled, kills the
+	connection.  Errors are of the given category (or `rio.ErrCancelled`).
+*/
+func (whCtrl Controller) connect(ctx context.Context, category rio.ErrorCategory) (*client, error) {
+	conn, err := dial(ctx, whCtrl.target)
+	if err != nil {
+		return nil, Errorf(category, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	c, err := newClient(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled: %s", err)
+		}
+		return nil, Errorf(category, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+	}
+	return c, nil
+}
+
+/*
+	Open a reader for the ware.  The file is read as it's consumed, a
+	window of reads ahead; the connection (and every read) is bound to
+	the context.
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if there's no such file
+	  - `rio.ErrWarehouseUnavailable` -- for connection failures, a missing warehouse, denied access, and so on
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (whCtrl Controller) OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error) {
+	r, _, err := whCtrl.OpenReaderFrom(ctx, wareID, 0)
+	return r, err
+}
+
+/*
+	Open a reader for the ware, starting `offset` bytes in.  An offset past
+	the end starts over from zero instead; `start` reports where the stream
+	actually begins.  Otherwise as OpenReader.
+*/
+func (whCtrl Controller) OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error) {
+	c, err := whCtrl.connect(ctx, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return nil, 0, err
+	}
+	handle, err := c.open(ctx, whCtrl.warePath(wareID), fxfRead, 0)
+	if err != nil {
+		defer c.Close()
+		return nil, 0, whCtrl.readErr(ctx, c, wareID, err)
+	}
+	size, err := c.size(ctx, fxpFstat, handle)
+	if err != nil {
+		defer c.Close()
+		return nil, 0, whCtrl.readErr(ctx, c, wareID, err)
+	}
+	if offset >= size {
+		offset = 0
+	}
+	return &fileReader{ctx: ctx, c: c, handle: handle, next: offset, size: size}, offset, nil
+}
+
+/*
+	Say how big the ware is, from the server's stat of it.
+	Errors as OpenReader.
+*/
+func (whCtrl Controller) WareSize(ctx context.Context, wareID api.WareID) (int64, error) {
+	c, err := whCtrl.connect(ctx, rio.ErrWarehouseUnavailable)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	size, err := c.size(ctx, fxpStat, whCtrl.warePath(wareID))
+	if err != nil {
+		return 0, whCtrl.readErr(ctx, c, wareID, err)
+	}
+	return size, nil
+}
+
+/*
+	Categorize an error reading the ware.  A missing file is only a missing
+	ware if the warehouse is there; so for that, we look.
+*/
+func (whCtrl Controller) readErr(ctx context.Context, c *client, wareID api.WareID, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	case isStatus(err, fxNoSuchFile):
+		if _, err := c.size(ctx, fxpStat, whCtrl.checkPath()); isStatus(err, fxNoSuchFile) {
+			return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s does not exist (%s)", whCtrl.addr, err)
+		}
+		return Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
+	default:
+		return Errorf(rio.ErrWarehouseUnavailable, "ware %s could not be retrieved from warehouse %s: %s", wareID, whCtrl.addr, err)
+	}
+}
+
+type fileReader struct {
+	ctx      context.Context
+	c        *client
+	handle   string
+	next     int64 // where the next read request will start.
+	size     int64
+	inflight []pendingRead
+	buf      []byte // what's been read, and not yet returned.
+}
+
+type pendingRead struct {
+	offset int64
+	length int
+	reply  <-chan response
+}
+
+func (r *fileReader) Read(bs []byte) (int, error) {
+	for len(r.buf) == 0 {
+		// Keep the window full.
+		for len(r.inflight) < window && r.next < r.size {
+			length := maxData
+			if r.size-r.next < int64(length) {
+				length = int(r.size - r.next)
+			}
+			ch, err := r.c.sendRead(r.handle, r.next, length)
+			if err != nil {
+				return 0, r.err(err)
+			}
+			r.inflight = append(r.inflight, pendingRead{r.next, length, ch})
+			r.next += int64(length)
+		}
+		if len(r.inflight) == 0 {
+			return 0, io.EOF
+		}
+		head := r.inflight[0]
+		r.inflight = r.inflight[1:]
+		resp, err := r.c.wait(r.ctx, head.reply)
+		if err != nil {
+			return 0, r.err(err)
+		}
+		switch resp.typ {
+		case fxpData:
+			data, err := resp.body.str()
+			if err != nil {
+				return 0, r.err(err)
+			}
+			r.buf = []byte(data)
+			// A short read leaves a gap before the reads after it: drop those, and ask again from here.
+			if len(data) < head.length {
+				r.next = head.offset + int64(len(data))
+				r.inflight = nil
+			}
+		default:
+			if err := resp.status(); isStatus(err, fxEOF) {
+				// The file got shorter than it was; there's no more.
+				r.size, r.inflight = head.offset, nil
+			} else {
+				return 0, r.err(err)
+			}
+		}
+	}
+	n := copy(bs, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *fileReader) err(err error) error {
+	if r.ctx.Err() != nil {
+		return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	}
+	return Errorf(rio.ErrWarehouseUnavailable, "error reading from warehouse: %s", err)
+}
+
+func (r *fileReader) Close() error {
+	r.c.closeHandle(r.ctx, r.handle)
+	return r.c.Close()
+}
+
+/*
+	Open a writer for a ware.
+
+	The data goes straight to a temp file on the server, beside where the
+	ware will go; commit renames it into place.
+*/
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	ctx := context.Background()
+	wc := &WriteController{whCtrl: whCtrl}
+	// Pick a random upload path.
+	if whCtrl.ctntAddr {
+		wc.stagePath = path.Join(whCtrl.basePath, ".tmp.upload."+guid.New())
+	} else {
+		// In non-CA mode, "base" path isn't really "base"; it's the final destination.
+		wc.stagePath = path.Join(path.Dir(whCtrl.basePath), ".tmp.upload."+path.Base(whCtrl.basePath)+"."+guid.New())
+	}
+	c, err := whCtrl.connect(ctx, rio.ErrWarehouseUnwritable)
+	if err != nil {
+		return wc, err
+	}
+	wc.c = c
+	wc.handle, err = c.open(ctx, wc.stagePath, fxfWrite|fxfCreat|fxfExcl, 0644)
+	if err != nil {
+		c.Close()
+		return wc, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space in warehouse: %s", err)
+	}
+	// Return the controller -- which has methods to either commit+close, or cancel+close.
+	return wc, nil
+}
+
+type WriteController struct {
+	whCtrl    Controller // Needed for the final move-into-place.
+	stagePath string     // Needed for the final move-into-place.
+	c         *client
+	handle    string // blank once closed.
+	offset    int64
+	inflight  []<-chan response
+	err       error // the first write to fail; every write after it fails too.
+	closed    bool
+}
+
+/*
+	Send the data, in pieces, without waiting for the server to say it has
+	each; only when the window is full do we wait for the oldest.
+*/
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	if wc.err != nil {
+		return 0, wc.err
+	}
+	for written := 0; written < len(bs); {
+		n := len(bs) - written
+		if n > maxData {
+			n = maxData
+		}
+		if len(wc.inflight) >= window {
+			if err := wc.waitWrite(); err != nil {
+				return written, err
+			}
+		}
+		ch, err := wc.c.sendWrite(wc.handle, wc.offset, bs[written:written+n])
+		if err != nil {
+			wc.err = Errorf(rio.ErrWarehouseUnwritable, "failed to write to warehouse: %s", err)
+			return written, wc.err
+		}
+		wc.inflight = append(wc.inflight, ch)
+		wc.offset += int64(n)
+		written += n
+	}
+	return len(bs), nil
+}
+
+func (wc *WriteController) waitWrite() error {
+	head := wc.inflight[0]
+	wc.inflight = wc.inflight[1:]
+	resp, err := wc.c.wait(context.Background(), head)
+	if err == nil {
+		err = resp.status()
+	}
+	if err != nil && wc.err == nil {
+		wc.err = Errorf(rio.ErrWarehouseUnwritable, "failed to write to warehouse: %s", err)
+	}
+	return wc.err
+}
+
+/*
+	Cancel the current write.  Close the connection, and remove the temp file.
+*/
+func (wc *WriteController) Close() error {
+	if wc.closed {
+		return nil
+	}
+	wc.closed = true
+	ctx := context.Background()
+	for len(wc.inflight) > 0 {
+		wc.waitWrite()
+	}
+	if wc.handle != "" {
+		wc.c.closeHandle(ctx, wc.handle)
+	}
+	err := wc.c.remove(ctx, wc.stagePath)
+	wc.c.Close()
+	if err != nil && !isStatus(err, fxNoSuchFile) {
+		return err
+	}
+	return nil
+}
+
+/*
+	Commit the current data as the given hash.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	ctx := context.Background()
+	what := fmt.Sprintf("failed to commit to warehouse %s", wc.whCtrl.addr)
+	// Wait for every write to land, and close the file.
+	for len(wc.inflight) > 0 {
+		wc.waitWrite()
+	}
+	if wc.err != nil {
+		return wc.err
+	}
+	err := wc.c.closeHandle(ctx, wc.handle)
+	wc.handle = ""
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+	}
+	// Make parent dirs if necessary in content-addr mode.
+	//  Mkdir failing is fine if the dir's there; the rename will say if it's not.
+	finalPath := wc.whCtrl.warePath(wareID)
+	if wc.whCtrl.ctntAddr {
+		wc.c.mkdir(ctx, path.Dir(path.Dir(finalPath)), 0755)
+		wc.c.mkdir(ctx, path.Dir(finalPath), 0755)
+	}
+	// Move into place.
+	//  Without posix-rename, a rename onto an existing file fails; in CA mode,
+	//  that's the same ware already there, which is as good as success.
+	if err := wc.c.rename(ctx, wc.stagePath, finalPath); err != nil {
+		if _, ok := wc.c.exts[extPosixRename]; ok || !wc.whCtrl.ctntAddr {
+			return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+		}
+		if _, statErr := wc.c.size(ctx, fxpStat, finalPath); statErr != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "%s: %s", what, err)
+		}
+	}
+	return nil
+}
+
+/*
+	Open a connection to the target's sftp subsystem.  A variable, so that
+	tests can connect to something else.
+*/
+var dial = dialSSH
+
+func dialSSH(ctx context.Context, t target) (io.ReadWriteCloser, error) {
+	argv := sshCommand(t)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &sshPipe{cmd: cmd, stdin: stdin, stdout: stdout}
+	cmd.Stderr = &p.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/*
+	The command to run for the connection: `RIO_SSH_COMMAND` (or "ssh"),
+	then the target (and its identity, if it has one), and the sftp subsystem.
+*/
+func sshCommand(t target) []string {
+	argv := strings.Fields(os.Getenv("RIO_SSH_COMMAND"))
+	if len(argv) == 0 {
+		argv = []string{"ssh"}
+	}
+	if t.port != "" {
+		argv = append(argv, "-p", t.port)
+	}
+	if t.user != "" {
+		argv = append(argv, "-l", t.user)
+	}
+	if t.identity != "" {
+		argv = append(argv, "-i", t.identity, "-o", "IdentitiesOnly=yes")
+	}
+	return append(argv, "-s", "--", t.host, "sftp")
+}
+
+/*
+	The ssh process's stdio, as one connection.  When its output ends,
+	reads say why it exited, stderr and all.
+*/
+type sshPipe struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   io.Reader
+	stderr   bytes.Buffer
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func (p *sshPipe) Read(bs []byte) (int, error) {
+	n, err := p.stdout.Read(bs)
+	if err == io.EOF {
+		if werr := p.wait(); werr != nil {
+			return n, fmt.Errorf("ssh: %s (stderr: %q)", werr, strings.TrimSpace(p.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (p *sshPipe) Write(bs []byte) (int, error) {
+	return p.stdin.Write(bs)
+}
+
+func (p *sshPipe) Close() error {
+	p.stdin.Close()
+	p.wait()
+	return nil
+}
+
+func (p *sshPipe) wait() error {
+	p.waitOnce.Do(func() {
+		p.waitErr = p.cmd.Wait()
+	})
+	return p.waitErr
+}
@@ -0,0 +1,364 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvsftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+/*
+	Just enough of an SFTP server to exercise the controller, serving a dir:
+	absolute paths are under root; relative ones, under root/home.
+*/
+type fakeSFTP struct {
+	root        string
+	posixRename bool // offer the posix-rename extension.
+	mu          sync.Mutex
+	sessions    int // how many the client has open.
+}
+
+func (f *fakeSFTP) dial(ctx context.Context, t target) (io.ReadWriteCloser, error) {
+	if t.host != "fileserver" {
+		return nil, fmt.Errorf("ssh: Could not resolve hostname %s", t.host)
+	}
+	client, server := net.Pipe()
+	f.mu.Lock()
+	f.sessions++
+	f.mu.Unlock()
+	go func() {
+		f.serve(server)
+		server.Close()
+	}()
+	return &fakeConn{client, f}, nil
+}
+
+// Counts itself closed as soon as the client closes it.
+type fakeConn struct {
+	net.Conn
+	f *fakeSFTP
+}
+
+func (c *fakeConn) Close() error {
+	c.f.mu.Lock()
+	c.f.sessions--
+	c.f.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (f *fakeSFTP) local(pth string) string {
+	if !strings.HasPrefix(pth, "/") {
+		pth = "/home/" + pth
+	}
+	return filepath.Join(f.root, filepath.FromSlash(pth))
+}
+
+func (f *fakeSFTP) serve(conn io.ReadWriter) {
+	handles := map[string]*os.File{}
+	defer func() {
+		for _, fh := range handles {
+			fh.Close()
+		}
+	}()
+	send := func(typ byte, p packet) {
+		hdr := packet{}.u32(uint32(len(p) + 1))
+		conn.Write(append(append(hdr, typ), p...))
+	}
+	for {
+		var hdr [5]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		body := make(reply, binary.BigEndian.Uint32(hdr[:4])-1)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		if hdr[4] == fxpInit {
+			p := packet{}.u32(3)
+			if f.posixRename {
+				p = p.str(extPosixRename).str("1")
+			}
+			send(fxpVersion, p)
+			continue
+		}
+		id, _ := body.u32()
+		status := func(err error) {
+			code := uint32(fxOK)
+			switch {
+			case err == io.EOF:
+				code = fxEOF
+			case os.IsNotExist(err):
+				code = fxNoSuchFile
+			case err != nil:
+				code = fxFailure
+			}
+			msg := ""
+			if err != nil {
+				msg = err.Error()
+			}
+			send(fxpStatus, packet{}.u32(id).u32(code).str(msg).str(""))
+		}
+		attrs := func(fi os.FileInfo, err error) {
+			if err != nil {
+				status(err)
+				return
+			}
+			send(fxpAttrs, packet{}.u32(id).u32(attrSize|attrPermissions).u64(uint64(fi.Size())).u32(uint32(fi.Mode().Perm())))
+		}
+		switch hdr[4] {
+		case fxpOpen:
+			pth, _ := body.str()
+			flags, _ := body.u32()
+			osFlags := os.O_RDONLY
+			if flags&fxfWrite != 0 {
+				osFlags = os.O_WRONLY
+			}
+			if flags&fxfCreat != 0 {
+				osFlags |= os.O_CREATE
+			}
+			if flags&fxfExcl != 0 {
+				osFlags |= os.O_EXCL
+			}
+			fh, err := os.OpenFile(f.local(pth), osFlags, 0644)
+			if err != nil {
+				status(err)
+				continue
+			}
+			handle := fmt.Sprintf("h%d", id)
+			handles[handle] = fh
+			send(fxpHandle, packet{}.u32(id).str(handle))
+		case fxpClose:
+			handle, _ := body.str()
+			fh, ok := handles[handle]
+			if !ok {
+				status(fmt.Errorf("no such handle"))
+				continue
+			}
+			delete(handles, handle)
+			status(fh.Close())
+		case fxpRead:
+			handle, _ := body.str()
+			offset, _ := body.u64()
+			length, _ := body.u32()
+			buf := make([]byte, length)
+			n, err := handles[handle].ReadAt(buf, int64(offset))
+			if n == 0 {
+				status(err)
+				continue
+			}
+			send(fxpData, packet{}.u32(id).str(string(buf[:n])))
+		case fxpWrite:
+			handle, _ := body.str()
+			offset, _ := body.u64()
+			data, _ := body.str()
+			_, err := handles[handle].WriteAt([]byte(data), int64(offset))
+			status(err)
+		case fxpFstat:
+			handle, _ := body.str()
+			attrs(handles[handle].Stat())
+		case fxpStat:
+			pth, _ := body.str()
+			attrs(os.Stat(f.local(pth)))
+		case fxpMkdir:
+			pth, _ := body.str()
+			status(os.Mkdir(f.local(pth), 0755))
+		case fxpRemove:
+			pth, _ := body.str()
+			status(os.Remove(f.local(pth)))
+		case fxpRename:
+			oldPth, _ := body.str()
+			newPth, _ := body.str()
+			if _, err := os.Lstat(f.local(newPth)); err == nil {
+				status(fmt.Errorf("file exists"))
+				continue
+			}
+			status(os.Rename(f.local(oldPth), f.local(newPth)))
+		case fxpExtended:
+			ext, _ := body.str()
+			oldPth, _ := body.str()
+			newPth, _ := body.str()
+			if ext != extPosixRename || !f.posixRename {
+				send(fxpStatus, packet{}.u32(id).u32(8).str("unsupported").str(""))
+				continue
+			}
+			status(os.Rename(f.local(oldPth), f.local(newPth)))
+		default:
+			send(fxpStatus, packet{}.u32(id).u32(8).str("unsupported").str(""))
+		}
+	}
+}
+
+func TestKvsftp(t *testing.T) {
+	Convey("kvsftp warehouse, against a fake SFTP server:", t, func() {
+		tmpDir, err := ioutil.TempDir("", "kvsftp")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpDir)
+		So(os.MkdirAll(tmpDir+"/srv/wares", 0755), ShouldBeNil)
+		So(os.MkdirAll(tmpDir+"/home/mine", 0755), ShouldBeNil)
+		fake := &fakeSFTP{root: tmpDir, posixRename: true}
+		defer func(d func(context.Context, target) (io.ReadWriteCloser, error)) { dial = d }(dial)
+		dial = fake.dial
+
+		wareID := api.WareID{"tar", "abcdefghijklmnop"}
+		write := func(addr api.WarehouseAddr, body []byte) error {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			defer wc.Close()
+			wc.Write(body)
+			return wc.Commit(wareID)
+		}
+		read := func(addr api.WarehouseAddr) ([]byte, error) {
+			whCtrl, err := NewController(addr)
+			So(err, ShouldBeNil)
+			reader, err := whCtrl.OpenReader(context.Background(), wareID)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+		// Everything in a dir, but the dirs themselves.
+		listFiles := func(dir string) (files []string) {
+			filepath.Walk(dir, func(pth string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() {
+					files = append(files, strings.TrimPrefix(pth, dir+"/"))
+				}
+				return nil
+			})
+			return
+		}
+
+		Convey("a ware should go in the kvfs layout, and come back out", func() {
+			So(write("ca+ssh://me@fileserver/srv/wares", []byte("small")), ShouldBeNil)
+			So(listFiles(tmpDir+"/srv/wares"), ShouldResemble, []string{"abc/def/abcdefghijklmnop"})
+			body, err := read("ca+ssh://me@fileserver/srv/wares")
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "small")
+			So(fake.sessions, ShouldEqual, 0)
+		})
+		Convey("a large ware should survive the pipelining both ways", func() {
+			var content []byte
+			for i := 0; len(content) < 1<<20; i++ {
+				content = append(content, fmt.Sprintf("%08d", i)...)
+			}
+			So(write("ssh://fileserver:2222/srv/wares/ware.tgz", content), ShouldBeNil)
+			body, err := read("ssh://fileserver:2222/srv/wares/ware.tgz")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(body, content), ShouldBeTrue)
+		})
+		Convey("paths under '/~/' should be from the home dir", func() {
+			So(write("ssh://fileserver/~/mine/ware.tgz", []byte("small")), ShouldBeNil)
+			So(listFiles(tmpDir+"/home/mine"), ShouldResemble, []string{"ware.tgz"})
+		})
+		Convey("writing a ware that's already there should be fine, even without posix-rename", func() {
+			fake.posixRename = false
+			So(write("ca+ssh://fileserver/srv/wares", []byte("small")), ShouldBeNil)
+			So(write("ca+ssh://fileserver/srv/wares", []byte("small")), ShouldBeNil)
+			So(listFiles(tmpDir+"/srv/wares"), ShouldResemble, []string{"abc/def/abcdefghijklmnop"})
+		})
+		Convey("an abandoned write should leave nothing behind", func() {
+			whCtrl, err := NewController("ca+ssh://fileserver/srv/wares")
+			So(err, ShouldBeNil)
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			wc.Write([]byte("half"))
+			So(wc.Close(), ShouldBeNil)
+			So(listFiles(tmpDir+"/srv/wares"), ShouldBeEmpty)
+			So(fake.sessions, ShouldEqual, 0)
+		})
+		Convey("reads from an offset should start there, or start over if past the end", func() {
+			So(write("ssh://fileserver/srv/wares/ware.tgz", []byte("small")), ShouldBeNil)
+			whCtrl, err := NewController("ssh://fileserver/srv/wares/ware.tgz")
+			So(err, ShouldBeNil)
+			for _, tr := range []struct {
+				offset, start int64
+				body          string
+			}{{2, 2, "all"}, {5, 0, "small"}} {
+				reader, start, err := whCtrl.(warehouse.BlobstoreRangeController).OpenReaderFrom(context.Background(), wareID, tr.offset)
+				So(err, ShouldBeNil)
+				body, err := ioutil.ReadAll(reader)
+				reader.Close()
+				So(err, ShouldBeNil)
+				So(start, ShouldEqual, tr.start)
+				So(string(body), ShouldEqual, tr.body)
+			}
+			size, err := whCtrl.(warehouse.BlobstoreSizeController).WareSize(context.Background(), wareID)
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, 5)
+		})
+		Convey("a missing file should be ware-not-found", func() {
+			_, err := read("ca+ssh://fileserver/srv/wares")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWareNotFound)
+		})
+		Convey("a missing dir should be warehouse-unavailable", func() {
+			_, err := read("ca+ssh://fileserver/srv/nope")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			_, err = read("ssh://fileserver/srv/nope/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+		})
+		Convey("a host that can't be reached should be warehouse-unavailable, or unwritable", func() {
+			_, err := read("ca+ssh://elsewhere/srv/wares")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnavailable)
+			So(err.Error(), ShouldContainSubstring, "Could not resolve hostname")
+			whCtrl, err := NewController("ca+ssh://elsewhere/srv/wares")
+			So(err, ShouldBeNil)
+			_, err = whCtrl.OpenWriter()
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrWarehouseUnwritable)
+		})
+		Convey("credentials listed for the host should give the user and identity", func() {
+			credsFile, err := ioutil.TempFile("", "rio-test-credentials")
+			So(err, ShouldBeNil)
+			defer os.Remove(credsFile.Name())
+			credsFile.WriteString(`{"hosts": {"fileserver:2222": {"username": "deploy", "identity": "/keys/deploy"}}}`)
+			credsFile.Close()
+			defer os.Setenv("RIO_CREDENTIALS_FILE", os.Getenv("RIO_CREDENTIALS_FILE"))
+			os.Setenv("RIO_CREDENTIALS_FILE", credsFile.Name())
+			whCtrl, err := NewController("ssh://fileserver:2222/srv/ware.tgz")
+			So(err, ShouldBeNil)
+			So(whCtrl.(Controller).target, ShouldResemble, target{"deploy", "fileserver", "2222", "/keys/deploy"})
+			whCtrl, err = NewController("ssh://me@fileserver:2222/srv/ware.tgz")
+			So(err, ShouldBeNil)
+			So(whCtrl.(Controller).target.user, ShouldEqual, "me")
+		})
+		Convey("addrs without a host, or a file, are refused, unless content-addressed", func() {
+			_, err := NewController("ssh:///srv/wares/ware.tgz")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("ssh://fileserver/")
+			So(err, errcat.ErrorShouldHaveCategory, rio.ErrUsage)
+			_, err = NewController("ca+ssh://fileserver/")
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("the ssh command should name the target, and ask for sftp", t, func() {
+		defer os.Setenv("RIO_SSH_COMMAND", os.Getenv("RIO_SSH_COMMAND"))
+		os.Unsetenv("RIO_SSH_COMMAND")
+		So(sshCommand(target{host: "fileserver"}), ShouldResemble, []string{"ssh", "-s", "--", "fileserver", "sftp"})
+		os.Setenv("RIO_SSH_COMMAND", "ssh -i /keys/ci")
+		So(sshCommand(target{"me", "fileserver", "2222", ""}), ShouldResemble,
+			[]string{"ssh", "-i", "/keys/ci", "-p", "2222", "-l", "me", "-s", "--", "fileserver", "sftp"})
+		os.Unsetenv("RIO_SSH_COMMAND")
+		So(sshCommand(target{"", "fileserver", "", "/keys/deploy"}), ShouldResemble,
+			[]string{"ssh", "-i", "/keys/deploy", "-o", "IdentitiesOnly=yes", "-s", "--", "fileserver", "sftp"})
+	})
+}
@@ -0,0 +1,401 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvsftp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+	Just enough of an SFTP client (protocol version 3, which is what
+	everything speaks) for reading and writing files, making dirs, and
+	renaming.  Requests may be in flight concurrently: replies are matched
+	to them by ID, so reads and writes can be pipelined.
+*/
+
+// Packet types.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpFstat    = 8
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Open flags.
+const (
+	fxfRead  = 0x01
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+	fxfExcl  = 0x20
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+)
+
+// Attribute flags.
+const (
+	attrSize        = 0x01
+	attrPermissions = 0x04
+)
+
+// How much is asked for in one read or write.  Every server takes this much.
+const maxData = 32 << 10
+
+// The largest reply we'll accept.  (Servers send at most 256KiB.)
+const maxPacket = 256<<10 + 1024
+
+const extPosixRename = "posix-rename@openssh.com"
+
+// A failure the server reported, with its status code.
+type statusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("sftp: status %d", e.code)
+	}
+	return "sftp: " + e.msg
+}
+
+func isStatus(err error, code uint32) bool {
+	serr, ok := err.(*statusError)
+	return ok && serr.code == code
+}
+
+// Packet building: each field appended in wire format.
+type packet []byte
+
+func (p packet) u32(v uint32) packet { return append(p, byte(v>>24), byte(v>>16), byte(v>>8), byte(v)) }
+func (p packet) u64(v uint64) packet { return p.u32(uint32(v >> 32)).u32(uint32(v)) }
+func (p packet) str(s string) packet { return append(p.u32(uint32(len(s))), s...) }
+
+// Packet parsing: each field consumed in turn; running short is an error.
+type reply []byte
+
+var errShortPacket = fmt.Errorf("sftp: malformed packet")
+
+func (r *reply) u32() (uint32, error) {
+	if len(*r) < 4 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, nil
+}
+
+func (r *reply) u64() (uint64, error) {
+	if len(*r) < 8 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, nil
+}
+
+func (r *reply) str() (string, error) {
+	n, err := r.u32()
+	if err != nil || uint32(len(*r)) < n {
+		return "", errShortPacket
+	}
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s, nil
+}
+
+// A reply to one request: its type, and the rest of it, after the ID.
+type response struct {
+	typ  byte
+	body reply
+}
+
+type client struct {
+	conn io.ReadWriteCloser
+	wmu  sync.Mutex // held while writing a packet.
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	exts    map[string]string // extensions the server offers.
+	done    chan struct{}     // closed when the connection fails (or is closed).
+	err     error             // why it did.
+}
+
+/*
+	Start an SFTP session over the connection: say hello, and start
+	reading replies.  The connection is the client's, now, to close.
+*/
+func newClient(conn io.ReadWriteCloser) (*client, error) {
+	c := &client{
+		conn:    conn,
+		pending: map[uint32]chan response{},
+		exts:    map[string]string{},
+		done:    make(chan struct{}),
+	}
+	if err := c.writePacket(fxpInit, packet{}.u32(3)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, body, err := c.readPacket()
+	if err == nil && typ != fxpVersion {
+		err = fmt.Errorf("sftp: unexpected reply to init (type %d)", typ)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := body.u32(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for len(body) > 0 {
+		name, err := body.str()
+		if err != nil {
+			break
+		}
+		data, _ := body.str()
+		c.exts[name] = data
+	}
+	go c.recvLoop()
+	return c, nil
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *client) writePacket(typ byte, payload packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	hdr := packet{}.u32(uint32(len(payload) + 1))
+	hdr = append(hdr, typ)
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *client) readPacket() (byte, reply, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: packet too large (%d bytes)", n)
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], body, nil
+}
+
+func (c *client) recvLoop() {
+	var err error
+	for {
+		var typ byte
+		var body reply
+		typ, body, err = c.readPacket()
+		if err != nil {
+			break
+		}
+		var id uint32
+		if id, err = body.u32(); err != nil {
+			break
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			err = fmt.Errorf("sftp: reply to unknown request %d", id)
+			break
+		}
+		ch <- response{typ, body}
+	}
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+}
+
+/*
+	Send a request, returning where its reply will arrive.
+	The payload is everything after the request ID.
+*/
+func (c *client) send(typ byte, payload packet) (<-chan response, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+	if err := c.writePacket(typ, append(packet{}.u32(id), payload...)); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Wait for a reply; or for the connection, or the context, to give out.
+func (c *client) wait(ctx context.Context, ch <-chan response) (response, error) {
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-c.done:
+		select {
+		case resp := <-ch: // it may have come in just before.
+			return resp, nil
+		default:
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.err == io.EOF {
+			return response{}, fmt.Errorf("sftp: connection closed")
+		}
+		return response{}, c.err
+	case <-ctx.Done():
+		return response{}, ctx.Err()
+	}
+}
+
+func (c *client) call(ctx context.Context, typ byte, payload packet) (response, error) {
+	ch, err := c.send(typ, payload)
+	if err != nil {
+		return response{}, err
+	}
+	return c.wait(ctx, ch)
+}
+
+// Interpret a reply that should be a status: nil if it's OK.
+func (resp response) status() error {
+	if resp.typ != fxpStatus {
+		return fmt.Errorf("sftp: unexpected reply (type %d)", resp.typ)
+	}
+	code, err := resp.body.u32()
+	if err != nil {
+		return err
+	}
+	if code == fxOK {
+		return nil
+	}
+	msg, _ := resp.body.str()
+	return &statusError{code, msg}
+}
+
+func (c *client) open(ctx context.Context, pth string, flags uint32, perm uint32) (string, error) {
+	resp, err := c.call(ctx, fxpOpen, packet{}.str(pth).u32(flags).u32(attrPermissions).u32(perm))
+	if err != nil {
+		return "", err
+	}
+	if resp.typ != fxpHandle {
+		return "", resp.status()
+	}
+	return resp.body.str()
+}
+
+func (c *client) closeHandle(ctx context.Context, handle string) error {
+	resp, err := c.call(ctx, fxpClose, packet{}.str(handle))
+	if err != nil {
+		return err
+	}
+	return resp.status()
+}
+
+// The size of what's at a path (or open handle, with fxpFstat).
+func (c *client) size(ctx context.Context, typ byte, pthOrHandle string) (int64, error) {
+	resp, err := c.call(ctx, typ, packet{}.str(pthOrHandle))
+	if err != nil {
+		return 0, err
+	}
+	if resp.typ != fxpAttrs {
+		return 0, resp.status()
+	}
+	flags, err := resp.body.u32()
+	if err != nil {
+		return 0, err
+	}
+	if flags&attrSize == 0 {
+		return 0, fmt.Errorf("sftp: server did not say the size")
+	}
+	size, err := resp.body.u64()
+	return int64(size), err
+}
+
+func (c *client) mkdir(ctx context.Context, pth string, perm uint32) error {
+	resp, err := c.call(ctx, fxpMkdir, packet{}.str(pth).u32(attrPermissions).u32(perm))
+	if err != nil {
+		return err
+	}
+	return resp.status()
+}
+
+func (c *client) remove(ctx context.Context, pth string) error {
+	resp, err := c.call(ctx, fxpRemove, packet{}.str(pth))
+	if err != nil {
+		return err
+	}
+	return resp.status()
+}
+
+/*
+	Rename, replacing anything at the new path, if the server can
+	(OpenSSH's posix-rename extension).  Otherwise, a plain rename, which
+	fails if the new path is taken.
+*/
+func (c *client) rename(ctx context.Context, oldPth, newPth string) error {
+	var resp response
+	var err error
+	if _, ok := c.exts[extPosixRename]; ok {
+		resp, err = c.call(ctx, fxpExtended, packet{}.str(extPosixRename).str(oldPth).str(newPth))
+	} else {
+		resp, err = c.call(ctx, fxpRename, packet{}.str(oldPth).str(newPth))
+	}
+	if err != nil {
+		return err
+	}
+	return resp.status()
+}
+
+// Ask for a read; the reply is data, or an EOF status.
+func (c *client) sendRead(handle string, offset int64, length int) (<-chan response, error) {
+	return c.send(fxpRead, packet{}.str(handle).u64(uint64(offset)).u32(uint32(length)))
+}
+
+func (c *client) sendWrite(handle string, offset int64, data []byte) (<-chan response, error) {
+	return c.send(fxpWrite, packet{}.str(handle).u64(uint64(offset)).str(string(data)))
+}
@@ -0,0 +1,133 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+)
+
+// Clients built so far, by host; kept so their connections get reused.
+var httpClients = struct {
+	sync.Mutex
+	m map[string]*http.Client
+}{m: map[string]*http.Client{}}
+
+/*
+	Return the HTTP client to use for the server at `u`: one trusting the
+	CAs, and presenting the client certificate, configured for its host
+	(see config.GetTLSCertsPath and config.GetTLSDefaultFiles).  If nothing
+	is configured, that's just http.DefaultClient.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- if the configured files can't be read, or don't parse
+*/
+func HTTPClient(u *url.URL) (*http.Client, error) {
+	httpClients.Lock()
+	defer httpClients.Unlock()
+	if client, ok := httpClients.m[u.Host]; ok {
+		return client, nil
+	}
+	tlsConfig, err := loadTLSConfig(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if tlsConfig != nil {
+		client = &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}}
+	}
+	httpClients.m[u.Host] = client
+	return client, nil
+}
+
+/*
+	Gather the TLS files for a host: from its dir under the certs path if
+	it has one, and otherwise the defaults.  Returns nil if there are none.
+*/
+func loadTLSConfig(host string) (*tls.Config, error) {
+	var caFiles []string
+	var certFile, keyFile string
+	dir := filepath.Join(config.GetTLSCertsPath().String(), host)
+	entries, err := ioutil.ReadDir(dir)
+	switch {
+	case err == nil:
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".crt") {
+				caFiles = append(caFiles, filepath.Join(dir, entry.Name()))
+			}
+		}
+		certFile, keyFile = filepath.Join(dir, "client.cert"), filepath.Join(dir, "client.key")
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			certFile, keyFile = "", ""
+		}
+	case os.IsNotExist(err):
+		var caFile string
+		caFile, certFile, keyFile, err = config.GetTLSDefaultFiles()
+		if err != nil {
+			return nil, err
+		}
+		if caFile != "" {
+			caFiles = []string{caFile}
+		}
+	default:
+		return nil, Errorf(rio.ErrUsage, "cannot read tls certs for %s: %s", host, err)
+	}
+	if len(caFiles) == 0 && certFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(caFiles) > 0 {
+		// Extra CAs are trusted on top of the system's, not instead of them.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range caFiles {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, Errorf(rio.ErrUsage, "cannot read tls certs for %s: %s", host, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, Errorf(rio.ErrUsage, "cannot use tls certs for %s: no certificates in %q", host, caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "cannot use tls client cert for %s: %s", host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -27,10 +27,47 @@ import (
 	packing format.
 */
 type BlobstoreController interface {
-	OpenReader(wareID api.WareID) (io.ReadCloser, error)
+	OpenReader(ctx context.Context, wareID api.WareID) (io.ReadCloser, error)
 	OpenWriter() (BlobstoreWriteController, error)
 }
 
+/*
+	Optionally implemented by BlobstoreControllers which can start reading
+	a ware partway in, as for resuming a fetch that was cut off.
+
+	The stream may not start where asked: if the warehouse can't serve
+	ranges (or the offset is past the end), it starts over from zero.
+	The returned `start` says which; the caller must check it.
+*/
+type BlobstoreRangeController interface {
+	OpenReaderFrom(ctx context.Context, wareID api.WareID, offset int64) (_ io.ReadCloser, start int64, _ error)
+}
+
+/*
+	Optionally implemented by BlobstoreControllers which can say how big a
+	ware is (in the bytes the warehouse stores, which may be compressed)
+	without reading it, as for checking there's room before a fetch.
+
+	Returns an error of category `rio.ErrWareNotFound` if the warehouse
+	doesn't have the ware, as OpenReader would.
+*/
+type BlobstoreSizeController interface {
+	WareSize(ctx context.Context, wareID api.WareID) (int64, error)
+}
+
+/*
+	Optionally implemented by BlobstoreControllers which can list the wares
+	they hold, as for checking every ware in a warehouse.
+
+	Only content-addressable warehouses can do this: the hash is what's in
+	the path.  Only the hash, though -- the packtype isn't stored anywhere --
+	so it's up to the caller to know what kind of wares it's listing.
+	Other warehouses return an error of category `rio.ErrUsage`.
+*/
+type BlobstoreListController interface {
+	ListHashes(ctx context.Context) ([]string, error)
+}
+
 /*
 	Blobstore-style warehouses return a "write controller", which is both
 	a simple `io.Writer`, and also carries a `Commit` function which must
@@ -62,6 +99,20 @@ func (NullBlobstoreWriteController) Write(bs []byte) (int, error)   { return len
 func (NullBlobstoreWriteController) Close() error                   { return nil }
 func (NullBlobstoreWriteController) Commit(wareID api.WareID) error { return nil }
 
+/*
+	A BlobstoreWriteController that writes straight through to a stream,
+	such as stdout.  There's nothing to commit, and nothing to take back
+	on close: whatever was written is already gone down the stream.
+	Closing the stream itself is up to whoever opened it.
+*/
+type StreamBlobstoreWriteController struct {
+	W io.Writer
+}
+
+func (wc StreamBlobstoreWriteController) Write(bs []byte) (int, error) { return wc.W.Write(bs) }
+func (StreamBlobstoreWriteController) Close() error                    { return nil }
+func (StreamBlobstoreWriteController) Commit(wareID api.WareID) error  { return nil }
+
 /*
 	A repository-style warehouse generally supports multiple versions of files
 	stored in a custom format. We generally won't _write_ to these repositories